@@ -37,8 +37,9 @@ var cmdUserList = &cobra.Command{
 }
 
 type userListOptions struct {
-	limit int
-	start string
+	limit        int
+	start        string
+	remoteSource string
 }
 
 var userListOpts userListOptions
@@ -48,6 +49,7 @@ func init() {
 
 	flags.IntVar(&userListOpts.limit, "limit", 10, "max number of runs to show")
 	flags.StringVar(&userListOpts.start, "start", "", "starting user name (excluded) to fetch")
+	flags.StringVar(&userListOpts.remoteSource, "remote-source", "", "only list the users with a linked account on this remote source")
 
 	cmdUser.AddCommand(cmdUserList)
 }
@@ -61,7 +63,13 @@ func printUsers(users []*gwapitypes.PrivateUserResponse) {
 func userList(cmd *cobra.Command, args []string) error {
 	gwclient := gwclient.NewClient(gatewayURL, token)
 
-	users, _, err := gwclient.GetUsers(context.TODO(), userListOpts.start, userListOpts.limit, false)
+	var users []*gwapitypes.PrivateUserResponse
+	var err error
+	if userListOpts.remoteSource != "" {
+		users, _, err = gwclient.GetRemoteSourceUsers(context.TODO(), userListOpts.remoteSource, userListOpts.start, userListOpts.limit, false)
+	} else {
+		users, _, err = gwclient.GetUsers(context.TODO(), userListOpts.start, userListOpts.limit, false)
+	}
 	if err != nil {
 		return errors.WithStack(err)
 	}
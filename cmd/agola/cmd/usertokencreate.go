@@ -17,6 +17,7 @@ package cmd
 import (
 	"context"
 	"fmt"
+	"time"
 
 	"agola.io/agola/internal/errors"
 	gwapitypes "agola.io/agola/services/gateway/api/types"
@@ -39,6 +40,8 @@ var cmdUserTokenCreate = &cobra.Command{
 type userTokenCreateOptions struct {
 	username  string
 	tokenName string
+	expiresIn time.Duration
+	scopes    []string
 }
 
 var userTokenCreateOpts userTokenCreateOptions
@@ -48,6 +51,8 @@ func init() {
 
 	flags.StringVarP(&userTokenCreateOpts.username, "username", "n", "", "user name")
 	flags.StringVarP(&userTokenCreateOpts.tokenName, "tokenname", "t", "", "token name")
+	flags.DurationVar(&userTokenCreateOpts.expiresIn, "expires-in", 0, "token time to live (i.e. 720h), the token never expires when not set")
+	flags.StringSliceVar(&userTokenCreateOpts.scopes, "scope", nil, "token scope (i.e. run:write), can be repeated. The token isn't restricted when not set")
 
 	if err := cmdUserTokenCreate.MarkFlagRequired("username"); err != nil {
 		log.Fatal().Err(err).Send()
@@ -64,6 +69,11 @@ func userTokenCreate(cmd *cobra.Command, args []string) error {
 
 	req := &gwapitypes.CreateUserTokenRequest{
 		TokenName: userTokenCreateOpts.tokenName,
+		Scopes:    userTokenCreateOpts.scopes,
+	}
+	if userTokenCreateOpts.expiresIn > 0 {
+		expiresAt := time.Now().Add(userTokenCreateOpts.expiresIn)
+		req.ExpiresAt = &expiresAt
 	}
 
 	log.Info().Msgf("creating token for user %q", userTokenCreateOpts.username)
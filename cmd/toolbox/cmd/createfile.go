@@ -33,6 +33,7 @@ var cmdCreateFile = &cobra.Command{
 
 type createFileOptions struct {
 	user string
+	path string
 }
 
 var createFileOpts createFileOptions
@@ -41,6 +42,7 @@ func init() {
 	flags := cmdCreateFile.PersistentFlags()
 
 	flags.StringVar(&createFileOpts.user, "user", "", "file owner")
+	flags.StringVar(&createFileOpts.path, "path", "", "file path, the file must not exist and is created readable only by its owner")
 
 	CmdToolbox.AddCommand(cmdCreateFile)
 }
@@ -67,7 +69,35 @@ func createFile(r io.Reader) (string, error) {
 	return filename, nil
 }
 
+// createFileAt writes the data read from r to a new file at path readable only
+// by its owner.
+func createFileAt(r io.Reader, path string) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0400)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if _, err := io.Copy(file, r); err != nil {
+		file.Close()
+		return errors.WithStack(err)
+	}
+
+	if err := file.Close(); err != nil {
+		return errors.WithStack(err)
+	}
+
+	return nil
+}
+
 func createFileRun(cmd *cobra.Command, args []string) {
+	if createFileOpts.path != "" {
+		if err := createFileAt(os.Stdin, createFileOpts.path); err != nil {
+			log.Fatalf("failed to write file: %v", err)
+		}
+		fmt.Fprint(os.Stdout, createFileOpts.path)
+		return
+	}
+
 	filename, err := createFile(os.Stdin)
 	if err != nil {
 		log.Fatalf("failed to write file: %v", err)
@@ -40,6 +40,7 @@ var cmdExec = &cobra.Command{
 type execOptions struct {
 	env        string
 	workingDir string
+	cleanEnv   bool
 }
 
 var execOpts execOptions
@@ -49,12 +50,17 @@ func init() {
 
 	flags.StringVarP(&execOpts.workingDir, "workingdir", "w", "", "working directory")
 	flags.StringVarP(&execOpts.env, "env", "e", "", "environment (as json object)")
+	flags.BoolVar(&execOpts.cleanEnv, "clean-env", false, "don't inherit the current environment, use only the provided one")
 
 	CmdToolbox.AddCommand(cmdExec)
 }
 
 func execRun(cmd *cobra.Command, args []string) {
 	env := os.Environ()
+	if execOpts.cleanEnv {
+		env = []string{}
+		os.Clearenv()
+	}
 	if execOpts.env != "" {
 		envmap := map[string]string{}
 		if err := json.Unmarshal([]byte(execOpts.env), &envmap); err != nil {
@@ -70,8 +76,12 @@ func execRun(cmd *cobra.Command, args []string) {
 	}
 
 	if execOpts.workingDir != "" {
+		// create the working dir if it doesn't exist
+		if err := os.MkdirAll(execOpts.workingDir, 0755); err != nil {
+			log.Fatalf("working dir %q doesn't exist and cannot be created: %v", execOpts.workingDir, err)
+		}
 		if err := os.Chdir(execOpts.workingDir); err != nil {
-			log.Fatalf("failed to change working dir to %q", execOpts.workingDir)
+			log.Fatalf("failed to change working dir to %q: %v", execOpts.workingDir, err)
 		}
 	}
 
@@ -16,6 +16,7 @@ package config
 
 import (
 	"io/ioutil"
+	"path/filepath"
 	"time"
 
 	"agola.io/agola/internal/errors"
@@ -121,8 +122,15 @@ type Executor struct {
 	Labels map[string]string `yaml:"labels"`
 	// ActiveTasksLimit is the max number of concurrent active tasks
 	ActiveTasksLimit int `yaml:"activeTasksLimit"`
+	// MaxExecOutputBytes, when > 0, is the max number of bytes of a task
+	// step log written by a step command. The exceeding output is discarded.
+	MaxExecOutputBytes int64 `yaml:"maxExecOutputBytes"`
 
 	AllowPrivilegedContainers bool `yaml:"allowPrivilegedContainers"`
+	// RunContainersAsUser runs the task containers as their configured user.
+	// When false the container user is only used to execute the task steps
+	// and the containers run as their image user.
+	RunContainersAsUser bool `yaml:"runContainersAsUser"`
 }
 
 type InitImage struct {
@@ -160,8 +168,28 @@ type Configstore struct {
 
 	Web           Web           `yaml:"web"`
 	ObjectStorage ObjectStorage `yaml:"objectStorage"`
+
+	// ReservedUserNames are the names, compared case insensitively, that
+	// can't be used as user names. When not set it defaults to
+	// defaultReservedUserNames.
+	ReservedUserNames []string `yaml:"reservedUserNames"`
+
+	// MaxUserTokens is the maximum number of active (not expired) tokens a
+	// user can have. A value less or equal than 0 disables the limit.
+	MaxUserTokens int `yaml:"maxUserTokens"`
+
+	// AuditLog is where the audit events of the users, user tokens and linked
+	// accounts changes are recorded. When empty they aren't recorded.
+	AuditLog AuditLogType `yaml:"auditLog"`
 }
 
+type AuditLogType string
+
+const (
+	// AuditLogTypeLog writes the audit events to the configstore log
+	AuditLogTypeLog AuditLogType = "log"
+)
+
 type Gitserver struct {
 	Debug bool `yaml:"debug"`
 
@@ -232,10 +260,91 @@ type Driver struct {
 
 	// docker fields
 
+	// Host is the docker daemon host (i.e. "tcp://docker.example.com:2376").
+	// When empty the DOCKER_HOST environment variable is used.
+	Host string `yaml:"host"`
+	// APIVersion is the docker api version used by the client
+	APIVersion string `yaml:"apiVersion"`
+	// TLSCertFile, TLSKeyFile and TLSCAFile are the paths to the client
+	// certificate, key and CA certificate used to connect to the docker daemon
+	// over TLS
+	TLSCertFile string `yaml:"tlsCertFile"`
+	TLSKeyFile  string `yaml:"tlsKeyFile"`
+	TLSCAFile   string `yaml:"tlsCAFile"`
+
+	// MaxConcurrentPulls limits the number of concurrent image pulls, 0 means
+	// no limit
+	MaxConcurrentPulls int `yaml:"maxConcurrentPulls"`
+	// RegistryMirrors maps the registry names to the mirror registry hosts
+	// used to pull their images
+	RegistryMirrors map[string]string `yaml:"registryMirrors"`
+	// StopTimeout is the time given to the pod containers to gracefully stop
+	// before being killed
+	StopTimeout time.Duration `yaml:"stopTimeout"`
+	// StopOrder is the order in which the pod containers are stopped:
+	// "forward" or "reverse" (the default)
+	StopOrder string `yaml:"stopOrder"`
+	// WaitHealthyTimeout, when set, is the max time the pod creation waits for
+	// the containers with a healthcheck to become healthy
+	WaitHealthyTimeout time.Duration `yaml:"waitHealthyTimeout"`
+	// ServiceSettlePeriod, when set, is the time the pod service containers
+	// must keep running for the pod creation to succeed
+	ServiceSettlePeriod time.Duration `yaml:"serviceSettlePeriod"`
+	// PodStartTimeout, when set, is the max duration of the pod creation
+	PodStartTimeout time.Duration `yaml:"podStartTimeout"`
+
+	// ResourceTTL, when set, adds to the created containers and volumes an
+	// expiry label for external cleanup tools
+	ResourceTTL time.Duration `yaml:"resourceTTL"`
+	// ExtraLabels are added to the created containers and volumes
+	ExtraLabels map[string]string `yaml:"extraLabels"`
+	// PruneOnStartup removes, at startup, the pods left by a previous executor
+	// with the same id
+	PruneOnStartup bool `yaml:"pruneOnStartup"`
+	// OrphanedVolumesGracePeriod is the min age of the volumes, not attached
+	// to any pod, removed at startup
+	OrphanedVolumesGracePeriod time.Duration `yaml:"orphanedVolumesGracePeriod"`
+
+	// DefaultUlimits are applied to every container
+	DefaultUlimits []Ulimit `yaml:"defaultUlimits"`
+	// TmpfsAllowExec mounts the tmpfs volumes without the noexec and nosuid
+	// options
+	TmpfsAllowExec bool `yaml:"tmpfsAllowExec"`
+	// AllowedBindSources are the host path prefixes that the bind volumes can
+	// mount
+	AllowedBindSources []string `yaml:"allowedBindSources"`
+	// CapacityMemory (in bytes) and CapacityCPU (in millicpus), when set,
+	// override the docker daemon total memory and cpus used to check the pods
+	// resource requests
+	CapacityMemory int64 `yaml:"capacityMemory"`
+	CapacityCPU    int64 `yaml:"capacityCPU"`
+
+	// ToolboxVolumePoolSize is the number of toolbox volumes kept ready, 0
+	// disables the toolbox volumes pool
+	ToolboxVolumePoolSize int `yaml:"toolboxVolumePoolSize"`
+	// WarmPool keeps idle task containers ready for the configured images
+	WarmPool WarmPool `yaml:"warmPool"`
+
 	// k8s fields
 
 }
 
+type Ulimit struct {
+	Name string `yaml:"name"`
+	Soft int64  `yaml:"soft"`
+	Hard int64  `yaml:"hard"`
+}
+
+type WarmPool struct {
+	// Images are the images of the pooled containers
+	Images []string `yaml:"images"`
+	// Size is the number of idle containers kept for every image
+	Size int `yaml:"size"`
+	// ProjectDir is the dir of the pooled containers project volume, emptied
+	// before reusing them. It's usually the tasks working dir
+	ProjectDir string `yaml:"projectDir"`
+}
+
 type TokenSigning struct {
 	// token duration (defaults to 12 hours)
 	Duration time.Duration `yaml:"duration"`
@@ -264,6 +373,23 @@ func (vt OrganizationMemberAddingMode) IsValid() bool {
 	return false
 }
 
+// defaultMaxUserTokens is the default maximum number of active tokens per user
+const defaultMaxUserTokens = 50
+
+// defaultReservedUserNames are the default reserved user names: the
+// administrative names and the org, user and project routing keywords.
+var defaultReservedUserNames = []string{
+	"admin",
+	"api",
+	"org",
+	"orgs",
+	"projectgroups",
+	"projects",
+	"system",
+	"user",
+	"users",
+}
+
 var defaultConfig = Config{
 	ID: "agola",
 	Gateway: Gateway{
@@ -283,6 +409,10 @@ var defaultConfig = Config{
 		},
 		ActiveTasksLimit: 2,
 	},
+	Configstore: Configstore{
+		ReservedUserNames: defaultReservedUserNames,
+		MaxUserTokens:     defaultMaxUserTokens,
+	},
 	Gitserver: Gitserver{
 		RepositoryCleanupInterval:    24 * time.Hour,
 		RepositoryRefsExpireInterval: 30 * 24 * time.Hour,
@@ -346,6 +476,27 @@ func validateInitImage(i *InitImage) error {
 	return nil
 }
 
+func validateDockerDriver(d *Driver) error {
+	switch d.StopOrder {
+	case "", "forward", "reverse":
+	default:
+		return errors.Errorf("unknown stop order %q", d.StopOrder)
+	}
+	if d.ToolboxVolumePoolSize < 0 {
+		return errors.Errorf("negative toolboxVolumePoolSize")
+	}
+	if len(d.WarmPool.Images) > 0 {
+		if d.WarmPool.Size <= 0 {
+			return errors.Errorf("warmPool size must be greater than 0")
+		}
+		if !filepath.IsAbs(d.WarmPool.ProjectDir) {
+			return errors.Errorf("warmPool projectDir must be an absolute path")
+		}
+	}
+
+	return nil
+}
+
 func Validate(c *Config, componentsNames []string) error {
 	// Global
 	if len(c.ID) > maxIDLength {
@@ -388,6 +539,11 @@ func Validate(c *Config, componentsNames []string) error {
 		if err := validateWeb(&c.Configstore.Web); err != nil {
 			return errors.Wrapf(err, "configstore web configuration error")
 		}
+		switch c.Configstore.AuditLog {
+		case "", AuditLogTypeLog:
+		default:
+			return errors.Errorf("configstore auditLog type %q unknown", c.Configstore.AuditLog)
+		}
 	}
 
 	// Runservice
@@ -419,6 +575,9 @@ func Validate(c *Config, componentsNames []string) error {
 		}
 		switch c.Executor.Driver.Type {
 		case DriverTypeDocker:
+			if err := validateDockerDriver(&c.Executor.Driver); err != nil {
+				return errors.Wrapf(err, "executor driver configuration error")
+			}
 		case DriverTypeK8s:
 		default:
 			return errors.Errorf("executor driver type %q unknown", c.Executor.Driver.Type)
@@ -220,6 +220,68 @@ gitserver:
   dataDir:`,
 			err: errors.Errorf("git server dataDir is empty"),
 		},
+		{
+			name:     "test config for executor with docker driver options",
+			services: []string{"executor"},
+			in: `
+executor:
+  dataDir: /data/agola/executor
+  toolboxPath: ./bin
+  runserviceURL: "http://localhost:4000"
+  web:
+    listenAddress: ":4001"
+  driver:
+    type: docker
+    host: "tcp://docker.example.com:2376"
+    maxConcurrentPulls: 2
+    stopTimeout: 10s
+    stopOrder: forward
+    extraLabels:
+      team: ci
+    defaultUlimits:
+      - name: nofile
+        soft: 1024
+        hard: 2048
+    warmPool:
+      images:
+        - busybox:stable
+      size: 2
+      projectDir: /root/project`,
+		},
+		{
+			name:     "test config for executor with docker driver warm pool relative project dir",
+			services: []string{"executor"},
+			in: `
+executor:
+  dataDir: /data/agola/executor
+  toolboxPath: ./bin
+  runserviceURL: "http://localhost:4000"
+  web:
+    listenAddress: ":4001"
+  driver:
+    type: docker
+    warmPool:
+      images:
+        - busybox:stable
+      size: 2
+      projectDir: project`,
+			err: errors.Errorf(`executor driver configuration error: warmPool projectDir must be an absolute path`),
+		},
+		{
+			name:     "test config for executor with wrong docker driver stop order",
+			services: []string{"executor"},
+			in: `
+executor:
+  dataDir: /data/agola/executor
+  toolboxPath: ./bin
+  runserviceURL: "http://localhost:4000"
+  web:
+    listenAddress: ":4001"
+  driver:
+    type: docker
+    stopOrder: random`,
+			err: errors.Errorf(`executor driver configuration error: unknown stop order "random"`),
+		},
 	}
 
 	for _, tt := range tests {
@@ -15,6 +15,8 @@
 package action
 
 import (
+	"strings"
+
 	"agola.io/agola/internal/errors"
 	"agola.io/agola/internal/lock"
 	"agola.io/agola/internal/services/configstore/db"
@@ -30,21 +32,39 @@ type ActionHandler struct {
 	d               *db.DB
 	lf              lock.LockFactory
 	maintenanceMode bool
+	auditLogger     AuditLogger
+	// maxUserTokens is the maximum number of active tokens per user. A value
+	// less or equal than 0 disables the limit.
+	maxUserTokens int
+
+	// reservedUserNames are the lowercased reserved user names
+	reservedUserNames map[string]struct{}
 }
 
-func NewActionHandler(log zerolog.Logger, d *db.DB, lf lock.LockFactory) *ActionHandler {
-	return &ActionHandler{
-		log:             log,
-		d:               d,
-		lf:              lf,
-		maintenanceMode: false,
+func NewActionHandler(log zerolog.Logger, d *db.DB, lf lock.LockFactory, reservedUserNames []string) *ActionHandler {
+	h := &ActionHandler{
+		log:               log,
+		d:                 d,
+		lf:                lf,
+		maintenanceMode:   false,
+		auditLogger:       nopAuditLogger{},
+		reservedUserNames: make(map[string]struct{}, len(reservedUserNames)),
+	}
+	for _, name := range reservedUserNames {
+		h.reservedUserNames[strings.ToLower(name)] = struct{}{}
 	}
+
+	return h
 }
 
 func (h *ActionHandler) SetMaintenanceMode(maintenanceMode bool) {
 	h.maintenanceMode = maintenanceMode
 }
 
+func (h *ActionHandler) SetMaxUserTokens(maxUserTokens int) {
+	h.maxUserTokens = maxUserTokens
+}
+
 func (h *ActionHandler) ResolveObjectID(tx *sql.Tx, objectKind types.ObjectKind, ref string) (string, error) {
 	switch objectKind {
 	case types.ObjectKindProjectGroup:
@@ -0,0 +1,110 @@
+// Copyright 2022 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package action
+
+import (
+	"context"
+	"time"
+
+	"agola.io/agola/internal/errors"
+	"agola.io/agola/internal/sql"
+
+	"github.com/rs/zerolog"
+)
+
+type AuditAction string
+
+const (
+	AuditActionUserCreate          AuditAction = "user.create"
+	AuditActionUserUpdate          AuditAction = "user.update"
+	AuditActionUserDelete          AuditAction = "user.delete"
+	AuditActionUserSecretRotate    AuditAction = "user.secret.rotate"
+	AuditActionUserTokenCreate     AuditAction = "usertoken.create"
+	AuditActionUserTokenDelete     AuditAction = "usertoken.delete"
+	AuditActionLinkedAccountCreate AuditAction = "linkedaccount.create"
+	AuditActionLinkedAccountDelete AuditAction = "linkedaccount.delete"
+)
+
+// AuditEvent is the record of a change done by an actor
+type AuditEvent struct {
+	// Actor is the identity that requested the change, see WithAuditActor.
+	// It's empty when unknown.
+	Actor  string
+	Action AuditAction
+	// TargetKind and TargetID are the kind and the id of the changed object
+	TargetKind string
+	TargetID   string
+	// UserID is the id of the user owning the changed object
+	UserID string
+	Time   time.Time
+}
+
+// AuditLogger records the audit events. LogAuditEvent is called inside the
+// transaction of the audited change so an implementation can write the event
+// consistently with it. A returned error aborts the change.
+type AuditLogger interface {
+	LogAuditEvent(tx *sql.Tx, event *AuditEvent) error
+}
+
+type nopAuditLogger struct{}
+
+func (nopAuditLogger) LogAuditEvent(tx *sql.Tx, event *AuditEvent) error { return nil }
+
+// LogAuditLogger writes the audit events to a logger. The events are written
+// inside the transaction of the audited change, so an event is also written
+// when the transaction is later rolled back.
+type LogAuditLogger struct {
+	log zerolog.Logger
+}
+
+func NewLogAuditLogger(log zerolog.Logger) *LogAuditLogger {
+	return &LogAuditLogger{log: log}
+}
+
+func (l *LogAuditLogger) LogAuditEvent(tx *sql.Tx, event *AuditEvent) error {
+	l.log.Info().Msgf("audit event: action: %q, actor: %q, target: %s %q, user id: %q, time: %s", event.Action, event.Actor, event.TargetKind, event.TargetID, event.UserID, event.Time.UTC().Format(time.RFC3339))
+
+	return nil
+}
+
+type auditActorKey struct{}
+
+// WithAuditActor returns a context reporting actor as the identity requesting
+// the changes done with it.
+func WithAuditActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, auditActorKey{}, actor)
+}
+
+func auditActor(ctx context.Context) string {
+	actor, _ := ctx.Value(auditActorKey{}).(string)
+	return actor
+}
+
+func (h *ActionHandler) SetAuditLogger(auditLogger AuditLogger) {
+	h.auditLogger = auditLogger
+}
+
+func (h *ActionHandler) logAuditEvent(ctx context.Context, tx *sql.Tx, action AuditAction, targetKind, targetID, userID string) error {
+	event := &AuditEvent{
+		Actor:      auditActor(ctx),
+		Action:     action,
+		TargetKind: targetKind,
+		TargetID:   targetID,
+		UserID:     userID,
+		Time:       time.Now(),
+	}
+
+	return errors.WithStack(h.auditLogger.LogAuditEvent(tx, event))
+}
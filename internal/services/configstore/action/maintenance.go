@@ -142,5 +142,11 @@ func (h *ActionHandler) Import(ctx context.Context, r io.Reader) error {
 		return errors.Wrap(err, "setup db error")
 	}
 
+	// an export made before user tokens were stored hashed could contain
+	// legacy plaintext tokens
+	if err := h.MigrateLegacyUserTokens(ctx); err != nil {
+		return errors.Wrap(err, "migrate legacy user tokens error")
+	}
+
 	return nil
 }
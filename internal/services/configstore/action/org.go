@@ -16,6 +16,7 @@ package action
 
 import (
 	"context"
+	"time"
 
 	"agola.io/agola/internal/errors"
 	"agola.io/agola/internal/services/configstore/db"
@@ -23,6 +24,8 @@ import (
 	"agola.io/agola/internal/util"
 	csapitypes "agola.io/agola/services/configstore/api/types"
 	"agola.io/agola/services/configstore/types"
+
+	"github.com/gofrs/uuid"
 )
 
 type OrgMemberResponse struct {
@@ -64,10 +67,61 @@ func (h *ActionHandler) GetOrgMembers(ctx context.Context, orgRef string) ([]*Or
 	return res, nil
 }
 
+type OrgResponse struct {
+	Organization *types.Organization
+	// MembersCount is populated only when requested
+	MembersCount int
+}
+
+// GetOrgs returns all the instance orgs paginated by org name. When
+// includeMembersCount is true the members count of every returned org is
+// also reported.
+func (h *ActionHandler) GetOrgs(ctx context.Context, start string, limit int, asc bool, includeMembersCount bool) ([]*OrgResponse, error) {
+	if limit < 0 {
+		return nil, util.NewAPIError(util.ErrBadRequest, errors.Errorf("limit must be greater or equal than 0"))
+	}
+
+	var orgs []*types.Organization
+	var membersCount map[string]int
+	err := h.d.Do(ctx, func(tx *sql.Tx) error {
+		var err error
+		orgs, err = h.d.GetOrgs(tx, start, limit, asc)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		if !includeMembersCount {
+			return nil
+		}
+
+		orgIDs := make([]string, len(orgs))
+		for i, org := range orgs {
+			orgIDs[i] = org.ID
+		}
+		membersCount, err = h.d.GetOrgsMembersCount(tx, orgIDs)
+		return errors.WithStack(err)
+	})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	res := make([]*OrgResponse, len(orgs))
+	for i, org := range orgs {
+		res[i] = &OrgResponse{
+			Organization: org,
+			MembersCount: membersCount[org.ID],
+		}
+	}
+
+	return res, nil
+}
+
 type CreateOrgRequest struct {
 	Name          string
 	Visibility    types.Visibility
 	CreatorUserID string
+	// MaxMembers, when > 0, is the maximum number of org members
+	MaxMembers int
 }
 
 func (h *ActionHandler) CreateOrg(ctx context.Context, req *CreateOrgRequest) (*types.Organization, error) {
@@ -80,6 +134,9 @@ func (h *ActionHandler) CreateOrg(ctx context.Context, req *CreateOrgRequest) (*
 	if !types.IsValidVisibility(req.Visibility) {
 		return nil, util.NewAPIError(util.ErrBadRequest, errors.Errorf("invalid organization visibility"))
 	}
+	if req.MaxMembers < 0 {
+		return nil, util.NewAPIError(util.ErrBadRequest, errors.Errorf("max members must be greater or equal than 0"))
+	}
 
 	var org *types.Organization
 	err := h.d.Do(ctx, func(tx *sql.Tx) error {
@@ -107,6 +164,7 @@ func (h *ActionHandler) CreateOrg(ctx context.Context, req *CreateOrgRequest) (*
 		org.Name = req.Name
 		org.Visibility = req.Visibility
 		org.CreatorUserID = req.CreatorUserID
+		org.MaxMembers = req.MaxMembers
 
 		if err := h.d.InsertOrganization(tx, org); err != nil {
 			return errors.WithStack(err)
@@ -148,12 +206,18 @@ func (h *ActionHandler) CreateOrg(ctx context.Context, req *CreateOrgRequest) (*
 
 type UpdateOrgRequest struct {
 	Visibility types.Visibility
+	// MaxMembers, when not nil, updates the maximum number of org members.
+	// Lowering it below the current members count doesn't remove members.
+	MaxMembers *int
 }
 
 func (h *ActionHandler) UpdateOrg(ctx context.Context, orgRef string, req *UpdateOrgRequest) (*types.Organization, error) {
 	if !types.IsValidVisibility(req.Visibility) {
 		return nil, util.NewAPIError(util.ErrBadRequest, errors.Errorf("invalid organization visibility"))
 	}
+	if req.MaxMembers != nil && *req.MaxMembers < 0 {
+		return nil, util.NewAPIError(util.ErrBadRequest, errors.Errorf("max members must be greater or equal than 0"))
+	}
 
 	var org *types.Organization
 	err := h.d.Do(ctx, func(tx *sql.Tx) error {
@@ -168,6 +232,9 @@ func (h *ActionHandler) UpdateOrg(ctx context.Context, orgRef string, req *Updat
 		}
 
 		org.Visibility = req.Visibility
+		if req.MaxMembers != nil {
+			org.MaxMembers = *req.MaxMembers
+		}
 
 		if err := h.d.UpdateOrganization(tx, org); err != nil {
 			return errors.WithStack(err)
@@ -198,12 +265,22 @@ func (h *ActionHandler) DeleteOrg(ctx context.Context, orgRef string) error {
 
 		orgInvitations, err := h.d.GetOrgInvitations(tx, org.ID)
 		if err != nil {
-			return util.NewAPIError(util.KindFromRemoteError(err), err)
+			return util.APIErrorFromRemote(err)
 		}
 		for _, invitation := range orgInvitations {
 			err = h.d.DeleteOrgInvitation(tx, invitation.ID)
 			if err != nil {
-				return util.NewAPIError(util.KindFromRemoteError(err), err)
+				return util.APIErrorFromRemote(err)
+			}
+		}
+
+		orgInviteLinks, err := h.d.GetOrgInviteLinks(tx, org.ID)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		for _, link := range orgInviteLinks {
+			if err := h.d.DeleteOrgInviteLink(tx, link.ID); err != nil {
+				return errors.WithStack(err)
 			}
 		}
 
@@ -244,6 +321,29 @@ func (h *ActionHandler) DeleteOrg(ctx context.Context, orgRef string) error {
 	return errors.WithStack(err)
 }
 
+// ErrorCodeOrgMemberLimit is the error code returned when adding a member to
+// an org that already has its maximum number of members
+const ErrorCodeOrgMemberLimit util.ErrorCode = "org_member_limit"
+
+// checkOrgMemberLimit returns an error when the org has already reached its
+// maximum number of members
+func (h *ActionHandler) checkOrgMemberLimit(tx *sql.Tx, org *types.Organization) error {
+	if org.MaxMembers <= 0 {
+		return nil
+	}
+
+	membersCount, err := h.d.GetOrgsMembersCount(tx, []string{org.ID})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if membersCount[org.ID] >= org.MaxMembers {
+		err := errors.Errorf("org %q reached its members limit of %d", org.Name, org.MaxMembers)
+		return util.NewAPIError(util.ErrBadRequest, err, util.WithCode(ErrorCodeOrgMemberLimit), util.WithMessage(err.Error()))
+	}
+
+	return nil
+}
+
 // AddOrgMember add/updates an org member.
 // TODO(sgotti) handle invitation when implemented
 func (h *ActionHandler) AddOrgMember(ctx context.Context, orgRef, userRef string, role types.MemberRole) (*types.OrganizationMember, error) {
@@ -283,6 +383,10 @@ func (h *ActionHandler) AddOrgMember(ctx context.Context, orgRef, userRef string
 			}
 			orgmember.MemberRole = role
 		} else {
+			if err := h.checkOrgMemberLimit(tx, org); err != nil {
+				return errors.WithStack(err)
+			}
+
 			orgmember = types.NewOrganizationMember(tx)
 			orgmember.OrganizationID = org.ID
 			orgmember.UserID = user.ID
@@ -356,6 +460,85 @@ func (h *ActionHandler) RemoveOrgMember(ctx context.Context, orgRef, userRef str
 	return errors.WithStack(err)
 }
 
+// ReassignOrgOwnership transfers, in a single transaction, the org owner role
+// from fromUserRef to toUserRef. fromUserRef remains an org member with the
+// member role. If toUserRef is already an org member its membership is
+// updated.
+func (h *ActionHandler) ReassignOrgOwnership(ctx context.Context, orgRef, fromUserRef, toUserRef string) error {
+	err := h.d.Do(ctx, func(tx *sql.Tx) error {
+		org, err := h.d.GetOrg(tx, orgRef)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if org == nil {
+			return util.NewAPIError(util.ErrBadRequest, errors.Errorf("org %q doesn't exists", orgRef))
+		}
+		fromUser, err := h.d.GetUser(tx, fromUserRef)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if fromUser == nil {
+			return util.NewAPIError(util.ErrBadRequest, errors.Errorf("user %q doesn't exists", fromUserRef))
+		}
+		toUser, err := h.d.GetUser(tx, toUserRef)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if toUser == nil {
+			return util.NewAPIError(util.ErrBadRequest, errors.Errorf("user %q doesn't exists", toUserRef))
+		}
+		if fromUser.ID == toUser.ID {
+			return util.NewAPIError(util.ErrBadRequest, errors.Errorf("cannot reassign org %q ownership to the same user", orgRef))
+		}
+
+		fromOrgmember, err := h.d.GetOrgMemberByOrgUserID(tx, org.ID, fromUser.ID)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if fromOrgmember == nil || fromOrgmember.MemberRole != types.MemberRoleOwner {
+			return util.NewAPIError(util.ErrBadRequest, errors.Errorf("user %q isn't an owner of org %q", fromUserRef, orgRef))
+		}
+
+		toOrgmember, err := h.d.GetOrgMemberByOrgUserID(tx, org.ID, toUser.ID)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if toOrgmember == nil {
+			if err := h.checkOrgMemberLimit(tx, org); err != nil {
+				return errors.WithStack(err)
+			}
+
+			toOrgmember = types.NewOrganizationMember(tx)
+			toOrgmember.OrganizationID = org.ID
+			toOrgmember.UserID = toUser.ID
+		}
+		toOrgmember.MemberRole = types.MemberRoleOwner
+		if err := h.d.InsertOrUpdateOrganizationMember(tx, toOrgmember); err != nil {
+			return errors.WithStack(err)
+		}
+
+		fromOrgmember.MemberRole = types.MemberRoleMember
+		if err := h.d.UpdateOrganizationMember(tx, fromOrgmember); err != nil {
+			return errors.WithStack(err)
+		}
+
+		// delete the new owner org invitation if exists
+		orgInvitation, err := h.d.GetOrgInvitationByOrgUserID(tx, org.ID, toUser.ID)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if orgInvitation != nil {
+			if err := h.d.DeleteOrgInvitation(tx, orgInvitation.ID); err != nil {
+				return errors.WithStack(err)
+			}
+		}
+
+		return nil
+	})
+
+	return errors.WithStack(err)
+}
+
 func (h *ActionHandler) GetOrgInvitations(ctx context.Context, orgRef string) ([]*types.OrgInvitation, error) {
 	var orgInvitations []*types.OrgInvitation
 	err := h.d.Do(ctx, func(tx *sql.Tx) error {
@@ -479,6 +662,224 @@ func (h *ActionHandler) CreateOrgInvitation(ctx context.Context, req *CreateOrgI
 	return orgInvitation, errors.WithStack(err)
 }
 
+type CreateOrgSignupInvitationRequest struct {
+	OrganizationRef string
+	Role            types.MemberRole
+	// ExpirationTime, when set, is the time after which the invitation
+	// cannot be used anymore
+	ExpirationTime *time.Time
+}
+
+// CreateOrgSignupInvitation creates an org invitation for a user that doesn't
+// exist yet. The returned invitation token must be provided to
+// CreateUserAndAcceptInvitation.
+func (h *ActionHandler) CreateOrgSignupInvitation(ctx context.Context, req *CreateOrgSignupInvitationRequest) (*types.OrgInvitation, error) {
+	if req.OrganizationRef == "" {
+		return nil, util.NewAPIError(util.ErrBadRequest, errors.Errorf("organization ref required"))
+	}
+	if !types.IsValidMemberRole(req.Role) {
+		return nil, util.NewAPIError(util.ErrBadRequest, errors.Errorf("invalid role"))
+	}
+
+	var orgInvitation *types.OrgInvitation
+	err := h.d.Do(ctx, func(tx *sql.Tx) error {
+		org, err := h.d.GetOrg(tx, req.OrganizationRef)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if org == nil {
+			return util.NewAPIError(util.ErrBadRequest, errors.Errorf("organization %q doesn't exist", req.OrganizationRef))
+		}
+
+		orgInvitation = types.NewOrgInvitation(tx)
+		orgInvitation.OrganizationID = org.ID
+		orgInvitation.Role = req.Role
+		orgInvitation.Token = util.EncodeSha1Hex(uuid.Must(uuid.NewV4()).String())
+		orgInvitation.ExpirationTime = req.ExpirationTime
+
+		if err := h.d.InsertOrgInvitation(tx, orgInvitation); err != nil {
+			return errors.WithStack(err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return orgInvitation, nil
+}
+
+type CreateOrgInviteLinkRequest struct {
+	OrganizationRef string
+	Role            types.MemberRole
+	// MaxUses is the number of users that can join the org using the link
+	MaxUses int
+	// ExpirationTime, when set, is the time after which the link cannot be
+	// used anymore
+	ExpirationTime *time.Time
+}
+
+// CreateOrgInviteLink creates a shareable org invite link. Its token can be
+// provided, up to MaxUses times, to CreateUserAndAcceptInvitation or to
+// AcceptOrgInviteLink by existing users.
+func (h *ActionHandler) CreateOrgInviteLink(ctx context.Context, req *CreateOrgInviteLinkRequest) (*types.OrgInviteLink, error) {
+	if req.OrganizationRef == "" {
+		return nil, util.NewAPIError(util.ErrBadRequest, errors.Errorf("organization ref required"))
+	}
+	if !types.IsValidMemberRole(req.Role) {
+		return nil, util.NewAPIError(util.ErrBadRequest, errors.Errorf("invalid role"))
+	}
+	if req.MaxUses < 1 {
+		return nil, util.NewAPIError(util.ErrBadRequest, errors.Errorf("max uses must be greater than 0"))
+	}
+
+	var orgInviteLink *types.OrgInviteLink
+	err := h.d.Do(ctx, func(tx *sql.Tx) error {
+		org, err := h.d.GetOrg(tx, req.OrganizationRef)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if org == nil {
+			return util.NewAPIError(util.ErrBadRequest, errors.Errorf("organization %q doesn't exist", req.OrganizationRef))
+		}
+
+		orgInviteLink = types.NewOrgInviteLink(tx)
+		orgInviteLink.OrganizationID = org.ID
+		orgInviteLink.Role = req.Role
+		orgInviteLink.Token = util.EncodeSha1Hex(uuid.Must(uuid.NewV4()).String())
+		orgInviteLink.RemainingUses = req.MaxUses
+		orgInviteLink.ExpirationTime = req.ExpirationTime
+
+		if err := h.d.InsertOrgInviteLink(tx, orgInviteLink); err != nil {
+			return errors.WithStack(err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return orgInviteLink, nil
+}
+
+func (h *ActionHandler) GetOrgInviteLinks(ctx context.Context, orgRef string) ([]*types.OrgInviteLink, error) {
+	var orgInviteLinks []*types.OrgInviteLink
+	err := h.d.Do(ctx, func(tx *sql.Tx) error {
+		org, err := h.d.GetOrg(tx, orgRef)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if org == nil {
+			return util.NewAPIError(util.ErrNotExist, errors.Errorf("org %q doesn't exist", orgRef))
+		}
+
+		orgInviteLinks, err = h.d.GetOrgInviteLinks(tx, org.ID)
+		return errors.WithStack(err)
+	})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return orgInviteLinks, nil
+}
+
+type AcceptOrgInviteLinkRequest struct {
+	UserRef string
+	Token   string
+}
+
+// AcceptOrgInviteLink adds an existing user as org member using an org invite
+// link token.
+func (h *ActionHandler) AcceptOrgInviteLink(ctx context.Context, req *AcceptOrgInviteLinkRequest) error {
+	if req.UserRef == "" {
+		return util.NewAPIError(util.ErrBadRequest, errors.Errorf("user ref required"))
+	}
+	if req.Token == "" {
+		return util.NewAPIError(util.ErrBadRequest, errors.Errorf("invitation token required"))
+	}
+
+	err := h.d.Do(ctx, func(tx *sql.Tx) error {
+		user, err := h.d.GetUser(tx, req.UserRef)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if user == nil {
+			return util.NewAPIError(util.ErrBadRequest, errors.Errorf("user %q doesn't exist", req.UserRef))
+		}
+
+		orgInviteLink, err := h.getValidOrgInviteLink(tx, req.Token)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		orgMember, err := h.d.GetOrgMemberByOrgUserID(tx, orgInviteLink.OrganizationID, user.ID)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if orgMember != nil {
+			return util.NewAPIError(util.ErrBadRequest, errors.Errorf("user %q is already an org member", req.UserRef))
+		}
+
+		return errors.WithStack(h.redeemOrgInviteLink(tx, orgInviteLink, user))
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	return nil
+}
+
+// getValidOrgInviteLink returns the org invite link with the provided token
+// if it can still be used.
+func (h *ActionHandler) getValidOrgInviteLink(tx *sql.Tx, token string) (*types.OrgInviteLink, error) {
+	orgInviteLink, err := h.d.GetOrgInviteLinkByToken(tx, token)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if orgInviteLink == nil {
+		return nil, util.NewAPIError(util.ErrBadRequest, errors.Errorf("invalid invitation token"))
+	}
+	if orgInviteLink.IsExpired(time.Now()) {
+		return nil, util.NewAPIError(util.ErrBadRequest, errors.Errorf("invitation expired"))
+	}
+
+	return orgInviteLink, nil
+}
+
+// redeemOrgInviteLink adds the user as org member with the link role and
+// consumes one link use. The link is removed when it has no remaining uses.
+func (h *ActionHandler) redeemOrgInviteLink(tx *sql.Tx, orgInviteLink *types.OrgInviteLink, user *types.User) error {
+	org, err := h.d.GetOrgByID(tx, orgInviteLink.OrganizationID)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if org == nil {
+		return util.NewAPIError(util.ErrBadRequest, errors.Errorf("invitation organization doesn't exist"))
+	}
+
+	if err := h.checkOrgMemberLimit(tx, org); err != nil {
+		return errors.WithStack(err)
+	}
+
+	orgMember := types.NewOrganizationMember(tx)
+	orgMember.OrganizationID = org.ID
+	orgMember.UserID = user.ID
+	orgMember.MemberRole = orgInviteLink.Role
+
+	if err := h.d.InsertOrganizationMember(tx, orgMember); err != nil {
+		return errors.WithStack(err)
+	}
+
+	orgInviteLink.RemainingUses--
+	if orgInviteLink.RemainingUses <= 0 {
+		return errors.WithStack(h.d.DeleteOrgInviteLink(tx, orgInviteLink.ID))
+	}
+
+	return errors.WithStack(h.d.UpdateOrgInviteLink(tx, orgInviteLink))
+}
+
 func (h *ActionHandler) DeleteOrgInvitation(ctx context.Context, orgRef string, userRef string) error {
 	err := h.d.Do(ctx, func(tx *sql.Tx) error {
 		org, err := h.d.GetOrg(tx, orgRef)
@@ -557,6 +958,10 @@ func (h *ActionHandler) OrgInvitationAction(ctx context.Context, req *OrgInvitat
 		}
 
 		if req.Action == csapitypes.Accept {
+			if err := h.checkOrgMemberLimit(tx, org); err != nil {
+				return errors.WithStack(err)
+			}
+
 			orgMember := types.NewOrganizationMember(tx)
 			orgMember.OrganizationID = orgInvitation.OrganizationID
 			orgMember.UserID = orgInvitation.UserID
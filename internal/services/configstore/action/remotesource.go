@@ -194,3 +194,47 @@ func (h *ActionHandler) DeleteRemoteSource(ctx context.Context, remoteSourceName
 
 	return errors.WithStack(err)
 }
+
+type ValidateRemoteSourcesResponse struct {
+	// Existing contains the provided remote source names that exist
+	Existing []string
+	// Missing contains the provided remote source names that don't exist
+	Missing []string
+}
+
+// ValidateRemoteSources checks, with a single query, which of the provided
+// remote source names exist. The returned names keep the requested order and
+// are deduplicated.
+func (h *ActionHandler) ValidateRemoteSources(ctx context.Context, names []string) (*ValidateRemoteSourcesResponse, error) {
+	var remoteSources []*types.RemoteSource
+	err := h.d.Do(ctx, func(tx *sql.Tx) error {
+		var err error
+		remoteSources, err = h.d.GetRemoteSourcesByNames(tx, names)
+		return errors.WithStack(err)
+	})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	existing := make(map[string]struct{}, len(remoteSources))
+	for _, rs := range remoteSources {
+		existing[rs.Name] = struct{}{}
+	}
+
+	res := &ValidateRemoteSourcesResponse{Existing: []string{}, Missing: []string{}}
+	seen := map[string]struct{}{}
+	for _, name := range names {
+		if _, ok := seen[name]; ok {
+			continue
+		}
+		seen[name] = struct{}{}
+
+		if _, ok := existing[name]; ok {
+			res.Existing = append(res.Existing, name)
+		} else {
+			res.Missing = append(res.Missing, name)
+		}
+	}
+
+	return res, nil
+}
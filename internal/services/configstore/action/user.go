@@ -16,6 +16,10 @@ package action
 
 import (
 	"context"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
 	"time"
 
 	"agola.io/agola/internal/errors"
@@ -27,84 +31,1236 @@ import (
 	"github.com/gofrs/uuid"
 )
 
+const (
+	// UserTokenLastUsedUpdateInterval is the min interval between two updates
+	// of a user token last used time
+	UserTokenLastUsedUpdateInterval = time.Minute
+	// UserLALastUsedUpdateInterval is the min interval between two updates of
+	// a linked account last used time
+	UserLALastUsedUpdateInterval = time.Minute
+)
+
 type CreateUserRequest struct {
 	UserName string
+	// Email is the optional user email
+	Email string
 
 	CreateUserLARequest *CreateUserLARequest
 }
 
-func (h *ActionHandler) CreateUser(ctx context.Context, req *CreateUserRequest) (*types.User, error) {
+// isReservedUserName reports if the user name is reserved, ignoring case.
+func (h *ActionHandler) isReservedUserName(name string) bool {
+	_, ok := h.reservedUserNames[strings.ToLower(name)]
+	return ok
+}
+
+func (h *ActionHandler) validateCreateUserRequest(req *CreateUserRequest) error {
 	if req.UserName == "" {
-		return nil, util.NewAPIError(util.ErrBadRequest, errors.Errorf("user name required"))
+		return util.NewAPIError(util.ErrBadRequest, errors.Errorf("user name required"))
 	}
 	if !util.ValidateName(req.UserName) {
-		return nil, util.NewAPIError(util.ErrBadRequest, errors.Errorf("invalid user name %q", req.UserName))
+		return util.NewAPIError(util.ErrBadRequest, errors.Errorf("invalid user name %q", req.UserName))
+	}
+	if h.isReservedUserName(req.UserName) {
+		return util.NewAPIError(util.ErrBadRequest, errors.Errorf("user name %q is reserved", req.UserName))
+	}
+	if req.Email != "" && !util.ValidateEmail(req.Email) {
+		return util.NewAPIError(util.ErrBadRequest, errors.Errorf("invalid user email %q", req.Email))
+	}
+
+	return nil
+}
+
+func (h *ActionHandler) CreateUser(ctx context.Context, req *CreateUserRequest) (*types.User, error) {
+	if err := h.validateCreateUserRequest(req); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	var user *types.User
+	err := h.d.Do(ctx, func(tx *sql.Tx) error {
+		var err error
+		user, err = h.createUser(tx, req)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		return errors.WithStack(h.logAuditEvent(ctx, tx, AuditActionUserCreate, types.UserKind, user.ID, user.ID))
+	})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return user, nil
+}
+
+// createUser creates the user, its optional linked account and its root
+// project group inside the provided transaction.
+func (h *ActionHandler) createUser(tx *sql.Tx, req *CreateUserRequest) (*types.User, error) {
+	// check duplicate user name, ignoring case
+	users, err := h.d.GetUsersByNameCaseInsensitive(tx, req.UserName)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if len(users) > 0 {
+		return nil, util.NewAPIError(util.ErrConflict, errors.Errorf("user with name %q already exists", users[0].Name))
+	}
+
+	if req.Email != "" {
+		// check duplicate user email
+		u, err := h.d.GetUserByEmail(tx, req.Email)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if u != nil {
+			return nil, util.NewAPIError(util.ErrConflict, errors.Errorf("user with email %q already exists", req.Email))
+		}
+	}
+
+	var rs *types.RemoteSource
+	if req.CreateUserLARequest != nil {
+		rs, err = h.d.GetRemoteSourceByName(tx, req.CreateUserLARequest.RemoteSourceName)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if rs == nil {
+			return nil, util.NewAPIError(util.ErrBadRequest, errors.Errorf("remote source %q doesn't exist", req.CreateUserLARequest.RemoteSourceName))
+		}
+		la, err := h.d.GetLinkedAccountByRemoteUserIDandSource(tx, req.CreateUserLARequest.RemoteUserID, rs.ID)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to get linked account for remote user id %q and remote source %q", req.CreateUserLARequest.RemoteUserID, rs.ID)
+		}
+		if la != nil {
+			return nil, util.NewAPIError(util.ErrConflict, errors.Errorf("linked account for remote user id %q for remote source %q already exists", req.CreateUserLARequest.RemoteUserID, req.CreateUserLARequest.RemoteSourceName))
+		}
+	}
+
+	user := types.NewUser(tx)
+	user.Name = req.UserName
+	user.Email = req.Email
+	user.Secret = util.EncodeSha1Hex(uuid.Must(uuid.NewV4()).String())
+
+	if req.CreateUserLARequest != nil {
+		la := types.NewLinkedAccount(tx)
+		la.UserID = user.ID
+		la.RemoteSourceID = rs.ID
+		la.RemoteUserID = req.CreateUserLARequest.RemoteUserID
+		la.RemoteUserName = req.CreateUserLARequest.RemoteUserName
+		la.UserAccessToken = req.CreateUserLARequest.UserAccessToken
+		la.Oauth2AccessToken = req.CreateUserLARequest.Oauth2AccessToken
+		la.Oauth2RefreshToken = req.CreateUserLARequest.Oauth2RefreshToken
+		la.Oauth2AccessTokenExpiresAt = req.CreateUserLARequest.Oauth2AccessTokenExpiresAt
+
+		if err := h.d.InsertLinkedAccount(tx, la); err != nil {
+			return nil, errors.WithStack(util.MapDBError(err))
+		}
+	}
+
+	// create root user project group
+	pg := types.NewProjectGroup(tx)
+	// use public visibility
+	pg.Visibility = types.VisibilityPublic
+	pg.Parent = types.Parent{
+		Kind: types.ObjectKindUser,
+		ID:   user.ID,
+	}
+
+	if err := h.d.InsertUser(tx, user); err != nil {
+		return nil, errors.WithStack(util.MapDBError(err))
+	}
+	if err := h.d.InsertProjectGroup(tx, pg); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return user, nil
+}
+
+type CreateUserAndAcceptInvitationRequest struct {
+	CreateUserRequest *CreateUserRequest
+
+	InvitationToken string
+}
+
+// CreateUserAndAcceptInvitation creates a new user and, in the same
+// transaction, consumes the org invitation or org invite link with the
+// provided token adding the user as org member with the invitation role. If
+// the invitation isn't valid the user isn't created.
+func (h *ActionHandler) CreateUserAndAcceptInvitation(ctx context.Context, req *CreateUserAndAcceptInvitationRequest) (*types.User, error) {
+	if req.CreateUserRequest == nil {
+		return nil, util.NewAPIError(util.ErrBadRequest, errors.Errorf("create user request required"))
+	}
+	if err := h.validateCreateUserRequest(req.CreateUserRequest); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if req.InvitationToken == "" {
+		return nil, util.NewAPIError(util.ErrBadRequest, errors.Errorf("invitation token required"))
+	}
+
+	var user *types.User
+	err := h.d.Do(ctx, func(tx *sql.Tx) error {
+		orgInvitation, err := h.d.GetOrgInvitationByToken(tx, req.InvitationToken)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if orgInvitation == nil {
+			// the token could be an org invite link token
+			orgInviteLink, err := h.getValidOrgInviteLink(tx, req.InvitationToken)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+
+			user, err = h.createUser(tx, req.CreateUserRequest)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			if err := h.logAuditEvent(ctx, tx, AuditActionUserCreate, types.UserKind, user.ID, user.ID); err != nil {
+				return errors.WithStack(err)
+			}
+
+			return errors.WithStack(h.redeemOrgInviteLink(tx, orgInviteLink, user))
+		}
+		if orgInvitation.IsExpired(time.Now()) {
+			return util.NewAPIError(util.ErrBadRequest, errors.Errorf("invitation expired"))
+		}
+
+		org, err := h.d.GetOrgByID(tx, orgInvitation.OrganizationID)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if org == nil {
+			return util.NewAPIError(util.ErrBadRequest, errors.Errorf("invitation organization doesn't exist"))
+		}
+
+		if err := h.checkOrgMemberLimit(tx, org); err != nil {
+			return errors.WithStack(err)
+		}
+
+		user, err = h.createUser(tx, req.CreateUserRequest)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if err := h.logAuditEvent(ctx, tx, AuditActionUserCreate, types.UserKind, user.ID, user.ID); err != nil {
+			return errors.WithStack(err)
+		}
+
+		orgMember := types.NewOrganizationMember(tx)
+		orgMember.OrganizationID = org.ID
+		orgMember.UserID = user.ID
+		orgMember.MemberRole = orgInvitation.Role
+
+		if err := h.d.InsertOrganizationMember(tx, orgMember); err != nil {
+			return errors.WithStack(err)
+		}
+		if err := h.d.DeleteOrgInvitation(tx, orgInvitation.ID); err != nil {
+			return errors.WithStack(err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return user, nil
+}
+
+// GetUser returns the user with the provided ref. Soft deleted users are
+// returned only when includeDeleted is true.
+func (h *ActionHandler) GetUser(ctx context.Context, userRef string, includeDeleted bool) (*types.User, error) {
+	var user *types.User
+	err := h.d.Do(ctx, func(tx *sql.Tx) error {
+		var err error
+		user, err = h.d.GetUser(tx, userRef)
+		return errors.WithStack(err)
+	})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	if user == nil || (user.IsDeleted() && !includeDeleted) {
+		return nil, util.NewAPIError(util.ErrNotExist, errors.Errorf("user %q doesn't exist", userRef))
+	}
+
+	return user, nil
+}
+
+type DeleteUserRequest struct {
+	UserRef string
+	// TransferToUserRef, when set, is the user receiving the deleted user
+	// root project group projects, subgroups, secrets and variables.
+	// Otherwise they're deleted.
+	TransferToUserRef string
+	// SoftDelete, when true, archives the user instead of removing it. The
+	// user is marked as deleted and its tokens and linked accounts are
+	// deactivated. The user root project group is kept.
+	SoftDelete bool
+}
+
+func (h *ActionHandler) DeleteUser(ctx context.Context, req *DeleteUserRequest) error {
+	err := h.d.Do(ctx, func(tx *sql.Tx) error {
+		var err error
+
+		// check user existance
+		user, err := h.d.GetUser(tx, req.UserRef)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if user == nil {
+			return util.NewAPIError(util.ErrBadRequest, errors.Errorf("user %q doesn't exist", req.UserRef))
+		}
+
+		var transferToUser *types.User
+		if req.TransferToUserRef != "" {
+			transferToUser, err = h.d.GetUser(tx, req.TransferToUserRef)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			if transferToUser == nil {
+				return util.NewAPIError(util.ErrBadRequest, errors.Errorf("user %q doesn't exist", req.TransferToUserRef))
+			}
+			if transferToUser.ID == user.ID {
+				return util.NewAPIError(util.ErrBadRequest, errors.Errorf("cannot transfer user %q projects to the same user", req.UserRef))
+			}
+			if transferToUser.IsDeleted() {
+				return util.NewAPIError(util.ErrBadRequest, errors.Errorf("user %q is deleted", req.TransferToUserRef))
+			}
+		}
+
+		if req.SoftDelete {
+			if user.IsDeleted() {
+				return util.NewAPIError(util.ErrBadRequest, errors.Errorf("user %q is already deleted", req.UserRef))
+			}
+			err = h.softDeleteUser(tx, user, transferToUser)
+		} else {
+			err = h.deleteUser(tx, user, transferToUser)
+		}
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		return errors.WithStack(h.logAuditEvent(ctx, tx, AuditActionUserDelete, types.UserKind, user.ID, user.ID))
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	return errors.WithStack(err)
+}
+
+// deleteUser deletes the user and its root project group. When
+// transferToUser isn't nil the root project group contents are moved to the
+// transferToUser root project group, otherwise they're deleted.
+func (h *ActionHandler) deleteUser(tx *sql.Tx, user *types.User, transferToUser *types.User) error {
+	userOrgInvitations, err := h.d.GetOrgInvitationByUserID(tx, user.ID)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	for _, orgInvitation := range userOrgInvitations {
+		err = h.d.DeleteOrgInvitation(tx, orgInvitation.ID)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	rootProjectGroup, err := h.d.GetProjectGroup(tx, path.Join("user", user.Name))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if rootProjectGroup != nil {
+		if transferToUser != nil {
+			if err := h.transferProjectGroupContents(tx, rootProjectGroup, path.Join("user", transferToUser.Name)); err != nil {
+				return errors.WithStack(err)
+			}
+		}
+		if err := h.deleteProjectGroupTree(tx, rootProjectGroup); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	if err := h.d.DeleteUser(tx, user.ID); err != nil {
+		return errors.WithStack(err)
+	}
+
+	return nil
+}
+
+// softDeleteUser marks the user as deleted, expires its tokens and removes
+// the credentials of its linked accounts. When transferToUser isn't nil the
+// user root project group contents are moved to the transferToUser root
+// project group.
+func (h *ActionHandler) softDeleteUser(tx *sql.Tx, user *types.User, transferToUser *types.User) error {
+	now := time.Now()
+
+	userOrgInvitations, err := h.d.GetOrgInvitationByUserID(tx, user.ID)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	for _, orgInvitation := range userOrgInvitations {
+		err = h.d.DeleteOrgInvitation(tx, orgInvitation.ID)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	if transferToUser != nil {
+		rootProjectGroup, err := h.d.GetProjectGroup(tx, path.Join("user", user.Name))
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if rootProjectGroup != nil {
+			if err := h.transferProjectGroupContents(tx, rootProjectGroup, path.Join("user", transferToUser.Name)); err != nil {
+				return errors.WithStack(err)
+			}
+		}
+	}
+
+	userTokens, err := h.d.GetUserTokens(tx, user.ID)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	for _, userToken := range userTokens {
+		if userToken.IsExpired(now) {
+			continue
+		}
+		userToken.ExpiresAt = &now
+		if err := h.d.UpdateUserToken(tx, userToken); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	linkedAccounts, err := h.d.GetUserLinkedAccounts(tx, user.ID)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	for _, la := range linkedAccounts {
+		la.UserAccessToken = ""
+		la.Oauth2AccessToken = ""
+		la.Oauth2RefreshToken = ""
+		la.Oauth2AccessTokenExpiresAt = time.Time{}
+		if err := h.d.UpdateLinkedAccount(tx, la); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	user.DeletedAt = &now
+	if err := h.d.UpdateUser(tx, user); err != nil {
+		return errors.WithStack(err)
+	}
+
+	return nil
+}
+
+// transferProjectGroupContents moves the projects, subgroups, secrets and
+// variables of the project group to the project group with the provided ref.
+// It fails if the target project group already contains an object with the
+// same name.
+func (h *ActionHandler) transferProjectGroupContents(tx *sql.Tx, projectGroup *types.ProjectGroup, toProjectGroupRef string) error {
+	toProjectGroup, err := h.d.GetProjectGroup(tx, toProjectGroupRef)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if toProjectGroup == nil {
+		return util.NewAPIError(util.ErrBadRequest, errors.Errorf("project group %q doesn't exist", toProjectGroupRef))
+	}
+
+	projects, err := h.d.GetProjectGroupProjects(tx, projectGroup.ID)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	for _, project := range projects {
+		ap, err := h.d.GetProjectByName(tx, toProjectGroup.ID, project.Name)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if ap != nil {
+			return util.NewAPIError(util.ErrConflict, errors.Errorf("project with name %q, path %q already exists", project.Name, path.Join(toProjectGroupRef, project.Name)))
+		}
+		project.Parent.ID = toProjectGroup.ID
+		if err := h.d.UpdateProject(tx, project); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	subgroups, err := h.d.GetProjectGroupSubgroups(tx, projectGroup.ID)
+	if err != nil {
+		return errors.WithStack(err)
 	}
+	for _, subgroup := range subgroups {
+		apg, err := h.d.GetProjectGroupByName(tx, toProjectGroup.ID, subgroup.Name)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if apg != nil {
+			return util.NewAPIError(util.ErrConflict, errors.Errorf("project group with name %q, path %q already exists", subgroup.Name, path.Join(toProjectGroupRef, subgroup.Name)))
+		}
+		subgroup.Parent.ID = toProjectGroup.ID
+		if err := h.d.UpdateProjectGroup(tx, subgroup); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	secrets, err := h.d.GetSecrets(tx, projectGroup.ID)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	for _, secret := range secrets {
+		as, err := h.d.GetSecretByName(tx, toProjectGroup.ID, secret.Name)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if as != nil {
+			return util.NewAPIError(util.ErrConflict, errors.Errorf("secret with name %q for project group %q already exists", secret.Name, toProjectGroupRef))
+		}
+		secret.Parent.ID = toProjectGroup.ID
+		if err := h.d.UpdateSecret(tx, secret); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	variables, err := h.d.GetVariables(tx, projectGroup.ID)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	for _, variable := range variables {
+		av, err := h.d.GetVariableByName(tx, toProjectGroup.ID, variable.Name)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if av != nil {
+			return util.NewAPIError(util.ErrConflict, errors.Errorf("variable with name %q for project group %q already exists", variable.Name, toProjectGroupRef))
+		}
+		variable.Parent.ID = toProjectGroup.ID
+		if err := h.d.UpdateVariable(tx, variable); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	return nil
+}
+
+// deleteProjectGroupTree deletes the project group, all its subgroups and
+// projects and their secrets and variables.
+func (h *ActionHandler) deleteProjectGroupTree(tx *sql.Tx, projectGroup *types.ProjectGroup) error {
+	subgroups, err := h.getAllProjectGroupSubgroups(tx, projectGroup.ID)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	for _, pg := range append(subgroups, projectGroup) {
+		projects, err := h.d.GetProjectGroupProjects(tx, pg.ID)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		for _, project := range projects {
+			if err := h.deleteParentSecretsAndVariables(tx, project.ID); err != nil {
+				return errors.WithStack(err)
+			}
+			if err := h.d.DeleteProject(tx, project.ID); err != nil {
+				return errors.WithStack(err)
+			}
+		}
+
+		if err := h.deleteParentSecretsAndVariables(tx, pg.ID); err != nil {
+			return errors.WithStack(err)
+		}
+		if err := h.d.DeleteProjectGroup(tx, pg.ID); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	return nil
+}
+
+// deleteParentSecretsAndVariables deletes the secrets and variables of the
+// project or project group with the provided id.
+func (h *ActionHandler) deleteParentSecretsAndVariables(tx *sql.Tx, parentID string) error {
+	secrets, err := h.d.GetSecrets(tx, parentID)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	for _, secret := range secrets {
+		if err := h.d.DeleteSecret(tx, secret.ID); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	variables, err := h.d.GetVariables(tx, parentID)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	for _, variable := range variables {
+		if err := h.d.DeleteVariable(tx, variable.ID); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	return nil
+}
+
+type SkippedUser struct {
+	User   *types.User
+	Reason string
+}
+
+type FailedUser struct {
+	User *types.User
+	Err  error
+}
+
+type DeleteInactiveUsersResponse struct {
+	// Deleted are the deleted users. In dry run mode they are the users that
+	// would be deleted.
+	Deleted []*types.User
+	// Skipped are the inactive users that cannot be deleted since they own
+	// shared resources
+	Skipped []*SkippedUser
+	// Failed are the inactive users whose deletion failed
+	Failed []*FailedUser
+}
+
+// DeleteInactiveUsers deletes the users created before inactiveSince and
+// without tokens or linked accounts used since then. Users with a token or
+// linked account without a recorded last used time aren't considered inactive
+// since their last use is unknown. Every user is deleted in its own
+// transaction. Users owning shared resources are skipped. In dry run mode
+// nothing is deleted and the response reports what would be done.
+func (h *ActionHandler) DeleteInactiveUsers(ctx context.Context, inactiveSince time.Time, dryRun bool) (*DeleteInactiveUsersResponse, error) {
+	var inactiveUsers []*types.User
+	err := h.d.Do(ctx, func(tx *sql.Tx) error {
+		users, err := h.d.GetUsers(tx, "", "", 0, true, true)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		for _, user := range users {
+			inactive, err := h.isUserInactive(tx, user, inactiveSince)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			if inactive {
+				inactiveUsers = append(inactiveUsers, user)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	res := &DeleteInactiveUsersResponse{
+		Deleted: []*types.User{},
+		Skipped: []*SkippedUser{},
+		Failed:  []*FailedUser{},
+	}
+	for _, user := range inactiveUsers {
+		var deleted bool
+		var skipReason string
+		err := h.d.Do(ctx, func(tx *sql.Tx) error {
+			deleted = false
+			skipReason = ""
+
+			// check again the user since it could have been changed or used
+			user, err := h.d.GetUserByID(tx, user.ID)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			if user == nil {
+				return nil
+			}
+			inactive, err := h.isUserInactive(tx, user, inactiveSince)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			if !inactive {
+				return nil
+			}
+
+			skipReason, err = h.userOwnsSharedResources(tx, user)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			if skipReason != "" {
+				return nil
+			}
+
+			deleted = true
+			if dryRun {
+				return nil
+			}
+
+			if err := h.deleteUser(tx, user, nil); err != nil {
+				return errors.WithStack(err)
+			}
+
+			return errors.WithStack(h.logAuditEvent(ctx, tx, AuditActionUserDelete, types.UserKind, user.ID, user.ID))
+		})
+		switch {
+		case err != nil:
+			res.Failed = append(res.Failed, &FailedUser{User: user, Err: err})
+		case skipReason != "":
+			res.Skipped = append(res.Skipped, &SkippedUser{User: user, Reason: skipReason})
+		case deleted:
+			res.Deleted = append(res.Deleted, user)
+		}
+	}
+
+	return res, nil
+}
+
+// isUserInactive reports whether the user was created before inactiveSince
+// and none of its tokens and linked accounts were used since then. A token or
+// linked account without a last used time, i.e. never used or used before its
+// use was recorded, makes the user not inactive.
+func (h *ActionHandler) isUserInactive(tx *sql.Tx, user *types.User, inactiveSince time.Time) (bool, error) {
+	if !user.CreationTime.Before(inactiveSince) {
+		return false, nil
+	}
+
+	tokens, err := h.d.GetUserTokens(tx, user.ID)
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	for _, token := range tokens {
+		if token.LastUsedAt == nil || !token.LastUsedAt.Before(inactiveSince) {
+			return false, nil
+		}
+	}
+
+	linkedAccounts, err := h.d.GetUserLinkedAccounts(tx, user.ID)
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	for _, la := range linkedAccounts {
+		if la.LastUsedAt == nil || !la.LastUsedAt.Before(inactiveSince) {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// userOwnsSharedResources returns the reason why the user owns shared
+// resources that would be left without an owner, or an empty string.
+func (h *ActionHandler) userOwnsSharedResources(tx *sql.Tx, user *types.User) (string, error) {
+	if user.Admin {
+		return "user is an admin", nil
+	}
+
+	userOrgs, err := h.d.GetUserOrgs(tx, user.ID, nil)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	for _, userOrg := range userOrgs {
+		if userOrg.Role != types.MemberRoleOwner {
+			continue
+		}
+		orgUsers, err := h.d.GetOrgUsers(tx, userOrg.Organization.ID)
+		if err != nil {
+			return "", errors.WithStack(err)
+		}
+		owners := 0
+		for _, orgUser := range orgUsers {
+			if orgUser.Role == types.MemberRoleOwner {
+				owners++
+			}
+		}
+		if owners == 1 {
+			return fmt.Sprintf("user is the only owner of organization %q", userOrg.Organization.Name), nil
+		}
+	}
+
+	return "", nil
+}
+
+type UpdateUserRequest struct {
+	UserRef string
+
+	UserName string
+	// Email, when not nil, sets the user email. An empty email removes it.
+	Email *string
+	// Disabled, when not nil, disables or enables the user
+	Disabled *bool
+}
+
+type UpdateUserResponse struct {
+	User *types.User
+	// PreviousName is the user name before the update. It differs from the
+	// user name when the user has been renamed so the callers can reconcile
+	// the references to the user by name.
+	PreviousName string
+}
+
+func (h *ActionHandler) UpdateUser(ctx context.Context, req *UpdateUserRequest) (*UpdateUserResponse, error) {
+	if req.UserName != "" && h.isReservedUserName(req.UserName) {
+		return nil, util.NewAPIError(util.ErrBadRequest, errors.Errorf("user name %q is reserved", req.UserName))
+	}
+
+	var user *types.User
+	var previousName string
+
+	err := h.d.Do(ctx, func(tx *sql.Tx) error {
+		var err error
+		user, err = h.d.GetUser(tx, req.UserRef)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if user == nil {
+			return util.NewAPIError(util.ErrBadRequest, errors.Errorf("user %q doesn't exist", req.UserRef))
+		}
+		previousName = user.Name
+
+		if req.UserName != "" {
+			// check duplicate user name, ignoring case. The user can change
+			// the case of its own name.
+			users, err := h.d.GetUsersByNameCaseInsensitive(tx, req.UserName)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			for _, u := range users {
+				if u.ID != user.ID {
+					return util.NewAPIError(util.ErrConflict, errors.Errorf("user with name %q already exists", u.Name))
+				}
+			}
+
+			user.Name = req.UserName
+		}
+
+		if req.Email != nil && *req.Email != user.Email {
+			if *req.Email != "" {
+				if !util.ValidateEmail(*req.Email) {
+					return util.NewAPIError(util.ErrBadRequest, errors.Errorf("invalid user email %q", *req.Email))
+				}
+
+				// check duplicate user email
+				u, err := h.d.GetUserByEmail(tx, *req.Email)
+				if err != nil {
+					return errors.WithStack(err)
+				}
+				if u != nil && u.ID != user.ID {
+					return util.NewAPIError(util.ErrConflict, errors.Errorf("user with email %q already exists", *req.Email))
+				}
+			}
+
+			user.Email = *req.Email
+		}
+
+		if req.Disabled != nil {
+			user.Disabled = *req.Disabled
+		}
+
+		if err := h.d.UpdateUser(tx, user); err != nil {
+			return errors.WithStack(err)
+		}
+
+		return errors.WithStack(h.logAuditEvent(ctx, tx, AuditActionUserUpdate, types.UserKind, user.ID, user.ID))
+	})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return &UpdateUserResponse{User: user, PreviousName: previousName}, nil
+}
+
+// RotateUserSecret replaces the user secret with a new random value and
+// returns the updated user. Everything derived from or signed with the
+// previous secret (like sessions or signatures) isn't valid anymore and must
+// be derived again from the new secret.
+func (h *ActionHandler) RotateUserSecret(ctx context.Context, userRef string) (*types.User, error) {
+	if userRef == "" {
+		return nil, util.NewAPIError(util.ErrBadRequest, errors.Errorf("user ref required"))
+	}
+
+	var user *types.User
+	err := h.d.Do(ctx, func(tx *sql.Tx) error {
+		var err error
+		user, err = h.d.GetUser(tx, userRef)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if user == nil {
+			return util.NewAPIError(util.ErrNotExist, errors.Errorf("user %q doesn't exist", userRef))
+		}
+
+		user.Secret = util.EncodeSha1Hex(uuid.Must(uuid.NewV4()).String())
+
+		if err := h.d.UpdateUser(tx, user); err != nil {
+			return errors.WithStack(err)
+		}
+
+		return errors.WithStack(h.logAuditEvent(ctx, tx, AuditActionUserSecretRotate, types.UserKind, user.ID, user.ID))
+	})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return user, nil
+}
+
+func (h *ActionHandler) GetUserLinkedAccounts(ctx context.Context, userRef string) ([]*types.LinkedAccount, error) {
+	if userRef == "" {
+		return nil, util.NewAPIError(util.ErrBadRequest, errors.Errorf("user ref required"))
+	}
+
+	var linkedAccounts []*types.LinkedAccount
+	err := h.d.Do(ctx, func(tx *sql.Tx) error {
+		user, err := h.d.GetUser(tx, userRef)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if user == nil {
+			return util.NewAPIError(util.ErrBadRequest, errors.Errorf("user %q doesn't exist", userRef))
+		}
+
+		linkedAccounts, err = h.d.GetUserLinkedAccounts(tx, user.ID)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return linkedAccounts, errors.WithStack(err)
+}
+
+// GetUserByRemoteUser returns the user owning the linked account of the
+// provided remote user on the remote source.
+func (h *ActionHandler) GetUserByRemoteUser(ctx context.Context, remoteSourceRef, remoteUserID string) (*types.User, error) {
+	if remoteSourceRef == "" {
+		return nil, util.NewAPIError(util.ErrBadRequest, errors.Errorf("remote source ref required"))
+	}
+	if remoteUserID == "" {
+		return nil, util.NewAPIError(util.ErrBadRequest, errors.Errorf("remote user id required"))
+	}
+
+	var user *types.User
+	err := h.d.Do(ctx, func(tx *sql.Tx) error {
+		rs, err := h.d.GetRemoteSource(tx, remoteSourceRef)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if rs == nil {
+			return util.NewAPIError(util.ErrNotExist, errors.Errorf("remote source %q doesn't exist", remoteSourceRef))
+		}
+
+		la, err := h.d.GetLinkedAccountByRemoteUserIDandSource(tx, remoteUserID, rs.ID)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if la == nil {
+			return util.NewAPIError(util.ErrNotExist, errors.Errorf("linked account with remote user %q for remote source %q doesn't exist", remoteUserID, remoteSourceRef))
+		}
+
+		user, err = h.d.GetUser(tx, la.UserID)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if user == nil || user.IsDeleted() {
+			return util.NewAPIError(util.ErrNotExist, errors.Errorf("user with remote user %q for remote source %q doesn't exist", remoteUserID, remoteSourceRef))
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return user, nil
+}
+
+type UserLinkedAccountResponse struct {
+	LinkedAccount *types.LinkedAccount
+	RemoteSource  *types.RemoteSource
+}
+
+// GetUserLinkedAccountsByRemoteSourceType returns the user linked accounts
+// whose remote source is of the provided type, with their remote source.
+func (h *ActionHandler) GetUserLinkedAccountsByRemoteSourceType(ctx context.Context, userRef string, rsType types.RemoteSourceType) ([]*UserLinkedAccountResponse, error) {
+	if userRef == "" {
+		return nil, util.NewAPIError(util.ErrBadRequest, errors.Errorf("user ref required"))
+	}
+	if !types.IsValidRemoteSourceType(rsType) {
+		return nil, util.NewAPIError(util.ErrBadRequest, errors.Errorf("invalid remotesource type %q", rsType))
+	}
+
+	var res []*UserLinkedAccountResponse
+	err := h.d.Do(ctx, func(tx *sql.Tx) error {
+		user, err := h.d.GetUser(tx, userRef)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if user == nil {
+			return util.NewAPIError(util.ErrBadRequest, errors.Errorf("user %q doesn't exist", userRef))
+		}
+
+		linkedAccounts, err := h.d.GetUserLinkedAccounts(tx, user.ID)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		remoteSourceIDs := make([]string, len(linkedAccounts))
+		for i, la := range linkedAccounts {
+			remoteSourceIDs[i] = la.RemoteSourceID
+		}
+		remoteSources, err := h.d.GetRemoteSourcesByIDs(tx, remoteSourceIDs)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		remoteSourcesMap := make(map[string]*types.RemoteSource, len(remoteSources))
+		for _, rs := range remoteSources {
+			remoteSourcesMap[rs.ID] = rs
+		}
+
+		res = []*UserLinkedAccountResponse{}
+		for _, la := range linkedAccounts {
+			rs, ok := remoteSourcesMap[la.RemoteSourceID]
+			if !ok || rs.Type != rsType {
+				continue
+			}
+			res = append(res, &UserLinkedAccountResponse{LinkedAccount: la, RemoteSource: rs})
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return res, nil
+}
+
+type CreateUserLARequest struct {
+	UserRef string
+
+	RemoteSourceName           string
+	RemoteUserID               string
+	RemoteUserName             string
+	UserAccessToken            string
+	Oauth2AccessToken          string
+	Oauth2RefreshToken         string
+	Oauth2AccessTokenExpiresAt time.Time
+}
+
+func (h *ActionHandler) CreateUserLA(ctx context.Context, req *CreateUserLARequest) (*types.LinkedAccount, error) {
+	if req.UserRef == "" {
+		return nil, util.NewAPIError(util.ErrBadRequest, errors.Errorf("user ref required"))
+	}
+	if req.RemoteSourceName == "" {
+		return nil, util.NewAPIError(util.ErrBadRequest, errors.Errorf("remote source name required"))
+	}
+
+	var la *types.LinkedAccount
+	err := h.d.Do(ctx, func(tx *sql.Tx) error {
+		user, err := h.d.GetUser(tx, req.UserRef)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if user == nil {
+			return util.NewAPIError(util.ErrBadRequest, errors.Errorf("user %q doesn't exist", req.UserRef))
+		}
+
+		rs, err := h.d.GetRemoteSourceByName(tx, req.RemoteSourceName)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if rs == nil {
+			return util.NewAPIError(util.ErrBadRequest, errors.Errorf("remote source %q doesn't exist", req.RemoteSourceName))
+		}
+
+		la, err = h.d.GetLinkedAccountByRemoteUserIDandSource(tx, req.RemoteUserID, rs.ID)
+		if err != nil {
+			return errors.Wrapf(err, "failed to get linked account for remote user id %q and remote source %q", req.RemoteUserID, rs.ID)
+		}
+		if la != nil {
+			return util.NewAPIError(util.ErrConflict, errors.Errorf("linked account for remote user id %q for remote source %q already exists", req.RemoteUserID, req.RemoteSourceName))
+		}
+
+		la = types.NewLinkedAccount(tx)
+		la.UserID = user.ID
+		la.RemoteSourceID = rs.ID
+		la.RemoteUserID = req.RemoteUserID
+		la.RemoteUserName = req.RemoteUserName
+		la.UserAccessToken = req.UserAccessToken
+		la.Oauth2AccessToken = req.Oauth2AccessToken
+		la.Oauth2RefreshToken = req.Oauth2RefreshToken
+		la.Oauth2AccessTokenExpiresAt = req.Oauth2AccessTokenExpiresAt
+
+		if err := h.d.InsertLinkedAccount(tx, la); err != nil {
+			return errors.WithStack(util.MapDBError(err))
+		}
+
+		return errors.WithStack(h.logAuditEvent(ctx, tx, AuditActionLinkedAccountCreate, types.LinkedAccountKind, la.ID, la.UserID))
+	})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return la, errors.WithStack(err)
+}
+
+func (h *ActionHandler) DeleteUserLA(ctx context.Context, userRef, laID string) error {
+	if userRef == "" {
+		return util.NewAPIError(util.ErrBadRequest, errors.Errorf("user ref  required"))
+	}
+	if laID == "" {
+		return util.NewAPIError(util.ErrBadRequest, errors.Errorf("user linked account id required"))
+	}
+
+	var user *types.User
+
+	err := h.d.Do(ctx, func(tx *sql.Tx) error {
+		var err error
+		user, err = h.d.GetUser(tx, userRef)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if user == nil {
+			return util.NewAPIError(util.ErrBadRequest, errors.Errorf("user %q doesn't exist", userRef))
+		}
+
+		la, err := h.d.GetLinkedAccount(tx, laID)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if la == nil {
+			return util.NewAPIError(util.ErrBadRequest, errors.Errorf("linked account id %q for user %q doesn't exist", laID, userRef))
+		}
+
+		// check that the linked account belongs to the right user
+		if user.ID != la.UserID {
+			return util.NewAPIError(util.ErrBadRequest, errors.Errorf("linked account id %q for user %q doesn't exist", laID, userRef))
+		}
+
+		if err := h.d.DeleteLinkedAccount(tx, la.ID); err != nil {
+			return errors.WithStack(err)
+		}
+
+		return errors.WithStack(h.logAuditEvent(ctx, tx, AuditActionLinkedAccountDelete, types.LinkedAccountKind, la.ID, la.UserID))
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	return errors.WithStack(err)
+}
+
+type UpdateUserLARequest struct {
+	UserRef string
+
+	LinkedAccountID            string
+	RemoteUserID               string
+	RemoteUserName             string
+	UserAccessToken            string
+	Oauth2AccessToken          string
+	Oauth2RefreshToken         string
+	Oauth2AccessTokenExpiresAt time.Time
+}
+
+func (h *ActionHandler) UpdateUserLA(ctx context.Context, req *UpdateUserLARequest) (*types.LinkedAccount, error) {
+	if req.UserRef == "" {
+		return nil, util.NewAPIError(util.ErrBadRequest, errors.Errorf("user ref required"))
+	}
+
+	var la *types.LinkedAccount
+	err := h.d.Do(ctx, func(tx *sql.Tx) error {
+		user, err := h.d.GetUser(tx, req.UserRef)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if user == nil {
+			return util.NewAPIError(util.ErrBadRequest, errors.Errorf("user %q doesn't exist", req.UserRef))
+		}
+
+		la, err = h.d.GetLinkedAccount(tx, req.LinkedAccountID)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if la == nil {
+			return util.NewAPIError(util.ErrBadRequest, errors.Errorf("linked account id %q for user %q doesn't exist", req.LinkedAccountID, req.UserRef))
+		}
 
-	var user *types.User
-	err := h.d.Do(ctx, func(tx *sql.Tx) error {
-		var err error
+		// check that the linked account belongs to the right user
+		if user.ID != la.UserID {
+			return util.NewAPIError(util.ErrBadRequest, errors.Errorf("linked account id %q for user %q doesn't exist", req.LinkedAccountID, req.UserRef))
+		}
 
-		// check duplicate user name
-		u, err := h.d.GetUserByName(tx, req.UserName)
+		rs, err := h.d.GetRemoteSource(tx, la.RemoteSourceID)
 		if err != nil {
 			return errors.WithStack(err)
 		}
-		if u != nil {
-			return util.NewAPIError(util.ErrBadRequest, errors.Errorf("user with name %q already exists", u.Name))
+		if rs == nil {
+			return util.NewAPIError(util.ErrBadRequest, errors.Errorf("remote source with id %q doesn't exist", la.RemoteSourceID))
 		}
 
-		var rs *types.RemoteSource
-		if req.CreateUserLARequest != nil {
-			rs, err = h.d.GetRemoteSourceByName(tx, req.CreateUserLARequest.RemoteSourceName)
-			if err != nil {
-				return errors.WithStack(err)
-			}
-			if rs == nil {
-				return util.NewAPIError(util.ErrBadRequest, errors.Errorf("remote source %q doesn't exist", req.CreateUserLARequest.RemoteSourceName))
-			}
-			la, err := h.d.GetLinkedAccountByRemoteUserIDandSource(tx, req.CreateUserLARequest.RemoteUserID, rs.ID)
-			if err != nil {
-				return errors.Wrapf(err, "failed to get linked account for remote user id %q and remote source %q", req.CreateUserLARequest.RemoteUserID, rs.ID)
-			}
-			if la != nil {
-				return util.NewAPIError(util.ErrBadRequest, errors.Errorf("linked account for remote user id %q for remote source %q already exists", req.CreateUserLARequest.RemoteUserID, req.CreateUserLARequest.RemoteSourceName))
-			}
+		// check that the remote user isn't linked by another linked account
+		ola, err := h.d.GetLinkedAccountByRemoteUserIDandSource(tx, req.RemoteUserID, rs.ID)
+		if err != nil {
+			return errors.Wrapf(err, "failed to get linked account for remote user id %q and remote source %q", req.RemoteUserID, rs.ID)
+		}
+		if ola != nil && ola.ID != la.ID {
+			return util.NewAPIError(util.ErrConflict, errors.Errorf("linked account for remote user id %q for remote source %q already exists", req.RemoteUserID, rs.Name))
 		}
 
-		user = types.NewUser(tx)
-		user.Name = req.UserName
-		user.Secret = util.EncodeSha1Hex(uuid.Must(uuid.NewV4()).String())
+		la.RemoteUserID = req.RemoteUserID
+		la.RemoteUserName = req.RemoteUserName
+		la.UserAccessToken = req.UserAccessToken
+		la.Oauth2AccessToken = req.Oauth2AccessToken
+		la.Oauth2RefreshToken = req.Oauth2RefreshToken
+		la.Oauth2AccessTokenExpiresAt = req.Oauth2AccessTokenExpiresAt
 
-		if req.CreateUserLARequest != nil {
-			la := types.NewLinkedAccount(tx)
-			la.UserID = user.ID
-			la.RemoteSourceID = rs.ID
-			la.RemoteUserID = req.CreateUserLARequest.RemoteUserID
-			la.RemoteUserName = req.CreateUserLARequest.RemoteUserName
-			la.UserAccessToken = req.CreateUserLARequest.UserAccessToken
-			la.Oauth2AccessToken = req.CreateUserLARequest.Oauth2AccessToken
-			la.Oauth2RefreshToken = req.CreateUserLARequest.Oauth2RefreshToken
-			la.Oauth2AccessTokenExpiresAt = req.CreateUserLARequest.Oauth2AccessTokenExpiresAt
-
-			if err := h.d.InsertLinkedAccount(tx, la); err != nil {
-				return errors.WithStack(err)
-			}
+		if err := h.d.UpdateLinkedAccount(tx, la); err != nil {
+			return errors.WithStack(err)
 		}
 
-		// create root user project group
-		pg := types.NewProjectGroup(tx)
-		// use public visibility
-		pg.Visibility = types.VisibilityPublic
-		pg.Parent = types.Parent{
-			Kind: types.ObjectKindUser,
-			ID:   user.ID,
+		return nil
+	})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return la, errors.WithStack(err)
+}
+
+// RefreshLinkedAccountOauth2Token updates only the linked account oauth2
+// access token, refresh token and access token expiration time, leaving the
+// other linked account fields unchanged.
+func (h *ActionHandler) RefreshLinkedAccountOauth2Token(ctx context.Context, userRef, laID, newAccessToken, newRefreshToken string, expiresAt time.Time) (*types.LinkedAccount, error) {
+	if userRef == "" {
+		return nil, util.NewAPIError(util.ErrBadRequest, errors.Errorf("user ref required"))
+	}
+	if laID == "" {
+		return nil, util.NewAPIError(util.ErrBadRequest, errors.Errorf("linked account id required"))
+	}
+	if newAccessToken == "" {
+		return nil, util.NewAPIError(util.ErrBadRequest, errors.Errorf("access token required"))
+	}
+
+	var la *types.LinkedAccount
+	err := h.d.Do(ctx, func(tx *sql.Tx) error {
+		user, err := h.d.GetUser(tx, userRef)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if user == nil {
+			return util.NewAPIError(util.ErrBadRequest, errors.Errorf("user %q doesn't exist", userRef))
 		}
 
-		if err := h.d.InsertUser(tx, user); err != nil {
+		la, err = h.d.GetLinkedAccount(tx, laID)
+		if err != nil {
 			return errors.WithStack(err)
 		}
-		if err := h.d.InsertProjectGroup(tx, pg); err != nil {
+		// a linked account of another user is reported as not existing
+		if la == nil || la.UserID != user.ID {
+			return util.NewAPIError(util.ErrNotExist, errors.Errorf("linked account id %q for user %q doesn't exist", laID, userRef))
+		}
+
+		la.Oauth2AccessToken = newAccessToken
+		la.Oauth2RefreshToken = newRefreshToken
+		la.Oauth2AccessTokenExpiresAt = expiresAt
+
+		if err := h.d.UpdateLinkedAccount(tx, la); err != nil {
 			return errors.WithStack(err)
 		}
 
@@ -114,14 +1270,21 @@ func (h *ActionHandler) CreateUser(ctx context.Context, req *CreateUserRequest)
 		return nil, errors.WithStack(err)
 	}
 
-	return user, nil
+	return la, nil
 }
 
-func (h *ActionHandler) DeleteUser(ctx context.Context, userRef string) error {
-	err := h.d.Do(ctx, func(tx *sql.Tx) error {
-		var err error
+// MarkUserLAUsed sets the linked account last used time to usedAt, leaving the
+// other linked account fields unchanged. To avoid a write on every login, the
+// last used time is updated only if older than UserLALastUsedUpdateInterval.
+func (h *ActionHandler) MarkUserLAUsed(ctx context.Context, userRef, laID string, usedAt time.Time) error {
+	if userRef == "" {
+		return util.NewAPIError(util.ErrBadRequest, errors.Errorf("user ref required"))
+	}
+	if laID == "" {
+		return util.NewAPIError(util.ErrBadRequest, errors.Errorf("linked account id required"))
+	}
 
-		// check user existance
+	err := h.d.Do(ctx, func(tx *sql.Tx) error {
 		user, err := h.d.GetUser(tx, userRef)
 		if err != nil {
 			return errors.WithStack(err)
@@ -130,82 +1293,324 @@ func (h *ActionHandler) DeleteUser(ctx context.Context, userRef string) error {
 			return util.NewAPIError(util.ErrBadRequest, errors.Errorf("user %q doesn't exist", userRef))
 		}
 
-		userOrgInvitations, err := h.d.GetOrgInvitationByUserID(tx, user.ID)
+		la, err := h.d.GetLinkedAccount(tx, laID)
 		if err != nil {
 			return errors.WithStack(err)
 		}
-		for _, orgInvitation := range userOrgInvitations {
-			err = h.d.DeleteOrgInvitation(tx, orgInvitation.ID)
+		// a linked account of another user is reported as not existing
+		if la == nil || la.UserID != user.ID {
+			return util.NewAPIError(util.ErrNotExist, errors.Errorf("linked account id %q for user %q doesn't exist", laID, userRef))
+		}
+
+		if la.LastUsedAt != nil && usedAt.Sub(*la.LastUsedAt) < UserLALastUsedUpdateInterval {
+			return nil
+		}
+
+		la.LastUsedAt = &usedAt
+
+		return errors.WithStack(h.d.UpdateLinkedAccount(tx, la))
+	})
+
+	return errors.WithStack(err)
+}
+
+type GetLinkedAccountsRequest struct {
+	StartID string
+	Limit   int
+	Asc     bool
+
+	// RemoteSourceRef, when set, filters the linked accounts on the remote
+	// source
+	RemoteSourceRef string
+	// OmitTokens clears the linked accounts access and refresh tokens
+	OmitTokens bool
+}
+
+type GetLinkedAccountsResponse struct {
+	LinkedAccounts []*types.LinkedAccount
+	HasMore        bool
+}
+
+// GetLinkedAccounts returns the linked accounts of all the users. Linked
+// accounts are sorted by id and paginated using the id of the last returned
+// linked account as start.
+func (h *ActionHandler) GetLinkedAccounts(ctx context.Context, req *GetLinkedAccountsRequest) (*GetLinkedAccountsResponse, error) {
+	if req.Limit < 0 {
+		return nil, util.NewAPIError(util.ErrBadRequest, errors.Errorf("limit must be greater or equal than 0"))
+	}
+
+	var linkedAccounts []*types.LinkedAccount
+	err := h.d.Do(ctx, func(tx *sql.Tx) error {
+		var remoteSourceID string
+		if req.RemoteSourceRef != "" {
+			rs, err := h.d.GetRemoteSource(tx, req.RemoteSourceRef)
 			if err != nil {
 				return errors.WithStack(err)
 			}
+			if rs == nil {
+				return util.NewAPIError(util.ErrNotExist, errors.Errorf("remote source %q doesn't exist", req.RemoteSourceRef))
+			}
+			remoteSourceID = rs.ID
 		}
 
-		if err := h.d.DeleteUser(tx, user.ID); err != nil {
-			return errors.WithStack(err)
+		// fetch one more linked account to know if there're other linked accounts
+		queryLimit := req.Limit
+		if queryLimit > 0 {
+			queryLimit++
 		}
+		var err error
+		linkedAccounts, err = h.d.GetAllLinkedAccounts(tx, remoteSourceID, req.StartID, queryLimit, req.Asc)
+		return errors.WithStack(err)
+	})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
 
-		return nil
+	res := &GetLinkedAccountsResponse{LinkedAccounts: linkedAccounts}
+	if req.Limit > 0 && len(linkedAccounts) > req.Limit {
+		res.LinkedAccounts = linkedAccounts[:req.Limit]
+		res.HasMore = true
+	}
+
+	if req.OmitTokens {
+		for _, la := range res.LinkedAccounts {
+			la.UserAccessToken = ""
+			la.Oauth2AccessToken = ""
+			la.Oauth2RefreshToken = ""
+		}
+	}
+
+	return res, nil
+}
+
+type GetOrphanedLinkedAccountsResponse struct {
+	LinkedAccounts []*types.LinkedAccount
+	HasMore        bool
+}
+
+// GetOrphanedLinkedAccounts returns the linked accounts referencing a deleted
+// remote source. Linked accounts are sorted by id and paginated using the id
+// of the last returned linked account as start.
+func (h *ActionHandler) GetOrphanedLinkedAccounts(ctx context.Context, limit int, start string) (*GetOrphanedLinkedAccountsResponse, error) {
+	if limit < 0 {
+		return nil, util.NewAPIError(util.ErrBadRequest, errors.Errorf("limit must be greater or equal than 0"))
+	}
 
+	var linkedAccounts []*types.LinkedAccount
+	err := h.d.Do(ctx, func(tx *sql.Tx) error {
+		// fetch one more linked account to know if there're other linked accounts
+		queryLimit := limit
+		if queryLimit > 0 {
+			queryLimit++
+		}
+		var err error
+		linkedAccounts, err = h.d.GetOrphanedLinkedAccounts(tx, start, queryLimit)
+		return errors.WithStack(err)
 	})
 	if err != nil {
-		return errors.WithStack(err)
+		return nil, errors.WithStack(err)
 	}
 
-	return errors.WithStack(err)
+	res := &GetOrphanedLinkedAccountsResponse{LinkedAccounts: linkedAccounts}
+	if limit > 0 && len(linkedAccounts) > limit {
+		res.LinkedAccounts = linkedAccounts[:limit]
+		res.HasMore = true
+	}
+
+	return res, nil
 }
 
-type UpdateUserRequest struct {
-	UserRef string
+type UsersSortField string
 
-	UserName string
+const (
+	UsersSortFieldName         UsersSortField = "name"
+	UsersSortFieldCreationTime UsersSortField = "creationTime"
+)
+
+func IsValidUsersSortField(sortField UsersSortField) bool {
+	switch sortField {
+	case UsersSortFieldName:
+	case UsersSortFieldCreationTime:
+	default:
+		return false
+	}
+	return true
 }
 
-func (h *ActionHandler) UpdateUser(ctx context.Context, req *UpdateUserRequest) (*types.User, error) {
-	var user *types.User
+// UserCursor returns the pagination cursor of the user for the provided sort
+// field. When sorting by name the cursor is the user name, when sorting by
+// creation time it's the user creation time in unix nanoseconds and the user
+// id separated by an underscore.
+func UserCursor(user *types.User, sortField UsersSortField) string {
+	if sortField == UsersSortFieldCreationTime {
+		return fmt.Sprintf("%d_%s", db.UserCreationTime(user), user.ID)
+	}
+	return user.Name
+}
 
-	err := h.d.Do(ctx, func(tx *sql.Tx) error {
+// parseUserCreationTimeCursor parses a creation time cursor returned by
+// UserCursor
+func parseUserCreationTimeCursor(cursor string) (int64, string, error) {
+	parts := strings.SplitN(cursor, "_", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return 0, "", util.NewAPIError(util.ErrBadRequest, errors.Errorf("invalid start cursor %q", cursor))
+	}
+	creationTime, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return 0, "", util.NewAPIError(util.ErrBadRequest, errors.Errorf("invalid start cursor %q", cursor))
+	}
+
+	return creationTime, parts[1], nil
+}
+
+type GetUsersRequest struct {
+	// StartUserName is the name of the user to start after when StartCursor
+	// is empty.
+	//
+	// Deprecated: use StartCursor.
+	StartUserName string
+	// StartCursor is the cursor (see UserCursor) of the user to start after
+	StartCursor string
+	Limit       int
+	Asc         bool
+	// SortField is the users sort field. It defaults to UsersSortFieldName.
+	SortField UsersSortField
+
+	// Query, when set, filters the users whose name matches it case
+	// insensitively. A query starting with a "*" wildcard matches the names
+	// containing the rest of the query, otherwise the names starting with
+	// the query are matched.
+	Query string
+	// RemoteSourceRef, when set, filters the users with a linked account on
+	// the remote source
+	RemoteSourceRef string
+
+	// IncludeDeleted also returns the soft deleted users
+	IncludeDeleted bool
+}
+
+type GetUsersResponse struct {
+	Users   []*types.User
+	HasMore bool
+	// NextCursor is the cursor to use as StartCursor to fetch the next users.
+	// It's set only when HasMore is true.
+	NextCursor string
+}
+
+// GetUsers returns the users sorted by name or by creation time and
+// paginated using the cursor of the last returned user as start.
+func (h *ActionHandler) GetUsers(ctx context.Context, req *GetUsersRequest) (*GetUsersResponse, error) {
+	if req.Limit < 0 {
+		return nil, util.NewAPIError(util.ErrBadRequest, errors.Errorf("limit must be greater or equal than 0"))
+	}
+	sortField := req.SortField
+	if sortField == "" {
+		sortField = UsersSortFieldName
+	}
+	if !IsValidUsersSortField(sortField) {
+		return nil, util.NewAPIError(util.ErrBadRequest, errors.Errorf("invalid sort field %q", sortField))
+	}
+	startCursor := req.StartCursor
+	if startCursor == "" {
+		startCursor = req.StartUserName
+	}
+
+	var startCreationTime int64
+	var startID string
+	if sortField == UsersSortFieldCreationTime && startCursor != "" {
 		var err error
-		user, err = h.d.GetUser(tx, req.UserRef)
+		startCreationTime, startID, err = parseUserCreationTimeCursor(startCursor)
 		if err != nil {
-			return errors.WithStack(err)
+			return nil, errors.WithStack(err)
 		}
-		if user == nil {
-			return util.NewAPIError(util.ErrBadRequest, errors.Errorf("user %q doesn't exist", req.UserRef))
+	}
+
+	var users []*types.User
+	err := h.d.Do(ctx, func(tx *sql.Tx) error {
+		// fetch one more user to know if there're other users
+		queryLimit := req.Limit
+		if queryLimit > 0 {
+			queryLimit++
 		}
 
-		if req.UserName != "" {
-			// check duplicate user name
-			u, err := h.d.GetUserByName(tx, req.UserName)
+		var remoteSourceID string
+		if req.RemoteSourceRef != "" {
+			rs, err := h.d.GetRemoteSource(tx, req.RemoteSourceRef)
 			if err != nil {
 				return errors.WithStack(err)
 			}
-			if u != nil {
-				return util.NewAPIError(util.ErrBadRequest, errors.Errorf("user with name %q already exists", u.Name))
+			if rs == nil {
+				return util.NewAPIError(util.ErrNotExist, errors.Errorf("remote source %q doesn't exist", req.RemoteSourceRef))
 			}
+			remoteSourceID = rs.ID
+		}
 
-			user.Name = req.UserName
+		var err error
+		switch {
+		case sortField == UsersSortFieldCreationTime:
+			users, err = h.d.GetUsersByCreationTime(tx, remoteSourceID, req.Query, startCreationTime, startID, queryLimit, req.Asc, req.IncludeDeleted)
+		case remoteSourceID != "":
+			users, err = h.d.GetRemoteSourceUsers(tx, remoteSourceID, req.Query, startCursor, queryLimit, req.Asc, req.IncludeDeleted)
+		default:
+			users, err = h.d.GetUsers(tx, req.Query, startCursor, queryLimit, req.Asc, req.IncludeDeleted)
 		}
+		return errors.WithStack(err)
+	})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
 
-		if err := h.d.UpdateUser(tx, user); err != nil {
-			return errors.WithStack(err)
+	res := &GetUsersResponse{Users: users}
+	if req.Limit > 0 && len(users) > req.Limit {
+		res.Users = users[:req.Limit]
+		res.HasMore = true
+		res.NextCursor = UserCursor(res.Users[req.Limit-1], sortField)
+	}
+
+	return res, nil
+}
+
+type GetUsersCountRequest struct {
+	// Query, RemoteSourceRef and IncludeDeleted filter the counted users
+	// like in GetUsersRequest
+	Query           string
+	RemoteSourceRef string
+	IncludeDeleted  bool
+}
+
+// GetUsersCount returns the number of users matching the request filters.
+func (h *ActionHandler) GetUsersCount(ctx context.Context, req *GetUsersCountRequest) (int, error) {
+	var count int
+	err := h.d.Do(ctx, func(tx *sql.Tx) error {
+		var remoteSourceID string
+		if req.RemoteSourceRef != "" {
+			rs, err := h.d.GetRemoteSource(tx, req.RemoteSourceRef)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			if rs == nil {
+				return util.NewAPIError(util.ErrNotExist, errors.Errorf("remote source %q doesn't exist", req.RemoteSourceRef))
+			}
+			remoteSourceID = rs.ID
 		}
 
-		return nil
+		var err error
+		count, err = h.d.GetUsersCount(tx, remoteSourceID, req.Query, req.IncludeDeleted)
+		return errors.WithStack(err)
 	})
 	if err != nil {
-		return nil, errors.WithStack(err)
+		return 0, errors.WithStack(err)
 	}
 
-	return user, errors.WithStack(err)
+	return count, nil
 }
 
-func (h *ActionHandler) GetUserLinkedAccounts(ctx context.Context, userRef string) ([]*types.LinkedAccount, error) {
+func (h *ActionHandler) GetUserTokens(ctx context.Context, userRef string) ([]*types.UserToken, error) {
 	if userRef == "" {
 		return nil, util.NewAPIError(util.ErrBadRequest, errors.Errorf("user ref required"))
 	}
 
-	var linkedAccounts []*types.LinkedAccount
+	var tokens []*types.UserToken
 	err := h.d.Do(ctx, func(tx *sql.Tx) error {
 		user, err := h.d.GetUser(tx, userRef)
 		if err != nil {
@@ -215,7 +1620,7 @@ func (h *ActionHandler) GetUserLinkedAccounts(ctx context.Context, userRef strin
 			return util.NewAPIError(util.ErrBadRequest, errors.Errorf("user %q doesn't exist", userRef))
 		}
 
-		linkedAccounts, err = h.d.GetUserLinkedAccounts(tx, user.ID)
+		tokens, err = h.d.GetUserTokens(tx, user.ID)
 		if err != nil {
 			return errors.WithStack(err)
 		}
@@ -226,30 +1631,54 @@ func (h *ActionHandler) GetUserLinkedAccounts(ctx context.Context, userRef strin
 		return nil, errors.WithStack(err)
 	}
 
-	return linkedAccounts, errors.WithStack(err)
+	return tokens, errors.WithStack(err)
 }
 
-type CreateUserLARequest struct {
-	UserRef string
+type CreateUserTokenRequest struct {
+	UserRef   string
+	TokenName string
+	// ExpiresAt is the optional token expiration time
+	ExpiresAt *time.Time
+	// Scopes are the optional token scopes
+	Scopes []string
+}
 
-	RemoteSourceName           string
-	RemoteUserID               string
-	RemoteUserName             string
-	UserAccessToken            string
-	Oauth2AccessToken          string
-	Oauth2RefreshToken         string
-	Oauth2AccessTokenExpiresAt time.Time
+// ErrorCodeUserTokenLimit is the error code returned when creating a token for
+// a user that already has its maximum number of active tokens
+const ErrorCodeUserTokenLimit util.ErrorCode = "user_token_limit"
+
+// checkUserTokensLimit returns an error when the user has already reached the
+// maximum number of active tokens. Expired tokens aren't counted.
+func (h *ActionHandler) checkUserTokensLimit(tx *sql.Tx, user *types.User) error {
+	if h.maxUserTokens <= 0 {
+		return nil
+	}
+
+	activeTokens, err := h.d.GetActiveUserTokensCount(tx, user.ID, time.Now())
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if activeTokens >= h.maxUserTokens {
+		err := errors.Errorf("user %q reached its tokens limit of %d", user.Name, h.maxUserTokens)
+		return util.NewAPIError(util.ErrTooManyRequests, err, util.WithCode(ErrorCodeUserTokenLimit), util.WithMessage(err.Error()))
+	}
+
+	return nil
 }
 
-func (h *ActionHandler) CreateUserLA(ctx context.Context, req *CreateUserLARequest) (*types.LinkedAccount, error) {
+// CreateUserToken creates a user token.
+// Only the token value hash is stored, the returned plaintext token value
+// can't be retrieved later.
+func (h *ActionHandler) CreateUserToken(ctx context.Context, req *CreateUserTokenRequest) (*types.UserToken, string, error) {
 	if req.UserRef == "" {
-		return nil, util.NewAPIError(util.ErrBadRequest, errors.Errorf("user ref required"))
+		return nil, "", util.NewAPIError(util.ErrBadRequest, errors.Errorf("user ref required"))
 	}
-	if req.RemoteSourceName == "" {
-		return nil, util.NewAPIError(util.ErrBadRequest, errors.Errorf("remote source name required"))
+	if err := validateUserToken(req.TokenName, req.ExpiresAt, req.Scopes); err != nil {
+		return nil, "", errors.WithStack(err)
 	}
 
-	var la *types.LinkedAccount
+	var token *types.UserToken
+	var tokenValue string
 	err := h.d.Do(ctx, func(tx *sql.Tx) error {
 		user, err := h.d.GetUser(tx, req.UserRef)
 		if err != nil {
@@ -259,197 +1688,226 @@ func (h *ActionHandler) CreateUserLA(ctx context.Context, req *CreateUserLAReque
 			return util.NewAPIError(util.ErrBadRequest, errors.Errorf("user %q doesn't exist", req.UserRef))
 		}
 
-		rs, err := h.d.GetRemoteSourceByName(tx, req.RemoteSourceName)
+		token, tokenValue, err = h.createUserToken(tx, user, req.TokenName, req.ExpiresAt, req.Scopes)
 		if err != nil {
 			return errors.WithStack(err)
 		}
-		if rs == nil {
-			return util.NewAPIError(util.ErrBadRequest, errors.Errorf("remote source %q doesn't exist", req.RemoteSourceName))
-		}
 
-		la, err = h.d.GetLinkedAccountByRemoteUserIDandSource(tx, req.RemoteUserID, rs.ID)
-		if err != nil {
-			return errors.Wrapf(err, "failed to get linked account for remote user id %q and remote source %q", req.RemoteUserID, rs.ID)
-		}
-		if la != nil {
-			return util.NewAPIError(util.ErrBadRequest, errors.Errorf("linked account for remote user id %q for remote source %q already exists", req.RemoteUserID, req.RemoteSourceName))
-		}
+		return errors.WithStack(h.logAuditEvent(ctx, tx, AuditActionUserTokenCreate, types.UserTokenKind, token.ID, token.UserID))
+	})
+	if err != nil {
+		return nil, "", errors.WithStack(err)
+	}
 
-		la = types.NewLinkedAccount(tx)
-		la.UserID = user.ID
-		la.RemoteSourceID = rs.ID
-		la.RemoteUserID = req.RemoteUserID
-		la.RemoteUserName = req.RemoteUserName
-		la.UserAccessToken = req.UserAccessToken
-		la.Oauth2AccessToken = req.Oauth2AccessToken
-		la.Oauth2RefreshToken = req.Oauth2RefreshToken
-		la.Oauth2AccessTokenExpiresAt = req.Oauth2AccessTokenExpiresAt
+	return token, tokenValue, nil
+}
 
-		if err := h.d.InsertLinkedAccount(tx, la); err != nil {
-			return errors.WithStack(err)
+// validateUserToken validates the fields of a user token to create
+func validateUserToken(tokenName string, expiresAt *time.Time, tokenScopes []string) error {
+	if tokenName == "" {
+		return util.NewAPIError(util.ErrBadRequest, errors.Errorf("token name required"))
+	}
+	if expiresAt != nil && !expiresAt.After(time.Now()) {
+		return util.NewAPIError(util.ErrBadRequest, errors.Errorf("token expiration time must be in the future"))
+	}
+	scopes := map[string]struct{}{}
+	for _, scope := range tokenScopes {
+		if !types.IsValidUserTokenScope(scope) {
+			return util.NewAPIError(util.ErrBadRequest, errors.Errorf("invalid token scope %q", scope))
 		}
+		if _, ok := scopes[scope]; ok {
+			return util.NewAPIError(util.ErrBadRequest, errors.Errorf("duplicate token scope %q", scope))
+		}
+		scopes[scope] = struct{}{}
+	}
 
-		return nil
-	})
+	return nil
+}
+
+// createUserToken creates a token for the user inside the provided
+// transaction and returns it with its plaintext value.
+func (h *ActionHandler) createUserToken(tx *sql.Tx, user *types.User, tokenName string, expiresAt *time.Time, scopes []string) (*types.UserToken, string, error) {
+	userToken, err := h.d.GetUserToken(tx, user.ID, tokenName)
 	if err != nil {
-		return nil, errors.WithStack(err)
+		return nil, "", errors.WithStack(err)
+	}
+	if userToken != nil {
+		return nil, "", util.NewAPIError(util.ErrConflict, errors.Errorf("token %q for user %q already exists", tokenName, user.Name))
 	}
 
-	return la, errors.WithStack(err)
+	if err := h.checkUserTokensLimit(tx, user); err != nil {
+		return nil, "", errors.WithStack(err)
+	}
+
+	tokenValue := util.EncodeSha1Hex(uuid.Must(uuid.NewV4()).String())
+
+	token := types.NewUserToken(tx)
+	token.UserID = user.ID
+	token.Name = tokenName
+	token.ValueHash = util.EncodeSha256Hex(tokenValue)
+	token.ExpiresAt = expiresAt
+	token.Scopes = scopes
+
+	if err := h.d.InsertUserToken(tx, token); err != nil {
+		return nil, "", errors.WithStack(util.MapDBError(err))
+	}
+
+	return token, tokenValue, nil
 }
 
-func (h *ActionHandler) DeleteUserLA(ctx context.Context, userRef, laID string) error {
-	if userRef == "" {
-		return util.NewAPIError(util.ErrBadRequest, errors.Errorf("user ref  required"))
+type CreateUserWithTokenRequest struct {
+	CreateUserRequest *CreateUserRequest
+
+	TokenName string
+	// TokenExpiresAt is the optional token expiration time
+	TokenExpiresAt *time.Time
+	// TokenScopes are the optional token scopes
+	TokenScopes []string
+}
+
+type CreateUserWithTokenResponse struct {
+	User  *types.User
+	Token *types.UserToken
+	// TokenValue is the plaintext token value. It can't be retrieved later.
+	TokenValue string
+}
+
+// CreateUserWithToken creates a new user, with its optional linked account,
+// and its initial token in the same transaction. If any of them can't be
+// created nothing is created.
+func (h *ActionHandler) CreateUserWithToken(ctx context.Context, req *CreateUserWithTokenRequest) (*CreateUserWithTokenResponse, error) {
+	if req.CreateUserRequest == nil {
+		return nil, util.NewAPIError(util.ErrBadRequest, errors.Errorf("create user request required"))
 	}
-	if laID == "" {
-		return util.NewAPIError(util.ErrBadRequest, errors.Errorf("user linked account id required"))
+	if err := h.validateCreateUserRequest(req.CreateUserRequest); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if err := validateUserToken(req.TokenName, req.TokenExpiresAt, req.TokenScopes); err != nil {
+		return nil, errors.WithStack(err)
 	}
 
-	var user *types.User
-
+	res := &CreateUserWithTokenResponse{}
 	err := h.d.Do(ctx, func(tx *sql.Tx) error {
-		var err error
-		user, err = h.d.GetUser(tx, userRef)
+		user, err := h.createUser(tx, req.CreateUserRequest)
 		if err != nil {
 			return errors.WithStack(err)
 		}
-		if user == nil {
-			return util.NewAPIError(util.ErrBadRequest, errors.Errorf("user %q doesn't exist", userRef))
+		if err := h.logAuditEvent(ctx, tx, AuditActionUserCreate, types.UserKind, user.ID, user.ID); err != nil {
+			return errors.WithStack(err)
 		}
 
-		la, err := h.d.GetLinkedAccount(tx, laID)
+		token, tokenValue, err := h.createUserToken(tx, user, req.TokenName, req.TokenExpiresAt, req.TokenScopes)
 		if err != nil {
 			return errors.WithStack(err)
 		}
-		if la == nil {
-			return util.NewAPIError(util.ErrBadRequest, errors.Errorf("linked account id %q for user %q doesn't exist", laID, userRef))
-		}
-
-		// check that the linked account belongs to the right user
-		if user.ID != la.UserID {
-			return util.NewAPIError(util.ErrBadRequest, errors.Errorf("linked account id %q for user %q doesn't exist", laID, userRef))
-		}
-
-		if err := h.d.DeleteLinkedAccount(tx, la.ID); err != nil {
+		if err := h.logAuditEvent(ctx, tx, AuditActionUserTokenCreate, types.UserTokenKind, token.ID, token.UserID); err != nil {
 			return errors.WithStack(err)
 		}
 
+		res.User = user
+		res.Token = token
+		res.TokenValue = tokenValue
+
 		return nil
 	})
 	if err != nil {
-		return errors.WithStack(err)
+		return nil, errors.WithStack(err)
 	}
 
-	return errors.WithStack(err)
-}
-
-type UpdateUserLARequest struct {
-	UserRef string
-
-	LinkedAccountID            string
-	RemoteUserID               string
-	RemoteUserName             string
-	UserAccessToken            string
-	Oauth2AccessToken          string
-	Oauth2RefreshToken         string
-	Oauth2AccessTokenExpiresAt time.Time
+	return res, nil
 }
 
-func (h *ActionHandler) UpdateUserLA(ctx context.Context, req *UpdateUserLARequest) (*types.LinkedAccount, error) {
-	if req.UserRef == "" {
-		return nil, util.NewAPIError(util.ErrBadRequest, errors.Errorf("user ref required"))
-	}
+// GetUserByTokenValue returns the user owning the token with the provided
+// value. Expired tokens are rejected. When usedAt isn't nil the token last
+// used time and client ip are set to usedAt and usedIP. To avoid a write on
+// every token authentication, they're updated only if the last used time is
+// older than UserTokenLastUsedUpdateInterval.
+func (h *ActionHandler) GetUserByTokenValue(ctx context.Context, tokenValue string, usedAt *time.Time, usedIP string) (*types.User, error) {
+	tokenValueHash := util.EncodeSha256Hex(tokenValue)
 
-	var la *types.LinkedAccount
+	var user *types.User
 	err := h.d.Do(ctx, func(tx *sql.Tx) error {
-		user, err := h.d.GetUser(tx, req.UserRef)
+		var err error
+		user, err = h.d.GetUserByTokenValueHash(tx, tokenValueHash)
 		if err != nil {
 			return errors.WithStack(err)
 		}
 		if user == nil {
-			return util.NewAPIError(util.ErrBadRequest, errors.Errorf("user %q doesn't exist", req.UserRef))
+			return util.NewAPIError(util.ErrNotExist, errors.Errorf("user with required token doesn't exist"))
+		}
+		if user.Disabled {
+			return util.NewAPIError(util.ErrUnauthorized, errors.Errorf("user %q is disabled", user.Name))
+		}
+		if user.IsDeleted() {
+			return util.NewAPIError(util.ErrUnauthorized, errors.Errorf("user %q is deleted", user.Name))
 		}
 
-		la, err = h.d.GetLinkedAccount(tx, req.LinkedAccountID)
+		userToken, err := h.d.GetUserTokenByValueHash(tx, tokenValueHash)
 		if err != nil {
 			return errors.WithStack(err)
 		}
-		if la == nil {
-			return util.NewAPIError(util.ErrBadRequest, errors.Errorf("linked account id %q for user %q doesn't exist", req.LinkedAccountID, req.UserRef))
+		if userToken == nil {
+			return util.NewAPIError(util.ErrNotExist, errors.Errorf("user with required token doesn't exist"))
 		}
-
-		// check that the linked account belongs to the right user
-		if user.ID != la.UserID {
-			return util.NewAPIError(util.ErrBadRequest, errors.Errorf("linked account id %q for user %q doesn't exist", req.LinkedAccountID, req.UserRef))
+		if userToken.IsExpired(time.Now()) {
+			return util.NewAPIError(util.ErrUnauthorized, errors.Errorf("user token %q expired", userToken.Name))
 		}
 
-		rs, err := h.d.GetRemoteSource(tx, la.RemoteSourceID)
-		if err != nil {
-			return errors.WithStack(err)
+		if usedAt == nil {
+			return nil
 		}
-		if rs == nil {
-			return util.NewAPIError(util.ErrBadRequest, errors.Errorf("remote source with id %q doesn't exist", la.RemoteSourceID))
+		if userToken.LastUsedAt != nil && usedAt.Sub(*userToken.LastUsedAt) < UserTokenLastUsedUpdateInterval {
+			return nil
 		}
 
-		la.RemoteUserID = req.RemoteUserID
-		la.RemoteUserName = req.RemoteUserName
-		la.UserAccessToken = req.UserAccessToken
-		la.Oauth2AccessToken = req.Oauth2AccessToken
-		la.Oauth2RefreshToken = req.Oauth2RefreshToken
-		la.Oauth2AccessTokenExpiresAt = req.Oauth2AccessTokenExpiresAt
-
-		if err := h.d.UpdateLinkedAccount(tx, la); err != nil {
-			return errors.WithStack(err)
-		}
+		userToken.LastUsedAt = usedAt
+		userToken.LastUsedIP = usedIP
 
-		return nil
+		return errors.WithStack(h.d.UpdateUserToken(tx, userToken))
 	})
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
 
-	return la, errors.WithStack(err)
+	return user, nil
 }
 
-func (h *ActionHandler) GetUserTokens(ctx context.Context, userRef string) ([]*types.UserToken, error) {
-	if userRef == "" {
-		return nil, util.NewAPIError(util.ErrBadRequest, errors.Errorf("user ref required"))
-	}
-
-	var tokens []*types.UserToken
+// MigrateLegacyUserTokens replaces the plaintext value of legacy user tokens
+// with its hash and marks them as needing rotation. Migrated tokens keep
+// working with their current value.
+func (h *ActionHandler) MigrateLegacyUserTokens(ctx context.Context) error {
 	err := h.d.Do(ctx, func(tx *sql.Tx) error {
-		user, err := h.d.GetUser(tx, userRef)
+		tokens, err := h.d.GetLegacyUserTokens(tx)
 		if err != nil {
 			return errors.WithStack(err)
 		}
-		if user == nil {
-			return util.NewAPIError(util.ErrBadRequest, errors.Errorf("user %q doesn't exist", userRef))
-		}
 
-		tokens, err = h.d.GetUserTokens(tx, user.ID)
-		if err != nil {
-			return errors.WithStack(err)
+		for _, token := range tokens {
+			h.log.Info().Msgf("migrating legacy user token %q of user %q", token.Name, token.UserID)
+
+			token.ValueHash = util.EncodeSha256Hex(token.Value)
+			token.Value = ""
+			token.NeedsRotation = true
+
+			if err := h.d.UpdateUserToken(tx, token); err != nil {
+				return errors.WithStack(err)
+			}
 		}
 
 		return nil
 	})
-	if err != nil {
-		return nil, errors.WithStack(err)
-	}
 
-	return tokens, errors.WithStack(err)
+	return errors.WithStack(err)
 }
 
-func (h *ActionHandler) CreateUserToken(ctx context.Context, userRef, tokenName string) (*types.UserToken, error) {
+func (h *ActionHandler) DeleteUserToken(ctx context.Context, userRef, tokenName string) error {
 	if userRef == "" {
-		return nil, util.NewAPIError(util.ErrBadRequest, errors.Errorf("user ref required"))
+		return util.NewAPIError(util.ErrBadRequest, errors.Errorf("user ref required"))
 	}
 	if tokenName == "" {
-		return nil, util.NewAPIError(util.ErrBadRequest, errors.Errorf("token name required"))
+		return util.NewAPIError(util.ErrBadRequest, errors.Errorf("token name required"))
 	}
 
-	var token *types.UserToken
 	err := h.d.Do(ctx, func(tx *sql.Tx) error {
 		user, err := h.d.GetUser(tx, userRef)
 		if err != nil {
@@ -464,36 +1922,36 @@ func (h *ActionHandler) CreateUserToken(ctx context.Context, userRef, tokenName
 			return errors.WithStack(err)
 		}
 
-		if userToken != nil {
-			return util.NewAPIError(util.ErrBadRequest, errors.Errorf("token %q for user %q already exists", tokenName, userRef))
+		if userToken == nil {
+			return util.NewAPIError(util.ErrBadRequest, errors.Errorf("token %q for user %q doesn't exist", tokenName, userRef))
 		}
 
-		token = types.NewUserToken(tx)
-		token.UserID = user.ID
-		token.Name = tokenName
-		token.Value = util.EncodeSha1Hex(uuid.Must(uuid.NewV4()).String())
-
-		if err := h.d.InsertUserToken(tx, token); err != nil {
+		if err := h.d.DeleteUserToken(tx, userToken.ID); err != nil {
 			return errors.WithStack(err)
 		}
 
-		return nil
+		return errors.WithStack(h.logAuditEvent(ctx, tx, AuditActionUserTokenDelete, types.UserTokenKind, userToken.ID, userToken.UserID))
 	})
 	if err != nil {
-		return nil, errors.WithStack(err)
+		return errors.WithStack(err)
 	}
 
-	return token, errors.WithStack(err)
+	return errors.WithStack(err)
 }
 
-func (h *ActionHandler) DeleteUserToken(ctx context.Context, userRef, tokenName string) error {
+// UpdateUserTokenName renames a user token. The token value isn't changed.
+func (h *ActionHandler) UpdateUserTokenName(ctx context.Context, userRef, oldName, newName string) (*types.UserToken, error) {
 	if userRef == "" {
-		return util.NewAPIError(util.ErrBadRequest, errors.Errorf("user ref required"))
+		return nil, util.NewAPIError(util.ErrBadRequest, errors.Errorf("user ref required"))
 	}
-	if tokenName == "" {
-		return util.NewAPIError(util.ErrBadRequest, errors.Errorf("token name required"))
+	if oldName == "" {
+		return nil, util.NewAPIError(util.ErrBadRequest, errors.Errorf("token name required"))
+	}
+	if newName == "" {
+		return nil, util.NewAPIError(util.ErrBadRequest, errors.Errorf("new token name required"))
 	}
 
+	var token *types.UserToken
 	err := h.d.Do(ctx, func(tx *sql.Tx) error {
 		user, err := h.d.GetUser(tx, userRef)
 		if err != nil {
@@ -503,26 +1961,39 @@ func (h *ActionHandler) DeleteUserToken(ctx context.Context, userRef, tokenName
 			return util.NewAPIError(util.ErrBadRequest, errors.Errorf("user %q doesn't exist", userRef))
 		}
 
-		userToken, err := h.d.GetUserToken(tx, user.ID, tokenName)
+		token, err = h.d.GetUserToken(tx, user.ID, oldName)
 		if err != nil {
 			return errors.WithStack(err)
 		}
+		if token == nil {
+			return util.NewAPIError(util.ErrNotExist, errors.Errorf("token %q for user %q doesn't exist", oldName, userRef))
+		}
 
-		if userToken == nil {
-			return util.NewAPIError(util.ErrBadRequest, errors.Errorf("token %q for user %q doesn't exist", tokenName, userRef))
+		if newName == oldName {
+			return nil
 		}
 
-		if err := h.d.DeleteUserToken(tx, userToken.ID); err != nil {
+		userToken, err := h.d.GetUserToken(tx, user.ID, newName)
+		if err != nil {
 			return errors.WithStack(err)
 		}
+		if userToken != nil {
+			return util.NewAPIError(util.ErrConflict, errors.Errorf("token %q for user %q already exists", newName, userRef))
+		}
+
+		token.Name = newName
+
+		if err := h.d.UpdateUserToken(tx, token); err != nil {
+			return errors.WithStack(util.MapDBError(err))
+		}
 
 		return nil
 	})
 	if err != nil {
-		return errors.WithStack(err)
+		return nil, errors.WithStack(err)
 	}
 
-	return errors.WithStack(err)
+	return token, nil
 }
 
 type UserOrgsResponse struct {
@@ -537,19 +2008,35 @@ func userOrgsResponse(userOrg *db.UserOrg) *UserOrgsResponse {
 	}
 }
 
-func (h *ActionHandler) GetUserOrgs(ctx context.Context, userRef string) ([]*UserOrgsResponse, error) {
+type GetUserOrgsRequest struct {
+	UserRef string
+
+	// MinRole, when set, returns only the orgs where the user has this role
+	// or a role with more privileges
+	MinRole types.MemberRole
+}
+
+func (h *ActionHandler) GetUserOrgs(ctx context.Context, req *GetUserOrgsRequest) ([]*UserOrgsResponse, error) {
+	var memberRoles []types.MemberRole
+	if req.MinRole != "" {
+		if !types.IsValidMemberRole(req.MinRole) {
+			return nil, util.NewAPIError(util.ErrBadRequest, errors.Errorf("invalid role %q", req.MinRole))
+		}
+		memberRoles = types.MemberRolesAtLeast(req.MinRole)
+	}
+
 	var userOrgs []*db.UserOrg
 	err := h.d.Do(ctx, func(tx *sql.Tx) error {
 		var err error
-		user, err := h.d.GetUser(tx, userRef)
+		user, err := h.d.GetUser(tx, req.UserRef)
 		if err != nil {
 			return errors.WithStack(err)
 		}
 		if user == nil {
-			return util.NewAPIError(util.ErrNotExist, errors.Errorf("user %q doesn't exist", userRef))
+			return util.NewAPIError(util.ErrNotExist, errors.Errorf("user %q doesn't exist", req.UserRef))
 		}
 
-		userOrgs, err = h.d.GetUserOrgs(tx, user.ID)
+		userOrgs, err = h.d.GetUserOrgs(tx, user.ID, memberRoles)
 		return errors.WithStack(err)
 	})
 	if err != nil {
@@ -564,6 +2051,141 @@ func (h *ActionHandler) GetUserOrgs(ctx context.Context, userRef string) ([]*Use
 	return res, nil
 }
 
+// UpdateUserOrgRole updates the role of the user in the org. The only owner of
+// an org can't be demoted.
+func (h *ActionHandler) UpdateUserOrgRole(ctx context.Context, userRef, orgRef string, role types.MemberRole) error {
+	if !types.IsValidMemberRole(role) {
+		return util.NewAPIError(util.ErrBadRequest, errors.Errorf("invalid role %q", role))
+	}
+
+	err := h.d.Do(ctx, func(tx *sql.Tx) error {
+		user, err := h.d.GetUser(tx, userRef)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if user == nil {
+			return util.NewAPIError(util.ErrBadRequest, errors.Errorf("user %q doesn't exist", userRef))
+		}
+		org, err := h.d.GetOrg(tx, orgRef)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if org == nil {
+			return util.NewAPIError(util.ErrBadRequest, errors.Errorf("org %q doesn't exist", orgRef))
+		}
+
+		orgmember, err := h.d.GetOrgMemberByOrgUserID(tx, org.ID, user.ID)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if orgmember == nil {
+			return util.NewAPIError(util.ErrNotExist, errors.Errorf("user %q isn't a member of org %q", userRef, orgRef))
+		}
+		if orgmember.MemberRole == role {
+			return nil
+		}
+
+		if orgmember.MemberRole == types.MemberRoleOwner {
+			orgUsers, err := h.d.GetOrgUsers(tx, org.ID)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			owners := 0
+			for _, orgUser := range orgUsers {
+				if orgUser.Role == types.MemberRoleOwner {
+					owners++
+				}
+			}
+			if owners == 1 {
+				return util.NewAPIError(util.ErrBadRequest, errors.Errorf("user %q is the only owner of org %q", userRef, orgRef))
+			}
+		}
+
+		orgmember.MemberRole = role
+
+		return errors.WithStack(h.d.UpdateOrganizationMember(tx, orgmember))
+	})
+
+	return errors.WithStack(err)
+}
+
+type GetUserProjectsResponse struct {
+	Projects []*types.Project
+	HasMore  bool
+}
+
+// GetUserProjects returns the projects of all the project groups under the
+// user root project group. Projects are sorted by name and paginated using
+// the id of the last returned project as start.
+func (h *ActionHandler) GetUserProjects(ctx context.Context, userRef string, start string, limit int, asc bool) (*GetUserProjectsResponse, error) {
+	if limit < 0 {
+		return nil, util.NewAPIError(util.ErrBadRequest, errors.Errorf("limit must be greater or equal than 0"))
+	}
+
+	var projects []*types.Project
+	err := h.d.Do(ctx, func(tx *sql.Tx) error {
+		user, err := h.d.GetUser(tx, userRef)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if user == nil {
+			return util.NewAPIError(util.ErrNotExist, errors.Errorf("user %q doesn't exist", userRef))
+		}
+
+		// walk the user project groups tree starting from the user root project group
+		projectGroupIDs := []string{}
+		parentIDs := []string{user.ID}
+		for len(parentIDs) > 0 {
+			parentID := parentIDs[0]
+			parentIDs = parentIDs[1:]
+
+			projectGroups, err := h.d.GetProjectGroupSubgroups(tx, parentID)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			for _, projectGroup := range projectGroups {
+				projectGroupIDs = append(projectGroupIDs, projectGroup.ID)
+				parentIDs = append(parentIDs, projectGroup.ID)
+			}
+		}
+
+		if start != "" {
+			startProject, err := h.d.GetProjectByID(tx, start)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			if startProject == nil {
+				return util.NewAPIError(util.ErrBadRequest, errors.Errorf("start project %q doesn't exist", start))
+			}
+			if !util.StringInSlice(projectGroupIDs, startProject.Parent.ID) {
+				return util.NewAPIError(util.ErrBadRequest, errors.Errorf("start project %q isn't a project of user %q", start, userRef))
+			}
+		}
+
+		// fetch one more project to know if there're other projects
+		queryLimit := limit
+		if queryLimit > 0 {
+			queryLimit++
+		}
+		projects, err = h.d.GetProjectGroupsProjects(tx, projectGroupIDs, start, queryLimit, asc)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	res := &GetUserProjectsResponse{Projects: projects}
+	if limit > 0 && len(projects) > limit {
+		res.Projects = projects[:limit]
+		res.HasMore = true
+	}
+
+	return res, nil
+}
+
 func (h *ActionHandler) GetUserOrgInvitations(ctx context.Context, userRef string) ([]*types.OrgInvitation, error) {
 	var orgInvitations []*types.OrgInvitation
 	err := h.d.Do(ctx, func(tx *sql.Tx) error {
@@ -588,3 +2210,30 @@ func (h *ActionHandler) GetUserOrgInvitations(ctx context.Context, userRef strin
 
 	return orgInvitations, errors.WithStack(err)
 }
+
+// GetCaseInsensitiveNameConflicts returns the groups of users whose names differ
+// only by case. Case insensitive user names uniqueness is enforced only when
+// creating or renaming a user, so it's meant to find the users created before
+// that must be renamed.
+func (h *ActionHandler) GetCaseInsensitiveNameConflicts(ctx context.Context) ([][]*types.User, error) {
+	var users []*types.User
+	err := h.d.Do(ctx, func(tx *sql.Tx) error {
+		var err error
+		users, err = h.d.GetCaseInsensitiveNameConflictingUsers(tx)
+		return errors.WithStack(err)
+	})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	// users are ordered by lowercased name
+	conflicts := [][]*types.User{}
+	for i, user := range users {
+		if i == 0 || strings.ToLower(users[i-1].Name) != strings.ToLower(user.Name) {
+			conflicts = append(conflicts, []*types.User{})
+		}
+		conflicts[len(conflicts)-1] = append(conflicts[len(conflicts)-1], user)
+	}
+
+	return conflicts, nil
+}
@@ -19,7 +19,9 @@ import (
 	"net/url"
 
 	"agola.io/agola/internal/errors"
+	"agola.io/agola/internal/services/configstore/action"
 	"agola.io/agola/internal/util"
+	csapitypes "agola.io/agola/services/configstore/api/types"
 	"agola.io/agola/services/configstore/types"
 
 	"github.com/gorilla/mux"
@@ -29,6 +31,18 @@ type ErrorResponse struct {
 	Message string `json:"message"`
 }
 
+// AuditActorMiddleware sets the audit actor sent in the AuditActorHeader
+// header, by the gateway, in the request context.
+func AuditActorMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if actor := r.Header.Get(csapitypes.AuditActorHeader); actor != "" {
+			r = r.WithContext(action.WithAuditActor(r.Context(), actor))
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
 func GetObjectKindRef(r *http.Request) (types.ObjectKind, string, error) {
 	vars := mux.Vars(r)
 	projectRef, err := url.PathUnescape(vars["projectref"])
@@ -90,6 +90,7 @@ func (h *CreateOrgHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		Name:          req.Name,
 		Visibility:    req.Visibility,
 		CreatorUserID: req.CreatorUserID,
+		MaxMembers:    req.MaxMembers,
 	}
 
 	org, err := h.ah.CreateOrg(ctx, creq)
@@ -126,6 +127,7 @@ func (h *UpdateOrgHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	creq := &action.UpdateOrgRequest{
 		Visibility: req.Visibility,
+		MaxMembers: req.MaxMembers,
 	}
 
 	org, err := h.ah.UpdateOrg(ctx, orgRef, creq)
@@ -18,6 +18,7 @@ import (
 	"encoding/json"
 	"net/http"
 	"strconv"
+	"time"
 
 	"agola.io/agola/internal/errors"
 	action "agola.io/agola/internal/services/configstore/action"
@@ -33,32 +34,24 @@ import (
 
 type UserHandler struct {
 	log zerolog.Logger
-	d   *db.DB
+	ah  *action.ActionHandler
 }
 
-func NewUserHandler(log zerolog.Logger, d *db.DB) *UserHandler {
-	return &UserHandler{log: log, d: d}
+func NewUserHandler(log zerolog.Logger, ah *action.ActionHandler) *UserHandler {
+	return &UserHandler{log: log, ah: ah}
 }
 
 func (h *UserHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	vars := mux.Vars(r)
 	userRef := vars["userref"]
+	query := r.URL.Query()
 
-	var user *types.User
-	err := h.d.Do(ctx, func(tx *sql.Tx) error {
-		var err error
-		user, err = h.d.GetUser(tx, userRef)
-		return errors.WithStack(err)
-	})
-	if err != nil {
-		h.log.Err(err).Send()
-		util.HTTPError(w, err)
-		return
-	}
+	_, includeDeleted := query["includedeleted"]
 
-	if user == nil {
-		util.HTTPError(w, util.NewAPIError(util.ErrNotExist, errors.Errorf("user %q doesn't exist", userRef)))
+	user, err := h.ah.GetUser(ctx, userRef, includeDeleted)
+	if util.HTTPError(w, err) {
+		h.log.Err(err).Send()
 		return
 	}
 
@@ -88,6 +81,7 @@ func (h *CreateUserHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	creq := &action.CreateUserRequest{
 		UserName: req.UserName,
+		Email:    req.Email,
 	}
 	if req.CreateUserLARequest != nil {
 		creq.CreateUserLARequest = &action.CreateUserLARequest{
@@ -137,15 +131,17 @@ func (h *UpdateUserHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	creq := &action.UpdateUserRequest{
 		UserRef:  userRef,
 		UserName: req.UserName,
+		Email:    req.Email,
+		Disabled: req.Disabled,
 	}
 
-	user, err := h.ah.UpdateUser(ctx, creq)
+	res, err := h.ah.UpdateUser(ctx, creq)
 	if util.HTTPError(w, err) {
 		h.log.Err(err).Send()
 		return
 	}
 
-	if err := util.HTTPResponse(w, http.StatusCreated, user); err != nil {
+	if err := util.HTTPResponse(w, http.StatusCreated, res.User); err != nil {
 		h.log.Err(err).Send()
 	}
 }
@@ -165,9 +161,18 @@ func (h *DeleteUserHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	userRef := vars["userref"]
 
-	err := h.ah.DeleteUser(ctx, userRef)
+	query := r.URL.Query()
+
+	_, softDelete := query["softdelete"]
+
+	err := h.ah.DeleteUser(ctx, &action.DeleteUserRequest{
+		UserRef:           userRef,
+		TransferToUserRef: query.Get("transfertouser"),
+		SoftDelete:        softDelete,
+	})
 	if util.HTTPError(w, err) {
 		h.log.Err(err).Send()
+		return
 	}
 	if err := util.HTTPResponse(w, http.StatusNoContent, nil); err != nil {
 		h.log.Err(err).Send()
@@ -181,11 +186,12 @@ const (
 
 type UsersHandler struct {
 	log zerolog.Logger
+	ah  *action.ActionHandler
 	d   *db.DB
 }
 
-func NewUsersHandler(log zerolog.Logger, d *db.DB) *UsersHandler {
-	return &UsersHandler{log: log, d: d}
+func NewUsersHandler(log zerolog.Logger, ah *action.ActionHandler, d *db.DB) *UsersHandler {
+	return &UsersHandler{log: log, ah: ah, d: d}
 }
 
 func (h *UsersHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -216,22 +222,68 @@ func (h *UsersHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	start := query.Get("start")
 
+	_, includeDeleted := query["includedeleted"]
+
 	// handle special queries, like get user by token
 	queryType := query.Get("query_type")
 
+	if queryType == "bytoken" {
+		// optionally record the token usage
+		var usedAt *time.Time
+		if _, ok := query["mark_used"]; ok {
+			now := time.Now()
+			usedAt = &now
+		}
+		user, err := h.ah.GetUserByTokenValue(ctx, query.Get("token"), usedAt, query.Get("used_ip"))
+		if util.HTTPError(w, err) {
+			h.log.Err(err).Send()
+			return
+		}
+
+		if err := util.HTTPResponse(w, http.StatusOK, []*types.User{user}); err != nil {
+			h.log.Err(err).Send()
+		}
+		return
+	}
+
+	if queryType == "byremoteuser" {
+		user, err := h.ah.GetUserByRemoteUser(ctx, query.Get("remotesourceid"), query.Get("remoteuserid"))
+		if util.HTTPError(w, err) {
+			h.log.Err(err).Send()
+			return
+		}
+
+		if err := util.HTTPResponse(w, http.StatusOK, []*types.User{user}); err != nil {
+			h.log.Err(err).Send()
+		}
+		return
+	}
+
+	if queryType != "bylinkedaccount" {
+		// default query
+		res, err := h.ah.GetUsers(ctx, &action.GetUsersRequest{
+			StartCursor:     start,
+			Limit:           limit,
+			Asc:             asc,
+			SortField:       action.UsersSortField(query.Get("sortfield")),
+			Query:           query.Get("query"),
+			RemoteSourceRef: query.Get("remotesource"),
+			IncludeDeleted:  includeDeleted,
+		})
+		if util.HTTPError(w, err) {
+			h.log.Err(err).Send()
+			return
+		}
+
+		if err := util.HTTPResponse(w, http.StatusOK, res.Users); err != nil {
+			h.log.Err(err).Send()
+		}
+		return
+	}
+
 	var users []*types.User
 	err := h.d.Do(ctx, func(tx *sql.Tx) error {
 		switch queryType {
-		case "bytoken":
-			token := query.Get("token")
-			user, err := h.d.GetUserByTokenValue(tx, token)
-			if err != nil {
-				return errors.WithStack(err)
-			}
-			if user == nil {
-				return util.NewAPIError(util.ErrNotExist, errors.Errorf("user with required token doesn't exist"))
-			}
-			users = []*types.User{user}
 		case "bylinkedaccount":
 			linkedAccountID := query.Get("linkedaccountid")
 			user, err := h.d.GetUserByLinkedAccount(tx, linkedAccountID)
@@ -242,30 +294,6 @@ func (h *UsersHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 				return util.NewAPIError(util.ErrNotExist, errors.Errorf("user with linked account %q token doesn't exist", linkedAccountID))
 			}
 			users = []*types.User{user}
-		case "byremoteuser":
-			remoteUserID := query.Get("remoteuserid")
-			remoteSourceID := query.Get("remotesourceid")
-			la, err := h.d.GetLinkedAccountByRemoteUserIDandSource(tx, remoteUserID, remoteSourceID)
-			if err != nil {
-				return errors.WithStack(err)
-			}
-			if la == nil {
-				return util.NewAPIError(util.ErrNotExist, errors.Errorf("linked account with remote user %q for remote source %q token doesn't exist", remoteUserID, remoteSourceID))
-			}
-
-			user, err := h.d.GetUser(tx, la.UserID)
-			if err != nil {
-				return errors.WithStack(err)
-			}
-			if user == nil {
-				return util.NewAPIError(util.ErrNotExist, errors.Errorf("user with remote user %q for remote source %q token doesn't exist", remoteUserID, remoteSourceID))
-			}
-			users = []*types.User{user}
-		default:
-			// default query
-			var err error
-			users, err = h.d.GetUsers(tx, start, limit, asc)
-			return errors.WithStack(err)
 		}
 
 		return nil
@@ -415,6 +443,65 @@ func (h *UpdateUserLAHandler) ServeHTTP(w http.ResponseWriter, r *http.Request)
 	}
 }
 
+type RefreshUserLAOauth2TokenHandler struct {
+	log zerolog.Logger
+	ah  *action.ActionHandler
+}
+
+func NewRefreshUserLAOauth2TokenHandler(log zerolog.Logger, ah *action.ActionHandler) *RefreshUserLAOauth2TokenHandler {
+	return &RefreshUserLAOauth2TokenHandler{log: log, ah: ah}
+}
+
+func (h *RefreshUserLAOauth2TokenHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	vars := mux.Vars(r)
+	userRef := vars["userref"]
+	linkedAccountID := vars["laid"]
+
+	var req csapitypes.RefreshUserLAOauth2TokenRequest
+	d := json.NewDecoder(r.Body)
+	if err := d.Decode(&req); err != nil {
+		util.HTTPError(w, util.NewAPIError(util.ErrBadRequest, err))
+		return
+	}
+
+	la, err := h.ah.RefreshLinkedAccountOauth2Token(ctx, userRef, linkedAccountID, req.Oauth2AccessToken, req.Oauth2RefreshToken, req.Oauth2AccessTokenExpiresAt)
+	if util.HTTPError(w, err) {
+		h.log.Err(err).Send()
+		return
+	}
+
+	if err := util.HTTPResponse(w, http.StatusOK, la); err != nil {
+		h.log.Err(err).Send()
+	}
+}
+
+type MarkUserLAUsedHandler struct {
+	log zerolog.Logger
+	ah  *action.ActionHandler
+}
+
+func NewMarkUserLAUsedHandler(log zerolog.Logger, ah *action.ActionHandler) *MarkUserLAUsedHandler {
+	return &MarkUserLAUsedHandler{log: log, ah: ah}
+}
+
+func (h *MarkUserLAUsedHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	vars := mux.Vars(r)
+	userRef := vars["userref"]
+	linkedAccountID := vars["laid"]
+
+	err := h.ah.MarkUserLAUsed(ctx, userRef, linkedAccountID, time.Now())
+	if util.HTTPError(w, err) {
+		h.log.Err(err).Send()
+		return
+	}
+
+	if err := util.HTTPResponse(w, http.StatusNoContent, nil); err != nil {
+		h.log.Err(err).Send()
+	}
+}
+
 type UserTokensHandler struct {
 	log zerolog.Logger
 	ah  *action.ActionHandler
@@ -461,21 +548,62 @@ func (h *CreateUserTokenHandler) ServeHTTP(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	token, err := h.ah.CreateUserToken(ctx, userRef, req.TokenName)
+	creq := &action.CreateUserTokenRequest{
+		UserRef:   userRef,
+		TokenName: req.TokenName,
+		ExpiresAt: req.ExpiresAt,
+		Scopes:    req.Scopes,
+	}
+	token, tokenValue, err := h.ah.CreateUserToken(ctx, creq)
 	if util.HTTPError(w, err) {
 		h.log.Err(err).Send()
 		return
 	}
 
 	resp := &csapitypes.CreateUserTokenResponse{
-		Name:  token.Name,
-		Token: token.Value,
+		Name:      token.Name,
+		Token:     tokenValue,
+		ExpiresAt: token.ExpiresAt,
+		Scopes:    token.Scopes,
 	}
 	if err := util.HTTPResponse(w, http.StatusCreated, resp); err != nil {
 		h.log.Err(err).Send()
 	}
 }
 
+type UpdateUserTokenHandler struct {
+	log zerolog.Logger
+	ah  *action.ActionHandler
+}
+
+func NewUpdateUserTokenHandler(log zerolog.Logger, ah *action.ActionHandler) *UpdateUserTokenHandler {
+	return &UpdateUserTokenHandler{log: log, ah: ah}
+}
+
+func (h *UpdateUserTokenHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	vars := mux.Vars(r)
+	userRef := vars["userref"]
+	tokenName := vars["tokenname"]
+
+	var req csapitypes.UpdateUserTokenRequest
+	d := json.NewDecoder(r.Body)
+	if err := d.Decode(&req); err != nil {
+		util.HTTPError(w, util.NewAPIError(util.ErrBadRequest, err))
+		return
+	}
+
+	token, err := h.ah.UpdateUserTokenName(ctx, userRef, tokenName, req.TokenName)
+	if util.HTTPError(w, err) {
+		h.log.Err(err).Send()
+		return
+	}
+
+	if err := util.HTTPResponse(w, http.StatusOK, token); err != nil {
+		h.log.Err(err).Send()
+	}
+}
+
 type DeleteUserTokenHandler struct {
 	log zerolog.Logger
 	ah  *action.ActionHandler
@@ -521,8 +649,12 @@ func (h *UserOrgsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	vars := mux.Vars(r)
 	userRef := vars["userref"]
+	query := r.URL.Query()
 
-	userOrgs, err := h.ah.GetUserOrgs(ctx, userRef)
+	userOrgs, err := h.ah.GetUserOrgs(ctx, &action.GetUserOrgsRequest{
+		UserRef: userRef,
+		MinRole: types.MemberRole(query.Get("minrole")),
+	})
 	if util.HTTPError(w, err) {
 		h.log.Err(err).Send()
 		return
@@ -125,9 +125,21 @@ func NewConfigstore(ctx context.Context, log zerolog.Logger, c *config.Configsto
 		return nil, errors.Wrapf(err, "create db error")
 	}
 
-	ah := action.NewActionHandler(log, d, lf)
+	ah := action.NewActionHandler(log, d, lf, c.ReservedUserNames)
+	ah.SetMaxUserTokens(c.MaxUserTokens)
+	switch c.AuditLog {
+	case "":
+	case config.AuditLogTypeLog:
+		ah.SetAuditLogger(action.NewLogAuditLogger(log))
+	default:
+		return nil, errors.Errorf("unknown audit log type %q", c.AuditLog)
+	}
 	cs.ah = ah
 
+	if err := ah.MigrateLegacyUserTokens(ctx); err != nil {
+		return nil, errors.Wrapf(err, "migrate legacy user tokens error")
+	}
+
 	return cs, nil
 }
 
@@ -159,8 +171,8 @@ func (s *Configstore) setupDefaultRouter() http.Handler {
 	updateVariableHandler := api.NewUpdateVariableHandler(s.log, s.ah)
 	deleteVariableHandler := api.NewDeleteVariableHandler(s.log, s.ah)
 
-	userHandler := api.NewUserHandler(s.log, s.d)
-	usersHandler := api.NewUsersHandler(s.log, s.d)
+	userHandler := api.NewUserHandler(s.log, s.ah)
+	usersHandler := api.NewUsersHandler(s.log, s.ah, s.d)
 	createUserHandler := api.NewCreateUserHandler(s.log, s.ah)
 	updateUserHandler := api.NewUpdateUserHandler(s.log, s.ah)
 	deleteUserHandler := api.NewDeleteUserHandler(s.log, s.ah)
@@ -171,9 +183,12 @@ func (s *Configstore) setupDefaultRouter() http.Handler {
 	createUserLAHandler := api.NewCreateUserLAHandler(s.log, s.ah)
 	deleteUserLAHandler := api.NewDeleteUserLAHandler(s.log, s.ah)
 	updateUserLAHandler := api.NewUpdateUserLAHandler(s.log, s.ah)
+	refreshUserLAOauth2TokenHandler := api.NewRefreshUserLAOauth2TokenHandler(s.log, s.ah)
+	markUserLAUsedHandler := api.NewMarkUserLAUsedHandler(s.log, s.ah)
 
 	userTokensHandler := api.NewUserTokensHandler(s.log, s.ah)
 	createUserTokenHandler := api.NewCreateUserTokenHandler(s.log, s.ah)
+	updateUserTokenHandler := api.NewUpdateUserTokenHandler(s.log, s.ah)
 	deleteUserTokenHandler := api.NewDeleteUserTokenHandler(s.log, s.ah)
 
 	userOrgsHandler := api.NewUserOrgsHandler(s.log, s.ah)
@@ -201,6 +216,7 @@ func (s *Configstore) setupDefaultRouter() http.Handler {
 
 	router := mux.NewRouter()
 	apirouter := router.PathPrefix("/api/v1alpha").Subrouter().UseEncodedPath()
+	apirouter.Use(api.AuditActorMiddleware)
 
 	apirouter.Handle("/projectgroups/{projectgroupref}", projectGroupHandler).Methods("GET")
 	apirouter.Handle("/projectgroups/{projectgroupref}/subgroups", projectGroupSubgroupsHandler).Methods("GET")
@@ -243,8 +259,11 @@ func (s *Configstore) setupDefaultRouter() http.Handler {
 	apirouter.Handle("/users/{userref}/linkedaccounts", createUserLAHandler).Methods("POST")
 	apirouter.Handle("/users/{userref}/linkedaccounts/{laid}", deleteUserLAHandler).Methods("DELETE")
 	apirouter.Handle("/users/{userref}/linkedaccounts/{laid}", updateUserLAHandler).Methods("PUT")
+	apirouter.Handle("/users/{userref}/linkedaccounts/{laid}/oauth2token", refreshUserLAOauth2TokenHandler).Methods("PUT")
+	apirouter.Handle("/users/{userref}/linkedaccounts/{laid}/lastused", markUserLAUsedHandler).Methods("PUT")
 	apirouter.Handle("/users/{userref}/tokens", userTokensHandler).Methods("GET")
 	apirouter.Handle("/users/{userref}/tokens", createUserTokenHandler).Methods("POST")
+	apirouter.Handle("/users/{userref}/tokens/{tokenname}", updateUserTokenHandler).Methods("PUT")
 	apirouter.Handle("/users/{userref}/tokens/{tokenname}", deleteUserTokenHandler).Methods("DELETE")
 
 	apirouter.Handle("/users/{userref}/orgs", userOrgsHandler).Methods("GET")
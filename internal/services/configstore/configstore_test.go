@@ -20,8 +20,10 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net"
+	"net/http/httptest"
 	"path"
 	"path/filepath"
+	"sort"
 	"sync"
 	"testing"
 	"time"
@@ -32,6 +34,8 @@ import (
 	"agola.io/agola/internal/sql"
 	"agola.io/agola/internal/testutil"
 	"agola.io/agola/internal/util"
+	csapitypes "agola.io/agola/services/configstore/api/types"
+	csclient "agola.io/agola/services/configstore/client"
 	"agola.io/agola/services/configstore/types"
 	stypes "agola.io/agola/services/types"
 
@@ -128,13 +132,31 @@ func getUsers(ctx context.Context, cs *Configstore) ([]*types.User, error) {
 	var users []*types.User
 	err := cs.d.Do(ctx, func(tx *sql.Tx) error {
 		var err error
-		users, err = cs.d.GetUsers(tx, "", 0, true)
+		users, err = cs.d.GetUsers(tx, "", "", 0, true, true)
 		return errors.WithStack(err)
 	})
 
 	return users, errors.WithStack(err)
 }
 
+func setUserTokenLastUsedAt(ctx context.Context, cs *Configstore, userName, tokenName string, usedAt time.Time) error {
+	err := cs.d.Do(ctx, func(tx *sql.Tx) error {
+		user, err := cs.d.GetUserByName(tx, userName)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		token, err := cs.d.GetUserToken(tx, user.ID, tokenName)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		token.LastUsedAt = &usedAt
+
+		return errors.WithStack(cs.d.UpdateUserToken(tx, token))
+	})
+
+	return errors.WithStack(err)
+}
+
 func getOrgs(ctx context.Context, cs *Configstore) ([]*types.Organization, error) {
 	var orgs []*types.Organization
 	err := cs.d.Do(ctx, func(tx *sql.Tx) error {
@@ -474,7 +496,7 @@ func TestUser(t *testing.T) {
 			t.Fatalf("unexpected err: %v", err)
 		}
 
-		err = cs.ah.DeleteUser(ctx, "user03")
+		err = cs.ah.DeleteUser(ctx, &action.DeleteUserRequest{UserRef: "user03"})
 		if err != nil {
 			t.Fatalf("unexpected err: %v", err)
 		}
@@ -492,9 +514,36 @@ func TestUser(t *testing.T) {
 			t.Fatalf("expected user nil, got: %v", user)
 		}
 	})
+
+	t.Run("rename user", func(t *testing.T) {
+		user, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: "user04"})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+
+		res, err := cs.ah.UpdateUser(ctx, &action.UpdateUserRequest{UserRef: user.ID, UserName: "user05"})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if res.PreviousName != "user04" {
+			t.Fatalf("expected previous name %q, got %q", "user04", res.PreviousName)
+		}
+		if res.User.Name != "user05" {
+			t.Fatalf("expected user name %q, got %q", "user05", res.User.Name)
+		}
+
+		// without a rename the previous name is the current name
+		res, err = cs.ah.UpdateUser(ctx, &action.UpdateUserRequest{UserRef: user.ID})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if res.PreviousName != "user05" {
+			t.Fatalf("expected previous name %q, got %q", "user05", res.PreviousName)
+		}
+	})
 }
 
-func TestProjectGroupsAndProjectsCreate(t *testing.T) {
+func TestUserNameCaseInsensitiveUniqueness(t *testing.T) {
 	dir := t.TempDir()
 	ctx := context.Background()
 	log := testutil.NewLogger(t)
@@ -502,133 +551,65 @@ func TestProjectGroupsAndProjectsCreate(t *testing.T) {
 	cs := setupConfigstore(ctx, t, log, dir)
 
 	t.Logf("starting cs")
-	go func() {
-		_ = cs.Run(ctx)
-	}()
+	go func() { _ = cs.Run(ctx) }()
 
-	user, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: "user01"})
+	alice, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: "Alice"})
 	if err != nil {
 		t.Fatalf("unexpected err: %v", err)
 	}
-	org, err := cs.ah.CreateOrg(ctx, &action.CreateOrgRequest{Name: "org01", Visibility: types.VisibilityPublic})
-	if err != nil {
+	if _, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: "bob"}); err != nil {
 		t.Fatalf("unexpected err: %v", err)
 	}
 
-	t.Run("create a project in user root project group", func(t *testing.T) {
-		_, err := cs.ah.CreateProject(ctx, &action.CreateUpdateProjectRequest{Name: "project01", Parent: types.Parent{Kind: types.ObjectKindProjectGroup, ID: path.Join("user", user.Name)}, Visibility: types.VisibilityPublic, RemoteRepositoryConfigType: types.RemoteRepositoryConfigTypeManual})
-		if err != nil {
-			t.Fatalf("unexpected err: %v", err)
-		}
-	})
-	t.Run("create a project in org root project group", func(t *testing.T) {
-		_, err := cs.ah.CreateProject(ctx, &action.CreateUpdateProjectRequest{Name: "project01", Parent: types.Parent{Kind: types.ObjectKindProjectGroup, ID: path.Join("org", org.Name)}, Visibility: types.VisibilityPublic, RemoteRepositoryConfigType: types.RemoteRepositoryConfigTypeManual})
-		if err != nil {
-			t.Fatalf("unexpected err: %v", err)
-		}
-	})
-	t.Run("create a projectgroup in user root project group", func(t *testing.T) {
-		_, err := cs.ah.CreateProjectGroup(ctx, &action.CreateUpdateProjectGroupRequest{Name: "projectgroup01", Parent: types.Parent{Kind: types.ObjectKindProjectGroup, ID: path.Join("user", user.Name)}, Visibility: types.VisibilityPublic})
-		if err != nil {
-			t.Fatalf("unexpected err: %v", err)
-		}
-	})
-	t.Run("create a projectgroup in org root project group", func(t *testing.T) {
-		_, err := cs.ah.CreateProjectGroup(ctx, &action.CreateUpdateProjectGroupRequest{Name: "projectgroup01", Parent: types.Parent{Kind: types.ObjectKindProjectGroup, ID: path.Join("org", org.Name)}, Visibility: types.VisibilityPublic})
-		if err != nil {
-			t.Fatalf("unexpected err: %v", err)
-		}
-	})
-	t.Run("create a project in user non root project group with same name as a root project", func(t *testing.T) {
-		_, err := cs.ah.CreateProject(ctx, &action.CreateUpdateProjectRequest{Name: "project01", Parent: types.Parent{Kind: types.ObjectKindProjectGroup, ID: path.Join("user", user.Name, "projectgroup01")}, Visibility: types.VisibilityPublic, RemoteRepositoryConfigType: types.RemoteRepositoryConfigTypeManual})
-		if err != nil {
-			t.Fatalf("unexpected err: %v", err)
-		}
-	})
-	t.Run("create a project in org non root project group with same name as a root project", func(t *testing.T) {
-		_, err := cs.ah.CreateProject(ctx, &action.CreateUpdateProjectRequest{Name: "project01", Parent: types.Parent{Kind: types.ObjectKindProjectGroup, ID: path.Join("org", org.Name, "projectgroup01")}, Visibility: types.VisibilityPublic, RemoteRepositoryConfigType: types.RemoteRepositoryConfigTypeManual})
+	t.Run("test display casing is preserved", func(t *testing.T) {
+		var user *types.User
+		err := cs.d.Do(ctx, func(tx *sql.Tx) error {
+			var err error
+			user, err = cs.d.GetUser(tx, alice.ID)
+			return errors.WithStack(err)
+		})
 		if err != nil {
 			t.Fatalf("unexpected err: %v", err)
 		}
-	})
-
-	t.Run("create duplicated project in user root project group", func(t *testing.T) {
-		projectName := "project01"
-		expectedErr := fmt.Sprintf("project with name %q, path %q already exists", projectName, path.Join("user", user.Name, projectName))
-		_, err := cs.ah.CreateProject(ctx, &action.CreateUpdateProjectRequest{Name: projectName, Parent: types.Parent{Kind: types.ObjectKindProjectGroup, ID: path.Join("user", user.Name)}, Visibility: types.VisibilityPublic, RemoteRepositoryConfigType: types.RemoteRepositoryConfigTypeManual})
-		if err.Error() != expectedErr {
-			t.Fatalf("expected err %v, got err: %v", expectedErr, err)
-		}
-	})
-	t.Run("create duplicated project in org root project group", func(t *testing.T) {
-		projectName := "project01"
-		expectedErr := fmt.Sprintf("project with name %q, path %q already exists", projectName, path.Join("org", org.Name, projectName))
-		_, err := cs.ah.CreateProject(ctx, &action.CreateUpdateProjectRequest{Name: projectName, Parent: types.Parent{Kind: types.ObjectKindProjectGroup, ID: path.Join("org", org.Name)}, Visibility: types.VisibilityPublic, RemoteRepositoryConfigType: types.RemoteRepositoryConfigTypeManual})
-		if err.Error() != expectedErr {
-			t.Fatalf("expected err %v, got err: %v", expectedErr, err)
+		if user.Name != "Alice" {
+			t.Fatalf("expected user name %q, got %q", "Alice", user.Name)
 		}
 	})
 
-	t.Run("create duplicated project in user non root project group", func(t *testing.T) {
-		projectName := "project01"
-		expectedErr := fmt.Sprintf("project with name %q, path %q already exists", projectName, path.Join("user", user.Name, "projectgroup01", projectName))
-		_, err := cs.ah.CreateProject(ctx, &action.CreateUpdateProjectRequest{Name: projectName, Parent: types.Parent{Kind: types.ObjectKindProjectGroup, ID: path.Join("user", user.Name, "projectgroup01")}, Visibility: types.VisibilityPublic, RemoteRepositoryConfigType: types.RemoteRepositoryConfigTypeManual})
-		if err.Error() != expectedErr {
-			t.Fatalf("expected err %v, got err: %v", expectedErr, err)
+	t.Run("test create user with a name differing only by case", func(t *testing.T) {
+		expectedErr := util.NewAPIError(util.ErrConflict, errors.Errorf(`user with name "Alice" already exists`))
+		_, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: "alice"})
+		if err == nil {
+			t.Fatalf("expected err, got nil err")
 		}
-	})
-	t.Run("create duplicated project in org non root project group", func(t *testing.T) {
-		projectName := "project01"
-		expectedErr := fmt.Sprintf("project with name %q, path %q already exists", projectName, path.Join("org", org.Name, "projectgroup01", projectName))
-		_, err := cs.ah.CreateProject(ctx, &action.CreateUpdateProjectRequest{Name: projectName, Parent: types.Parent{Kind: types.ObjectKindProjectGroup, ID: path.Join("org", org.Name, "projectgroup01")}, Visibility: types.VisibilityPublic, RemoteRepositoryConfigType: types.RemoteRepositoryConfigTypeManual})
-		if err.Error() != expectedErr {
+		if !util.APIErrorIs(err, util.ErrConflict) || err.Error() != expectedErr.Error() {
 			t.Fatalf("expected err %v, got err: %v", expectedErr, err)
 		}
 	})
 
-	t.Run("create project in unexistent project group", func(t *testing.T) {
-		expectedErr := `project group with id "unexistentid" doesn't exist`
-		_, err := cs.ah.CreateProject(ctx, &action.CreateUpdateProjectRequest{Name: "project01", Parent: types.Parent{Kind: types.ObjectKindProjectGroup, ID: "unexistentid"}, Visibility: types.VisibilityPublic, RemoteRepositoryConfigType: types.RemoteRepositoryConfigTypeManual})
-		if err.Error() != expectedErr {
-			t.Fatalf("expected err %v, got err: %v", expectedErr, err)
+	t.Run("test rename user to a name differing only by case from another user", func(t *testing.T) {
+		expectedErr := util.NewAPIError(util.ErrConflict, errors.Errorf(`user with name "Alice" already exists`))
+		_, err := cs.ah.UpdateUser(ctx, &action.UpdateUserRequest{UserRef: "bob", UserName: "ALICE"})
+		if err == nil {
+			t.Fatalf("expected err, got nil err")
 		}
-	})
-	t.Run("create project without parent id specified", func(t *testing.T) {
-		expectedErr := "project parent id required"
-		_, err := cs.ah.CreateProject(ctx, &action.CreateUpdateProjectRequest{Name: "project01", Visibility: types.VisibilityPublic, RemoteRepositoryConfigType: types.RemoteRepositoryConfigTypeManual})
-		if err.Error() != expectedErr {
+		if !util.APIErrorIs(err, util.ErrConflict) || err.Error() != expectedErr.Error() {
 			t.Fatalf("expected err %v, got err: %v", expectedErr, err)
 		}
 	})
 
-	t.Run("concurrent project with same name creation", func(t *testing.T) {
-		prevProjects, err := getProjects(ctx, cs)
-		if err != nil {
-			t.Fatalf("unexpected err: %v", err)
-		}
-
-		wg := sync.WaitGroup{}
-		for i := 0; i < 10; i++ {
-			wg.Add(1)
-			go func() {
-				_, _ = cs.ah.CreateProject(ctx, &action.CreateUpdateProjectRequest{Name: "project02", Parent: types.Parent{Kind: types.ObjectKindProjectGroup, ID: path.Join("user", user.Name)}, Visibility: types.VisibilityPublic, RemoteRepositoryConfigType: types.RemoteRepositoryConfigTypeManual})
-				wg.Done()
-			}()
-		}
-		wg.Wait()
-
-		projects, err := getProjects(ctx, cs)
+	t.Run("test change user name case", func(t *testing.T) {
+		res, err := cs.ah.UpdateUser(ctx, &action.UpdateUserRequest{UserRef: "Alice", UserName: "alice"})
 		if err != nil {
 			t.Fatalf("unexpected err: %v", err)
 		}
-
-		if len(projects) != len(prevProjects)+1 {
-			t.Fatalf("expected %d projects, got %d", len(prevProjects)+1, len(projects))
+		if res.User.Name != "alice" {
+			t.Fatalf("expected user name %q, got %q", "alice", res.User.Name)
 		}
 	})
 }
 
-func TestProjectUpdate(t *testing.T) {
+func TestReservedUserNames(t *testing.T) {
 	dir := t.TempDir()
 	ctx := context.Background()
 	log := testutil.NewLogger(t)
@@ -636,60 +617,50 @@ func TestProjectUpdate(t *testing.T) {
 	cs := setupConfigstore(ctx, t, log, dir)
 
 	t.Logf("starting cs")
-	go func() {
-		_ = cs.Run(ctx)
-	}()
+	go func() { _ = cs.Run(ctx) }()
 
-	user, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: "user01"})
-	if err != nil {
-		t.Fatalf("unexpected err: %v", err)
-	}
+	ah := action.NewActionHandler(log, cs.d, cs.lf, []string{"admin", "API"})
 
-	if _, err := cs.ah.CreateProjectGroup(ctx, &action.CreateUpdateProjectGroupRequest{Name: "projectgroup01", Parent: types.Parent{Kind: types.ObjectKindProjectGroup, ID: path.Join("user", user.Name)}, Visibility: types.VisibilityPublic}); err != nil {
-		t.Fatalf("unexpected err: %v", err)
-	}
-	p01 := &action.CreateUpdateProjectRequest{Name: "project01", Parent: types.Parent{Kind: types.ObjectKindProjectGroup, ID: path.Join("user", user.Name)}, Visibility: types.VisibilityPublic, RemoteRepositoryConfigType: types.RemoteRepositoryConfigTypeManual}
-	if _, err := cs.ah.CreateProject(ctx, p01); err != nil {
-		t.Fatalf("unexpected err: %v", err)
-	}
-	p02 := &action.CreateUpdateProjectRequest{Name: "project01", Parent: types.Parent{Kind: types.ObjectKindProjectGroup, ID: path.Join("user", user.Name, "projectgroup01")}, Visibility: types.VisibilityPublic, RemoteRepositoryConfigType: types.RemoteRepositoryConfigTypeManual}
-	if _, err := cs.ah.CreateProject(ctx, p02); err != nil {
-		t.Fatalf("unexpected err: %v", err)
-	}
-	p03 := &action.CreateUpdateProjectRequest{Name: "project02", Parent: types.Parent{Kind: types.ObjectKindProjectGroup, ID: path.Join("user", user.Name, "projectgroup01")}, Visibility: types.VisibilityPublic, RemoteRepositoryConfigType: types.RemoteRepositoryConfigTypeManual}
-	if _, err := cs.ah.CreateProject(ctx, p03); err != nil {
+	if _, err := ah.CreateUser(ctx, &action.CreateUserRequest{UserName: "user01"}); err != nil {
 		t.Fatalf("unexpected err: %v", err)
 	}
 
-	t.Run("rename project keeping same parent", func(t *testing.T) {
-		projectName := "project02"
-		p03.Name = "newproject02"
-		_, err := cs.ah.UpdateProject(ctx, path.Join("user", user.Name, "projectgroup01", projectName), p03)
-		if err != nil {
-			t.Fatalf("unexpected err: %v", err)
+	t.Run("test create user with a reserved name", func(t *testing.T) {
+		for _, userName := range []string{"admin", "Admin", "api"} {
+			expectedErr := util.NewAPIError(util.ErrBadRequest, errors.Errorf("user name %q is reserved", userName))
+			_, err := ah.CreateUser(ctx, &action.CreateUserRequest{UserName: userName})
+			if err == nil {
+				t.Fatalf("expected err, got nil err")
+			}
+			if !util.APIErrorIs(err, util.ErrBadRequest) || err.Error() != expectedErr.Error() {
+				t.Fatalf("expected err %v, got err: %v", expectedErr, err)
+			}
 		}
 	})
-	t.Run("move project to project group having project with same name", func(t *testing.T) {
-		projectName := "project01"
-		expectedErr := fmt.Sprintf("project with name %q, path %q already exists", projectName, path.Join("user", user.Name, projectName))
-		p02.Parent.ID = path.Join("user", user.Name)
-		_, err := cs.ah.UpdateProject(ctx, path.Join("user", user.Name, "projectgroup01", projectName), p02)
-		if err.Error() != expectedErr {
+
+	t.Run("test rename user to a reserved name", func(t *testing.T) {
+		expectedErr := util.NewAPIError(util.ErrBadRequest, errors.Errorf(`user name "admin" is reserved`))
+		_, err := ah.UpdateUser(ctx, &action.UpdateUserRequest{UserRef: "user01", UserName: "admin"})
+		if err == nil {
+			t.Fatalf("expected err, got nil err")
+		}
+		if !util.APIErrorIs(err, util.ErrBadRequest) || err.Error() != expectedErr.Error() {
 			t.Fatalf("expected err %v, got err: %v", expectedErr, err)
 		}
 	})
-	t.Run("move project to project group changing name", func(t *testing.T) {
-		projectName := "project01"
-		p02.Name = "newproject01"
-		p02.Parent.ID = path.Join("user", user.Name)
-		_, err := cs.ah.UpdateProject(ctx, path.Join("user", user.Name, "projectgroup01", projectName), p02)
+
+	t.Run("test create user with a not reserved name", func(t *testing.T) {
+		user, err := ah.CreateUser(ctx, &action.CreateUserRequest{UserName: "administrator"})
 		if err != nil {
 			t.Fatalf("unexpected err: %v", err)
 		}
+		if user.Name != "administrator" {
+			t.Fatalf("expected user name %q, got %q", "administrator", user.Name)
+		}
 	})
 }
 
-func TestProjectGroupUpdate(t *testing.T) {
+func TestGetCaseInsensitiveNameConflicts(t *testing.T) {
 	dir := t.TempDir()
 	ctx := context.Background()
 	log := testutil.NewLogger(t)
@@ -697,153 +668,3474 @@ func TestProjectGroupUpdate(t *testing.T) {
 	cs := setupConfigstore(ctx, t, log, dir)
 
 	t.Logf("starting cs")
-	go func() {
-		_ = cs.Run(ctx)
-	}()
+	go func() { _ = cs.Run(ctx) }()
 
-	user, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: "user01"})
-	if err != nil {
-		t.Fatalf("unexpected err: %v", err)
+	// conflicting users can't be created anymore, insert them directly to
+	// simulate users created before case insensitive user names uniqueness
+	// was enforced
+	users := map[string]*types.User{}
+	for _, userName := range []string{"bob", "user01", "Bob", "alice", "BOB", "User01", "user02"} {
+		err := cs.d.Do(ctx, func(tx *sql.Tx) error {
+			user := types.NewUser(tx)
+			user.Name = userName
+			users[userName] = user
+
+			return errors.WithStack(cs.d.InsertUser(tx, user))
+		})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
 	}
 
-	rootPG, err := cs.ah.GetProjectGroup(ctx, path.Join("user", user.Name))
+	conflicts, err := cs.ah.GetCaseInsensitiveNameConflicts(ctx)
 	if err != nil {
 		t.Fatalf("unexpected err: %v", err)
 	}
 
-	pg01req := &action.CreateUpdateProjectGroupRequest{Name: "pg01", Parent: types.Parent{Kind: types.ProjectGroupKind, ID: path.Join("user", user.Name)}, Visibility: types.VisibilityPublic}
-	if _, err := cs.ah.CreateProjectGroup(ctx, pg01req); err != nil {
-		t.Fatalf("unexpected err: %v", err)
-	}
-	pg02req := &action.CreateUpdateProjectGroupRequest{Name: "pg02", Parent: types.Parent{Kind: types.ProjectGroupKind, ID: path.Join("user", user.Name)}, Visibility: types.VisibilityPublic}
-	if _, err := cs.ah.CreateProjectGroup(ctx, pg02req); err != nil {
-		t.Fatalf("unexpected err: %v", err)
-	}
-	pg03req := &action.CreateUpdateProjectGroupRequest{Name: "pg03", Parent: types.Parent{Kind: types.ProjectGroupKind, ID: path.Join("user", user.Name)}, Visibility: types.VisibilityPublic}
-	if _, err := cs.ah.CreateProjectGroup(ctx, pg03req); err != nil {
-		t.Fatalf("unexpected err: %v", err)
+	expectedConflicts := [][]*types.User{
+		{users["BOB"], users["Bob"], users["bob"]},
+		{users["User01"], users["user01"]},
 	}
-	pg04req := &action.CreateUpdateProjectGroupRequest{Name: "pg01", Parent: types.Parent{Kind: types.ProjectGroupKind, ID: path.Join("user", user.Name, "pg01")}, Visibility: types.VisibilityPublic}
-	if _, err := cs.ah.CreateProjectGroup(ctx, pg04req); err != nil {
-		t.Fatalf("unexpected err: %v", err)
+	if diff := cmpDiffObject(expectedConflicts, conflicts); diff != "" {
+		t.Fatalf("unexpected conflicts:\n%s", diff)
 	}
-	pg05req := &action.CreateUpdateProjectGroupRequest{Name: "pg01", Parent: types.Parent{Kind: types.ProjectGroupKind, ID: path.Join("user", user.Name, "pg02")}, Visibility: types.VisibilityPublic}
-	if _, err := cs.ah.CreateProjectGroup(ctx, pg05req); err != nil {
+}
+
+func TestDeleteInactiveUsers(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+	log := testutil.NewLogger(t)
+
+	cs := setupConfigstore(ctx, t, log, dir)
+
+	t.Logf("starting cs")
+	go func() { _ = cs.Run(ctx) }()
+
+	// all the users are created before the cutoff
+	inactiveSince := time.Now().Add(1 * time.Hour)
+	usedBefore := inactiveSince.Add(-30 * time.Minute)
+	usedAfter := inactiveSince.Add(1 * time.Hour)
+
+	if _, err := cs.ah.CreateRemoteSource(ctx, &action.CreateUpdateRemoteSourceRequest{
+		Name:                "rs01",
+		APIURL:              "https://api.example.com",
+		Type:                types.RemoteSourceTypeGitea,
+		AuthType:            types.RemoteSourceAuthTypeOauth2,
+		Oauth2ClientID:      "clientid",
+		Oauth2ClientSecret:  "clientsecret",
+		RegistrationEnabled: util.BoolP(true),
+		LoginEnabled:        util.BoolP(true),
+	}); err != nil {
 		t.Fatalf("unexpected err: %v", err)
 	}
 
-	t.Run("rename project group keeping same parent", func(t *testing.T) {
-		projectGroupName := "pg03"
-		pg03req.Name = "newpg03"
-		if _, err := cs.ah.UpdateProjectGroup(ctx, path.Join("user", user.Name, projectGroupName), pg03req); err != nil {
-			t.Fatalf("unexpected err: %v", err)
+	setup := func(t *testing.T) {
+		users := map[string]*types.User{}
+		for i := 1; i <= 8; i++ {
+			req := &action.CreateUserRequest{UserName: fmt.Sprintf("user%02d", i)}
+			if i == 3 || i == 8 {
+				remoteUserID := fmt.Sprintf("remoteuser%02d", i)
+				req.CreateUserLARequest = &action.CreateUserLARequest{RemoteSourceName: "rs01", RemoteUserID: remoteUserID, RemoteUserName: remoteUserID}
+			}
+			user, err := cs.ah.CreateUser(ctx, req)
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			users[user.Name] = user
 		}
-	})
-	t.Run("move project to project group having project with same name", func(t *testing.T) {
-		projectGroupName := "pg01"
-		expectedErr := fmt.Sprintf("project group with name %q, path %q already exists", projectGroupName, path.Join("user", user.Name, projectGroupName))
-		pg05req.Parent.ID = path.Join("user", user.Name)
-		_, err := cs.ah.UpdateProjectGroup(ctx, path.Join("user", user.Name, "pg02", projectGroupName), pg05req)
-		if err.Error() != expectedErr {
-			t.Fatalf("expected err %v, got err: %v", expectedErr, err)
+
+		// user02 token used after the cutoff
+		// user04 token used before the cutoff
+		// user07 token used after the cutoff
+		for userName, usedAt := range map[string]time.Time{"user02": usedAfter, "user04": usedBefore, "user07": usedAfter} {
+			if _, _, err := cs.ah.CreateUserToken(ctx, &action.CreateUserTokenRequest{UserRef: userName, TokenName: "token01"}); err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			if err := setUserTokenLastUsedAt(ctx, cs, userName, "token01", usedAt); err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
 		}
-	})
-	t.Run("move project group to root project group changing name", func(t *testing.T) {
-		projectGroupName := "pg01"
-		pg05req.Name = "newpg01"
-		pg05req.Parent.ID = path.Join("user", user.Name)
-		pg05, err := cs.ah.UpdateProjectGroup(ctx, path.Join("user", user.Name, "pg02", projectGroupName), pg05req)
+
+		// user03 linked account used after the cutoff
+		las, err := cs.ah.GetUserLinkedAccounts(ctx, "user03")
 		if err != nil {
 			t.Fatalf("unexpected err: %v", err)
 		}
-		if pg05.Parent.ID != rootPG.ID {
-			t.Fatalf("expected project group parent id as root project group id")
+		if err := cs.ah.MarkUserLAUsed(ctx, "user03", las[0].ID, usedAfter); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+
+		// user08 linked account never used, its last use is unknown
+
+		// user05 is the only owner of org01
+		if _, err := cs.ah.CreateOrg(ctx, &action.CreateOrgRequest{Name: "org01", Visibility: types.VisibilityPublic, CreatorUserID: users["user05"].ID}); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		// user06 is an owner of org02 together with user07
+		org02, err := cs.ah.CreateOrg(ctx, &action.CreateOrgRequest{Name: "org02", Visibility: types.VisibilityPublic, CreatorUserID: users["user06"].ID})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if _, err := cs.ah.AddOrgMember(ctx, org02.ID, "user07", types.MemberRoleOwner); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+	}
+
+	cleanup := func(t *testing.T) {
+		for _, orgName := range []string{"org01", "org02"} {
+			if err := cs.ah.DeleteOrg(ctx, orgName); err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+		}
+		for _, userName := range []string{"user03", "user08"} {
+			las, err := cs.ah.GetUserLinkedAccounts(ctx, userName)
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			if err := cs.ah.DeleteUserLA(ctx, userName, las[0].ID); err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+		}
+		for i := 1; i <= 8; i++ {
+			// ignore not existing users
+			_ = cs.ah.DeleteUser(ctx, &action.DeleteUserRequest{UserRef: fmt.Sprintf("user%02d", i)})
+		}
+	}
+
+	userNames := func(users []*types.User) []string {
+		names := []string{}
+		for _, user := range users {
+			names = append(names, user.Name)
+		}
+		return names
+	}
+
+	expectedDeleted := []string{"user01", "user04", "user06"}
+	expectedSkipped := map[string]string{"user05": `user is the only owner of organization "org01"`}
+
+	for _, dryRun := range []bool{true, false} {
+		t.Run(fmt.Sprintf("test delete inactive users with dry run %t", dryRun), func(t *testing.T) {
+			setup(t)
+			defer cleanup(t)
+
+			res, err := cs.ah.DeleteInactiveUsers(ctx, inactiveSince, dryRun)
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+
+			if diff := cmp.Diff(expectedDeleted, userNames(res.Deleted)); diff != "" {
+				t.Fatalf("unexpected deleted users:\n%s", diff)
+			}
+			skipped := map[string]string{}
+			for _, s := range res.Skipped {
+				skipped[s.User.Name] = s.Reason
+			}
+			if diff := cmp.Diff(expectedSkipped, skipped); diff != "" {
+				t.Fatalf("unexpected skipped users:\n%s", diff)
+			}
+			if len(res.Failed) != 0 {
+				t.Fatalf("unexpected failed users: %v", res.Failed)
+			}
+
+			users, err := getUsers(ctx, cs)
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			expectedUsers := []string{"user01", "user02", "user03", "user04", "user05", "user06", "user07", "user08"}
+			if !dryRun {
+				expectedUsers = []string{"user02", "user03", "user05", "user07", "user08"}
+			}
+			if diff := cmp.Diff(expectedUsers, userNames(users)); diff != "" {
+				t.Fatalf("unexpected users:\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestMarkUserLAUsed(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+	log := testutil.NewLogger(t)
+
+	cs := setupConfigstore(ctx, t, log, dir)
+
+	t.Logf("starting cs")
+	go func() { _ = cs.Run(ctx) }()
+
+	if _, err := cs.ah.CreateRemoteSource(ctx, &action.CreateUpdateRemoteSourceRequest{
+		Name:                "rs01",
+		APIURL:              "https://api.example.com",
+		Type:                types.RemoteSourceTypeGitea,
+		AuthType:            types.RemoteSourceAuthTypeOauth2,
+		Oauth2ClientID:      "clientid",
+		Oauth2ClientSecret:  "clientsecret",
+		RegistrationEnabled: util.BoolP(true),
+		LoginEnabled:        util.BoolP(true),
+	}); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if _, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: "user01", CreateUserLARequest: &action.CreateUserLARequest{RemoteSourceName: "rs01", RemoteUserID: "remoteuser01", RemoteUserName: "remoteuser01"}}); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if _, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: "user02"}); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	getLA := func(t *testing.T) *types.LinkedAccount {
+		las, err := cs.ah.GetUserLinkedAccounts(ctx, "user01")
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		return las[0]
+	}
+
+	la := getLA(t)
+	if la.LastUsedAt != nil {
+		t.Fatalf("expected nil linked account last used time, got %v", la.LastUsedAt)
+	}
+
+	server := httptest.NewServer(cs.setupDefaultRouter())
+	defer server.Close()
+	client := csclient.NewClient(server.URL)
+
+	t.Run("test mark linked account used", func(t *testing.T) {
+		if _, err := client.MarkUserLAUsed(ctx, "user01", la.ID); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+
+		if getLA(t).LastUsedAt == nil {
+			t.Fatalf("expected linked account last used time, got nil")
+		}
+	})
+
+	t.Run("test last used time not updated before the update interval", func(t *testing.T) {
+		firstUse := *getLA(t).LastUsedAt
+
+		if err := cs.ah.MarkUserLAUsed(ctx, "user01", la.ID, firstUse.Add(action.UserLALastUsedUpdateInterval/2)); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if got := getLA(t).LastUsedAt; got == nil || !got.Equal(firstUse) {
+			t.Fatalf("expected linked account last used time %v, got %v", firstUse, got)
+		}
+
+		usedAt := firstUse.Add(action.UserLALastUsedUpdateInterval)
+		if err := cs.ah.MarkUserLAUsed(ctx, "user01", la.ID, usedAt); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if got := getLA(t).LastUsedAt; got == nil || !got.Equal(usedAt) {
+			t.Fatalf("expected linked account last used time %v, got %v", usedAt, got)
+		}
+	})
+
+	t.Run("test only the last used time is updated", func(t *testing.T) {
+		before := getLA(t)
+
+		if _, err := cs.ah.UpdateUserLA(ctx, &action.UpdateUserLARequest{UserRef: "user01", LinkedAccountID: la.ID, RemoteUserID: "remoteuser01", RemoteUserName: "remoteuser01", Oauth2AccessToken: "newaccesstoken", Oauth2RefreshToken: "newrefreshtoken"}); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if err := cs.ah.MarkUserLAUsed(ctx, "user01", la.ID, before.LastUsedAt.Add(action.UserLALastUsedUpdateInterval)); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+
+		after := getLA(t)
+		if after.Oauth2AccessToken != "newaccesstoken" || after.Oauth2RefreshToken != "newrefreshtoken" {
+			t.Fatalf("expected updated oauth2 tokens to be kept, got access token %q, refresh token %q", after.Oauth2AccessToken, after.Oauth2RefreshToken)
+		}
+	})
+
+	t.Run("test mark linked account of another user used", func(t *testing.T) {
+		expectedErr := fmt.Sprintf("linked account id %q for user %q doesn't exist", la.ID, "user02")
+		err := cs.ah.MarkUserLAUsed(ctx, "user02", la.ID, time.Now())
+		if err == nil {
+			t.Fatalf("expected error %v, got nil err", expectedErr)
+		}
+		if !util.APIErrorIs(err, util.ErrNotExist) {
+			t.Fatalf("expected not exist error, got: %v", err)
 		}
-	})
-	t.Run("move project group inside itself", func(t *testing.T) {
-		projectGroupName := "pg02"
-		expectedErr := "cannot move project group inside itself or child project group"
-		pg02req.Parent.ID = path.Join("user", user.Name, "pg02")
-		_, err := cs.ah.UpdateProjectGroup(ctx, path.Join("user", user.Name, projectGroupName), pg02req)
 		if err.Error() != expectedErr {
 			t.Fatalf("expected err %v, got err: %v", expectedErr, err)
 		}
 	})
-	t.Run("move project group to child project group", func(t *testing.T) {
-		projectGroupName := "pg01"
-		expectedErr := "cannot move project group inside itself or child project group"
-		pg01req.Parent.ID = path.Join("user", user.Name, "pg01", "pg01")
-		_, err := cs.ah.UpdateProjectGroup(ctx, path.Join("user", user.Name, projectGroupName), pg01req)
-		if err.Error() != expectedErr {
+}
+
+func TestDeleteUserProjects(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+	log := testutil.NewLogger(t)
+
+	cs := setupConfigstore(ctx, t, log, dir)
+
+	t.Logf("starting cs")
+	go func() { _ = cs.Run(ctx) }()
+
+	createUserProjects := func(t *testing.T, userName string) {
+		if _, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: userName}); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if _, err := cs.ah.CreateProject(ctx, &action.CreateUpdateProjectRequest{Name: "project01", Parent: types.Parent{Kind: types.ObjectKindProjectGroup, ID: path.Join("user", userName)}, Visibility: types.VisibilityPublic, RemoteRepositoryConfigType: types.RemoteRepositoryConfigTypeManual}); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if _, err := cs.ah.CreateProjectGroup(ctx, &action.CreateUpdateProjectGroupRequest{Name: "projectgroup01", Parent: types.Parent{Kind: types.ObjectKindProjectGroup, ID: path.Join("user", userName)}, Visibility: types.VisibilityPublic}); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if _, err := cs.ah.CreateProject(ctx, &action.CreateUpdateProjectRequest{Name: "project02", Parent: types.Parent{Kind: types.ObjectKindProjectGroup, ID: path.Join("user", userName, "projectgroup01")}, Visibility: types.VisibilityPublic, RemoteRepositoryConfigType: types.RemoteRepositoryConfigTypeManual}); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if _, err := cs.ah.CreateSecret(ctx, &action.CreateUpdateSecretRequest{Name: "secret01", Parent: types.Parent{Kind: types.ObjectKindProject, ID: path.Join("user", userName, "projectgroup01", "project02")}, Type: types.SecretTypeInternal, Data: map[string]string{"secret01": "secretvar01"}}); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+	}
+
+	t.Run("delete user without transfer target deletes its projects", func(t *testing.T) {
+		createUserProjects(t, "user01")
+
+		if err := cs.ah.DeleteUser(ctx, &action.DeleteUserRequest{UserRef: "user01"}); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+
+		projectGroups, err := getProjectGroups(ctx, cs)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if len(projectGroups) != 0 {
+			t.Fatalf("expected 0 project groups, got %d", len(projectGroups))
+		}
+		projects, err := getProjects(ctx, cs)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if len(projects) != 0 {
+			t.Fatalf("expected 0 projects, got %d", len(projects))
+		}
+		secrets, err := getSecrets(ctx, cs)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if len(secrets) != 0 {
+			t.Fatalf("expected 0 secrets, got %d", len(secrets))
+		}
+	})
+
+	t.Run("delete user with transfer target moves its projects", func(t *testing.T) {
+		createUserProjects(t, "user02")
+		if _, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: "user03"}); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+
+		if err := cs.ah.DeleteUser(ctx, &action.DeleteUserRequest{UserRef: "user02", TransferToUserRef: "user03"}); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+
+		if _, err := cs.ah.GetProject(ctx, path.Join("user", "user03", "project01")); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if _, err := cs.ah.GetProject(ctx, path.Join("user", "user03", "projectgroup01", "project02")); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		secrets, err := cs.ah.GetSecrets(ctx, types.ObjectKindProject, path.Join("user", "user03", "projectgroup01", "project02"), false)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if len(secrets) != 1 {
+			t.Fatalf("expected 1 secret, got %d", len(secrets))
+		}
+
+		// only user03 root project group and the transferred projectgroup01 remain
+		projectGroups, err := getProjectGroups(ctx, cs)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if len(projectGroups) != 2 {
+			t.Fatalf("expected 2 project groups, got %d", len(projectGroups))
+		}
+	})
+
+	t.Run("delete user with transfer target and conflicting project name", func(t *testing.T) {
+		createUserProjects(t, "user04")
+
+		expectedErr := util.NewAPIError(util.ErrConflict, errors.Errorf("project with name %q, path %q already exists", "project01", path.Join("user", "user03", "project01")))
+		err := cs.ah.DeleteUser(ctx, &action.DeleteUserRequest{UserRef: "user04", TransferToUserRef: "user03"})
+		if err == nil {
+			t.Fatalf("expected error %v, got nil err", expectedErr)
+		}
+		if !util.APIErrorIs(err, util.ErrConflict) || err.Error() != expectedErr.Error() {
 			t.Fatalf("expected err %v, got err: %v", expectedErr, err)
 		}
+
+		// nothing changed
+		if _, err := cs.ah.GetProject(ctx, path.Join("user", "user04", "project01")); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
 	})
-	t.Run("change root project group parent kind", func(t *testing.T) {
-		var rootPG *types.ProjectGroup
-		rootPG, err := cs.ah.GetProjectGroup(ctx, path.Join("user", user.Name))
+
+	t.Run("delete user with not existing transfer target", func(t *testing.T) {
+		expectedErr := util.NewAPIError(util.ErrBadRequest, errors.Errorf("user %q doesn't exist", "user99"))
+		err := cs.ah.DeleteUser(ctx, &action.DeleteUserRequest{UserRef: "user04", TransferToUserRef: "user99"})
+		if err == nil {
+			t.Fatalf("expected error %v, got nil err", expectedErr)
+		}
+		if !util.APIErrorIs(err, util.ErrBadRequest) || err.Error() != expectedErr.Error() {
+			t.Fatalf("expected err %v, got err: %v", expectedErr, err)
+		}
+	})
+}
+
+func TestSoftDeleteUser(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+	log := testutil.NewLogger(t)
+
+	cs := setupConfigstore(ctx, t, log, dir)
+
+	t.Logf("starting cs")
+	go func() { _ = cs.Run(ctx) }()
+
+	if _, err := cs.ah.CreateRemoteSource(ctx, &action.CreateUpdateRemoteSourceRequest{
+		Name:                "rs01",
+		APIURL:              "https://api.example.com",
+		Type:                types.RemoteSourceTypeGitea,
+		AuthType:            types.RemoteSourceAuthTypeOauth2,
+		Oauth2ClientID:      "clientid",
+		Oauth2ClientSecret:  "clientsecret",
+		RegistrationEnabled: util.BoolP(true),
+		LoginEnabled:        util.BoolP(true),
+	}); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	if _, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: "user01", CreateUserLARequest: &action.CreateUserLARequest{RemoteSourceName: "rs01", RemoteUserID: "remoteuser01", RemoteUserName: "remoteuser01", Oauth2AccessToken: "accesstoken", Oauth2RefreshToken: "refreshtoken"}}); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if _, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: "user02"}); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	_, tokenValue, err := cs.ah.CreateUserToken(ctx, &action.CreateUserTokenRequest{UserRef: "user01", TokenName: "token01"})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	if err := cs.ah.DeleteUser(ctx, &action.DeleteUserRequest{UserRef: "user01", SoftDelete: true}); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	t.Run("soft deleted users are excluded by default", func(t *testing.T) {
+		res, err := cs.ah.GetUsers(ctx, &action.GetUsersRequest{Asc: true})
 		if err != nil {
 			t.Fatalf("unexpected err: %v", err)
 		}
-		rootPG.Parent.Kind = types.ObjectKindProjectGroup
-		rootPG.Name = "rootpg"
+		userNames := []string{}
+		for _, user := range res.Users {
+			userNames = append(userNames, user.Name)
+		}
+		if diff := cmp.Diff([]string{"user02"}, userNames); diff != "" {
+			t.Fatalf("users mismatch (-want +got):\n%s", diff)
+		}
 
-		expectedErr := "changing project group parent kind isn't supported"
-		_, err = cs.ah.UpdateProjectGroup(ctx, path.Join("user", user.Name), &action.CreateUpdateProjectGroupRequest{Name: rootPG.Name, Parent: rootPG.Parent, Visibility: rootPG.Visibility})
-		if err.Error() != expectedErr {
+		count, err := cs.ah.GetUsersCount(ctx, &action.GetUsersCountRequest{})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if count != 1 {
+			t.Fatalf("expected 1 user, got %d", count)
+		}
+
+		expectedErr := util.NewAPIError(util.ErrNotExist, errors.Errorf("user %q doesn't exist", "user01"))
+		_, err = cs.ah.GetUser(ctx, "user01", false)
+		if err == nil {
+			t.Fatalf("expected error %v, got nil err", expectedErr)
+		}
+		if !util.APIErrorIs(err, util.ErrNotExist) || err.Error() != expectedErr.Error() {
 			t.Fatalf("expected err %v, got err: %v", expectedErr, err)
 		}
 	})
-	t.Run("change root project group parent id", func(t *testing.T) {
-		var rootPG *types.ProjectGroup
-		rootPG, err := cs.ah.GetProjectGroup(ctx, path.Join("user", user.Name))
+
+	t.Run("soft deleted users are included when requested", func(t *testing.T) {
+		res, err := cs.ah.GetUsers(ctx, &action.GetUsersRequest{Asc: true, IncludeDeleted: true})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		userNames := []string{}
+		for _, user := range res.Users {
+			userNames = append(userNames, user.Name)
+		}
+		if diff := cmp.Diff([]string{"user01", "user02"}, userNames); diff != "" {
+			t.Fatalf("users mismatch (-want +got):\n%s", diff)
+		}
+
+		count, err := cs.ah.GetUsersCount(ctx, &action.GetUsersCountRequest{IncludeDeleted: true})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if count != 2 {
+			t.Fatalf("expected 2 users, got %d", count)
+		}
+
+		user, err := cs.ah.GetUser(ctx, "user01", true)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if !user.IsDeleted() {
+			t.Fatalf("expected user %q to be deleted", user.Name)
+		}
+	})
+
+	t.Run("soft deleted user tokens and linked accounts are deactivated", func(t *testing.T) {
+		expectedErr := util.NewAPIError(util.ErrUnauthorized, errors.Errorf("user %q is deleted", "user01"))
+		_, err := cs.ah.GetUserByTokenValue(ctx, tokenValue, nil, "")
+		if err == nil {
+			t.Fatalf("expected error %v, got nil err", expectedErr)
+		}
+		if !util.APIErrorIs(err, util.ErrUnauthorized) || err.Error() != expectedErr.Error() {
+			t.Fatalf("expected err %v, got err: %v", expectedErr, err)
+		}
+
+		userTokens, err := cs.ah.GetUserTokens(ctx, "user01")
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if len(userTokens) != 1 || !userTokens[0].IsExpired(time.Now()) {
+			t.Fatalf("expected user token to be expired")
+		}
+
+		las, err := cs.ah.GetUserLinkedAccounts(ctx, "user01")
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if len(las) != 1 {
+			t.Fatalf("expected 1 linked account, got %d", len(las))
+		}
+		if las[0].Oauth2AccessToken != "" || las[0].Oauth2RefreshToken != "" {
+			t.Fatalf("expected linked account credentials to be removed")
+		}
+
+		if _, err := cs.ah.GetUserByRemoteUser(ctx, "rs01", "remoteuser01"); !util.APIErrorIs(err, util.ErrNotExist) {
+			t.Fatalf("expected not exist error, got err: %v", err)
+		}
+	})
+
+	t.Run("soft delete an already soft deleted user", func(t *testing.T) {
+		expectedErr := util.NewAPIError(util.ErrBadRequest, errors.Errorf("user %q is already deleted", "user01"))
+		err := cs.ah.DeleteUser(ctx, &action.DeleteUserRequest{UserRef: "user01", SoftDelete: true})
+		if err == nil {
+			t.Fatalf("expected error %v, got nil err", expectedErr)
+		}
+		if !util.APIErrorIs(err, util.ErrBadRequest) || err.Error() != expectedErr.Error() {
+			t.Fatalf("expected err %v, got err: %v", expectedErr, err)
+		}
+	})
+
+	t.Run("hard delete a soft deleted user", func(t *testing.T) {
+		if err := cs.ah.DeleteUser(ctx, &action.DeleteUserRequest{UserRef: "user01"}); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if _, err := cs.ah.GetUser(ctx, "user01", true); !util.APIErrorIs(err, util.ErrNotExist) {
+			t.Fatalf("expected not exist error, got err: %v", err)
+		}
+	})
+}
+
+type testAuditLogger struct {
+	events []*action.AuditEvent
+	err    error
+	// failAction, when set, makes only the events with this action fail with
+	// err
+	failAction action.AuditAction
+}
+
+func (l *testAuditLogger) LogAuditEvent(tx *sql.Tx, event *action.AuditEvent) error {
+	if l.err != nil && (l.failAction == "" || l.failAction == event.Action) {
+		return l.err
+	}
+	l.events = append(l.events, event)
+	return nil
+}
+
+func TestAuditEvents(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+	log := testutil.NewLogger(t)
+
+	cs := setupConfigstore(ctx, t, log, dir)
+
+	t.Logf("starting cs")
+	go func() { _ = cs.Run(ctx) }()
+
+	auditLogger := &testAuditLogger{}
+	cs.ah.SetAuditLogger(auditLogger)
+
+	if _, err := cs.ah.CreateRemoteSource(ctx, &action.CreateUpdateRemoteSourceRequest{
+		Name:                "rs01",
+		APIURL:              "https://api.example.com",
+		Type:                types.RemoteSourceTypeGitea,
+		AuthType:            types.RemoteSourceAuthTypeOauth2,
+		Oauth2ClientID:      "clientid",
+		Oauth2ClientSecret:  "clientsecret",
+		RegistrationEnabled: util.BoolP(true),
+		LoginEnabled:        util.BoolP(true),
+	}); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	actorCtx := action.WithAuditActor(ctx, "admin")
+
+	user, err := cs.ah.CreateUser(actorCtx, &action.CreateUserRequest{UserName: "user01"})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if _, err := cs.ah.UpdateUser(actorCtx, &action.UpdateUserRequest{UserRef: "user01", UserName: "user02"}); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	token, _, err := cs.ah.CreateUserToken(actorCtx, &action.CreateUserTokenRequest{UserRef: "user02", TokenName: "token01"})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if err := cs.ah.DeleteUserToken(actorCtx, "user02", "token01"); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	la, err := cs.ah.CreateUserLA(actorCtx, &action.CreateUserLARequest{UserRef: "user02", RemoteSourceName: "rs01", RemoteUserID: "remoteuser01", RemoteUserName: "remoteuser01"})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if err := cs.ah.DeleteUserLA(actorCtx, "user02", la.ID); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if err := cs.ah.DeleteUser(actorCtx, &action.DeleteUserRequest{UserRef: "user02"}); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	expectedEvents := []*action.AuditEvent{
+		{Actor: "admin", Action: action.AuditActionUserCreate, TargetKind: types.UserKind, TargetID: user.ID, UserID: user.ID},
+		{Actor: "admin", Action: action.AuditActionUserUpdate, TargetKind: types.UserKind, TargetID: user.ID, UserID: user.ID},
+		{Actor: "admin", Action: action.AuditActionUserTokenCreate, TargetKind: types.UserTokenKind, TargetID: token.ID, UserID: user.ID},
+		{Actor: "admin", Action: action.AuditActionUserTokenDelete, TargetKind: types.UserTokenKind, TargetID: token.ID, UserID: user.ID},
+		{Actor: "admin", Action: action.AuditActionLinkedAccountCreate, TargetKind: types.LinkedAccountKind, TargetID: la.ID, UserID: user.ID},
+		{Actor: "admin", Action: action.AuditActionLinkedAccountDelete, TargetKind: types.LinkedAccountKind, TargetID: la.ID, UserID: user.ID},
+		{Actor: "admin", Action: action.AuditActionUserDelete, TargetKind: types.UserKind, TargetID: user.ID, UserID: user.ID},
+	}
+	for _, event := range auditLogger.events {
+		if event.Time.IsZero() {
+			t.Fatalf("expected audit event time to be set")
+		}
+	}
+	if diff := cmp.Diff(expectedEvents, auditLogger.events, cmpopts.IgnoreFields(action.AuditEvent{}, "Time")); diff != "" {
+		t.Fatalf("audit events mismatch (-want +got):\n%s", diff)
+	}
+
+	t.Run("audit logger error aborts the change", func(t *testing.T) {
+		auditLogger.err = errors.Errorf("audit error")
+
+		if _, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: "user03"}); err == nil {
+			t.Fatalf("expected error, got nil err")
+		}
+
+		users, err := getUsers(ctx, cs)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if len(users) != 0 {
+			t.Fatalf("expected 0 users, got %d", len(users))
+		}
+	})
+}
+
+func TestAuditActorHeader(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+	log := testutil.NewLogger(t)
+
+	cs := setupConfigstore(ctx, t, log, dir)
+
+	t.Logf("starting cs")
+	go func() { _ = cs.Run(ctx) }()
+
+	auditLogger := &testAuditLogger{}
+	cs.ah.SetAuditLogger(auditLogger)
+
+	server := httptest.NewServer(cs.setupDefaultRouter())
+	defer server.Close()
+	client := csclient.NewClient(server.URL)
+
+	user, _, err := client.CreateUser(csclient.WithAuditActor(ctx, "actor01"), &csapitypes.CreateUserRequest{UserName: "user01"})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if _, err := client.DeleteUser(ctx, "user01"); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	expectedEvents := []*action.AuditEvent{
+		{Actor: "actor01", Action: action.AuditActionUserCreate, TargetKind: types.UserKind, TargetID: user.ID, UserID: user.ID},
+		{Actor: "", Action: action.AuditActionUserDelete, TargetKind: types.UserKind, TargetID: user.ID, UserID: user.ID},
+	}
+	if diff := cmp.Diff(expectedEvents, auditLogger.events, cmpopts.IgnoreFields(action.AuditEvent{}, "Time")); diff != "" {
+		t.Fatalf("audit events mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestLogAuditLogger(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+	log := testutil.NewLogger(t)
+
+	cs := setupConfigstore(ctx, t, log, dir)
+
+	t.Logf("starting cs")
+	go func() { _ = cs.Run(ctx) }()
+
+	var buf bytes.Buffer
+	cs.ah.SetAuditLogger(action.NewLogAuditLogger(zerolog.New(zerolog.ConsoleWriter{Out: &buf, NoColor: true})))
+
+	user, err := cs.ah.CreateUser(action.WithAuditActor(ctx, "admin"), &action.CreateUserRequest{UserName: "user01"})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	expected := fmt.Sprintf(`audit event: action: "user.create", actor: "admin", target: user %q, user id: %q`, user.ID, user.ID)
+	if !bytes.Contains(buf.Bytes(), []byte(expected)) {
+		t.Fatalf("expected audit log to contain %q, got %q", expected, buf.String())
+	}
+}
+
+func TestRotateUserSecret(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+	log := testutil.NewLogger(t)
+
+	cs := setupConfigstore(ctx, t, log, dir)
+
+	t.Logf("starting cs")
+	go func() { _ = cs.Run(ctx) }()
+
+	users := []*types.User{}
+	for _, userName := range []string{"user01", "user02"} {
+		user, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: userName})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		users = append(users, user)
+	}
+
+	t.Run("test rotate user secret", func(t *testing.T) {
+		user, err := cs.ah.RotateUserSecret(ctx, "user01")
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if user.Secret == "" || user.Secret == users[0].Secret {
+			t.Fatalf("expected a new user secret, got %q", user.Secret)
+		}
+		if user.Secret == users[1].Secret {
+			t.Fatalf("expected user secret to be unique")
+		}
+
+		storedUser, err := cs.ah.GetUser(ctx, "user01", false)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if storedUser.Secret != user.Secret {
+			t.Fatalf("expected stored user secret %q, got %q", user.Secret, storedUser.Secret)
+		}
+
+		// rotating again generates another secret
+		rotatedUser, err := cs.ah.RotateUserSecret(ctx, "user01")
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if rotatedUser.Secret == user.Secret {
+			t.Fatalf("expected a new user secret, got %q", rotatedUser.Secret)
+		}
+	})
+
+	t.Run("test rotate secret of not existing user", func(t *testing.T) {
+		expectedErr := util.NewAPIError(util.ErrNotExist, errors.Errorf("user %q doesn't exist", "user03"))
+		_, err := cs.ah.RotateUserSecret(ctx, "user03")
+		if err == nil {
+			t.Fatalf("expected error %v, got nil err", expectedErr)
+		}
+		if !util.APIErrorIs(err, util.ErrNotExist) || err.Error() != expectedErr.Error() {
+			t.Fatalf("expected err %v, got err: %v", expectedErr, err)
+		}
+	})
+}
+
+func TestGetUserByTokenValueMarkUsed(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+	log := testutil.NewLogger(t)
+
+	cs := setupConfigstore(ctx, t, log, dir)
+
+	t.Logf("starting cs")
+	go func() { _ = cs.Run(ctx) }()
+
+	user, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: "user01"})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	_, tokenValue, err := cs.ah.CreateUserToken(ctx, &action.CreateUserTokenRequest{UserRef: "user01", TokenName: "token01"})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	getToken := func(t *testing.T) *types.UserToken {
+		tokens, err := cs.ah.GetUserTokens(ctx, "user01")
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		return tokens[0]
+	}
+	lastUsedAt := func(t *testing.T) *time.Time {
+		return getToken(t).LastUsedAt
+	}
+
+	t.Run("test get user without marking token used", func(t *testing.T) {
+		u, err := cs.ah.GetUserByTokenValue(ctx, tokenValue, nil, "")
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if u.ID != user.ID {
+			t.Fatalf("expected user %q, got %q", user.ID, u.ID)
+		}
+		if lastUsedAt(t) != nil {
+			t.Fatalf("expected nil token last used time")
+		}
+	})
+
+	firstUse := time.Now().UTC().Truncate(time.Second)
+
+	t.Run("test token last used time set on first use", func(t *testing.T) {
+		if _, err := cs.ah.GetUserByTokenValue(ctx, tokenValue, &firstUse, "10.0.0.1"); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		userToken := getToken(t)
+		if got := userToken.LastUsedAt; got == nil || !got.Equal(firstUse) {
+			t.Fatalf("expected token last used time %v, got %v", firstUse, got)
+		}
+		if userToken.LastUsedIP != "10.0.0.1" {
+			t.Fatalf("expected token last used ip %q, got %q", "10.0.0.1", userToken.LastUsedIP)
+		}
+	})
+
+	t.Run("test token last used time update throttled", func(t *testing.T) {
+		revision := getToken(t).Revision
+		for i := 1; i <= 3; i++ {
+			usedAt := firstUse.Add(action.UserTokenLastUsedUpdateInterval - time.Duration(i)*time.Second)
+			if _, err := cs.ah.GetUserByTokenValue(ctx, tokenValue, &usedAt, "10.0.0.2"); err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+		}
+		userToken := getToken(t)
+		// the token isn't written
+		if userToken.Revision != revision {
+			t.Fatalf("expected token revision %d, got %d", revision, userToken.Revision)
+		}
+		if got := userToken.LastUsedAt; got == nil || !got.Equal(firstUse) {
+			t.Fatalf("expected token last used time %v, got %v", firstUse, got)
+		}
+		if userToken.LastUsedIP != "10.0.0.1" {
+			t.Fatalf("expected token last used ip %q, got %q", "10.0.0.1", userToken.LastUsedIP)
+		}
+	})
+
+	t.Run("test token last used time updated after the update interval", func(t *testing.T) {
+		usedAt := firstUse.Add(action.UserTokenLastUsedUpdateInterval)
+		if _, err := cs.ah.GetUserByTokenValue(ctx, tokenValue, &usedAt, "10.0.0.2"); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		userToken := getToken(t)
+		if got := userToken.LastUsedAt; got == nil || !got.Equal(usedAt) {
+			t.Fatalf("expected token last used time %v, got %v", usedAt, got)
+		}
+		if userToken.LastUsedIP != "10.0.0.2" {
+			t.Fatalf("expected token last used ip %q, got %q", "10.0.0.2", userToken.LastUsedIP)
+		}
+	})
+
+	t.Run("test get user with unexistent token", func(t *testing.T) {
+		now := time.Now()
+		expectedErr := util.NewAPIError(util.ErrNotExist, errors.Errorf("user with required token doesn't exist"))
+		_, err := cs.ah.GetUserByTokenValue(ctx, "unexistent", &now, "")
+		if err == nil {
+			t.Fatalf("expected err, got nil err")
+		}
+		if !util.APIErrorIs(err, util.ErrNotExist) || err.Error() != expectedErr.Error() {
+			t.Fatalf("expected err %v, got err: %v", expectedErr, err)
+		}
+	})
+}
+
+func TestUserTokenExpiration(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+	log := testutil.NewLogger(t)
+
+	cs := setupConfigstore(ctx, t, log, dir)
+
+	t.Logf("starting cs")
+	go func() { _ = cs.Run(ctx) }()
+
+	user, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: "user01"})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	t.Run("test create token with past expiration time", func(t *testing.T) {
+		expiresAt := time.Now().Add(-time.Hour)
+		expectedErr := util.NewAPIError(util.ErrBadRequest, errors.Errorf("token expiration time must be in the future"))
+		_, _, err := cs.ah.CreateUserToken(ctx, &action.CreateUserTokenRequest{UserRef: "user01", TokenName: "token01", ExpiresAt: &expiresAt})
+		if err == nil {
+			t.Fatalf("expected err, got nil err")
+		}
+		if !util.APIErrorIs(err, util.ErrBadRequest) || err.Error() != expectedErr.Error() {
+			t.Fatalf("expected err %v, got err: %v", expectedErr, err)
+		}
+	})
+
+	expiresAt := time.Now().Add(time.Second).UTC()
+	_, tokenValue, err := cs.ah.CreateUserToken(ctx, &action.CreateUserTokenRequest{UserRef: "user01", TokenName: "token01", ExpiresAt: &expiresAt})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	t.Run("test get user tokens includes the expiration time", func(t *testing.T) {
+		tokens, err := cs.ah.GetUserTokens(ctx, "user01")
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if len(tokens) != 1 || tokens[0].ExpiresAt == nil || !tokens[0].ExpiresAt.Equal(expiresAt) {
+			t.Fatalf("expected token expiration time %v, got tokens: %v", expiresAt, tokens)
+		}
+	})
+
+	t.Run("test not expired token accepted", func(t *testing.T) {
+		u, err := cs.ah.GetUserByTokenValue(ctx, tokenValue, nil, "")
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if u.ID != user.ID {
+			t.Fatalf("expected user %q, got %q", user.ID, u.ID)
+		}
+	})
+
+	t.Run("test expired token rejected", func(t *testing.T) {
+		time.Sleep(time.Until(expiresAt))
+
+		now := time.Now()
+		expectedErr := util.NewAPIError(util.ErrUnauthorized, errors.Errorf(`user token "token01" expired`))
+		_, err := cs.ah.GetUserByTokenValue(ctx, tokenValue, &now, "")
+		if err == nil {
+			t.Fatalf("expected err, got nil err")
+		}
+		if !util.APIErrorIs(err, util.ErrUnauthorized) || err.Error() != expectedErr.Error() {
+			t.Fatalf("expected err %v, got err: %v", expectedErr, err)
+		}
+
+		// the expired token isn't deleted
+		tokens, err := cs.ah.GetUserTokens(ctx, "user01")
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if len(tokens) != 1 {
+			t.Fatalf("expected 1 token, got %d", len(tokens))
+		}
+		if tokens[0].LastUsedAt != nil {
+			t.Fatalf("expected expired token last used time not updated")
+		}
+	})
+}
+
+func TestUserTokenHashed(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+	log := testutil.NewLogger(t)
+
+	cs := setupConfigstore(ctx, t, log, dir)
+
+	t.Logf("starting cs")
+	go func() { _ = cs.Run(ctx) }()
+
+	user, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: "user01"})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	getToken := func(t *testing.T, tokenName string) *types.UserToken {
+		var token *types.UserToken
+		err := cs.d.Do(ctx, func(tx *sql.Tx) error {
+			var err error
+			token, err = cs.d.GetUserToken(tx, user.ID, tokenName)
+			return errors.WithStack(err)
+		})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		return token
+	}
+
+	t.Run("test token value isn't stored", func(t *testing.T) {
+		_, tokenValue, err := cs.ah.CreateUserToken(ctx, &action.CreateUserTokenRequest{UserRef: "user01", TokenName: "token01"})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if tokenValue == "" {
+			t.Fatalf("expected token value")
+		}
+
+		token := getToken(t, "token01")
+		if token.Value != "" {
+			t.Fatalf("expected empty stored token value, got %q", token.Value)
+		}
+		if token.ValueHash == tokenValue || token.ValueHash != util.EncodeSha256Hex(tokenValue) {
+			t.Fatalf("expected stored token value hash %q, got %q", util.EncodeSha256Hex(tokenValue), token.ValueHash)
+		}
+		if token.NeedsRotation {
+			t.Fatalf("expected new token not needing rotation")
+		}
+
+		u, err := cs.ah.GetUserByTokenValue(ctx, tokenValue, nil, "")
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if u.ID != user.ID {
+			t.Fatalf("expected user %q, got %q", user.ID, u.ID)
+		}
+
+		// the hash can't be used as the token value
+		expectedErr := util.NewAPIError(util.ErrNotExist, errors.Errorf("user with required token doesn't exist"))
+		_, err = cs.ah.GetUserByTokenValue(ctx, token.ValueHash, nil, "")
+		if err == nil {
+			t.Fatalf("expected err, got nil err")
+		}
+		if !util.APIErrorIs(err, util.ErrNotExist) || err.Error() != expectedErr.Error() {
+			t.Fatalf("expected err %v, got err: %v", expectedErr, err)
+		}
+	})
+
+	t.Run("test legacy token migration", func(t *testing.T) {
+		legacyTokenValue := util.EncodeSha1Hex("legacytoken")
+		err := cs.d.Do(ctx, func(tx *sql.Tx) error {
+			token := types.NewUserToken(tx)
+			token.UserID = user.ID
+			token.Name = "legacytoken"
+			token.Value = legacyTokenValue
+
+			return errors.WithStack(cs.d.InsertUserToken(tx, token))
+		})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+
+		// run the migration twice to check that it's idempotent
+		for i := 0; i < 2; i++ {
+			if err := cs.ah.MigrateLegacyUserTokens(ctx); err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+		}
+
+		token := getToken(t, "legacytoken")
+		if token.Value != "" {
+			t.Fatalf("expected empty stored token value, got %q", token.Value)
+		}
+		if token.ValueHash != util.EncodeSha256Hex(legacyTokenValue) {
+			t.Fatalf("expected stored token value hash %q, got %q", util.EncodeSha256Hex(legacyTokenValue), token.ValueHash)
+		}
+		if !token.NeedsRotation {
+			t.Fatalf("expected migrated token needing rotation")
+		}
+		if token := getToken(t, "token01"); token.NeedsRotation {
+			t.Fatalf("expected new token not needing rotation")
+		}
+
+		u, err := cs.ah.GetUserByTokenValue(ctx, legacyTokenValue, nil, "")
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if u.ID != user.ID {
+			t.Fatalf("expected user %q, got %q", user.ID, u.ID)
+		}
+	})
+}
+
+func TestUpdateUserTokenName(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+	log := testutil.NewLogger(t)
+
+	cs := setupConfigstore(ctx, t, log, dir)
+
+	t.Logf("starting cs")
+	go func() { _ = cs.Run(ctx) }()
+
+	user, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: "user01"})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	token01, tokenValue, err := cs.ah.CreateUserToken(ctx, &action.CreateUserTokenRequest{UserRef: "user01", TokenName: "token01"})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if _, _, err := cs.ah.CreateUserToken(ctx, &action.CreateUserTokenRequest{UserRef: "user01", TokenName: "token02"}); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	t.Run("test rename unexistent token", func(t *testing.T) {
+		expectedErr := util.NewAPIError(util.ErrNotExist, errors.Errorf(`token "token03" for user "user01" doesn't exist`))
+		_, err := cs.ah.UpdateUserTokenName(ctx, "user01", "token03", "token04")
+		if err == nil {
+			t.Fatalf("expected err, got nil err")
+		}
+		if !util.APIErrorIs(err, util.ErrNotExist) || err.Error() != expectedErr.Error() {
+			t.Fatalf("expected err %v, got err: %v", expectedErr, err)
+		}
+	})
+
+	t.Run("test rename token to an already existing name", func(t *testing.T) {
+		expectedErr := util.NewAPIError(util.ErrConflict, errors.Errorf(`token "token02" for user "user01" already exists`))
+		_, err := cs.ah.UpdateUserTokenName(ctx, "user01", "token01", "token02")
+		if err == nil {
+			t.Fatalf("expected err, got nil err")
+		}
+		if !util.APIErrorIs(err, util.ErrConflict) || err.Error() != expectedErr.Error() {
+			t.Fatalf("expected err %v, got err: %v", expectedErr, err)
+		}
+	})
+
+	t.Run("test rename token", func(t *testing.T) {
+		token, err := cs.ah.UpdateUserTokenName(ctx, "user01", "token01", "token03")
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if token.ID != token01.ID || token.Name != "token03" {
+			t.Fatalf("expected token %q renamed to %q, got token %q with name %q", token01.ID, "token03", token.ID, token.Name)
+		}
+		if token.ValueHash != token01.ValueHash {
+			t.Fatalf("expected token value hash %q, got %q", token01.ValueHash, token.ValueHash)
+		}
+
+		tokens, err := cs.ah.GetUserTokens(ctx, "user01")
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		names := []string{}
+		for _, token := range tokens {
+			names = append(names, token.Name)
+		}
+		sort.Strings(names)
+		if diff := cmp.Diff([]string{"token02", "token03"}, names); diff != "" {
+			t.Fatalf("user tokens mismatch (-want +got):\n%s", diff)
+		}
+
+		// the token value is unchanged
+		u, err := cs.ah.GetUserByTokenValue(ctx, tokenValue, nil, "")
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if u.ID != user.ID {
+			t.Fatalf("expected user %q, got %q", user.ID, u.ID)
+		}
+	})
+}
+
+func TestUserTokenScopes(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+	log := testutil.NewLogger(t)
+
+	cs := setupConfigstore(ctx, t, log, dir)
+
+	t.Logf("starting cs")
+	go func() { _ = cs.Run(ctx) }()
+
+	if _, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: "user01"}); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		tokenName string
+		scopes    []string
+		err       error
+	}{
+		{
+			name:      "test create token without scopes",
+			tokenName: "token01",
+		},
+		{
+			name:      "test create token with valid scopes",
+			tokenName: "token02",
+			scopes:    []string{types.UserTokenScopeRunRead, types.UserTokenScopeRunWrite},
+		},
+		{
+			name:      "test create token with unknown scope",
+			tokenName: "token03",
+			scopes:    []string{types.UserTokenScopeRunRead, "user:delete"},
+			err:       util.NewAPIError(util.ErrBadRequest, errors.Errorf(`invalid token scope "user:delete"`)),
+		},
+		{
+			name:      "test create token with duplicate scope",
+			tokenName: "token04",
+			scopes:    []string{types.UserTokenScopeRunRead, types.UserTokenScopeRunRead},
+			err:       util.NewAPIError(util.ErrBadRequest, errors.Errorf(`duplicate token scope "run:read"`)),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, _, err := cs.ah.CreateUserToken(ctx, &action.CreateUserTokenRequest{UserRef: "user01", TokenName: tt.tokenName, Scopes: tt.scopes})
+			if tt.err != nil {
+				if err == nil {
+					t.Fatalf("expected err, got nil err")
+				}
+				if !util.APIErrorIs(err, util.ErrBadRequest) || err.Error() != tt.err.Error() {
+					t.Fatalf("expected err %v, got err: %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			if diff := cmp.Diff(tt.scopes, token.Scopes); diff != "" {
+				t.Fatalf("token scopes mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	t.Run("test get user tokens returns the scopes", func(t *testing.T) {
+		tokens, err := cs.ah.GetUserTokens(ctx, "user01")
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		scopes := map[string][]string{}
+		for _, token := range tokens {
+			scopes[token.Name] = token.Scopes
+		}
+		expectedScopes := map[string][]string{
+			"token01": nil,
+			"token02": {types.UserTokenScopeRunRead, types.UserTokenScopeRunWrite},
+		}
+		if diff := cmp.Diff(expectedScopes, scopes); diff != "" {
+			t.Fatalf("user tokens scopes mismatch (-want +got):\n%s", diff)
+		}
+	})
+}
+
+func TestUserTokensLimit(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+	log := testutil.NewLogger(t)
+
+	cs := setupConfigstore(ctx, t, log, dir)
+
+	t.Logf("starting cs")
+	go func() { _ = cs.Run(ctx) }()
+
+	cs.ah.SetMaxUserTokens(3)
+
+	for _, userName := range []string{"user01", "user02"} {
+		if _, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: userName}); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+	}
+
+	expectLimitErr := func(t *testing.T, err error) {
+		t.Helper()
+
+		expectedErr := fmt.Sprintf("user %q reached its tokens limit of %d", "user01", 3)
+		if err == nil {
+			t.Fatalf("expected err %q, got nil err", expectedErr)
+		}
+		if err.Error() != expectedErr {
+			t.Fatalf("expected err %q, got err: %q", expectedErr, err.Error())
+		}
+		derr, ok := util.AsAPIError(err)
+		if !ok || derr.Kind != util.ErrTooManyRequests || derr.Code != action.ErrorCodeUserTokenLimit {
+			t.Fatalf("expected too many requests api error with code %q, got err: %v", action.ErrorCodeUserTokenLimit, err)
+		}
+	}
+
+	t.Run("test create tokens up to the limit", func(t *testing.T) {
+		for i := 1; i <= 3; i++ {
+			if _, _, err := cs.ah.CreateUserToken(ctx, &action.CreateUserTokenRequest{UserRef: "user01", TokenName: fmt.Sprintf("token%02d", i)}); err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+		}
+	})
+
+	t.Run("test create token over the limit", func(t *testing.T) {
+		_, _, err := cs.ah.CreateUserToken(ctx, &action.CreateUserTokenRequest{UserRef: "user01", TokenName: "token04"})
+		expectLimitErr(t, err)
+	})
+
+	t.Run("test limit is per user", func(t *testing.T) {
+		if _, _, err := cs.ah.CreateUserToken(ctx, &action.CreateUserTokenRequest{UserRef: "user02", TokenName: "token01"}); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+	})
+
+	t.Run("test deleting a token frees a slot", func(t *testing.T) {
+		if err := cs.ah.DeleteUserToken(ctx, "user01", "token01"); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if _, _, err := cs.ah.CreateUserToken(ctx, &action.CreateUserTokenRequest{UserRef: "user01", TokenName: "token04"}); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+
+		_, _, err := cs.ah.CreateUserToken(ctx, &action.CreateUserTokenRequest{UserRef: "user01", TokenName: "token05"})
+		expectLimitErr(t, err)
+	})
+
+	t.Run("test expired tokens aren't counted", func(t *testing.T) {
+		if err := cs.ah.DeleteUserToken(ctx, "user01", "token02"); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		expiresAt := time.Now().Add(time.Second)
+		if _, _, err := cs.ah.CreateUserToken(ctx, &action.CreateUserTokenRequest{UserRef: "user01", TokenName: "token05", ExpiresAt: &expiresAt}); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+
+		_, _, err := cs.ah.CreateUserToken(ctx, &action.CreateUserTokenRequest{UserRef: "user01", TokenName: "token06"})
+		expectLimitErr(t, err)
+
+		time.Sleep(time.Until(expiresAt))
+
+		if _, _, err := cs.ah.CreateUserToken(ctx, &action.CreateUserTokenRequest{UserRef: "user01", TokenName: "token06"}); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+	})
+}
+
+func TestCreateUserWithToken(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+	log := testutil.NewLogger(t)
+
+	cs := setupConfigstore(ctx, t, log, dir)
+
+	t.Logf("starting cs")
+	go func() { _ = cs.Run(ctx) }()
+
+	auditLogger := &testAuditLogger{}
+	cs.ah.SetAuditLogger(auditLogger)
+
+	if _, err := cs.ah.CreateRemoteSource(ctx, &action.CreateUpdateRemoteSourceRequest{
+		Name:                "rs01",
+		APIURL:              "https://api.example.com",
+		Type:                types.RemoteSourceTypeGitea,
+		AuthType:            types.RemoteSourceAuthTypeOauth2,
+		Oauth2ClientID:      "clientid",
+		Oauth2ClientSecret:  "clientsecret",
+		RegistrationEnabled: util.BoolP(true),
+		LoginEnabled:        util.BoolP(true),
+	}); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	expectNoUser := func(t *testing.T, userName string) {
+		t.Helper()
+
+		users, err := getUsers(ctx, cs)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		for _, user := range users {
+			if user.Name == userName {
+				t.Fatalf("expected user %q to not exist", userName)
+			}
+		}
+	}
+
+	t.Run("test create user with token", func(t *testing.T) {
+		res, err := cs.ah.CreateUserWithToken(ctx, &action.CreateUserWithTokenRequest{
+			CreateUserRequest: &action.CreateUserRequest{UserName: "user01"},
+			TokenName:         "token01",
+			TokenScopes:       []string{types.UserTokenScopeRunRead},
+		})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if res.Token.UserID != res.User.ID || res.Token.Name != "token01" {
+			t.Fatalf("unexpected token: %v", res.Token)
+		}
+
+		user, err := cs.ah.GetUserByTokenValue(ctx, res.TokenValue, nil, "")
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if user.ID != res.User.ID {
+			t.Fatalf("expected user %q, got %q", res.User.ID, user.ID)
+		}
+	})
+
+	t.Run("test create user with token and linked account", func(t *testing.T) {
+		res, err := cs.ah.CreateUserWithToken(ctx, &action.CreateUserWithTokenRequest{
+			CreateUserRequest: &action.CreateUserRequest{UserName: "user02", CreateUserLARequest: &action.CreateUserLARequest{RemoteSourceName: "rs01", RemoteUserID: "remoteuser02", RemoteUserName: "remoteuser02"}},
+			TokenName:         "token01",
+		})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+
+		las, err := cs.ah.GetUserLinkedAccounts(ctx, res.User.ID)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if len(las) != 1 {
+			t.Fatalf("expected 1 linked account, got %d", len(las))
+		}
+	})
+
+	t.Run("test create user with token with invalid token scope", func(t *testing.T) {
+		expectedErr := util.NewAPIError(util.ErrBadRequest, errors.Errorf("invalid token scope %q", "admin"))
+		_, err := cs.ah.CreateUserWithToken(ctx, &action.CreateUserWithTokenRequest{
+			CreateUserRequest: &action.CreateUserRequest{UserName: "user03"},
+			TokenName:         "token01",
+			TokenScopes:       []string{"admin"},
+		})
+		if err == nil {
+			t.Fatalf("expected error %v, got nil err", expectedErr)
+		}
+		if !util.APIErrorIs(err, util.ErrBadRequest) || err.Error() != expectedErr.Error() {
+			t.Fatalf("expected err %v, got err: %v", expectedErr, err)
+		}
+
+		expectNoUser(t, "user03")
+	})
+
+	t.Run("test create user with token rolls back the user when token creation fails", func(t *testing.T) {
+		auditLogger.err = errors.Errorf("audit error")
+		auditLogger.failAction = action.AuditActionUserTokenCreate
+
+		_, err := cs.ah.CreateUserWithToken(ctx, &action.CreateUserWithTokenRequest{
+			CreateUserRequest: &action.CreateUserRequest{UserName: "user03", CreateUserLARequest: &action.CreateUserLARequest{RemoteSourceName: "rs01", RemoteUserID: "remoteuser03", RemoteUserName: "remoteuser03"}},
+			TokenName:         "token01",
+		})
+		if err == nil {
+			t.Fatalf("expected error, got nil err")
+		}
+
+		auditLogger.err = nil
+		auditLogger.failAction = ""
+
+		expectNoUser(t, "user03")
+
+		// the linked account was rolled back too so the remote user can be
+		// linked again
+		if _, err := cs.ah.CreateUserWithToken(ctx, &action.CreateUserWithTokenRequest{
+			CreateUserRequest: &action.CreateUserRequest{UserName: "user04", CreateUserLARequest: &action.CreateUserLARequest{RemoteSourceName: "rs01", RemoteUserID: "remoteuser03", RemoteUserName: "remoteuser03"}},
+			TokenName:         "token01",
+		}); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+	})
+}
+
+func TestUserDisabled(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+	log := testutil.NewLogger(t)
+
+	cs := setupConfigstore(ctx, t, log, dir)
+
+	t.Logf("starting cs")
+	go func() { _ = cs.Run(ctx) }()
+
+	user, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: "user01"})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if user.Disabled {
+		t.Fatalf("expected new user enabled")
+	}
+	_, tokenValue, err := cs.ah.CreateUserToken(ctx, &action.CreateUserTokenRequest{UserRef: "user01", TokenName: "token01"})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	getUser := func(t *testing.T) *types.User {
+		var u *types.User
+		err := cs.d.Do(ctx, func(tx *sql.Tx) error {
+			var err error
+			u, err = cs.d.GetUser(tx, user.ID)
+			return errors.WithStack(err)
+		})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		return u
+	}
+
+	t.Run("test disable user", func(t *testing.T) {
+		res, err := cs.ah.UpdateUser(ctx, &action.UpdateUserRequest{UserRef: "user01", Disabled: util.BoolP(true)})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if !res.User.Disabled || !getUser(t).Disabled {
+			t.Fatalf("expected user disabled")
+		}
+	})
+
+	t.Run("test disabled user token rejected", func(t *testing.T) {
+		expectedErr := util.NewAPIError(util.ErrUnauthorized, errors.Errorf(`user "user01" is disabled`))
+		_, err := cs.ah.GetUserByTokenValue(ctx, tokenValue, nil, "")
+		if err == nil {
+			t.Fatalf("expected err, got nil err")
+		}
+		if !util.APIErrorIs(err, util.ErrUnauthorized) || err.Error() != expectedErr.Error() {
+			t.Fatalf("expected err %v, got err: %v", expectedErr, err)
+		}
+	})
+
+	t.Run("test nil disabled keeps the user disabled", func(t *testing.T) {
+		res, err := cs.ah.UpdateUser(ctx, &action.UpdateUserRequest{UserRef: "user01", UserName: "user02"})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if res.User.Name != "user02" || !res.User.Disabled {
+			t.Fatalf("expected renamed user still disabled, got name %q, disabled %t", res.User.Name, res.User.Disabled)
+		}
+	})
+
+	t.Run("test enable user", func(t *testing.T) {
+		res, err := cs.ah.UpdateUser(ctx, &action.UpdateUserRequest{UserRef: "user02", Disabled: util.BoolP(false)})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if res.User.Disabled {
+			t.Fatalf("expected user enabled")
+		}
+
+		u, err := cs.ah.GetUserByTokenValue(ctx, tokenValue, nil, "")
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if u.ID != user.ID {
+			t.Fatalf("expected user %q, got %q", user.ID, u.ID)
+		}
+	})
+
+	t.Run("test nil disabled keeps the user enabled", func(t *testing.T) {
+		res, err := cs.ah.UpdateUser(ctx, &action.UpdateUserRequest{UserRef: "user02", UserName: "user03"})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if res.User.Disabled {
+			t.Fatalf("expected user enabled")
+		}
+	})
+}
+
+func TestUserEmail(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+	log := testutil.NewLogger(t)
+
+	cs := setupConfigstore(ctx, t, log, dir)
+
+	t.Logf("starting cs")
+	go func() { _ = cs.Run(ctx) }()
+
+	t.Run("test create user without email", func(t *testing.T) {
+		user, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: "user01"})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if user.Email != "" {
+			t.Fatalf("expected empty email, got %q", user.Email)
+		}
+	})
+
+	t.Run("test create user with email", func(t *testing.T) {
+		user, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: "user02", Email: "user02@example.com"})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if user.Email != "user02@example.com" {
+			t.Fatalf("expected email %q, got %q", "user02@example.com", user.Email)
+		}
+	})
+
+	tests := []struct {
+		name            string
+		f               func() error
+		expectedErr     string
+		expectedErrKind util.ErrorKind
+	}{
+		{
+			name: "test create user with duplicate email",
+			f: func() error {
+				_, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: "user03", Email: "User02@Example.com"})
+				return err
+			},
+			expectedErr:     `user with email "User02@Example.com" already exists`,
+			expectedErrKind: util.ErrConflict,
+		},
+		{
+			name: "test create user with malformed email",
+			f: func() error {
+				_, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: "user03", Email: "User03 <user03@example.com>"})
+				return err
+			},
+			expectedErr:     `invalid user email "User03 <user03@example.com>"`,
+			expectedErrKind: util.ErrBadRequest,
+		},
+		{
+			name: "test update user with duplicate email",
+			f: func() error {
+				_, err := cs.ah.UpdateUser(ctx, &action.UpdateUserRequest{UserRef: "user01", Email: util.StringP("user02@example.com")})
+				return err
+			},
+			expectedErr:     `user with email "user02@example.com" already exists`,
+			expectedErrKind: util.ErrConflict,
+		},
+		{
+			name: "test update user with malformed email",
+			f: func() error {
+				_, err := cs.ah.UpdateUser(ctx, &action.UpdateUserRequest{UserRef: "user01", Email: util.StringP("user01")})
+				return err
+			},
+			expectedErr:     `invalid user email "user01"`,
+			expectedErrKind: util.ErrBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.f()
+			if err == nil {
+				t.Fatalf("expected err %q, got nil err", tt.expectedErr)
+			}
+			if !util.APIErrorIs(err, tt.expectedErrKind) || err.Error() != tt.expectedErr {
+				t.Fatalf("expected %s err %q, got err: %v", tt.expectedErrKind, tt.expectedErr, err)
+			}
+		})
+	}
+
+	t.Run("test update user email", func(t *testing.T) {
+		res, err := cs.ah.UpdateUser(ctx, &action.UpdateUserRequest{UserRef: "user02", Email: util.StringP("USER02@example.com")})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if res.User.Email != "USER02@example.com" {
+			t.Fatalf("expected email %q, got %q", "USER02@example.com", res.User.Email)
+		}
+
+		// a nil email keeps the current one
+		res, err = cs.ah.UpdateUser(ctx, &action.UpdateUserRequest{UserRef: "user02"})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if res.User.Email != "USER02@example.com" {
+			t.Fatalf("expected email %q, got %q", "USER02@example.com", res.User.Email)
+		}
+
+		// an empty email removes it and makes it available to other users
+		if _, err := cs.ah.UpdateUser(ctx, &action.UpdateUserRequest{UserRef: "user02", Email: util.StringP("")}); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if _, err := cs.ah.UpdateUser(ctx, &action.UpdateUserRequest{UserRef: "user01", Email: util.StringP("user02@example.com")}); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+	})
+}
+
+func TestGetUserLinkedAccountsByRemoteSourceType(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+	log := testutil.NewLogger(t)
+
+	cs := setupConfigstore(ctx, t, log, dir)
+
+	t.Logf("starting cs")
+	go func() { _ = cs.Run(ctx) }()
+
+	rsTypes := []types.RemoteSourceType{types.RemoteSourceTypeGithub, types.RemoteSourceTypeGitea, types.RemoteSourceTypeGithub, types.RemoteSourceTypeGitlab}
+	remoteSources := []*types.RemoteSource{}
+	for i, rsType := range rsTypes {
+		rs, err := cs.ah.CreateRemoteSource(ctx, &action.CreateUpdateRemoteSourceRequest{
+			Name:                fmt.Sprintf("rs%d", i),
+			APIURL:              "https://api.example.com",
+			Type:                rsType,
+			AuthType:            types.RemoteSourceAuthTypeOauth2,
+			Oauth2ClientID:      "clientid",
+			Oauth2ClientSecret:  "clientsecret",
+			RegistrationEnabled: util.BoolP(true),
+			LoginEnabled:        util.BoolP(true),
+		})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		remoteSources = append(remoteSources, rs)
+	}
+
+	user, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: "user01"})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	// another user linked account must not be reported
+	if _, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: "user02", CreateUserLARequest: &action.CreateUserLARequest{RemoteSourceName: "rs0", RemoteUserID: "remoteuser02", RemoteUserName: "remoteuser02"}}); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	linkedAccounts := []*types.LinkedAccount{}
+	for i, rs := range remoteSources {
+		la, err := cs.ah.CreateUserLA(ctx, &action.CreateUserLARequest{UserRef: user.Name, RemoteSourceName: rs.Name, RemoteUserID: fmt.Sprintf("remoteuser%d", i), RemoteUserName: "remoteuser01"})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		linkedAccounts = append(linkedAccounts, la)
+	}
+
+	sortResponse := cmpopts.SortSlices(func(a, b *action.UserLinkedAccountResponse) bool { return a.RemoteSource.Name < b.RemoteSource.Name })
+
+	t.Run("test get user linked accounts by remote source type", func(t *testing.T) {
+		res, err := cs.ah.GetUserLinkedAccountsByRemoteSourceType(ctx, user.Name, types.RemoteSourceTypeGithub)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		expectedResponse := []*action.UserLinkedAccountResponse{
+			{LinkedAccount: linkedAccounts[0], RemoteSource: remoteSources[0]},
+			{LinkedAccount: linkedAccounts[2], RemoteSource: remoteSources[2]},
+		}
+		if diff := cmp.Diff(expectedResponse, res, cmpopts.IgnoreFields(stypes.ObjectMeta{}, "TxID"), sortResponse); diff != "" {
+			t.Fatalf("mismatch (-want +got):\n%s", diff)
+		}
+
+		res, err = cs.ah.GetUserLinkedAccountsByRemoteSourceType(ctx, user.Name, types.RemoteSourceTypeGitlab)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		expectedResponse = []*action.UserLinkedAccountResponse{
+			{LinkedAccount: linkedAccounts[3], RemoteSource: remoteSources[3]},
+		}
+		if diff := cmpDiffObject(expectedResponse, res); diff != "" {
+			t.Fatalf("mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("test get user linked accounts by invalid remote source type", func(t *testing.T) {
+		expectedErr := fmt.Sprintf("invalid remotesource type %q", "bitbucket")
+		_, err := cs.ah.GetUserLinkedAccountsByRemoteSourceType(ctx, user.Name, "bitbucket")
+		if err == nil {
+			t.Fatalf("expected error %v, got nil err", expectedErr)
+		}
+		if err.Error() != expectedErr {
+			t.Fatalf("expected err %v, got err: %v", expectedErr, err)
+		}
+	})
+}
+
+func TestGetOrphanedLinkedAccounts(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+	log := testutil.NewLogger(t)
+
+	cs := setupConfigstore(ctx, t, log, dir)
+
+	t.Logf("starting cs")
+	go func() { _ = cs.Run(ctx) }()
+
+	user, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: "user01"})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	linkedAccounts := []*types.LinkedAccount{}
+	for i := 0; i < 3; i++ {
+		rs, err := cs.ah.CreateRemoteSource(ctx, &action.CreateUpdateRemoteSourceRequest{
+			Name:                fmt.Sprintf("rs%d", i),
+			APIURL:              "https://api.example.com",
+			Type:                types.RemoteSourceTypeGitea,
+			AuthType:            types.RemoteSourceAuthTypeOauth2,
+			Oauth2ClientID:      "clientid",
+			Oauth2ClientSecret:  "clientsecret",
+			RegistrationEnabled: util.BoolP(true),
+			LoginEnabled:        util.BoolP(true),
+		})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		la, err := cs.ah.CreateUserLA(ctx, &action.CreateUserLARequest{UserRef: user.Name, RemoteSourceName: rs.Name, RemoteUserID: fmt.Sprintf("remoteuser%d", i), RemoteUserName: "remoteuser01"})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		linkedAccounts = append(linkedAccounts, la)
+	}
+
+	t.Run("test no orphaned linked accounts", func(t *testing.T) {
+		res, err := cs.ah.GetOrphanedLinkedAccounts(ctx, 0, "")
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if len(res.LinkedAccounts) != 0 {
+			t.Fatalf("expected no orphaned linked accounts, got %d", len(res.LinkedAccounts))
+		}
+	})
+
+	// deleting a remote source leaves its linked accounts orphaned
+	for _, rsName := range []string{"rs0", "rs2"} {
+		if err := cs.ah.DeleteRemoteSource(ctx, rsName); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+	}
+	orphanedLinkedAccounts := []*types.LinkedAccount{linkedAccounts[0], linkedAccounts[2]}
+	sort.Slice(orphanedLinkedAccounts, func(i, j int) bool { return orphanedLinkedAccounts[i].ID < orphanedLinkedAccounts[j].ID })
+
+	t.Run("test get orphaned linked accounts", func(t *testing.T) {
+		res, err := cs.ah.GetOrphanedLinkedAccounts(ctx, 0, "")
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if diff := cmpDiffObject(orphanedLinkedAccounts, res.LinkedAccounts); diff != "" {
+			t.Fatalf("mismatch (-want +got):\n%s", diff)
+		}
+		if res.HasMore {
+			t.Fatalf("expected no more orphaned linked accounts")
+		}
+	})
+
+	t.Run("test get orphaned linked accounts paginated", func(t *testing.T) {
+		res, err := cs.ah.GetOrphanedLinkedAccounts(ctx, 1, "")
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if diff := cmpDiffObject(orphanedLinkedAccounts[:1], res.LinkedAccounts); diff != "" {
+			t.Fatalf("mismatch (-want +got):\n%s", diff)
+		}
+		if !res.HasMore {
+			t.Fatalf("expected more orphaned linked accounts")
+		}
+
+		res, err = cs.ah.GetOrphanedLinkedAccounts(ctx, 1, res.LinkedAccounts[0].ID)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if diff := cmpDiffObject(orphanedLinkedAccounts[1:], res.LinkedAccounts); diff != "" {
+			t.Fatalf("mismatch (-want +got):\n%s", diff)
+		}
+		if res.HasMore {
+			t.Fatalf("expected no more orphaned linked accounts")
+		}
+	})
+}
+
+func TestGetLinkedAccounts(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+	log := testutil.NewLogger(t)
+
+	cs := setupConfigstore(ctx, t, log, dir)
+
+	t.Logf("starting cs")
+	go func() { _ = cs.Run(ctx) }()
+
+	for i := 0; i < 2; i++ {
+		if _, err := cs.ah.CreateRemoteSource(ctx, &action.CreateUpdateRemoteSourceRequest{
+			Name:                fmt.Sprintf("rs%d", i),
+			APIURL:              "https://api.example.com",
+			Type:                types.RemoteSourceTypeGitea,
+			AuthType:            types.RemoteSourceAuthTypeOauth2,
+			Oauth2ClientID:      "clientid",
+			Oauth2ClientSecret:  "clientsecret",
+			RegistrationEnabled: util.BoolP(true),
+			LoginEnabled:        util.BoolP(true),
+		}); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+	}
+
+	// user01 and user02 have a linked account on rs0, user03 on rs1
+	allLinkedAccounts := []*types.LinkedAccount{}
+	rs0LinkedAccounts := []*types.LinkedAccount{}
+	for i, rsName := range []string{"rs0", "rs0", "rs1"} {
+		userName := fmt.Sprintf("user%02d", i+1)
+		if _, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: userName}); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		la, err := cs.ah.CreateUserLA(ctx, &action.CreateUserLARequest{
+			UserRef:            userName,
+			RemoteSourceName:   rsName,
+			RemoteUserID:       fmt.Sprintf("remoteuser%d", i),
+			RemoteUserName:     userName,
+			UserAccessToken:    "useraccesstoken",
+			Oauth2AccessToken:  "accesstoken",
+			Oauth2RefreshToken: "refreshtoken",
+		})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		allLinkedAccounts = append(allLinkedAccounts, la)
+		if rsName == "rs0" {
+			rs0LinkedAccounts = append(rs0LinkedAccounts, la)
+		}
+	}
+	sort.Slice(allLinkedAccounts, func(i, j int) bool { return allLinkedAccounts[i].ID < allLinkedAccounts[j].ID })
+	sort.Slice(rs0LinkedAccounts, func(i, j int) bool { return rs0LinkedAccounts[i].ID < rs0LinkedAccounts[j].ID })
+
+	reversed := func(las []*types.LinkedAccount) []*types.LinkedAccount {
+		r := make([]*types.LinkedAccount, 0, len(las))
+		for i := len(las) - 1; i >= 0; i-- {
+			r = append(r, las[i])
+		}
+		return r
+	}
+
+	// getAll fetches all the linked accounts in pages of limit linked
+	// accounts, checking that only the last page has HasMore false
+	getAll := func(t *testing.T, req *action.GetLinkedAccountsRequest) []*types.LinkedAccount {
+		las := []*types.LinkedAccount{}
+		for {
+			res, err := cs.ah.GetLinkedAccounts(ctx, req)
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			if len(res.LinkedAccounts) > req.Limit {
+				t.Fatalf("expected at most %d linked accounts, got %d", req.Limit, len(res.LinkedAccounts))
+			}
+			las = append(las, res.LinkedAccounts...)
+			if !res.HasMore {
+				return las
+			}
+			if len(res.LinkedAccounts) == 0 {
+				t.Fatalf("expected linked accounts when HasMore is true")
+			}
+			req.StartID = res.LinkedAccounts[len(res.LinkedAccounts)-1].ID
+		}
+	}
+
+	t.Run("test get all linked accounts", func(t *testing.T) {
+		res, err := cs.ah.GetLinkedAccounts(ctx, &action.GetLinkedAccountsRequest{Asc: true})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if diff := cmpDiffObject(allLinkedAccounts, res.LinkedAccounts); diff != "" {
+			t.Fatalf("mismatch (-want +got):\n%s", diff)
+		}
+		if res.HasMore {
+			t.Fatalf("expected no more linked accounts")
+		}
+	})
+
+	for _, limit := range []int{1, 2, 3, 4} {
+		t.Run(fmt.Sprintf("test get linked accounts paginated with limit %d", limit), func(t *testing.T) {
+			las := getAll(t, &action.GetLinkedAccountsRequest{Limit: limit, Asc: true})
+			if diff := cmpDiffObject(allLinkedAccounts, las); diff != "" {
+				t.Fatalf("mismatch (-want +got):\n%s", diff)
+			}
+
+			las = getAll(t, &action.GetLinkedAccountsRequest{Limit: limit})
+			if diff := cmpDiffObject(reversed(allLinkedAccounts), las); diff != "" {
+				t.Fatalf("mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	t.Run("test get linked accounts limit equal to the linked accounts count", func(t *testing.T) {
+		res, err := cs.ah.GetLinkedAccounts(ctx, &action.GetLinkedAccountsRequest{Limit: len(allLinkedAccounts), Asc: true})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if len(res.LinkedAccounts) != len(allLinkedAccounts) || res.HasMore {
+			t.Fatalf("expected %d linked accounts and no more linked accounts, got %d linked accounts, has more: %t", len(allLinkedAccounts), len(res.LinkedAccounts), res.HasMore)
+		}
+	})
+
+	t.Run("test get linked accounts filtered by remote source", func(t *testing.T) {
+		las := getAll(t, &action.GetLinkedAccountsRequest{Limit: 1, Asc: true, RemoteSourceRef: "rs0"})
+		if diff := cmpDiffObject(rs0LinkedAccounts, las); diff != "" {
+			t.Fatalf("mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("test get linked accounts with unexistent remote source", func(t *testing.T) {
+		expectedErr := util.NewAPIError(util.ErrNotExist, errors.Errorf(`remote source "rs2" doesn't exist`))
+		_, err := cs.ah.GetLinkedAccounts(ctx, &action.GetLinkedAccountsRequest{RemoteSourceRef: "rs2"})
+		if err == nil {
+			t.Fatalf("expected err, got nil err")
+		}
+		if !util.APIErrorIs(err, util.ErrNotExist) || err.Error() != expectedErr.Error() {
+			t.Fatalf("expected err %v, got err: %v", expectedErr, err)
+		}
+	})
+
+	t.Run("test get linked accounts omitting tokens", func(t *testing.T) {
+		res, err := cs.ah.GetLinkedAccounts(ctx, &action.GetLinkedAccountsRequest{Asc: true, OmitTokens: true})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if len(res.LinkedAccounts) != len(allLinkedAccounts) {
+			t.Fatalf("expected %d linked accounts, got %d", len(allLinkedAccounts), len(res.LinkedAccounts))
+		}
+		for _, la := range res.LinkedAccounts {
+			if la.UserAccessToken != "" || la.Oauth2AccessToken != "" || la.Oauth2RefreshToken != "" {
+				t.Fatalf("expected linked account %q without tokens", la.ID)
+			}
+			if la.RemoteUserName == "" {
+				t.Fatalf("expected linked account %q remote user name", la.ID)
+			}
+		}
+	})
+}
+
+func TestGetUserByRemoteUser(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+	log := testutil.NewLogger(t)
+
+	cs := setupConfigstore(ctx, t, log, dir)
+
+	t.Logf("starting cs")
+	go func() { _ = cs.Run(ctx) }()
+
+	rs, err := cs.ah.CreateRemoteSource(ctx, &action.CreateUpdateRemoteSourceRequest{
+		Name:                "rs01",
+		APIURL:              "https://api.example.com",
+		Type:                types.RemoteSourceTypeGitea,
+		AuthType:            types.RemoteSourceAuthTypeOauth2,
+		Oauth2ClientID:      "clientid",
+		Oauth2ClientSecret:  "clientsecret",
+		RegistrationEnabled: util.BoolP(true),
+		LoginEnabled:        util.BoolP(true),
+	})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	users := []*types.User{}
+	for i := 1; i <= 2; i++ {
+		user, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: fmt.Sprintf("user%02d", i)})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if _, err := cs.ah.CreateUserLA(ctx, &action.CreateUserLARequest{UserRef: user.Name, RemoteSourceName: rs.Name, RemoteUserID: fmt.Sprintf("remoteuser%02d", i), RemoteUserName: user.Name}); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		users = append(users, user)
+	}
+
+	t.Run("test get user by remote user", func(t *testing.T) {
+		// the remote source can be referenced by name or id
+		for _, rsRef := range []string{rs.Name, rs.ID} {
+			user, err := cs.ah.GetUserByRemoteUser(ctx, rsRef, "remoteuser02")
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			if diff := cmpDiffObject(users[1], user); diff != "" {
+				t.Fatalf("mismatch (-want +got):\n%s", diff)
+			}
+		}
+	})
+
+	t.Run("test get user by unexistent remote user", func(t *testing.T) {
+		expectedErr := util.NewAPIError(util.ErrNotExist, errors.Errorf(`linked account with remote user "remoteuser03" for remote source "rs01" doesn't exist`))
+		_, err := cs.ah.GetUserByRemoteUser(ctx, "rs01", "remoteuser03")
+		if err == nil {
+			t.Fatalf("expected err, got nil err")
+		}
+		if !util.APIErrorIs(err, util.ErrNotExist) || err.Error() != expectedErr.Error() {
+			t.Fatalf("expected err %v, got err: %v", expectedErr, err)
+		}
+	})
+
+	t.Run("test get user by remote user with unexistent remote source", func(t *testing.T) {
+		expectedErr := util.NewAPIError(util.ErrNotExist, errors.Errorf(`remote source "rs02" doesn't exist`))
+		_, err := cs.ah.GetUserByRemoteUser(ctx, "rs02", "remoteuser01")
+		if err == nil {
+			t.Fatalf("expected err, got nil err")
+		}
+		if !util.APIErrorIs(err, util.ErrNotExist) || err.Error() != expectedErr.Error() {
+			t.Fatalf("expected err %v, got err: %v", expectedErr, err)
+		}
+	})
+}
+
+func TestRefreshLinkedAccountOauth2Token(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+	log := testutil.NewLogger(t)
+
+	cs := setupConfigstore(ctx, t, log, dir)
+
+	t.Logf("starting cs")
+	go func() { _ = cs.Run(ctx) }()
+
+	rs, err := cs.ah.CreateRemoteSource(ctx, &action.CreateUpdateRemoteSourceRequest{
+		Name:                "rs01",
+		APIURL:              "https://api.example.com",
+		Type:                types.RemoteSourceTypeGitea,
+		AuthType:            types.RemoteSourceAuthTypeOauth2,
+		Oauth2ClientID:      "clientid",
+		Oauth2ClientSecret:  "clientsecret",
+		RegistrationEnabled: util.BoolP(true),
+		LoginEnabled:        util.BoolP(true),
+	})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	las := []*types.LinkedAccount{}
+	for i := 1; i <= 2; i++ {
+		userName := fmt.Sprintf("user%02d", i)
+		if _, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: userName}); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		la, err := cs.ah.CreateUserLA(ctx, &action.CreateUserLARequest{
+			UserRef:                    userName,
+			RemoteSourceName:           rs.Name,
+			RemoteUserID:               fmt.Sprintf("remoteuser%02d", i),
+			RemoteUserName:             userName,
+			UserAccessToken:            "useraccesstoken",
+			Oauth2AccessToken:          "accesstoken",
+			Oauth2RefreshToken:         "refreshtoken",
+			Oauth2AccessTokenExpiresAt: time.Now().UTC(),
+		})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		las = append(las, la)
+	}
+
+	t.Run("test refresh linked account oauth2 token", func(t *testing.T) {
+		expiresAt := time.Now().Add(time.Hour).UTC()
+		la, err := cs.ah.RefreshLinkedAccountOauth2Token(ctx, "user01", las[0].ID, "newaccesstoken", "newrefreshtoken", expiresAt)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+
+		expectedLA := *las[0]
+		expectedLA.ObjectMeta = la.ObjectMeta
+		expectedLA.Oauth2AccessToken = "newaccesstoken"
+		expectedLA.Oauth2RefreshToken = "newrefreshtoken"
+		expectedLA.Oauth2AccessTokenExpiresAt = expiresAt
+		if diff := cmpDiffObject(&expectedLA, la); diff != "" {
+			t.Fatalf("mismatch (-want +got):\n%s", diff)
+		}
+
+		userLAs, err := cs.ah.GetUserLinkedAccounts(ctx, "user01")
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if diff := cmpDiffObject([]*types.LinkedAccount{&expectedLA}, userLAs); diff != "" {
+			t.Fatalf("mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("test refresh linked account oauth2 token of another user", func(t *testing.T) {
+		expectedErr := util.NewAPIError(util.ErrNotExist, errors.Errorf(`linked account id %q for user "user01" doesn't exist`, las[1].ID))
+		_, err := cs.ah.RefreshLinkedAccountOauth2Token(ctx, "user01", las[1].ID, "newaccesstoken", "newrefreshtoken", time.Now().Add(time.Hour))
+		if err == nil {
+			t.Fatalf("expected err, got nil err")
+		}
+		if !util.APIErrorIs(err, util.ErrNotExist) || err.Error() != expectedErr.Error() {
+			t.Fatalf("expected err %v, got err: %v", expectedErr, err)
+		}
+
+		// the other user linked account is unchanged
+		userLAs, err := cs.ah.GetUserLinkedAccounts(ctx, "user02")
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if diff := cmpDiffObject([]*types.LinkedAccount{las[1]}, userLAs); diff != "" {
+			t.Fatalf("mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("test refresh unexistent linked account oauth2 token", func(t *testing.T) {
+		expectedErr := util.NewAPIError(util.ErrNotExist, errors.Errorf(`linked account id "unexistent" for user "user01" doesn't exist`))
+		_, err := cs.ah.RefreshLinkedAccountOauth2Token(ctx, "user01", "unexistent", "newaccesstoken", "newrefreshtoken", time.Now().Add(time.Hour))
+		if err == nil {
+			t.Fatalf("expected err, got nil err")
+		}
+		if !util.APIErrorIs(err, util.ErrNotExist) || err.Error() != expectedErr.Error() {
+			t.Fatalf("expected err %v, got err: %v", expectedErr, err)
+		}
+	})
+}
+
+func TestUpdateUserLARemoteUserConflict(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+	log := testutil.NewLogger(t)
+
+	cs := setupConfigstore(ctx, t, log, dir)
+
+	t.Logf("starting cs")
+	go func() { _ = cs.Run(ctx) }()
+
+	rs, err := cs.ah.CreateRemoteSource(ctx, &action.CreateUpdateRemoteSourceRequest{
+		Name:                "rs01",
+		APIURL:              "https://api.example.com",
+		Type:                types.RemoteSourceTypeGitea,
+		AuthType:            types.RemoteSourceAuthTypeOauth2,
+		Oauth2ClientID:      "clientid",
+		Oauth2ClientSecret:  "clientsecret",
+		RegistrationEnabled: util.BoolP(true),
+		LoginEnabled:        util.BoolP(true),
+	})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	las := []*types.LinkedAccount{}
+	for i := 1; i <= 2; i++ {
+		userName := fmt.Sprintf("user%02d", i)
+		if _, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: userName}); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		la, err := cs.ah.CreateUserLA(ctx, &action.CreateUserLARequest{UserRef: userName, RemoteSourceName: rs.Name, RemoteUserID: fmt.Sprintf("remoteuser%02d", i), RemoteUserName: userName})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		las = append(las, la)
+	}
+
+	t.Run("test update linked account to an already linked remote user", func(t *testing.T) {
+		expectedErr := util.NewAPIError(util.ErrConflict, errors.Errorf(`linked account for remote user id "remoteuser02" for remote source "rs01" already exists`))
+		_, err := cs.ah.UpdateUserLA(ctx, &action.UpdateUserLARequest{UserRef: "user01", LinkedAccountID: las[0].ID, RemoteUserID: "remoteuser02", RemoteUserName: "user01"})
+		if err == nil {
+			t.Fatalf("expected err, got nil err")
+		}
+		if !util.APIErrorIs(err, util.ErrConflict) || err.Error() != expectedErr.Error() {
+			t.Fatalf("expected err %v, got err: %v", expectedErr, err)
+		}
+	})
+
+	t.Run("test update linked account keeping its remote user", func(t *testing.T) {
+		la, err := cs.ah.UpdateUserLA(ctx, &action.UpdateUserLARequest{UserRef: "user01", LinkedAccountID: las[0].ID, RemoteUserID: "remoteuser01", RemoteUserName: "newuser01"})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if la.RemoteUserID != "remoteuser01" || la.RemoteUserName != "newuser01" {
+			t.Fatalf("expected remote user id %q and name %q, got %q and %q", "remoteuser01", "newuser01", la.RemoteUserID, la.RemoteUserName)
+		}
+	})
+
+	t.Run("test update linked account to a not linked remote user", func(t *testing.T) {
+		la, err := cs.ah.UpdateUserLA(ctx, &action.UpdateUserLARequest{UserRef: "user01", LinkedAccountID: las[0].ID, RemoteUserID: "remoteuser03", RemoteUserName: "user01"})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if la.RemoteUserID != "remoteuser03" {
+			t.Fatalf("expected remote user id %q, got %q", "remoteuser03", la.RemoteUserID)
+		}
+	})
+}
+
+func TestGetUsersByRemoteSource(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+	log := testutil.NewLogger(t)
+
+	cs := setupConfigstore(ctx, t, log, dir)
+
+	t.Logf("starting cs")
+	go func() { _ = cs.Run(ctx) }()
+
+	for i := 0; i < 2; i++ {
+		if _, err := cs.ah.CreateRemoteSource(ctx, &action.CreateUpdateRemoteSourceRequest{
+			Name:                fmt.Sprintf("rs%d", i),
+			APIURL:              "https://api.example.com",
+			Type:                types.RemoteSourceTypeGitea,
+			AuthType:            types.RemoteSourceAuthTypeOauth2,
+			Oauth2ClientID:      "clientid",
+			Oauth2ClientSecret:  "clientsecret",
+			RegistrationEnabled: util.BoolP(true),
+			LoginEnabled:        util.BoolP(true),
+		}); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+	}
+
+	// userRemoteSources maps the users to the remote sources of their linked
+	// accounts. user02 has two linked accounts on rs0.
+	userRemoteSources := map[string][]string{
+		"user01": {"rs0"},
+		"user02": {"rs0", "rs0"},
+		"user03": {"rs1"},
+		"user04": {"rs0", "rs1"},
+		"user05": {},
+	}
+	users := map[string]*types.User{}
+	for i := 1; i <= 5; i++ {
+		userName := fmt.Sprintf("user%02d", i)
+		user, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: userName})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		users[userName] = user
+		for j, rsName := range userRemoteSources[userName] {
+			if _, err := cs.ah.CreateUserLA(ctx, &action.CreateUserLARequest{UserRef: userName, RemoteSourceName: rsName, RemoteUserID: fmt.Sprintf("remote%s%d", userName, j), RemoteUserName: userName}); err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+		}
+	}
+
+	t.Run("test get users filtered by remote source", func(t *testing.T) {
+		res, err := cs.ah.GetUsers(ctx, &action.GetUsersRequest{RemoteSourceRef: "rs0", Asc: true})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		expectedUsers := []*types.User{users["user01"], users["user02"], users["user04"]}
+		if diff := cmpDiffObject(expectedUsers, res.Users); diff != "" {
+			t.Fatalf("mismatch (-want +got):\n%s", diff)
+		}
+		if res.HasMore {
+			t.Fatalf("expected no more users")
+		}
+	})
+
+	t.Run("test get users filtered by remote source paginated", func(t *testing.T) {
+		res, err := cs.ah.GetUsers(ctx, &action.GetUsersRequest{RemoteSourceRef: "rs0", Limit: 2, Asc: true})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		expectedUsers := []*types.User{users["user01"], users["user02"]}
+		if diff := cmpDiffObject(expectedUsers, res.Users); diff != "" {
+			t.Fatalf("mismatch (-want +got):\n%s", diff)
+		}
+		if !res.HasMore {
+			t.Fatalf("expected more users")
+		}
+
+		res, err = cs.ah.GetUsers(ctx, &action.GetUsersRequest{RemoteSourceRef: "rs0", StartUserName: res.Users[1].Name, Limit: 2, Asc: true})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		expectedUsers = []*types.User{users["user04"]}
+		if diff := cmpDiffObject(expectedUsers, res.Users); diff != "" {
+			t.Fatalf("mismatch (-want +got):\n%s", diff)
+		}
+		if res.HasMore {
+			t.Fatalf("expected no more users")
+		}
+	})
+
+	t.Run("test get users filtered by remote source paginated at the boundary", func(t *testing.T) {
+		res, err := cs.ah.GetUsers(ctx, &action.GetUsersRequest{RemoteSourceRef: "rs1", Limit: 2})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		expectedUsers := []*types.User{users["user04"], users["user03"]}
+		if diff := cmpDiffObject(expectedUsers, res.Users); diff != "" {
+			t.Fatalf("mismatch (-want +got):\n%s", diff)
+		}
+		if res.HasMore {
+			t.Fatalf("expected no more users")
+		}
+	})
+
+	t.Run("test get users without remote source filter", func(t *testing.T) {
+		res, err := cs.ah.GetUsers(ctx, &action.GetUsersRequest{Limit: 4, Asc: true})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		expectedUsers := []*types.User{users["user01"], users["user02"], users["user03"], users["user04"]}
+		if diff := cmpDiffObject(expectedUsers, res.Users); diff != "" {
+			t.Fatalf("mismatch (-want +got):\n%s", diff)
+		}
+		if !res.HasMore {
+			t.Fatalf("expected more users")
+		}
+	})
+
+	t.Run("test get users filtered by not existing remote source", func(t *testing.T) {
+		expectedErr := util.NewAPIError(util.ErrNotExist, errors.Errorf(`remote source "rs99" doesn't exist`))
+		_, err := cs.ah.GetUsers(ctx, &action.GetUsersRequest{RemoteSourceRef: "rs99"})
+		if err == nil {
+			t.Fatalf("expected error %v, got nil err", expectedErr)
+		}
+		if !util.APIErrorIs(err, util.ErrNotExist) {
+			t.Fatalf("expected not exist error, got err: %v", err)
+		}
+		if err.Error() != expectedErr.Error() {
+			t.Fatalf("expected err %v, got err: %v", expectedErr, err)
+		}
+	})
+}
+
+func TestGetUsersCount(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+	log := testutil.NewLogger(t)
+
+	cs := setupConfigstore(ctx, t, log, dir)
+
+	t.Logf("starting cs")
+	go func() { _ = cs.Run(ctx) }()
+
+	rs, err := cs.ah.CreateRemoteSource(ctx, &action.CreateUpdateRemoteSourceRequest{
+		Name:                "rs01",
+		APIURL:              "https://api.example.com",
+		Type:                types.RemoteSourceTypeGitea,
+		AuthType:            types.RemoteSourceAuthTypeOauth2,
+		Oauth2ClientID:      "clientid",
+		Oauth2ClientSecret:  "clientsecret",
+		RegistrationEnabled: util.BoolP(true),
+		LoginEnabled:        util.BoolP(true),
+	})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	// alice and malice have a linked account on rs01
+	for _, userName := range []string{"Alfred", "alice", "bob", "malice"} {
+		if _, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: userName}); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if userName != "alice" && userName != "malice" {
+			continue
+		}
+		if _, err := cs.ah.CreateUserLA(ctx, &action.CreateUserLARequest{UserRef: userName, RemoteSourceName: rs.Name, RemoteUserID: userName, RemoteUserName: userName}); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+	}
+
+	tests := []struct {
+		name          string
+		req           *action.GetUsersCountRequest
+		expectedCount int
+	}{
+		{
+			name:          "test count all users",
+			req:           &action.GetUsersCountRequest{},
+			expectedCount: 4,
+		},
+		{
+			name:          "test count with prefix query",
+			req:           &action.GetUsersCountRequest{Query: "AL"},
+			expectedCount: 2,
+		},
+		{
+			name:          "test count with mid-string query",
+			req:           &action.GetUsersCountRequest{Query: "*lic"},
+			expectedCount: 2,
+		},
+		{
+			name:          "test count with not matching query",
+			req:           &action.GetUsersCountRequest{Query: "carl"},
+			expectedCount: 0,
+		},
+		{
+			name:          "test count with remote source",
+			req:           &action.GetUsersCountRequest{RemoteSourceRef: "rs01"},
+			expectedCount: 2,
+		},
+		{
+			name:          "test count with remote source and query",
+			req:           &action.GetUsersCountRequest{RemoteSourceRef: "rs01", Query: "al"},
+			expectedCount: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			count, err := cs.ah.GetUsersCount(ctx, tt.req)
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			if count != tt.expectedCount {
+				t.Fatalf("expected %d users, got %d", tt.expectedCount, count)
+			}
+		})
+	}
+
+	t.Run("test count with unexistent remote source", func(t *testing.T) {
+		expectedErr := util.NewAPIError(util.ErrNotExist, errors.Errorf(`remote source "rs02" doesn't exist`))
+		_, err := cs.ah.GetUsersCount(ctx, &action.GetUsersCountRequest{RemoteSourceRef: "rs02"})
+		if err == nil {
+			t.Fatalf("expected err, got nil err")
+		}
+		if !util.APIErrorIs(err, util.ErrNotExist) || err.Error() != expectedErr.Error() {
+			t.Fatalf("expected err %v, got err: %v", expectedErr, err)
+		}
+	})
+}
+
+func TestGetUsersByCreationTime(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+	log := testutil.NewLogger(t)
+
+	cs := setupConfigstore(ctx, t, log, dir)
+
+	t.Logf("starting cs")
+	go func() { _ = cs.Run(ctx) }()
+
+	// create the users in reverse name order
+	creationOrder := []string{"user05", "user04", "user03", "user02", "user01"}
+	for _, userName := range creationOrder {
+		if _, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: userName}); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+	}
+
+	getAllUsers := func(t *testing.T, sortField action.UsersSortField, asc bool) ([]string, []bool) {
+		t.Helper()
+
+		userNames := []string{}
+		hasMores := []bool{}
+		cursor := ""
+		for {
+			res, err := cs.ah.GetUsers(ctx, &action.GetUsersRequest{StartCursor: cursor, Limit: 2, Asc: asc, SortField: sortField})
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			for _, user := range res.Users {
+				userNames = append(userNames, user.Name)
+			}
+			hasMores = append(hasMores, res.HasMore)
+			if !res.HasMore {
+				break
+			}
+			cursor = res.NextCursor
+		}
+
+		return userNames, hasMores
+	}
+
+	tests := []struct {
+		name              string
+		sortField         action.UsersSortField
+		asc               bool
+		expectedUserNames []string
+	}{
+		{
+			name:              "test get users by creation time ascending",
+			sortField:         action.UsersSortFieldCreationTime,
+			asc:               true,
+			expectedUserNames: []string{"user05", "user04", "user03", "user02", "user01"},
+		},
+		{
+			name:              "test get users by creation time descending",
+			sortField:         action.UsersSortFieldCreationTime,
+			asc:               false,
+			expectedUserNames: []string{"user01", "user02", "user03", "user04", "user05"},
+		},
+		{
+			name:              "test get users with default sort field",
+			asc:               true,
+			expectedUserNames: []string{"user01", "user02", "user03", "user04", "user05"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			userNames, hasMores := getAllUsers(t, tt.sortField, tt.asc)
+			if diff := cmp.Diff(tt.expectedUserNames, userNames); diff != "" {
+				t.Fatalf("users mismatch (-want +got):\n%s", diff)
+			}
+			if diff := cmp.Diff([]bool{true, true, false}, hasMores); diff != "" {
+				t.Fatalf("has more mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	t.Run("test get users by creation time without limit", func(t *testing.T) {
+		res, err := cs.ah.GetUsers(ctx, &action.GetUsersRequest{Asc: true, SortField: action.UsersSortFieldCreationTime})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if len(res.Users) != len(creationOrder) || res.HasMore {
+			t.Fatalf("expected %d users and no more users, got %d users, has more: %t", len(creationOrder), len(res.Users), res.HasMore)
+		}
+	})
+
+	t.Run("test get users with invalid sort field", func(t *testing.T) {
+		expectedErr := util.NewAPIError(util.ErrBadRequest, errors.Errorf("invalid sort field %q", "email"))
+		_, err := cs.ah.GetUsers(ctx, &action.GetUsersRequest{SortField: "email"})
+		if err == nil {
+			t.Fatalf("expected error %v, got nil err", expectedErr)
+		}
+		if !util.APIErrorIs(err, util.ErrBadRequest) || err.Error() != expectedErr.Error() {
+			t.Fatalf("expected err %v, got err: %v", expectedErr, err)
+		}
+	})
+
+	t.Run("test get users by creation time with invalid cursor", func(t *testing.T) {
+		expectedErr := util.NewAPIError(util.ErrBadRequest, errors.Errorf("invalid start cursor %q", "user01"))
+		_, err := cs.ah.GetUsers(ctx, &action.GetUsersRequest{StartCursor: "user01", SortField: action.UsersSortFieldCreationTime})
+		if err == nil {
+			t.Fatalf("expected error %v, got nil err", expectedErr)
+		}
+		if !util.APIErrorIs(err, util.ErrBadRequest) || err.Error() != expectedErr.Error() {
+			t.Fatalf("expected err %v, got err: %v", expectedErr, err)
+		}
+	})
+}
+
+func TestGetUsersQuery(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+	log := testutil.NewLogger(t)
+
+	cs := setupConfigstore(ctx, t, log, dir)
+
+	t.Logf("starting cs")
+	go func() { _ = cs.Run(ctx) }()
+
+	users := map[string]*types.User{}
+	for _, userName := range []string{"Alfred", "alice", "bob", "malice"} {
+		user, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: userName})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		users[userName] = user
+	}
+
+	tests := []struct {
+		name            string
+		req             *action.GetUsersRequest
+		expectedUsers   []string
+		expectedHasMore bool
+	}{
+		{
+			name:          "test empty query",
+			req:           &action.GetUsersRequest{Asc: true},
+			expectedUsers: []string{"Alfred", "alice", "bob", "malice"},
+		},
+		{
+			name:          "test prefix match",
+			req:           &action.GetUsersRequest{Query: "AL", Asc: true},
+			expectedUsers: []string{"Alfred", "alice"},
+		},
+		{
+			name:          "test mid-string match",
+			req:           &action.GetUsersRequest{Query: "*LIC", Asc: true},
+			expectedUsers: []string{"alice", "malice"},
+		},
+		{
+			name:          "test like special characters are matched literally",
+			req:           &action.GetUsersRequest{Query: "*a_i", Asc: true},
+			expectedUsers: []string{},
+		},
+		{
+			name:            "test mid-string match paginated",
+			req:             &action.GetUsersRequest{Query: "*lic", Limit: 1, Asc: true},
+			expectedUsers:   []string{"alice"},
+			expectedHasMore: true,
+		},
+		{
+			name:          "test mid-string match paginated from start user",
+			req:           &action.GetUsersRequest{Query: "*lic", StartUserName: "alice", Limit: 1, Asc: true},
+			expectedUsers: []string{"malice"},
+		},
+		{
+			name:            "test prefix match paginated descending",
+			req:             &action.GetUsersRequest{Query: "al", Limit: 1},
+			expectedUsers:   []string{"alice"},
+			expectedHasMore: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := cs.ah.GetUsers(ctx, tt.req)
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			expectedUsers := []*types.User{}
+			for _, userName := range tt.expectedUsers {
+				expectedUsers = append(expectedUsers, users[userName])
+			}
+			if diff := cmpDiffObject(expectedUsers, res.Users); diff != "" {
+				t.Fatalf("mismatch (-want +got):\n%s", diff)
+			}
+			if res.HasMore != tt.expectedHasMore {
+				t.Fatalf("expected has more %t, got %t", tt.expectedHasMore, res.HasMore)
+			}
+		})
+	}
+}
+
+func TestProjectGroupsAndProjectsCreate(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+	log := testutil.NewLogger(t)
+
+	cs := setupConfigstore(ctx, t, log, dir)
+
+	t.Logf("starting cs")
+	go func() {
+		_ = cs.Run(ctx)
+	}()
+
+	user, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: "user01"})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	org, err := cs.ah.CreateOrg(ctx, &action.CreateOrgRequest{Name: "org01", Visibility: types.VisibilityPublic})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	t.Run("create a project in user root project group", func(t *testing.T) {
+		_, err := cs.ah.CreateProject(ctx, &action.CreateUpdateProjectRequest{Name: "project01", Parent: types.Parent{Kind: types.ObjectKindProjectGroup, ID: path.Join("user", user.Name)}, Visibility: types.VisibilityPublic, RemoteRepositoryConfigType: types.RemoteRepositoryConfigTypeManual})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+	})
+	t.Run("create a project in org root project group", func(t *testing.T) {
+		_, err := cs.ah.CreateProject(ctx, &action.CreateUpdateProjectRequest{Name: "project01", Parent: types.Parent{Kind: types.ObjectKindProjectGroup, ID: path.Join("org", org.Name)}, Visibility: types.VisibilityPublic, RemoteRepositoryConfigType: types.RemoteRepositoryConfigTypeManual})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+	})
+	t.Run("create a projectgroup in user root project group", func(t *testing.T) {
+		_, err := cs.ah.CreateProjectGroup(ctx, &action.CreateUpdateProjectGroupRequest{Name: "projectgroup01", Parent: types.Parent{Kind: types.ObjectKindProjectGroup, ID: path.Join("user", user.Name)}, Visibility: types.VisibilityPublic})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+	})
+	t.Run("create a projectgroup in org root project group", func(t *testing.T) {
+		_, err := cs.ah.CreateProjectGroup(ctx, &action.CreateUpdateProjectGroupRequest{Name: "projectgroup01", Parent: types.Parent{Kind: types.ObjectKindProjectGroup, ID: path.Join("org", org.Name)}, Visibility: types.VisibilityPublic})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+	})
+	t.Run("create a project in user non root project group with same name as a root project", func(t *testing.T) {
+		_, err := cs.ah.CreateProject(ctx, &action.CreateUpdateProjectRequest{Name: "project01", Parent: types.Parent{Kind: types.ObjectKindProjectGroup, ID: path.Join("user", user.Name, "projectgroup01")}, Visibility: types.VisibilityPublic, RemoteRepositoryConfigType: types.RemoteRepositoryConfigTypeManual})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+	})
+	t.Run("create a project in org non root project group with same name as a root project", func(t *testing.T) {
+		_, err := cs.ah.CreateProject(ctx, &action.CreateUpdateProjectRequest{Name: "project01", Parent: types.Parent{Kind: types.ObjectKindProjectGroup, ID: path.Join("org", org.Name, "projectgroup01")}, Visibility: types.VisibilityPublic, RemoteRepositoryConfigType: types.RemoteRepositoryConfigTypeManual})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+	})
+
+	t.Run("create duplicated project in user root project group", func(t *testing.T) {
+		projectName := "project01"
+		expectedErr := fmt.Sprintf("project with name %q, path %q already exists", projectName, path.Join("user", user.Name, projectName))
+		_, err := cs.ah.CreateProject(ctx, &action.CreateUpdateProjectRequest{Name: projectName, Parent: types.Parent{Kind: types.ObjectKindProjectGroup, ID: path.Join("user", user.Name)}, Visibility: types.VisibilityPublic, RemoteRepositoryConfigType: types.RemoteRepositoryConfigTypeManual})
+		if err.Error() != expectedErr {
+			t.Fatalf("expected err %v, got err: %v", expectedErr, err)
+		}
+	})
+	t.Run("create duplicated project in org root project group", func(t *testing.T) {
+		projectName := "project01"
+		expectedErr := fmt.Sprintf("project with name %q, path %q already exists", projectName, path.Join("org", org.Name, projectName))
+		_, err := cs.ah.CreateProject(ctx, &action.CreateUpdateProjectRequest{Name: projectName, Parent: types.Parent{Kind: types.ObjectKindProjectGroup, ID: path.Join("org", org.Name)}, Visibility: types.VisibilityPublic, RemoteRepositoryConfigType: types.RemoteRepositoryConfigTypeManual})
+		if err.Error() != expectedErr {
+			t.Fatalf("expected err %v, got err: %v", expectedErr, err)
+		}
+	})
+
+	t.Run("create duplicated project in user non root project group", func(t *testing.T) {
+		projectName := "project01"
+		expectedErr := fmt.Sprintf("project with name %q, path %q already exists", projectName, path.Join("user", user.Name, "projectgroup01", projectName))
+		_, err := cs.ah.CreateProject(ctx, &action.CreateUpdateProjectRequest{Name: projectName, Parent: types.Parent{Kind: types.ObjectKindProjectGroup, ID: path.Join("user", user.Name, "projectgroup01")}, Visibility: types.VisibilityPublic, RemoteRepositoryConfigType: types.RemoteRepositoryConfigTypeManual})
+		if err.Error() != expectedErr {
+			t.Fatalf("expected err %v, got err: %v", expectedErr, err)
+		}
+	})
+	t.Run("create duplicated project in org non root project group", func(t *testing.T) {
+		projectName := "project01"
+		expectedErr := fmt.Sprintf("project with name %q, path %q already exists", projectName, path.Join("org", org.Name, "projectgroup01", projectName))
+		_, err := cs.ah.CreateProject(ctx, &action.CreateUpdateProjectRequest{Name: projectName, Parent: types.Parent{Kind: types.ObjectKindProjectGroup, ID: path.Join("org", org.Name, "projectgroup01")}, Visibility: types.VisibilityPublic, RemoteRepositoryConfigType: types.RemoteRepositoryConfigTypeManual})
+		if err.Error() != expectedErr {
+			t.Fatalf("expected err %v, got err: %v", expectedErr, err)
+		}
+	})
+
+	t.Run("create project in unexistent project group", func(t *testing.T) {
+		expectedErr := `project group with id "unexistentid" doesn't exist`
+		_, err := cs.ah.CreateProject(ctx, &action.CreateUpdateProjectRequest{Name: "project01", Parent: types.Parent{Kind: types.ObjectKindProjectGroup, ID: "unexistentid"}, Visibility: types.VisibilityPublic, RemoteRepositoryConfigType: types.RemoteRepositoryConfigTypeManual})
+		if err.Error() != expectedErr {
+			t.Fatalf("expected err %v, got err: %v", expectedErr, err)
+		}
+	})
+	t.Run("create project without parent id specified", func(t *testing.T) {
+		expectedErr := "project parent id required"
+		_, err := cs.ah.CreateProject(ctx, &action.CreateUpdateProjectRequest{Name: "project01", Visibility: types.VisibilityPublic, RemoteRepositoryConfigType: types.RemoteRepositoryConfigTypeManual})
+		if err.Error() != expectedErr {
+			t.Fatalf("expected err %v, got err: %v", expectedErr, err)
+		}
+	})
+
+	t.Run("concurrent project with same name creation", func(t *testing.T) {
+		prevProjects, err := getProjects(ctx, cs)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+
+		wg := sync.WaitGroup{}
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				_, _ = cs.ah.CreateProject(ctx, &action.CreateUpdateProjectRequest{Name: "project02", Parent: types.Parent{Kind: types.ObjectKindProjectGroup, ID: path.Join("user", user.Name)}, Visibility: types.VisibilityPublic, RemoteRepositoryConfigType: types.RemoteRepositoryConfigTypeManual})
+				wg.Done()
+			}()
+		}
+		wg.Wait()
+
+		projects, err := getProjects(ctx, cs)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+
+		if len(projects) != len(prevProjects)+1 {
+			t.Fatalf("expected %d projects, got %d", len(prevProjects)+1, len(projects))
+		}
+	})
+}
+
+func TestGetUserProjects(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+	log := testutil.NewLogger(t)
+
+	cs := setupConfigstore(ctx, t, log, dir)
+
+	t.Logf("starting cs")
+	go func() { _ = cs.Run(ctx) }()
+
+	user, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: "user01"})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	user02, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: "user02"})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	if _, err := cs.ah.CreateProjectGroup(ctx, &action.CreateUpdateProjectGroupRequest{Name: "projectgroup01", Parent: types.Parent{Kind: types.ObjectKindProjectGroup, ID: path.Join("user", user.Name)}, Visibility: types.VisibilityPublic}); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if _, err := cs.ah.CreateProjectGroup(ctx, &action.CreateUpdateProjectGroupRequest{Name: "projectgroup02", Parent: types.Parent{Kind: types.ObjectKindProjectGroup, ID: path.Join("user", user.Name, "projectgroup01")}, Visibility: types.VisibilityPublic}); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	// projects of another user must not be reported
+	user02Project, err := cs.ah.CreateProject(ctx, &action.CreateUpdateProjectRequest{Name: "project00", Parent: types.Parent{Kind: types.ObjectKindProjectGroup, ID: path.Join("user", user02.Name)}, Visibility: types.VisibilityPublic, RemoteRepositoryConfigType: types.RemoteRepositoryConfigTypeManual})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	parentPaths := []string{
+		path.Join("user", user.Name),
+		path.Join("user", user.Name, "projectgroup01"),
+		path.Join("user", user.Name, "projectgroup01", "projectgroup02"),
+	}
+	projects := []*types.Project{}
+	for i := 0; i < 6; i++ {
+		project, err := cs.ah.CreateProject(ctx, &action.CreateUpdateProjectRequest{Name: fmt.Sprintf("project%d", i+1), Parent: types.Parent{Kind: types.ObjectKindProjectGroup, ID: parentPaths[i%len(parentPaths)]}, Visibility: types.VisibilityPublic, RemoteRepositoryConfigType: types.RemoteRepositoryConfigTypeManual})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		projects = append(projects, project)
+	}
+
+	t.Run("test get user projects paginated", func(t *testing.T) {
+		start := ""
+		for i := 0; i < 3; i++ {
+			res, err := cs.ah.GetUserProjects(ctx, user.Name, start, 2, true)
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			expectedResponse := &action.GetUserProjectsResponse{
+				Projects: projects[i*2 : i*2+2],
+				HasMore:  i < 2,
+			}
+			if diff := cmpDiffObject(res, expectedResponse); diff != "" {
+				t.Fatalf("mismatch (-want +got):\n%s", diff)
+			}
+			start = res.Projects[len(res.Projects)-1].ID
+		}
+	})
+
+	t.Run("test get user projects descending", func(t *testing.T) {
+		res, err := cs.ah.GetUserProjects(ctx, user.Name, projects[2].ID, 0, false)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		expectedResponse := &action.GetUserProjectsResponse{
+			Projects: []*types.Project{projects[1], projects[0]},
+		}
+		if diff := cmpDiffObject(res, expectedResponse); diff != "" {
+			t.Fatalf("mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("test get user projects with unexistent start project", func(t *testing.T) {
+		expectedErr := fmt.Sprintf("start project %q doesn't exist", "unexistent")
+		_, err := cs.ah.GetUserProjects(ctx, user.Name, "unexistent", 0, true)
+		if err == nil {
+			t.Fatalf("expected error %v, got nil err", expectedErr)
+		}
+		if !util.APIErrorIs(err, util.ErrBadRequest) || err.Error() != expectedErr {
+			t.Fatalf("expected err %v, got err: %v", expectedErr, err)
+		}
+	})
+
+	t.Run("test get user projects with start project of another user", func(t *testing.T) {
+		expectedErr := fmt.Sprintf("start project %q isn't a project of user %q", user02Project.ID, user.Name)
+		_, err := cs.ah.GetUserProjects(ctx, user.Name, user02Project.ID, 0, true)
+		if err == nil {
+			t.Fatalf("expected error %v, got nil err", expectedErr)
+		}
+		if !util.APIErrorIs(err, util.ErrBadRequest) || err.Error() != expectedErr {
+			t.Fatalf("expected err %v, got err: %v", expectedErr, err)
+		}
+	})
+
+	t.Run("test get projects of unexistent user", func(t *testing.T) {
+		expectedErr := fmt.Sprintf("user %q doesn't exist", "user03")
+		_, err := cs.ah.GetUserProjects(ctx, "user03", "", 0, true)
+		if err == nil {
+			t.Fatalf("expected error %v, got nil err", expectedErr)
+		}
+		if err.Error() != expectedErr {
+			t.Fatalf("expected err %v, got err: %v", expectedErr, err)
+		}
+	})
+}
+
+func TestProjectUpdate(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+	log := testutil.NewLogger(t)
+
+	cs := setupConfigstore(ctx, t, log, dir)
+
+	t.Logf("starting cs")
+	go func() {
+		_ = cs.Run(ctx)
+	}()
+
+	user, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: "user01"})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	if _, err := cs.ah.CreateProjectGroup(ctx, &action.CreateUpdateProjectGroupRequest{Name: "projectgroup01", Parent: types.Parent{Kind: types.ObjectKindProjectGroup, ID: path.Join("user", user.Name)}, Visibility: types.VisibilityPublic}); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	p01 := &action.CreateUpdateProjectRequest{Name: "project01", Parent: types.Parent{Kind: types.ObjectKindProjectGroup, ID: path.Join("user", user.Name)}, Visibility: types.VisibilityPublic, RemoteRepositoryConfigType: types.RemoteRepositoryConfigTypeManual}
+	if _, err := cs.ah.CreateProject(ctx, p01); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	p02 := &action.CreateUpdateProjectRequest{Name: "project01", Parent: types.Parent{Kind: types.ObjectKindProjectGroup, ID: path.Join("user", user.Name, "projectgroup01")}, Visibility: types.VisibilityPublic, RemoteRepositoryConfigType: types.RemoteRepositoryConfigTypeManual}
+	if _, err := cs.ah.CreateProject(ctx, p02); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	p03 := &action.CreateUpdateProjectRequest{Name: "project02", Parent: types.Parent{Kind: types.ObjectKindProjectGroup, ID: path.Join("user", user.Name, "projectgroup01")}, Visibility: types.VisibilityPublic, RemoteRepositoryConfigType: types.RemoteRepositoryConfigTypeManual}
+	if _, err := cs.ah.CreateProject(ctx, p03); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	t.Run("rename project keeping same parent", func(t *testing.T) {
+		projectName := "project02"
+		p03.Name = "newproject02"
+		_, err := cs.ah.UpdateProject(ctx, path.Join("user", user.Name, "projectgroup01", projectName), p03)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+	})
+	t.Run("move project to project group having project with same name", func(t *testing.T) {
+		projectName := "project01"
+		expectedErr := fmt.Sprintf("project with name %q, path %q already exists", projectName, path.Join("user", user.Name, projectName))
+		p02.Parent.ID = path.Join("user", user.Name)
+		_, err := cs.ah.UpdateProject(ctx, path.Join("user", user.Name, "projectgroup01", projectName), p02)
+		if err.Error() != expectedErr {
+			t.Fatalf("expected err %v, got err: %v", expectedErr, err)
+		}
+	})
+	t.Run("move project to project group changing name", func(t *testing.T) {
+		projectName := "project01"
+		p02.Name = "newproject01"
+		p02.Parent.ID = path.Join("user", user.Name)
+		_, err := cs.ah.UpdateProject(ctx, path.Join("user", user.Name, "projectgroup01", projectName), p02)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+	})
+}
+
+func TestProjectGroupUpdate(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+	log := testutil.NewLogger(t)
+
+	cs := setupConfigstore(ctx, t, log, dir)
+
+	t.Logf("starting cs")
+	go func() {
+		_ = cs.Run(ctx)
+	}()
+
+	user, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: "user01"})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	rootPG, err := cs.ah.GetProjectGroup(ctx, path.Join("user", user.Name))
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	pg01req := &action.CreateUpdateProjectGroupRequest{Name: "pg01", Parent: types.Parent{Kind: types.ProjectGroupKind, ID: path.Join("user", user.Name)}, Visibility: types.VisibilityPublic}
+	if _, err := cs.ah.CreateProjectGroup(ctx, pg01req); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	pg02req := &action.CreateUpdateProjectGroupRequest{Name: "pg02", Parent: types.Parent{Kind: types.ProjectGroupKind, ID: path.Join("user", user.Name)}, Visibility: types.VisibilityPublic}
+	if _, err := cs.ah.CreateProjectGroup(ctx, pg02req); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	pg03req := &action.CreateUpdateProjectGroupRequest{Name: "pg03", Parent: types.Parent{Kind: types.ProjectGroupKind, ID: path.Join("user", user.Name)}, Visibility: types.VisibilityPublic}
+	if _, err := cs.ah.CreateProjectGroup(ctx, pg03req); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	pg04req := &action.CreateUpdateProjectGroupRequest{Name: "pg01", Parent: types.Parent{Kind: types.ProjectGroupKind, ID: path.Join("user", user.Name, "pg01")}, Visibility: types.VisibilityPublic}
+	if _, err := cs.ah.CreateProjectGroup(ctx, pg04req); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	pg05req := &action.CreateUpdateProjectGroupRequest{Name: "pg01", Parent: types.Parent{Kind: types.ProjectGroupKind, ID: path.Join("user", user.Name, "pg02")}, Visibility: types.VisibilityPublic}
+	if _, err := cs.ah.CreateProjectGroup(ctx, pg05req); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	t.Run("rename project group keeping same parent", func(t *testing.T) {
+		projectGroupName := "pg03"
+		pg03req.Name = "newpg03"
+		if _, err := cs.ah.UpdateProjectGroup(ctx, path.Join("user", user.Name, projectGroupName), pg03req); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+	})
+	t.Run("move project to project group having project with same name", func(t *testing.T) {
+		projectGroupName := "pg01"
+		expectedErr := fmt.Sprintf("project group with name %q, path %q already exists", projectGroupName, path.Join("user", user.Name, projectGroupName))
+		pg05req.Parent.ID = path.Join("user", user.Name)
+		_, err := cs.ah.UpdateProjectGroup(ctx, path.Join("user", user.Name, "pg02", projectGroupName), pg05req)
+		if err.Error() != expectedErr {
+			t.Fatalf("expected err %v, got err: %v", expectedErr, err)
+		}
+	})
+	t.Run("move project group to root project group changing name", func(t *testing.T) {
+		projectGroupName := "pg01"
+		pg05req.Name = "newpg01"
+		pg05req.Parent.ID = path.Join("user", user.Name)
+		pg05, err := cs.ah.UpdateProjectGroup(ctx, path.Join("user", user.Name, "pg02", projectGroupName), pg05req)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if pg05.Parent.ID != rootPG.ID {
+			t.Fatalf("expected project group parent id as root project group id")
+		}
+	})
+	t.Run("move project group inside itself", func(t *testing.T) {
+		projectGroupName := "pg02"
+		expectedErr := "cannot move project group inside itself or child project group"
+		pg02req.Parent.ID = path.Join("user", user.Name, "pg02")
+		_, err := cs.ah.UpdateProjectGroup(ctx, path.Join("user", user.Name, projectGroupName), pg02req)
+		if err.Error() != expectedErr {
+			t.Fatalf("expected err %v, got err: %v", expectedErr, err)
+		}
+	})
+	t.Run("move project group to child project group", func(t *testing.T) {
+		projectGroupName := "pg01"
+		expectedErr := "cannot move project group inside itself or child project group"
+		pg01req.Parent.ID = path.Join("user", user.Name, "pg01", "pg01")
+		_, err := cs.ah.UpdateProjectGroup(ctx, path.Join("user", user.Name, projectGroupName), pg01req)
+		if err.Error() != expectedErr {
+			t.Fatalf("expected err %v, got err: %v", expectedErr, err)
+		}
+	})
+	t.Run("change root project group parent kind", func(t *testing.T) {
+		var rootPG *types.ProjectGroup
+		rootPG, err := cs.ah.GetProjectGroup(ctx, path.Join("user", user.Name))
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		rootPG.Parent.Kind = types.ObjectKindProjectGroup
+		rootPG.Name = "rootpg"
+
+		expectedErr := "changing project group parent kind isn't supported"
+		_, err = cs.ah.UpdateProjectGroup(ctx, path.Join("user", user.Name), &action.CreateUpdateProjectGroupRequest{Name: rootPG.Name, Parent: rootPG.Parent, Visibility: rootPG.Visibility})
+		if err.Error() != expectedErr {
+			t.Fatalf("expected err %v, got err: %v", expectedErr, err)
+		}
+	})
+	t.Run("change root project group parent id", func(t *testing.T) {
+		var rootPG *types.ProjectGroup
+		rootPG, err := cs.ah.GetProjectGroup(ctx, path.Join("user", user.Name))
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		rootPG.Parent.ID = path.Join("user", user.Name, "pg01")
+
+		expectedErr := "cannot change root project group parent kind or id"
+		_, err = cs.ah.UpdateProjectGroup(ctx, path.Join("user", user.Name), &action.CreateUpdateProjectGroupRequest{Name: rootPG.Name, Parent: rootPG.Parent, Visibility: rootPG.Visibility})
+		if err.Error() != expectedErr {
+			t.Fatalf("expected err %v, got err: %v", expectedErr, err)
+		}
+	})
+	t.Run("change root project group name", func(t *testing.T) {
+		var rootPG *types.ProjectGroup
+		rootPG, err := cs.ah.GetProjectGroup(ctx, path.Join("user", user.Name))
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		rootPG.Name = "rootpgnewname"
+
+		expectedErr := "project group name for root project group must be empty"
+		_, err = cs.ah.UpdateProjectGroup(ctx, path.Join("user", user.Name), &action.CreateUpdateProjectGroupRequest{Name: rootPG.Name, Parent: rootPG.Parent, Visibility: rootPG.Visibility})
+		if err.Error() != expectedErr {
+			t.Fatalf("expected err %v, got err: %v", expectedErr, err)
+		}
+	})
+	t.Run("change root project group visibility", func(t *testing.T) {
+		var rootPG *types.ProjectGroup
+		rootPG, err := cs.ah.GetProjectGroup(ctx, path.Join("user", user.Name))
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		rootPG.Visibility = types.VisibilityPrivate
+
+		if _, err := cs.ah.UpdateProjectGroup(ctx, path.Join("user", user.Name), &action.CreateUpdateProjectGroupRequest{Name: rootPG.Name, Parent: rootPG.Parent, Visibility: rootPG.Visibility}); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+
+		rootPG, err = cs.ah.GetProjectGroup(ctx, path.Join("user", user.Name))
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if rootPG.Visibility != types.VisibilityPrivate {
+			t.Fatalf("expected visiblity %q, got visibility: %q", types.VisibilityPublic, rootPG.Visibility)
+		}
+	})
+}
+
+func TestProjectGroupDelete(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+	log := testutil.NewLogger(t)
+
+	cs := setupConfigstore(ctx, t, log, dir)
+
+	t.Logf("starting cs")
+	go func() {
+		_ = cs.Run(ctx)
+	}()
+
+	org, err := cs.ah.CreateOrg(ctx, &action.CreateOrgRequest{Name: "org01", Visibility: types.VisibilityPublic})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	// create a projectgroup in org root project group
+	pg01, err := cs.ah.CreateProjectGroup(ctx, &action.CreateUpdateProjectGroupRequest{Name: "projectgroup01", Parent: types.Parent{Kind: types.ObjectKindProjectGroup, ID: path.Join("org", org.Name)}, Visibility: types.VisibilityPublic})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	// create a child projectgroup in org root project group
+	if _, err := cs.ah.CreateProjectGroup(ctx, &action.CreateUpdateProjectGroupRequest{Name: "subprojectgroup01", Parent: types.Parent{Kind: types.ObjectKindProjectGroup, ID: pg01.ID}, Visibility: types.VisibilityPublic}); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	t.Run("delete root project group", func(t *testing.T) {
+		expectedErr := "cannot delete root project group"
+		err := cs.ah.DeleteProjectGroup(ctx, path.Join("org", org.Name))
+		if err.Error() != expectedErr {
+			t.Fatalf("expected err %v, got err: %v", expectedErr, err)
+		}
+	})
+
+	t.Run("delete project group", func(t *testing.T) {
+		err := cs.ah.DeleteProjectGroup(ctx, pg01.ID)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+	})
+}
+
+func TestProjectGroupDeleteDontSeeOldChildObjects(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+	log := testutil.NewLogger(t)
+
+	cs := setupConfigstore(ctx, t, log, dir)
+
+	t.Logf("starting cs")
+	go func() {
+		_ = cs.Run(ctx)
+	}()
+
+	org, err := cs.ah.CreateOrg(ctx, &action.CreateOrgRequest{Name: "org01", Visibility: types.VisibilityPublic})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	// create a projectgroup in org root project group
+	pg01, err := cs.ah.CreateProjectGroup(ctx, &action.CreateUpdateProjectGroupRequest{Name: "projectgroup01", Parent: types.Parent{Kind: types.ObjectKindProjectGroup, ID: path.Join("org", org.Name)}, Visibility: types.VisibilityPublic})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	// create a child projectgroup in org root project group
+	spg01, err := cs.ah.CreateProjectGroup(ctx, &action.CreateUpdateProjectGroupRequest{Name: "subprojectgroup01", Parent: types.Parent{Kind: types.ObjectKindProjectGroup, ID: pg01.ID}, Visibility: types.VisibilityPublic})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	// create a project inside child projectgroup
+	project, err := cs.ah.CreateProject(ctx, &action.CreateUpdateProjectRequest{Name: "project01", Parent: types.Parent{Kind: types.ObjectKindProjectGroup, ID: spg01.ID}, Visibility: types.VisibilityPublic, RemoteRepositoryConfigType: types.RemoteRepositoryConfigTypeManual})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	// create project secret
+	if _, err := cs.ah.CreateSecret(ctx, &action.CreateUpdateSecretRequest{Name: "secret01", Parent: types.Parent{Kind: types.ObjectKindProject, ID: project.ID}, Type: types.SecretTypeInternal, Data: map[string]string{"secret01": "secretvar01"}}); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	// create project variable
+	if _, err = cs.ah.CreateVariable(ctx, &action.CreateUpdateVariableRequest{Name: "variable01", Parent: types.Parent{Kind: types.ObjectKindProject, ID: project.ID}, Values: []types.VariableValue{{SecretName: "secret01", SecretVar: "secretvar01"}}}); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	// delete projectgroup
+	if err := cs.ah.DeleteProjectGroup(ctx, pg01.ID); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	// recreate the same hierarchj using the paths
+	pg01, err = cs.ah.CreateProjectGroup(ctx, &action.CreateUpdateProjectGroupRequest{Name: "projectgroup01", Parent: types.Parent{Kind: types.ObjectKindProjectGroup, ID: path.Join("org", org.Name)}, Visibility: types.VisibilityPublic})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	spg01, err = cs.ah.CreateProjectGroup(ctx, &action.CreateUpdateProjectGroupRequest{Name: "subprojectgroup01", Parent: types.Parent{Kind: types.ObjectKindProjectGroup, ID: path.Join("org", org.Name, pg01.Name)}, Visibility: types.VisibilityPublic})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	project, err = cs.ah.CreateProject(ctx, &action.CreateUpdateProjectRequest{Name: "project01", Parent: types.Parent{Kind: types.ObjectKindProjectGroup, ID: path.Join("org", org.Name, pg01.Name, spg01.Name)}, Visibility: types.VisibilityPublic, RemoteRepositoryConfigType: types.RemoteRepositoryConfigTypeManual})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	secret, err := cs.ah.CreateSecret(ctx, &action.CreateUpdateSecretRequest{Name: "secret01", Parent: types.Parent{Kind: types.ObjectKindProject, ID: path.Join("org", org.Name, pg01.Name, spg01.Name, project.Name)}, Type: types.SecretTypeInternal, Data: map[string]string{"secret01": "secretvar01"}})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	variable, err := cs.ah.CreateVariable(ctx, &action.CreateUpdateVariableRequest{Name: "variable01", Parent: types.Parent{Kind: types.ObjectKindProject, ID: path.Join("org", org.Name, pg01.Name, spg01.Name, project.Name)}, Values: []types.VariableValue{{SecretName: "secret01", SecretVar: "secretvar01"}}})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	// Get by projectgroup id
+	projects, err := cs.ah.GetProjectGroupProjects(ctx, spg01.ID)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if diff := cmpDiffObject(projects, []*types.Project{project}); diff != "" {
+		t.Fatalf("mismatch (-want +got):\n%s", diff)
+	}
+
+	// Get by projectgroup path
+	projects, err = cs.ah.GetProjectGroupProjects(ctx, path.Join("org", org.Name, pg01.Name, spg01.Name))
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if diff := cmpDiffObject(projects, []*types.Project{project}); diff != "" {
+		t.Fatalf("mismatch (-want +got):\n%s", diff)
+	}
+
+	secrets, err := cs.ah.GetSecrets(ctx, types.ObjectKindProject, project.ID, false)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if diff := cmpDiffObject(secrets, []*types.Secret{secret}); diff != "" {
+		t.Fatalf("mismatch (-want +got):\n%s", diff)
+	}
+
+	secrets, err = cs.ah.GetSecrets(ctx, types.ObjectKindProject, path.Join("org", org.Name, pg01.Name, spg01.Name, project.Name), false)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if diff := cmpDiffObject(secrets, []*types.Secret{secret}); diff != "" {
+		t.Fatalf("mismatch (-want +got):\n%s", diff)
+	}
+
+	variables, err := cs.ah.GetVariables(ctx, types.ObjectKindProject, project.ID, false)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if diff := cmpDiffObject(variables, []*types.Variable{variable}); diff != "" {
+		t.Fatalf("mismatch (-want +got):\n%s", diff)
+	}
+
+	variables, err = cs.ah.GetVariables(ctx, types.ObjectKindProject, path.Join("org", org.Name, pg01.Name, spg01.Name, project.Name), false)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if diff := cmpDiffObject(variables, []*types.Variable{variable}); diff != "" {
+		t.Fatalf("mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestOrgMembers(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+	log := testutil.NewLogger(t)
+
+	cs := setupConfigstore(ctx, t, log, dir)
+
+	t.Logf("starting cs")
+	go func() { _ = cs.Run(ctx) }()
+
+	user, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: "user01"})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	org, err := cs.ah.CreateOrg(ctx, &action.CreateOrgRequest{Name: "org01", Visibility: types.VisibilityPublic, CreatorUserID: user.ID})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	t.Run("test user org creator is org member with owner role", func(t *testing.T) {
+		expectedResponse := []*action.UserOrgsResponse{
+			{
+				Organization: org,
+				Role:         types.MemberRoleOwner,
+			},
+		}
+		res, err := cs.ah.GetUserOrgs(ctx, &action.GetUserOrgsRequest{UserRef: user.ID})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if diff := cmpDiffObject(res, expectedResponse); diff != "" {
+			t.Fatalf("mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	orgs := []*types.Organization{}
+	for i := 0; i < 10; i++ {
+		org, err := cs.ah.CreateOrg(ctx, &action.CreateOrgRequest{Name: fmt.Sprintf("org%d", i), Visibility: types.VisibilityPublic, CreatorUserID: user.ID})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		orgs = append(orgs, org)
+	}
+
+	for i := 0; i < 5; i++ {
+		if err := cs.ah.DeleteOrg(ctx, fmt.Sprintf("org%d", i)); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+	}
+
+	// delete some org and check that if also orgmembers aren't yet cleaned only the existing orgs are reported
+	t.Run("test only existing orgs are reported", func(t *testing.T) {
+		expectedResponse := []*action.UserOrgsResponse{
+			{
+				Organization: org,
+				Role:         types.MemberRoleOwner,
+			},
+		}
+		for i := 5; i < 10; i++ {
+			expectedResponse = append(expectedResponse, &action.UserOrgsResponse{
+				Organization: orgs[i],
+				Role:         types.MemberRoleOwner,
+			})
+		}
+		res, err := cs.ah.GetUserOrgs(ctx, &action.GetUserOrgsRequest{UserRef: user.ID})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if diff := cmpDiffObject(res, expectedResponse); diff != "" {
+			t.Fatalf("mismatch (-want +got):\n%s", diff)
+		}
+	})
+}
+
+func TestOrgMemberLimit(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+	log := testutil.NewLogger(t)
+
+	cs := setupConfigstore(ctx, t, log, dir)
+
+	t.Logf("starting cs")
+	go func() { _ = cs.Run(ctx) }()
+
+	users := []*types.User{}
+	for i := 1; i <= 5; i++ {
+		user, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: fmt.Sprintf("user%02d", i)})
 		if err != nil {
 			t.Fatalf("unexpected err: %v", err)
 		}
-		rootPG.Parent.ID = path.Join("user", user.Name, "pg01")
+		users = append(users, user)
+	}
 
-		expectedErr := "cannot change root project group parent kind or id"
-		_, err = cs.ah.UpdateProjectGroup(ctx, path.Join("user", user.Name), &action.CreateUpdateProjectGroupRequest{Name: rootPG.Name, Parent: rootPG.Parent, Visibility: rootPG.Visibility})
+	// the creator is the first org member
+	org, err := cs.ah.CreateOrg(ctx, &action.CreateOrgRequest{Name: "org01", Visibility: types.VisibilityPublic, CreatorUserID: users[0].ID, MaxMembers: 3})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	expectLimitErr := func(t *testing.T, err error) {
+		t.Helper()
+
+		expectedErr := fmt.Sprintf("org %q reached its members limit of %d", "org01", 3)
+		if err == nil {
+			t.Fatalf("expected err %q, got nil err", expectedErr)
+		}
 		if err.Error() != expectedErr {
-			t.Fatalf("expected err %v, got err: %v", expectedErr, err)
+			t.Fatalf("expected err %q, got err: %q", expectedErr, err.Error())
+		}
+		derr, ok := util.AsAPIError(err)
+		if !ok || derr.Kind != util.ErrBadRequest || derr.Code != action.ErrorCodeOrgMemberLimit {
+			t.Fatalf("expected bad request api error with code %q, got err: %v", action.ErrorCodeOrgMemberLimit, err)
+		}
+	}
+
+	t.Run("test add member below the limit", func(t *testing.T) {
+		if _, err := cs.ah.AddOrgMember(ctx, org.Name, users[1].Name, types.MemberRoleMember); err != nil {
+			t.Fatalf("unexpected err: %v", err)
 		}
 	})
-	t.Run("change root project group name", func(t *testing.T) {
-		var rootPG *types.ProjectGroup
-		rootPG, err := cs.ah.GetProjectGroup(ctx, path.Join("user", user.Name))
-		if err != nil {
+
+	t.Run("test add member reaching the limit", func(t *testing.T) {
+		if _, err := cs.ah.AddOrgMember(ctx, org.Name, users[2].Name, types.MemberRoleMember); err != nil {
 			t.Fatalf("unexpected err: %v", err)
 		}
-		rootPG.Name = "rootpgnewname"
+	})
 
-		expectedErr := "project group name for root project group must be empty"
-		_, err = cs.ah.UpdateProjectGroup(ctx, path.Join("user", user.Name), &action.CreateUpdateProjectGroupRequest{Name: rootPG.Name, Parent: rootPG.Parent, Visibility: rootPG.Visibility})
-		if err.Error() != expectedErr {
-			t.Fatalf("expected err %v, got err: %v", expectedErr, err)
+	t.Run("test add member above the limit", func(t *testing.T) {
+		_, err := cs.ah.AddOrgMember(ctx, org.Name, users[3].Name, types.MemberRoleMember)
+		expectLimitErr(t, err)
+	})
+
+	t.Run("test update member role at the limit", func(t *testing.T) {
+		if _, err := cs.ah.AddOrgMember(ctx, org.Name, users[2].Name, types.MemberRoleOwner); err != nil {
+			t.Fatalf("unexpected err: %v", err)
 		}
 	})
-	t.Run("change root project group visibility", func(t *testing.T) {
-		var rootPG *types.ProjectGroup
-		rootPG, err := cs.ah.GetProjectGroup(ctx, path.Join("user", user.Name))
-		if err != nil {
+
+	t.Run("test accept invitation above the limit", func(t *testing.T) {
+		if _, err := cs.ah.CreateOrgInvitation(ctx, &action.CreateOrgInvitationRequest{UserRef: users[4].Name, OrganizationRef: org.Name, Role: types.MemberRoleMember}); err != nil {
 			t.Fatalf("unexpected err: %v", err)
 		}
-		rootPG.Visibility = types.VisibilityPrivate
+		err := cs.ah.OrgInvitationAction(ctx, &action.OrgInvitationActionRequest{OrgRef: org.Name, UserRef: users[4].Name, Action: csapitypes.Accept})
+		expectLimitErr(t, err)
+	})
 
-		if _, err := cs.ah.UpdateProjectGroup(ctx, path.Join("user", user.Name), &action.CreateUpdateProjectGroupRequest{Name: rootPG.Name, Parent: rootPG.Parent, Visibility: rootPG.Visibility}); err != nil {
+	t.Run("test add member after raising the limit", func(t *testing.T) {
+		if _, err := cs.ah.UpdateOrg(ctx, org.Name, &action.UpdateOrgRequest{Visibility: types.VisibilityPublic, MaxMembers: util.IntP(4)}); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if _, err := cs.ah.AddOrgMember(ctx, org.Name, users[3].Name, types.MemberRoleMember); err != nil {
 			t.Fatalf("unexpected err: %v", err)
 		}
 
-		rootPG, err = cs.ah.GetProjectGroup(ctx, path.Join("user", user.Name))
+		members, err := cs.ah.GetOrgMembers(ctx, org.Name)
 		if err != nil {
 			t.Fatalf("unexpected err: %v", err)
 		}
-		if rootPG.Visibility != types.VisibilityPrivate {
-			t.Fatalf("expected visiblity %q, got visibility: %q", types.VisibilityPublic, rootPG.Visibility)
+		if len(members) != 4 {
+			t.Fatalf("expected 4 members, got %d", len(members))
 		}
 	})
 }
 
-func TestProjectGroupDelete(t *testing.T) {
+func TestReassignOrgOwnership(t *testing.T) {
 	dir := t.TempDir()
 	ctx := context.Background()
 	log := testutil.NewLogger(t)
@@ -851,43 +4143,102 @@ func TestProjectGroupDelete(t *testing.T) {
 	cs := setupConfigstore(ctx, t, log, dir)
 
 	t.Logf("starting cs")
-	go func() {
-		_ = cs.Run(ctx)
-	}()
+	go func() { _ = cs.Run(ctx) }()
 
-	org, err := cs.ah.CreateOrg(ctx, &action.CreateOrgRequest{Name: "org01", Visibility: types.VisibilityPublic})
-	if err != nil {
-		t.Fatalf("unexpected err: %v", err)
+	users := map[string]*types.User{}
+	for _, userName := range []string{"user01", "user02", "user03", "user04"} {
+		user, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: userName})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		users[userName] = user
 	}
 
-	// create a projectgroup in org root project group
-	pg01, err := cs.ah.CreateProjectGroup(ctx, &action.CreateUpdateProjectGroupRequest{Name: "projectgroup01", Parent: types.Parent{Kind: types.ObjectKindProjectGroup, ID: path.Join("org", org.Name)}, Visibility: types.VisibilityPublic})
-	if err != nil {
-		t.Fatalf("unexpected err: %v", err)
+	orgMembers := func(t *testing.T, orgRef string) map[string]types.MemberRole {
+		members, err := cs.ah.GetOrgMembers(ctx, orgRef)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		roles := map[string]types.MemberRole{}
+		for _, member := range members {
+			if _, ok := roles[member.User.Name]; ok {
+				t.Fatalf("duplicate membership for user %q", member.User.Name)
+			}
+			roles[member.User.Name] = member.Role
+		}
+		return roles
 	}
 
-	// create a child projectgroup in org root project group
-	if _, err := cs.ah.CreateProjectGroup(ctx, &action.CreateUpdateProjectGroupRequest{Name: "subprojectgroup01", Parent: types.Parent{Kind: types.ObjectKindProjectGroup, ID: pg01.ID}, Visibility: types.VisibilityPublic}); err != nil {
+	// org01 owners: user01, user02. members: user03
+	if _, err := cs.ah.CreateOrg(ctx, &action.CreateOrgRequest{Name: "org01", Visibility: types.VisibilityPublic, CreatorUserID: users["user01"].ID}); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if _, err := cs.ah.AddOrgMember(ctx, "org01", "user02", types.MemberRoleOwner); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if _, err := cs.ah.AddOrgMember(ctx, "org01", "user03", types.MemberRoleMember); err != nil {
 		t.Fatalf("unexpected err: %v", err)
 	}
 
-	t.Run("delete root project group", func(t *testing.T) {
-		expectedErr := "cannot delete root project group"
-		err := cs.ah.DeleteProjectGroup(ctx, path.Join("org", org.Name))
-		if err.Error() != expectedErr {
-			t.Fatalf("expected err %v, got err: %v", expectedErr, err)
+	t.Run("test reassign ownership to a non member user", func(t *testing.T) {
+		if err := cs.ah.ReassignOrgOwnership(ctx, "org01", "user01", "user04"); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+
+		expectedMembers := map[string]types.MemberRole{
+			"user01": types.MemberRoleMember,
+			"user02": types.MemberRoleOwner,
+			"user03": types.MemberRoleMember,
+			"user04": types.MemberRoleOwner,
+		}
+		if diff := cmp.Diff(expectedMembers, orgMembers(t, "org01")); diff != "" {
+			t.Fatalf("unexpected org members:\n%s", diff)
 		}
 	})
 
-	t.Run("delete project group", func(t *testing.T) {
-		err := cs.ah.DeleteProjectGroup(ctx, pg01.ID)
-		if err != nil {
+	t.Run("test reassign ownership to an existing member", func(t *testing.T) {
+		if err := cs.ah.ReassignOrgOwnership(ctx, "org01", "user04", "user03"); err != nil {
 			t.Fatalf("unexpected err: %v", err)
 		}
+
+		expectedMembers := map[string]types.MemberRole{
+			"user01": types.MemberRoleMember,
+			"user02": types.MemberRoleOwner,
+			"user03": types.MemberRoleOwner,
+			"user04": types.MemberRoleMember,
+		}
+		if diff := cmp.Diff(expectedMembers, orgMembers(t, "org01")); diff != "" {
+			t.Fatalf("unexpected org members:\n%s", diff)
+		}
+	})
+
+	t.Run("test reassign ownership from a non owner user", func(t *testing.T) {
+		expectedErr := `user "user01" isn't an owner of org "org01"`
+		err := cs.ah.ReassignOrgOwnership(ctx, "org01", "user01", "user04")
+		if err == nil {
+			t.Fatalf("expected error %v, got nil err", expectedErr)
+		}
+		if !util.APIErrorIs(err, util.ErrBadRequest) {
+			t.Fatalf("expected bad request error, got: %v", err)
+		}
+		if err.Error() != expectedErr {
+			t.Fatalf("expected err %v, got err: %v", expectedErr, err)
+		}
+
+		// nothing changed
+		expectedMembers := map[string]types.MemberRole{
+			"user01": types.MemberRoleMember,
+			"user02": types.MemberRoleOwner,
+			"user03": types.MemberRoleOwner,
+			"user04": types.MemberRoleMember,
+		}
+		if diff := cmp.Diff(expectedMembers, orgMembers(t, "org01")); diff != "" {
+			t.Fatalf("unexpected org members:\n%s", diff)
+		}
 	})
 }
 
-func TestProjectGroupDeleteDontSeeOldChildObjects(t *testing.T) {
+func TestUpdateUserOrgRole(t *testing.T) {
 	dir := t.TempDir()
 	ctx := context.Background()
 	log := testutil.NewLogger(t)
@@ -895,121 +4246,181 @@ func TestProjectGroupDeleteDontSeeOldChildObjects(t *testing.T) {
 	cs := setupConfigstore(ctx, t, log, dir)
 
 	t.Logf("starting cs")
-	go func() {
-		_ = cs.Run(ctx)
-	}()
+	go func() { _ = cs.Run(ctx) }()
 
-	org, err := cs.ah.CreateOrg(ctx, &action.CreateOrgRequest{Name: "org01", Visibility: types.VisibilityPublic})
-	if err != nil {
-		t.Fatalf("unexpected err: %v", err)
+	users := map[string]*types.User{}
+	for _, userName := range []string{"user01", "user02", "user03"} {
+		user, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: userName})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		users[userName] = user
 	}
 
-	// create a projectgroup in org root project group
-	pg01, err := cs.ah.CreateProjectGroup(ctx, &action.CreateUpdateProjectGroupRequest{Name: "projectgroup01", Parent: types.Parent{Kind: types.ObjectKindProjectGroup, ID: path.Join("org", org.Name)}, Visibility: types.VisibilityPublic})
-	if err != nil {
-		t.Fatalf("unexpected err: %v", err)
+	userOrgRole := func(t *testing.T, userRef string) types.MemberRole {
+		userOrgs, err := cs.ah.GetUserOrgs(ctx, &action.GetUserOrgsRequest{UserRef: userRef})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if len(userOrgs) != 1 {
+			t.Fatalf("expected 1 user org, got %d", len(userOrgs))
+		}
+		return userOrgs[0].Role
 	}
 
-	// create a child projectgroup in org root project group
-	spg01, err := cs.ah.CreateProjectGroup(ctx, &action.CreateUpdateProjectGroupRequest{Name: "subprojectgroup01", Parent: types.Parent{Kind: types.ObjectKindProjectGroup, ID: pg01.ID}, Visibility: types.VisibilityPublic})
-	if err != nil {
+	// org01 owners: user01. members: user02
+	if _, err := cs.ah.CreateOrg(ctx, &action.CreateOrgRequest{Name: "org01", Visibility: types.VisibilityPublic, CreatorUserID: users["user01"].ID}); err != nil {
 		t.Fatalf("unexpected err: %v", err)
 	}
-
-	// create a project inside child projectgroup
-	project, err := cs.ah.CreateProject(ctx, &action.CreateUpdateProjectRequest{Name: "project01", Parent: types.Parent{Kind: types.ObjectKindProjectGroup, ID: spg01.ID}, Visibility: types.VisibilityPublic, RemoteRepositoryConfigType: types.RemoteRepositoryConfigTypeManual})
-	if err != nil {
+	if _, err := cs.ah.AddOrgMember(ctx, "org01", "user02", types.MemberRoleMember); err != nil {
 		t.Fatalf("unexpected err: %v", err)
 	}
 
-	// create project secret
-	if _, err := cs.ah.CreateSecret(ctx, &action.CreateUpdateSecretRequest{Name: "secret01", Parent: types.Parent{Kind: types.ObjectKindProject, ID: project.ID}, Type: types.SecretTypeInternal, Data: map[string]string{"secret01": "secretvar01"}}); err != nil {
-		t.Fatalf("unexpected err: %v", err)
-	}
-	// create project variable
-	if _, err = cs.ah.CreateVariable(ctx, &action.CreateUpdateVariableRequest{Name: "variable01", Parent: types.Parent{Kind: types.ObjectKindProject, ID: project.ID}, Values: []types.VariableValue{{SecretName: "secret01", SecretVar: "secretvar01"}}}); err != nil {
-		t.Fatalf("unexpected err: %v", err)
-	}
+	t.Run("test update role with invalid role", func(t *testing.T) {
+		expectedErr := util.NewAPIError(util.ErrBadRequest, errors.Errorf(`invalid role "admin"`))
+		err := cs.ah.UpdateUserOrgRole(ctx, "user02", "org01", "admin")
+		if err == nil {
+			t.Fatalf("expected err, got nil err")
+		}
+		if !util.APIErrorIs(err, util.ErrBadRequest) || err.Error() != expectedErr.Error() {
+			t.Fatalf("expected err %v, got err: %v", expectedErr, err)
+		}
+	})
 
-	// delete projectgroup
-	if err := cs.ah.DeleteProjectGroup(ctx, pg01.ID); err != nil {
-		t.Fatalf("unexpected err: %v", err)
-	}
+	t.Run("test demote the only org owner", func(t *testing.T) {
+		expectedErr := util.NewAPIError(util.ErrBadRequest, errors.Errorf(`user "user01" is the only owner of org "org01"`))
+		err := cs.ah.UpdateUserOrgRole(ctx, "user01", "org01", types.MemberRoleMember)
+		if err == nil {
+			t.Fatalf("expected err, got nil err")
+		}
+		if !util.APIErrorIs(err, util.ErrBadRequest) || err.Error() != expectedErr.Error() {
+			t.Fatalf("expected err %v, got err: %v", expectedErr, err)
+		}
+	})
 
-	// recreate the same hierarchj using the paths
-	pg01, err = cs.ah.CreateProjectGroup(ctx, &action.CreateUpdateProjectGroupRequest{Name: "projectgroup01", Parent: types.Parent{Kind: types.ObjectKindProjectGroup, ID: path.Join("org", org.Name)}, Visibility: types.VisibilityPublic})
-	if err != nil {
-		t.Fatalf("unexpected err: %v", err)
-	}
-	spg01, err = cs.ah.CreateProjectGroup(ctx, &action.CreateUpdateProjectGroupRequest{Name: "subprojectgroup01", Parent: types.Parent{Kind: types.ObjectKindProjectGroup, ID: path.Join("org", org.Name, pg01.Name)}, Visibility: types.VisibilityPublic})
-	if err != nil {
-		t.Fatalf("unexpected err: %v", err)
+	t.Run("test promote org member", func(t *testing.T) {
+		if err := cs.ah.UpdateUserOrgRole(ctx, "user02", "org01", types.MemberRoleOwner); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if role := userOrgRole(t, "user02"); role != types.MemberRoleOwner {
+			t.Fatalf("expected role %q, got %q", types.MemberRoleOwner, role)
+		}
+	})
+
+	t.Run("test demote an org owner", func(t *testing.T) {
+		if err := cs.ah.UpdateUserOrgRole(ctx, "user01", "org01", types.MemberRoleMember); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if role := userOrgRole(t, "user01"); role != types.MemberRoleMember {
+			t.Fatalf("expected role %q, got %q", types.MemberRoleMember, role)
+		}
+	})
+
+	t.Run("test update role of a user not member of the org", func(t *testing.T) {
+		expectedErr := util.NewAPIError(util.ErrNotExist, errors.Errorf(`user "user03" isn't a member of org "org01"`))
+		err := cs.ah.UpdateUserOrgRole(ctx, "user03", "org01", types.MemberRoleOwner)
+		if err == nil {
+			t.Fatalf("expected err, got nil err")
+		}
+		if !util.APIErrorIs(err, util.ErrNotExist) || err.Error() != expectedErr.Error() {
+			t.Fatalf("expected err %v, got err: %v", expectedErr, err)
+		}
+
+		// the user isn't added to the org
+		userOrgs, err := cs.ah.GetUserOrgs(ctx, &action.GetUserOrgsRequest{UserRef: "user03"})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if len(userOrgs) != 0 {
+			t.Fatalf("expected no user orgs, got %d", len(userOrgs))
+		}
+	})
+}
+
+func TestGetUserOrgsMinRole(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+	log := testutil.NewLogger(t)
+
+	cs := setupConfigstore(ctx, t, log, dir)
+
+	t.Logf("starting cs")
+	go func() { _ = cs.Run(ctx) }()
+
+	users := []*types.User{}
+	for _, userName := range []string{"user01", "user02"} {
+		user, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: userName})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		users = append(users, user)
 	}
-	project, err = cs.ah.CreateProject(ctx, &action.CreateUpdateProjectRequest{Name: "project01", Parent: types.Parent{Kind: types.ObjectKindProjectGroup, ID: path.Join("org", org.Name, pg01.Name, spg01.Name)}, Visibility: types.VisibilityPublic, RemoteRepositoryConfigType: types.RemoteRepositoryConfigTypeManual})
-	if err != nil {
+
+	// user01 is owner of org01 and member of org02
+	if _, err := cs.ah.CreateOrg(ctx, &action.CreateOrgRequest{Name: "org01", Visibility: types.VisibilityPublic, CreatorUserID: users[0].ID}); err != nil {
 		t.Fatalf("unexpected err: %v", err)
 	}
-	secret, err := cs.ah.CreateSecret(ctx, &action.CreateUpdateSecretRequest{Name: "secret01", Parent: types.Parent{Kind: types.ObjectKindProject, ID: path.Join("org", org.Name, pg01.Name, spg01.Name, project.Name)}, Type: types.SecretTypeInternal, Data: map[string]string{"secret01": "secretvar01"}})
-	if err != nil {
+	if _, err := cs.ah.CreateOrg(ctx, &action.CreateOrgRequest{Name: "org02", Visibility: types.VisibilityPublic, CreatorUserID: users[1].ID}); err != nil {
 		t.Fatalf("unexpected err: %v", err)
 	}
-	variable, err := cs.ah.CreateVariable(ctx, &action.CreateUpdateVariableRequest{Name: "variable01", Parent: types.Parent{Kind: types.ObjectKindProject, ID: path.Join("org", org.Name, pg01.Name, spg01.Name, project.Name)}, Values: []types.VariableValue{{SecretName: "secret01", SecretVar: "secretvar01"}}})
-	if err != nil {
+	if _, err := cs.ah.AddOrgMember(ctx, "org02", "user01", types.MemberRoleMember); err != nil {
 		t.Fatalf("unexpected err: %v", err)
 	}
 
-	// Get by projectgroup id
-	projects, err := cs.ah.GetProjectGroupProjects(ctx, spg01.ID)
-	if err != nil {
-		t.Fatalf("unexpected err: %v", err)
-	}
-	if diff := cmpDiffObject(projects, []*types.Project{project}); diff != "" {
-		t.Fatalf("mismatch (-want +got):\n%s", diff)
-	}
+	getUserOrgNames := func(t *testing.T, minRole types.MemberRole) []string {
+		t.Helper()
 
-	// Get by projectgroup path
-	projects, err = cs.ah.GetProjectGroupProjects(ctx, path.Join("org", org.Name, pg01.Name, spg01.Name))
-	if err != nil {
-		t.Fatalf("unexpected err: %v", err)
-	}
-	if diff := cmpDiffObject(projects, []*types.Project{project}); diff != "" {
-		t.Fatalf("mismatch (-want +got):\n%s", diff)
+		userOrgs, err := cs.ah.GetUserOrgs(ctx, &action.GetUserOrgsRequest{UserRef: "user01", MinRole: minRole})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		orgNames := []string{}
+		for _, userOrg := range userOrgs {
+			orgNames = append(orgNames, userOrg.Organization.Name)
+		}
+		return orgNames
 	}
 
-	secrets, err := cs.ah.GetSecrets(ctx, types.ObjectKindProject, project.ID, false)
-	if err != nil {
-		t.Fatalf("unexpected err: %v", err)
-	}
-	if diff := cmpDiffObject(secrets, []*types.Secret{secret}); diff != "" {
-		t.Fatalf("mismatch (-want +got):\n%s", diff)
-	}
+	t.Run("test get user orgs without min role", func(t *testing.T) {
+		if diff := cmp.Diff([]string{"org01", "org02"}, getUserOrgNames(t, "")); diff != "" {
+			t.Fatalf("user orgs mismatch (-want +got):\n%s", diff)
+		}
+	})
 
-	secrets, err = cs.ah.GetSecrets(ctx, types.ObjectKindProject, path.Join("org", org.Name, pg01.Name, spg01.Name, project.Name), false)
-	if err != nil {
-		t.Fatalf("unexpected err: %v", err)
-	}
-	if diff := cmpDiffObject(secrets, []*types.Secret{secret}); diff != "" {
-		t.Fatalf("mismatch (-want +got):\n%s", diff)
-	}
+	t.Run("test get user orgs with min role member", func(t *testing.T) {
+		if diff := cmp.Diff([]string{"org01", "org02"}, getUserOrgNames(t, types.MemberRoleMember)); diff != "" {
+			t.Fatalf("user orgs mismatch (-want +got):\n%s", diff)
+		}
+	})
 
-	variables, err := cs.ah.GetVariables(ctx, types.ObjectKindProject, project.ID, false)
-	if err != nil {
-		t.Fatalf("unexpected err: %v", err)
-	}
-	if diff := cmpDiffObject(variables, []*types.Variable{variable}); diff != "" {
-		t.Fatalf("mismatch (-want +got):\n%s", diff)
-	}
+	t.Run("test get user orgs with min role owner", func(t *testing.T) {
+		if diff := cmp.Diff([]string{"org01"}, getUserOrgNames(t, types.MemberRoleOwner)); diff != "" {
+			t.Fatalf("user orgs mismatch (-want +got):\n%s", diff)
+		}
+	})
 
-	variables, err = cs.ah.GetVariables(ctx, types.ObjectKindProject, path.Join("org", org.Name, pg01.Name, spg01.Name, project.Name), false)
-	if err != nil {
-		t.Fatalf("unexpected err: %v", err)
-	}
-	if diff := cmpDiffObject(variables, []*types.Variable{variable}); diff != "" {
-		t.Fatalf("mismatch (-want +got):\n%s", diff)
-	}
+	t.Run("test get user orgs with min role owner after role update", func(t *testing.T) {
+		if err := cs.ah.UpdateUserOrgRole(ctx, "user01", "org02", types.MemberRoleOwner); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if diff := cmp.Diff([]string{"org01", "org02"}, getUserOrgNames(t, types.MemberRoleOwner)); diff != "" {
+			t.Fatalf("user orgs mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("test get user orgs with invalid min role", func(t *testing.T) {
+		expectedErr := util.NewAPIError(util.ErrBadRequest, errors.Errorf("invalid role %q", "admin"))
+		_, err := cs.ah.GetUserOrgs(ctx, &action.GetUserOrgsRequest{UserRef: "user01", MinRole: "admin"})
+		if err == nil {
+			t.Fatalf("expected error %v, got nil err", expectedErr)
+		}
+		if !util.APIErrorIs(err, util.ErrBadRequest) || err.Error() != expectedErr.Error() {
+			t.Fatalf("expected err %v, got err: %v", expectedErr, err)
+		}
+	})
 }
 
-func TestOrgMembers(t *testing.T) {
+func TestGetOrgs(t *testing.T) {
 	dir := t.TempDir()
 	ctx := context.Background()
 	log := testutil.NewLogger(t)
@@ -1019,68 +4430,98 @@ func TestOrgMembers(t *testing.T) {
 	t.Logf("starting cs")
 	go func() { _ = cs.Run(ctx) }()
 
-	user, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: "user01"})
-	if err != nil {
-		t.Fatalf("unexpected err: %v", err)
+	users := []*types.User{}
+	for i := 0; i < 3; i++ {
+		user, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: fmt.Sprintf("user%d", i)})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		users = append(users, user)
 	}
-	org, err := cs.ah.CreateOrg(ctx, &action.CreateOrgRequest{Name: "org01", Visibility: types.VisibilityPublic, CreatorUserID: user.ID})
-	if err != nil {
-		t.Fatalf("unexpected err: %v", err)
+
+	orgs := []*types.Organization{}
+	for i := 0; i < 5; i++ {
+		org, err := cs.ah.CreateOrg(ctx, &action.CreateOrgRequest{Name: fmt.Sprintf("org%d", i), Visibility: types.VisibilityPublic, CreatorUserID: users[0].ID})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		orgs = append(orgs, org)
 	}
 
-	t.Run("test user org creator is org member with owner role", func(t *testing.T) {
-		expectedResponse := []*action.UserOrgsResponse{
-			{
-				Organization: org,
-				Role:         types.MemberRoleOwner,
-			},
+	// org i will have i+1 members (capped to the number of users)
+	for i := 1; i < 5; i++ {
+		for j := 1; j <= i && j < len(users); j++ {
+			if _, err := cs.ah.AddOrgMember(ctx, orgs[i].ID, users[j].ID, types.MemberRoleMember); err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
 		}
-		res, err := cs.ah.GetUserOrgs(ctx, user.ID)
+	}
+	expectedMembersCount := []int{1, 2, 3, 3, 3}
+
+	t.Run("test get orgs paginated ascending", func(t *testing.T) {
+		res, err := cs.ah.GetOrgs(ctx, "", 2, true, false)
 		if err != nil {
 			t.Fatalf("unexpected err: %v", err)
 		}
+		expectedResponse := []*action.OrgResponse{
+			{Organization: orgs[0]},
+			{Organization: orgs[1]},
+		}
 		if diff := cmpDiffObject(res, expectedResponse); diff != "" {
 			t.Fatalf("mismatch (-want +got):\n%s", diff)
 		}
-	})
 
-	orgs := []*types.Organization{}
-	for i := 0; i < 10; i++ {
-		org, err := cs.ah.CreateOrg(ctx, &action.CreateOrgRequest{Name: fmt.Sprintf("org%d", i), Visibility: types.VisibilityPublic, CreatorUserID: user.ID})
+		res, err = cs.ah.GetOrgs(ctx, orgs[1].Name, 2, true, false)
 		if err != nil {
 			t.Fatalf("unexpected err: %v", err)
 		}
-		orgs = append(orgs, org)
-	}
+		expectedResponse = []*action.OrgResponse{
+			{Organization: orgs[2]},
+			{Organization: orgs[3]},
+		}
+		if diff := cmpDiffObject(res, expectedResponse); diff != "" {
+			t.Fatalf("mismatch (-want +got):\n%s", diff)
+		}
+	})
 
-	for i := 0; i < 5; i++ {
-		if err := cs.ah.DeleteOrg(ctx, fmt.Sprintf("org%d", i)); err != nil {
+	t.Run("test get orgs paginated descending", func(t *testing.T) {
+		res, err := cs.ah.GetOrgs(ctx, orgs[2].Name, 0, false, false)
+		if err != nil {
 			t.Fatalf("unexpected err: %v", err)
 		}
-	}
-
-	// delete some org and check that if also orgmembers aren't yet cleaned only the existing orgs are reported
-	t.Run("test only existing orgs are reported", func(t *testing.T) {
-		expectedResponse := []*action.UserOrgsResponse{
-			{
-				Organization: org,
-				Role:         types.MemberRoleOwner,
-			},
+		expectedResponse := []*action.OrgResponse{
+			{Organization: orgs[1]},
+			{Organization: orgs[0]},
 		}
-		for i := 5; i < 10; i++ {
-			expectedResponse = append(expectedResponse, &action.UserOrgsResponse{
-				Organization: orgs[i],
-				Role:         types.MemberRoleOwner,
-			})
+		if diff := cmpDiffObject(res, expectedResponse); diff != "" {
+			t.Fatalf("mismatch (-want +got):\n%s", diff)
 		}
-		res, err := cs.ah.GetUserOrgs(ctx, user.ID)
+	})
+
+	t.Run("test get orgs with members count", func(t *testing.T) {
+		res, err := cs.ah.GetOrgs(ctx, "", 0, true, true)
 		if err != nil {
 			t.Fatalf("unexpected err: %v", err)
 		}
+		expectedResponse := []*action.OrgResponse{}
+		for i, org := range orgs {
+			expectedResponse = append(expectedResponse, &action.OrgResponse{Organization: org, MembersCount: expectedMembersCount[i]})
+		}
 		if diff := cmpDiffObject(res, expectedResponse); diff != "" {
 			t.Fatalf("mismatch (-want +got):\n%s", diff)
 		}
 	})
+
+	t.Run("test get orgs with negative limit", func(t *testing.T) {
+		expectedErr := "limit must be greater or equal than 0"
+		_, err := cs.ah.GetOrgs(ctx, "", -1, true, false)
+		if err == nil {
+			t.Fatalf("expected error %v, got nil err", expectedErr)
+		}
+		if err.Error() != expectedErr {
+			t.Fatalf("expected err %v, got err: %v", expectedErr, err)
+		}
+	})
 }
 
 func TestRemoteSource(t *testing.T) {
@@ -1206,6 +4647,36 @@ func TestRemoteSource(t *testing.T) {
 				}
 			},
 		},
+		{
+			name: "test validate remote sources",
+			f: func(ctx context.Context, t *testing.T, cs *Configstore) {
+				for _, name := range []string{"rs01", "rs02"} {
+					rsreq := &action.CreateUpdateRemoteSourceRequest{
+						Name:               name,
+						APIURL:             "https://api.example.com",
+						Type:               types.RemoteSourceTypeGitea,
+						AuthType:           types.RemoteSourceAuthTypeOauth2,
+						Oauth2ClientID:     "clientid",
+						Oauth2ClientSecret: "clientsecret",
+					}
+					if _, err := cs.ah.CreateRemoteSource(ctx, rsreq); err != nil {
+						t.Fatalf("unexpected err: %v", err)
+					}
+				}
+
+				res, err := cs.ah.ValidateRemoteSources(ctx, []string{"rs03", "rs02", "rs01", "rs04", "rs02"})
+				if err != nil {
+					t.Fatalf("unexpected err: %v", err)
+				}
+				expectedResponse := &action.ValidateRemoteSourcesResponse{
+					Existing: []string{"rs02", "rs01"},
+					Missing:  []string{"rs03", "rs04"},
+				}
+				if diff := cmp.Diff(expectedResponse, res); diff != "" {
+					t.Fatalf("mismatch (-want +got):\n%s", diff)
+				}
+			},
+		},
 	}
 
 	for _, tt := range tests {
@@ -1450,7 +4921,7 @@ func TestOrgInvitation(t *testing.T) {
 					t.Fatalf("unexpected err: %v", err)
 				}
 
-				err = cs.ah.DeleteUser(ctx, userInvitation.ID)
+				err = cs.ah.DeleteUser(ctx, &action.DeleteUserRequest{UserRef: userInvitation.ID})
 				if err != nil {
 					t.Fatalf("unexpected err: %v", err)
 				}
@@ -1525,3 +4996,251 @@ func TestOrgInvitation(t *testing.T) {
 		})
 	}
 }
+
+func TestCreateUserAndAcceptInvitation(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+	log := testutil.NewLogger(t)
+
+	cs := setupConfigstore(ctx, t, log, dir)
+
+	t.Logf("starting cs")
+	go func() { _ = cs.Run(ctx) }()
+
+	org, err := cs.ah.CreateOrg(ctx, &action.CreateOrgRequest{Name: "org01", Visibility: types.VisibilityPublic})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	t.Run("test create user and accept invitation", func(t *testing.T) {
+		expirationTime := time.Now().Add(1 * time.Hour)
+		orgInvitation, err := cs.ah.CreateOrgSignupInvitation(ctx, &action.CreateOrgSignupInvitationRequest{OrganizationRef: org.Name, Role: types.MemberRoleMember, ExpirationTime: &expirationTime})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+
+		user, err := cs.ah.CreateUserAndAcceptInvitation(ctx, &action.CreateUserAndAcceptInvitationRequest{
+			CreateUserRequest: &action.CreateUserRequest{UserName: "user01"},
+			InvitationToken:   orgInvitation.Token,
+		})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+
+		expectedResponse := []*action.UserOrgsResponse{
+			{
+				Organization: org,
+				Role:         types.MemberRoleMember,
+			},
+		}
+		res, err := cs.ah.GetUserOrgs(ctx, &action.GetUserOrgsRequest{UserRef: user.ID})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if diff := cmpDiffObject(res, expectedResponse); diff != "" {
+			t.Fatalf("mismatch (-want +got):\n%s", diff)
+		}
+
+		// the invitation must be consumed
+		orgInvitations, err := cs.ah.GetOrgInvitations(ctx, org.Name)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if len(orgInvitations) != 0 {
+			t.Fatalf("expected 0 org invitations, got %d", len(orgInvitations))
+		}
+
+		expectedErr := "invalid invitation token"
+		_, err = cs.ah.CreateUserAndAcceptInvitation(ctx, &action.CreateUserAndAcceptInvitationRequest{
+			CreateUserRequest: &action.CreateUserRequest{UserName: "user02"},
+			InvitationToken:   orgInvitation.Token,
+		})
+		if err == nil {
+			t.Fatalf("expected error %v, got nil err", expectedErr)
+		}
+		if err.Error() != expectedErr {
+			t.Fatalf("expected err %v, got err: %v", expectedErr, err)
+		}
+	})
+
+	t.Run("test create user with expired invitation", func(t *testing.T) {
+		expirationTime := time.Now().Add(-1 * time.Hour)
+		orgInvitation, err := cs.ah.CreateOrgSignupInvitation(ctx, &action.CreateOrgSignupInvitationRequest{OrganizationRef: org.Name, Role: types.MemberRoleMember, ExpirationTime: &expirationTime})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+
+		prevUsers, err := getUsers(ctx, cs)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+
+		expectedErr := "invitation expired"
+		_, err = cs.ah.CreateUserAndAcceptInvitation(ctx, &action.CreateUserAndAcceptInvitationRequest{
+			CreateUserRequest: &action.CreateUserRequest{UserName: "user03"},
+			InvitationToken:   orgInvitation.Token,
+		})
+		if err == nil {
+			t.Fatalf("expected error %v, got nil err", expectedErr)
+		}
+		if err.Error() != expectedErr {
+			t.Fatalf("expected err %v, got err: %v", expectedErr, err)
+		}
+
+		// the user must not be created
+		users, err := getUsers(ctx, cs)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if len(users) != len(prevUsers) {
+			t.Fatalf("expected %d users, got %d", len(prevUsers), len(users))
+		}
+	})
+}
+
+func TestOrgInviteLink(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+	log := testutil.NewLogger(t)
+
+	cs := setupConfigstore(ctx, t, log, dir)
+
+	t.Logf("starting cs")
+	go func() { _ = cs.Run(ctx) }()
+
+	org, err := cs.ah.CreateOrg(ctx, &action.CreateOrgRequest{Name: "org01", Visibility: types.VisibilityPublic})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	user01, err := cs.ah.CreateUser(ctx, &action.CreateUserRequest{UserName: "user01"})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	t.Run("test create invite link with invalid max uses", func(t *testing.T) {
+		expectedErr := "max uses must be greater than 0"
+		_, err := cs.ah.CreateOrgInviteLink(ctx, &action.CreateOrgInviteLinkRequest{OrganizationRef: org.Name, Role: types.MemberRoleMember})
+		if err == nil {
+			t.Fatalf("expected error %v, got nil err", expectedErr)
+		}
+		if err.Error() != expectedErr {
+			t.Fatalf("expected err %v, got err: %v", expectedErr, err)
+		}
+	})
+
+	t.Run("test redeem invite link", func(t *testing.T) {
+		orgInviteLink, err := cs.ah.CreateOrgInviteLink(ctx, &action.CreateOrgInviteLinkRequest{OrganizationRef: org.Name, Role: types.MemberRoleMember, MaxUses: 2})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if orgInviteLink.Token == "" {
+			t.Fatalf("expected invite link token")
+		}
+		if orgInviteLink.RemainingUses != 2 {
+			t.Fatalf("expected 2 remaining uses, got %d", orgInviteLink.RemainingUses)
+		}
+
+		if err := cs.ah.AcceptOrgInviteLink(ctx, &action.AcceptOrgInviteLinkRequest{UserRef: user01.Name, Token: orgInviteLink.Token}); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+
+		orgInviteLinks, err := cs.ah.GetOrgInviteLinks(ctx, org.Name)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if len(orgInviteLinks) != 1 {
+			t.Fatalf("expected 1 org invite link, got %d", len(orgInviteLinks))
+		}
+		if orgInviteLinks[0].RemainingUses != 1 {
+			t.Fatalf("expected 1 remaining use, got %d", orgInviteLinks[0].RemainingUses)
+		}
+
+		expectedErr := fmt.Sprintf("user %q is already an org member", user01.Name)
+		err = cs.ah.AcceptOrgInviteLink(ctx, &action.AcceptOrgInviteLinkRequest{UserRef: user01.Name, Token: orgInviteLink.Token})
+		if err == nil {
+			t.Fatalf("expected error %v, got nil err", expectedErr)
+		}
+		if err.Error() != expectedErr {
+			t.Fatalf("expected err %v, got err: %v", expectedErr, err)
+		}
+
+		user02, err := cs.ah.CreateUserAndAcceptInvitation(ctx, &action.CreateUserAndAcceptInvitationRequest{
+			CreateUserRequest: &action.CreateUserRequest{UserName: "user02"},
+			InvitationToken:   orgInviteLink.Token,
+		})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+
+		for _, user := range []*types.User{user01, user02} {
+			expectedResponse := []*action.UserOrgsResponse{
+				{
+					Organization: org,
+					Role:         types.MemberRoleMember,
+				},
+			}
+			res, err := cs.ah.GetUserOrgs(ctx, &action.GetUserOrgsRequest{UserRef: user.ID})
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			if diff := cmpDiffObject(res, expectedResponse); diff != "" {
+				t.Fatalf("mismatch (-want +got):\n%s", diff)
+			}
+		}
+
+		// the exhausted invite link must be removed
+		orgInviteLinks, err = cs.ah.GetOrgInviteLinks(ctx, org.Name)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if len(orgInviteLinks) != 0 {
+			t.Fatalf("expected 0 org invite links, got %d", len(orgInviteLinks))
+		}
+
+		expectedErr = "invalid invitation token"
+		_, err = cs.ah.CreateUserAndAcceptInvitation(ctx, &action.CreateUserAndAcceptInvitationRequest{
+			CreateUserRequest: &action.CreateUserRequest{UserName: "user03"},
+			InvitationToken:   orgInviteLink.Token,
+		})
+		if err == nil {
+			t.Fatalf("expected error %v, got nil err", expectedErr)
+		}
+		if err.Error() != expectedErr {
+			t.Fatalf("expected err %v, got err: %v", expectedErr, err)
+		}
+	})
+
+	t.Run("test redeem expired invite link", func(t *testing.T) {
+		expirationTime := time.Now().Add(-1 * time.Hour)
+		orgInviteLink, err := cs.ah.CreateOrgInviteLink(ctx, &action.CreateOrgInviteLinkRequest{OrganizationRef: org.Name, Role: types.MemberRoleMember, MaxUses: 1, ExpirationTime: &expirationTime})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+
+		prevUsers, err := getUsers(ctx, cs)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+
+		expectedErr := "invitation expired"
+		_, err = cs.ah.CreateUserAndAcceptInvitation(ctx, &action.CreateUserAndAcceptInvitationRequest{
+			CreateUserRequest: &action.CreateUserRequest{UserName: "user04"},
+			InvitationToken:   orgInviteLink.Token,
+		})
+		if err == nil {
+			t.Fatalf("expected error %v, got nil err", expectedErr)
+		}
+		if err.Error() != expectedErr {
+			t.Fatalf("expected err %v, got err: %v", expectedErr, err)
+		}
+
+		// the user must not be created
+		users, err := getUsers(ctx, cs)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if len(users) != len(prevUsers) {
+			t.Fatalf("expected %d users, got %d", len(prevUsers), len(users))
+		}
+	})
+}
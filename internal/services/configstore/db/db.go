@@ -6,6 +6,7 @@ import (
 	"encoding/json"
 	"path"
 	"strings"
+	"time"
 
 	idb "agola.io/agola/internal/db"
 	"agola.io/agola/internal/errors"
@@ -22,8 +23,8 @@ import (
 //go:generate ../../../../tools/bin/generators -component configstore
 
 const (
-	dataTablesVersion  = 1
-	queryTablesVersion = 1
+	dataTablesVersion  = 2
+	queryTablesVersion = 10
 )
 
 var dstmts = []string{
@@ -39,21 +40,25 @@ var dstmts = []string{
 	"create table if not exists secret (id varchar, revision bigint, data bytea, PRIMARY KEY (id))",
 	"create table if not exists variable (id varchar, revision bigint, data bytea, PRIMARY KEY (id))",
 	"create table if not exists orginvitation (id varchar, revision bigint, data bytea, PRIMARY KEY (id))",
+	"create table if not exists orginvitelink (id varchar, revision bigint, data bytea, PRIMARY KEY (id))",
 }
 
 var qstmts = []string{
 	// query tables for single object types. Can be rebuilt by data tables.
 	"create table if not exists remotesource_q (id varchar, revision bigint, name varchar, data bytea, PRIMARY KEY (id))",
-	"create table if not exists user_t_q (id varchar, revision bigint, name varchar, data bytea, PRIMARY KEY (id))",
-	"create table if not exists usertoken_q (id varchar, revision bigint, user_id varchar, name varchar, value varchar, data bytea, PRIMARY KEY (id))",
+	"create table if not exists user_t_q (id varchar, revision bigint, name varchar, email varchar, deleted boolean, creation_time bigint, data bytea, PRIMARY KEY (id))",
+	"create index if not exists user_t_q_lower_name_idx on user_t_q (lower(name))",
+	"create index if not exists user_t_q_creation_time_idx on user_t_q (creation_time, id)",
+	"create table if not exists usertoken_q (id varchar, revision bigint, user_id varchar, name varchar, value_hash varchar, expiration_time bigint, data bytea, PRIMARY KEY (id))",
 	"create table if not exists linkedaccount_q (id varchar, revision bigint, remotesource_id varchar, user_id varchar, remoteuser_id varchar, data bytea, PRIMARY KEY (id))",
 	"create table if not exists org_q (id varchar, revision bigint, name varchar, data bytea, PRIMARY KEY (id))",
-	"create table if not exists orgmember_q (id varchar, revision bigint, org_id varchar, user_id varchar, data bytea, PRIMARY KEY (id))",
+	"create table if not exists orgmember_q (id varchar, revision bigint, org_id varchar, user_id varchar, member_role varchar, data bytea, PRIMARY KEY (id))",
 	"create table if not exists projectgroup_q (id varchar, revision bigint, name varchar, parent_id varchar, parent_kind varchar, data bytea, PRIMARY KEY (id))",
 	"create table if not exists project_q (id varchar, revision bigint, name varchar, parent_id varchar, parent_kind varchar, data bytea, PRIMARY KEY (id))",
 	"create table if not exists secret_q (id varchar, revision bigint, name varchar, parent_id varchar, parent_kind varchar, data bytea, PRIMARY KEY (id))",
 	"create table if not exists variable_q (id varchar, revision bigint, name varchar, parent_id varchar, parent_kind varchar, data bytea, PRIMARY KEY (id))",
-	"create table if not exists orginvitation_q (id varchar, revision bigint, user_id varchar, org_id varchar, data bytea, PRIMARY KEY (id))",
+	"create table if not exists orginvitation_q (id varchar, revision bigint, user_id varchar, org_id varchar, token varchar, data bytea, PRIMARY KEY (id))",
+	"create table if not exists orginvitelink_q (id varchar, revision bigint, org_id varchar, token varchar, data bytea, PRIMARY KEY (id))",
 }
 
 // denormalized tables for querying, can be rebuilt by query tables.
@@ -153,6 +158,8 @@ func (d *DB) UnmarshalObject(data []byte) (stypes.Object, error) {
 		obj = &types.Variable{}
 	case types.OrgInvitationKind:
 		obj = &types.OrgInvitation{}
+	case types.OrgInviteLinkKind:
+		obj = &types.OrgInviteLink{}
 	default:
 		panic(errors.Errorf("unknown object kind %q", om.Kind))
 	}
@@ -187,6 +194,8 @@ func (d *DB) InsertRawObject(tx *sql.Tx, obj stypes.Object) ([]byte, error) {
 		return d.insertRawVariableData(tx, obj.(*types.Variable))
 	case types.OrgInvitationKind:
 		return d.insertRawOrgInvitationData(tx, obj.(*types.OrgInvitation))
+	case types.OrgInviteLinkKind:
+		return d.insertRawOrgInviteLinkData(tx, obj.(*types.OrgInviteLink))
 	default:
 		panic(errors.Errorf("unknown object kind %q", obj.GetKind()))
 	}
@@ -290,6 +299,28 @@ func (d *DB) GetRemoteSourceByName(tx *sql.Tx, name string) (*types.RemoteSource
 	return remoteSources[0], nil
 }
 
+func (d *DB) GetRemoteSourcesByIDs(tx *sql.Tx, remoteSourceIDs []string) ([]*types.RemoteSource, error) {
+	if len(remoteSourceIDs) == 0 {
+		return []*types.RemoteSource{}, nil
+	}
+
+	q := remoteSourceQSelect.Where(sq.Eq{"id": remoteSourceIDs})
+	remoteSources, _, err := d.fetchRemoteSources(tx, q)
+
+	return remoteSources, errors.WithStack(err)
+}
+
+func (d *DB) GetRemoteSourcesByNames(tx *sql.Tx, names []string) ([]*types.RemoteSource, error) {
+	if len(names) == 0 {
+		return []*types.RemoteSource{}, nil
+	}
+
+	q := remoteSourceQSelect.Where(sq.Eq{"name": names})
+	remoteSources, _, err := d.fetchRemoteSources(tx, q)
+
+	return remoteSources, errors.WithStack(err)
+}
+
 func getRemoteSourcesFilteredQuery(startRemoteSourceName string, limit int, asc bool) sq.SelectBuilder {
 	q := remoteSourceQSelect
 	if asc {
@@ -364,6 +395,33 @@ func (d *DB) GetUserByName(tx *sql.Tx, name string) (*types.User, error) {
 	return users[0], nil
 }
 
+// GetUsersByNameCaseInsensitive returns the users with the provided name,
+// compared case insensitively. Multiple users are returned only when they were
+// created before case insensitive user names uniqueness was enforced.
+func (d *DB) GetUsersByNameCaseInsensitive(tx *sql.Tx, name string) ([]*types.User, error) {
+	q := userQSelect.Where("lower(user_t_q.name) = ?", strings.ToLower(name))
+	users, _, err := d.fetchUsers(tx, q)
+
+	return users, errors.WithStack(err)
+}
+
+// GetUserByEmail returns the user with the provided email, compared case
+// insensitively.
+func (d *DB) GetUserByEmail(tx *sql.Tx, email string) (*types.User, error) {
+	q := userQSelect.Where("lower(email) = ?", strings.ToLower(email))
+	users, _, err := d.fetchUsers(tx, q)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if len(users) > 1 {
+		return nil, errors.Errorf("too many rows returned")
+	}
+	if len(users) == 0 {
+		return nil, nil
+	}
+	return users[0], nil
+}
+
 func (d *DB) GetUserTokens(tx *sql.Tx, userID string) ([]*types.UserToken, error) {
 	q := userTokenQSelect.Join("user_t_q on usertoken_q.user_id = user_t_q.id").Where(sq.Eq{"user_t_q.id": userID})
 	tokens, _, err := d.fetchUserTokens(tx, q)
@@ -386,10 +444,59 @@ func (d *DB) GetUserToken(tx *sql.Tx, userID, tokenName string) (*types.UserToke
 	return userTokens[0], nil
 }
 
-func (d *DB) GetUserByTokenValue(tx *sql.Tx, tokenValue string) (*types.User, error) {
+func (d *DB) GetUserTokenByValueHash(tx *sql.Tx, tokenValueHash string) (*types.UserToken, error) {
+	q := userTokenQSelect.Where(sq.Eq{"usertoken_q.value_hash": tokenValueHash})
+	userTokens, _, err := d.fetchUserTokens(tx, q)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if len(userTokens) > 1 {
+		return nil, errors.Errorf("too many rows returned")
+	}
+	if len(userTokens) == 0 {
+		return nil, nil
+	}
+	return userTokens[0], nil
+}
+
+// GetActiveUserTokensCount returns the number of user tokens not expired at
+// the provided time.
+func (d *DB) GetActiveUserTokensCount(tx *sql.Tx, userID string, now time.Time) (int, error) {
+	q := sb.Select("count(*)").From("usertoken_q").Where(sq.Eq{"usertoken_q.user_id": userID})
+	q = q.Where(sq.Or{sq.Eq{"usertoken_q.expiration_time": 0}, sq.Gt{"usertoken_q.expiration_time": now.UnixNano()}})
+
+	rows, err := d.query(tx, q)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	defer rows.Close()
+
+	var count int
+	for rows.Next() {
+		if err := rows.Scan(&count); err != nil {
+			return 0, errors.Wrapf(err, "failed to scan rows")
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return 0, errors.WithStack(err)
+	}
+
+	return count, nil
+}
+
+// GetLegacyUserTokens returns the tokens still storing a plaintext value
+// instead of its hash.
+func (d *DB) GetLegacyUserTokens(tx *sql.Tx) ([]*types.UserToken, error) {
+	q := userTokenQSelect.Where(sq.Eq{"usertoken_q.value_hash": ""})
+	tokens, _, err := d.fetchUserTokens(tx, q)
+
+	return tokens, errors.WithStack(err)
+}
+
+func (d *DB) GetUserByTokenValueHash(tx *sql.Tx, tokenValueHash string) (*types.User, error) {
 	q := userQSelect
 	q = q.Join("usertoken_q on usertoken_q.user_id = user_t_q.id")
-	q = q.Where(sq.Eq{"usertoken_q.value": tokenValue})
+	q = q.Where(sq.Eq{"usertoken_q.value_hash": tokenValueHash})
 
 	users, _, err := d.fetchUsers(tx, q)
 	if err != nil {
@@ -480,6 +587,52 @@ func (d *DB) GetLinkedAccountByRemoteUserIDandSource(tx *sql.Tx, remoteUserID, r
 	return linkedAccounts[0], nil
 }
 
+// GetOrphanedLinkedAccounts returns the linked accounts whose remote source
+// doesn't exist. The linked accounts are ordered by id and start after the
+// provided linked account id.
+func (d *DB) GetOrphanedLinkedAccounts(tx *sql.Tx, startLinkedAccountID string, limit int) ([]*types.LinkedAccount, error) {
+	q := linkedAccountQSelect.LeftJoin("remotesource_q on remotesource_q.id = linkedaccount_q.remotesource_id")
+	q = q.Where(sq.Eq{"remotesource_q.id": nil})
+	if startLinkedAccountID != "" {
+		q = q.Where(sq.Gt{"linkedaccount_q.id": startLinkedAccountID})
+	}
+	q = q.OrderBy("linkedaccount_q.id asc")
+	if limit > 0 {
+		q = q.Limit(uint64(limit))
+	}
+	linkedAccounts, _, err := d.fetchLinkedAccounts(tx, q)
+
+	return linkedAccounts, errors.WithStack(err)
+}
+
+// GetAllLinkedAccounts returns the linked accounts of all the users sorted by
+// id. When remoteSourceID isn't empty only the linked accounts on this remote
+// source are returned.
+func (d *DB) GetAllLinkedAccounts(tx *sql.Tx, remoteSourceID, startLinkedAccountID string, limit int, asc bool) ([]*types.LinkedAccount, error) {
+	q := linkedAccountQSelect
+	if remoteSourceID != "" {
+		q = q.Where(sq.Eq{"linkedaccount_q.remotesource_id": remoteSourceID})
+	}
+	if startLinkedAccountID != "" {
+		if asc {
+			q = q.Where(sq.Gt{"linkedaccount_q.id": startLinkedAccountID})
+		} else {
+			q = q.Where(sq.Lt{"linkedaccount_q.id": startLinkedAccountID})
+		}
+	}
+	if asc {
+		q = q.OrderBy("linkedaccount_q.id asc")
+	} else {
+		q = q.OrderBy("linkedaccount_q.id desc")
+	}
+	if limit > 0 {
+		q = q.Limit(uint64(limit))
+	}
+	linkedAccounts, _, err := d.fetchLinkedAccounts(tx, q)
+
+	return linkedAccounts, errors.WithStack(err)
+}
+
 // func (d *DB) GetUserByLinkedAccountRemoteUserIDandSource(tx *sql.Tx, remoteUserID, remoteSourceID string) (*types.User, error) {
 // 	q := userQSelect
 // 	q = q.Join("linkedaccount_q on linkedaccount_q.user_id = user_t_q.id")
@@ -497,8 +650,26 @@ func (d *DB) GetLinkedAccountByRemoteUserIDandSource(tx *sql.Tx, remoteUserID, r
 // 	return users[0], nil
 // }
 
-func getUsersFilteredQuery(startUserName string, limit int, asc bool) sq.SelectBuilder {
+// userNameLikeEscaper escapes the like pattern special characters
+var userNameLikeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// userNameLikePattern returns the like pattern matching, case insensitively,
+// the user names for the provided search query. A query starting with a "*"
+// wildcard matches the user names containing the rest of the query, otherwise
+// the user names starting with the query are matched. The prefix pattern has
+// no leading wildcard so the database can use an index on the lowercased name.
+func userNameLikePattern(query string) string {
+	if strings.HasPrefix(query, "*") {
+		return "%" + userNameLikeEscaper.Replace(strings.ToLower(strings.TrimLeft(query, "*"))) + "%"
+	}
+	return userNameLikeEscaper.Replace(strings.ToLower(query)) + "%"
+}
+
+func getUsersFilteredQuery(query, startUserName string, limit int, asc, includeDeleted bool) sq.SelectBuilder {
 	q := userQSelect
+	if !includeDeleted {
+		q = q.Where(sq.Eq{"user_t_q.deleted": false})
+	}
 	if asc {
 		q = q.OrderBy("user_t_q.name asc")
 	} else {
@@ -511,6 +682,9 @@ func getUsersFilteredQuery(startUserName string, limit int, asc bool) sq.SelectB
 			q = q.Where(sq.Lt{"user_t_q.name": startUserName})
 		}
 	}
+	if query != "" {
+		q = q.Where(`lower(user_t_q.name) like ? escape '\'`, userNameLikePattern(query))
+	}
 	if limit > 0 {
 		q = q.Limit(uint64(limit))
 	}
@@ -518,8 +692,110 @@ func getUsersFilteredQuery(startUserName string, limit int, asc bool) sq.SelectB
 	return q
 }
 
-func (d *DB) GetUsers(tx *sql.Tx, startUserName string, limit int, asc bool) ([]*types.User, error) {
-	q := getUsersFilteredQuery(startUserName, limit, asc)
+// GetUsers returns the users sorted by name. When query isn't empty only the
+// users whose name matches it are returned (see userNameLikePattern). Soft
+// deleted users are returned only when includeDeleted is true.
+func (d *DB) GetUsers(tx *sql.Tx, query, startUserName string, limit int, asc, includeDeleted bool) ([]*types.User, error) {
+	q := getUsersFilteredQuery(query, startUserName, limit, asc, includeDeleted)
+	users, _, err := d.fetchUsers(tx, q)
+
+	return users, errors.WithStack(err)
+}
+
+// GetRemoteSourceUsers returns the users with a linked account on the provided
+// remote source, filtered and sorted like GetUsers.
+func (d *DB) GetRemoteSourceUsers(tx *sql.Tx, remoteSourceID, query, startUserName string, limit int, asc, includeDeleted bool) ([]*types.User, error) {
+	q := getUsersFilteredQuery(query, startUserName, limit, asc, includeDeleted)
+	q = q.Where("user_t_q.id in (select linkedaccount_q.user_id from linkedaccount_q where linkedaccount_q.remotesource_id = ?)", remoteSourceID)
+	users, _, err := d.fetchUsers(tx, q)
+
+	return users, errors.WithStack(err)
+}
+
+// GetUsersByCreationTime returns the users sorted by creation time and id,
+// filtered like GetUsers. When remoteSourceID isn't empty only the users with
+// a linked account on the remote source are returned. When startID isn't empty
+// the users after the (startCreationTime, startID) cursor, in the requested
+// order, are returned. startCreationTime is the creation time in unix
+// nanoseconds.
+func (d *DB) GetUsersByCreationTime(tx *sql.Tx, remoteSourceID, query string, startCreationTime int64, startID string, limit int, asc, includeDeleted bool) ([]*types.User, error) {
+	q := userQSelect
+	if !includeDeleted {
+		q = q.Where(sq.Eq{"user_t_q.deleted": false})
+	}
+	if asc {
+		q = q.OrderBy("user_t_q.creation_time asc", "user_t_q.id asc")
+	} else {
+		q = q.OrderBy("user_t_q.creation_time desc", "user_t_q.id desc")
+	}
+	if startID != "" {
+		if asc {
+			q = q.Where(sq.Or{sq.Gt{"user_t_q.creation_time": startCreationTime}, sq.And{sq.Eq{"user_t_q.creation_time": startCreationTime}, sq.Gt{"user_t_q.id": startID}}})
+		} else {
+			q = q.Where(sq.Or{sq.Lt{"user_t_q.creation_time": startCreationTime}, sq.And{sq.Eq{"user_t_q.creation_time": startCreationTime}, sq.Lt{"user_t_q.id": startID}}})
+		}
+	}
+	if query != "" {
+		q = q.Where(`lower(user_t_q.name) like ? escape '\'`, userNameLikePattern(query))
+	}
+	if remoteSourceID != "" {
+		q = q.Where("user_t_q.id in (select linkedaccount_q.user_id from linkedaccount_q where linkedaccount_q.remotesource_id = ?)", remoteSourceID)
+	}
+	if limit > 0 {
+		q = q.Limit(uint64(limit))
+	}
+
+	users, _, err := d.fetchUsers(tx, q)
+
+	return users, errors.WithStack(err)
+}
+
+// GetUsersCount returns, using a single aggregate query, the number of users
+// matching the filters of GetUsers and GetRemoteSourceUsers. Empty filters
+// aren't applied.
+func (d *DB) GetUsersCount(tx *sql.Tx, remoteSourceID, query string, includeDeleted bool) (int, error) {
+	q := sb.Select("count(*)").From("user_t_q")
+	if !includeDeleted {
+		q = q.Where(sq.Eq{"user_t_q.deleted": false})
+	}
+	if query != "" {
+		q = q.Where(`lower(user_t_q.name) like ? escape '\'`, userNameLikePattern(query))
+	}
+	if remoteSourceID != "" {
+		q = q.Where("user_t_q.id in (select linkedaccount_q.user_id from linkedaccount_q where linkedaccount_q.remotesource_id = ?)", remoteSourceID)
+	}
+
+	rows, err := d.query(tx, q)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	defer rows.Close()
+
+	var count int
+	for rows.Next() {
+		if err := rows.Scan(&count); err != nil {
+			return 0, errors.Wrapf(err, "failed to scan rows")
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return 0, errors.WithStack(err)
+	}
+
+	return count, nil
+}
+
+// GetCaseInsensitiveNameConflictingUsers returns, using a single query, the
+// users whose name conflicts with the name of another user when compared case
+// insensitively. The users are ordered by lowercased name and then by name.
+func (d *DB) GetCaseInsensitiveNameConflictingUsers(tx *sql.Tx) ([]*types.User, error) {
+	conflictsq := sb.Select("lower(name)").From("user_t_q").GroupBy("lower(name)").Having("count(*) > 1")
+	conflictsSQL, conflictsArgs, err := conflictsq.ToSql()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to build query")
+	}
+
+	q := userQSelect.Where("lower(user_t_q.name) in ("+conflictsSQL+")", conflictsArgs...)
+	q = q.OrderBy("lower(user_t_q.name)", "user_t_q.name")
 	users, _, err := d.fetchUsers(tx, q)
 
 	return users, errors.WithStack(err)
@@ -673,17 +949,55 @@ func (d *DB) GetOrgUsers(tx *sql.Tx, orgID string) ([]*OrgUser, error) {
 	return orgusers, nil
 }
 
+// GetOrgsMembersCount returns the number of members of every provided org
+// using a single aggregate query. Orgs without members aren't reported.
+func (d *DB) GetOrgsMembersCount(tx *sql.Tx, orgIDs []string) (map[string]int, error) {
+	counts := map[string]int{}
+	if len(orgIDs) == 0 {
+		return counts, nil
+	}
+
+	q := sb.Select("orgmember_q.org_id", "count(*)").From("orgmember_q")
+	q = q.Where(sq.Eq{"orgmember_q.org_id": orgIDs})
+	q = q.GroupBy("orgmember_q.org_id")
+
+	rows, err := d.query(tx, q)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var orgID string
+		var count int
+		if err := rows.Scan(&orgID, &count); err != nil {
+			return nil, errors.Wrapf(err, "failed to scan rows")
+		}
+		counts[orgID] = count
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return counts, nil
+}
+
 type UserOrg struct {
 	Organization *types.Organization
 	Role         types.MemberRole
 }
 
+// GetUserOrgs returns the user orgs sorted by name. When memberRoles isn't
+// empty only the orgs where the user has one of these roles are returned.
 // TODO(sgotti) implement cursor fetching
-func (d *DB) GetUserOrgs(tx *sql.Tx, userID string) ([]*UserOrg, error) {
+func (d *DB) GetUserOrgs(tx *sql.Tx, userID string, memberRoles []types.MemberRole) ([]*UserOrg, error) {
 	q := sb.Select(
 		"orgmember_q.revision", "orgmember_q.data",
 		"org_q.revision", "org_q.data").From("orgmember_q")
 	q = q.Where(sq.Eq{"orgmember_q.user_id": userID})
+	if len(memberRoles) > 0 {
+		q = q.Where(sq.Eq{"orgmember_q.member_role": memberRoles})
+	}
 	q = q.Join("org_q on org_q.id = orgmember_q.org_id")
 	q = q.OrderBy("org_q.name")
 
@@ -1017,6 +1331,45 @@ func (d *DB) GetProjectGroupProjects(tx *sql.Tx, parentID string) ([]*types.Proj
 	return projects, errors.WithStack(err)
 }
 
+// GetProjectGroupsProjects returns the projects that are direct children of
+// the provided project groups, sorted by name and id. When startProjectID is
+// provided, only the projects following it are returned.
+func (d *DB) GetProjectGroupsProjects(tx *sql.Tx, parentIDs []string, startProjectID string, limit int, asc bool) ([]*types.Project, error) {
+	if len(parentIDs) == 0 {
+		return []*types.Project{}, nil
+	}
+
+	q := projectQSelect.Where(sq.Eq{"parent_id": parentIDs})
+	if asc {
+		q = q.OrderBy("project_q.name asc", "project_q.id asc")
+	} else {
+		q = q.OrderBy("project_q.name desc", "project_q.id desc")
+	}
+	if startProjectID != "" {
+		startProject, err := d.GetProjectByID(tx, startProjectID)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if startProject == nil {
+			return nil, errors.Errorf("start project %q doesn't exist", startProjectID)
+		}
+		// project names aren't unique across project groups so also use the
+		// project id to continue from the start project
+		if asc {
+			q = q.Where(sq.Or{sq.Gt{"project_q.name": startProject.Name}, sq.And{sq.Eq{"project_q.name": startProject.Name}, sq.Gt{"project_q.id": startProject.ID}}})
+		} else {
+			q = q.Where(sq.Or{sq.Lt{"project_q.name": startProject.Name}, sq.And{sq.Eq{"project_q.name": startProject.Name}, sq.Lt{"project_q.id": startProject.ID}}})
+		}
+	}
+	if limit > 0 {
+		q = q.Limit(uint64(limit))
+	}
+
+	projects, _, err := d.fetchProjects(tx, q)
+
+	return projects, errors.WithStack(err)
+}
+
 func (d *DB) GetSecretByID(tx *sql.Tx, secretID string) (*types.Secret, error) {
 	q := secretQSelect.Where(sq.Eq{"id": secretID})
 	secrets, _, err := d.fetchSecrets(tx, q)
@@ -1252,6 +1605,22 @@ func (d *DB) GetOrgInvitationByOrgUserID(tx *sql.Tx, orgID, userID string) (*typ
 	return orgInvitations[0], nil
 }
 
+func (d *DB) GetOrgInvitationByToken(tx *sql.Tx, token string) (*types.OrgInvitation, error) {
+	q := orgInvitationQSelect.Where(sq.Eq{"token": token})
+
+	orgInvitations, _, err := d.fetchOrgInvitations(tx, q)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if len(orgInvitations) > 1 {
+		return nil, errors.Errorf("too many rows returned")
+	}
+	if len(orgInvitations) == 0 {
+		return nil, nil
+	}
+	return orgInvitations[0], nil
+}
+
 func (d *DB) GetOrgInvitationByUserID(tx *sql.Tx, userID string) ([]*types.OrgInvitation, error) {
 	q := orgInvitationQSelect.Where(sq.Eq{"user_id": userID})
 
@@ -1261,3 +1630,26 @@ func (d *DB) GetOrgInvitationByUserID(tx *sql.Tx, userID string) ([]*types.OrgIn
 	}
 	return orgInvitations, errors.WithStack(err)
 }
+
+func (d *DB) GetOrgInviteLinks(tx *sql.Tx, orgID string) ([]*types.OrgInviteLink, error) {
+	q := orgInviteLinkQSelect.Where(sq.Eq{"org_id": orgID})
+	orgInviteLinks, _, err := d.fetchOrgInviteLinks(tx, q)
+
+	return orgInviteLinks, errors.WithStack(err)
+}
+
+func (d *DB) GetOrgInviteLinkByToken(tx *sql.Tx, token string) (*types.OrgInviteLink, error) {
+	q := orgInviteLinkQSelect.Where(sq.Eq{"token": token})
+
+	orgInviteLinks, _, err := d.fetchOrgInviteLinks(tx, q)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if len(orgInviteLinks) > 1 {
+		return nil, errors.Errorf("too many rows returned")
+	}
+	if len(orgInviteLinks) == 0 {
+		return nil, nil
+	}
+	return orgInviteLinks[0], nil
+}
@@ -748,3 +748,70 @@ func (d *DB) scanOrgInvitations(rows *stdsql.Rows, txID string) ([]*types.OrgInv
 	}
 	return vs, ids, nil
 }
+
+func (d *DB) fetchOrgInviteLinks(tx *sql.Tx, q sq.Sqlizer) ([]*types.OrgInviteLink, []string, error) {
+	rows, err := d.query(tx, q)
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+	defer rows.Close()
+
+	return d.scanOrgInviteLinks(rows, tx.ID())
+}
+
+func (d *DB) scanOrgInviteLink(rows *stdsql.Rows, additionalFields []interface{}) (*types.OrgInviteLink, string, error) {
+	var id string
+	var revision uint64
+	var data []byte
+	fields := append([]interface{}{&id, &revision, &data}, additionalFields...)
+	if err := rows.Scan(fields...); err != nil {
+		return nil, "", errors.Wrap(err, "failed to scan rows")
+	}
+	v := types.OrgInviteLink{}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &v); err != nil {
+			return nil, "", errors.Wrap(err, "failed to unmarshal OrgInviteLink")
+		}
+	}
+
+	v.Revision = revision
+
+	return &v, id, nil
+}
+
+func (d *DB) scanOrgInviteLinks(rows *stdsql.Rows, txID string) ([]*types.OrgInviteLink, []string, error) {
+	cols, err := rows.Columns()
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+	fieldsNumber := len(cols)
+	if fieldsNumber < 3 {
+		return nil, nil, errors.Errorf("not enough columns (%d < 3)", len(cols))
+	}
+	var additionalFieldsPtr []interface{}
+	if fieldsNumber > 3 {
+		additionalFieldsNumber := fieldsNumber - 3
+		additionalFields := make([]interface{}, additionalFieldsNumber)
+		additionalFieldsPtr = make([]interface{}, additionalFieldsNumber)
+		for i := 0; i < additionalFieldsNumber; i++ {
+			additionalFieldsPtr[i] = &additionalFields[i]
+		}
+	}
+
+	vs := []*types.OrgInviteLink{}
+	ids := []string{}
+	for rows.Next() {
+		v, id, err := d.scanOrgInviteLink(rows, additionalFieldsPtr)
+		if err != nil {
+			rows.Close()
+			return nil, nil, errors.WithStack(err)
+		}
+		v.TxID = txID
+		vs = append(vs, v)
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+	return vs, ids, nil
+}
@@ -1497,3 +1497,138 @@ func (d *DB) deleteOrgInvitationData(tx *sql.Tx, id string) error {
 
 	return nil
 }
+
+func (d *DB) InsertOrUpdateOrgInviteLink(tx *sql.Tx, v *types.OrgInviteLink) error {
+	var err error
+	if v.Revision == 0 {
+		err = d.InsertOrgInviteLink(tx, v)
+	} else {
+		err = d.UpdateOrgInviteLink(tx, v)
+	}
+
+	return errors.WithStack(err)
+}
+
+func (d *DB) InsertOrgInviteLink(tx *sql.Tx, v *types.OrgInviteLink) error {
+	if v.Revision != 0 {
+		return errors.Errorf("expected revision 0 got %d", v.Revision)
+	}
+
+	if v.TxID != tx.ID() {
+		return errors.Errorf("object was not created by this transaction")
+	}
+
+	data, err := d.insertOrgInviteLinkData(tx, v)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	return d.insertOrgInviteLinkQ(tx, v, data)
+}
+
+func (d *DB) insertOrgInviteLinkData(tx *sql.Tx, v *types.OrgInviteLink) ([]byte, error) {
+	v.Revision = 1
+
+	now := time.Now()
+	v.SetCreationTime(now)
+	v.SetUpdateTime(now)
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		v.Revision = 0
+		return nil, errors.WithStack(err)
+	}
+
+	q := sb.Insert("orginvitelink").Columns("id", "revision", "data").Values(v.ID, v.Revision, data)
+	if _, err := d.exec(tx, q); err != nil {
+		v.Revision = 0
+		return nil, errors.Wrap(err, "failed to insert orginvitelink")
+	}
+
+	return data, nil
+}
+
+// insertRawOrgInviteLinkData should be used only for import.
+// It won't update object times.
+func (d *DB) insertRawOrgInviteLinkData(tx *sql.Tx, v *types.OrgInviteLink) ([]byte, error) {
+	v.Revision = 1
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		v.Revision = 0
+		return nil, errors.WithStack(err)
+	}
+
+	q := sb.Insert("orginvitelink").Columns("id", "revision", "data").Values(v.ID, v.Revision, data)
+	if _, err := d.exec(tx, q); err != nil {
+		v.Revision = 0
+		return nil, errors.Wrap(err, "failed to insert orginvitelink")
+	}
+
+	return data, nil
+}
+
+func (d *DB) UpdateOrgInviteLink(tx *sql.Tx, v *types.OrgInviteLink) error {
+	data, err := d.updateOrgInviteLinkData(tx, v)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	return d.updateOrgInviteLinkQ(tx, v, data)
+}
+
+func (d *DB) updateOrgInviteLinkData(tx *sql.Tx, v *types.OrgInviteLink) ([]byte, error) {
+	if v.Revision < 1 {
+		return nil, errors.Errorf("expected revision > 0 got %d", v.Revision)
+	}
+
+	if v.TxID != tx.ID() {
+		return nil, errors.Errorf("object was not fetched by this transaction")
+	}
+
+	curRevision := v.Revision
+	v.Revision++
+
+	v.SetUpdateTime(time.Now())
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	q := sb.Update("orginvitelink").SetMap(map[string]interface{}{"id": v.ID, "revision": v.Revision, "data": data}).Where(sq.Eq{"id": v.ID, "revision": curRevision})
+	res, err := d.exec(tx, q)
+	if err != nil {
+		v.Revision = curRevision
+		return nil, errors.Wrap(err, "failed to update orginvitelink")
+	}
+
+	rows, err := res.RowsAffected()
+	if err != nil {
+		v.Revision = curRevision
+		return nil, errors.Wrap(err, "failed to update orginvitelink")
+	}
+
+	if rows != 1 {
+		v.Revision = curRevision
+		return nil, idb.ErrConcurrent
+	}
+
+	return data, nil
+}
+
+func (d *DB) DeleteOrgInviteLink(tx *sql.Tx, id string) error {
+	if err := d.deleteOrgInviteLinkData(tx, id); err != nil {
+		return errors.WithStack(err)
+	}
+
+	return d.deleteOrgInviteLinkQ(tx, id)
+}
+
+func (d *DB) deleteOrgInviteLinkData(tx *sql.Tx, id string) error {
+	if _, err := tx.Exec("delete from orginvitelink where id = $1", id); err != nil {
+		return errors.Wrap(err, "failed to delete orginvitelink")
+	}
+
+	return nil
+}
@@ -16,4 +16,5 @@ var ObjectsInfo = []idb.ObjectInfo{
 	{Name: "Secret", Table: "secret"},
 	{Name: "Variable", Table: "variable"},
 	{Name: "OrgInvitation", Table: "orginvitation"},
+	{Name: "OrgInviteLink", Table: "orginvitelink"},
 }
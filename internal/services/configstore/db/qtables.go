@@ -21,19 +21,19 @@ var (
 	}
 
 	userQSelect = sb.Select("user_t_q.id", "user_t_q.revision", "user_t_q.data").From("user_t_q")
-	userQInsert = func(id string, revision uint64, name string, data []byte) sq.InsertBuilder {
-		return sb.Insert("user_t_q").Columns("id", "revision", "name", "data").Values(id, revision, name, data)
+	userQInsert = func(id string, revision uint64, name, email string, deleted bool, creationTime int64, data []byte) sq.InsertBuilder {
+		return sb.Insert("user_t_q").Columns("id", "revision", "name", "email", "deleted", "creation_time", "data").Values(id, revision, name, email, deleted, creationTime, data)
 	}
-	userQUpdate = func(id string, revision uint64, name string, data []byte) sq.UpdateBuilder {
-		return sb.Update("user_t_q").SetMap(map[string]interface{}{"id": id, "revision": revision, "name": name, "data": data}).Where(sq.Eq{"id": id})
+	userQUpdate = func(id string, revision uint64, name, email string, deleted bool, creationTime int64, data []byte) sq.UpdateBuilder {
+		return sb.Update("user_t_q").SetMap(map[string]interface{}{"id": id, "revision": revision, "name": name, "email": email, "deleted": deleted, "creation_time": creationTime, "data": data}).Where(sq.Eq{"id": id})
 	}
 
 	userTokenQSelect = sb.Select("usertoken_q.id", "usertoken_q.revision", "usertoken_q.data").From("usertoken_q")
-	userTokenQInsert = func(id string, revision uint64, userID, name, value string, data []byte) sq.InsertBuilder {
-		return sb.Insert("usertoken_q").Columns("id", "revision", "user_id", "name", "value", "data").Values(id, revision, userID, name, value, data)
+	userTokenQInsert = func(id string, revision uint64, userID, name, valueHash string, expirationTime int64, data []byte) sq.InsertBuilder {
+		return sb.Insert("usertoken_q").Columns("id", "revision", "user_id", "name", "value_hash", "expiration_time", "data").Values(id, revision, userID, name, valueHash, expirationTime, data)
 	}
-	userTokenQUpdate = func(id string, revision uint64, userID, name, value string, data []byte) sq.UpdateBuilder {
-		return sb.Update("usertoken_q").SetMap(map[string]interface{}{"id": id, "revision": revision, "user_id": userID, "name": name, "value": value, "data": data}).Where(sq.Eq{"id": id})
+	userTokenQUpdate = func(id string, revision uint64, userID, name, valueHash string, expirationTime int64, data []byte) sq.UpdateBuilder {
+		return sb.Update("usertoken_q").SetMap(map[string]interface{}{"id": id, "revision": revision, "user_id": userID, "name": name, "value_hash": valueHash, "expiration_time": expirationTime, "data": data}).Where(sq.Eq{"id": id})
 	}
 
 	linkedAccountQSelect = sb.Select("linkedaccount_q.id", "linkedaccount_q.revision", "linkedaccount_q.data").From("linkedaccount_q")
@@ -53,11 +53,11 @@ var (
 	}
 
 	orgmemberQSelect = sb.Select("orgmember_q.id", "orgmember_q.revision", "orgmember_q.data").From("orgmember_q")
-	orgmemberQInsert = func(id string, revision uint64, orgID, userID string, data []byte) sq.InsertBuilder {
-		return sb.Insert("orgmember_q").Columns("id", "revision", "org_id", "user_id", "data").Values(id, revision, orgID, userID, data)
+	orgmemberQInsert = func(id string, revision uint64, orgID, userID string, memberRole types.MemberRole, data []byte) sq.InsertBuilder {
+		return sb.Insert("orgmember_q").Columns("id", "revision", "org_id", "user_id", "member_role", "data").Values(id, revision, orgID, userID, memberRole, data)
 	}
-	orgmemberQUpdate = func(id string, revision uint64, orgID, userID string, data []byte) sq.UpdateBuilder {
-		return sb.Update("orgmember_q").SetMap(map[string]interface{}{"id": id, "revision": revision, "org_id": orgID, "user_id": userID, "data": data}).Where(sq.Eq{"id": id})
+	orgmemberQUpdate = func(id string, revision uint64, orgID, userID string, memberRole types.MemberRole, data []byte) sq.UpdateBuilder {
+		return sb.Update("orgmember_q").SetMap(map[string]interface{}{"id": id, "revision": revision, "org_id": orgID, "user_id": userID, "member_role": memberRole, "data": data}).Where(sq.Eq{"id": id})
 	}
 
 	projectGroupQSelect = sb.Select("projectgroup_q.id", "projectgroup_q.revision", "projectgroup_q.data").From("projectgroup_q")
@@ -93,11 +93,19 @@ var (
 	}
 
 	orgInvitationQSelect = sb.Select("orginvitation_q.id", "orginvitation_q.revision", "orginvitation_q.data").From("orginvitation_q")
-	orgInvitationQInsert = func(id string, revision uint64, userID string, orgID string, data []byte) sq.InsertBuilder {
-		return sb.Insert("orginvitation_q").Columns("id", "revision", "user_id", "org_id", "data").Values(id, revision, userID, orgID, data)
+	orgInvitationQInsert = func(id string, revision uint64, userID string, orgID string, token string, data []byte) sq.InsertBuilder {
+		return sb.Insert("orginvitation_q").Columns("id", "revision", "user_id", "org_id", "token", "data").Values(id, revision, userID, orgID, token, data)
 	}
-	orgInvitationQUpdate = func(id string, revision uint64, userID, orgID string, data []byte) sq.UpdateBuilder {
-		return sb.Update("orginvitation_q").SetMap(map[string]interface{}{"id": id, "revision": revision, "user_id": userID, "org_id": orgID, "data": data}).Where(sq.Eq{"id": id})
+	orgInvitationQUpdate = func(id string, revision uint64, userID, orgID, token string, data []byte) sq.UpdateBuilder {
+		return sb.Update("orginvitation_q").SetMap(map[string]interface{}{"id": id, "revision": revision, "user_id": userID, "org_id": orgID, "token": token, "data": data}).Where(sq.Eq{"id": id})
+	}
+
+	orgInviteLinkQSelect = sb.Select("orginvitelink_q.id", "orginvitelink_q.revision", "orginvitelink_q.data").From("orginvitelink_q")
+	orgInviteLinkQInsert = func(id string, revision uint64, orgID string, token string, data []byte) sq.InsertBuilder {
+		return sb.Insert("orginvitelink_q").Columns("id", "revision", "org_id", "token", "data").Values(id, revision, orgID, token, data)
+	}
+	orgInviteLinkQUpdate = func(id string, revision uint64, orgID, token string, data []byte) sq.UpdateBuilder {
+		return sb.Update("orginvitelink_q").SetMap(map[string]interface{}{"id": id, "revision": revision, "org_id": orgID, "token": token, "data": data}).Where(sq.Eq{"id": id})
 	}
 )
 
@@ -125,6 +133,8 @@ func (d *DB) InsertObjectQ(tx *sql.Tx, obj stypes.Object, data []byte) error {
 		return d.insertVariableQ(tx, obj.(*types.Variable), data)
 	case types.OrgInvitationKind:
 		return d.insertOrgInvitationQ(tx, obj.(*types.OrgInvitation), data)
+	case types.OrgInviteLinkKind:
+		return d.insertOrgInviteLinkQ(tx, obj.(*types.OrgInviteLink), data)
 
 	default:
 		panic(errors.Errorf("unknown object kind %q", obj.GetKind()))
@@ -157,8 +167,17 @@ func (d *DB) deleteRemoteSourceQ(tx *sql.Tx, id string) error {
 	return nil
 }
 
+// UserCreationTime returns the user creation time as unix nanoseconds, used to
+// sort the users by creation time. Users without a creation time sort first.
+func UserCreationTime(user *types.User) int64 {
+	if user.CreationTime.IsZero() {
+		return 0
+	}
+	return user.CreationTime.UnixNano()
+}
+
 func (d *DB) insertUserQ(tx *sql.Tx, user *types.User, data []byte) error {
-	q := userQInsert(user.ID, user.Revision, user.Name, data)
+	q := userQInsert(user.ID, user.Revision, user.Name, user.Email, user.IsDeleted(), UserCreationTime(user), data)
 	if _, err := d.exec(tx, q); err != nil {
 		return errors.Wrapf(err, "failed to insert user_t_q")
 	}
@@ -167,7 +186,7 @@ func (d *DB) insertUserQ(tx *sql.Tx, user *types.User, data []byte) error {
 }
 
 func (d *DB) updateUserQ(tx *sql.Tx, user *types.User, data []byte) error {
-	q := userQUpdate(user.ID, user.Revision, user.Name, data)
+	q := userQUpdate(user.ID, user.Revision, user.Name, user.Email, user.IsDeleted(), UserCreationTime(user), data)
 	if _, err := d.exec(tx, q); err != nil {
 		return errors.Wrapf(err, "failed to insert user_t_q")
 	}
@@ -183,8 +202,18 @@ func (d *DB) deleteUserQ(tx *sql.Tx, id string) error {
 	return nil
 }
 
+// userTokenExpirationTime returns the user token expiration time as unix
+// nanoseconds, used to count the active tokens. Tokens without an expiration
+// time return 0.
+func userTokenExpirationTime(userToken *types.UserToken) int64 {
+	if userToken.ExpiresAt == nil {
+		return 0
+	}
+	return userToken.ExpiresAt.UnixNano()
+}
+
 func (d *DB) insertUserTokenQ(tx *sql.Tx, userToken *types.UserToken, data []byte) error {
-	q := userTokenQInsert(userToken.ID, userToken.Revision, userToken.UserID, userToken.Name, userToken.Value, data)
+	q := userTokenQInsert(userToken.ID, userToken.Revision, userToken.UserID, userToken.Name, userToken.ValueHash, userTokenExpirationTime(userToken), data)
 	if _, err := d.exec(tx, q); err != nil {
 		return errors.Wrapf(err, "failed to insert usertoken_q")
 	}
@@ -193,7 +222,7 @@ func (d *DB) insertUserTokenQ(tx *sql.Tx, userToken *types.UserToken, data []byt
 }
 
 func (d *DB) updateUserTokenQ(tx *sql.Tx, userToken *types.UserToken, data []byte) error {
-	q := userTokenQUpdate(userToken.ID, userToken.Revision, userToken.UserID, userToken.Name, userToken.Value, data)
+	q := userTokenQUpdate(userToken.ID, userToken.Revision, userToken.UserID, userToken.Name, userToken.ValueHash, userTokenExpirationTime(userToken), data)
 	if _, err := d.exec(tx, q); err != nil {
 		return errors.Wrapf(err, "failed to insert usertoken_q")
 	}
@@ -262,7 +291,7 @@ func (d *DB) deleteOrganizationQ(tx *sql.Tx, id string) error {
 }
 
 func (d *DB) insertOrganizationMemberQ(tx *sql.Tx, orgmember *types.OrganizationMember, data []byte) error {
-	q := orgmemberQInsert(orgmember.ID, orgmember.Revision, orgmember.OrganizationID, orgmember.UserID, data)
+	q := orgmemberQInsert(orgmember.ID, orgmember.Revision, orgmember.OrganizationID, orgmember.UserID, orgmember.MemberRole, data)
 	if _, err := d.exec(tx, q); err != nil {
 		return errors.Wrapf(err, "failed to insert orgmember_q")
 	}
@@ -271,7 +300,7 @@ func (d *DB) insertOrganizationMemberQ(tx *sql.Tx, orgmember *types.Organization
 }
 
 func (d *DB) updateOrganizationMemberQ(tx *sql.Tx, orgmember *types.OrganizationMember, data []byte) error {
-	q := orgmemberQUpdate(orgmember.ID, orgmember.Revision, orgmember.OrganizationID, orgmember.UserID, data)
+	q := orgmemberQUpdate(orgmember.ID, orgmember.Revision, orgmember.OrganizationID, orgmember.UserID, orgmember.MemberRole, data)
 	if _, err := d.exec(tx, q); err != nil {
 		return errors.Wrapf(err, "failed to insert orgmember_q")
 	}
@@ -392,7 +421,7 @@ func (d *DB) deleteVariableQ(tx *sql.Tx, id string) error {
 }
 
 func (d *DB) insertOrgInvitationQ(tx *sql.Tx, orgInvitation *types.OrgInvitation, data []byte) error {
-	q := orgInvitationQInsert(orgInvitation.ID, orgInvitation.Revision, orgInvitation.UserID, orgInvitation.OrganizationID, data)
+	q := orgInvitationQInsert(orgInvitation.ID, orgInvitation.Revision, orgInvitation.UserID, orgInvitation.OrganizationID, orgInvitation.Token, data)
 	if _, err := d.exec(tx, q); err != nil {
 		return errors.Wrapf(err, "failed to insert orginvitation_q")
 	}
@@ -401,7 +430,7 @@ func (d *DB) insertOrgInvitationQ(tx *sql.Tx, orgInvitation *types.OrgInvitation
 }
 
 func (d *DB) updateOrgInvitationQ(tx *sql.Tx, orgInvitation *types.OrgInvitation, data []byte) error {
-	q := orgInvitationQUpdate(orgInvitation.ID, orgInvitation.Revision, orgInvitation.UserID, orgInvitation.OrganizationID, data)
+	q := orgInvitationQUpdate(orgInvitation.ID, orgInvitation.Revision, orgInvitation.UserID, orgInvitation.OrganizationID, orgInvitation.Token, data)
 	if _, err := d.exec(tx, q); err != nil {
 		return errors.Wrapf(err, "failed to update orginvitation_q")
 	}
@@ -416,3 +445,29 @@ func (d *DB) deleteOrgInvitationQ(tx *sql.Tx, id string) error {
 
 	return nil
 }
+
+func (d *DB) insertOrgInviteLinkQ(tx *sql.Tx, orgInviteLink *types.OrgInviteLink, data []byte) error {
+	q := orgInviteLinkQInsert(orgInviteLink.ID, orgInviteLink.Revision, orgInviteLink.OrganizationID, orgInviteLink.Token, data)
+	if _, err := d.exec(tx, q); err != nil {
+		return errors.Wrapf(err, "failed to insert orginvitelink_q")
+	}
+
+	return nil
+}
+
+func (d *DB) updateOrgInviteLinkQ(tx *sql.Tx, orgInviteLink *types.OrgInviteLink, data []byte) error {
+	q := orgInviteLinkQUpdate(orgInviteLink.ID, orgInviteLink.Revision, orgInviteLink.OrganizationID, orgInviteLink.Token, data)
+	if _, err := d.exec(tx, q); err != nil {
+		return errors.Wrapf(err, "failed to update orginvitelink_q")
+	}
+
+	return nil
+}
+
+func (d *DB) deleteOrgInviteLinkQ(tx *sql.Tx, id string) error {
+	if _, err := tx.Exec("delete from orginvitelink_q where id = $1", id); err != nil {
+		return errors.Wrapf(err, "failed to delete orginvitelink_q")
+	}
+
+	return nil
+}
@@ -15,32 +15,67 @@
 package driver
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"os"
+	"path"
 	"path/filepath"
+	"reflect"
 	"runtime"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"agola.io/agola/internal/errors"
 	"agola.io/agola/internal/services/executor/registry"
+	"agola.io/agola/internal/util"
 	"agola.io/agola/services/types"
 
 	dockertypes "github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/events"
 	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/api/types/versions"
 	"github.com/docker/docker/api/types/volume"
 	"github.com/docker/docker/client"
+	"github.com/docker/docker/errdefs"
 	"github.com/docker/docker/pkg/archive"
 	"github.com/docker/docker/pkg/stdcopy"
+	units "github.com/docker/go-units"
 	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	defaultStopTimeout = 1 * time.Second
+	defaultAPIVersion  = "1.26"
+
+	// minPlatformAPIVersion is the first docker api version where the daemon
+	// handles the image pull platform. Older daemons silently ignore it.
+	minPlatformAPIVersion = "1.32"
+
+	defaultOrphanedVolumesGracePeriod = 24 * time.Hour
+
+	// podPollInterval is the interval between two checks of the pod
+	// containers state when waiting for them to be ready or healthy
+	podPollInterval = 500 * time.Millisecond
+
+	// podSecretsDir is the main container tmpfs dir containing the pod
+	// secrets files
+	podSecretsDir = "/run/secrets"
+
+	// serviceLogsTailLines is the number of log lines of a failed service
+	// container reported in the NewPod error
+	serviceLogsTailLines = 20
 )
 
 type DockerDriver struct {
@@ -51,189 +86,1792 @@ type DockerDriver struct {
 	initDockerConfig *registry.DockerConfig
 	executorID       string
 	arch             types.Arch
+
+	// pullSem, when not nil, limits the number of concurrent image pulls
+	pullSem chan struct{}
+	// stopTimeout is the time given to the pod containers to gracefully stop
+	// before being killed
+	stopTimeout time.Duration
+	// stopOrder is the order in which the pod containers are stopped
+	stopOrder StopOrder
+	// resourceTTL, when > 0, is used to set the expiry label on the created
+	// resources
+	resourceTTL time.Duration
+	// extraLabels are set on every created container and volume
+	extraLabels map[string]string
+	// imagePullMetricsHook, when not nil, receives the metrics of every
+	// image fetch
+	imagePullMetricsHook ImagePullMetricsHook
+	// defaultUlimits are the ulimits set on every container, overridden by the
+	// container ulimits with the same name
+	defaultUlimits []Ulimit
+	// tmpfsNoExec mounts the tmpfs volumes as noexec,nosuid unless they
+	// explicitly allow exec
+	tmpfsNoExec bool
+	// allowedBindSources are the host path prefixes that can be bind mounted
+	// in the containers
+	allowedBindSources []string
+	// toolboxVolumePoolSize is the number of toolbox volumes kept ready in
+	// the warm pool, 0 disables the warm pool
+	toolboxVolumePoolSize int
+	// toolboxVolumePool, when not nil, is the warm pool of toolbox volumes
+	toolboxVolumePool *warmPool
+	// warmPoolConfig, when not nil, configures the warm pool of idle pod
+	// main containers
+	warmPoolConfig *WarmPoolConfig
+	// containerPools are the warm pools of idle pod main containers, by image
+	containerPools map[string]*warmPool
+
+	// pruneOnStartup removes, at setup, the pods left by a previous executor
+	// with the same id
+	pruneOnStartup bool
+	// orphanedVolumesGracePeriod is the min age of a volume not attached to
+	// any pod before being removed
+	orphanedVolumesGracePeriod time.Duration
+
+	// tracer creates the spans around the driver operations
+	tracer trace.Tracer
+	// capacity, when its fields are > 0, overrides the docker daemon total
+	// memory and cpus used to check the pods resource requests
+	capacity ResourceRequests
+	// capacityMu protects pendingRequests
+	capacityMu sync.Mutex
+	// pendingRequests are the resource requests of the pods being created,
+	// not yet accounted by their container labels
+	pendingRequests ResourceRequests
+
+	// waitHealthyTimeout, when > 0, is the max time NewPod waits for the pod
+	// containers with a healthcheck to become healthy
+	waitHealthyTimeout time.Duration
+	// serviceSettlePeriod, when > 0, is the time the pod service containers
+	// must keep running for NewPod to succeed
+	serviceSettlePeriod time.Duration
+	// podStartTimeout, when > 0, is the max duration of NewPod
+	podStartTimeout time.Duration
+
+	// registryMirrors maps the (normalized) registry names to the mirror
+	// registry host used to pull their images
+	registryMirrors map[string]string
+
+	// docker client options, they override the options from the environment
+	dockerHost  string
+	apiVersion  string
+	tlsCertPath string
+	tlsKeyPath  string
+	tlsCAPath   string
 }
 
-func NewDockerDriver(log zerolog.Logger, executorID, toolboxPath, initImage string, initDockerConfig *registry.DockerConfig) (*DockerDriver, error) {
-	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithVersion("1.26"))
-	if err != nil {
-		return nil, errors.WithStack(err)
+type DockerDriverOption func(d *DockerDriver)
+
+// WithDockerDriverMaxConcurrentPulls limits the number of image pulls
+// executed concurrently by the driver. A value <= 0 means no limit.
+func WithDockerDriverMaxConcurrentPulls(n int) DockerDriverOption {
+	return func(d *DockerDriver) {
+		if n > 0 {
+			d.pullSem = make(chan struct{}, n)
+		}
+	}
+}
+
+// WithDockerDriverStopTimeout sets the time given to the pod containers to
+// gracefully stop before being killed. Defaults to 1 second.
+func WithDockerDriverStopTimeout(timeout time.Duration) DockerDriverOption {
+	return func(d *DockerDriver) {
+		d.stopTimeout = timeout
+	}
+}
+
+// WithDockerDriverStopOrder sets the order in which the pod containers are
+// stopped. Defaults to StopOrderReverse.
+func WithDockerDriverStopOrder(order StopOrder) DockerDriverOption {
+	return func(d *DockerDriver) {
+		d.stopOrder = order
+	}
+}
+
+// WithDockerDriverResourceTTL sets on every created container and volume the
+// "agola.io/expiry" label with value the creation time plus the provided ttl,
+// in RFC3339 format and UTC (i.e. "2006-01-02T15:04:05Z"). The label is only a
+// hint for external tools to clean up leaked resources, it doesn't change the
+// executor resources garbage collection.
+func WithDockerDriverResourceTTL(ttl time.Duration) DockerDriverOption {
+	return func(d *DockerDriver) {
+		d.resourceTTL = ttl
+	}
+}
+
+// WithDockerDriverExtraLabels sets the provided labels on every created
+// container and volume (i.e. for external monitoring or cost allocation). The
+// label keys cannot use the reserved "agola.io/" prefix.
+func WithDockerDriverExtraLabels(labels map[string]string) DockerDriverOption {
+	return func(d *DockerDriver) {
+		d.extraLabels = labels
+	}
+}
+
+// WithDockerDriverImagePullMetricsHook sets a hook called with the metrics of
+// every successful image fetch.
+func WithDockerDriverImagePullMetricsHook(hook ImagePullMetricsHook) DockerDriverOption {
+	return func(d *DockerDriver) {
+		d.imagePullMetricsHook = hook
+	}
+}
+
+// WithDockerDriverDefaultUlimits sets the ulimits applied to every container.
+// The container config ulimits with the same name override them.
+func WithDockerDriverDefaultUlimits(ulimits []Ulimit) DockerDriverOption {
+	return func(d *DockerDriver) {
+		d.defaultUlimits = ulimits
+	}
+}
+
+// WithDockerDriverTmpfsNoExec defines if tmpfs volumes are mounted by default
+// with the noexec and nosuid options. Volumes can opt-out setting AllowExec.
+// Defaults to true.
+func WithDockerDriverTmpfsNoExec(noExec bool) DockerDriverOption {
+	return func(d *DockerDriver) {
+		d.tmpfsNoExec = noExec
+	}
+}
+
+// WithDockerDriverAllowedBindSources sets the host path prefixes that the
+// bind volumes can mount. Binds of other host paths are forbidden. Defaults to
+// no allowed binds.
+func WithDockerDriverAllowedBindSources(sources []string) DockerDriverOption {
+	return func(d *DockerDriver) {
+		d.allowedBindSources = sources
+	}
+}
+
+// WithDockerDriverToolboxVolumePoolSize enables a warm pool keeping size
+// toolbox volumes pre-created and already populated with the toolbox, so the
+// pods don't wait for their creation. The volumes of removed pods are reset
+// and returned to the pool.
+func WithDockerDriverToolboxVolumePoolSize(size int) DockerDriverOption {
+	return func(d *DockerDriver) {
+		d.toolboxVolumePoolSize = size
+	}
+}
+
+// WarmPoolConfig is the configuration of the warm pool of idle pod main
+// containers.
+type WarmPoolConfig struct {
+	// Images are the images of the pooled containers, usually the common base
+	// images used by the tasks
+	Images []string
+	// Size is the number of idle containers kept for every image
+	Size int
+	// InitVolumeDir is the dir where the pooled containers mount the toolbox.
+	// Only pods with the same InitVolumeDir use the pooled containers.
+	InitVolumeDir string
+	// ProjectDir is the dir where the pooled containers mount their project
+	// volume, usually the tasks working dir. The volume is created by docker
+	// so it's owned by root unless the dir exists in the image.
+	ProjectDir string
+}
+
+// WithDockerDriverWarmPool enables a warm pool keeping, for every configured
+// image, idle main containers already created and started, so the pods don't
+// wait for their creation.
+//
+// Only pods whose main container runs the toolbox sleeper without any other
+// option (like the executor task pods without a container env or user) and
+// without dns config, external networks and secrets use a pooled container.
+//
+// When the pod is removed its container is reset and returned to the pool:
+// the container is restarted, killing the processes left by the pod, and its
+// project volume is emptied. The other changes made by the pod to the
+// container filesystem are kept, so the warm pool must only be used for
+// trusted tasks. Containers failing the reset are discarded.
+func WithDockerDriverWarmPool(config WarmPoolConfig) DockerDriverOption {
+	return func(d *DockerDriver) {
+		d.warmPoolConfig = &config
+	}
+}
+
+// WithDockerDriverRegistryMirrors sets the registry mirrors (or pull-through
+// caches) used to pull the images. The map keys are the registry names (any of
+// "docker.io", "index.docker.io" and "registry-1.docker.io" for docker hub)
+// and the values the mirror registry host. Images of registries without a
+// configured mirror are pulled from their registry.
+func WithDockerDriverRegistryMirrors(mirrors map[string]string) DockerDriverOption {
+	return func(d *DockerDriver) {
+		d.registryMirrors = make(map[string]string, len(mirrors))
+		for regName, mirror := range mirrors {
+			d.registryMirrors[registry.NormalizeRegistry(regName)] = mirror
+		}
+	}
+}
+
+// WithDockerDriverTracer sets the tracer used to create spans around the pod
+// creation, exec and removal. By default no span is created.
+func WithDockerDriverTracer(tracer trace.Tracer) DockerDriverOption {
+	return func(d *DockerDriver) {
+		d.tracer = tracer
+	}
+}
+
+// WithDockerDriverCapacity sets the executor memory (in bytes) and cpu (in
+// millicpus) capacity used to check that the pods resource requests fit. Zero
+// values mean the docker daemon total memory and cpus.
+func WithDockerDriverCapacity(memory, cpu int64) DockerDriverOption {
+	return func(d *DockerDriver) {
+		d.capacity = ResourceRequests{Memory: memory, CPU: cpu}
+	}
+}
+
+// WithDockerDriverWaitHealthy makes NewPod wait, up to the provided timeout,
+// for the pod containers with a healthcheck to become healthy. If a container
+// becomes unhealthy or isn't healthy before the timeout the pod is removed.
+func WithDockerDriverWaitHealthy(timeout time.Duration) DockerDriverOption {
+	return func(d *DockerDriver) {
+		d.waitHealthyTimeout = timeout
+	}
+}
+
+// WithDockerDriverServiceSettlePeriod makes NewPod check that the pod service
+// containers keep running for the provided period. If a service container
+// exits the pod is removed and the error reports the container last logs.
+func WithDockerDriverServiceSettlePeriod(period time.Duration) DockerDriverOption {
+	return func(d *DockerDriver) {
+		d.serviceSettlePeriod = period
+	}
+}
+
+// WithDockerDriverPodStartTimeout bounds the whole NewPod operation, images
+// fetch included. On timeout the pod resources already created are removed.
+func WithDockerDriverPodStartTimeout(timeout time.Duration) DockerDriverOption {
+	return func(d *DockerDriver) {
+		d.podStartTimeout = timeout
+	}
+}
+
+// WithDockerDriverPruneOnStartup enables the removal, at setup, of the pods
+// left by a previous executor process with the same executor id. Since at
+// setup the executor doesn't have any live pod, all the executor pods are
+// stopped and removed. Disabled by default to keep the containers for
+// inspection.
+func WithDockerDriverPruneOnStartup(prune bool) DockerDriverOption {
+	return func(d *DockerDriver) {
+		d.pruneOnStartup = prune
+	}
+}
+
+// WithDockerDriverOrphanedVolumesGracePeriod sets the min age of the volumes,
+// not attached to any pod, removed at executor startup. Defaults to 24 hours.
+func WithDockerDriverOrphanedVolumesGracePeriod(gracePeriod time.Duration) DockerDriverOption {
+	return func(d *DockerDriver) {
+		d.orphanedVolumesGracePeriod = gracePeriod
+	}
+}
+
+// WithDockerDriverHost sets the docker daemon host (i.e.
+// "tcp://docker.example.com:2376"). It overrides the DOCKER_HOST environment
+// variable.
+func WithDockerDriverHost(host string) DockerDriverOption {
+	return func(d *DockerDriver) {
+		d.dockerHost = host
+	}
+}
+
+// WithDockerDriverTLS sets the client certificate, key and the CA certificate
+// used to connect to the docker daemon over TLS.
+func WithDockerDriverTLS(certPath, keyPath, caPath string) DockerDriverOption {
+	return func(d *DockerDriver) {
+		d.tlsCertPath = certPath
+		d.tlsKeyPath = keyPath
+		d.tlsCAPath = caPath
+	}
+}
+
+// WithDockerDriverAPIVersion sets the docker api version used by the client.
+// Defaults to 1.26.
+func WithDockerDriverAPIVersion(version string) DockerDriverOption {
+	return func(d *DockerDriver) {
+		d.apiVersion = version
 	}
+}
 
-	return &DockerDriver{
+func NewDockerDriver(log zerolog.Logger, executorID, toolboxPath, initImage string, initDockerConfig *registry.DockerConfig, options ...DockerDriverOption) (*DockerDriver, error) {
+	d := &DockerDriver{
 		log:              log,
-		client:           cli,
 		toolboxPath:      toolboxPath,
 		initImage:        initImage,
 		initDockerConfig: initDockerConfig,
 		executorID:       executorID,
 		arch:             types.ArchFromString(runtime.GOARCH),
-	}, nil
+		stopTimeout:      defaultStopTimeout,
+		stopOrder:        StopOrderReverse,
+		tmpfsNoExec:      true,
+		apiVersion:       defaultAPIVersion,
+
+		orphanedVolumesGracePeriod: defaultOrphanedVolumesGracePeriod,
+	}
+
+	for _, opt := range options {
+		opt(d)
+	}
+
+	for _, ulimit := range d.defaultUlimits {
+		if err := validateUlimit(ulimit); err != nil {
+			return nil, errors.Wrapf(err, "invalid default ulimit")
+		}
+	}
+	if d.stopOrder != StopOrderForward && d.stopOrder != StopOrderReverse {
+		return nil, errors.Errorf("unknown stop order %q", d.stopOrder)
+	}
+	if d.warmPoolConfig != nil && !filepath.IsAbs(d.warmPoolConfig.ProjectDir) {
+		return nil, errors.Errorf("warm pool project dir %q isn't an absolute path", d.warmPoolConfig.ProjectDir)
+	}
+	for key := range d.extraLabels {
+		if strings.HasPrefix(key, labelPrefix) {
+			return nil, errors.Errorf("extra label %q uses the reserved %q prefix", key, labelPrefix)
+		}
+	}
+
+	clientOptions := []client.Opt{client.FromEnv}
+	if d.dockerHost != "" {
+		clientOptions = append(clientOptions, client.WithHost(d.dockerHost))
+	}
+	if d.tlsCertPath != "" || d.tlsKeyPath != "" || d.tlsCAPath != "" {
+		for _, path := range []string{d.tlsCertPath, d.tlsKeyPath, d.tlsCAPath} {
+			if _, err := os.Stat(path); err != nil {
+				return nil, errors.Wrapf(err, "invalid docker tls file %q", path)
+			}
+		}
+		clientOptions = append(clientOptions, client.WithTLSClientConfig(d.tlsCAPath, d.tlsCertPath, d.tlsKeyPath))
+	}
+	clientOptions = append(clientOptions, client.WithVersion(d.apiVersion))
+
+	cli, err := client.NewClientWithOpts(clientOptions...)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	d.client = cli
+
+	return d, nil
 }
 
 func (d *DockerDriver) Setup(ctx context.Context) error {
+	// fail fast since no pod can be created without the toolbox
+	if _, err := toolboxExecPath(d.toolboxPath, d.arch); err != nil {
+		return errors.Wrapf(err, "missing toolbox binary for executor arch %q in toolbox path %q", d.arch, d.toolboxPath)
+	}
+
+	if d.pruneOnStartup {
+		if err := d.prunePods(ctx); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	if err := d.Cleanup(ctx); err != nil {
+		return errors.WithStack(err)
+	}
+
+	if d.warmPoolConfig != nil {
+		if err := d.removeIdlePooledContainers(ctx); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	if d.toolboxVolumePoolSize > 0 || d.warmPoolConfig != nil {
+		// remove the warm pool volumes left by a previous executor run
+		args := filters.NewArgs()
+		args.Add("label", fmt.Sprintf("%s=%s", executorIDKey, d.executorID))
+		args.Add("label", fmt.Sprintf("%s=%s", warmPoolKey, "true"))
+		volumes, err := d.client.VolumeList(ctx, args)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		for _, vol := range volumes.Volumes {
+			// ignore volumes still used by a pod
+			_ = d.client.VolumeRemove(ctx, vol.Name, false)
+		}
+	}
+
+	if d.toolboxVolumePoolSize > 0 {
+		d.toolboxVolumePool = newWarmPool(d.log, d.toolboxVolumePoolSize, d.createPoolToolboxVolume, d.resetPoolToolboxVolume, d.removePoolToolboxVolume)
+		go d.toolboxVolumePool.run(ctx)
+	}
+
+	if d.warmPoolConfig != nil && d.warmPoolConfig.Size > 0 {
+		d.containerPools = map[string]*warmPool{}
+		for _, image := range d.warmPoolConfig.Images {
+			image := image
+			create := func(ctx context.Context) (string, error) {
+				return d.createPooledContainer(ctx, image)
+			}
+			pool := newWarmPool(d.log, d.warmPoolConfig.Size, create, d.resetPooledContainer, d.removePooledContainer)
+			d.containerPools[image] = pool
+			go pool.run(ctx)
+		}
+	}
+
 	return nil
 }
 
-func (d *DockerDriver) createToolboxVolume(ctx context.Context, podID string, out io.Writer) (*dockertypes.Volume, error) {
-	if err := d.fetchImage(ctx, d.initImage, false, d.initDockerConfig, out); err != nil {
+// prunePods stops and removes all the executor pods.
+func (d *DockerDriver) prunePods(ctx context.Context) error {
+	pods, err := d.GetPods(ctx, true)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	errs := &util.Errors{}
+	for _, pod := range pods {
+		d.log.Info().Msgf("pruning leftover pod %q", pod.ID())
+		if err := pod.Stop(ctx); err != nil {
+			errs.Append(errors.Wrapf(err, "failed to stop pod %q", pod.ID()))
+		}
+		if err := pod.Remove(ctx); err != nil {
+			errs.Append(errors.Wrapf(err, "failed to remove pod %q", pod.ID()))
+		}
+	}
+	if errs.IsErr() {
+		return errors.WithStack(errs)
+	}
+
+	return nil
+}
+
+// Cleanup removes the executor volumes left by crashed executors: the
+// volumes not attached to any existing pod and older than the orphaned
+// volumes grace period. The warm pool volumes aren't considered.
+func (d *DockerDriver) Cleanup(ctx context.Context) error {
+	pods, err := d.GetPods(ctx, true)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	podsIDs := map[string]struct{}{}
+	podsVolumes := map[string]struct{}{}
+	for _, pod := range pods {
+		dp := pod.(*DockerPod)
+		podsIDs[dp.id] = struct{}{}
+		if dp.toolboxVolumeName != "" {
+			podsVolumes[dp.toolboxVolumeName] = struct{}{}
+		}
+	}
+
+	args := filters.NewArgs()
+	args.Add("label", fmt.Sprintf("%s=%s", agolaLabelKey, agolaLabelValue))
+	args.Add("label", fmt.Sprintf("%s=%s", executorIDKey, d.executorID))
+	volumes, err := d.client.VolumeList(ctx, args)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	now := time.Now()
+	for _, vol := range volumes.Volumes {
+		if vol.Labels[agolaLabelKey] != agolaLabelValue || vol.Labels[executorIDKey] != d.executorID {
+			continue
+		}
+		if _, ok := vol.Labels[warmPoolKey]; ok {
+			continue
+		}
+		if _, ok := vol.Labels[persistentVolumeKey]; ok {
+			continue
+		}
+		if _, ok := podsVolumes[vol.Name]; ok {
+			continue
+		}
+		if _, ok := podsIDs[vol.Labels[podIDKey]]; ok {
+			continue
+		}
+
+		// older docker api versions don't report the volume creation time,
+		// don't remove volumes with an unknown age
+		createdAt, err := time.Parse(time.RFC3339, vol.CreatedAt)
+		if err != nil {
+			d.log.Debug().Msgf("skipping orphaned volume %q with unknown creation time", vol.Name)
+			continue
+		}
+		if now.Sub(createdAt) < d.orphanedVolumesGracePeriod {
+			continue
+		}
+
+		if err := d.client.VolumeRemove(ctx, vol.Name, false); err != nil {
+			d.log.Warn().Err(err).Msgf("failed to remove orphaned volume %q", vol.Name)
+			continue
+		}
+		d.log.Info().Msgf("removed orphaned volume %q created at %s", vol.Name, vol.CreatedAt)
+	}
+
+	return nil
+}
+
+// persistentVolumeName returns the stable name of the persistent volume with
+// the provided cache key
+func persistentVolumeName(cacheKey string) string {
+	return fmt.Sprintf("agola-cache-%x", sha256.Sum256([]byte(cacheKey)))
+}
+
+// ensurePersistentVolume creates the persistent volume with the provided cache
+// key if it doesn't exist and returns its name. Concurrent pods can create the
+// same volume, an already existing volume isn't an error.
+func (d *DockerDriver) ensurePersistentVolume(ctx context.Context, cacheKey string) (string, error) {
+	name := persistentVolumeName(cacheKey)
+
+	labels := map[string]string{}
+	labels[agolaLabelKey] = agolaLabelValue
+	labels[executorIDKey] = d.executorID
+	labels[persistentVolumeKey] = "true"
+	labels[cacheKeyKey] = cacheKey
+	d.setExtraLabels(labels)
+
+	if _, err := d.createVolume(ctx, volume.VolumeCreateBody{Name: name, Driver: "local", Labels: labels}); err != nil {
+		return "", errors.Wrapf(err, "failed to create persistent volume %q", name)
+	}
+
+	return name, nil
+}
+
+// volumeCreateBackoff is the backoff used to retry a volume creation failed
+// with a transient docker daemon error
+var volumeCreateBackoff = util.Backoff{
+	Steps:    4,
+	Duration: 100 * time.Millisecond,
+	Factor:   2.0,
+	Jitter:   0.1,
+}
+
+// createVolume creates a volume retrying on transient docker daemon errors.
+// If a volume with the same name already exists (i.e. concurrently created by
+// another pod) the existing volume is returned.
+func (d *DockerDriver) createVolume(ctx context.Context, body volume.VolumeCreateBody) (*dockertypes.Volume, error) {
+	var vol dockertypes.Volume
+	var lastErr error
+	err := util.ExponentialBackoff(ctx, volumeCreateBackoff, func() (bool, error) {
+		var err error
+		vol, err = d.client.VolumeCreate(ctx, body)
+		if err != nil && errdefs.IsConflict(err) && body.Name != "" {
+			vol, err = d.client.VolumeInspect(ctx, body.Name)
+		}
+		if err == nil {
+			return true, nil
+		}
+		if !isTransientDockerError(err) {
+			return false, errors.WithStack(err)
+		}
+		d.log.Warn().Err(err).Msgf("failed to create volume, retrying")
+		lastErr = err
+		return false, nil
+	})
+	if errors.Is(err, util.ErrWaitTimeout) {
+		return nil, errors.Wrapf(lastErr, "failed to create volume after %d attempts", volumeCreateBackoff.Steps)
+	}
+	if err != nil {
 		return nil, errors.WithStack(err)
 	}
+	// the backoff returns without error when ctx is done
+	if ctx.Err() != nil {
+		return nil, errors.WithStack(ctx.Err())
+	}
+
+	return &vol, nil
+}
+
+// isTransientDockerError reports whether the docker daemon error could be
+// temporary so the request can be retried
+func isTransientDockerError(err error) bool {
+	return errdefs.IsUnavailable(err) || errdefs.IsSystem(err) || client.IsErrConnectionFailed(err)
+}
+
+// EvictPersistentVolume removes the persistent volume with the provided cache
+// key. The volume must not be used by a pod.
+func (d *DockerDriver) EvictPersistentVolume(ctx context.Context, cacheKey string) error {
+	name := persistentVolumeName(cacheKey)
+	if err := d.client.VolumeRemove(ctx, name, false); err != nil {
+		switch {
+		case errdefs.IsNotFound(err):
+			return util.NewAPIError(util.ErrNotExist, errors.Errorf("persistent volume for cache key %q doesn't exist", cacheKey))
+		case errdefs.IsConflict(err):
+			return util.NewAPIError(util.ErrConflict, errors.Errorf("persistent volume for cache key %q is in use", cacheKey))
+		}
+		return errors.Wrapf(err, "failed to remove persistent volume %q", name)
+	}
+
+	return nil
+}
+
+func (d *DockerDriver) createPoolToolboxVolume(ctx context.Context) (string, error) {
+	labels := map[string]string{}
+	labels[agolaLabelKey] = agolaLabelValue
+	labels[executorIDKey] = d.executorID
+	labels[warmPoolKey] = "true"
+	// pooled volumes can stay idle for a long time so don't set the expiry
+	// label
+	toolboxVol, err := d.createToolboxVolume(ctx, labels, ioutil.Discard)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	return toolboxVol.Name, nil
+}
+
+// resetPoolToolboxVolume populates again the toolbox volume of a removed pod.
+// The volume is mounted read only, this ensures it contains the current
+// toolbox.
+func (d *DockerDriver) resetPoolToolboxVolume(ctx context.Context, name string) error {
+	return errors.WithStack(d.populateToolboxVolume(ctx, name, ioutil.Discard))
+}
+
+func (d *DockerDriver) removePoolToolboxVolume(ctx context.Context, name string) error {
+	return errors.WithStack(d.client.VolumeRemove(ctx, name, true))
+}
+
+// podToolboxVolume returns a toolbox volume for the pod, from the warm pool if
+// enabled and not empty.
+func (d *DockerDriver) podToolboxVolume(ctx context.Context, podID string, out io.Writer) (*dockertypes.Volume, error) {
+	if d.toolboxVolumePool != nil {
+		if name, ok := d.toolboxVolumePool.acquire(); ok {
+			return &dockertypes.Volume{Name: name, Labels: map[string]string{warmPoolKey: "true"}}, nil
+		}
+	}
 
 	labels := map[string]string{}
 	labels[agolaLabelKey] = agolaLabelValue
 	labels[executorIDKey] = d.executorID
 	labels[podIDKey] = podID
-	toolboxVol, err := d.client.VolumeCreate(ctx, volume.VolumeCreateBody{Driver: "local", Labels: labels})
+	d.setExpiryLabel(labels)
+
+	return d.createToolboxVolume(ctx, labels, out)
+}
+
+func (d *DockerDriver) createToolboxVolume(ctx context.Context, labels map[string]string, out io.Writer) (*dockertypes.Volume, error) {
+	d.setExtraLabels(labels)
+	toolboxVol, err := d.createVolume(ctx, volume.VolumeCreateBody{Driver: "local", Labels: labels})
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
 
-	resp, err := d.client.ContainerCreate(ctx, &container.Config{
-		Entrypoint: []string{"cat"},
-		Image:      d.initImage,
-		Tty:        true,
-	}, &container.HostConfig{
-		Binds: []string{fmt.Sprintf("%s:%s", toolboxVol.Name, "/tmp/agola")},
-	}, nil, "")
+	if err := d.populateToolboxVolume(ctx, toolboxVol.Name, out); err != nil {
+		// use a new context since ctx could be expired
+		if rerr := d.client.VolumeRemove(context.Background(), toolboxVol.Name, true); rerr != nil {
+			d.log.Warn().Err(rerr).Msgf("failed to remove toolbox volume %q", toolboxVol.Name)
+		}
+		return nil, errors.WithStack(err)
+	}
+
+	return toolboxVol, nil
+}
+
+// populateToolboxVolume copies the toolbox inside the volume using a temporary
+// helper container. The helper is only created, never started: copying to a
+// created container writes inside its mounted volumes. It's always removed,
+// also when the copy fails.
+func (d *DockerDriver) populateToolboxVolume(ctx context.Context, name string, out io.Writer) error {
+	toolboxExecPath, err := toolboxExecPath(d.toolboxPath, d.arch)
+	if err != nil {
+		return errors.Wrapf(err, "failed to get toolbox path for arch %q", d.arch)
+	}
+	srcInfo, err := archive.CopyInfoSourcePath(toolboxExecPath, false)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	srcInfo.RebaseName = "agola-toolbox"
+
+	if err := d.fetchImage(ctx, d.initImage, d.defaultPlatform(), false, d.initDockerConfig, out); err != nil {
+		return errors.WithStack(err)
+	}
+
+	containerLabels := map[string]string{}
+	d.setExpiryLabel(containerLabels)
+	resp, err := d.client.ContainerCreate(ctx, &container.Config{
+		// the helper container is never started, set an entrypoint since the
+		// init image could not define a command
+		Entrypoint: []string{"true"},
+		Image:      d.initImage,
+		Labels:     containerLabels,
+	}, &container.HostConfig{
+		Binds: []string{fmt.Sprintf("%s:%s", name, "/tmp/agola")},
+	}, nil, "")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	containerID := resp.ID
+	// use a new context since ctx could be expired
+	defer func() {
+		if err := d.client.ContainerRemove(context.Background(), containerID, dockertypes.ContainerRemoveOptions{Force: true}); err != nil {
+			d.log.Warn().Err(err).Msgf("failed to remove toolbox helper container %q", containerID)
+		}
+	}()
+
+	srcArchive, err := archive.TarResource(srcInfo)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer srcArchive.Close()
+
+	options := dockertypes.CopyToContainerOptions{
+		AllowOverwriteDirWithFile: false,
+		CopyUIDGID:                false,
+	}
+
+	if err := d.client.CopyToContainer(ctx, containerID, "/tmp/agola", srcArchive, options); err != nil {
+		return errors.WithStack(err)
+	}
+
+	return nil
+}
+
+// pooledContainerConfig returns the main container config of the pods that can
+// use the pooled containers of the provided image.
+func (d *DockerDriver) pooledContainerConfig(image string) *ContainerConfig {
+	return &ContainerConfig{
+		Image:      image,
+		Entrypoint: []string{filepath.Join(d.warmPoolConfig.InitVolumeDir, toolboxPrefix), "sleeper"},
+	}
+}
+
+// podContainerPool returns the warm pool of the containers usable as the pod
+// main container or nil if the pod can't use a pooled container.
+func (d *DockerDriver) podContainerPool(podConfig *PodConfig) *warmPool {
+	if d.containerPools == nil {
+		return nil
+	}
+	if podConfig.InitVolumeDir != d.warmPoolConfig.InitVolumeDir || podConfig.DNS != nil || len(podConfig.ExternalNetworks) > 0 || len(podConfig.Secrets) > 0 {
+		return nil
+	}
+
+	mainConfig := *podConfig.Containers[0]
+	pool, ok := d.containerPools[mainConfig.Image]
+	if !ok {
+		return nil
+	}
+
+	// the pod main container options must be the ones of the pooled
+	// containers
+	if len(mainConfig.Env) == 0 {
+		mainConfig.Env = nil
+	}
+	if len(mainConfig.Volumes) == 0 {
+		mainConfig.Volumes = nil
+	}
+	if !reflect.DeepEqual(&mainConfig, d.pooledContainerConfig(mainConfig.Image)) {
+		return nil
+	}
+
+	return pool
+}
+
+// createPooledContainer creates and starts an idle container, with its own
+// toolbox volume, for the warm pool of the provided image.
+func (d *DockerDriver) createPooledContainer(ctx context.Context, image string) (_ string, err error) {
+	if err := d.fetchImage(ctx, image, d.defaultPlatform(), false, nil, ioutil.Discard); err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	labels := map[string]string{}
+	labels[agolaLabelKey] = agolaLabelValue
+	labels[executorIDKey] = d.executorID
+	labels[warmPoolKey] = "true"
+	// pooled resources can stay idle for a long time so don't set the expiry
+	// label
+	toolboxVol, err := d.createToolboxVolume(ctx, labels, ioutil.Discard)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	defer func() {
+		if err == nil {
+			return
+		}
+		// use a new context since ctx could be expired
+		if rerr := d.client.VolumeRemove(context.Background(), toolboxVol.Name, true); rerr != nil {
+			d.log.Warn().Err(rerr).Msgf("failed to remove toolbox volume %q", toolboxVol.Name)
+		}
+	}()
+
+	podConfig := &PodConfig{
+		InitVolumeDir: d.warmPoolConfig.InitVolumeDir,
+		Containers:    []*ContainerConfig{d.pooledContainerConfig(image)},
+	}
+	cliContainerConfig, cliHostConfig, err := d.containerCreateConfig(ctx, 0, podConfig, "", toolboxVol)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	// the pooled containers aren't bound to a pod until acquired
+	delete(cliContainerConfig.Labels, podIDKey)
+	delete(cliContainerConfig.Labels, taskIDKey)
+	delete(cliContainerConfig.Labels, expiryKey)
+	cliContainerConfig.Labels[warmPoolKey] = "true"
+	cliContainerConfig.Labels[toolboxVolumeKey] = toolboxVol.Name
+	// the project volume is an anonymous volume, removed with the container
+	cliContainerConfig.Volumes = map[string]struct{}{d.warmPoolConfig.ProjectDir: {}}
+
+	resp, err := d.client.ContainerCreate(ctx, cliContainerConfig, cliHostConfig, nil, "")
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	if err := d.client.ContainerStart(ctx, resp.ID, dockertypes.ContainerStartOptions{}); err != nil {
+		if rerr := d.client.ContainerRemove(context.Background(), resp.ID, dockertypes.ContainerRemoveOptions{Force: true, RemoveVolumes: true}); rerr != nil {
+			d.log.Warn().Err(rerr).Msgf("failed to remove pooled container %q", resp.ID)
+		}
+		return "", errors.WithStack(err)
+	}
+
+	return resp.ID, nil
+}
+
+// resetPooledContainer resets the container of a removed pod: it's restarted,
+// killing the processes left by the pod, and its project volume is emptied.
+// The image must provide sh and rm.
+func (d *DockerDriver) resetPooledContainer(ctx context.Context, containerID string) error {
+	timeout := d.stopTimeout
+	if err := d.client.ContainerRestart(ctx, containerID, &timeout); err != nil {
+		return errors.WithStack(err)
+	}
+
+	resp, err := d.client.ContainerExecCreate(ctx, containerID, dockertypes.ExecConfig{
+		Cmd:          []string{"sh", "-c", `rm -rf "$0"/* "$0"/.[!.]* "$0"/..?*`, d.warmPoolConfig.ProjectDir},
+		User:         "0",
+		AttachStdout: true,
+		AttachStderr: true,
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	hresp, err := d.client.ContainerExecAttach(ctx, resp.ID, dockertypes.ExecStartCheck{})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	// the stream ends when the exec exits
+	_, err = io.Copy(ioutil.Discard, hresp.Reader)
+	hresp.Close()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	inspect, err := d.client.ContainerExecInspect(ctx, resp.ID)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if inspect.ExitCode != 0 {
+		return errors.Errorf("failed to empty project dir %q, exit code: %d", d.warmPoolConfig.ProjectDir, inspect.ExitCode)
+	}
+
+	return nil
+}
+
+func (d *DockerDriver) removePooledContainer(ctx context.Context, containerID string) error {
+	return errors.WithStack(removePooledContainer(ctx, d.client, containerID))
+}
+
+// removePooledContainer removes the pooled container with its toolbox volume.
+func removePooledContainer(ctx context.Context, cli *client.Client, containerID string) error {
+	info, err := cli.ContainerInspect(ctx, containerID)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if err := cli.ContainerRemove(ctx, containerID, dockertypes.ContainerRemoveOptions{Force: true, RemoveVolumes: true}); err != nil {
+		return errors.WithStack(err)
+	}
+	if toolboxVolumeName := info.Config.Labels[toolboxVolumeKey]; toolboxVolumeName != "" {
+		if err := cli.VolumeRemove(ctx, toolboxVolumeName, true); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	return nil
+}
+
+// removeIdlePooledContainers removes the idle pooled containers left by a
+// previous executor run. The pooled containers claimed by a pod are released
+// when the pod is removed.
+func (d *DockerDriver) removeIdlePooledContainers(ctx context.Context) error {
+	args := filters.NewArgs()
+	args.Add("label", fmt.Sprintf("%s=%s", executorIDKey, d.executorID))
+	args.Add("label", pooledContainerKey)
+	volumes, err := d.client.VolumeList(ctx, args)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	claimed := map[string]struct{}{}
+	for _, vol := range volumes.Volumes {
+		claimed[vol.Labels[pooledContainerKey]] = struct{}{}
+	}
+
+	args = filters.NewArgs()
+	args.Add("label", fmt.Sprintf("%s=%s", executorIDKey, d.executorID))
+	args.Add("label", fmt.Sprintf("%s=%s", warmPoolKey, "true"))
+	containers, err := d.client.ContainerList(ctx, dockertypes.ContainerListOptions{Filters: args, All: true})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	for _, container := range containers {
+		if _, ok := claimed[container.ID]; ok {
+			continue
+		}
+		if err := d.removePooledContainer(ctx, container.ID); err != nil {
+			return errors.Wrapf(err, "failed to remove pooled container %q", container.ID)
+		}
+	}
+
+	return nil
+}
+
+// claimPooledContainer creates the volume claiming the pooled container for the
+// pod. Since the container labels can't be changed after its creation, the
+// volume labels bind the container to the pod.
+func (d *DockerDriver) claimPooledContainer(ctx context.Context, podConfig *PodConfig, containerID string) (*dockertypes.Volume, error) {
+	labels := map[string]string{}
+	labels[agolaLabelKey] = agolaLabelValue
+	labels[executorIDKey] = d.executorID
+	labels[podIDKey] = podConfig.ID
+	labels[taskIDKey] = podConfig.TaskID
+	labels[containerIndexKey] = "0"
+	labels[containerNameKey] = podContainerName(0, podConfig.Containers[0].Name)
+	labels[pooledContainerKey] = containerID
+	d.setExtraLabels(labels)
+	d.setExpiryLabel(labels)
+
+	vol, err := d.createVolume(ctx, volume.VolumeCreateBody{Driver: "local", Labels: labels})
+	return vol, errors.WithStack(err)
+}
+
+// pooledContainerCurrent reports if the pooled container is running the
+// current image, since the image could have been updated after the container
+// creation.
+func (d *DockerDriver) pooledContainerCurrent(ctx context.Context, containerID, image string) (bool, error) {
+	info, err := d.client.ContainerInspect(ctx, containerID)
+	if err != nil {
+		if client.IsErrNotFound(err) {
+			return false, nil
+		}
+		return false, errors.WithStack(err)
+	}
+	if info.State == nil || !info.State.Running {
+		return false, nil
+	}
+	imageInfo, _, err := d.client.ImageInspectWithRaw(ctx, image)
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+
+	return info.Image == imageInfo.ID, nil
+}
+
+// dockerUlimits merges the default ulimits with the container ulimits. The
+// container ulimits override the default ones with the same name.
+func dockerUlimits(defaultUlimits, ulimits []Ulimit) []*units.Ulimit {
+	dockerUlimits := []*units.Ulimit{}
+	index := map[string]int{}
+	for _, ulimits := range [][]Ulimit{defaultUlimits, ulimits} {
+		for _, ulimit := range ulimits {
+			dockerUlimit := &units.Ulimit{Name: ulimit.Name, Soft: ulimit.Soft, Hard: ulimit.Hard}
+			if i, ok := index[ulimit.Name]; ok {
+				dockerUlimits[i] = dockerUlimit
+				continue
+			}
+			index[ulimit.Name] = len(dockerUlimits)
+			dockerUlimits = append(dockerUlimits, dockerUlimit)
+		}
+	}
+
+	return dockerUlimits
+}
+
+// setExtraLabels sets the configured extra labels
+func (d *DockerDriver) setExtraLabels(labels map[string]string) {
+	for k, v := range d.extraLabels {
+		labels[k] = v
+	}
+}
+
+// setExpiryLabel sets the expiry label when a resource ttl is configured
+func (d *DockerDriver) setExpiryLabel(labels map[string]string) {
+	if d.resourceTTL <= 0 {
+		return
+	}
+	labels[expiryKey] = time.Now().Add(d.resourceTTL).UTC().Format(time.RFC3339)
+}
+
+func (d *DockerDriver) Archs(ctx context.Context) ([]types.Arch, error) {
+	// since we are using the local docker driver we can return our go arch
+	// information, if a toolbox binary for it exists
+	return toolboxArchs(d.toolboxPath, []types.Arch{d.arch}), nil
+}
+
+func (d *DockerDriver) NewPod(ctx context.Context, podConfig *PodConfig, out io.Writer) (Pod, error) {
+	ctx, span := startSpan(ctx, d.tracer, "driver.NewPod", spanAttrPodID.String(podConfig.ID), spanAttrTaskID.String(podConfig.TaskID))
+	pod, err := d.newPod(ctx, podConfig, out)
+	span.end(err)
+
+	return pod, err
+}
+
+func (d *DockerDriver) newPod(ctx context.Context, podConfig *PodConfig, out io.Writer) (_ Pod, err error) {
+	if d.podStartTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.podStartTimeout)
+		defer cancel()
+		defer func() {
+			if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				err = errors.Wrapf(err, "pod not started after %s", d.podStartTimeout)
+			}
+		}()
+	}
+
+	if len(podConfig.Containers) == 0 {
+		return nil, errors.Errorf("empty container config")
+	}
+	if err := validatePodConfig(podConfig); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	for _, containerConfig := range podConfig.Containers {
+		if containerConfig.SeccompProfilePath != "" {
+			if _, err := readSeccompProfile(containerConfig.SeccompProfilePath); err != nil {
+				return nil, errors.WithStack(err)
+			}
+		}
+		for _, vol := range containerConfig.Volumes {
+			if vol.Bind != nil && !d.bindSourceAllowed(vol.Bind.Source) {
+				return nil, util.NewAPIError(util.ErrForbidden, errors.Errorf("bind source %q isn't allowed", vol.Bind.Source))
+			}
+		}
+	}
+	if err := d.validatePodPlatforms(podConfig); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	for _, network := range podConfig.ExternalNetworks {
+		if _, err := d.client.NetworkInspect(ctx, network, dockertypes.NetworkInspectOptions{}); err != nil {
+			if client.IsErrNotFound(err) {
+				return nil, util.NewAPIError(util.ErrNotExist, errors.Errorf("external network %q doesn't exist", network))
+			}
+			return nil, errors.WithStack(err)
+		}
+	}
+
+	requests := podRequests(podConfig)
+	if requests.Memory > 0 || requests.CPU > 0 {
+		release, err := d.reserveCapacity(ctx, requests)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		defer release()
+	}
+
+	// created tracks the pod resources created so far to remove them if the
+	// pod creation fails
+	created := &DockerPod{
+		id:                podConfig.ID,
+		client:            d.client,
+		toolboxVolumePool: d.toolboxVolumePool,
+	}
+	defer func() {
+		if err == nil {
+			return
+		}
+		// use a new context since ctx could be expired
+		if rerr := created.remove(context.Background()); rerr != nil {
+			d.log.Warn().Err(rerr).Msgf("failed to remove resources of failed pod %q", podConfig.ID)
+		}
+	}()
+
+	containerPool := d.podContainerPool(podConfig)
+	var pooledContainerID string
+	if containerPool != nil {
+		if id, ok := containerPool.acquire(); ok {
+			pooledContainerID = id
+			created.containers = []*DockerContainer{{Index: 0, Container: dockertypes.Container{ID: id}}}
+			created.pooledMainContainer = true
+			created.containerPool = containerPool
+		}
+	}
+
+	// by default always try to pull the images so we are sure only authorized users can fetch them
+	// see https://kubernetes.io/docs/reference/access-authn-authz/admission-controllers/#alwayspullimages
+	images := make([]pullImage, len(podConfig.Containers))
+	for i, containerConfig := range podConfig.Containers {
+		platform := containerConfig.Platform
+		if platform == "" {
+			platform = d.defaultPlatform()
+		}
+		images[i] = pullImage{image: containerConfig.Image, platform: platform}
+	}
+	if err := d.fetchImages(ctx, images, true, podConfig.DockerConfig, out); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	if pooledContainerID != "" {
+		current, err := d.pooledContainerCurrent(ctx, pooledContainerID, podConfig.Containers[0].Image)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if !current {
+			// the pooled container is stale, create a new main container
+			created.containers = nil
+			created.pooledMainContainer = false
+			created.containerPool = nil
+			if err := d.removePooledContainer(ctx, pooledContainerID); err != nil {
+				d.log.Warn().Err(err).Msgf("failed to remove stale pooled container %q", pooledContainerID)
+			}
+			pooledContainerID = ""
+		}
+	}
+
+	var toolboxVol *dockertypes.Volume
+	var claimVol *dockertypes.Volume
+	if pooledContainerID != "" {
+		claimVol, err = d.claimPooledContainer(ctx, podConfig, pooledContainerID)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		created.claimVolumeName = claimVol.Name
+	} else {
+		toolboxVol, err = d.podToolboxVolume(ctx, podConfig.ID, out)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		created.toolboxVolumeName = toolboxVol.Name
+		created.pooledToolboxVol = toolboxVol.Labels[warmPoolKey] == "true"
+	}
+
+	var mainContainerID string
+	for cindex := range podConfig.Containers {
+		if cindex == 0 && pooledContainerID != "" {
+			// the pooled container is already started
+			mainContainerID = pooledContainerID
+			continue
+		}
+
+		cctx, span := startSpan(ctx, d.tracer, "driver.createContainer", spanAttrImage.String(podConfig.Containers[cindex].Image), spanAttrContainerIndex.Int64(int64(cindex)))
+		resp, err := d.createContainer(cctx, cindex, podConfig, mainContainerID, toolboxVol)
+		span.end(err)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		containerID := resp.ID
+		created.containers = append(created.containers, &DockerContainer{Index: cindex, Container: dockertypes.Container{ID: containerID}})
+		if cindex == 0 {
+			// save the maincontainerid
+			mainContainerID = containerID
+
+			// the other containers share the main container network
+			// namespace so only the main container is connected
+			for _, network := range podConfig.ExternalNetworks {
+				if err := d.client.NetworkConnect(ctx, network, containerID, nil); err != nil {
+					return nil, errors.Wrapf(err, "failed to connect main container to external network %q", network)
+				}
+			}
+		}
+
+		if err := d.client.ContainerStart(ctx, containerID, dockertypes.ContainerStartOptions{}); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+
+	searchLabels := map[string]string{}
+	searchLabels[agolaLabelKey] = agolaLabelValue
+	searchLabels[executorIDKey] = d.executorID
+	searchLabels[podIDKey] = podConfig.ID
+	searchLabels[taskIDKey] = podConfig.TaskID
+	args := filters.NewArgs()
+	for k, v := range searchLabels {
+		args.Add("label", fmt.Sprintf("%s=%s", k, v))
+	}
+
+	containers, err := d.client.ContainerList(ctx,
+		dockertypes.ContainerListOptions{
+			Filters: args,
+		})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if len(containers) == 0 && pooledContainerID == "" {
+		return nil, errors.Errorf("no container with labels %s", searchLabels)
+	}
+
+	pod := &DockerPod{
+		id:                podConfig.ID,
+		client:            d.client,
+		executorID:        d.executorID,
+		stopTimeout:       d.stopTimeout,
+		stopOrder:         d.stopOrder,
+		tracer:            d.tracer,
+		containers:        []*DockerContainer{},
+		containersMap:     map[string]*DockerContainer{},
+		toolboxVolumePool: d.toolboxVolumePool,
+		initVolumeDir:     podConfig.InitVolumeDir,
+	}
+	if pooledContainerID != "" {
+		pod.labels = claimVol.Labels
+		pod.claimVolumeName = claimVol.Name
+		pod.pooledMainContainer = true
+		pod.containerPool = containerPool
+		mainContainer := &DockerContainer{
+			Index:     0,
+			Name:      podContainerName(0, podConfig.Containers[0].Name),
+			Container: dockertypes.Container{ID: pooledContainerID, Image: podConfig.Containers[0].Image, Labels: claimVol.Labels},
+		}
+		pod.containers = append(pod.containers, mainContainer)
+		pod.containersMap[mainContainer.Name] = mainContainer
+	} else {
+		pod.toolboxVolumeName = toolboxVol.Name
+		pod.pooledToolboxVol = toolboxVol.Labels[warmPoolKey] == "true"
+	}
+
+	count := 0
+	seenIndexes := map[int]struct{}{}
+	if pooledContainerID != "" {
+		seenIndexes[0] = struct{}{}
+	}
+	for _, container := range containers {
+		cIndexStr, ok := container.Labels[containerIndexKey]
+		if !ok {
+			// ignore container
+			continue
+		}
+		cIndex, err := strconv.Atoi(cIndexStr)
+		if err != nil {
+			// ignore container
+			continue
+		}
+		if _, ok := seenIndexes[cIndex]; ok {
+			return nil, errors.Errorf("duplicate container with index %d", cIndex)
+		}
+		dContainer := &DockerContainer{
+			Index:     cIndex,
+			Name:      podContainerName(cIndex, container.Labels[containerNameKey]),
+			Container: container,
+		}
+		pod.containers = append(pod.containers, dContainer)
+		pod.containersMap[dContainer.Name] = dContainer
+
+		seenIndexes[cIndex] = struct{}{}
+		count++
+	}
+	if count != len(containers) {
+		return nil, errors.Errorf("expected %d containers but got %d", len(containers), count)
+	}
+	// put the containers in the right order based on their container index
+	sort.Sort(ContainerSlice(pod.containers))
+
+	if len(podConfig.Secrets) > 0 {
+		if err := writePodSecrets(ctx, pod, podConfig.Secrets); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+
+	if d.serviceSettlePeriod > 0 {
+		if err := d.waitServicesSettled(ctx, pod); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+
+	if d.waitHealthyTimeout > 0 {
+		if err := d.waitPodHealthy(ctx, pod); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+
+	return pod, nil
+}
+
+// waitPodHealthy waits for the pod containers with a healthcheck to become
+// healthy. Containers without a healthcheck are ignored.
+func (d *DockerDriver) waitPodHealthy(ctx context.Context, pod *DockerPod) error {
+	ctx, cancel := context.WithTimeout(ctx, d.waitHealthyTimeout)
+	defer cancel()
+
+	pending := make([]*DockerContainer, len(pod.containers))
+	copy(pending, pod.containers)
+	for {
+		notHealthy := []*DockerContainer{}
+		for i, container := range pending {
+			inspect, err := d.client.ContainerInspect(ctx, container.ID)
+			if err != nil {
+				if ctx.Err() != nil {
+					// timed out, the remaining containers aren't healthy
+					notHealthy = append(notHealthy, pending[i:]...)
+					break
+				}
+				return errors.Wrapf(err, "failed to inspect container %q", container.Name)
+			}
+			if !inspect.State.Running {
+				return errors.Errorf("container %q exited with code %d before becoming healthy", container.Name, inspect.State.ExitCode)
+			}
+			if inspect.State.Health == nil {
+				continue
+			}
+			switch inspect.State.Health.Status {
+			case dockertypes.Healthy:
+			case dockertypes.Unhealthy:
+				return errors.Errorf("container %q is unhealthy%s", container.Name, lastHealthcheckOutput(inspect.State.Health))
+			default:
+				notHealthy = append(notHealthy, container)
+			}
+		}
+		if len(notHealthy) == 0 {
+			return nil
+		}
+		pending = notHealthy
+
+		select {
+		case <-ctx.Done():
+			names := []string{}
+			for _, container := range pending {
+				names = append(names, container.Name)
+			}
+			return errors.Errorf("containers not healthy after %s: %s", d.waitHealthyTimeout, strings.Join(names, ", "))
+		case <-time.After(podPollInterval):
+		}
+	}
+}
+
+// secretsTmpfsOptions returns the mount options of the secrets tmpfs. Only its
+// owner can access it. When the main container user is numeric it's the
+// tmpfs owner, otherwise the tmpfs is owned by root.
+func secretsTmpfsOptions(user string) string {
+	options := "rw,noexec,nosuid,mode=0700"
+
+	uid, gid := splitContainerUser(user)
+	if _, err := strconv.ParseUint(uid, 10, 32); err == nil {
+		options += ",uid=" + uid
+	}
+	if _, err := strconv.ParseUint(gid, 10, 32); err == nil {
+		options += ",gid=" + gid
+	}
+
+	return options
+}
+
+// writePodSecrets writes the secrets files inside the main container secrets
+// tmpfs. Since files cannot be copied inside a tmpfs using the docker api they
+// are written, after the container start, by the toolbox reading the secret
+// from stdin. The secrets contents are never written to the pod output.
+func writePodSecrets(ctx context.Context, pod *DockerPod, secrets map[string][]byte) error {
+	names := make([]string, 0, len(secrets))
+	for name := range secrets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		var stderr bytes.Buffer
+		ce, err := pod.Exec(ctx, &ExecConfig{
+			Cmd:         []string{filepath.Join(pod.initVolumeDir, "agola-toolbox"), "createfile", "--path", path.Join(podSecretsDir, name)},
+			AttachStdin: true,
+			Stderr:      &stderr,
+		})
+		if err != nil {
+			return errors.Wrapf(err, "failed to write secret %q", name)
+		}
+
+		stdin := ce.Stdin()
+		go func(data []byte) {
+			_, _ = stdin.Write(data)
+			stdin.Close()
+		}(secrets[name])
+
+		exitCode, err := ce.Wait(ctx)
+		if err != nil {
+			return errors.Wrapf(err, "failed to write secret %q", name)
+		}
+		if exitCode != 0 {
+			return errors.Errorf("failed to write secret %q, toolbox exited with code %d: %s", name, exitCode, strings.TrimSpace(stderr.String()))
+		}
+	}
+
+	return nil
+}
+
+// waitServicesSettled checks that the pod service containers keep running for
+// the settle period.
+func (d *DockerDriver) waitServicesSettled(ctx context.Context, pod *DockerPod) error {
+	deadline := time.Now().Add(d.serviceSettlePeriod)
+	for {
+		for _, container := range pod.containers {
+			if container.Index == 0 {
+				continue
+			}
+			inspect, err := d.client.ContainerInspect(ctx, container.ID)
+			if err != nil {
+				return errors.Wrapf(err, "failed to inspect container %q", container.Name)
+			}
+			if !inspect.State.Running {
+				return errors.Errorf("service container %q failed to start, exited with code %d%s", container.Name, inspect.State.ExitCode, d.containerLogsTail(ctx, container.ID, inspect.Config != nil && inspect.Config.Tty))
+			}
+		}
+
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return nil
+		}
+		if wait > podPollInterval {
+			wait = podPollInterval
+		}
+
+		select {
+		case <-ctx.Done():
+			return errors.WithStack(ctx.Err())
+		case <-time.After(wait):
+		}
+	}
+}
+
+// containerLogsTail returns the last lines of the container logs, if any, to
+// be appended to an error message.
+func (d *DockerDriver) containerLogsTail(ctx context.Context, containerID string, tty bool) string {
+	rc, err := d.client.ContainerLogs(ctx, containerID, dockertypes.ContainerLogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+		Tail:       strconv.Itoa(serviceLogsTailLines),
+	})
+	if err != nil {
+		d.log.Warn().Err(err).Msgf("failed to get container %q logs", containerID)
+		return ""
+	}
+	defer rc.Close()
+
+	var buf bytes.Buffer
+	// when the container isn't using a tty stdout and stderr are multiplexed
+	// in the same stream
+	if tty {
+		_, err = io.Copy(&buf, rc)
+	} else {
+		_, err = stdcopy.StdCopy(&buf, &buf, rc)
+	}
 	if err != nil {
-		return nil, errors.WithStack(err)
+		d.log.Warn().Err(err).Msgf("failed to read container %q logs", containerID)
 	}
 
-	containerID := resp.ID
+	logs := strings.TrimSpace(buf.String())
+	if logs == "" {
+		return ""
+	}
+	return fmt.Sprintf(", last logs:\n%s", logs)
+}
 
-	if err := d.client.ContainerStart(ctx, containerID, dockertypes.ContainerStartOptions{}); err != nil {
-		return nil, errors.WithStack(err)
+// lastHealthcheckOutput returns the output of the last healthcheck, if any,
+// to report why the container is unhealthy
+func lastHealthcheckOutput(health *dockertypes.Health) string {
+	if len(health.Log) == 0 {
+		return ""
 	}
+	output := strings.TrimSpace(health.Log[len(health.Log)-1].Output)
+	if output == "" {
+		return ""
+	}
+	return fmt.Sprintf(", last check output: %s", output)
+}
 
-	toolboxExecPath, err := toolboxExecPath(d.toolboxPath, d.arch)
-	if err != nil {
-		return nil, errors.Wrapf(err, "failed to get toolbox path for arch %q", d.arch)
+// bindSourceAllowed reports whether the host path is inside one of the
+// allowed bind sources
+func (d *DockerDriver) bindSourceAllowed(source string) bool {
+	for _, allowed := range d.allowedBindSources {
+		allowed = filepath.Clean(allowed)
+		if source == allowed || strings.HasPrefix(source, strings.TrimSuffix(allowed, "/")+"/") {
+			return true
+		}
 	}
-	srcInfo, err := archive.CopyInfoSourcePath(toolboxExecPath, false)
+	return false
+}
+
+// podRequests returns the sum of the pod containers resource requests
+func podRequests(podConfig *PodConfig) ResourceRequests {
+	var requests ResourceRequests
+	for _, containerConfig := range podConfig.Containers {
+		requests.Memory += containerConfig.Requests.Memory
+		requests.CPU += containerConfig.Requests.CPU
+	}
+	return requests
+}
+
+// reserveCapacity checks that the pod resource requests fit the executor
+// available capacity (its capacity minus the resources requested by the
+// running pods) and reserves them until the returned release function is
+// called.
+func (d *DockerDriver) reserveCapacity(ctx context.Context, requests ResourceRequests) (func(), error) {
+	d.capacityMu.Lock()
+	defer d.capacityMu.Unlock()
+
+	capacity, err := d.totalCapacity(ctx)
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
-	srcInfo.RebaseName = "agola-toolbox"
-
-	srcArchive, err := archive.TarResource(srcInfo)
+	used, err := d.usedCapacity(ctx)
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
-	defer srcArchive.Close()
 
-	options := dockertypes.CopyToContainerOptions{
-		AllowOverwriteDirWithFile: false,
-		CopyUIDGID:                false,
+	available := ResourceRequests{
+		Memory: capacity.Memory - used.Memory - d.pendingRequests.Memory,
+		CPU:    capacity.CPU - used.CPU - d.pendingRequests.CPU,
 	}
-
-	if err := d.client.CopyToContainer(ctx, containerID, "/tmp/agola", srcArchive, options); err != nil {
-		return nil, errors.WithStack(err)
+	if requests.Memory > available.Memory || requests.CPU > available.CPU {
+		return nil, util.NewAPIError(util.ErrUnavailable, errors.Errorf("pod resource requests (memory: %d, cpu: %dm) exceed the executor available capacity (memory: %d, cpu: %dm)", requests.Memory, requests.CPU, available.Memory, available.CPU))
 	}
 
-	// ignore remove error
-	_ = d.client.ContainerRemove(ctx, containerID, dockertypes.ContainerRemoveOptions{Force: true})
+	d.pendingRequests.Memory += requests.Memory
+	d.pendingRequests.CPU += requests.CPU
 
-	return &toolboxVol, nil
-}
+	return func() {
+		d.capacityMu.Lock()
+		defer d.capacityMu.Unlock()
 
-func (d *DockerDriver) Archs(ctx context.Context) ([]types.Arch, error) {
-	// since we are using the local docker driver we can return our go arch information
-	return []types.Arch{d.arch}, nil
+		d.pendingRequests.Memory -= requests.Memory
+		d.pendingRequests.CPU -= requests.CPU
+	}, nil
 }
 
-func (d *DockerDriver) NewPod(ctx context.Context, podConfig *PodConfig, out io.Writer) (Pod, error) {
-	if len(podConfig.Containers) == 0 {
-		return nil, errors.Errorf("empty container config")
+// totalCapacity returns the executor capacity, by default the docker daemon
+// total memory and cpus
+func (d *DockerDriver) totalCapacity(ctx context.Context) (ResourceRequests, error) {
+	capacity := d.capacity
+	if capacity.Memory > 0 && capacity.CPU > 0 {
+		return capacity, nil
 	}
 
-	toolboxVol, err := d.createToolboxVolume(ctx, podConfig.ID, out)
+	info, err := d.client.Info(ctx)
 	if err != nil {
-		return nil, errors.WithStack(err)
+		return ResourceRequests{}, errors.WithStack(err)
+	}
+	if capacity.Memory <= 0 {
+		capacity.Memory = info.MemTotal
+	}
+	if capacity.CPU <= 0 {
+		capacity.CPU = int64(info.NCPU) * 1000
 	}
 
-	var mainContainerID string
-	for cindex := range podConfig.Containers {
-		resp, err := d.createContainer(ctx, cindex, podConfig, mainContainerID, toolboxVol, out)
-		if err != nil {
-			return nil, errors.WithStack(err)
-		}
+	return capacity, nil
+}
 
-		containerID := resp.ID
-		if cindex == 0 {
-			// save the maincontainerid
-			mainContainerID = containerID
+// usedCapacity returns the resources requested by the running executor
+// containers
+func (d *DockerDriver) usedCapacity(ctx context.Context) (ResourceRequests, error) {
+	args := filters.NewArgs()
+	args.Add("label", fmt.Sprintf("%s=%s", agolaLabelKey, agolaLabelValue))
+	args.Add("label", fmt.Sprintf("%s=%s", executorIDKey, d.executorID))
+
+	containers, err := d.client.ContainerList(ctx, dockertypes.ContainerListOptions{Filters: args})
+	if err != nil {
+		return ResourceRequests{}, errors.WithStack(err)
+	}
+
+	var used ResourceRequests
+	for _, container := range containers {
+		if v, ok := container.Labels[memoryRequestKey]; ok {
+			memory, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				d.log.Warn().Msgf("container %q has an invalid memory request label %q", container.ID, v)
+				continue
+			}
+			used.Memory += memory
 		}
+		if v, ok := container.Labels[cpuRequestKey]; ok {
+			cpu, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				d.log.Warn().Msgf("container %q has an invalid cpu request label %q", container.ID, v)
+				continue
+			}
+			used.CPU += cpu
+		}
+	}
 
-		if err := d.client.ContainerStart(ctx, containerID, dockertypes.ContainerStartOptions{}); err != nil {
-			return nil, errors.WithStack(err)
+	return used, nil
+}
+
+// pullImage is an image to pull for a specific platform
+type pullImage struct {
+	image    string
+	platform string
+}
+
+// defaultPlatform returns the platform, derived from the driver arch, used to
+// pull the images when not specified.
+func (d *DockerDriver) defaultPlatform() string {
+	return "linux/" + string(d.arch)
+}
+
+// validatePodPlatforms checks that the container image platforms can be
+// honored by the driver.
+//
+// The platform is only used when pulling the images: the container create api
+// of the docker client doesn't accept a platform, so the containers are
+// created from the image tag as last pulled. For this reason a pod cannot use
+// the same image with different platforms.
+func (d *DockerDriver) validatePodPlatforms(podConfig *PodConfig) error {
+	platforms := map[string]string{}
+	for _, containerConfig := range podConfig.Containers {
+		platform := containerConfig.Platform
+		if platform != "" && versions.LessThan(d.client.ClientVersion(), minPlatformAPIVersion) {
+			return util.NewAPIError(util.ErrBadRequest, errors.Errorf("container image platform requires docker api version >= %s, the driver uses api version %s", minPlatformAPIVersion, d.client.ClientVersion()))
 		}
+		if platform == "" {
+			platform = d.defaultPlatform()
+		}
+		if p, ok := platforms[containerConfig.Image]; ok && p != platform {
+			return util.NewAPIError(util.ErrBadRequest, errors.Errorf("image %q used with different platforms %q and %q", containerConfig.Image, p, platform))
+		}
+		platforms[containerConfig.Image] = platform
 	}
 
-	searchLabels := map[string]string{}
-	searchLabels[agolaLabelKey] = agolaLabelValue
-	searchLabels[executorIDKey] = d.executorID
-	searchLabels[podIDKey] = podConfig.ID
-	searchLabels[taskIDKey] = podConfig.TaskID
-	args := filters.NewArgs()
-	for k, v := range searchLabels {
-		args.Add("label", fmt.Sprintf("%s=%s", k, v))
+	return nil
+}
+
+// fetchImages concurrently fetches all the distinct provided images. The
+// number of concurrent pulls is limited by the driver pull semaphore, if
+// configured.
+func (d *DockerDriver) fetchImages(ctx context.Context, images []pullImage, alwaysFetch bool, registryConfig *registry.DockerConfig, out io.Writer) error {
+	seenImages := map[pullImage]struct{}{}
+	uniqueImages := []pullImage{}
+	for _, image := range images {
+		if _, ok := seenImages[image]; ok {
+			continue
+		}
+		seenImages[image] = struct{}{}
+		uniqueImages = append(uniqueImages, image)
 	}
 
-	containers, err := d.client.ContainerList(ctx,
-		dockertypes.ContainerListOptions{
-			Filters: args,
+	// serialize writes to out since it could not be safe for concurrent use
+	sout := &syncWriter{w: out}
+
+	var wg sync.WaitGroup
+	var errsMu sync.Mutex
+	errs := &util.Errors{}
+	for _, image := range uniqueImages {
+		image := image
+		util.GoWait(&wg, func() {
+			if d.pullSem != nil {
+				select {
+				case d.pullSem <- struct{}{}:
+				case <-ctx.Done():
+					errsMu.Lock()
+					errs.Append(errors.Wrapf(ctx.Err(), "failed to fetch image %q", image.image))
+					errsMu.Unlock()
+					return
+				}
+				defer func() { <-d.pullSem }()
+			}
+
+			ctx, span := startSpan(ctx, d.tracer, "driver.fetchImage", spanAttrImage.String(image.image), spanAttrPlatform.String(image.platform))
+			err := d.fetchImage(ctx, image.image, image.platform, alwaysFetch, registryConfig, sout)
+			span.end(err)
+			if err != nil {
+				errsMu.Lock()
+				errs.Append(errors.Wrapf(err, "failed to fetch image %q", image.image))
+				errsMu.Unlock()
+			}
 		})
-	if err != nil {
-		return nil, errors.WithStack(err)
-	}
-	if len(containers) == 0 {
-		return nil, errors.Errorf("no container with labels %s", searchLabels)
 	}
+	wg.Wait()
 
-	pod := &DockerPod{
-		id:                podConfig.ID,
-		client:            d.client,
-		executorID:        d.executorID,
-		containers:        []*DockerContainer{},
-		toolboxVolumeName: toolboxVol.Name,
-		initVolumeDir:     podConfig.InitVolumeDir,
+	// return a single error as is to keep its kind
+	if len(errs.Errs) == 1 {
+		return errors.WithStack(errs.Errs[0])
+	}
+	if errs.IsErr() {
+		return errors.WithStack(errs)
 	}
 
-	count := 0
-	seenIndexes := map[int]struct{}{}
-	for _, container := range containers {
-		cIndexStr, ok := container.Labels[containerIndexKey]
-		if !ok {
-			// ignore container
-			continue
-		}
-		cIndex, err := strconv.Atoi(cIndexStr)
-		if err != nil {
-			// ignore container
-			continue
-		}
-		if _, ok := seenIndexes[cIndex]; ok {
-			return nil, errors.Errorf("duplicate container with index %d", cIndex)
-		}
-		dContainer := &DockerContainer{
-			Index:     cIndex,
-			Container: container,
+	return nil
+}
+
+type syncWriter struct {
+	w  io.Writer
+	mu sync.Mutex
+}
+
+func (s *syncWriter) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.w.Write(p)
+}
+
+// ImagePullMetrics are the metrics of an image fetch
+type ImagePullMetrics struct {
+	Image    string
+	Platform string
+	// CacheHit reports that no layer was downloaded since the image was
+	// already available or up to date
+	CacheHit bool
+	// BytesDownloaded is the size of the downloaded layers reported by the
+	// pull progress
+	BytesDownloaded int64
+	Duration        time.Duration
+}
+
+// ImagePullMetricsHook receives the metrics of an image fetch. It's called
+// concurrently when fetching multiple images.
+type ImagePullMetricsHook func(metrics ImagePullMetrics)
+
+// pullProgressMessage is a message of the image pull progress stream
+type pullProgressMessage struct {
+	Status         string `json:"status"`
+	ID             string `json:"id"`
+	ProgressDetail struct {
+		Current int64 `json:"current"`
+		Total   int64 `json:"total"`
+	} `json:"progressDetail"`
+}
+
+// pullProgress parses the image pull progress stream written to it to
+// compute the downloaded bytes. Unparsable messages are ignored.
+type pullProgress struct {
+	buf []byte
+	// layers contains the downloaded layers size by layer id
+	layers map[string]int64
+}
+
+func newPullProgress() *pullProgress {
+	return &pullProgress{layers: map[string]int64{}}
+}
+
+func (p *pullProgress) Write(b []byte) (int, error) {
+	p.buf = append(p.buf, b...)
+	for {
+		i := bytes.IndexByte(p.buf, '\n')
+		if i < 0 {
+			break
 		}
-		pod.containers = append(pod.containers, dContainer)
+		p.parseMessage(p.buf[:i])
+		p.buf = p.buf[i+1:]
+	}
 
-		seenIndexes[cIndex] = struct{}{}
-		count++
+	return len(b), nil
+}
+
+func (p *pullProgress) parseMessage(b []byte) {
+	b = bytes.TrimSpace(b)
+	if len(b) == 0 {
+		return
 	}
-	if count != len(containers) {
-		return nil, errors.Errorf("expected %d containers but got %d", len(containers), count)
+	var msg pullProgressMessage
+	if err := json.Unmarshal(b, &msg); err != nil {
+		return
 	}
-	// put the containers in the right order based on their container index
-	sort.Sort(ContainerSlice(pod.containers))
+	if msg.Status != "Downloading" || msg.ID == "" {
+		return
+	}
+	// the total is the layer size, when unknown use the downloaded bytes
+	size := msg.ProgressDetail.Total
+	if size <= 0 {
+		size = msg.ProgressDetail.Current
+	}
+	if size > p.layers[msg.ID] {
+		p.layers[msg.ID] = size
+	}
+}
 
-	return pod, nil
+// bytesDownloaded returns the total size of the downloaded layers
+func (p *pullProgress) bytesDownloaded() int64 {
+	// parse the last message when not terminated by a newline
+	p.parseMessage(p.buf)
+	p.buf = nil
+
+	var total int64
+	for _, size := range p.layers {
+		total += size
+	}
+	return total
 }
 
-func (d *DockerDriver) fetchImage(ctx context.Context, image string, alwaysFetch bool, registryConfig *registry.DockerConfig, out io.Writer) error {
+func (d *DockerDriver) fetchImage(ctx context.Context, image, platform string, alwaysFetch bool, registryConfig *registry.DockerConfig, out io.Writer) error {
+	start := time.Now()
+
 	regName, err := registry.GetRegistry(image)
 	if err != nil {
 		return errors.WithStack(err)
@@ -255,37 +1893,144 @@ func (d *DockerDriver) fetchImage(ctx context.Context, image string, alwaysFetch
 		return errors.WithStack(err)
 	}
 
-	args := filters.NewArgs()
-	args.Add("reference", image)
-	img, err := d.client.ImageList(ctx, dockertypes.ImageListOptions{Filters: args})
-	if err != nil {
-		return errors.WithStack(err)
+	// fetch only if forced, is latest tag or image isn't fully available
+	// (i.e. it doesn't exist or a previous pull was interrupted, for example
+	// by an executor restart)
+	fetch := alwaysFetch || tag == "latest"
+	var progress *pullProgress
+	if !fetch {
+		complete, err := d.imageComplete(ctx, image)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		fetch = !complete
 	}
-	exists := len(img) > 0
 
-	// fetch only if forced, is latest tag or image doesn't exist
-	if alwaysFetch || tag == "latest" || !exists {
-		reader, err := d.client.ImagePull(ctx, image, dockertypes.ImagePullOptions{RegistryAuth: registryAuthEnc})
+	if fetch {
+		pullImage, mirrored, err := d.mirrorImage(image, regName)
 		if err != nil {
 			return errors.WithStack(err)
 		}
 
-		_, err = io.Copy(out, reader)
-		return errors.WithStack(err)
+		reader, err := d.client.ImagePull(ctx, pullImage, dockertypes.ImagePullOptions{RegistryAuth: registryAuthEnc, Platform: platform})
+		if err != nil {
+			return imagePullError(ctx, err, pullImage, platform)
+		}
+		defer reader.Close()
+
+		var src io.Reader = reader
+		if d.imagePullMetricsHook != nil {
+			progress = newPullProgress()
+			src = io.TeeReader(reader, progress)
+		}
+		if _, err := io.Copy(out, src); err != nil {
+			return imagePullError(ctx, err, pullImage, platform)
+		}
+
+		// tag the mirrored image with the original reference since the
+		// containers are created using it
+		if mirrored {
+			if err := d.client.ImageTag(ctx, pullImage, image); err != nil {
+				return errors.Wrapf(err, "failed to tag mirrored image %q as %q", pullImage, image)
+			}
+		}
+	}
+
+	if d.imagePullMetricsHook != nil {
+		metrics := ImagePullMetrics{
+			Image:    image,
+			Platform: platform,
+			CacheHit: true,
+			Duration: time.Since(start),
+		}
+		if progress != nil {
+			metrics.BytesDownloaded = progress.bytesDownloaded()
+			metrics.CacheHit = metrics.BytesDownloaded == 0
+		}
+		d.imagePullMetricsHook(metrics)
 	}
 
 	return nil
 }
 
-func (d *DockerDriver) createContainer(ctx context.Context, index int, podConfig *PodConfig, maincontainerID string, toolboxVol *dockertypes.Volume, out io.Writer) (*container.ContainerCreateCreatedBody, error) {
-	containerConfig := podConfig.Containers[index]
+// imagePullError returns the image pull error as an APIError with a kind
+// reporting if the registry refused the credentials (401/403) or the image
+// doesn't exist (404). A pull timeout is reported as a retryable
+// ErrUnavailable error. ctx is also checked since the docker client reports a
+// request timeout as a connection failure.
+func imagePullError(ctx context.Context, err error, image, platform string) error {
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded), errors.Is(err, context.DeadlineExceeded), errdefs.IsDeadline(err):
+		return util.NewAPIError(util.ErrUnavailable, errors.Wrapf(err, "failed to pull image %q for platform %q: timeout", image, platform), util.WithRetryable())
+	case errdefs.IsUnauthorized(err), errdefs.IsForbidden(err):
+		return util.NewAPIError(util.ErrUnauthorized, errors.Wrapf(err, "failed to pull image %q: registry authentication failed, check the registry credentials", image))
+	case errdefs.IsNotFound(err):
+		return util.NewAPIError(util.ErrNotExist, errors.Wrapf(err, "failed to pull image %q for platform %q: image not found", image, platform))
+	default:
+		return errors.Wrapf(err, "failed to pull image %q for platform %q", image, platform)
+	}
+}
 
-	// by default always try to pull the image so we are sure only authorized users can fetch them
-	// see https://kubernetes.io/docs/reference/access-authn-authz/admission-controllers/#alwayspullimages
-	if err := d.fetchImage(ctx, containerConfig.Image, true, podConfig.DockerConfig, out); err != nil {
+// mirrorImage returns the image reference to pull, rewritten to use the
+// configured registry mirror if any, and whether it has been rewritten.
+// Images referenced by digest aren't rewritten since they can't be tagged
+// with their original reference.
+func (d *DockerDriver) mirrorImage(image, regName string) (string, bool, error) {
+	mirror, ok := d.registryMirrors[registry.NormalizeRegistry(regName)]
+	if !ok {
+		return image, false, nil
+	}
+	if strings.Contains(image, "@") {
+		d.log.Debug().Msgf("image %q referenced by digest, not using registry mirror %q", image, mirror)
+		return image, false, nil
+	}
+
+	mirrorImage, err := registry.ReplaceRegistry(image, mirror)
+	if err != nil {
+		return "", false, errors.WithStack(err)
+	}
+
+	return mirrorImage, true, nil
+}
+
+// imageComplete reports whether the image exists and is fully available
+// locally. An image reported by the docker daemon but without a rootfs layers
+// list is considered partially pulled and must be fetched again. The layers
+// already downloaded will be reused by the docker layer cache.
+func (d *DockerDriver) imageComplete(ctx context.Context, image string) (bool, error) {
+	inspect, _, err := d.client.ImageInspectWithRaw(ctx, image)
+	if err != nil {
+		if client.IsErrNotFound(err) {
+			return false, nil
+		}
+		return false, errors.WithStack(err)
+	}
+
+	if inspect.RootFS.Type != "layers" || len(inspect.RootFS.Layers) == 0 {
+		d.log.Warn().Msgf("image %q is not complete, fetching it again", image)
+		return false, nil
+	}
+
+	return true, nil
+}
+
+func (d *DockerDriver) createContainer(ctx context.Context, index int, podConfig *PodConfig, maincontainerID string, toolboxVol *dockertypes.Volume) (*container.ContainerCreateCreatedBody, error) {
+	cliContainerConfig, cliHostConfig, err := d.containerCreateConfig(ctx, index, podConfig, maincontainerID, toolboxVol)
+	if err != nil {
 		return nil, errors.WithStack(err)
 	}
 
+	// the client container create doesn't accept a platform, the container
+	// uses the image tag pulled for the platform (see validatePodPlatforms)
+	resp, err := d.client.ContainerCreate(ctx, cliContainerConfig, cliHostConfig, nil, "")
+	return &resp, errors.WithStack(err)
+}
+
+// containerCreateConfig returns the docker config of the pod container at the
+// provided index.
+func (d *DockerDriver) containerCreateConfig(ctx context.Context, index int, podConfig *PodConfig, maincontainerID string, toolboxVol *dockertypes.Volume) (*container.Config, *container.HostConfig, error) {
+	containerConfig := podConfig.Containers[index]
+
 	labels := map[string]string{}
 	labels[agolaLabelKey] = agolaLabelValue
 	labels[executorIDKey] = d.executorID
@@ -297,24 +2042,88 @@ func (d *DockerDriver) createContainer(ctx context.Context, index int, podConfig
 		containerLabels[k] = v
 	}
 	containerLabels[containerIndexKey] = strconv.Itoa(index)
+	containerLabels[containerNameKey] = podContainerName(index, containerConfig.Name)
+	if index == 0 && toolboxVol.Labels[warmPoolKey] == "true" {
+		// pooled toolbox volumes don't have the pod id label, save their
+		// name in the main container
+		containerLabels[toolboxVolumeKey] = toolboxVol.Name
+	}
+	if containerConfig.Requests.Memory > 0 {
+		containerLabels[memoryRequestKey] = strconv.FormatInt(containerConfig.Requests.Memory, 10)
+	}
+	if containerConfig.Requests.CPU > 0 {
+		containerLabels[cpuRequestKey] = strconv.FormatInt(containerConfig.Requests.CPU, 10)
+	}
+	d.setExtraLabels(containerLabels)
+	d.setExpiryLabel(containerLabels)
 
+	entrypoint, cmd := containerEntrypointCmd(containerConfig)
 	cliContainerConfig := &container.Config{
-		Entrypoint: containerConfig.Cmd,
+		Entrypoint: entrypoint,
+		Cmd:        cmd,
 		Env:        makeEnvSlice(containerConfig.Env),
 		WorkingDir: containerConfig.WorkingDir,
 		Image:      containerConfig.Image,
+		User:       containerConfig.User,
 		Tty:        true,
 		Labels:     containerLabels,
+		StopSignal: containerConfig.StopSignal,
+	}
+	if containerConfig.Healthcheck != nil {
+		cliContainerConfig.Healthcheck = &container.HealthConfig{
+			Test:        containerConfig.Healthcheck.Test,
+			Interval:    containerConfig.Healthcheck.Interval,
+			Timeout:     containerConfig.Healthcheck.Timeout,
+			StartPeriod: containerConfig.Healthcheck.StartPeriod,
+			Retries:     containerConfig.Healthcheck.Retries,
+		}
 	}
 
 	cliHostConfig := &container.HostConfig{
-		Privileged: containerConfig.Privileged,
+		Privileged:     containerConfig.Privileged,
+		CapAdd:         containerConfig.CapAdd,
+		CapDrop:        containerConfig.CapDrop,
+		ReadonlyRootfs: containerConfig.ReadOnlyRootfs,
+		ShmSize:        containerConfig.ShmSizeBytes,
+		Sysctls:        containerConfig.Sysctls,
+	}
+	cliHostConfig.Ulimits = dockerUlimits(d.defaultUlimits, containerConfig.Ulimits)
+	if containerConfig.SeccompProfilePath != "" {
+		// like the docker cli, pass the profile content and not its path
+		seccompProfile, err := readSeccompProfile(containerConfig.SeccompProfilePath)
+		if err != nil {
+			return nil, nil, errors.WithStack(err)
+		}
+		cliHostConfig.SecurityOpt = append(cliHostConfig.SecurityOpt, "seccomp="+seccompProfile)
+	}
+	if containerConfig.RestartPolicy != nil {
+		cliHostConfig.RestartPolicy = container.RestartPolicy{
+			Name:              string(containerConfig.RestartPolicy.Name),
+			MaximumRetryCount: containerConfig.RestartPolicy.MaximumRetryCount,
+		}
+	}
+	if containerConfig.AppArmorProfile != "" {
+		cliHostConfig.SecurityOpt = append(cliHostConfig.SecurityOpt, "apparmor="+containerConfig.AppArmorProfile)
 	}
 	if index == 0 {
 		// main container requires the initvolume containing the toolbox
 		// TODO(sgotti) migrate this to cliHostConfig.Mounts
 		cliHostConfig.Binds = []string{fmt.Sprintf("%s:%s", toolboxVol.Name, podConfig.InitVolumeDir)}
 		cliHostConfig.ReadonlyPaths = []string{fmt.Sprintf("%s:%s", toolboxVol.Name, podConfig.InitVolumeDir)}
+		// other containers share the main container network namespace, hosts
+		// and resolv.conf files
+		cliHostConfig.ExtraHosts = podExtraHosts(podConfig)
+		if podConfig.DNS != nil {
+			cliHostConfig.DNS = podConfig.DNS.Servers
+			cliHostConfig.DNSSearch = podConfig.DNS.Searches
+			cliHostConfig.DNSOptions = podConfig.DNS.Options
+		}
+		if len(podConfig.Secrets) > 0 {
+			if cliHostConfig.Tmpfs == nil {
+				cliHostConfig.Tmpfs = map[string]string{}
+			}
+			cliHostConfig.Tmpfs[podSecretsDir] = secretsTmpfsOptions(containerConfig.User)
+		}
 	} else {
 		// attach other containers to maincontainer network
 		cliHostConfig.NetworkMode = container.NetworkMode(fmt.Sprintf("container:%s", maincontainerID))
@@ -324,6 +2133,19 @@ func (d *DockerDriver) createContainer(ctx context.Context, index int, podConfig
 
 	for _, vol := range containerConfig.Volumes {
 		if vol.TmpFS != nil {
+			if d.tmpfsNoExec && !vol.TmpFS.AllowExec {
+				// mount.TmpfsOptions doesn't support mount options so use
+				// the HostConfig Tmpfs
+				if cliHostConfig.Tmpfs == nil {
+					cliHostConfig.Tmpfs = map[string]string{}
+				}
+				options := "rw,noexec,nosuid"
+				if vol.TmpFS.Size != 0 {
+					options += fmt.Sprintf(",size=%d", vol.TmpFS.Size)
+				}
+				cliHostConfig.Tmpfs[vol.Path] = options
+				continue
+			}
 			mounts = append(mounts, mount.Mount{
 				Type:   mount.TypeTmpfs,
 				Target: vol.Path,
@@ -331,16 +2153,32 @@ func (d *DockerDriver) createContainer(ctx context.Context, index int, podConfig
 					SizeBytes: vol.TmpFS.Size,
 				},
 			})
+		} else if vol.Persistent != nil {
+			name, err := d.ensurePersistentVolume(ctx, vol.Persistent.CacheKey)
+			if err != nil {
+				return nil, nil, errors.WithStack(err)
+			}
+			mounts = append(mounts, mount.Mount{
+				Type:   mount.TypeVolume,
+				Source: name,
+				Target: vol.Path,
+			})
+		} else if vol.Bind != nil {
+			mounts = append(mounts, mount.Mount{
+				Type:     mount.TypeBind,
+				Source:   vol.Bind.Source,
+				Target:   vol.Path,
+				ReadOnly: vol.Bind.ReadOnly,
+			})
 		} else {
-			return nil, errors.Errorf("missing volume config")
+			return nil, nil, errors.Errorf("missing volume config")
 		}
 	}
 	if mounts != nil {
 		cliHostConfig.Mounts = mounts
 	}
 
-	resp, err := d.client.ContainerCreate(ctx, cliContainerConfig, cliHostConfig, nil, "")
-	return &resp, errors.WithStack(err)
+	return cliContainerConfig, cliHostConfig, nil
 }
 
 func (d *DockerDriver) ExecutorGroup(ctx context.Context) (string, error) {
@@ -370,7 +2208,26 @@ func (d *DockerDriver) GetPods(ctx context.Context, all bool) ([]Pod, error) {
 	}
 
 	podsMap := map[string]*DockerPod{}
+	addPod := func(podID string) {
+		if _, ok := podsMap[podID]; !ok {
+			pod := &DockerPod{
+				id:                podID,
+				client:            d.client,
+				executorID:        d.executorID,
+				stopTimeout:       d.stopTimeout,
+				stopOrder:         d.stopOrder,
+				tracer:            d.tracer,
+				toolboxVolumePool: d.toolboxVolumePool,
+				containers:        []*DockerContainer{},
+				containersMap:     map[string]*DockerContainer{},
+				// TODO(sgotti) initvolumeDir isn't set
+			}
+			podsMap[podID] = pod
+		}
+	}
+	containersByID := map[string]dockertypes.Container{}
 	for _, container := range containers {
+		containersByID[container.ID] = container
 		executorID, ok := container.Labels[executorIDKey]
 		if !ok || executorID != d.executorID {
 			// skip container
@@ -381,16 +2238,7 @@ func (d *DockerDriver) GetPods(ctx context.Context, all bool) ([]Pod, error) {
 			// skip container
 			continue
 		}
-		if _, ok := podsMap[podID]; !ok {
-			pod := &DockerPod{
-				id:         podID,
-				client:     d.client,
-				executorID: d.executorID,
-				containers: []*DockerContainer{},
-				// TODO(sgotti) initvolumeDir isn't set
-			}
-			podsMap[podID] = pod
-		}
+		addPod(podID)
 	}
 
 	for _, container := range containers {
@@ -418,22 +2266,29 @@ func (d *DockerDriver) GetPods(ctx context.Context, all bool) ([]Pod, error) {
 		pod := podsMap[podID]
 		dContainer := &DockerContainer{
 			Index:     cIndex,
+			Name:      podContainerName(cIndex, container.Labels[containerNameKey]),
 			Container: container,
 		}
 		pod.containers = append(pod.containers, dContainer)
+		pod.containersMap[dContainer.Name] = dContainer
 
 		// overwrite containers with the right order
 
 		// add labels from the container with index 0
 		if cIndex == 0 {
 			podLabels := map[string]string{}
-			// keep only labels starting with our prefix
+			// keep only labels starting with our prefix and the extra labels
 			for labelName, labelValue := range container.Labels {
-				if strings.HasPrefix(labelName, labelPrefix) {
+				if _, ok := d.extraLabels[labelName]; ok || strings.HasPrefix(labelName, labelPrefix) {
 					podLabels[labelName] = labelValue
 				}
 			}
 			pod.labels = podLabels
+
+			if toolboxVolumeName, ok := container.Labels[toolboxVolumeKey]; ok {
+				pod.toolboxVolumeName = toolboxVolumeName
+				pod.pooledToolboxVol = true
+			}
 		}
 	}
 
@@ -449,6 +2304,38 @@ func (d *DockerDriver) GetPods(ctx context.Context, all bool) ([]Pod, error) {
 			continue
 		}
 
+		if containerID, ok := vol.Labels[pooledContainerKey]; ok {
+			// the pod main container is a pooled container claimed by this
+			// volume
+			container, ok := containersByID[containerID]
+			if !ok {
+				// skip vol
+				continue
+			}
+			addPod(podID)
+			pod := podsMap[podID]
+			dContainer := &DockerContainer{
+				Index:     0,
+				Name:      podContainerName(0, vol.Labels[containerNameKey]),
+				Container: container,
+			}
+			pod.containers = append(pod.containers, dContainer)
+			pod.containersMap[dContainer.Name] = dContainer
+
+			podLabels := map[string]string{}
+			// keep only labels starting with our prefix and the extra labels
+			for labelName, labelValue := range vol.Labels {
+				if _, ok := d.extraLabels[labelName]; ok || strings.HasPrefix(labelName, labelPrefix) {
+					podLabels[labelName] = labelValue
+				}
+			}
+			pod.labels = podLabels
+			pod.claimVolumeName = vol.Name
+			pod.pooledMainContainer = true
+			pod.containerPool = d.containerPools[container.Image]
+			continue
+		}
+
 		pod, ok := podsMap[podID]
 		if !ok {
 			// skip vol
@@ -472,14 +2359,29 @@ type DockerPod struct {
 	client            *client.Client
 	labels            map[string]string
 	containers        []*DockerContainer
+	containersMap     map[string]*DockerContainer
 	toolboxVolumeName string
-	executorID        string
+	// toolboxVolumePool is the warm pool where the pooled toolbox volume is
+	// returned on pod removal
+	toolboxVolumePool *warmPool
+	pooledToolboxVol  bool
+	// pooledMainContainer is true when the main container was acquired from
+	// the warm pool. It's claimed by the claimVolumeName volume and returned
+	// to the containerPool on pod removal
+	pooledMainContainer bool
+	claimVolumeName     string
+	containerPool       *warmPool
+	executorID          string
+	stopTimeout         time.Duration
+	stopOrder           StopOrder
+	tracer              trace.Tracer
 
 	initVolumeDir string
 }
 
 type DockerContainer struct {
 	Index int
+	Name  string
 	dockertypes.Container
 }
 
@@ -502,11 +2404,11 @@ func (dp *DockerPod) TaskID() string {
 }
 
 func (dp *DockerPod) Stop(ctx context.Context) error {
-	d := 1 * time.Second
+	d := dp.stopTimeout
 	errs := []error{}
-	for _, container := range dp.containers {
+	for _, container := range stopOrderContainers(dp.containers, dp.stopOrder) {
 		if err := dp.client.ContainerStop(ctx, container.ID, &d); err != nil {
-			errs = append(errs, err)
+			errs = append(errs, errors.Wrapf(err, "failed to stop container %q (index %d)", container.Name, container.Index))
 		}
 	}
 	if len(errs) != 0 {
@@ -515,15 +2417,276 @@ func (dp *DockerPod) Stop(ctx context.Context) error {
 	return nil
 }
 
+// WaitReady waits for all the pod containers to be running. It returns an
+// error if a container exited.
+func (dp *DockerPod) WaitReady(ctx context.Context) error {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, defaultWaitReadyTimeout)
+		defer cancel()
+	}
+
+	for {
+		ready := true
+		for _, container := range dp.containers {
+			inspect, err := dp.client.ContainerInspect(ctx, container.ID)
+			if err != nil {
+				if ctx.Err() != nil {
+					return errors.WithStack(ctx.Err())
+				}
+				return errors.Wrapf(err, "failed to inspect container %q", container.Name)
+			}
+			if inspect.State.Running {
+				continue
+			}
+			if inspect.State.Status == "exited" || inspect.State.Status == "dead" {
+				return containerExitedError(container.Name, inspect.State.ExitCode)
+			}
+			ready = false
+		}
+		if ready {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return errors.WithStack(ctx.Err())
+		case <-time.After(podPollInterval):
+		}
+	}
+}
+
+// ContainerStatus is the status of a pod container
+type ContainerStatus struct {
+	Index   int
+	Name    string
+	Running bool
+	// ExitCode is the container exit code, valid only when the container
+	// isn't running and FinishedAt isn't zero
+	ExitCode  int
+	OOMKilled bool
+	// StartedAt and FinishedAt are zero when the container hasn't started or
+	// finished
+	StartedAt  time.Time
+	FinishedAt time.Time
+}
+
+// InspectContainers returns the status of all the pod containers ordered by
+// index.
+func (dp *DockerPod) InspectContainers(ctx context.Context) ([]ContainerStatus, error) {
+	containers := make([]*DockerContainer, len(dp.containers))
+	copy(containers, dp.containers)
+	sort.Sort(ContainerSlice(containers))
+
+	statuses := make([]ContainerStatus, 0, len(containers))
+	for _, container := range containers {
+		status, err := dp.inspectContainer(ctx, container)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		statuses = append(statuses, *status)
+	}
+
+	return statuses, nil
+}
+
+// InspectMainContainer returns the status of the pod main container. It's
+// cheaper than InspectContainers when only the main container is needed.
+func (dp *DockerPod) InspectMainContainer(ctx context.Context) (*ContainerStatus, error) {
+	for _, container := range dp.containers {
+		if container.Index == 0 {
+			return dp.inspectContainer(ctx, container)
+		}
+	}
+
+	return nil, errors.Errorf("pod %q has no main container", dp.id)
+}
+
+func (dp *DockerPod) inspectContainer(ctx context.Context, container *DockerContainer) (*ContainerStatus, error) {
+	inspect, err := dp.client.ContainerInspect(ctx, container.ID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to inspect container %q", container.Name)
+	}
+
+	status := &ContainerStatus{
+		Index: container.Index,
+		Name:  container.Name,
+	}
+	if inspect.ContainerJSONBase == nil || inspect.State == nil {
+		return status, nil
+	}
+	state := inspect.State
+	status.Running = state.Running
+	status.ExitCode = state.ExitCode
+	status.OOMKilled = state.OOMKilled
+	// docker reports the zero time as 0001-01-01T00:00:00Z
+	if t, err := time.Parse(time.RFC3339Nano, state.StartedAt); err == nil {
+		status.StartedAt = t
+	}
+	if t, err := time.Parse(time.RFC3339Nano, state.FinishedAt); err == nil {
+		status.FinishedAt = t
+	}
+
+	return status, nil
+}
+
+// ContainerStats is a sample of a container resource usage
+type ContainerStats struct {
+	// CPUPercent is the cpu usage percentage, 100% is a full cpu
+	CPUPercent float64
+	// MemoryUsage is the memory usage in bytes, excluding the page cache
+	MemoryUsage uint64
+	// MemoryLimit is the memory limit in bytes
+	MemoryLimit uint64
+	// NetworkRx is the total of bytes received on all the networks
+	NetworkRx uint64
+	// NetworkTx is the total of bytes sent on all the networks
+	NetworkTx uint64
+}
+
+// Stats samples the pod containers resource usage. The returned stats are
+// keyed by container name. Containers that aren't running anymore are skipped.
+func (dp *DockerPod) Stats(ctx context.Context) (map[string]ContainerStats, error) {
+	podStats := make(map[string]ContainerStats, len(dp.containers))
+	for _, container := range dp.containers {
+		stats, ok, err := dp.containerStats(ctx, container.ID)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to get container %q stats", container.Name)
+		}
+		if !ok {
+			continue
+		}
+		podStats[container.Name] = stats
+	}
+
+	return podStats, nil
+}
+
+// containerStats samples the container resource usage. It returns false when
+// the container isn't running.
+func (dp *DockerPod) containerStats(ctx context.Context, containerID string) (ContainerStats, bool, error) {
+	resp, err := dp.client.ContainerStats(ctx, containerID, false)
+	if err != nil {
+		if client.IsErrNotFound(err) {
+			return ContainerStats{}, false, nil
+		}
+		return ContainerStats{}, false, errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+
+	var s dockertypes.StatsJSON
+	if err := json.NewDecoder(resp.Body).Decode(&s); err != nil {
+		return ContainerStats{}, false, errors.WithStack(err)
+	}
+	// the daemon returns an empty sample for stopped containers
+	if s.Read.IsZero() {
+		return ContainerStats{}, false, nil
+	}
+
+	stats := ContainerStats{
+		CPUPercent:  cpuPercent(&s),
+		MemoryUsage: memoryUsage(&s.MemoryStats),
+		MemoryLimit: s.MemoryStats.Limit,
+	}
+	for _, network := range s.Networks {
+		stats.NetworkRx += network.RxBytes
+		stats.NetworkTx += network.TxBytes
+	}
+
+	return stats, true, nil
+}
+
+// cpuPercent calculates the cpu usage percentage between the previous and
+// the current stats sample like the docker cli does
+func cpuPercent(s *dockertypes.StatsJSON) float64 {
+	cpuDelta := float64(s.CPUStats.CPUUsage.TotalUsage) - float64(s.PreCPUStats.CPUUsage.TotalUsage)
+	systemDelta := float64(s.CPUStats.SystemUsage) - float64(s.PreCPUStats.SystemUsage)
+	if cpuDelta <= 0 || systemDelta <= 0 {
+		return 0
+	}
+
+	onlineCPUs := float64(s.CPUStats.OnlineCPUs)
+	if onlineCPUs == 0 {
+		onlineCPUs = float64(len(s.CPUStats.CPUUsage.PercpuUsage))
+	}
+
+	return cpuDelta / systemDelta * onlineCPUs * 100
+}
+
+// memoryUsage returns the memory usage excluding the inactive page cache like
+// the docker cli does (the stats key is "total_inactive_file" on cgroup v1
+// and "inactive_file" on cgroup v2)
+func memoryUsage(s *dockertypes.MemoryStats) uint64 {
+	inactive, ok := s.Stats["total_inactive_file"]
+	if !ok {
+		inactive = s.Stats["inactive_file"]
+	}
+	if inactive > s.Usage {
+		return s.Usage
+	}
+	return s.Usage - inactive
+}
+
+// stopOrderContainers returns the containers, ordered by index, in the
+// provided stop order
+func stopOrderContainers(containers []*DockerContainer, order StopOrder) []*DockerContainer {
+	ordered := make([]*DockerContainer, len(containers))
+	copy(ordered, containers)
+	sort.Sort(ContainerSlice(ordered))
+	if order == StopOrderForward {
+		return ordered
+	}
+	for i, j := 0, len(ordered)-1; i < j; i, j = i+1, j-1 {
+		ordered[i], ordered[j] = ordered[j], ordered[i]
+	}
+	return ordered
+}
+
 func (dp *DockerPod) Remove(ctx context.Context) error {
+	ctx, span := startSpan(ctx, dp.tracer, "driver.Remove", spanAttrPodID.String(dp.id), spanAttrTaskID.String(dp.TaskID()))
+	err := dp.remove(ctx)
+	span.end(err)
+
+	return err
+}
+
+func (dp *DockerPod) remove(ctx context.Context) error {
 	errs := []error{}
 	for _, container := range dp.containers {
+		if container.Index == 0 && dp.pooledMainContainer {
+			continue
+		}
 		if err := dp.client.ContainerRemove(ctx, container.ID, dockertypes.ContainerRemoveOptions{Force: true}); err != nil {
 			errs = append(errs, err)
 		}
 	}
+	// remove the claim before releasing the pooled container: if the executor
+	// stops in the meantime the unclaimed container is removed at setup
+	if dp.claimVolumeName != "" {
+		if err := dp.client.VolumeRemove(ctx, dp.claimVolumeName, true); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if dp.pooledMainContainer {
+		for _, container := range dp.containers {
+			if container.Index != 0 {
+				continue
+			}
+			if dp.containerPool != nil {
+				if err := dp.containerPool.release(ctx, container.ID); err != nil {
+					errs = append(errs, err)
+				}
+			} else if err := removePooledContainer(ctx, dp.client, container.ID); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
 	if dp.toolboxVolumeName != "" {
-		if err := dp.client.VolumeRemove(ctx, dp.toolboxVolumeName, true); err != nil {
+		if dp.pooledToolboxVol && dp.toolboxVolumePool != nil {
+			if err := dp.toolboxVolumePool.release(ctx, dp.toolboxVolumeName); err != nil {
+				errs = append(errs, err)
+			}
+		} else if err := dp.client.VolumeRemove(ctx, dp.toolboxVolumeName, true); err != nil {
 			errs = append(errs, err)
 		}
 	}
@@ -533,44 +2696,474 @@ func (dp *DockerPod) Remove(ctx context.Context) error {
 	return nil
 }
 
+// CopyFromContainer returns a tar stream of the srcPath content inside the pod
+// container with the provided name.
+func (dp *DockerPod) CopyFromContainer(ctx context.Context, containerName, srcPath string) (io.ReadCloser, error) {
+	container, ok := dp.containersMap[containerName]
+	if !ok {
+		return nil, util.NewAPIError(util.ErrNotExist, errors.Errorf("container %q doesn't exist in pod %q", containerName, dp.id))
+	}
+
+	rc, _, err := dp.client.CopyFromContainer(ctx, container.ID, srcPath)
+	if err != nil {
+		if client.IsErrNotFound(err) {
+			return nil, util.NewAPIError(util.ErrNotExist, errors.Wrapf(err, "path %q doesn't exist in container %q", srcPath, containerName))
+		}
+		return nil, errors.WithStack(err)
+	}
+
+	return rc, nil
+}
+
+// ContainerChangeKind is the kind of a container filesystem change
+type ContainerChangeKind string
+
+const (
+	ContainerChangeModified ContainerChangeKind = "modified"
+	ContainerChangeAdded    ContainerChangeKind = "added"
+	ContainerChangeDeleted  ContainerChangeKind = "deleted"
+)
+
+// ContainerChange is a path changed in the container filesystem
+type ContainerChange struct {
+	Kind ContainerChangeKind
+	Path string
+}
+
+// containerChangeKinds maps the docker change kinds to the container change
+// kinds
+var containerChangeKinds = map[uint8]ContainerChangeKind{
+	0: ContainerChangeModified,
+	1: ContainerChangeAdded,
+	2: ContainerChangeDeleted,
+}
+
+// ContainerDiff returns the paths changed in the container filesystem compared
+// to its image. Changes inside volumes aren't reported.
+func (dp *DockerPod) ContainerDiff(ctx context.Context, containerName string) ([]ContainerChange, error) {
+	container, ok := dp.containersMap[containerName]
+	if !ok {
+		return nil, util.NewAPIError(util.ErrNotExist, errors.Errorf("container %q doesn't exist in pod %q", containerName, dp.id))
+	}
+
+	items, err := dp.client.ContainerDiff(ctx, container.ID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get container %q changes", containerName)
+	}
+
+	changes := make([]ContainerChange, 0, len(items))
+	for _, item := range items {
+		kind, ok := containerChangeKinds[item.Kind]
+		if !ok {
+			return nil, errors.Errorf("unknown container change kind %d for path %q", item.Kind, item.Path)
+		}
+		changes = append(changes, ContainerChange{Kind: kind, Path: item.Path})
+	}
+
+	return changes, nil
+}
+
+// PodEventKind is the kind of a pod container lifecycle event
+type PodEventKind string
+
+const (
+	PodEventDie          PodEventKind = "die"
+	PodEventOOM          PodEventKind = "oom"
+	PodEventHealthStatus PodEventKind = "health_status"
+)
+
+// PodEvent is a lifecycle event of a pod container
+type PodEvent struct {
+	Kind           PodEventKind
+	ContainerName  string
+	ContainerIndex int
+	Time           time.Time
+	// ExitCode is the container exit code, set on die events
+	ExitCode int
+	// HealthStatus is the container new health status, set on health_status
+	// events
+	HealthStatus string
+}
+
+// Events returns a channel receiving the die, oom and health_status events of
+// the pod containers. The channel is closed when ctx is done or the docker
+// events stream fails.
+func (dp *DockerPod) Events(ctx context.Context) (<-chan PodEvent, error) {
+	args := filters.NewArgs()
+	args.Add("type", "container")
+	args.Add("label", fmt.Sprintf("%s=%s", executorIDKey, dp.executorID))
+	if dp.pooledMainContainer {
+		// the pooled main container doesn't have the pod id label
+		for _, container := range dp.containers {
+			args.Add("container", container.ID)
+		}
+	} else {
+		args.Add("label", fmt.Sprintf("%s=%s", podIDKey, dp.id))
+	}
+	for _, kind := range []PodEventKind{PodEventDie, PodEventOOM, PodEventHealthStatus} {
+		args.Add("event", string(kind))
+	}
+
+	containers := map[string]*DockerContainer{}
+	for _, container := range dp.containers {
+		containers[container.ID] = container
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	msgs, errs := dp.client.Events(ctx, dockertypes.EventsOptions{Filters: args})
+
+	ch := make(chan PodEvent)
+	go func() {
+		defer close(ch)
+		// stop the events stream when exiting on errors
+		defer cancel()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-errs:
+				return
+			case msg := <-msgs:
+				container, ok := containers[msg.Actor.ID]
+				if !ok {
+					continue
+				}
+				event, ok := podEvent(msg)
+				if !ok {
+					continue
+				}
+				event.ContainerName = container.Name
+				event.ContainerIndex = container.Index
+
+				select {
+				case ch <- event:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	return ch, nil
+}
+
+// podEvent converts a docker container event to a PodEvent. It returns false
+// for unhandled events.
+func podEvent(msg events.Message) (PodEvent, bool) {
+	event := PodEvent{Time: time.Unix(0, msg.TimeNano)}
+
+	// the health_status action also contains the new status (i.e.
+	// "health_status: healthy")
+	action := msg.Action
+	var actionValue string
+	if i := strings.Index(action, ":"); i >= 0 {
+		action, actionValue = action[:i], strings.TrimSpace(action[i+1:])
+	}
+
+	switch PodEventKind(action) {
+	case PodEventDie:
+		event.Kind = PodEventDie
+		exitCode, err := strconv.Atoi(msg.Actor.Attributes["exitCode"])
+		if err != nil {
+			return PodEvent{}, false
+		}
+		event.ExitCode = exitCode
+	case PodEventOOM:
+		event.Kind = PodEventOOM
+	case PodEventHealthStatus:
+		event.Kind = PodEventHealthStatus
+		event.HealthStatus = actionValue
+	default:
+		return PodEvent{}, false
+	}
+
+	return event, true
+}
+
+// ContainerLogs returns the stdout and stderr logs of the pod container with
+// the provided name. When since isn't zero only the logs produced after it are
+// returned. Every log line is prefixed with the container index so logs of
+// different containers can be interleaved while remaining attributable.
+func (dp *DockerPod) ContainerLogs(ctx context.Context, containerName string, follow bool, since time.Time) (io.ReadCloser, error) {
+	container, ok := dp.containersMap[containerName]
+	if !ok {
+		return nil, util.NewAPIError(util.ErrNotExist, errors.Errorf("container %q doesn't exist in pod %q", containerName, dp.id))
+	}
+
+	info, err := dp.client.ContainerInspect(ctx, container.ID)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	tty := info.Config != nil && info.Config.Tty
+
+	options := dockertypes.ContainerLogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+		Follow:     follow,
+	}
+	if !since.IsZero() {
+		options.Since = since.Format(time.RFC3339Nano)
+	}
+	rc, err := dp.client.ContainerLogs(ctx, container.ID, options)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		w := &linePrefixWriter{w: pw, prefix: []byte(fmt.Sprintf("[%d] ", container.Index)), lineStart: true}
+		var err error
+		// when the container isn't using a tty stdout and stderr are
+		// multiplexed in the same stream
+		if tty {
+			_, err = io.Copy(w, rc)
+		} else {
+			_, err = stdcopy.StdCopy(w, w, rc)
+		}
+		rc.Close()
+		pw.CloseWithError(err)
+	}()
+
+	return &containerLogsReader{PipeReader: pr, rc: rc}, nil
+}
+
+// containerLogsReader closes also the underlying docker logs stream so a
+// following copy will be stopped.
+type containerLogsReader struct {
+	*io.PipeReader
+	rc io.Closer
+}
+
+func (r *containerLogsReader) Close() error {
+	r.rc.Close()
+	return r.PipeReader.Close()
+}
+
+// linePrefixWriter writes the prefix at the start of every line
+type linePrefixWriter struct {
+	w         io.Writer
+	prefix    []byte
+	lineStart bool
+}
+
+func (l *linePrefixWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		if l.lineStart {
+			if _, err := l.w.Write(l.prefix); err != nil {
+				return n, err
+			}
+			l.lineStart = false
+		}
+
+		i := bytes.IndexByte(p, '\n')
+		chunk := p
+		if i >= 0 {
+			chunk = p[:i+1]
+			l.lineStart = true
+		}
+		cn, err := l.w.Write(chunk)
+		n += cn
+		if err != nil {
+			return n, err
+		}
+		p = p[len(chunk):]
+	}
+
+	return n, nil
+}
+
 type DockerContainerExec struct {
-	execID string
-	hresp  *dockertypes.HijackedResponse
-	client *client.Client
-	endCh  chan error
+	execID      string
+	containerID string
+	tty         bool
+	oomKilled   bool
+	hresp       *dockertypes.HijackedResponse
+	client      *client.Client
+	endCh       chan error
 
 	stdin io.WriteCloser
 }
 
-// Stdin is a wrapped HikackedResponse implementing io.WriteCloser so users can
+const (
+	// stdinChunkSize is the max size of a chunk queued to the exec stdin
+	stdinChunkSize = 32 * 1024
+	// stdinQueueChunks is the max number of chunks queued to the exec stdin
+	// before Write blocks
+	stdinQueueChunks = 8
+)
+
+// Stdin is a wrapped HijackedResponse implementing io.WriteCloser so users can
 // easily close stdin. Internally it will close only the write side of the conn.
+//
+// Writes are queued in a bounded queue and written to the conn by a dedicated
+// goroutine, so Write blocks when the queue is full (the exec isn't consuming
+// its stdin fast enough) and returns an error when the exec has exited or
+// writing to the conn failed. The goroutine is started by the first Write and
+// exits when the exec exits, so execs not using stdin don't start it.
 type Stdin struct {
 	hresp *dockertypes.HijackedResponse
+
+	// mu serializes Write and Close
+	mu            sync.Mutex
+	closed        bool
+	writerStarted bool
+
+	queue chan []byte
+	// execDoneCh is closed when the exec has exited
+	execDoneCh chan struct{}
+	// writerDoneCh is closed when the writer goroutine has exited, after
+	// setting writerErr
+	writerDoneCh chan struct{}
+	writerErr    error
+}
+
+func newStdin(hresp *dockertypes.HijackedResponse, execDoneCh chan struct{}) *Stdin {
+	return &Stdin{
+		hresp:        hresp,
+		queue:        make(chan []byte, stdinQueueChunks),
+		execDoneCh:   execDoneCh,
+		writerDoneCh: make(chan struct{}),
+	}
+}
+
+func (s *Stdin) writer() {
+	defer close(s.writerDoneCh)
+
+	for {
+		select {
+		case chunk, ok := <-s.queue:
+			if !ok {
+				// the queue was closed and flushed, close the write side of the conn
+				if err := s.hresp.CloseWrite(); err != nil {
+					s.writerErr = errors.WithStack(err)
+				}
+				return
+			}
+			if _, err := s.hresp.Conn.Write(chunk); err != nil {
+				s.writerErr = errors.Wrapf(err, "failed to write to exec stdin")
+				return
+			}
+		case <-s.execDoneCh:
+			if len(s.queue) > 0 {
+				s.writerErr = errors.Wrapf(io.ErrClosedPipe, "exec exited before all the stdin data was written")
+			}
+			return
+		}
+	}
+}
+
+// writerExitErr returns the error reported by Write after the writer exited
+func (s *Stdin) writerExitErr() error {
+	if s.writerErr != nil {
+		return errors.WithStack(s.writerErr)
+	}
+
+	return errors.Wrapf(io.ErrClosedPipe, "exec exited")
 }
 
 func (s *Stdin) Write(p []byte) (int, error) {
-	n, err := s.hresp.Conn.Write(p)
-	return n, errors.WithStack(err)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return 0, errors.WithStack(io.ErrClosedPipe)
+	}
+
+	if !s.writerStarted {
+		s.writerStarted = true
+		go s.writer()
+	}
+
+	var n int
+	for len(p) > 0 {
+		size := len(p)
+		if size > stdinChunkSize {
+			size = stdinChunkSize
+		}
+		// copy the chunk since the caller can reuse p after Write returns
+		chunk := make([]byte, size)
+		copy(chunk, p)
+
+		// report a writer failure also when the queue has free space
+		select {
+		case <-s.writerDoneCh:
+			return n, s.writerExitErr()
+		default:
+		}
+
+		select {
+		case s.queue <- chunk:
+		case <-s.writerDoneCh:
+			return n, s.writerExitErr()
+		case <-s.execDoneCh:
+			return n, errors.Wrapf(io.ErrClosedPipe, "exec exited")
+		}
+
+		n += size
+		p = p[size:]
+	}
+
+	return n, nil
 }
 
+// Close flushes the queued data and closes the write side of the conn. If the
+// exec exits before all the queued data is written it returns an error.
 func (s *Stdin) Close() error {
-	return errors.WithStack(s.hresp.CloseWrite())
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+
+	if !s.writerStarted {
+		select {
+		case <-s.execDoneCh:
+			return nil
+		default:
+		}
+		return errors.WithStack(s.hresp.CloseWrite())
+	}
+
+	close(s.queue)
+
+	select {
+	case <-s.writerDoneCh:
+	case <-s.execDoneCh:
+		// release the writer if it's blocked writing to the conn, the exec
+		// has exited so the conn won't be used anymore
+		s.hresp.Close()
+		<-s.writerDoneCh
+	}
+
+	return errors.WithStack(s.writerErr)
 }
 
+// Exec starts the exec. Its span ends when the exec exits.
 func (dp *DockerPod) Exec(ctx context.Context, execConfig *ExecConfig) (ContainerExec, error) {
+	ctx, span := startSpan(ctx, dp.tracer, "driver.Exec", spanAttrPodID.String(dp.id), spanAttrTaskID.String(dp.TaskID()))
+	exec, err := dp.exec(ctx, execConfig, span)
+	if err != nil {
+		span.end(err)
+	}
+
+	return exec, err
+}
+
+func (dp *DockerPod) exec(ctx context.Context, execConfig *ExecConfig, span *driverSpan) (ContainerExec, error) {
 	endCh := make(chan error)
 
 	// old docker versions doesn't support providing Env (before api 1.25) and
 	// WorkingDir (before api 1.35) in exec command.
 	// Use a toolbox command that will set them up and then exec the real command.
-	envj, err := json.Marshal(execConfig.Env)
+	cmd, err := toolboxExecCmd(dp.initVolumeDir, execConfig)
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
 
-	cmd := []string{filepath.Join(dp.initVolumeDir, "agola-toolbox"), "exec", "-e", string(envj), "-w", execConfig.WorkingDir, "--"}
-	cmd = append(cmd, execConfig.Cmd...)
-
 	dockerExecConfig := dockertypes.ExecConfig{
 		Cmd:          cmd,
 		Tty:          execConfig.Tty,
@@ -593,15 +3186,17 @@ func (dp *DockerPod) Exec(ctx context.Context, execConfig *ExecConfig) (Containe
 		return nil, errors.WithStack(err)
 	}
 
-	stdout := execConfig.Stdout
-	stderr := execConfig.Stderr
-	if execConfig.Stdout == nil {
+	stdout, stderr := execOutput(execConfig)
+	if stdout == nil {
 		stdout = ioutil.Discard
 	}
-	if execConfig.Stderr == nil {
+	if stderr == nil {
 		stderr = ioutil.Discard
 	}
 
+	// closed when the exec output ends, meaning the exec has exited
+	execDoneCh := make(chan struct{})
+
 	// copy both stdout and stderr to out file
 	go func() {
 		var err error
@@ -610,19 +3205,21 @@ func (dp *DockerPod) Exec(ctx context.Context, execConfig *ExecConfig) (Containe
 		} else {
 			_, err = stdcopy.StdCopy(stdout, stderr, hresp.Reader)
 		}
+		close(execDoneCh)
+		span.end(err)
 		endCh <- err
 	}()
 
-	stdin := &Stdin{
-		hresp: &hresp,
-	}
+	stdin := newStdin(&hresp, execDoneCh)
 
 	return &DockerContainerExec{
-		execID: response.ID,
-		hresp:  &hresp,
-		client: dp.client,
-		stdin:  stdin,
-		endCh:  endCh,
+		execID:      response.ID,
+		containerID: dp.containers[0].ID,
+		tty:         execConfig.Tty,
+		hresp:       &hresp,
+		client:      dp.client,
+		stdin:       stdin,
+		endCh:       endCh,
 	}, nil
 }
 
@@ -647,15 +3244,41 @@ func (e *DockerContainerExec) Wait(ctx context.Context) (int, error) {
 		time.Sleep(500 * time.Millisecond)
 	}
 
+	// check if the container was OOM killed. This is best effort: on
+	// inspection errors just report the exec exit code
+	if info, err := e.client.ContainerInspect(ctx, e.containerID); err == nil && info.ContainerJSONBase != nil && info.State != nil {
+		e.oomKilled = info.State.OOMKilled
+	}
+
 	e.hresp.Close()
 
 	return exitCode, nil
 }
 
+// OOMKilled reports whether, after Wait returned, the exec container was found
+// OOM killed.
+func (e *DockerContainerExec) OOMKilled() bool {
+	return e.oomKilled
+}
+
 func (e *DockerContainerExec) Stdin() io.WriteCloser {
 	return e.stdin
 }
 
+// Resize resizes the exec tty to the provided size. It's meant to keep the
+// exec tty in sync with a local terminal (i.e. on SIGWINCH).
+func (e *DockerContainerExec) Resize(ctx context.Context, height, width uint) error {
+	if !e.tty {
+		return util.NewAPIError(util.ErrBadRequest, errors.Errorf("cannot resize exec %q: exec has no tty", e.execID))
+	}
+
+	if err := e.client.ContainerExecResize(ctx, e.execID, dockertypes.ResizeOptions{Height: height, Width: width}); err != nil {
+		return errors.WithStack(err)
+	}
+
+	return nil
+}
+
 func makeEnvSlice(env map[string]string) []string {
 	envList := make([]string, 0, len(env))
 	for k, v := range env {
@@ -17,18 +17,154 @@ package driver
 import (
 	"bytes"
 	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"agola.io/agola/internal/errors"
+	"agola.io/agola/internal/services/executor/registry"
 	"agola.io/agola/internal/testutil"
+	"agola.io/agola/internal/util"
+	stypes "agola.io/agola/services/types"
 
 	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/api/types/strslice"
+	"github.com/docker/docker/api/types/volume"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
+	units "github.com/docker/go-units"
 	"github.com/gofrs/uuid"
 	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// newFakeToolboxDir creates a toolbox dir with fake toolbox binaries for the
+// provided archs
+func newFakeToolboxDir(t *testing.T, archs ...stypes.Arch) string {
+	dir := t.TempDir()
+	for _, arch := range archs {
+		if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("%s-linux-%s", toolboxPrefix, arch)), []byte("toolbox"), 0755); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+	}
+
+	return dir
+}
+
+// newFakeDockerDriver returns a docker driver whose client talks to a fake
+// docker daemon implemented by the provided handler.
+func newFakeDockerDriver(t *testing.T, handler http.Handler, options ...DockerDriverOption) *DockerDriver {
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+
+	cli, err := client.NewClientWithOpts(client.WithHost("tcp://"+strings.TrimPrefix(srv.URL, "http://")), client.WithVersion("1.26"))
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	d := &DockerDriver{
+		log:         zerolog.Nop(),
+		client:      cli,
+		executorID:  "executorid01",
+		toolboxPath: newFakeToolboxDir(t, "amd64"),
+		arch:        "amd64",
+		stopTimeout: defaultStopTimeout,
+		stopOrder:   StopOrderReverse,
+		tmpfsNoExec: true,
+
+		orphanedVolumesGracePeriod: defaultOrphanedVolumesGracePeriod,
+	}
+	for _, opt := range options {
+		opt(d)
+	}
+
+	return d
+}
+
+func TestNewDockerDriverClientOptions(t *testing.T) {
+	dir := t.TempDir()
+
+	tests := []struct {
+		name            string
+		options         []DockerDriverOption
+		expectedHost    string
+		expectedVersion string
+		expectedErr     string
+	}{
+		{
+			name:            "test host and api version",
+			options:         []DockerDriverOption{WithDockerDriverHost("tcp://docker.example.com:2376"), WithDockerDriverAPIVersion("1.40")},
+			expectedHost:    "tcp://docker.example.com:2376",
+			expectedVersion: "1.40",
+		},
+		{
+			name:            "test default api version",
+			options:         []DockerDriverOption{WithDockerDriverHost("unix:///var/run/docker.sock")},
+			expectedHost:    "unix:///var/run/docker.sock",
+			expectedVersion: defaultAPIVersion,
+		},
+		{
+			name:        "test missing tls files",
+			options:     []DockerDriverOption{WithDockerDriverHost("tcp://docker.example.com:2376"), WithDockerDriverTLS(filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"), filepath.Join(dir, "ca.pem"))},
+			expectedErr: fmt.Sprintf("invalid docker tls file %q: stat %s: no such file or directory", filepath.Join(dir, "cert.pem"), filepath.Join(dir, "cert.pem")),
+		},
+		{
+			name:        "test extra label with reserved prefix",
+			options:     []DockerDriverOption{WithDockerDriverExtraLabels(map[string]string{"team": "team01", "agola.io/podid": "podid01"})},
+			expectedErr: `extra label "agola.io/podid" uses the reserved "agola.io/" prefix`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := NewDockerDriver(zerolog.Nop(), "executorid01", "/agola-toolbox", "busybox:stable", nil, tt.options...)
+			if tt.expectedErr != "" {
+				if err == nil {
+					t.Fatalf("expected err %q, got nil", tt.expectedErr)
+				}
+				if err.Error() != tt.expectedErr {
+					t.Fatalf("expected err %q, got %q", tt.expectedErr, err.Error())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+
+			if d.client.DaemonHost() != tt.expectedHost {
+				t.Fatalf("expected host %q, got %q", tt.expectedHost, d.client.DaemonHost())
+			}
+			if d.client.ClientVersion() != tt.expectedVersion {
+				t.Fatalf("expected api version %q, got %q", tt.expectedVersion, d.client.ClientVersion())
+			}
+		})
+	}
+}
+
 func TestDockerPod(t *testing.T) {
 	if os.Getenv("SKIP_DOCKER_TESTS") == "1" {
 		t.Skip("skipping since env var SKIP_DOCKER_TESTS is 1")
@@ -104,6 +240,130 @@ func TestDockerPod(t *testing.T) {
 		}
 	})
 
+	t.Run("execute a command inside a pod with an unexistent working dir", func(t *testing.T) {
+		pod, err := d.NewPod(ctx, &PodConfig{
+			ID:     uuid.Must(uuid.NewV4()).String(),
+			TaskID: uuid.Must(uuid.NewV4()).String(),
+			Containers: []*ContainerConfig{
+				&ContainerConfig{
+					Cmd:   []string{"cat"},
+					Image: "busybox",
+				},
+			},
+			InitVolumeDir: "/tmp/agola",
+		}, ioutil.Discard)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		defer func() { _ = pod.Remove(ctx) }()
+
+		var buf bytes.Buffer
+		ce, err := pod.Exec(ctx, &ExecConfig{
+			Cmd:        []string{"pwd"},
+			WorkingDir: "/tmp/unexistent/workingdir",
+			Stdout:     &buf,
+		})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+
+		code, err := ce.Wait(ctx)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if code != 0 {
+			t.Fatalf("unexpected exit code: %d", code)
+		}
+		if strings.TrimSpace(buf.String()) != "/tmp/unexistent/workingdir" {
+			t.Fatalf("unexpected working dir: %q", buf.String())
+		}
+	})
+
+	t.Run("test pod with extra hosts", func(t *testing.T) {
+		pod, err := d.NewPod(ctx, &PodConfig{
+			ID:     uuid.Must(uuid.NewV4()).String(),
+			TaskID: uuid.Must(uuid.NewV4()).String(),
+			Containers: []*ContainerConfig{
+				&ContainerConfig{
+					Cmd:        []string{"cat"},
+					Image:      "busybox",
+					ExtraHosts: []string{"db.internal:10.0.0.1"},
+				},
+			},
+			InitVolumeDir: "/tmp/agola",
+		}, ioutil.Discard)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		defer func() { _ = pod.Remove(ctx) }()
+
+		var buf bytes.Buffer
+		ce, err := pod.Exec(ctx, &ExecConfig{
+			Cmd:    []string{"cat", "/etc/hosts"},
+			Stdout: &buf,
+		})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+
+		code, err := ce.Wait(ctx)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if code != 0 {
+			t.Fatalf("unexpected exit code: %d", code)
+		}
+		if !strings.Contains(buf.String(), "10.0.0.1\tdb.internal") {
+			t.Fatalf("expected extra host in hosts file, got: %q", buf.String())
+		}
+	})
+
+	t.Run("test pod with container aliases", func(t *testing.T) {
+		pod, err := d.NewPod(ctx, &PodConfig{
+			ID:     uuid.Must(uuid.NewV4()).String(),
+			TaskID: uuid.Must(uuid.NewV4()).String(),
+			Containers: []*ContainerConfig{
+				&ContainerConfig{
+					Cmd:   []string{"cat"},
+					Image: "busybox",
+				},
+				&ContainerConfig{
+					Name:    "redis",
+					Cmd:     []string{"cat"},
+					Image:   "busybox",
+					Aliases: []string{"redis", "cache.internal"},
+				},
+			},
+			InitVolumeDir: "/tmp/agola",
+		}, ioutil.Discard)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		defer func() { _ = pod.Remove(ctx) }()
+
+		for _, alias := range []string{"redis", "cache.internal"} {
+			var buf bytes.Buffer
+			ce, err := pod.Exec(ctx, &ExecConfig{
+				Cmd:    []string{"nslookup", alias},
+				Stdout: &buf,
+			})
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+
+			code, err := ce.Wait(ctx)
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			if code != 0 {
+				t.Fatalf("unexpected exit code: %d", code)
+			}
+			if !strings.Contains(buf.String(), "127.0.0.1") {
+				t.Fatalf("expected alias %q resolving to 127.0.0.1, got: %q", alias, buf.String())
+			}
+		}
+	})
+
 	t.Run("test pod environment", func(t *testing.T) {
 		env := map[string]string{
 			"ENV01": "ENVVALUE01",
@@ -161,6 +421,108 @@ func TestDockerPod(t *testing.T) {
 		}
 	})
 
+	t.Run("test pod exec environment inheritance", func(t *testing.T) {
+		pod, err := d.NewPod(ctx, &PodConfig{
+			ID:     uuid.Must(uuid.NewV4()).String(),
+			TaskID: uuid.Must(uuid.NewV4()).String(),
+			Containers: []*ContainerConfig{
+				&ContainerConfig{
+					Cmd:   []string{"cat"},
+					Image: "busybox",
+					Env:   map[string]string{"CONTAINERENV": "CONTAINERVALUE"},
+				},
+			},
+			InitVolumeDir: "/tmp/agola",
+		}, ioutil.Discard)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		defer func() { _ = pod.Remove(ctx) }()
+
+		for _, inherit := range []bool{true, false} {
+			var buf bytes.Buffer
+			ce, err := pod.Exec(ctx, &ExecConfig{
+				Cmd:                 []string{"/bin/env"},
+				Env:                 map[string]string{"EXECENV": "EXECVALUE"},
+				Stdout:              &buf,
+				Stderr:              &buf,
+				InheritContainerEnv: util.BoolP(inherit),
+			})
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+
+			code, err := ce.Wait(ctx)
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			if code != 0 {
+				t.Fatalf("unexpected exit code: %d", code)
+			}
+
+			curEnv, err := testutil.ParseEnvs(bytes.NewReader(buf.Bytes()))
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+
+			if curEnv["EXECENV"] != "EXECVALUE" {
+				t.Fatalf("missing env var EXECENV")
+			}
+			if _, ok := curEnv["CONTAINERENV"]; ok != inherit {
+				t.Fatalf("expected container env var inherited: %t, got env: %v", inherit, curEnv)
+			}
+		}
+	})
+
+	t.Run("test pod exec with large stdin and slow reader", func(t *testing.T) {
+		pod, err := d.NewPod(ctx, &PodConfig{
+			ID:     uuid.Must(uuid.NewV4()).String(),
+			TaskID: uuid.Must(uuid.NewV4()).String(),
+			Containers: []*ContainerConfig{
+				&ContainerConfig{
+					Cmd:   []string{"cat"},
+					Image: "busybox",
+				},
+			},
+			InitVolumeDir: "/tmp/agola",
+		}, ioutil.Discard)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		defer func() { _ = pod.Remove(ctx) }()
+
+		var buf bytes.Buffer
+		ce, err := pod.Exec(ctx, &ExecConfig{
+			Cmd:         []string{"sh", "-c", "sleep 2; wc -c"},
+			AttachStdin: true,
+			Stdout:      &buf,
+			Stderr:      &buf,
+		})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+
+		input := bytes.Repeat([]byte("0123456789abcdef"), 512*1024)
+		stdin := ce.Stdin()
+		if _, err := stdin.Write(input); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if err := stdin.Close(); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+
+		code, err := ce.Wait(ctx)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if code != 0 {
+			t.Fatalf("unexpected exit code: %d, output: %s", code, buf.String())
+		}
+		if strings.TrimSpace(buf.String()) != fmt.Sprintf("%d", len(input)) {
+			t.Fatalf("expected %d bytes read, got output: %q", len(input), buf.String())
+		}
+	})
+
 	t.Run("create a pod with two containers", func(t *testing.T) {
 		pod, err := d.NewPod(ctx, &PodConfig{
 			ID:     uuid.Must(uuid.NewV4()).String(),
@@ -535,3 +897,4461 @@ func TestDockerPod(t *testing.T) {
 		}
 	})
 }
+
+func TestDockerFetchImages(t *testing.T) {
+	var mu sync.Mutex
+	pulls := map[string]int{}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/images/create"):
+			image := r.URL.Query().Get("fromImage") + ":" + r.URL.Query().Get("tag")
+			mu.Lock()
+			pulls[image]++
+			mu.Unlock()
+			_, _ = w.Write([]byte(`{"status":"pulled"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+
+	d := newFakeDockerDriver(t, handler, WithDockerDriverMaxConcurrentPulls(1))
+
+	images := []pullImage{{image: "busybox:stable"}, {image: "nginx:1.16"}, {image: "busybox:stable"}}
+	if err := d.fetchImages(context.Background(), images, true, nil, ioutil.Discard); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	expectedPulls := map[string]int{
+		"busybox:stable": 1,
+		"nginx:1.16":     1,
+	}
+	if diff := cmp.Diff(expectedPulls, pulls); diff != "" {
+		t.Fatalf("unexpected pulls: %s", diff)
+	}
+}
+
+func TestDockerFetchImagePlatform(t *testing.T) {
+	var mu sync.Mutex
+	pulls := map[string]string{}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/images/create") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		image := r.URL.Query().Get("fromImage") + ":" + r.URL.Query().Get("tag")
+		platform := r.URL.Query().Get("platform")
+		if platform == "windows/s390x" {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"message":"no matching manifest for windows/s390x in the manifest list entries"}`))
+			return
+		}
+		mu.Lock()
+		pulls[image] = platform
+		mu.Unlock()
+		_, _ = w.Write([]byte(`{"status":"pulled"}`))
+	})
+
+	d := newFakeDockerDriver(t, handler)
+
+	images := []pullImage{{image: "busybox:stable", platform: "linux/amd64"}, {image: "nginx:1.16", platform: "linux/arm64/v8"}}
+	if err := d.fetchImages(context.Background(), images, true, nil, ioutil.Discard); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	expectedPulls := map[string]string{
+		"busybox:stable": "linux/amd64",
+		"nginx:1.16":     "linux/arm64/v8",
+	}
+	if diff := cmp.Diff(expectedPulls, pulls); diff != "" {
+		t.Fatalf("unexpected pulls: %s", diff)
+	}
+
+	expectedErr := `failed to pull image "alpine:3.12" for platform "windows/s390x"`
+	err := d.fetchImage(context.Background(), "alpine:3.12", "windows/s390x", true, nil, ioutil.Discard)
+	if err == nil {
+		t.Fatalf("expected err, got nil err")
+	}
+	if !strings.Contains(err.Error(), expectedErr) || !strings.Contains(err.Error(), "no matching manifest") {
+		t.Fatalf("expected err containing %q and the daemon error, got: %v", expectedErr, err)
+	}
+}
+
+func TestDockerNewPodPlatform(t *testing.T) {
+	var mu sync.Mutex
+	var paths []string
+	pulls := map[string]string{}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		paths = append(paths, r.URL.Path)
+		if strings.HasSuffix(r.URL.Path, "/images/create") {
+			pulls[r.URL.Query().Get("fromImage")+":"+r.URL.Query().Get("tag")] = r.URL.Query().Get("platform")
+			_, _ = w.Write([]byte(`{"status":"pulled"}`))
+			return
+		}
+		// stop the pod creation after the pulls
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte(`{"message":"fake error"}`))
+	})
+
+	newPodConfig := func(platforms ...string) *PodConfig {
+		podConfig := &PodConfig{
+			ID:            uuid.Must(uuid.NewV4()).String(),
+			TaskID:        uuid.Must(uuid.NewV4()).String(),
+			InitVolumeDir: "/tmp/agola",
+		}
+		for _, platform := range platforms {
+			podConfig.Containers = append(podConfig.Containers, &ContainerConfig{
+				Cmd:      []string{"cat"},
+				Image:    "busybox:stable",
+				Platform: platform,
+			})
+		}
+		return podConfig
+	}
+
+	t.Run("test platform with api version lower than 1.32", func(t *testing.T) {
+		d := newFakeDockerDriver(t, handler)
+		paths = nil
+
+		_, err := d.NewPod(context.Background(), newPodConfig("linux/arm64/v8"), ioutil.Discard)
+		if !util.APIErrorIs(err, util.ErrBadRequest) {
+			t.Fatalf("expected bad request error, got: %v", err)
+		}
+		expectedErr := "container image platform requires docker api version >= 1.32, the driver uses api version 1.26"
+		if !strings.Contains(err.Error(), expectedErr) {
+			t.Fatalf("expected err containing %q, got: %v", expectedErr, err)
+		}
+		if len(paths) != 0 {
+			t.Fatalf("expected no api calls, got: %v", paths)
+		}
+	})
+
+	t.Run("test platform with api version 1.32", func(t *testing.T) {
+		d := newFakeDockerDriver(t, handler)
+		cli, err := client.NewClientWithOpts(client.WithHost(d.client.DaemonHost()), client.WithVersion("1.32"))
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		d.client = cli
+		pulls = map[string]string{}
+
+		if _, err := d.NewPod(context.Background(), newPodConfig("linux/arm64/v8"), ioutil.Discard); err == nil {
+			t.Fatalf("expected err, got nil err")
+		}
+		expectedPulls := map[string]string{"busybox:stable": "linux/arm64/v8"}
+		if diff := cmp.Diff(expectedPulls, pulls); diff != "" {
+			t.Fatalf("unexpected pulls: %s", diff)
+		}
+	})
+
+	t.Run("test same image with different platforms", func(t *testing.T) {
+		d := newFakeDockerDriver(t, handler)
+		cli, err := client.NewClientWithOpts(client.WithHost(d.client.DaemonHost()), client.WithVersion("1.32"))
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		d.client = cli
+		paths = nil
+
+		// an empty platform is the driver default platform
+		_, err = d.NewPod(context.Background(), newPodConfig("", "linux/arm64/v8"), ioutil.Discard)
+		if !util.APIErrorIs(err, util.ErrBadRequest) {
+			t.Fatalf("expected bad request error, got: %v", err)
+		}
+		expectedErr := `image "busybox:stable" used with different platforms "linux/amd64" and "linux/arm64/v8"`
+		if !strings.Contains(err.Error(), expectedErr) {
+			t.Fatalf("expected err containing %q, got: %v", expectedErr, err)
+		}
+		if len(paths) != 0 {
+			t.Fatalf("expected no api calls, got: %v", paths)
+		}
+
+		if _, err := d.NewPod(context.Background(), newPodConfig("", "linux/amd64"), ioutil.Discard); util.APIErrorIs(err, util.ErrBadRequest) {
+			t.Fatalf("unexpected bad request error: %v", err)
+		}
+	})
+}
+
+func TestDockerFetchImagePullMetrics(t *testing.T) {
+	// canned pull progress stream: a layer already exists, a layer is
+	// downloaded with progress and a layer with an unknown size
+	pullStream := strings.Join([]string{
+		`{"status":"Pulling from library/busybox","id":"1.32"}`,
+		`{"status":"Already exists","progressDetail":{},"id":"layer01"}`,
+		`{"status":"Pulling fs layer","progressDetail":{},"id":"layer02"}`,
+		`{"status":"Downloading","progressDetail":{"current":512,"total":2048},"progress":"[====>    ]","id":"layer02"}`,
+		`{"status":"Downloading","progressDetail":{"current":2048,"total":2048},"progress":"[========>]","id":"layer02"}`,
+		`{"status":"Download complete","progressDetail":{},"id":"layer02"}`,
+		`{"status":"Downloading","progressDetail":{"current":100},"id":"layer03"}`,
+		`{"status":"Downloading","progressDetail":{"current":300},"id":"layer03"}`,
+		`not a json message`,
+		`{"status":"Digest: sha256:0123456789abcdef"}`,
+		`{"status":"Status: Downloaded newer image for busybox:1.32"}`,
+	}, "\r\n")
+
+	upToDateStream := strings.Join([]string{
+		`{"status":"Pulling from library/busybox","id":"latest"}`,
+		`{"status":"Digest: sha256:0123456789abcdef"}`,
+		`{"status":"Status: Image is up to date for busybox:latest"}`,
+	}, "\r\n") + "\r\n"
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/images/create") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.URL.Query().Get("tag") == "latest" {
+			_, _ = w.Write([]byte(upToDateStream))
+			return
+		}
+		_, _ = w.Write([]byte(pullStream))
+	})
+
+	var mu sync.Mutex
+	metrics := map[string]ImagePullMetrics{}
+	hook := func(m ImagePullMetrics) {
+		mu.Lock()
+		defer mu.Unlock()
+		metrics[m.Image] = m
+	}
+	d := newFakeDockerDriver(t, handler, WithDockerDriverImagePullMetricsHook(hook))
+
+	var out bytes.Buffer
+	images := []pullImage{{image: "busybox:1.32", platform: "linux/amd64"}, {image: "busybox:latest", platform: "linux/amd64"}}
+	if err := d.fetchImages(context.Background(), images, true, nil, &out); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	// the pull output is still written
+	if !strings.Contains(out.String(), "Downloaded newer image for busybox:1.32") {
+		t.Fatalf("expected pull output, got: %s", out.String())
+	}
+
+	expectedMetrics := map[string]ImagePullMetrics{
+		"busybox:1.32":   {Image: "busybox:1.32", Platform: "linux/amd64", BytesDownloaded: 2348},
+		"busybox:latest": {Image: "busybox:latest", Platform: "linux/amd64", CacheHit: true},
+	}
+	if diff := cmp.Diff(expectedMetrics, metrics, cmpopts.IgnoreFields(ImagePullMetrics{}, "Duration")); diff != "" {
+		t.Fatalf("unexpected metrics: %s", diff)
+	}
+	for image, m := range metrics {
+		if m.Duration <= 0 {
+			t.Fatalf("expected positive duration for image %q, got %s", image, m.Duration)
+		}
+	}
+}
+
+func TestDockerFetchImagePullErrors(t *testing.T) {
+	tests := []struct {
+		name         string
+		statusCode   int
+		message      string
+		expectedKind util.ErrorKind
+		expectedErr  string
+	}{
+		{
+			name:         "test registry unauthorized",
+			statusCode:   http.StatusUnauthorized,
+			message:      "unauthorized: authentication required",
+			expectedKind: util.ErrUnauthorized,
+			expectedErr:  `failed to pull image "registry.example.com/image01:v1": registry authentication failed, check the registry credentials: Error response from daemon: unauthorized: authentication required`,
+		},
+		{
+			name:         "test registry access denied",
+			statusCode:   http.StatusForbidden,
+			message:      "denied: requested access to the resource is denied",
+			expectedKind: util.ErrUnauthorized,
+			expectedErr:  `failed to pull image "registry.example.com/image01:v1": registry authentication failed, check the registry credentials: Error response from daemon: denied: requested access to the resource is denied`,
+		},
+		{
+			name:         "test manifest not found",
+			statusCode:   http.StatusNotFound,
+			message:      "manifest for registry.example.com/image01:v1 not found: manifest unknown",
+			expectedKind: util.ErrNotExist,
+			expectedErr:  `failed to pull image "registry.example.com/image01:v1" for platform "linux/amd64": image not found: Error response from daemon: manifest for registry.example.com/image01:v1 not found: manifest unknown`,
+		},
+		{
+			name:         "test other error",
+			statusCode:   http.StatusInternalServerError,
+			message:      "registry unavailable",
+			expectedKind: util.ErrInternal,
+			expectedErr:  `failed to pull image "registry.example.com/image01:v1" for platform "linux/amd64": Error response from daemon: registry unavailable`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(tt.statusCode)
+				_, _ = w.Write([]byte(fmt.Sprintf(`{"message":%q}`, tt.message)))
+			})
+
+			d := newFakeDockerDriver(t, handler)
+
+			images := []pullImage{{image: "registry.example.com/image01:v1", platform: "linux/amd64"}}
+			err := d.fetchImages(context.Background(), images, true, nil, ioutil.Discard)
+			if err == nil {
+				t.Fatalf("expected err, got nil err")
+			}
+			if kind := util.RootAPIErrorKind(err); kind != tt.expectedKind {
+				t.Fatalf("expected err kind %q, got %q: %v", tt.expectedKind, kind, err)
+			}
+			if !strings.Contains(err.Error(), tt.expectedErr) {
+				t.Fatalf("expected err containing %q, got: %v", tt.expectedErr, err)
+			}
+		})
+	}
+}
+
+func TestDockerFetchImagePullTimeout(t *testing.T) {
+	tests := []struct {
+		name        string
+		startStream bool
+	}{
+		{
+			name: "test pull request timeout",
+		},
+		{
+			name:        "test pull stream timeout",
+			startStream: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.startStream {
+					w.Header().Set("Content-Type", "application/json")
+					w.WriteHeader(http.StatusOK)
+					_, _ = w.Write([]byte(`{"status":"Pulling from image01"}` + "\n"))
+					w.(http.Flusher).Flush()
+				}
+				<-r.Context().Done()
+			})
+
+			d := newFakeDockerDriver(t, handler)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+			defer cancel()
+
+			images := []pullImage{{image: "registry.example.com/image01:v1", platform: "linux/amd64"}}
+			err := d.fetchImages(ctx, images, true, nil, ioutil.Discard)
+			if err == nil {
+				t.Fatalf("expected err, got nil err")
+			}
+			if !util.APIErrorIs(err, util.ErrUnavailable) {
+				t.Fatalf("expected err kind %q, got err: %v", util.ErrUnavailable, err)
+			}
+			if !util.IsRetryable(err) {
+				t.Fatalf("expected retryable err, got err: %v", err)
+			}
+			expectedErr := `failed to pull image "registry.example.com/image01:v1" for platform "linux/amd64": timeout`
+			if !strings.Contains(err.Error(), expectedErr) {
+				t.Fatalf("expected err containing %q, got: %v", expectedErr, err)
+			}
+		})
+	}
+}
+
+func TestDockerFetchImageRegistryMirrors(t *testing.T) {
+	tests := []struct {
+		name          string
+		mirrors       map[string]string
+		image         string
+		expectedPull  string
+		expectedTag   string
+		expectedAuths []string
+	}{
+		{
+			name:         "test no mirrors",
+			image:        "busybox:stable",
+			expectedPull: "busybox:stable",
+		},
+		{
+			name:         "test mirror for other registry",
+			mirrors:      map[string]string{"quay.io": "mirror.local:5000"},
+			image:        "busybox:stable",
+			expectedPull: "busybox:stable",
+		},
+		{
+			name:         "test docker hub mirror",
+			mirrors:      map[string]string{"docker.io": "mirror.local:5000"},
+			image:        "busybox:stable",
+			expectedPull: "mirror.local:5000/library/busybox:stable",
+			expectedTag:  "busybox:stable",
+		},
+		{
+			name:         "test docker hub mirror with registry-1.docker.io key",
+			mirrors:      map[string]string{"registry-1.docker.io": "mirror.local:5000"},
+			image:        "docker.io/sorintlab/agola:v0.5.0",
+			expectedPull: "mirror.local:5000/sorintlab/agola:v0.5.0",
+			// the docker client sends the familiar image name
+			expectedTag: "sorintlab/agola:v0.5.0",
+		},
+		{
+			name:         "test other registry mirror",
+			mirrors:      map[string]string{"quay.io": "mirror.local:5000"},
+			image:        "quay.io/coreos/etcd:v3.4.0",
+			expectedPull: "mirror.local:5000/coreos/etcd:v3.4.0",
+			expectedTag:  "quay.io/coreos/etcd:v3.4.0",
+		},
+		{
+			name:         "test image by digest not mirrored",
+			mirrors:      map[string]string{"docker.io": "mirror.local:5000"},
+			image:        "busybox@sha256:a2490cec4484ee6c1068ba3a05f89934010c85242f736280b35343483b2264b6",
+			expectedPull: "busybox@sha256:a2490cec4484ee6c1068ba3a05f89934010c85242f736280b35343483b2264b6",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var pulled, tagged, auth string
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch {
+				case strings.HasSuffix(r.URL.Path, "/images/create"):
+					q := r.URL.Query()
+					pulled = q.Get("fromImage")
+					if tag := q.Get("tag"); strings.HasPrefix(tag, "sha256:") {
+						pulled += "@" + tag
+					} else if tag != "" {
+						pulled += ":" + tag
+					}
+					auth = r.Header.Get("X-Registry-Auth")
+					_, _ = w.Write([]byte(`{"status":"pulled"}`))
+				case strings.HasSuffix(r.URL.Path, "/tag"):
+					q := r.URL.Query()
+					tagged = q.Get("repo") + ":" + q.Get("tag")
+					w.WriteHeader(http.StatusCreated)
+				default:
+					w.WriteHeader(http.StatusNotFound)
+				}
+			})
+
+			d := newFakeDockerDriver(t, handler, WithDockerDriverRegistryMirrors(tt.mirrors))
+
+			regName, err := registry.GetRegistry(tt.image)
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			registryConfig := &registry.DockerConfig{Auths: map[string]registry.DockerConfigAuth{regName: {Username: "user01", Password: "password01"}}}
+
+			if err := d.fetchImage(context.Background(), tt.image, "linux/amd64", true, registryConfig, ioutil.Discard); err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+
+			if pulled != tt.expectedPull {
+				t.Fatalf("expected pulled image %q, got %q", tt.expectedPull, pulled)
+			}
+			if tagged != tt.expectedTag {
+				t.Fatalf("expected tagged image %q, got %q", tt.expectedTag, tagged)
+			}
+
+			// the original registry auth must be used
+			buf, err := base64.URLEncoding.DecodeString(auth)
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			var pullAuth registry.DockerConfigAuth
+			if err := json.Unmarshal(buf, &pullAuth); err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			if pullAuth.Username != "user01" {
+				t.Fatalf("expected original registry auth, got: %+v", pullAuth)
+			}
+		})
+	}
+}
+
+func TestDockerFetchImageCompleteness(t *testing.T) {
+	var mu sync.Mutex
+	pulls := map[string]int{}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/images/busybox:stable/json"):
+			// fully present image
+			_, _ = w.Write([]byte(`{"Id":"sha256:01","RootFS":{"Type":"layers","Layers":["sha256:0a"]}}`))
+		case strings.HasSuffix(r.URL.Path, "/images/nginx:1.16/json"):
+			// partially pulled image
+			_, _ = w.Write([]byte(`{"Id":"sha256:02","RootFS":{"Type":"layers"}}`))
+		case strings.HasSuffix(r.URL.Path, "/images/create"):
+			image := r.URL.Query().Get("fromImage") + ":" + r.URL.Query().Get("tag")
+			mu.Lock()
+			pulls[image]++
+			mu.Unlock()
+			_, _ = w.Write([]byte(`{"status":"pulled"}`))
+		default:
+			// unexistent image
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"message":"No such image"}`))
+		}
+	})
+
+	d := newFakeDockerDriver(t, handler)
+
+	images := []pullImage{{image: "busybox:stable"}, {image: "nginx:1.16"}, {image: "alpine:3.12"}}
+	if err := d.fetchImages(context.Background(), images, false, nil, ioutil.Discard); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	expectedPulls := map[string]int{
+		"nginx:1.16":  1,
+		"alpine:3.12": 1,
+	}
+	if diff := cmp.Diff(expectedPulls, pulls); diff != "" {
+		t.Fatalf("unexpected pulls: %s", diff)
+	}
+}
+
+func TestDockerPodCopyFromContainer(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/containers/containerid01/archive") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.URL.Query().Get("path") != "/artifacts" {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"message":"Could not find the file"}`))
+			return
+		}
+		w.Header().Set("X-Docker-Container-Path-Stat", "e30=")
+		_, _ = w.Write([]byte("tardata"))
+	})
+
+	d := newFakeDockerDriver(t, handler)
+	mainContainer := &DockerContainer{Index: 0, Name: mainContainerName, Container: types.Container{ID: "containerid01"}}
+	pod := &DockerPod{
+		id:            "podid01",
+		client:        d.client,
+		containers:    []*DockerContainer{mainContainer},
+		containersMap: map[string]*DockerContainer{mainContainerName: mainContainer},
+	}
+
+	ctx := context.Background()
+
+	t.Run("copy existing path", func(t *testing.T) {
+		rc, err := pod.CopyFromContainer(ctx, mainContainerName, "/artifacts")
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		defer rc.Close()
+
+		data, err := ioutil.ReadAll(rc)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if string(data) != "tardata" {
+			t.Fatalf("unexpected data: %q", data)
+		}
+	})
+
+	t.Run("copy from unknown container", func(t *testing.T) {
+		_, err := pod.CopyFromContainer(ctx, "unknown", "/artifacts")
+		if !util.APIErrorIs(err, util.ErrNotExist) {
+			t.Fatalf("expected ErrNotExist, got: %v", err)
+		}
+	})
+
+	t.Run("copy unexistent path", func(t *testing.T) {
+		_, err := pod.CopyFromContainer(ctx, mainContainerName, "/unexistent")
+		if !util.APIErrorIs(err, util.ErrNotExist) {
+			t.Fatalf("expected ErrNotExist, got: %v", err)
+		}
+	})
+}
+
+func TestDockerPodContainerLogs(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/containers/containerid01/json"):
+			_, _ = w.Write([]byte(`{"Id":"containerid01","Config":{"Tty":false}}`))
+		case strings.HasSuffix(r.URL.Path, "/containers/containerid01/logs"):
+			stdout := stdcopy.NewStdWriter(w, stdcopy.Stdout)
+			stderr := stdcopy.NewStdWriter(w, stdcopy.Stderr)
+			_, _ = stdout.Write([]byte("starting\nlistening"))
+			_, _ = stdout.Write([]byte(" on port 5432\n"))
+			_, _ = stderr.Write([]byte("warning\n"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+
+	d := newFakeDockerDriver(t, handler)
+	serviceContainer := &DockerContainer{Index: 1, Name: "service1", Container: types.Container{ID: "containerid01"}}
+	pod := &DockerPod{
+		id:            "podid01",
+		client:        d.client,
+		containers:    []*DockerContainer{serviceContainer},
+		containersMap: map[string]*DockerContainer{"service1": serviceContainer},
+	}
+
+	ctx := context.Background()
+
+	t.Run("get logs of existing container", func(t *testing.T) {
+		rc, err := pod.ContainerLogs(ctx, "service1", false, time.Time{})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		defer rc.Close()
+
+		logs, err := ioutil.ReadAll(rc)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		expectedLogs := "[1] starting\n[1] listening on port 5432\n[1] warning\n"
+		if diff := cmp.Diff(expectedLogs, string(logs)); diff != "" {
+			t.Fatalf("unexpected logs: %s", diff)
+		}
+	})
+
+	t.Run("get logs of unknown container", func(t *testing.T) {
+		_, err := pod.ContainerLogs(ctx, "service2", false, time.Time{})
+		if !util.APIErrorIs(err, util.ErrNotExist) {
+			t.Fatalf("expected not exist error, got: %v", err)
+		}
+	})
+}
+
+func TestDockerExecStdin(t *testing.T) {
+	t.Run("test large input with slow reader", func(t *testing.T) {
+		clientConn, serverConn := net.Pipe()
+		defer clientConn.Close()
+		defer serverConn.Close()
+
+		stdin := newStdin(&types.HijackedResponse{Conn: clientConn}, make(chan struct{}))
+
+		input := bytes.Repeat([]byte("0123456789abcdef"), 256*1024)
+
+		writeErrCh := make(chan error, 1)
+		go func() {
+			_, err := stdin.Write(input)
+			writeErrCh <- err
+		}()
+
+		// the write must block since nobody is reading
+		select {
+		case err := <-writeErrCh:
+			t.Fatalf("expected write to block, got err: %v", err)
+		case <-time.After(100 * time.Millisecond):
+		}
+
+		var output bytes.Buffer
+		buf := make([]byte, 4096)
+		for output.Len() < len(input) {
+			n, err := serverConn.Read(buf)
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			output.Write(buf[:n])
+			if output.Len()%(256*1024) == 0 {
+				time.Sleep(1 * time.Millisecond)
+			}
+		}
+
+		if err := <-writeErrCh; err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if !bytes.Equal(input, output.Bytes()) {
+			t.Fatalf("stdin data mismatch")
+		}
+		if err := stdin.Close(); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if _, err := stdin.Write([]byte("data")); !errors.Is(err, io.ErrClosedPipe) {
+			t.Fatalf("expected closed pipe err, got: %v", err)
+		}
+	})
+
+	t.Run("test write after exec exited", func(t *testing.T) {
+		clientConn, serverConn := net.Pipe()
+		defer clientConn.Close()
+		defer serverConn.Close()
+
+		execDoneCh := make(chan struct{})
+		stdin := newStdin(&types.HijackedResponse{Conn: clientConn}, execDoneCh)
+
+		writeErrCh := make(chan error, 1)
+		go func() {
+			_, err := stdin.Write(make([]byte, stdinChunkSize*(stdinQueueChunks+2)))
+			writeErrCh <- err
+		}()
+
+		// wait for the write to block with the queue full
+		select {
+		case err := <-writeErrCh:
+			t.Fatalf("expected write to block, got err: %v", err)
+		case <-time.After(100 * time.Millisecond):
+		}
+
+		// the exec exits without consuming its stdin
+		close(execDoneCh)
+
+		select {
+		case err := <-writeErrCh:
+			if !errors.Is(err, io.ErrClosedPipe) {
+				t.Fatalf("expected closed pipe err, got: %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("write didn't return after exec exited")
+		}
+		// the queued data can't be written anymore
+		if err := stdin.Close(); !errors.Is(err, io.ErrClosedPipe) {
+			t.Fatalf("expected closed pipe err, got: %v", err)
+		}
+	})
+
+	t.Run("test writer exits when exec exits", func(t *testing.T) {
+		clientConn, serverConn := net.Pipe()
+		defer clientConn.Close()
+		defer serverConn.Close()
+
+		execDoneCh := make(chan struct{})
+		stdin := newStdin(&types.HijackedResponse{Conn: clientConn}, execDoneCh)
+
+		go func() { _, _ = io.Copy(ioutil.Discard, serverConn) }()
+		if _, err := stdin.Write([]byte("data")); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+
+		// the exec exits without stdin being closed
+		close(execDoneCh)
+
+		select {
+		case <-stdin.writerDoneCh:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("writer didn't exit after exec exited")
+		}
+	})
+}
+
+func TestDockerPodExecWithoutStdin(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/containers/containerid01/exec"):
+			w.WriteHeader(http.StatusCreated)
+			_, _ = w.Write([]byte(`{"Id":"execid01"}`))
+		case strings.HasSuffix(r.URL.Path, "/exec/execid01/start"):
+			_, _ = io.Copy(ioutil.Discard, r.Body)
+			conn, bufrw, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				t.Errorf("unexpected err: %v", err)
+				return
+			}
+			defer conn.Close()
+			_, _ = bufrw.WriteString("HTTP/1.1 101 UPGRADED\r\nContent-Type: application/vnd.docker.raw-stream\r\nConnection: Upgrade\r\nUpgrade: tcp\r\n\r\n")
+			// write a stdout frame and exit
+			_, _ = bufrw.Write(append([]byte{1, 0, 0, 0, 0, 0, 0, 6}, []byte("output")...))
+			_ = bufrw.Flush()
+		case strings.HasSuffix(r.URL.Path, "/exec/execid01/json"):
+			_, _ = w.Write([]byte(`{"ID":"execid01","Running":false,"ExitCode":0}`))
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	})
+
+	d := newFakeDockerDriver(t, handler)
+
+	pod := &DockerPod{
+		id:            "podid01",
+		client:        d.client,
+		containers:    []*DockerContainer{{Container: types.Container{ID: "containerid01"}}},
+		initVolumeDir: "/tmp/agola",
+	}
+
+	var out bytes.Buffer
+	ce, err := pod.Exec(context.Background(), &ExecConfig{Cmd: []string{"ls"}, AttachStdin: true, Stdout: &out})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	code, err := ce.Wait(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got: %d", code)
+	}
+	if out.String() != "output" {
+		t.Fatalf("expected output %q, got %q", "output", out.String())
+	}
+
+	// no stdin writer goroutine must be left running
+	buf := make([]byte, 1<<20)
+	stacks := string(buf[:runtime.Stack(buf, true)])
+	if strings.Contains(stacks, "(*Stdin).writer") {
+		t.Fatalf("stdin writer goroutine still running: %s", stacks)
+	}
+}
+
+func TestDockerContainerExecResize(t *testing.T) {
+	var mu sync.Mutex
+	resizes := []string{}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/exec/execid01/resize") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		mu.Lock()
+		resizes = append(resizes, r.URL.Query().Get("h")+"x"+r.URL.Query().Get("w"))
+		mu.Unlock()
+	})
+
+	d := newFakeDockerDriver(t, handler)
+
+	ctx := context.Background()
+
+	t.Run("resize tty exec", func(t *testing.T) {
+		e := &DockerContainerExec{execID: "execid01", tty: true, client: d.client}
+		if err := e.Resize(ctx, 40, 120); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+
+		expectedResizes := []string{"40x120"}
+		if diff := cmp.Diff(expectedResizes, resizes); diff != "" {
+			t.Fatalf("unexpected resizes: %s", diff)
+		}
+	})
+
+	t.Run("resize exec without tty", func(t *testing.T) {
+		e := &DockerContainerExec{execID: "execid01", client: d.client}
+		err := e.Resize(ctx, 40, 120)
+		if !util.APIErrorIs(err, util.ErrBadRequest) {
+			t.Fatalf("expected bad request error, got: %v", err)
+		}
+	})
+}
+
+func TestDockerContainerExecWaitOOMKilled(t *testing.T) {
+	tests := []struct {
+		name              string
+		containerResponse string
+		expectedOOMKilled bool
+	}{
+		{
+			name:              "test oom killed container",
+			containerResponse: `{"Id":"containerid01","State":{"OOMKilled":true}}`,
+			expectedOOMKilled: true,
+		},
+		{
+			name:              "test not oom killed container",
+			containerResponse: `{"Id":"containerid01","State":{"OOMKilled":false}}`,
+		},
+		{
+			name: "test failed container inspection",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch {
+				case strings.HasSuffix(r.URL.Path, "/exec/execid01/json"):
+					_, _ = w.Write([]byte(`{"ID":"execid01","Running":false,"ExitCode":137}`))
+				case strings.HasSuffix(r.URL.Path, "/containers/containerid01/json") && tt.containerResponse != "":
+					_, _ = w.Write([]byte(tt.containerResponse))
+				default:
+					w.WriteHeader(http.StatusInternalServerError)
+				}
+			})
+
+			d := newFakeDockerDriver(t, handler)
+
+			conn, _ := net.Pipe()
+			endCh := make(chan error, 1)
+			endCh <- nil
+			e := &DockerContainerExec{
+				execID:      "execid01",
+				containerID: "containerid01",
+				hresp:       &types.HijackedResponse{Conn: conn},
+				client:      d.client,
+				endCh:       endCh,
+			}
+
+			code, err := e.Wait(context.Background())
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			if code != 137 {
+				t.Fatalf("expected exit code 137, got: %d", code)
+			}
+			if e.OOMKilled() != tt.expectedOOMKilled {
+				t.Fatalf("expected oom killed %t, got: %t", tt.expectedOOMKilled, e.OOMKilled())
+			}
+		})
+	}
+}
+
+func TestDockerPodStop(t *testing.T) {
+	var mu sync.Mutex
+	stops := map[string]string{}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/containers/containerid01/stop"):
+			mu.Lock()
+			stops["containerid01"] = r.URL.Query().Get("t")
+			mu.Unlock()
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte(`{"message":"cannot stop container"}`))
+		}
+	})
+
+	d := newFakeDockerDriver(t, handler, WithDockerDriverStopTimeout(30*time.Second))
+	pod := &DockerPod{
+		id:          "podid01",
+		client:      d.client,
+		stopTimeout: d.stopTimeout,
+		containers: []*DockerContainer{
+			{Index: 0, Name: mainContainerName, Container: types.Container{ID: "containerid01"}},
+			{Index: 1, Name: "service1", Container: types.Container{ID: "containerid02"}},
+		},
+	}
+
+	err := pod.Stop(context.Background())
+	if err == nil {
+		t.Fatalf("expected err, got nil err")
+	}
+	if !strings.Contains(err.Error(), `failed to stop container "service1" (index 1)`) {
+		t.Fatalf("expected error to report the failed container, got: %v", err)
+	}
+	if strings.Contains(err.Error(), mainContainerName) {
+		t.Fatalf("unexpected error for container %q: %v", mainContainerName, err)
+	}
+
+	expectedStops := map[string]string{"containerid01": "30"}
+	if diff := cmp.Diff(expectedStops, stops); diff != "" {
+		t.Fatalf("unexpected stops: %s", diff)
+	}
+}
+
+func TestDockerPodStopOrder(t *testing.T) {
+	tests := []struct {
+		name          string
+		options       []DockerDriverOption
+		expectedStops []string
+	}{
+		{
+			name:          "test default reverse stop order",
+			expectedStops: []string{"containerid03", "containerid02", "containerid01"},
+		},
+		{
+			name:          "test forward stop order",
+			options:       []DockerDriverOption{WithDockerDriverStopOrder(StopOrderForward)},
+			expectedStops: []string{"containerid01", "containerid02", "containerid03"},
+		},
+		{
+			name:          "test reverse stop order",
+			options:       []DockerDriverOption{WithDockerDriverStopOrder(StopOrderReverse)},
+			expectedStops: []string{"containerid03", "containerid02", "containerid01"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			stops := []string{}
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if !strings.HasSuffix(r.URL.Path, "/stop") {
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+				parts := strings.Split(r.URL.Path, "/")
+				mu.Lock()
+				stops = append(stops, parts[len(parts)-2])
+				mu.Unlock()
+				w.WriteHeader(http.StatusNoContent)
+			})
+
+			d := newFakeDockerDriver(t, handler, tt.options...)
+			pod := &DockerPod{
+				id:          "podid01",
+				client:      d.client,
+				stopTimeout: d.stopTimeout,
+				stopOrder:   d.stopOrder,
+				// containers not ordered by index like returned by GetPods
+				containers: []*DockerContainer{
+					{Index: 1, Name: "service1", Container: types.Container{ID: "containerid02"}},
+					{Index: 0, Name: mainContainerName, Container: types.Container{ID: "containerid01"}},
+					{Index: 2, Name: "service2", Container: types.Container{ID: "containerid03"}},
+				},
+			}
+
+			if err := pod.Stop(context.Background()); err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+
+			if diff := cmp.Diff(tt.expectedStops, stops); diff != "" {
+				t.Fatalf("unexpected stop order: %s", diff)
+			}
+		})
+	}
+}
+
+func TestDockerSetupPruneOnStartup(t *testing.T) {
+	containerLabels := func(executorID, podID string) map[string]string {
+		return map[string]string{agolaLabelKey: agolaLabelValue, executorIDKey: executorID, podIDKey: podID, containerIndexKey: "0"}
+	}
+	containers := []types.Container{
+		{ID: "containerid01", Labels: containerLabels("executorid01", "podid01")},
+		{ID: "containerid02", Labels: containerLabels("executorid01", "podid02")},
+		{ID: "containerid03", Labels: containerLabels("executorid02", "podid03")},
+	}
+	volumes := volume.VolumeListOKBody{
+		Volumes: []*types.Volume{
+			{Name: "volume01", Labels: map[string]string{agolaLabelKey: agolaLabelValue, executorIDKey: "executorid01", podIDKey: "podid01"}},
+		},
+	}
+
+	tests := []struct {
+		name            string
+		options         []DockerDriverOption
+		expectedStopped []string
+		expectedRemoved []string
+	}{
+		{
+			name:            "test prune disabled",
+			expectedStopped: []string{},
+			expectedRemoved: []string{},
+		},
+		{
+			name:            "test prune enabled",
+			options:         []DockerDriverOption{WithDockerDriverPruneOnStartup(true)},
+			expectedStopped: []string{"containerid01", "containerid02"},
+			expectedRemoved: []string{"containerid01", "containerid02", "volume01"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			stopped := []string{}
+			removed := []string{}
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				defer mu.Unlock()
+				parts := strings.Split(r.URL.Path, "/")
+				switch {
+				case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/containers/json"):
+					_ = json.NewEncoder(w).Encode(containers)
+				case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/volumes"):
+					_ = json.NewEncoder(w).Encode(volumes)
+				case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/stop"):
+					stopped = append(stopped, parts[len(parts)-2])
+					w.WriteHeader(http.StatusNoContent)
+				case r.Method == http.MethodDelete:
+					removed = append(removed, parts[len(parts)-1])
+					w.WriteHeader(http.StatusNoContent)
+				default:
+					w.WriteHeader(http.StatusNotFound)
+				}
+			})
+
+			d := newFakeDockerDriver(t, handler, tt.options...)
+
+			if err := d.Setup(context.Background()); err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+
+			sort.Strings(stopped)
+			sort.Strings(removed)
+			if diff := cmp.Diff(tt.expectedStopped, stopped); diff != "" {
+				t.Fatalf("unexpected stopped containers: %s", diff)
+			}
+			if diff := cmp.Diff(tt.expectedRemoved, removed); diff != "" {
+				t.Fatalf("unexpected removed resources: %s", diff)
+			}
+		})
+	}
+}
+
+func TestDockerToolboxArch(t *testing.T) {
+	tests := []struct {
+		name          string
+		toolboxArchs  []stypes.Arch
+		expectedArchs []stypes.Arch
+		expectedErr   string
+	}{
+		{
+			name:          "test toolbox for executor arch",
+			toolboxArchs:  []stypes.Arch{"amd64", "arm64"},
+			expectedArchs: []stypes.Arch{"amd64"},
+		},
+		{
+			name:          "test missing toolbox for executor arch",
+			toolboxArchs:  []stypes.Arch{"arm64"},
+			expectedArchs: []stypes.Arch{},
+			expectedErr:   `missing toolbox binary for executor arch "amd64" in toolbox path`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch {
+				case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/containers/json"):
+					_ = json.NewEncoder(w).Encode([]types.Container{})
+				case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/volumes"):
+					_ = json.NewEncoder(w).Encode(volume.VolumeListOKBody{})
+				default:
+					w.WriteHeader(http.StatusNotFound)
+				}
+			})
+
+			d := newFakeDockerDriver(t, handler)
+			d.toolboxPath = newFakeToolboxDir(t, tt.toolboxArchs...)
+
+			err := d.Setup(context.Background())
+			if tt.expectedErr != "" {
+				if err == nil {
+					t.Fatalf("expected error %q, got nil err", tt.expectedErr)
+				}
+				if !strings.Contains(err.Error(), tt.expectedErr) {
+					t.Fatalf("expected error %q, got: %v", tt.expectedErr, err)
+				}
+			} else if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+
+			archs, err := d.Archs(context.Background())
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			if diff := cmp.Diff(tt.expectedArchs, archs); diff != "" {
+				t.Fatalf("unexpected archs: %s", diff)
+			}
+		})
+	}
+}
+
+func TestDockerCleanupOrphanedVolumes(t *testing.T) {
+	now := time.Now()
+	oldTime := now.Add(-48 * time.Hour).Format(time.RFC3339)
+	recentTime := now.Add(-1 * time.Hour).Format(time.RFC3339)
+
+	volumeLabels := func(podID string) map[string]string {
+		return map[string]string{agolaLabelKey: agolaLabelValue, executorIDKey: "executorid01", podIDKey: podID}
+	}
+	poolLabels := map[string]string{agolaLabelKey: agolaLabelValue, executorIDKey: "executorid01", warmPoolKey: "true"}
+	otherExecutorLabels := map[string]string{agolaLabelKey: agolaLabelValue, executorIDKey: "executorid02", podIDKey: "podid05"}
+	persistentLabels := map[string]string{agolaLabelKey: agolaLabelValue, executorIDKey: "executorid01", persistentVolumeKey: "true", cacheKeyKey: "cachekey01"}
+
+	volumes := volume.VolumeListOKBody{
+		Volumes: []*types.Volume{
+			{Name: "podvolume", Labels: volumeLabels("podid01"), CreatedAt: oldTime},
+			{Name: "oldorphanedvolume", Labels: volumeLabels("podid02"), CreatedAt: oldTime},
+			{Name: "recentorphanedvolume", Labels: volumeLabels("podid03"), CreatedAt: recentTime},
+			{Name: "unknownageorphanedvolume", Labels: volumeLabels("podid04")},
+			{Name: "poolvolume", Labels: poolLabels, CreatedAt: oldTime},
+			{Name: "otherexecutorvolume", Labels: otherExecutorLabels, CreatedAt: oldTime},
+			{Name: "persistentvolume", Labels: persistentLabels, CreatedAt: oldTime},
+		},
+	}
+	containers := []types.Container{
+		{
+			ID: "containerid01",
+			Labels: map[string]string{
+				agolaLabelKey:     agolaLabelValue,
+				executorIDKey:     "executorid01",
+				podIDKey:          "podid01",
+				containerIndexKey: "0",
+			},
+		},
+	}
+
+	var mu sync.Mutex
+	removed := []string{}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/containers/json"):
+			_ = json.NewEncoder(w).Encode(containers)
+		case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/volumes"):
+			_ = json.NewEncoder(w).Encode(volumes)
+		case r.Method == http.MethodDelete && strings.Contains(r.URL.Path, "/volumes/"):
+			mu.Lock()
+			removed = append(removed, r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:])
+			mu.Unlock()
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+
+	d := newFakeDockerDriver(t, handler, WithDockerDriverOrphanedVolumesGracePeriod(24*time.Hour))
+
+	if err := d.Cleanup(context.Background()); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	if diff := cmp.Diff([]string{"oldorphanedvolume"}, removed); diff != "" {
+		t.Fatalf("unexpected removed volumes: %s", diff)
+	}
+}
+
+func TestDockerNewPodWarmPool(t *testing.T) {
+	pooledContainerInspect := func(imageID string) string {
+		return fmt.Sprintf(`{"Id":"pooledcontainer01","Image":%q,"State":{"Running":true},"Config":{"Labels":{%q:"pooltoolboxvol01"}}}`, imageID, toolboxVolumeKey)
+	}
+
+	tests := []struct {
+		name                  string
+		pooledImageID         string
+		expectedMainContainer string
+		expectedCreated       []string
+		expectedRemoved       []string
+	}{
+		{
+			name:                  "test pooled container used as main container",
+			pooledImageID:         "sha256:image01",
+			expectedMainContainer: "pooledcontainer01",
+			expectedCreated:       []string{"nginx:1.16 container:pooledcontainer01"},
+			expectedRemoved:       []string{},
+		},
+		{
+			name:                  "test stale pooled container replaced",
+			pooledImageID:         "sha256:oldimage01",
+			expectedMainContainer: "containerid01",
+			expectedCreated:       []string{"busybox:stable ", "nginx:1.16 container:containerid01"},
+			expectedRemoved:       []string{"/containers/pooledcontainer01", "/volumes/pooltoolboxvol01"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			created := []string{}
+			removed := []string{}
+			var claimLabels map[string]string
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				defer mu.Unlock()
+				switch {
+				case strings.HasSuffix(r.URL.Path, "/images/create"):
+					_, _ = w.Write([]byte(`{"status":"pulled"}`))
+				case strings.HasSuffix(r.URL.Path, "/images/busybox:stable/json"):
+					_, _ = w.Write([]byte(`{"Id":"sha256:image01"}`))
+				case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/containers/pooledcontainer01/json"):
+					_, _ = w.Write([]byte(pooledContainerInspect(tt.pooledImageID)))
+				case strings.HasSuffix(r.URL.Path, "/volumes/create"):
+					var body volume.VolumeCreateBody
+					_ = json.NewDecoder(r.Body).Decode(&body)
+					claimLabels = body.Labels
+					w.WriteHeader(http.StatusCreated)
+					_ = json.NewEncoder(w).Encode(types.Volume{Name: "claimvol01", Labels: body.Labels})
+				case strings.HasSuffix(r.URL.Path, "/containers/create"):
+					var body struct {
+						Image      string
+						HostConfig container.HostConfig
+					}
+					_ = json.NewDecoder(r.Body).Decode(&body)
+					created = append(created, fmt.Sprintf("%s %s", body.Image, body.HostConfig.NetworkMode))
+					w.WriteHeader(http.StatusCreated)
+					_, _ = w.Write([]byte(fmt.Sprintf(`{"Id":"containerid%02d"}`, len(created))))
+				case strings.HasSuffix(r.URL.Path, "/start"):
+					w.WriteHeader(http.StatusNoContent)
+				case strings.HasSuffix(r.URL.Path, "/containers/json"):
+					containers := []types.Container{}
+					for i := range created {
+						index := i
+						if tt.expectedMainContainer == "pooledcontainer01" {
+							index++
+						}
+						labels := map[string]string{containerIndexKey: strconv.Itoa(index)}
+						if index > 0 {
+							labels[containerNameKey] = "service1"
+						}
+						containers = append(containers, types.Container{ID: fmt.Sprintf("containerid%02d", i+1), Labels: labels})
+					}
+					_ = json.NewEncoder(w).Encode(containers)
+				case r.Method == http.MethodDelete:
+					removed = append(removed, r.URL.Path[strings.Index(r.URL.Path[1:], "/")+1:])
+					w.WriteHeader(http.StatusNoContent)
+				default:
+					w.WriteHeader(http.StatusNotFound)
+				}
+			})
+
+			d := newFakeDockerDriver(t, handler, WithDockerDriverWarmPool(WarmPoolConfig{
+				Images:        []string{"busybox:stable"},
+				Size:          1,
+				InitVolumeDir: "/tmp/agola",
+				ProjectDir:    "/root/project",
+			}))
+			pool := newWarmPool(zerolog.Nop(), 1, nil, nil, nil)
+			pool.idle = []string{"pooledcontainer01"}
+			d.containerPools = map[string]*warmPool{"busybox:stable": pool}
+			// use a pooled toolbox volume to avoid populating it
+			d.toolboxVolumePool = newWarmPool(zerolog.Nop(), 1, nil, nil, nil)
+			d.toolboxVolumePool.idle = []string{"toolboxvol01"}
+
+			p, err := d.NewPod(context.Background(), &PodConfig{
+				ID:     "podid01",
+				TaskID: "taskid01",
+				Containers: []*ContainerConfig{
+					{
+						Image:      "busybox:stable",
+						Entrypoint: []string{"/tmp/agola/agola-toolbox", "sleeper"},
+						Volumes:    []Volume{},
+					},
+					{Image: "nginx:1.16", Name: "service1"},
+				},
+				InitVolumeDir: "/tmp/agola",
+			}, ioutil.Discard)
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			pod := p.(*DockerPod)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if pod.containers[0].ID != tt.expectedMainContainer {
+				t.Fatalf("expected main container %q, got %q", tt.expectedMainContainer, pod.containers[0].ID)
+			}
+			if diff := cmp.Diff(tt.expectedCreated, created); diff != "" {
+				t.Fatalf("unexpected created containers: %s", diff)
+			}
+			if diff := cmp.Diff(tt.expectedRemoved, removed); diff != "" {
+				t.Fatalf("unexpected removed resources: %s", diff)
+			}
+
+			if tt.expectedMainContainer != "pooledcontainer01" {
+				if pod.pooledMainContainer || claimLabels != nil {
+					t.Fatalf("unexpected pooled main container")
+				}
+				return
+			}
+			if !pod.pooledMainContainer || pod.claimVolumeName != "claimvol01" {
+				t.Fatalf("expected pooled main container claimed by volume %q, got %q", "claimvol01", pod.claimVolumeName)
+			}
+			if claimLabels[pooledContainerKey] != "pooledcontainer01" || claimLabels[podIDKey] != "podid01" || claimLabels[taskIDKey] != "taskid01" {
+				t.Fatalf("unexpected claim volume labels: %v", claimLabels)
+			}
+			if pod.TaskID() != "taskid01" {
+				t.Fatalf("expected task id %q, got %q", "taskid01", pod.TaskID())
+			}
+		})
+	}
+}
+
+func TestDockerPodContainerPoolIncompatible(t *testing.T) {
+	d := newFakeDockerDriver(t, http.NotFoundHandler(), WithDockerDriverWarmPool(WarmPoolConfig{
+		Images:        []string{"busybox:stable"},
+		Size:          1,
+		InitVolumeDir: "/tmp/agola",
+		ProjectDir:    "/root/project",
+	}))
+	pool := newWarmPool(zerolog.Nop(), 1, nil, nil, nil)
+	d.containerPools = map[string]*warmPool{"busybox:stable": pool}
+
+	mainContainer := func() *ContainerConfig {
+		return &ContainerConfig{
+			Image:      "busybox:stable",
+			Entrypoint: []string{"/tmp/agola/agola-toolbox", "sleeper"},
+		}
+	}
+
+	tests := []struct {
+		name       string
+		podConfig  func() *PodConfig
+		expectPool bool
+	}{
+		{
+			name: "test compatible pod",
+			podConfig: func() *PodConfig {
+				return &PodConfig{InitVolumeDir: "/tmp/agola", Containers: []*ContainerConfig{mainContainer()}}
+			},
+			expectPool: true,
+		},
+		{
+			name: "test image without pool",
+			podConfig: func() *PodConfig {
+				c := mainContainer()
+				c.Image = "alpine:3.11"
+				return &PodConfig{InitVolumeDir: "/tmp/agola", Containers: []*ContainerConfig{c}}
+			},
+		},
+		{
+			name: "test main container env",
+			podConfig: func() *PodConfig {
+				c := mainContainer()
+				c.Env = map[string]string{"FOO": "bar"}
+				return &PodConfig{InitVolumeDir: "/tmp/agola", Containers: []*ContainerConfig{c}}
+			},
+		},
+		{
+			name: "test different main container options",
+			podConfig: func() *PodConfig {
+				c := mainContainer()
+				c.User = "1000"
+				return &PodConfig{InitVolumeDir: "/tmp/agola", Containers: []*ContainerConfig{c}}
+			},
+		},
+		{
+			name: "test different init volume dir",
+			podConfig: func() *PodConfig {
+				return &PodConfig{InitVolumeDir: "/mnt/agola", Containers: []*ContainerConfig{mainContainer()}}
+			},
+		},
+		{
+			name: "test pod with secrets",
+			podConfig: func() *PodConfig {
+				return &PodConfig{InitVolumeDir: "/tmp/agola", Containers: []*ContainerConfig{mainContainer()}, Secrets: map[string][]byte{"secret01": []byte("secret")}}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := d.podContainerPool(tt.podConfig())
+			if tt.expectPool && p != pool {
+				t.Fatalf("expected container pool")
+			}
+			if !tt.expectPool && p != nil {
+				t.Fatalf("unexpected container pool")
+			}
+		})
+	}
+}
+
+func TestDockerPodRemovePooledContainer(t *testing.T) {
+	tests := []struct {
+		name            string
+		resetExitCode   int
+		expectedIdle    []string
+		expectedRemoved []string
+	}{
+		{
+			name:            "test pooled container reset and returned to the pool",
+			expectedIdle:    []string{"pooledcontainer01"},
+			expectedRemoved: []string{"/containers/containerid02", "/volumes/claimvol01"},
+		},
+		{
+			name:            "test pooled container removed when reset fails",
+			resetExitCode:   1,
+			expectedIdle:    []string{},
+			expectedRemoved: []string{"/containers/containerid02", "/volumes/claimvol01", "/containers/pooledcontainer01", "/volumes/pooltoolboxvol01"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			removed := []string{}
+			restarted := false
+			var execConfig types.ExecConfig
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if strings.HasSuffix(r.URL.Path, "/exec/execid01/start") {
+					_, _ = io.Copy(ioutil.Discard, r.Body)
+					conn, bufrw, err := w.(http.Hijacker).Hijack()
+					if err != nil {
+						t.Errorf("unexpected err: %v", err)
+						return
+					}
+					defer conn.Close()
+					_, _ = bufrw.WriteString("HTTP/1.1 101 UPGRADED\r\nContent-Type: application/vnd.docker.raw-stream\r\nConnection: Upgrade\r\nUpgrade: tcp\r\n\r\n")
+					_ = bufrw.Flush()
+					return
+				}
+
+				mu.Lock()
+				defer mu.Unlock()
+				switch {
+				case strings.HasSuffix(r.URL.Path, "/containers/pooledcontainer01/restart"):
+					restarted = true
+					w.WriteHeader(http.StatusNoContent)
+				case strings.HasSuffix(r.URL.Path, "/containers/pooledcontainer01/exec"):
+					_ = json.NewDecoder(r.Body).Decode(&execConfig)
+					w.WriteHeader(http.StatusCreated)
+					_, _ = w.Write([]byte(`{"Id":"execid01"}`))
+				case strings.HasSuffix(r.URL.Path, "/exec/execid01/json"):
+					_, _ = w.Write([]byte(fmt.Sprintf(`{"ID":"execid01","Running":false,"ExitCode":%d}`, tt.resetExitCode)))
+				case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/containers/pooledcontainer01/json"):
+					_, _ = w.Write([]byte(fmt.Sprintf(`{"Id":"pooledcontainer01","Config":{"Labels":{%q:"pooltoolboxvol01"}}}`, toolboxVolumeKey)))
+				case r.Method == http.MethodDelete:
+					removed = append(removed, r.URL.Path[strings.Index(r.URL.Path[1:], "/")+1:])
+					w.WriteHeader(http.StatusNoContent)
+				default:
+					w.WriteHeader(http.StatusNotFound)
+				}
+			})
+
+			d := newFakeDockerDriver(t, handler, WithDockerDriverWarmPool(WarmPoolConfig{
+				Images:        []string{"busybox:stable"},
+				Size:          1,
+				InitVolumeDir: "/tmp/agola",
+				ProjectDir:    "/root/project",
+			}))
+			pool := newWarmPool(zerolog.Nop(), 1, nil, d.resetPooledContainer, d.removePooledContainer)
+
+			pod := &DockerPod{
+				id:     "podid01",
+				client: d.client,
+				containers: []*DockerContainer{
+					{Index: 0, Name: mainContainerName, Container: types.Container{ID: "pooledcontainer01"}},
+					{Index: 1, Name: "service1", Container: types.Container{ID: "containerid02"}},
+				},
+				pooledMainContainer: true,
+				claimVolumeName:     "claimvol01",
+				containerPool:       pool,
+			}
+
+			if err := pod.Remove(context.Background()); err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if !restarted {
+				t.Fatalf("expected pooled container restart")
+			}
+			expectedCmd := []string{"sh", "-c", `rm -rf "$0"/* "$0"/.[!.]* "$0"/..?*`, "/root/project"}
+			if diff := cmp.Diff(expectedCmd, []string(execConfig.Cmd)); diff != "" {
+				t.Fatalf("unexpected reset cmd: %s", diff)
+			}
+			if execConfig.User != "0" {
+				t.Fatalf("expected reset exec user %q, got %q", "0", execConfig.User)
+			}
+			if diff := cmp.Diff(tt.expectedIdle, pool.idle, cmpopts.EquateEmpty()); diff != "" {
+				t.Fatalf("unexpected idle pooled containers: %s", diff)
+			}
+			if diff := cmp.Diff(tt.expectedRemoved, removed); diff != "" {
+				t.Fatalf("unexpected removed resources: %s", diff)
+			}
+		})
+	}
+}
+
+func TestDockerCreatePooledContainer(t *testing.T) {
+	var mu sync.Mutex
+	var created struct {
+		Image      string
+		Entrypoint []string
+		Labels     map[string]string
+		Volumes    map[string]struct{}
+	}
+	started := []string{}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/images/create"):
+			_, _ = w.Write([]byte(`{"status":"pulled"}`))
+		case strings.HasSuffix(r.URL.Path, "/volumes/create"):
+			w.WriteHeader(http.StatusCreated)
+			_, _ = w.Write([]byte(`{"Name":"pooltoolboxvol01"}`))
+		case strings.HasSuffix(r.URL.Path, "/containers/create"):
+			var body struct {
+				Entrypoint []string
+			}
+			data, _ := ioutil.ReadAll(r.Body)
+			_ = json.Unmarshal(data, &body)
+			w.WriteHeader(http.StatusCreated)
+			if len(body.Entrypoint) == 1 && body.Entrypoint[0] == "true" {
+				// toolbox volume helper container
+				_, _ = w.Write([]byte(`{"Id":"helperid01"}`))
+				return
+			}
+			_ = json.Unmarshal(data, &created)
+			_, _ = w.Write([]byte(`{"Id":"pooledcontainer01"}`))
+		case strings.HasSuffix(r.URL.Path, "/archive"):
+			w.WriteHeader(http.StatusOK)
+		case strings.HasSuffix(r.URL.Path, "/start"):
+			started = append(started, r.URL.Path[strings.Index(r.URL.Path[1:], "/")+1:])
+			w.WriteHeader(http.StatusNoContent)
+		case r.Method == http.MethodDelete:
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+
+	d := newFakeDockerDriver(t, handler, WithDockerDriverWarmPool(WarmPoolConfig{
+		Images:        []string{"busybox:stable"},
+		Size:          1,
+		InitVolumeDir: "/tmp/agola",
+		ProjectDir:    "/root/project",
+	}))
+	d.initImage = "busybox:latest"
+
+	id, err := d.createPooledContainer(context.Background(), "busybox:stable")
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if id != "pooledcontainer01" {
+		t.Fatalf("expected pooled container %q, got %q", "pooledcontainer01", id)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if created.Image != "busybox:stable" {
+		t.Fatalf("expected image %q, got %q", "busybox:stable", created.Image)
+	}
+	if diff := cmp.Diff([]string{"/tmp/agola/agola-toolbox", "sleeper"}, created.Entrypoint); diff != "" {
+		t.Fatalf("unexpected entrypoint: %s", diff)
+	}
+	if diff := cmp.Diff(map[string]struct{}{"/root/project": {}}, created.Volumes); diff != "" {
+		t.Fatalf("unexpected volumes: %s", diff)
+	}
+	if created.Labels[warmPoolKey] != "true" || created.Labels[toolboxVolumeKey] != "pooltoolboxvol01" {
+		t.Fatalf("unexpected labels: %v", created.Labels)
+	}
+	if _, ok := created.Labels[podIDKey]; ok {
+		t.Fatalf("unexpected pod id label on pooled container")
+	}
+	if diff := cmp.Diff([]string{"/containers/pooledcontainer01/start"}, started); diff != "" {
+		t.Fatalf("unexpected started containers: %s", diff)
+	}
+}
+
+func TestDockerGetPodsPooledContainer(t *testing.T) {
+	poolLabels := map[string]string{agolaLabelKey: agolaLabelValue, executorIDKey: "executorid01", warmPoolKey: "true"}
+	containers := []types.Container{
+		{ID: "pooledcontainer01", Image: "busybox:stable", Labels: poolLabels},
+		{ID: "pooledcontainer02", Image: "busybox:stable", Labels: poolLabels},
+		{
+			ID: "containerid02",
+			Labels: map[string]string{
+				agolaLabelKey:     agolaLabelValue,
+				executorIDKey:     "executorid01",
+				podIDKey:          "podid01",
+				taskIDKey:         "taskid01",
+				containerIndexKey: "1",
+				containerNameKey:  "service1",
+			},
+		},
+	}
+	volumes := volume.VolumeListOKBody{
+		Volumes: []*types.Volume{
+			{
+				Name: "claimvol01",
+				Labels: map[string]string{
+					agolaLabelKey:      agolaLabelValue,
+					executorIDKey:      "executorid01",
+					podIDKey:           "podid01",
+					taskIDKey:          "taskid01",
+					containerIndexKey:  "0",
+					containerNameKey:   mainContainerName,
+					pooledContainerKey: "pooledcontainer01",
+				},
+			},
+		},
+	}
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/containers/json"):
+			_ = json.NewEncoder(w).Encode(containers)
+		case strings.HasSuffix(r.URL.Path, "/volumes"):
+			_ = json.NewEncoder(w).Encode(volumes)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+
+	d := newFakeDockerDriver(t, handler)
+	pool := newWarmPool(zerolog.Nop(), 1, nil, nil, nil)
+	d.containerPools = map[string]*warmPool{"busybox:stable": pool}
+
+	pods, err := d.GetPods(context.Background(), true)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if len(pods) != 1 {
+		t.Fatalf("expected 1 pod, got %d", len(pods))
+	}
+	pod := pods[0].(*DockerPod)
+
+	containerIDs := []string{}
+	for _, c := range pod.containers {
+		containerIDs = append(containerIDs, c.ID)
+	}
+	if diff := cmp.Diff([]string{"pooledcontainer01", "containerid02"}, containerIDs); diff != "" {
+		t.Fatalf("unexpected pod containers: %s", diff)
+	}
+	if _, ok := pod.containersMap[mainContainerName]; !ok {
+		t.Fatalf("expected main container %q", mainContainerName)
+	}
+	if !pod.pooledMainContainer || pod.claimVolumeName != "claimvol01" || pod.containerPool != pool {
+		t.Fatalf("expected pooled main container claimed by volume %q", "claimvol01")
+	}
+	if pod.toolboxVolumeName != "" {
+		t.Fatalf("unexpected toolbox volume %q", pod.toolboxVolumeName)
+	}
+	if pod.TaskID() != "taskid01" {
+		t.Fatalf("expected task id %q, got %q", "taskid01", pod.TaskID())
+	}
+}
+
+func TestParseExtraHost(t *testing.T) {
+	tests := []struct {
+		extraHost    string
+		expectedHost string
+		expectedIP   string
+		expectedErr  bool
+	}{
+		{extraHost: "db.internal:10.0.0.1", expectedHost: "db.internal", expectedIP: "10.0.0.1"},
+		{extraHost: "db.internal:fe80::1", expectedHost: "db.internal", expectedIP: "fe80::1"},
+		{extraHost: "db.internal", expectedErr: true},
+		{extraHost: ":10.0.0.1", expectedErr: true},
+		{extraHost: "db internal:10.0.0.1", expectedErr: true},
+		{extraHost: "db.internal:notanip", expectedErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.extraHost, func(t *testing.T) {
+			host, ip, err := parseExtraHost(tt.extraHost)
+			if tt.expectedErr {
+				if !util.APIErrorIs(err, util.ErrBadRequest) {
+					t.Fatalf("expected bad request error, got: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			if host != tt.expectedHost || ip != tt.expectedIP {
+				t.Fatalf("expected %s:%s, got %s:%s", tt.expectedHost, tt.expectedIP, host, ip)
+			}
+		})
+	}
+}
+
+func TestToolboxExecCmd(t *testing.T) {
+	tests := []struct {
+		name        string
+		execConfig  *ExecConfig
+		expectedCmd []string
+		expectedErr string
+	}{
+		{
+			name: "test default inherits container env",
+			execConfig: &ExecConfig{
+				Cmd:        []string{"ls", "-l"},
+				Env:        map[string]string{"ENV01": "VALUE01"},
+				WorkingDir: "/work",
+			},
+			expectedCmd: []string{"/tmp/agola/agola-toolbox", "exec", "-e", `{"ENV01":"VALUE01"}`, "-w", "/work", "--", "ls", "-l"},
+		},
+		{
+			name: "test inherit container env",
+			execConfig: &ExecConfig{
+				Cmd:                 []string{"ls"},
+				WorkingDir:          "/work",
+				InheritContainerEnv: util.BoolP(true),
+			},
+			expectedCmd: []string{"/tmp/agola/agola-toolbox", "exec", "-e", "null", "-w", "/work", "--", "ls"},
+		},
+		{
+			name: "test clean env",
+			execConfig: &ExecConfig{
+				Cmd:                 []string{"ls"},
+				WorkingDir:          "/work",
+				InheritContainerEnv: util.BoolP(false),
+			},
+			expectedCmd: []string{"/tmp/agola/agola-toolbox", "exec", "-e", "null", "-w", "/work", "--clean-env", "--", "ls"},
+		},
+		{
+			name: "test shell",
+			execConfig: &ExecConfig{
+				Cmd:        []string{"echo 01\necho 02"},
+				WorkingDir: "/work",
+				Shell:      []string{"/bin/sh", "-c"},
+			},
+			expectedCmd: []string{"/tmp/agola/agola-toolbox", "exec", "-e", "null", "-w", "/work", "--", "/bin/sh", "-c", "echo 01\necho 02"},
+		},
+		{
+			name: "test shell with arguments",
+			execConfig: &ExecConfig{
+				Cmd:        []string{`echo "$@"`, "a b", "c;$HOME"},
+				WorkingDir: "/work",
+				Shell:      []string{"/bin/sh", "-c"},
+			},
+			expectedCmd: []string{"/tmp/agola/agola-toolbox", "exec", "-e", "null", "-w", "/work", "--", "/bin/sh", "-c", `echo "$@"`, "/bin/sh", "a b", "c;$HOME"},
+		},
+		{
+			name: "test empty shell executable",
+			execConfig: &ExecConfig{
+				Cmd:        []string{"ls"},
+				WorkingDir: "/work",
+				Shell:      []string{"", "-c"},
+			},
+			expectedErr: "empty exec shell executable",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd, err := toolboxExecCmd("/tmp/agola", tt.execConfig)
+			if tt.expectedErr != "" {
+				if err == nil {
+					t.Fatalf("expected err %q, got nil err", tt.expectedErr)
+				}
+				if err.Error() != tt.expectedErr {
+					t.Fatalf("expected err %q, got err: %q", tt.expectedErr, err.Error())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			if diff := cmp.Diff(tt.expectedCmd, cmd); diff != "" {
+				t.Fatalf("unexpected cmd: %s", diff)
+			}
+		})
+	}
+}
+
+func TestToolboxExecCmdShellArguments(t *testing.T) {
+	if _, err := os.Stat("/bin/sh"); err != nil {
+		t.Skipf("missing /bin/sh")
+	}
+
+	args := []string{"a b", "c;$HOME", "'d'"}
+	cmd, err := toolboxExecCmd("/tmp/agola", &ExecConfig{
+		Cmd:   append([]string{`printf '%s\n' "$@"`}, args...),
+		Shell: []string{"/bin/sh", "-c"},
+	})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	// run the shell command like the toolbox exec does
+	var shellCmd []string
+	for i, arg := range cmd {
+		if arg == "--" {
+			shellCmd = cmd[i+1:]
+			break
+		}
+	}
+	out, err := exec.Command(shellCmd[0], shellCmd[1:]...).Output()
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if diff := cmp.Diff(args, strings.Split(strings.TrimSuffix(string(out), "\n"), "\n")); diff != "" {
+		t.Fatalf("unexpected shell arguments: %s", diff)
+	}
+}
+
+// containerCreateRecorder records the last container create request received
+// by the fake docker daemon
+type containerCreateRecorder struct {
+	mu sync.Mutex
+	container.Config
+	HostConfig *container.HostConfig
+}
+
+func (c *containerCreateRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasSuffix(r.URL.Path, "/containers/create") {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// reset the previously recorded config since decoding merges maps
+	c.Config = container.Config{}
+	c.HostConfig = nil
+	if err := json.NewDecoder(r.Body).Decode(c); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	_, _ = w.Write([]byte(`{"Id":"containerid01"}`))
+}
+
+func TestDockerCreateContainerExpiryLabel(t *testing.T) {
+	createdConfig := &containerCreateRecorder{}
+
+	ttl := 6 * time.Hour
+	d := newFakeDockerDriver(t, createdConfig, WithDockerDriverResourceTTL(ttl))
+
+	podConfig := &PodConfig{
+		ID:     "podid01",
+		TaskID: "taskid01",
+		Containers: []*ContainerConfig{
+			{Image: "busybox", Cmd: []string{"cat"}},
+		},
+		InitVolumeDir: "/tmp/agola",
+	}
+
+	before := time.Now().Add(ttl).UTC().Truncate(time.Second)
+	if _, err := d.createContainer(context.Background(), 0, podConfig, "", &types.Volume{Name: "volume01"}); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	after := time.Now().Add(ttl).UTC()
+
+	expiryLabel, ok := createdConfig.Labels[expiryKey]
+	if !ok {
+		t.Fatalf("missing expiry label, got labels: %v", createdConfig.Labels)
+	}
+	expiry, err := time.Parse(time.RFC3339, expiryLabel)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if expiry.Before(before) || expiry.After(after) {
+		t.Fatalf("expected expiry between %s and %s, got %s", before, after, expiry)
+	}
+}
+
+func TestDockerCreateContainerEntrypointCmd(t *testing.T) {
+	tests := []struct {
+		name               string
+		entrypoint         []string
+		cmd                []string
+		expectedEntrypoint []string
+		expectedCmd        []string
+	}{
+		{
+			name: "test image entrypoint and cmd",
+		},
+		{
+			name:               "test only cmd used as entrypoint",
+			cmd:                []string{"redis-server", "--appendonly", "yes"},
+			expectedEntrypoint: []string{"redis-server", "--appendonly", "yes"},
+		},
+		{
+			name:               "test only entrypoint",
+			entrypoint:         []string{"/docker-entrypoint.sh"},
+			expectedEntrypoint: []string{"/docker-entrypoint.sh"},
+		},
+		{
+			name:               "test entrypoint and cmd",
+			entrypoint:         []string{"/docker-entrypoint.sh"},
+			cmd:                []string{"postgres", "-c", "fsync=off"},
+			expectedEntrypoint: []string{"/docker-entrypoint.sh"},
+			expectedCmd:        []string{"postgres", "-c", "fsync=off"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			createdConfig := &containerCreateRecorder{}
+			d := newFakeDockerDriver(t, createdConfig)
+
+			podConfig := &PodConfig{
+				ID:     "podid01",
+				TaskID: "taskid01",
+				Containers: []*ContainerConfig{
+					{Image: "busybox", Cmd: []string{"cat"}},
+					{Image: "postgres", Entrypoint: tt.entrypoint, Cmd: tt.cmd},
+				},
+				InitVolumeDir: "/tmp/agola",
+			}
+			if _, err := d.createContainer(context.Background(), 1, podConfig, "containerid01", &types.Volume{Name: "volume01"}); err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+
+			if diff := cmp.Diff(strslice.StrSlice(tt.expectedEntrypoint), createdConfig.Entrypoint); diff != "" {
+				t.Fatalf("unexpected entrypoint: %s", diff)
+			}
+			if diff := cmp.Diff(strslice.StrSlice(tt.expectedCmd), createdConfig.Cmd); diff != "" {
+				t.Fatalf("unexpected cmd: %s", diff)
+			}
+		})
+	}
+}
+
+func TestDockerCreateContainerUser(t *testing.T) {
+	createdConfig := &containerCreateRecorder{}
+	d := newFakeDockerDriver(t, createdConfig)
+
+	podConfig := &PodConfig{
+		ID:     "podid01",
+		TaskID: "taskid01",
+		Containers: []*ContainerConfig{
+			{Image: "busybox", Cmd: []string{"cat"}},
+			{Image: "postgres", User: "999:999"},
+		},
+		InitVolumeDir: "/tmp/agola",
+	}
+
+	if _, err := d.createContainer(context.Background(), 0, podConfig, "", &types.Volume{Name: "volume01"}); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if createdConfig.User != "" {
+		t.Fatalf("expected image user, got user %q", createdConfig.User)
+	}
+
+	if _, err := d.createContainer(context.Background(), 1, podConfig, "containerid01", &types.Volume{Name: "volume01"}); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if createdConfig.User != "999:999" {
+		t.Fatalf("expected user %q, got user %q", "999:999", createdConfig.User)
+	}
+}
+
+func TestDockerExtraLabels(t *testing.T) {
+	extraLabels := map[string]string{"team": "team01", "environment": "test"}
+
+	t.Run("test container extra labels", func(t *testing.T) {
+		createdConfig := &containerCreateRecorder{}
+		d := newFakeDockerDriver(t, createdConfig, WithDockerDriverExtraLabels(extraLabels))
+
+		podConfig := &PodConfig{
+			ID:     "podid01",
+			TaskID: "taskid01",
+			Containers: []*ContainerConfig{
+				{Image: "busybox", Cmd: []string{"cat"}},
+			},
+			InitVolumeDir: "/tmp/agola",
+		}
+		if _, err := d.createContainer(context.Background(), 0, podConfig, "", &types.Volume{Name: "volume01"}); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+
+		for k, v := range extraLabels {
+			if createdConfig.Labels[k] != v {
+				t.Fatalf("expected label %s=%s, got labels: %v", k, v, createdConfig.Labels)
+			}
+		}
+		if createdConfig.Labels[podIDKey] != "podid01" {
+			t.Fatalf("expected label %s=%s, got labels: %v", podIDKey, "podid01", createdConfig.Labels)
+		}
+	})
+
+	t.Run("test volume extra labels", func(t *testing.T) {
+		var createdLabels map[string]string
+		handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !strings.HasSuffix(r.URL.Path, "/volumes/create") {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			var body volume.VolumeCreateBody
+			_ = json.NewDecoder(r.Body).Decode(&body)
+			createdLabels = body.Labels
+			w.WriteHeader(http.StatusCreated)
+			_ = json.NewEncoder(w).Encode(types.Volume{Name: body.Name, Labels: body.Labels})
+		})
+		d := newFakeDockerDriver(t, handler, WithDockerDriverExtraLabels(extraLabels))
+
+		if _, err := d.ensurePersistentVolume(context.Background(), "cachekey01"); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		for k, v := range extraLabels {
+			if createdLabels[k] != v {
+				t.Fatalf("expected label %s=%s, got labels: %v", k, v, createdLabels)
+			}
+		}
+	})
+
+	t.Run("test pod labels passthrough", func(t *testing.T) {
+		containers := []types.Container{
+			{
+				ID: "containerid01",
+				Labels: map[string]string{
+					agolaLabelKey:     agolaLabelValue,
+					executorIDKey:     "executorid01",
+					podIDKey:          "podid01",
+					containerIndexKey: "0",
+					"team":            "team01",
+					"environment":     "test",
+					"other":           "other01",
+				},
+			},
+		}
+		handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch {
+			case strings.HasSuffix(r.URL.Path, "/containers/json"):
+				_ = json.NewEncoder(w).Encode(containers)
+			case strings.HasSuffix(r.URL.Path, "/volumes"):
+				_ = json.NewEncoder(w).Encode(volume.VolumeListOKBody{})
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		})
+		d := newFakeDockerDriver(t, handler, WithDockerDriverExtraLabels(extraLabels))
+
+		pods, err := d.GetPods(context.Background(), true)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if len(pods) != 1 {
+			t.Fatalf("expected 1 pod, got %d", len(pods))
+		}
+
+		expectedLabels := map[string]string{
+			agolaLabelKey:     agolaLabelValue,
+			executorIDKey:     "executorid01",
+			podIDKey:          "podid01",
+			containerIndexKey: "0",
+			"team":            "team01",
+			"environment":     "test",
+		}
+		if diff := cmp.Diff(expectedLabels, pods[0].(*DockerPod).labels); diff != "" {
+			t.Fatalf("unexpected pod labels: %s", diff)
+		}
+	})
+}
+
+func TestDockerCreateContainerAliases(t *testing.T) {
+	createdConfig := &containerCreateRecorder{}
+	d := newFakeDockerDriver(t, createdConfig)
+
+	podConfig := &PodConfig{
+		ID:     "podid01",
+		TaskID: "taskid01",
+		Containers: []*ContainerConfig{
+			{Image: "busybox", Cmd: []string{"cat"}, ExtraHosts: []string{"db.internal:10.0.0.1"}},
+			{Name: "redis", Image: "redis", Aliases: []string{"redis"}},
+			{Name: "postgres", Image: "postgres", Aliases: []string{"postgres", "db.local"}},
+		},
+		InitVolumeDir: "/tmp/agola",
+	}
+
+	if _, err := d.createContainer(context.Background(), 0, podConfig, "", &types.Volume{Name: "volume01"}); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	// the aliases are set on the main container since its hosts file is
+	// shared with the other pod containers
+	expectedExtraHosts := []string{"db.internal:10.0.0.1", "redis:127.0.0.1", "postgres:127.0.0.1", "db.local:127.0.0.1"}
+	if diff := cmp.Diff(expectedExtraHosts, createdConfig.HostConfig.ExtraHosts); diff != "" {
+		t.Fatalf("unexpected extra hosts: %s", diff)
+	}
+
+	if _, err := d.createContainer(context.Background(), 1, podConfig, "containerid01", &types.Volume{Name: "volume01"}); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if len(createdConfig.HostConfig.ExtraHosts) != 0 {
+		t.Fatalf("unexpected extra hosts on service container: %v", createdConfig.HostConfig.ExtraHosts)
+	}
+}
+
+func TestDockerCreateContainerBindVolume(t *testing.T) {
+	createdConfig := &containerCreateRecorder{}
+	d := newFakeDockerDriver(t, createdConfig)
+
+	podConfig := &PodConfig{
+		ID:     "podid01",
+		TaskID: "taskid01",
+		Containers: []*ContainerConfig{
+			{
+				Image: "busybox",
+				Cmd:   []string{"cat"},
+				Volumes: []Volume{
+					{Path: "/root/.npm", Bind: &VolumeBind{Source: "/var/cache/agola/npm"}},
+					{Path: "/etc/certs", Bind: &VolumeBind{Source: "/var/cache/agola/certs", ReadOnly: true}},
+				},
+			},
+		},
+		InitVolumeDir: "/tmp/agola",
+	}
+
+	if _, err := d.createContainer(context.Background(), 0, podConfig, "", &types.Volume{Name: "volume01"}); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	expectedMounts := []mount.Mount{
+		{Type: mount.TypeBind, Source: "/var/cache/agola/npm", Target: "/root/.npm"},
+		{Type: mount.TypeBind, Source: "/var/cache/agola/certs", Target: "/etc/certs", ReadOnly: true},
+	}
+	if diff := cmp.Diff(expectedMounts, createdConfig.HostConfig.Mounts); diff != "" {
+		t.Fatalf("unexpected mounts: %s", diff)
+	}
+}
+
+func TestDockerPopulateToolboxVolume(t *testing.T) {
+	tests := []struct {
+		name        string
+		failCopy    bool
+		expectedErr string
+	}{
+		{
+			name: "test populate toolbox volume",
+		},
+		{
+			name:        "test copy failure",
+			failCopy:    true,
+			expectedErr: "Error response from daemon: cannot copy",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var binds []string
+			started := false
+			removed := []string{}
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				defer mu.Unlock()
+				switch {
+				case strings.HasSuffix(r.URL.Path, "/images/create"):
+					_, _ = w.Write([]byte(`{"status":"pulled"}`))
+				case strings.HasSuffix(r.URL.Path, "/containers/create"):
+					var req struct {
+						HostConfig container.HostConfig
+					}
+					if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+						t.Errorf("unexpected err: %v", err)
+					}
+					binds = req.HostConfig.Binds
+					w.WriteHeader(http.StatusCreated)
+					_, _ = w.Write([]byte(`{"Id":"helperid01"}`))
+				case strings.HasSuffix(r.URL.Path, "/start"):
+					started = true
+					w.WriteHeader(http.StatusNoContent)
+				case strings.HasSuffix(r.URL.Path, "/containers/helperid01/archive"):
+					if tt.failCopy {
+						w.Header().Set("Content-Type", "application/json")
+						w.WriteHeader(http.StatusInternalServerError)
+						_, _ = w.Write([]byte(`{"message":"cannot copy"}`))
+						return
+					}
+					w.WriteHeader(http.StatusOK)
+				case r.Method == http.MethodDelete && strings.Contains(r.URL.Path, "/containers/"):
+					parts := strings.Split(r.URL.Path, "/")
+					removed = append(removed, parts[len(parts)-1])
+					w.WriteHeader(http.StatusNoContent)
+				default:
+					w.WriteHeader(http.StatusNotFound)
+				}
+			})
+
+			d := newFakeDockerDriver(t, handler)
+			d.initImage = "busybox:latest"
+
+			err := d.populateToolboxVolume(context.Background(), "toolboxvol01", ioutil.Discard)
+			if tt.expectedErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected err: %v", err)
+				}
+			} else {
+				if err == nil {
+					t.Fatalf("expected err %q, got nil err", tt.expectedErr)
+				}
+				if err.Error() != tt.expectedErr {
+					t.Fatalf("expected err %q, got err: %q", tt.expectedErr, err.Error())
+				}
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if diff := cmp.Diff([]string{"toolboxvol01:/tmp/agola"}, binds); diff != "" {
+				t.Fatalf("unexpected helper container binds: %s", diff)
+			}
+			if started {
+				t.Fatalf("expected helper container not started")
+			}
+			if diff := cmp.Diff([]string{"helperid01"}, removed); diff != "" {
+				t.Fatalf("unexpected removed containers: %s", diff)
+			}
+		})
+	}
+}
+
+func TestDockerCreateVolume(t *testing.T) {
+	tests := []struct {
+		name             string
+		volumeName       string
+		createStatuses   []int
+		expectedCreates  int
+		expectedInspects int
+		expectedErr      string
+	}{
+		{
+			name:            "test volume created",
+			createStatuses:  []int{http.StatusCreated},
+			expectedCreates: 1,
+		},
+		{
+			name:             "test volume already existing",
+			volumeName:       "volume01",
+			createStatuses:   []int{http.StatusConflict},
+			expectedCreates:  1,
+			expectedInspects: 1,
+		},
+		{
+			name:            "test transient errors retried",
+			createStatuses:  []int{http.StatusInternalServerError, http.StatusServiceUnavailable, http.StatusCreated},
+			expectedCreates: 3,
+		},
+		{
+			name:            "test non transient error not retried",
+			createStatuses:  []int{http.StatusBadRequest},
+			expectedCreates: 1,
+			expectedErr:     "Error response from daemon: create error",
+		},
+		{
+			name:            "test transient errors retries exhausted",
+			createStatuses:  []int{http.StatusInternalServerError},
+			expectedCreates: 4,
+			expectedErr:     "failed to create volume after 4 attempts: Error response from daemon: create error",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			creates := 0
+			inspects := 0
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				defer mu.Unlock()
+				switch {
+				case strings.HasSuffix(r.URL.Path, "/volumes/create"):
+					status := tt.createStatuses[len(tt.createStatuses)-1]
+					if creates < len(tt.createStatuses) {
+						status = tt.createStatuses[creates]
+					}
+					creates++
+					if status != http.StatusCreated {
+						w.Header().Set("Content-Type", "application/json")
+						w.WriteHeader(status)
+						_, _ = w.Write([]byte(`{"message":"create error"}`))
+						return
+					}
+					w.WriteHeader(http.StatusCreated)
+					_ = json.NewEncoder(w).Encode(types.Volume{Name: "volume01"})
+				case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/volumes/volume01"):
+					inspects++
+					_ = json.NewEncoder(w).Encode(types.Volume{Name: "volume01", Labels: map[string]string{"existing": "true"}})
+				default:
+					w.WriteHeader(http.StatusNotFound)
+				}
+			})
+			d := newFakeDockerDriver(t, handler)
+
+			vol, err := d.createVolume(context.Background(), volume.VolumeCreateBody{Name: tt.volumeName, Driver: "local"})
+			if tt.expectedErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected err: %v", err)
+				}
+				if vol.Name != "volume01" {
+					t.Fatalf("expected volume %q, got %q", "volume01", vol.Name)
+				}
+			} else {
+				if err == nil {
+					t.Fatalf("expected err %q, got nil err", tt.expectedErr)
+				}
+				if err.Error() != tt.expectedErr {
+					t.Fatalf("expected err %q, got err: %q", tt.expectedErr, err.Error())
+				}
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if creates != tt.expectedCreates {
+				t.Fatalf("expected %d volume creates, got %d", tt.expectedCreates, creates)
+			}
+			if inspects != tt.expectedInspects {
+				t.Fatalf("expected %d volume inspects, got %d", tt.expectedInspects, inspects)
+			}
+		})
+	}
+}
+
+func TestDockerCreateContainerPersistentVolume(t *testing.T) {
+	var mu sync.Mutex
+	var createdVolumes []volume.VolumeCreateBody
+	var createdMounts [][]mount.Mount
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/volumes/create"):
+			var body volume.VolumeCreateBody
+			_ = json.NewDecoder(r.Body).Decode(&body)
+			createdVolumes = append(createdVolumes, body)
+			// the volume was already created by another pod
+			if len(createdVolumes) > 1 {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusConflict)
+				_, _ = w.Write([]byte(`{"message":"volume already exists"}`))
+				return
+			}
+			w.WriteHeader(http.StatusCreated)
+			_ = json.NewEncoder(w).Encode(types.Volume{Name: body.Name, Labels: body.Labels})
+		case r.Method == http.MethodGet && strings.Contains(r.URL.Path, "/volumes/"):
+			parts := strings.Split(r.URL.Path, "/")
+			_ = json.NewEncoder(w).Encode(types.Volume{Name: parts[len(parts)-1]})
+		case strings.HasSuffix(r.URL.Path, "/containers/create"):
+			var config struct {
+				HostConfig *container.HostConfig
+			}
+			_ = json.NewDecoder(r.Body).Decode(&config)
+			createdMounts = append(createdMounts, config.HostConfig.Mounts)
+			w.WriteHeader(http.StatusCreated)
+			_, _ = w.Write([]byte(`{"Id":"containerid01"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+	d := newFakeDockerDriver(t, handler)
+
+	podConfig := &PodConfig{
+		ID:     "podid01",
+		TaskID: "taskid01",
+		Containers: []*ContainerConfig{
+			{
+				Image:   "busybox",
+				Cmd:     []string{"cat"},
+				Volumes: []Volume{{Path: "/root/.npm", Persistent: &VolumePersistent{CacheKey: "project01/npm"}}},
+			},
+		},
+		InitVolumeDir: "/tmp/agola",
+	}
+
+	// the second container creation finds the volume already existing
+	for i := 0; i < 2; i++ {
+		if _, err := d.createContainer(context.Background(), 0, podConfig, "", &types.Volume{Name: "volume01"}); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+	}
+
+	name := persistentVolumeName("project01/npm")
+	expectedVolume := volume.VolumeCreateBody{
+		Name:   name,
+		Driver: "local",
+		Labels: map[string]string{
+			agolaLabelKey:       agolaLabelValue,
+			executorIDKey:       "executorid01",
+			persistentVolumeKey: "true",
+			cacheKeyKey:         "project01/npm",
+		},
+	}
+	if diff := cmp.Diff([]volume.VolumeCreateBody{expectedVolume, expectedVolume}, createdVolumes); diff != "" {
+		t.Fatalf("unexpected created volumes: %s", diff)
+	}
+	expectedMounts := []mount.Mount{{Type: mount.TypeVolume, Source: name, Target: "/root/.npm"}}
+	if diff := cmp.Diff([][]mount.Mount{expectedMounts, expectedMounts}, createdMounts); diff != "" {
+		t.Fatalf("unexpected mounts: %s", diff)
+	}
+}
+
+func TestDockerEvictPersistentVolume(t *testing.T) {
+	tests := []struct {
+		name         string
+		status       int
+		expectedErr  string
+		expectedKind util.ErrorKind
+	}{
+		{
+			name:   "test evict persistent volume",
+			status: http.StatusNoContent,
+		},
+		{
+			name:         "test evict missing persistent volume",
+			status:       http.StatusNotFound,
+			expectedErr:  `persistent volume for cache key "project01/npm" doesn't exist`,
+			expectedKind: util.ErrNotExist,
+		},
+		{
+			name:         "test evict persistent volume in use",
+			status:       http.StatusConflict,
+			expectedErr:  `persistent volume for cache key "project01/npm" is in use`,
+			expectedKind: util.ErrConflict,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var removed []string
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != http.MethodDelete || !strings.Contains(r.URL.Path, "/volumes/") {
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+				removed = append(removed, r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:])
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(tt.status)
+				if tt.status != http.StatusNoContent {
+					_, _ = w.Write([]byte(`{"message":"volume error"}`))
+				}
+			})
+			d := newFakeDockerDriver(t, handler)
+
+			err := d.EvictPersistentVolume(context.Background(), "project01/npm")
+			if diff := cmp.Diff([]string{persistentVolumeName("project01/npm")}, removed); diff != "" {
+				t.Fatalf("unexpected removed volumes: %s", diff)
+			}
+			if tt.expectedErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected err: %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("expected err %q, got nil err", tt.expectedErr)
+			}
+			if err.Error() != tt.expectedErr {
+				t.Fatalf("expected err %q, got err: %q", tt.expectedErr, err.Error())
+			}
+			if !util.APIErrorIs(err, tt.expectedKind) {
+				t.Fatalf("expected err kind %q, got err: %v", tt.expectedKind, err)
+			}
+		})
+	}
+}
+
+func TestDockerNewPodBindSources(t *testing.T) {
+	tests := []struct {
+		name           string
+		allowedSources []string
+		source         string
+		expectedErr    string
+	}{
+		{
+			name:        "test bind without allowed sources",
+			source:      "/var/cache/agola",
+			expectedErr: `bind source "/var/cache/agola" isn't allowed`,
+		},
+		{
+			name:           "test bind outside the allowed sources",
+			allowedSources: []string{"/var/cache/agola"},
+			source:         "/var/cache/agola-other",
+			expectedErr:    `bind source "/var/cache/agola-other" isn't allowed`,
+		},
+		{
+			name:           "test bind of an allowed source",
+			allowedSources: []string{"/var/cache/other", "/var/cache/agola/"},
+			source:         "/var/cache/agola",
+		},
+		{
+			name:           "test bind inside an allowed source",
+			allowedSources: []string{"/var/cache/agola"},
+			source:         "/var/cache/agola/npm",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newFakeDockerDriver(t, http.NotFoundHandler(), WithDockerDriverAllowedBindSources(tt.allowedSources))
+
+			if tt.expectedErr == "" {
+				if !d.bindSourceAllowed(tt.source) {
+					t.Fatalf("expected bind source %q to be allowed", tt.source)
+				}
+				return
+			}
+
+			_, err := d.NewPod(context.Background(), &PodConfig{
+				ID:     "podid01",
+				TaskID: "taskid01",
+				Containers: []*ContainerConfig{
+					{Image: "busybox", Volumes: []Volume{{Path: "/cache", Bind: &VolumeBind{Source: tt.source}}}},
+				},
+				InitVolumeDir: "/tmp/agola",
+			}, ioutil.Discard)
+			if err == nil {
+				t.Fatalf("expected err %q, got nil err", tt.expectedErr)
+			}
+			if err.Error() != tt.expectedErr {
+				t.Fatalf("expected err %q, got err: %q", tt.expectedErr, err.Error())
+			}
+			if !util.APIErrorIs(err, util.ErrForbidden) {
+				t.Fatalf("expected err kind %q, got err: %v", util.ErrForbidden, err)
+			}
+		})
+	}
+}
+
+func TestDockerCreateContainerHealthcheck(t *testing.T) {
+	createdConfig := &containerCreateRecorder{}
+	d := newFakeDockerDriver(t, createdConfig)
+
+	healthcheck := &Healthcheck{
+		Test:        []string{"CMD-SHELL", "pg_isready -U postgres"},
+		Interval:    2 * time.Second,
+		Timeout:     time.Second,
+		StartPeriod: 10 * time.Second,
+		Retries:     5,
+	}
+	podConfig := &PodConfig{
+		ID:     "podid01",
+		TaskID: "taskid01",
+		Containers: []*ContainerConfig{
+			{Image: "busybox", Cmd: []string{"cat"}},
+			{Image: "postgres", Healthcheck: healthcheck},
+		},
+		InitVolumeDir: "/tmp/agola",
+	}
+
+	if _, err := d.createContainer(context.Background(), 1, podConfig, "containerid01", &types.Volume{Name: "volume01"}); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	expectedHealthcheck := &container.HealthConfig{
+		Test:        []string{"CMD-SHELL", "pg_isready -U postgres"},
+		Interval:    2 * time.Second,
+		Timeout:     time.Second,
+		StartPeriod: 10 * time.Second,
+		Retries:     5,
+	}
+	if diff := cmp.Diff(expectedHealthcheck, createdConfig.Healthcheck); diff != "" {
+		t.Fatalf("unexpected healthcheck: %s", diff)
+	}
+}
+
+func TestDockerCreateContainerDNS(t *testing.T) {
+	createdConfig := &containerCreateRecorder{}
+	d := newFakeDockerDriver(t, createdConfig)
+
+	dns := &DNSConfig{
+		Servers:  []string{"10.0.0.53"},
+		Searches: []string{"internal.example.com"},
+		Options:  []string{"ndots:2"},
+	}
+	podConfig := &PodConfig{
+		ID:     "podid01",
+		TaskID: "taskid01",
+		Containers: []*ContainerConfig{
+			{Image: "busybox", Cmd: []string{"cat"}},
+		},
+		InitVolumeDir: "/tmp/agola",
+		DNS:           dns,
+	}
+
+	if _, err := d.createContainer(context.Background(), 0, podConfig, "", &types.Volume{Name: "volume01"}); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	hostConfig := createdConfig.HostConfig
+	if diff := cmp.Diff(dns, &DNSConfig{Servers: hostConfig.DNS, Searches: hostConfig.DNSSearch, Options: hostConfig.DNSOptions}); diff != "" {
+		t.Fatalf("unexpected dns config: %s", diff)
+	}
+}
+
+func TestDockerCreateContainerReadOnlyRootfs(t *testing.T) {
+	createdConfig := &containerCreateRecorder{}
+	d := newFakeDockerDriver(t, createdConfig)
+
+	podConfig := &PodConfig{
+		ID:     "podid01",
+		TaskID: "taskid01",
+		Containers: []*ContainerConfig{
+			{Image: "busybox", Cmd: []string{"cat"}, ReadOnlyRootfs: true},
+			{Image: "busybox", Cmd: []string{"cat"}},
+		},
+		InitVolumeDir: "/tmp/agola",
+	}
+
+	for i, expectedReadOnlyRootfs := range []bool{true, false} {
+		if _, err := d.createContainer(context.Background(), i, podConfig, "containerid01", &types.Volume{Name: "volume01"}); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if createdConfig.HostConfig.ReadonlyRootfs != expectedReadOnlyRootfs {
+			t.Fatalf("container %d: expected read only rootfs %t, got %t", i, expectedReadOnlyRootfs, createdConfig.HostConfig.ReadonlyRootfs)
+		}
+	}
+}
+
+func TestDockerCreateContainerShmSize(t *testing.T) {
+	createdConfig := &containerCreateRecorder{}
+	d := newFakeDockerDriver(t, createdConfig)
+
+	podConfig := &PodConfig{
+		ID:     "podid01",
+		TaskID: "taskid01",
+		Containers: []*ContainerConfig{
+			{Image: "busybox", Cmd: []string{"cat"}, ShmSizeBytes: 512 * 1024 * 1024},
+			{Image: "busybox", Cmd: []string{"cat"}},
+		},
+		InitVolumeDir: "/tmp/agola",
+	}
+
+	for i, expectedShmSize := range []int64{512 * 1024 * 1024, 0} {
+		if _, err := d.createContainer(context.Background(), i, podConfig, "containerid01", &types.Volume{Name: "volume01"}); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if createdConfig.HostConfig.ShmSize != expectedShmSize {
+			t.Fatalf("container %d: expected shm size %d, got %d", i, expectedShmSize, createdConfig.HostConfig.ShmSize)
+		}
+	}
+}
+
+func TestDockerCreateContainerSysctls(t *testing.T) {
+	createdConfig := &containerCreateRecorder{}
+	d := newFakeDockerDriver(t, createdConfig)
+
+	podConfig := &PodConfig{
+		ID:     "podid01",
+		TaskID: "taskid01",
+		Containers: []*ContainerConfig{
+			{Image: "busybox", Cmd: []string{"cat"}, Sysctls: map[string]string{"net.core.somaxconn": "1024"}},
+			{Image: "busybox", Cmd: []string{"cat"}, Sysctls: map[string]string{"kernel.shmmax": "268435456"}},
+		},
+		InitVolumeDir: "/tmp/agola",
+	}
+
+	for i, expectedSysctls := range []map[string]string{{"net.core.somaxconn": "1024"}, {"kernel.shmmax": "268435456"}} {
+		if _, err := d.createContainer(context.Background(), i, podConfig, "containerid01", &types.Volume{Name: "volume01"}); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if diff := cmp.Diff(expectedSysctls, createdConfig.HostConfig.Sysctls); diff != "" {
+			t.Fatalf("container %d: unexpected sysctls: %s", i, diff)
+		}
+	}
+}
+
+func TestDockerCreateContainerSecurityOpt(t *testing.T) {
+	dir := t.TempDir()
+
+	seccompProfilePath := filepath.Join(dir, "seccomp.json")
+	if err := ioutil.WriteFile(seccompProfilePath, []byte("{\n  \"defaultAction\": \"SCMP_ACT_ALLOW\"\n}\n"), 0644); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	invalidSeccompProfilePath := filepath.Join(dir, "invalid.json")
+	if err := ioutil.WriteFile(invalidSeccompProfilePath, []byte("{\"defaultAction\": "), 0644); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	tests := []struct {
+		name                string
+		containerConfig     *ContainerConfig
+		expectedSecurityOpt []string
+		expectedErr         string
+	}{
+		{
+			name:            "test no security options",
+			containerConfig: &ContainerConfig{Image: "busybox", Cmd: []string{"cat"}},
+		},
+		{
+			name:                "test seccomp and apparmor profiles",
+			containerConfig:     &ContainerConfig{Image: "busybox", Cmd: []string{"cat"}, SeccompProfilePath: seccompProfilePath, AppArmorProfile: "agola-task"},
+			expectedSecurityOpt: []string{`seccomp={"defaultAction":"SCMP_ACT_ALLOW"}`, "apparmor=agola-task"},
+		},
+		{
+			name:            "test unexistent seccomp profile",
+			containerConfig: &ContainerConfig{Image: "busybox", Cmd: []string{"cat"}, SeccompProfilePath: filepath.Join(dir, "unexistent.json")},
+			expectedErr:     fmt.Sprintf("failed to read seccomp profile %q: open %s: no such file or directory", filepath.Join(dir, "unexistent.json"), filepath.Join(dir, "unexistent.json")),
+		},
+		{
+			name:            "test invalid seccomp profile",
+			containerConfig: &ContainerConfig{Image: "busybox", Cmd: []string{"cat"}, SeccompProfilePath: invalidSeccompProfilePath},
+			expectedErr:     fmt.Sprintf("invalid seccomp profile %q: unexpected end of JSON input", invalidSeccompProfilePath),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			createdConfig := &containerCreateRecorder{}
+			d := newFakeDockerDriver(t, createdConfig)
+
+			podConfig := &PodConfig{
+				ID:            "podid01",
+				TaskID:        "taskid01",
+				Containers:    []*ContainerConfig{tt.containerConfig},
+				InitVolumeDir: "/tmp/agola",
+			}
+
+			if tt.expectedErr != "" {
+				_, err := d.NewPod(context.Background(), podConfig, ioutil.Discard)
+				if err == nil {
+					t.Fatalf("expected err %q, got nil", tt.expectedErr)
+				}
+				if !util.APIErrorIs(err, util.ErrBadRequest) {
+					t.Fatalf("expected bad request err, got: %v", err)
+				}
+				if err.Error() != tt.expectedErr {
+					t.Fatalf("expected err %q, got %q", tt.expectedErr, err.Error())
+				}
+				return
+			}
+
+			if _, err := d.createContainer(context.Background(), 0, podConfig, "", &types.Volume{Name: "volume01"}); err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			if diff := cmp.Diff(tt.expectedSecurityOpt, createdConfig.HostConfig.SecurityOpt); diff != "" {
+				t.Fatalf("unexpected security options: %s", diff)
+			}
+		})
+	}
+}
+
+func TestDockerCreateContainerRestartPolicy(t *testing.T) {
+	createdConfig := &containerCreateRecorder{}
+	d := newFakeDockerDriver(t, createdConfig)
+
+	podConfig := &PodConfig{
+		ID:     "podid01",
+		TaskID: "taskid01",
+		Containers: []*ContainerConfig{
+			{Image: "busybox", Cmd: []string{"cat"}},
+			{Image: "postgres", RestartPolicy: &RestartPolicy{Name: RestartPolicyOnFailure, MaximumRetryCount: 3}},
+		},
+		InitVolumeDir: "/tmp/agola",
+	}
+
+	for i, expectedRestartPolicy := range []container.RestartPolicy{{}, {Name: "on-failure", MaximumRetryCount: 3}} {
+		if _, err := d.createContainer(context.Background(), i, podConfig, "containerid01", &types.Volume{Name: "volume01"}); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if diff := cmp.Diff(expectedRestartPolicy, createdConfig.HostConfig.RestartPolicy); diff != "" {
+			t.Fatalf("container %d: unexpected restart policy: %s", i, diff)
+		}
+	}
+}
+
+func TestValidatePodConfig(t *testing.T) {
+	tests := []struct {
+		name        string
+		podConfig   *PodConfig
+		expectedErr string
+	}{
+		{
+			name: "test valid pod config",
+			podConfig: &PodConfig{
+				Containers: []*ContainerConfig{{Image: "busybox", ExtraHosts: []string{"db:10.0.0.1"}}},
+				DNS:        &DNSConfig{Servers: []string{"10.0.0.53", "fd00::53"}},
+			},
+		},
+		{
+			name: "test invalid dns server",
+			podConfig: &PodConfig{
+				Containers: []*ContainerConfig{{Image: "busybox"}},
+				DNS:        &DNSConfig{Servers: []string{"dns.example.com"}},
+			},
+			expectedErr: `invalid dns server "dns.example.com", must be an ip address`,
+		},
+		{
+			name: "test empty external network",
+			podConfig: &PodConfig{
+				Containers:       []*ContainerConfig{{Image: "busybox"}},
+				ExternalNetworks: []string{""},
+			},
+			expectedErr: "empty external network name",
+		},
+		{
+			name: "test duplicate external network",
+			podConfig: &PodConfig{
+				Containers:       []*ContainerConfig{{Image: "busybox"}},
+				ExternalNetworks: []string{"fixtures", "fixtures"},
+			},
+			expectedErr: `duplicate external network "fixtures"`,
+		},
+		{
+			name: "test duplicate container name",
+			podConfig: &PodConfig{
+				Containers: []*ContainerConfig{{Image: "busybox"}, {Name: "db", Image: "postgres"}, {Name: "db", Image: "postgres"}},
+			},
+			expectedErr: `duplicate container name "db"`,
+		},
+		{
+			name: "test container name colliding with a derived container name",
+			podConfig: &PodConfig{
+				Containers: []*ContainerConfig{{Image: "busybox"}, {Name: "service2", Image: "postgres"}, {Image: "redis"}},
+			},
+			expectedErr: `duplicate container name "service2"`,
+		},
+		{
+			name: "test reserved main container name",
+			podConfig: &PodConfig{
+				Containers: []*ContainerConfig{{Image: "busybox"}, {Name: mainContainerName, Image: "postgres"}},
+			},
+			expectedErr: `duplicate container name "maincontainer"`,
+		},
+		{
+			name: "test invalid container name",
+			podConfig: &PodConfig{
+				Containers: []*ContainerConfig{{Image: "busybox"}, {Name: "../db", Image: "postgres"}},
+			},
+			expectedErr: `invalid container name "../db", must be a lowercase dns label of at most 63 characters`,
+		},
+		{
+			name: "test container name not a dns label",
+			podConfig: &PodConfig{
+				Containers: []*ContainerConfig{{Image: "busybox"}, {Name: "My_DB", Image: "postgres"}},
+			},
+			expectedErr: `invalid container name "My_DB", must be a lowercase dns label of at most 63 characters`,
+		},
+		{
+			name: "test container name ending with a dash",
+			podConfig: &PodConfig{
+				Containers: []*ContainerConfig{{Image: "busybox"}, {Name: "db-", Image: "postgres"}},
+			},
+			expectedErr: `invalid container name "db-", must be a lowercase dns label of at most 63 characters`,
+		},
+		{
+			name: "test container name too long",
+			podConfig: &PodConfig{
+				Containers: []*ContainerConfig{{Image: "busybox"}, {Name: strings.Repeat("a", 64), Image: "postgres"}},
+			},
+			expectedErr: fmt.Sprintf("invalid container name %q, must be a lowercase dns label of at most 63 characters", strings.Repeat("a", 64)),
+		},
+		{
+			name: "test container name with max length",
+			podConfig: &PodConfig{
+				Containers: []*ContainerConfig{{Image: "busybox"}, {Name: strings.Repeat("a", 63), Image: "postgres"}},
+			},
+		},
+		{
+			name: "test invalid secret name",
+			podConfig: &PodConfig{
+				Containers: []*ContainerConfig{{Image: "busybox"}},
+				Secrets:    map[string][]byte{"../token": []byte("secret")},
+			},
+			expectedErr: `invalid secret name "../token"`,
+		},
+		{
+			name: "test negative shm size",
+			podConfig: &PodConfig{
+				Containers: []*ContainerConfig{{Image: "busybox", ShmSizeBytes: -1}},
+			},
+			expectedErr: "invalid shm size -1, must be positive",
+		},
+		{
+			name: "test invalid alias",
+			podConfig: &PodConfig{
+				Containers: []*ContainerConfig{{Image: "busybox"}, {Image: "redis", Aliases: []string{"redis_01"}}},
+			},
+			expectedErr: `invalid alias "redis_01", must be a valid host name`,
+		},
+		{
+			name: "test duplicate alias",
+			podConfig: &PodConfig{
+				Containers: []*ContainerConfig{{Image: "busybox", Aliases: []string{"db"}}, {Image: "postgres", Aliases: []string{"db"}}},
+			},
+			expectedErr: `duplicate alias "db"`,
+		},
+		{
+			name: "test invalid healthcheck test",
+			podConfig: &PodConfig{
+				Containers: []*ContainerConfig{{Image: "busybox"}, {Image: "redis", Healthcheck: &Healthcheck{Test: []string{"redis-cli", "ping"}}}},
+			},
+			expectedErr: `invalid healthcheck test ["redis-cli" "ping"], must be in the {"CMD", args...} or {"CMD-SHELL", command} form`,
+		},
+		{
+			name: "test negative healthcheck retries",
+			podConfig: &PodConfig{
+				Containers: []*ContainerConfig{{Image: "busybox"}, {Image: "redis", Healthcheck: &Healthcheck{Test: []string{"CMD", "redis-cli", "ping"}, Retries: -1}}},
+			},
+			expectedErr: "invalid healthcheck retries -1, must be positive",
+		},
+		{
+			name: "test negative resource requests",
+			podConfig: &PodConfig{
+				Containers: []*ContainerConfig{{Image: "busybox", Requests: ResourceRequests{Memory: -1}}},
+			},
+			expectedErr: "invalid resource requests, must be positive",
+		},
+		{
+			name: "test valid container users",
+			podConfig: &PodConfig{
+				Containers: []*ContainerConfig{{Image: "busybox", User: "1000"}, {Image: "postgres", User: "postgres:postgres"}, {Image: "redis", User: "1000:1000"}},
+			},
+		},
+		{
+			name: "test container user with empty group",
+			podConfig: &PodConfig{
+				Containers: []*ContainerConfig{{Image: "busybox", User: "1000:"}},
+			},
+			expectedErr: `invalid container user "1000:", must be in the uid[:gid] format`,
+		},
+		{
+			name: "test container user with too many parts",
+			podConfig: &PodConfig{
+				Containers: []*ContainerConfig{{Image: "busybox", User: "1000:1000:1000"}},
+			},
+			expectedErr: `invalid container user "1000:1000:1000", must be in the uid[:gid] format`,
+		},
+		{
+			name: "test empty persistent volume cache key",
+			podConfig: &PodConfig{
+				Containers: []*ContainerConfig{{Image: "busybox", Volumes: []Volume{{Path: "/cache", Persistent: &VolumePersistent{}}}}},
+			},
+			expectedErr: "empty persistent volume cache key",
+		},
+		{
+			name: "test relative bind source",
+			podConfig: &PodConfig{
+				Containers: []*ContainerConfig{{Image: "busybox", Volumes: []Volume{{Path: "/cache", Bind: &VolumeBind{Source: "cache"}}}}},
+			},
+			expectedErr: `invalid bind source "cache", must be a clean absolute path`,
+		},
+		{
+			name: "test not clean bind source",
+			podConfig: &PodConfig{
+				Containers: []*ContainerConfig{{Image: "busybox", Volumes: []Volume{{Path: "/cache", Bind: &VolumeBind{Source: "/var/cache/agola/../../../etc"}}}}},
+			},
+			expectedErr: `invalid bind source "/var/cache/agola/../../../etc", must be a clean absolute path`,
+		},
+		{
+			name: "test invalid platform",
+			podConfig: &PodConfig{
+				Containers: []*ContainerConfig{{Image: "busybox", Platform: "linux"}},
+			},
+			expectedErr: `invalid platform "linux", must be in the os/arch[/variant] format`,
+		},
+		{
+			name: "test restart policy on main container",
+			podConfig: &PodConfig{
+				Containers: []*ContainerConfig{{Image: "busybox", RestartPolicy: &RestartPolicy{Name: RestartPolicyAlways}}},
+			},
+			expectedErr: "restart policy cannot be set on the main container",
+		},
+		{
+			name: "test unknown restart policy",
+			podConfig: &PodConfig{
+				Containers: []*ContainerConfig{{Image: "busybox"}, {Image: "postgres", RestartPolicy: &RestartPolicy{Name: "sometimes"}}},
+			},
+			expectedErr: `unknown restart policy "sometimes"`,
+		},
+		{
+			name: "test max retry count without on-failure restart policy",
+			podConfig: &PodConfig{
+				Containers: []*ContainerConfig{{Image: "busybox"}, {Image: "postgres", RestartPolicy: &RestartPolicy{Name: RestartPolicyAlways, MaximumRetryCount: 3}}},
+			},
+			expectedErr: `max retry count cannot be set with restart policy "always"`,
+		},
+		{
+			name: "test network sysctl on main container",
+			podConfig: &PodConfig{
+				Containers: []*ContainerConfig{{Image: "busybox", Sysctls: map[string]string{"net.core.somaxconn": "1024"}}},
+			},
+		},
+		{
+			name: "test network sysctl on non main container",
+			podConfig: &PodConfig{
+				Containers: []*ContainerConfig{
+					{Image: "busybox"},
+					{Image: "postgres", Sysctls: map[string]string{"net.core.somaxconn": "1024"}},
+				},
+			},
+			expectedErr: `network sysctl "net.core.somaxconn" can be set only on the main container since the pod containers share its network namespace`,
+		},
+		{
+			name: "test valid capabilities",
+			podConfig: &PodConfig{
+				Containers: []*ContainerConfig{{Image: "busybox", CapAdd: []string{"NET_ADMIN", "cap_sys_ptrace"}, CapDrop: []string{"ALL"}}},
+			},
+		},
+		{
+			name: "test unknown capability",
+			podConfig: &PodConfig{
+				Containers: []*ContainerConfig{{Image: "busybox"}, {Image: "busybox", CapAdd: []string{"NET_ADMN"}}},
+			},
+			expectedErr: `unknown capability "NET_ADMN"`,
+		},
+		{
+			name: "test unknown ulimit",
+			podConfig: &PodConfig{
+				Containers: []*ContainerConfig{{Image: "busybox", Ulimits: []Ulimit{{Name: "nofiles", Soft: 1024, Hard: 1024}}}},
+			},
+			expectedErr: `unknown ulimit "nofiles"`,
+		},
+		{
+			name: "test ulimit soft limit greater than hard limit",
+			podConfig: &PodConfig{
+				Containers: []*ContainerConfig{{Image: "busybox", Ulimits: []Ulimit{{Name: "nofile", Soft: 2048, Hard: 1024}}}},
+			},
+			expectedErr: `ulimit "nofile" soft limit 2048 is greater than hard limit 1024`,
+		},
+		{
+			name: "test invalid extra host",
+			podConfig: &PodConfig{
+				Containers: []*ContainerConfig{{Image: "busybox", ExtraHosts: []string{"db"}}},
+			},
+			expectedErr: `invalid extra host "db", must be in the name:ip form`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validatePodConfig(tt.podConfig)
+			if tt.expectedErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected err: %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("expected err %q, got nil err", tt.expectedErr)
+			}
+			if !util.APIErrorIs(err, util.ErrBadRequest) {
+				t.Fatalf("expected bad request error, got: %v", err)
+			}
+			if err.Error() != tt.expectedErr {
+				t.Fatalf("expected err %q, got err: %q", tt.expectedErr, err.Error())
+			}
+		})
+	}
+}
+
+func TestExecOutputLimit(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	execConfig := &ExecConfig{
+		Stdout:         &stdout,
+		Stderr:         &stderr,
+		MaxOutputBytes: 10,
+	}
+
+	outw, errw := execOutput(execConfig)
+	writes := []struct {
+		w    io.Writer
+		data string
+	}{
+		{w: outw, data: "012345"},
+		{w: errw, data: "678"},
+		{w: outw, data: "9abcdef"},
+		{w: errw, data: "ghi"},
+		{w: outw, data: "jkl"},
+	}
+	for _, write := range writes {
+		n, err := write.w.Write([]byte(write.data))
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if n != len(write.data) {
+			t.Fatalf("expected %d bytes written, got %d", len(write.data), n)
+		}
+	}
+
+	if diff := cmp.Diff("0123459"+outputTruncatedMarker, stdout.String()); diff != "" {
+		t.Fatalf("unexpected stdout: %s", diff)
+	}
+	if diff := cmp.Diff("678", stderr.String()); diff != "" {
+		t.Fatalf("unexpected stderr: %s", diff)
+	}
+}
+
+func TestDockerCreateContainerUlimits(t *testing.T) {
+	createdConfig := &containerCreateRecorder{}
+	d := newFakeDockerDriver(t, createdConfig, WithDockerDriverDefaultUlimits([]Ulimit{
+		{Name: "nofile", Soft: 1024, Hard: 4096},
+		{Name: "nproc", Soft: 512, Hard: 512},
+	}))
+
+	podConfig := &PodConfig{
+		ID:     "podid01",
+		TaskID: "taskid01",
+		Containers: []*ContainerConfig{
+			{
+				Image: "busybox",
+				Cmd:   []string{"cat"},
+				Ulimits: []Ulimit{
+					{Name: "nofile", Soft: 65536, Hard: 65536},
+					{Name: "memlock", Soft: -1, Hard: -1},
+				},
+			},
+		},
+		InitVolumeDir: "/tmp/agola",
+	}
+
+	if _, err := d.createContainer(context.Background(), 0, podConfig, "", &types.Volume{Name: "volume01"}); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	expectedUlimits := []*units.Ulimit{
+		{Name: "nofile", Soft: 65536, Hard: 65536},
+		{Name: "nproc", Soft: 512, Hard: 512},
+		{Name: "memlock", Soft: -1, Hard: -1},
+	}
+	if diff := cmp.Diff(expectedUlimits, createdConfig.HostConfig.Ulimits); diff != "" {
+		t.Fatalf("unexpected ulimits: %s", diff)
+	}
+}
+
+func TestDockerCreateContainerTmpfsNoExec(t *testing.T) {
+	podConfig := &PodConfig{
+		ID:     "podid01",
+		TaskID: "taskid01",
+		Containers: []*ContainerConfig{
+			{
+				Image: "busybox",
+				Cmd:   []string{"cat"},
+				Volumes: []Volume{
+					{Path: "/tmp", TmpFS: &VolumeTmpFS{Size: 1024 * 1024}},
+					{Path: "/scratch", TmpFS: &VolumeTmpFS{}},
+					{Path: "/bin-cache", TmpFS: &VolumeTmpFS{Size: 1024 * 1024, AllowExec: true}},
+				},
+			},
+		},
+		InitVolumeDir: "/tmp/agola",
+	}
+
+	tests := []struct {
+		name           string
+		options        []DockerDriverOption
+		expectedTmpfs  map[string]string
+		expectedMounts []mount.Mount
+	}{
+		{
+			name: "test default noexec tmpfs",
+			expectedTmpfs: map[string]string{
+				"/tmp":     "rw,noexec,nosuid,size=1048576",
+				"/scratch": "rw,noexec,nosuid",
+			},
+			expectedMounts: []mount.Mount{
+				{Type: mount.TypeTmpfs, Target: "/bin-cache", TmpfsOptions: &mount.TmpfsOptions{SizeBytes: 1024 * 1024}},
+			},
+		},
+		{
+			name:    "test noexec tmpfs disabled",
+			options: []DockerDriverOption{WithDockerDriverTmpfsNoExec(false)},
+			expectedMounts: []mount.Mount{
+				{Type: mount.TypeTmpfs, Target: "/tmp", TmpfsOptions: &mount.TmpfsOptions{SizeBytes: 1024 * 1024}},
+				{Type: mount.TypeTmpfs, Target: "/scratch", TmpfsOptions: &mount.TmpfsOptions{}},
+				{Type: mount.TypeTmpfs, Target: "/bin-cache", TmpfsOptions: &mount.TmpfsOptions{SizeBytes: 1024 * 1024}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			createdConfig := &containerCreateRecorder{}
+			d := newFakeDockerDriver(t, createdConfig, tt.options...)
+
+			if _, err := d.createContainer(context.Background(), 0, podConfig, "", &types.Volume{Name: "volume01"}); err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+
+			if diff := cmp.Diff(tt.expectedTmpfs, createdConfig.HostConfig.Tmpfs); diff != "" {
+				t.Fatalf("unexpected tmpfs: %s", diff)
+			}
+			if diff := cmp.Diff(tt.expectedMounts, createdConfig.HostConfig.Mounts); diff != "" {
+				t.Fatalf("unexpected mounts: %s", diff)
+			}
+		})
+	}
+}
+
+// spanAttrs returns the span attributes by key
+func spanAttrs(span sdktrace.ReadOnlySpan) map[attribute.Key]attribute.Value {
+	attrs := map[attribute.Key]attribute.Value{}
+	for _, attr := range span.Attributes() {
+		attrs[attr.Key] = attr.Value
+	}
+	return attrs
+}
+
+func TestDockerNewPodTracing(t *testing.T) {
+	var mu sync.Mutex
+	createdContainers := 0
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/images/create"):
+			_, _ = w.Write([]byte(`{"status":"pulled"}`))
+		case strings.HasSuffix(r.URL.Path, "/containers/create"):
+			mu.Lock()
+			createdContainers++
+			id := fmt.Sprintf("containerid%02d", createdContainers)
+			mu.Unlock()
+			w.WriteHeader(http.StatusCreated)
+			_, _ = w.Write([]byte(fmt.Sprintf(`{"Id":%q}`, id)))
+		case strings.HasSuffix(r.URL.Path, "/start"):
+			w.WriteHeader(http.StatusNoContent)
+		case strings.HasSuffix(r.URL.Path, "/containers/json"):
+			containers := []types.Container{
+				{ID: "containerid01", Labels: map[string]string{containerIndexKey: "0"}},
+				{ID: "containerid02", Labels: map[string]string{containerIndexKey: "1", containerNameKey: "service1"}},
+			}
+			_ = json.NewEncoder(w).Encode(containers)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+
+	sr := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr))
+	d := newFakeDockerDriver(t, handler, WithDockerDriverTracer(tp.Tracer("agola")))
+	// use a pooled toolbox volume to avoid populating it
+	d.toolboxVolumePool = newWarmPool(zerolog.Nop(), 1, nil, nil, nil)
+	d.toolboxVolumePool.idle = []string{"toolboxvol01"}
+
+	_, err := d.NewPod(context.Background(), &PodConfig{
+		ID:     "podid01",
+		TaskID: "taskid01",
+		Containers: []*ContainerConfig{
+			{Image: "busybox:stable"},
+			{Image: "nginx:1.16", Name: "service1"},
+		},
+		InitVolumeDir: "/tmp/agola",
+	}, ioutil.Discard)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	spans := sr.Ended()
+	if len(spans) != len(sr.Started()) {
+		t.Fatalf("expected all the %d started spans ended, got %d", len(sr.Started()), len(spans))
+	}
+
+	var root sdktrace.ReadOnlySpan
+	for _, span := range spans {
+		if span.Parent().IsValid() {
+			continue
+		}
+		if root != nil {
+			t.Fatalf("expected 1 root span, got %q and %q", root.Name(), span.Name())
+		}
+		root = span
+	}
+	if root == nil {
+		t.Fatalf("expected 1 root span")
+	}
+	if root.Name() != "driver.NewPod" {
+		t.Fatalf("expected root span %q, got %q", "driver.NewPod", root.Name())
+	}
+	rootAttrs := spanAttrs(root)
+	if rootAttrs[spanAttrPodID].AsString() != "podid01" || rootAttrs[spanAttrTaskID].AsString() != "taskid01" {
+		t.Fatalf("unexpected root span attributes: %v", root.Attributes())
+	}
+	if _, ok := rootAttrs[spanAttrDurationMs]; !ok {
+		t.Fatalf("expected root span duration attribute")
+	}
+
+	children := []string{}
+	for _, span := range spans {
+		if span == root {
+			continue
+		}
+		if span.Parent().SpanID() != root.SpanContext().SpanID() {
+			t.Fatalf("expected span %q child of the root span", span.Name())
+		}
+		attrs := spanAttrs(span)
+		if _, ok := attrs[spanAttrDurationMs]; !ok {
+			t.Fatalf("expected span %q duration attribute", span.Name())
+		}
+		children = append(children, fmt.Sprintf("%s %s", span.Name(), attrs[spanAttrImage].AsString()))
+	}
+	// image fetches are concurrent
+	sort.Strings(children)
+	expectedChildren := []string{
+		"driver.createContainer busybox:stable",
+		"driver.createContainer nginx:1.16",
+		"driver.fetchImage busybox:stable",
+		"driver.fetchImage nginx:1.16",
+	}
+	if diff := cmp.Diff(expectedChildren, children); diff != "" {
+		t.Fatalf("unexpected child spans: %s", diff)
+	}
+}
+
+func TestStartSpanNoTracer(t *testing.T) {
+	// the default no-op tracer must be used when no tracer is configured
+	ctx, span := startSpan(context.Background(), nil, "driver.NewPod", spanAttrPodID.String("podid01"))
+	if trace.SpanContextFromContext(ctx).IsValid() {
+		t.Fatalf("unexpected span in context")
+	}
+	if span.span.IsRecording() {
+		t.Fatalf("expected noop span")
+	}
+	span.end(errors.Errorf("error"))
+}
+
+func TestDockerSpanError(t *testing.T) {
+	sr := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr))
+
+	_, span := startSpan(context.Background(), tp.Tracer("agola"), "driver.Remove")
+	span.end(errors.Errorf("remove error"))
+
+	spans := sr.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("expected 1 span, got %d", len(spans))
+	}
+	if spans[0].Status().Code != codes.Error || spans[0].Status().Description != "remove error" {
+		t.Fatalf("unexpected span status: %v", spans[0].Status())
+	}
+	if len(spans[0].Events()) != 1 || spans[0].Events()[0].Name != "exception" {
+		t.Fatalf("expected recorded error event, got: %v", spans[0].Events())
+	}
+}
+
+func TestDockerNewPodWaitHealthy(t *testing.T) {
+	tests := []struct {
+		name            string
+		timeout         time.Duration
+		healthStatuses  []string
+		healthOutput    string
+		expectedErr     string
+		expectedRemoved bool
+	}{
+		{
+			name:           "test containers becoming healthy",
+			timeout:        5 * time.Second,
+			healthStatuses: []string{types.Starting, types.Starting, types.Healthy},
+		},
+		{
+			name:            "test unhealthy container",
+			timeout:         5 * time.Second,
+			healthStatuses:  []string{types.Starting, types.Unhealthy},
+			healthOutput:    "connection refused\n",
+			expectedErr:     `container "service1" is unhealthy, last check output: connection refused`,
+			expectedRemoved: true,
+		},
+		{
+			name:            "test container not healthy before timeout",
+			timeout:         time.Second,
+			healthStatuses:  []string{types.Starting},
+			expectedErr:     "containers not healthy after 1s: service1",
+			expectedRemoved: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			createdContainers := 0
+			inspects := 0
+			removed := []string{}
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				defer mu.Unlock()
+				switch {
+				case strings.HasSuffix(r.URL.Path, "/images/create"):
+					_, _ = w.Write([]byte(`{"status":"pulled"}`))
+				case strings.HasSuffix(r.URL.Path, "/containers/create"):
+					createdContainers++
+					w.WriteHeader(http.StatusCreated)
+					_, _ = w.Write([]byte(fmt.Sprintf(`{"Id":"containerid%02d"}`, createdContainers)))
+				case strings.HasSuffix(r.URL.Path, "/start"):
+					w.WriteHeader(http.StatusNoContent)
+				case strings.HasSuffix(r.URL.Path, "/containers/json"):
+					containers := []types.Container{
+						{ID: "containerid01", Labels: map[string]string{containerIndexKey: "0"}},
+						{ID: "containerid02", Labels: map[string]string{containerIndexKey: "1"}},
+					}
+					_ = json.NewEncoder(w).Encode(containers)
+				case strings.HasSuffix(r.URL.Path, "/json"):
+					state := &types.ContainerState{Running: true}
+					// only the service container has a healthcheck
+					if strings.Contains(r.URL.Path, "containerid02") {
+						status := tt.healthStatuses[len(tt.healthStatuses)-1]
+						if inspects < len(tt.healthStatuses) {
+							status = tt.healthStatuses[inspects]
+						}
+						inspects++
+						state.Health = &types.Health{Status: status, Log: []*types.HealthcheckResult{{Output: tt.healthOutput}}}
+					}
+					_ = json.NewEncoder(w).Encode(types.ContainerJSON{ContainerJSONBase: &types.ContainerJSONBase{State: state}})
+				case r.Method == http.MethodDelete:
+					parts := strings.Split(r.URL.Path, "/")
+					removed = append(removed, parts[len(parts)-1])
+					w.WriteHeader(http.StatusNoContent)
+				default:
+					w.WriteHeader(http.StatusNotFound)
+				}
+			})
+
+			d := newFakeDockerDriver(t, handler, WithDockerDriverWaitHealthy(tt.timeout))
+			// use a pooled toolbox volume to avoid populating it
+			noop := func(ctx context.Context, id string) error { return nil }
+			d.toolboxVolumePool = newWarmPool(zerolog.Nop(), 1, nil, noop, noop)
+			d.toolboxVolumePool.idle = []string{"toolboxvol01"}
+
+			_, err := d.NewPod(context.Background(), &PodConfig{
+				ID:     "podid01",
+				TaskID: "taskid01",
+				Containers: []*ContainerConfig{
+					{Image: "busybox"},
+					{Image: "postgres", Healthcheck: &Healthcheck{Test: []string{"CMD", "pg_isready"}}},
+				},
+				InitVolumeDir: "/tmp/agola",
+			}, ioutil.Discard)
+
+			if tt.expectedErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected err: %v", err)
+				}
+			} else {
+				if err == nil {
+					t.Fatalf("expected err %q, got nil err", tt.expectedErr)
+				}
+				if err.Error() != tt.expectedErr {
+					t.Fatalf("expected err %q, got err: %q", tt.expectedErr, err.Error())
+				}
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if tt.expectedRemoved {
+				sort.Strings(removed)
+				if diff := cmp.Diff([]string{"containerid01", "containerid02"}, removed); diff != "" {
+					t.Fatalf("unexpected removed containers: %s", diff)
+				}
+			} else if len(removed) != 0 {
+				t.Fatalf("unexpected removed containers: %v", removed)
+			}
+		})
+	}
+}
+
+func TestDockerNewPodServiceSettle(t *testing.T) {
+	tests := []struct {
+		name            string
+		serviceRunning  bool
+		expectedErr     string
+		expectedRemoved bool
+	}{
+		{
+			name:           "test service container running",
+			serviceRunning: true,
+		},
+		{
+			name:            "test service container exiting immediately",
+			expectedErr:     "service container \"service1\" failed to start, exited with code 127, last logs:\nexec: \"postgresql\": executable file not found in $PATH",
+			expectedRemoved: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			createdContainers := 0
+			removed := []string{}
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				defer mu.Unlock()
+				switch {
+				case strings.HasSuffix(r.URL.Path, "/images/create"):
+					_, _ = w.Write([]byte(`{"status":"pulled"}`))
+				case strings.HasSuffix(r.URL.Path, "/containers/create"):
+					createdContainers++
+					w.WriteHeader(http.StatusCreated)
+					_, _ = w.Write([]byte(fmt.Sprintf(`{"Id":"containerid%02d"}`, createdContainers)))
+				case strings.HasSuffix(r.URL.Path, "/start"):
+					w.WriteHeader(http.StatusNoContent)
+				case strings.HasSuffix(r.URL.Path, "/containers/json"):
+					containers := []types.Container{
+						{ID: "containerid01", Labels: map[string]string{containerIndexKey: "0"}},
+						{ID: "containerid02", Labels: map[string]string{containerIndexKey: "1"}},
+					}
+					_ = json.NewEncoder(w).Encode(containers)
+				case strings.HasSuffix(r.URL.Path, "/containerid02/logs"):
+					if r.URL.Query().Get("tail") != strconv.Itoa(serviceLogsTailLines) {
+						t.Errorf("unexpected logs tail %q", r.URL.Query().Get("tail"))
+					}
+					stderr := stdcopy.NewStdWriter(w, stdcopy.Stderr)
+					_, _ = stderr.Write([]byte("exec: \"postgresql\": executable file not found in $PATH\n"))
+				case strings.HasSuffix(r.URL.Path, "/json"):
+					state := &types.ContainerState{Running: true}
+					if strings.Contains(r.URL.Path, "containerid02") && !tt.serviceRunning {
+						state = &types.ContainerState{ExitCode: 127}
+					}
+					_ = json.NewEncoder(w).Encode(types.ContainerJSON{ContainerJSONBase: &types.ContainerJSONBase{State: state}, Config: &container.Config{}})
+				case r.Method == http.MethodDelete:
+					parts := strings.Split(r.URL.Path, "/")
+					removed = append(removed, parts[len(parts)-1])
+					w.WriteHeader(http.StatusNoContent)
+				default:
+					w.WriteHeader(http.StatusNotFound)
+				}
+			})
+
+			d := newFakeDockerDriver(t, handler, WithDockerDriverServiceSettlePeriod(time.Second))
+			// use a pooled toolbox volume to avoid populating it
+			noop := func(ctx context.Context, id string) error { return nil }
+			d.toolboxVolumePool = newWarmPool(zerolog.Nop(), 1, nil, noop, noop)
+			d.toolboxVolumePool.idle = []string{"toolboxvol01"}
+
+			_, err := d.NewPod(context.Background(), &PodConfig{
+				ID:     "podid01",
+				TaskID: "taskid01",
+				Containers: []*ContainerConfig{
+					{Image: "busybox"},
+					{Image: "postgres", Cmd: []string{"postgresql"}},
+				},
+				InitVolumeDir: "/tmp/agola",
+			}, ioutil.Discard)
+
+			if tt.expectedErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected err: %v", err)
+				}
+			} else {
+				if err == nil {
+					t.Fatalf("expected err %q, got nil err", tt.expectedErr)
+				}
+				if err.Error() != tt.expectedErr {
+					t.Fatalf("expected err %q, got err: %q", tt.expectedErr, err.Error())
+				}
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			expectedRemoved := []string{}
+			if tt.expectedRemoved {
+				expectedRemoved = []string{"containerid01", "containerid02"}
+			}
+			sort.Strings(removed)
+			if diff := cmp.Diff(expectedRemoved, removed); diff != "" {
+				t.Fatalf("unexpected removed containers: %s", diff)
+			}
+		})
+	}
+}
+
+func TestDockerNewPodCleanupOnFailure(t *testing.T) {
+	tests := []struct {
+		name        string
+		options     []DockerDriverOption
+		failImage   string
+		blockImage  string
+		expectedErr string
+	}{
+		{
+			name:        "test failure on the third container",
+			failImage:   "redis:7",
+			expectedErr: "Error response from daemon: cannot create container",
+		},
+		{
+			name:        "test pod start timeout",
+			options:     []DockerDriverOption{WithDockerDriverPodStartTimeout(500 * time.Millisecond)},
+			blockImage:  "postgres:14",
+			expectedErr: "pod not started after 500ms",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			created := 0
+			// containers maps the existing containers ids to their image
+			containers := map[string]string{}
+			volumes := map[string]struct{}{}
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				defer mu.Unlock()
+				parts := strings.Split(r.URL.Path, "/")
+				switch {
+				case strings.HasSuffix(r.URL.Path, "/images/create"):
+					_, _ = w.Write([]byte(`{"status":"pulled"}`))
+				case strings.HasSuffix(r.URL.Path, "/volumes/create"):
+					volumes["toolboxvol01"] = struct{}{}
+					w.WriteHeader(http.StatusCreated)
+					_, _ = w.Write([]byte(`{"Name":"toolboxvol01"}`))
+				case strings.HasSuffix(r.URL.Path, "/containers/create"):
+					var config container.Config
+					if err := json.NewDecoder(r.Body).Decode(&config); err != nil {
+						t.Errorf("unexpected err: %v", err)
+					}
+					if config.Image == tt.failImage {
+						w.Header().Set("Content-Type", "application/json")
+						w.WriteHeader(http.StatusInternalServerError)
+						_, _ = w.Write([]byte(`{"message":"cannot create container"}`))
+						return
+					}
+					created++
+					id := fmt.Sprintf("containerid%02d", created)
+					containers[id] = config.Image
+					w.WriteHeader(http.StatusCreated)
+					_, _ = w.Write([]byte(fmt.Sprintf(`{"Id":%q}`, id)))
+				case strings.HasSuffix(r.URL.Path, "/start"):
+					if containers[parts[len(parts)-2]] == tt.blockImage {
+						mu.Unlock()
+						<-r.Context().Done()
+						mu.Lock()
+						return
+					}
+					w.WriteHeader(http.StatusNoContent)
+				case strings.HasSuffix(r.URL.Path, "/archive"):
+					w.WriteHeader(http.StatusOK)
+				case r.Method == http.MethodDelete && strings.Contains(r.URL.Path, "/containers/"):
+					delete(containers, parts[len(parts)-1])
+					w.WriteHeader(http.StatusNoContent)
+				case r.Method == http.MethodDelete && strings.Contains(r.URL.Path, "/volumes/"):
+					delete(volumes, parts[len(parts)-1])
+					w.WriteHeader(http.StatusNoContent)
+				default:
+					w.WriteHeader(http.StatusNotFound)
+				}
+			})
+
+			d := newFakeDockerDriver(t, handler, tt.options...)
+			d.initImage = "busybox:latest"
+
+			_, err := d.NewPod(context.Background(), &PodConfig{
+				ID:     "podid01",
+				TaskID: "taskid01",
+				Containers: []*ContainerConfig{
+					{Image: "alpine:3.16"},
+					{Image: "postgres:14"},
+					{Image: "redis:7"},
+				},
+				InitVolumeDir: "/tmp/agola",
+			}, ioutil.Discard)
+			if err == nil {
+				t.Fatalf("expected err %q, got nil err", tt.expectedErr)
+			}
+			if !strings.Contains(err.Error(), tt.expectedErr) {
+				t.Fatalf("expected err %q, got err: %q", tt.expectedErr, err.Error())
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if len(containers) != 0 {
+				t.Fatalf("unexpected leftover containers: %v", containers)
+			}
+			if len(volumes) != 0 {
+				t.Fatalf("unexpected leftover volumes: %v", volumes)
+			}
+		})
+	}
+}
+
+func TestDockerNewPodExternalNetworks(t *testing.T) {
+	tests := []struct {
+		name              string
+		externalNetworks  []string
+		expectedConnected []string
+		expectedErr       string
+		expectedNotExist  bool
+	}{
+		{
+			name:              "test connect main container to external networks",
+			externalNetworks:  []string{"fixtures", "shared"},
+			expectedConnected: []string{"fixtures/containerid01", "shared/containerid01"},
+		},
+		{
+			name:              "test missing external network",
+			externalNetworks:  []string{"fixtures", "missing"},
+			expectedConnected: []string{},
+			expectedErr:       `external network "missing" doesn't exist`,
+			expectedNotExist:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			createdContainers := 0
+			connected := []string{}
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				defer mu.Unlock()
+				parts := strings.Split(r.URL.Path, "/")
+				switch {
+				case r.Method == http.MethodGet && strings.Contains(r.URL.Path, "/networks/"):
+					name := parts[len(parts)-1]
+					if name == "missing" {
+						w.Header().Set("Content-Type", "application/json")
+						w.WriteHeader(http.StatusNotFound)
+						_, _ = w.Write([]byte(`{"message":"network missing not found"}`))
+						return
+					}
+					_ = json.NewEncoder(w).Encode(types.NetworkResource{Name: name})
+				case strings.HasSuffix(r.URL.Path, "/connect"):
+					var req types.NetworkConnect
+					if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+						t.Errorf("unexpected err: %v", err)
+					}
+					connected = append(connected, parts[len(parts)-2]+"/"+req.Container)
+					w.WriteHeader(http.StatusOK)
+				case strings.HasSuffix(r.URL.Path, "/images/create"):
+					_, _ = w.Write([]byte(`{"status":"pulled"}`))
+				case strings.HasSuffix(r.URL.Path, "/containers/create"):
+					createdContainers++
+					w.WriteHeader(http.StatusCreated)
+					_, _ = w.Write([]byte(fmt.Sprintf(`{"Id":"containerid%02d"}`, createdContainers)))
+				case strings.HasSuffix(r.URL.Path, "/start"):
+					w.WriteHeader(http.StatusNoContent)
+				case strings.HasSuffix(r.URL.Path, "/containers/json"):
+					containers := []types.Container{
+						{ID: "containerid01", Labels: map[string]string{containerIndexKey: "0"}},
+						{ID: "containerid02", Labels: map[string]string{containerIndexKey: "1"}},
+					}
+					_ = json.NewEncoder(w).Encode(containers)
+				default:
+					w.WriteHeader(http.StatusNotFound)
+				}
+			})
+
+			d := newFakeDockerDriver(t, handler)
+			// use a pooled toolbox volume to avoid populating it
+			noop := func(ctx context.Context, id string) error { return nil }
+			d.toolboxVolumePool = newWarmPool(zerolog.Nop(), 1, nil, noop, noop)
+			d.toolboxVolumePool.idle = []string{"toolboxvol01"}
+
+			_, err := d.NewPod(context.Background(), &PodConfig{
+				ID:     "podid01",
+				TaskID: "taskid01",
+				Containers: []*ContainerConfig{
+					{Image: "busybox"},
+					{Image: "postgres"},
+				},
+				InitVolumeDir:    "/tmp/agola",
+				ExternalNetworks: tt.externalNetworks,
+			}, ioutil.Discard)
+
+			if tt.expectedErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected err: %v", err)
+				}
+			} else {
+				if err == nil {
+					t.Fatalf("expected err %q, got nil err", tt.expectedErr)
+				}
+				if err.Error() != tt.expectedErr {
+					t.Fatalf("expected err %q, got err: %q", tt.expectedErr, err.Error())
+				}
+				if tt.expectedNotExist && !util.APIErrorIs(err, util.ErrNotExist) {
+					t.Fatalf("expected not exist error, got err: %v", err)
+				}
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if diff := cmp.Diff(tt.expectedConnected, connected); diff != "" {
+				t.Fatalf("unexpected connected networks: %s", diff)
+			}
+		})
+	}
+}
+
+func TestDockerNewPodDuplicateContainerName(t *testing.T) {
+	var mu sync.Mutex
+	requests := []string{}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		w.WriteHeader(http.StatusNotFound)
+	})
+
+	d := newFakeDockerDriver(t, handler)
+
+	_, err := d.NewPod(context.Background(), &PodConfig{
+		ID:     "podid01",
+		TaskID: "taskid01",
+		Containers: []*ContainerConfig{
+			{Image: "busybox"},
+			{Name: "db", Image: "postgres"},
+			{Name: "db", Image: "mysql"},
+		},
+		InitVolumeDir: "/tmp/agola",
+	}, ioutil.Discard)
+	if !util.APIErrorIs(err, util.ErrBadRequest) {
+		t.Fatalf("expected bad request error, got: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(requests) != 0 {
+		t.Fatalf("expected no docker requests, got: %v", requests)
+	}
+}
+
+func TestDockerNewPodSecrets(t *testing.T) {
+	var mu sync.Mutex
+	var tmpfs map[string]string
+	execCmds := [][]string{}
+	stdins := map[string]string{}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/images/create"):
+			_, _ = w.Write([]byte(`{"status":"pulled"}`))
+		case strings.HasSuffix(r.URL.Path, "/containers/create"):
+			var req struct {
+				HostConfig container.HostConfig
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				t.Errorf("unexpected err: %v", err)
+			}
+			mu.Lock()
+			tmpfs = req.HostConfig.Tmpfs
+			mu.Unlock()
+			w.WriteHeader(http.StatusCreated)
+			_, _ = w.Write([]byte(`{"Id":"containerid01"}`))
+		case strings.HasSuffix(r.URL.Path, "/containers/containerid01/start"):
+			w.WriteHeader(http.StatusNoContent)
+		case strings.HasSuffix(r.URL.Path, "/containers/json"):
+			_ = json.NewEncoder(w).Encode([]types.Container{{ID: "containerid01", Labels: map[string]string{containerIndexKey: "0"}}})
+		case strings.HasSuffix(r.URL.Path, "/containers/containerid01/exec"):
+			var req types.ExecConfig
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				t.Errorf("unexpected err: %v", err)
+			}
+			mu.Lock()
+			execCmds = append(execCmds, req.Cmd)
+			execID := fmt.Sprintf("execid%02d", len(execCmds))
+			mu.Unlock()
+			w.WriteHeader(http.StatusCreated)
+			_, _ = w.Write([]byte(fmt.Sprintf(`{"Id":%q}`, execID)))
+		case strings.HasSuffix(r.URL.Path, "/start"):
+			// hijack the connection and read the exec stdin until closed
+			parts := strings.Split(r.URL.Path, "/")
+			execID := parts[len(parts)-2]
+			// consume the exec start request body before hijacking
+			_, _ = io.Copy(ioutil.Discard, r.Body)
+			conn, bufrw, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				t.Errorf("unexpected err: %v", err)
+				return
+			}
+			defer conn.Close()
+			_, _ = bufrw.WriteString("HTTP/1.1 101 UPGRADED\r\nContent-Type: application/vnd.docker.raw-stream\r\nConnection: Upgrade\r\nUpgrade: tcp\r\n\r\n")
+			_ = bufrw.Flush()
+			data, err := io.ReadAll(bufrw)
+			if err != nil {
+				t.Errorf("unexpected err: %v", err)
+			}
+			mu.Lock()
+			stdins[execID] = string(data)
+			mu.Unlock()
+		case strings.Contains(r.URL.Path, "/exec/"):
+			_, _ = w.Write([]byte(`{"Running":false,"ExitCode":0}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+
+	d := newFakeDockerDriver(t, handler)
+	// use a pooled toolbox volume to avoid populating it
+	noop := func(ctx context.Context, id string) error { return nil }
+	d.toolboxVolumePool = newWarmPool(zerolog.Nop(), 1, nil, noop, noop)
+	d.toolboxVolumePool.idle = []string{"toolboxvol01"}
+
+	var out bytes.Buffer
+	_, err := d.NewPod(context.Background(), &PodConfig{
+		ID:            "podid01",
+		TaskID:        "taskid01",
+		Containers:    []*ContainerConfig{{Image: "busybox", User: "1000:1000"}},
+		InitVolumeDir: "/tmp/agola",
+		Secrets: map[string][]byte{
+			"token":    []byte("tokensecret"),
+			"id_rsa.1": []byte("keysecret"),
+		},
+	}, &out)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	expectedTmpfs := map[string]string{podSecretsDir: "rw,noexec,nosuid,mode=0700,uid=1000,gid=1000"}
+	if diff := cmp.Diff(expectedTmpfs, tmpfs); diff != "" {
+		t.Fatalf("unexpected tmpfs: %s", diff)
+	}
+
+	expectedCmds := [][]string{
+		{"/tmp/agola/agola-toolbox", "exec", "-e", "null", "-w", "", "--", "/tmp/agola/agola-toolbox", "createfile", "--path", "/run/secrets/id_rsa.1"},
+		{"/tmp/agola/agola-toolbox", "exec", "-e", "null", "-w", "", "--", "/tmp/agola/agola-toolbox", "createfile", "--path", "/run/secrets/token"},
+	}
+	if diff := cmp.Diff(expectedCmds, execCmds); diff != "" {
+		t.Fatalf("unexpected exec cmds: %s", diff)
+	}
+
+	expectedStdins := map[string]string{"execid01": "keysecret", "execid02": "tokensecret"}
+	if diff := cmp.Diff(expectedStdins, stdins); diff != "" {
+		t.Fatalf("unexpected exec stdins: %s", diff)
+	}
+
+	if strings.Contains(out.String(), "secret") {
+		t.Fatalf("secrets contents written to the pod output: %q", out.String())
+	}
+}
+
+func TestSecretsTmpfsOptions(t *testing.T) {
+	tests := []struct {
+		user     string
+		expected string
+	}{
+		{user: "", expected: "rw,noexec,nosuid,mode=0700"},
+		{user: "1000", expected: "rw,noexec,nosuid,mode=0700,uid=1000"},
+		{user: "1000:1001", expected: "rw,noexec,nosuid,mode=0700,uid=1000,gid=1001"},
+		{user: "agola:1001", expected: "rw,noexec,nosuid,mode=0700,gid=1001"},
+		{user: "agola", expected: "rw,noexec,nosuid,mode=0700"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.user, func(t *testing.T) {
+			if options := secretsTmpfsOptions(tt.user); options != tt.expected {
+				t.Fatalf("expected options %q, got %q", tt.expected, options)
+			}
+		})
+	}
+}
+
+func TestDockerNewPodCapacity(t *testing.T) {
+	tests := []struct {
+		name          string
+		requests      ResourceRequests
+		expectedErr   string
+		expectCreated bool
+	}{
+		{
+			name:          "test pod fitting the available capacity",
+			requests:      ResourceRequests{Memory: 1024, CPU: 1000},
+			expectCreated: true,
+		},
+		{
+			name:          "test pod without requests",
+			expectCreated: true,
+		},
+		{
+			name:        "test pod exceeding the available memory",
+			requests:    ResourceRequests{Memory: 1025, CPU: 500},
+			expectedErr: "pod resource requests (memory: 1025, cpu: 500m) exceed the executor available capacity (memory: 1024, cpu: 1500m)",
+		},
+		{
+			name:        "test pod exceeding the available cpu",
+			requests:    ResourceRequests{Memory: 512, CPU: 2000},
+			expectedErr: "pod resource requests (memory: 512, cpu: 2000m) exceed the executor available capacity (memory: 1024, cpu: 1500m)",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var createdLabels []map[string]string
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				defer mu.Unlock()
+				switch {
+				case strings.HasSuffix(r.URL.Path, "/info"):
+					// the capacity option overrides only the memory
+					_ = json.NewEncoder(w).Encode(types.Info{NCPU: 2, MemTotal: 1 << 30})
+				case strings.HasSuffix(r.URL.Path, "/images/create"):
+					_, _ = w.Write([]byte(`{"status":"pulled"}`))
+				case strings.HasSuffix(r.URL.Path, "/containers/create"):
+					var config container.Config
+					_ = json.NewDecoder(r.Body).Decode(&config)
+					createdLabels = append(createdLabels, config.Labels)
+					w.WriteHeader(http.StatusCreated)
+					_, _ = w.Write([]byte(fmt.Sprintf(`{"Id":"containerid%02d"}`, len(createdLabels))))
+				case strings.HasSuffix(r.URL.Path, "/start"):
+					w.WriteHeader(http.StatusNoContent)
+				case strings.HasSuffix(r.URL.Path, "/containers/json"):
+					// an already running pod using part of the capacity
+					containers := []types.Container{
+						{ID: "runningid01", Labels: map[string]string{containerIndexKey: "0", memoryRequestKey: "1024", cpuRequestKey: "500"}},
+					}
+					_ = json.NewEncoder(w).Encode(containers)
+				default:
+					w.WriteHeader(http.StatusNotFound)
+				}
+			})
+
+			d := newFakeDockerDriver(t, handler, WithDockerDriverCapacity(2048, 0))
+			// use a pooled toolbox volume to avoid populating it
+			noop := func(ctx context.Context, id string) error { return nil }
+			d.toolboxVolumePool = newWarmPool(zerolog.Nop(), 1, nil, noop, noop)
+			d.toolboxVolumePool.idle = []string{"toolboxvol01"}
+
+			_, err := d.NewPod(context.Background(), &PodConfig{
+				ID:     "podid01",
+				TaskID: "taskid01",
+				Containers: []*ContainerConfig{
+					{Image: "busybox", Requests: tt.requests},
+				},
+				InitVolumeDir: "/tmp/agola",
+			}, ioutil.Discard)
+
+			if tt.expectedErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected err: %v", err)
+				}
+			} else {
+				if err == nil {
+					t.Fatalf("expected err %q, got nil err", tt.expectedErr)
+				}
+				if err.Error() != tt.expectedErr {
+					t.Fatalf("expected err %q, got err: %q", tt.expectedErr, err.Error())
+				}
+				if !util.APIErrorIs(err, util.ErrUnavailable) {
+					t.Fatalf("expected err kind %q, got err: %v", util.ErrUnavailable, err)
+				}
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if !tt.expectCreated {
+				if len(createdLabels) != 0 {
+					t.Fatalf("expected no created containers, got %d", len(createdLabels))
+				}
+				return
+			}
+			if len(createdLabels) != 1 {
+				t.Fatalf("expected 1 created container, got %d", len(createdLabels))
+			}
+			if tt.requests.Memory > 0 {
+				if v := createdLabels[0][memoryRequestKey]; v != strconv.FormatInt(tt.requests.Memory, 10) {
+					t.Fatalf("unexpected memory request label %q", v)
+				}
+			} else if _, ok := createdLabels[0][memoryRequestKey]; ok {
+				t.Fatalf("unexpected memory request label")
+			}
+			if tt.requests.CPU > 0 {
+				if v := createdLabels[0][cpuRequestKey]; v != strconv.FormatInt(tt.requests.CPU, 10) {
+					t.Fatalf("unexpected cpu request label %q", v)
+				}
+			}
+			if d.pendingRequests != (ResourceRequests{}) {
+				t.Fatalf("expected released pending requests, got %+v", d.pendingRequests)
+			}
+		})
+	}
+}
+
+func TestDockerPodWaitReady(t *testing.T) {
+	tests := []struct {
+		name        string
+		states      []types.ContainerState
+		timeout     time.Duration
+		expectedErr string
+	}{
+		{
+			name: "test containers running",
+			states: []types.ContainerState{
+				{Status: "created"},
+				{Status: "running", Running: true},
+			},
+			timeout: 5 * time.Second,
+		},
+		{
+			name: "test container exited with error",
+			states: []types.ContainerState{
+				{Status: "created"},
+				{Status: "exited", ExitCode: 2},
+			},
+			timeout:     5 * time.Second,
+			expectedErr: `container "service1" exited with code 2`,
+		},
+		{
+			name: "test container exited without error",
+			states: []types.ContainerState{
+				{Status: "created"},
+				{Status: "exited", ExitCode: 0},
+			},
+			timeout:     5 * time.Second,
+			expectedErr: `container "service1" exited with code 0`,
+		},
+		{
+			name: "test container not running before deadline",
+			states: []types.ContainerState{
+				{Status: "created"},
+			},
+			timeout:     time.Second,
+			expectedErr: context.DeadlineExceeded.Error(),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			inspects := 0
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if !strings.HasSuffix(r.URL.Path, "/json") {
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+				state := &types.ContainerState{Status: "running", Running: true}
+				// the service container state changes at every inspect
+				if strings.Contains(r.URL.Path, "containerid02") {
+					mu.Lock()
+					s := tt.states[len(tt.states)-1]
+					if inspects < len(tt.states) {
+						s = tt.states[inspects]
+					}
+					inspects++
+					mu.Unlock()
+					state = &s
+				}
+				_ = json.NewEncoder(w).Encode(types.ContainerJSON{ContainerJSONBase: &types.ContainerJSONBase{State: state}})
+			})
+
+			d := newFakeDockerDriver(t, handler)
+			pod := &DockerPod{
+				id:     "podid01",
+				client: d.client,
+				containers: []*DockerContainer{
+					{Index: 0, Name: mainContainerName, Container: types.Container{ID: "containerid01"}},
+					{Index: 1, Name: "service1", Container: types.Container{ID: "containerid02"}},
+				},
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), tt.timeout)
+			defer cancel()
+
+			err := pod.WaitReady(ctx)
+			if tt.expectedErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected err: %v", err)
+				}
+			} else {
+				if err == nil {
+					t.Fatalf("expected err %q, got nil err", tt.expectedErr)
+				}
+				if err.Error() != tt.expectedErr {
+					t.Fatalf("expected err %q, got err: %q", tt.expectedErr, err.Error())
+				}
+				if strings.Contains(tt.expectedErr, "exited") {
+					if derr, ok := util.AsAPIError(err); !ok || derr.Kind != util.ErrInternal || derr.Code != ErrorCodeContainerExited {
+						t.Fatalf("expected internal api error with code %q, got: %v", ErrorCodeContainerExited, err)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestDockerPodStats(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/stats") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		switch {
+		case strings.Contains(r.URL.Path, "containerid01"):
+			s := types.StatsJSON{
+				Stats: types.Stats{
+					Read: time.Now(),
+					CPUStats: types.CPUStats{
+						CPUUsage:    types.CPUUsage{TotalUsage: 300},
+						SystemUsage: 2000,
+						OnlineCPUs:  2,
+					},
+					PreCPUStats: types.CPUStats{
+						CPUUsage:    types.CPUUsage{TotalUsage: 100},
+						SystemUsage: 1000,
+					},
+					MemoryStats: types.MemoryStats{
+						Usage: 1000,
+						Limit: 4000,
+						Stats: map[string]uint64{"total_inactive_file": 200},
+					},
+				},
+				Networks: map[string]types.NetworkStats{
+					"eth0": {RxBytes: 10, TxBytes: 20},
+					"eth1": {RxBytes: 1, TxBytes: 2},
+				},
+			}
+			_ = json.NewEncoder(w).Encode(s)
+		case strings.Contains(r.URL.Path, "containerid02"):
+			// exited container
+			_ = json.NewEncoder(w).Encode(types.StatsJSON{})
+		default:
+			// removed container
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"message":"No such container"}`))
+		}
+	})
+
+	d := newFakeDockerDriver(t, handler)
+	pod := &DockerPod{
+		id:     "podid01",
+		client: d.client,
+		containers: []*DockerContainer{
+			{Index: 0, Name: mainContainerName, Container: types.Container{ID: "containerid01"}},
+			{Index: 1, Name: "service1", Container: types.Container{ID: "containerid02"}},
+			{Index: 2, Name: "service2", Container: types.Container{ID: "containerid03"}},
+		},
+	}
+
+	stats, err := pod.Stats(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	expectedStats := map[string]ContainerStats{
+		mainContainerName: {
+			CPUPercent:  40,
+			MemoryUsage: 800,
+			MemoryLimit: 4000,
+			NetworkRx:   11,
+			NetworkTx:   22,
+		},
+	}
+	if diff := cmp.Diff(expectedStats, stats); diff != "" {
+		t.Fatalf("unexpected stats: %s", diff)
+	}
+}
+
+func TestDockerPodInspectContainers(t *testing.T) {
+	startedAt := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	finishedAt := startedAt.Add(time.Minute)
+
+	var mu sync.Mutex
+	inspected := []string{}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/json") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		parts := strings.Split(r.URL.Path, "/")
+		id := parts[len(parts)-2]
+		mu.Lock()
+		inspected = append(inspected, id)
+		mu.Unlock()
+
+		state := &types.ContainerState{Status: "running", Running: true, StartedAt: startedAt.Format(time.RFC3339Nano), FinishedAt: "0001-01-01T00:00:00Z"}
+		if id == "containerid02" {
+			state = &types.ContainerState{Status: "exited", ExitCode: 137, OOMKilled: true, StartedAt: startedAt.Format(time.RFC3339Nano), FinishedAt: finishedAt.Format(time.RFC3339Nano)}
+		}
+		_ = json.NewEncoder(w).Encode(types.ContainerJSON{ContainerJSONBase: &types.ContainerJSONBase{ID: id, State: state}})
+	})
+
+	d := newFakeDockerDriver(t, handler)
+	pod := &DockerPod{
+		id:     "podid01",
+		client: d.client,
+		containers: []*DockerContainer{
+			{Index: 1, Name: "service1", Container: types.Container{ID: "containerid02"}},
+			{Index: 0, Name: mainContainerName, Container: types.Container{ID: "containerid01"}},
+		},
+	}
+
+	mainStatus := ContainerStatus{Index: 0, Name: mainContainerName, Running: true, StartedAt: startedAt}
+	serviceStatus := ContainerStatus{Index: 1, Name: "service1", ExitCode: 137, OOMKilled: true, StartedAt: startedAt, FinishedAt: finishedAt}
+
+	t.Run("test inspect all containers", func(t *testing.T) {
+		statuses, err := pod.InspectContainers(context.Background())
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if diff := cmp.Diff([]ContainerStatus{mainStatus, serviceStatus}, statuses); diff != "" {
+			t.Fatalf("unexpected statuses: %s", diff)
+		}
+	})
+
+	t.Run("test inspect main container", func(t *testing.T) {
+		mu.Lock()
+		inspected = []string{}
+		mu.Unlock()
+
+		status, err := pod.InspectMainContainer(context.Background())
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if diff := cmp.Diff(&mainStatus, status); diff != "" {
+			t.Fatalf("unexpected status: %s", diff)
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		if diff := cmp.Diff([]string{"containerid01"}, inspected); diff != "" {
+			t.Fatalf("unexpected inspected containers: %s", diff)
+		}
+	})
+}
+
+func TestDockerPodContainerDiff(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/containers/containerid02/changes") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write([]byte(`[{"Kind":0,"Path":"/root"},{"Kind":1,"Path":"/root/.npm"},{"Kind":2,"Path":"/tmp/old"}]`))
+	})
+
+	d := newFakeDockerDriver(t, handler)
+	mainContainer := &DockerContainer{Index: 0, Name: mainContainerName, Container: types.Container{ID: "containerid01"}}
+	serviceContainer := &DockerContainer{Index: 1, Name: "service1", Container: types.Container{ID: "containerid02"}}
+	pod := &DockerPod{
+		id:            "podid01",
+		client:        d.client,
+		containers:    []*DockerContainer{mainContainer, serviceContainer},
+		containersMap: map[string]*DockerContainer{mainContainerName: mainContainer, "service1": serviceContainer},
+	}
+
+	t.Run("test container changes", func(t *testing.T) {
+		changes, err := pod.ContainerDiff(context.Background(), "service1")
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		expectedChanges := []ContainerChange{
+			{Kind: ContainerChangeModified, Path: "/root"},
+			{Kind: ContainerChangeAdded, Path: "/root/.npm"},
+			{Kind: ContainerChangeDeleted, Path: "/tmp/old"},
+		}
+		if diff := cmp.Diff(expectedChanges, changes); diff != "" {
+			t.Fatalf("unexpected changes: %s", diff)
+		}
+	})
+
+	t.Run("test unknown container", func(t *testing.T) {
+		expectedErr := `container "service2" doesn't exist in pod "podid01"`
+		_, err := pod.ContainerDiff(context.Background(), "service2")
+		if err == nil {
+			t.Fatalf("expected err %q, got nil err", expectedErr)
+		}
+		if err.Error() != expectedErr {
+			t.Fatalf("expected err %q, got err: %q", expectedErr, err.Error())
+		}
+		if !util.APIErrorIs(err, util.ErrNotExist) {
+			t.Fatalf("expected err kind %q, got err: %v", util.ErrNotExist, err)
+		}
+	})
+}
+
+func TestDockerPodEvents(t *testing.T) {
+	msgs := []events.Message{
+		{Type: "container", Action: "oom", Actor: events.Actor{ID: "containerid02"}, TimeNano: 1},
+		// start events aren't reported
+		{Type: "container", Action: "start", Actor: events.Actor{ID: "containerid02"}, TimeNano: 2},
+		{Type: "container", Action: "die", Actor: events.Actor{ID: "containerid02", Attributes: map[string]string{"exitCode": "137"}}, TimeNano: 3},
+		// events of containers outside the pod are ignored
+		{Type: "container", Action: "die", Actor: events.Actor{ID: "containerid03", Attributes: map[string]string{"exitCode": "0"}}, TimeNano: 4},
+		{Type: "container", Action: "health_status: unhealthy", Actor: events.Actor{ID: "containerid01"}, TimeNano: 5},
+	}
+
+	newPod := func(t *testing.T, handler http.Handler) *DockerPod {
+		d := newFakeDockerDriver(t, handler)
+		mainContainer := &DockerContainer{Index: 0, Name: mainContainerName, Container: types.Container{ID: "containerid01"}}
+		serviceContainer := &DockerContainer{Index: 1, Name: "service1", Container: types.Container{ID: "containerid02"}}
+		return &DockerPod{
+			id:            "podid01",
+			client:        d.client,
+			executorID:    d.executorID,
+			containers:    []*DockerContainer{mainContainer, serviceContainer},
+			containersMap: map[string]*DockerContainer{mainContainerName: mainContainer, "service1": serviceContainer},
+		}
+	}
+
+	t.Run("test pod events", func(t *testing.T) {
+		handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !strings.HasSuffix(r.URL.Path, "/events") {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			filters := r.URL.Query().Get("filters")
+			for _, filter := range []string{podIDKey + "=podid01", executorIDKey + "=executorid01", `"die"`, `"oom"`, `"health_status"`} {
+				if !strings.Contains(filters, filter) {
+					t.Errorf("expected filter %q in filters %s", filter, filters)
+				}
+			}
+			enc := json.NewEncoder(w)
+			for _, msg := range msgs {
+				_ = enc.Encode(msg)
+			}
+		})
+
+		pod := newPod(t, handler)
+		ch, err := pod.Events(context.Background())
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+
+		// the channel is closed at the end of the events stream
+		podEvents := []PodEvent{}
+		for event := range ch {
+			podEvents = append(podEvents, event)
+		}
+
+		expectedEvents := []PodEvent{
+			{Kind: PodEventOOM, ContainerName: "service1", ContainerIndex: 1, Time: time.Unix(0, 1)},
+			{Kind: PodEventDie, ContainerName: "service1", ContainerIndex: 1, Time: time.Unix(0, 3), ExitCode: 137},
+			{Kind: PodEventHealthStatus, ContainerName: mainContainerName, ContainerIndex: 0, Time: time.Unix(0, 5), HealthStatus: "unhealthy"},
+		}
+		if diff := cmp.Diff(expectedEvents, podEvents); diff != "" {
+			t.Fatalf("unexpected events: %s", diff)
+		}
+	})
+
+	t.Run("test context cancelation closes the channel", func(t *testing.T) {
+		handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+		})
+
+		pod := newPod(t, handler)
+		ctx, cancel := context.WithCancel(context.Background())
+		ch, err := pod.Events(ctx)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		cancel()
+
+		select {
+		case _, ok := <-ch:
+			if ok {
+				t.Fatalf("unexpected event")
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("channel not closed after context cancelation")
+		}
+	})
+}
@@ -15,14 +15,23 @@
 package driver
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net"
 	"os"
 	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
 
 	"agola.io/agola/internal/errors"
 	"agola.io/agola/internal/services/executor/registry"
+	"agola.io/agola/internal/util"
 	"agola.io/agola/services/types"
 )
 
@@ -39,8 +48,69 @@ const (
 	taskIDKey     = labelPrefix + "taskid"
 
 	containerIndexKey = labelPrefix + "containerindex"
+	containerNameKey  = labelPrefix + "containername"
+
+	// expiryKey is the label containing the time, in RFC3339 format and UTC,
+	// after which the resource can be considered leaked by external tools
+	expiryKey = labelPrefix + "expiry"
+
+	// warmPoolKey is the label set on the resources created for the warm pool
+	warmPoolKey = labelPrefix + "warmpool"
+	// toolboxVolumeKey is the label, set on the pod main container and on the
+	// pooled containers, containing the name of the toolbox volume when
+	// acquired from the warm pool
+	toolboxVolumeKey = labelPrefix + "toolboxvolume"
+	// pooledContainerKey is the label, set on the volume claiming a pooled
+	// container for a pod, containing the pooled container id
+	pooledContainerKey = labelPrefix + "pooledcontainer"
+	// persistentVolumeKey is the label set on the persistent volumes, they
+	// aren't removed with the pods
+	persistentVolumeKey = labelPrefix + "persistentvolume"
+	// cacheKeyKey is the label containing the persistent volume cache key
+	cacheKeyKey = labelPrefix + "cachekey"
+
+	// memoryRequestKey and cpuRequestKey are the labels containing the
+	// container resource requests
+	memoryRequestKey = labelPrefix + "memoryrequest"
+	cpuRequestKey    = labelPrefix + "cpurequest"
+
+	// mainContainerName is the name of the first pod container
+	mainContainerName = "maincontainer"
+
+	// aliasIP is the address the container aliases resolve to
+	aliasIP = "127.0.0.1"
+
+	// defaultWaitReadyTimeout is the pod WaitReady timeout when its context
+	// has no deadline
+	defaultWaitReadyTimeout = 5 * time.Minute
 )
 
+var hostnameRegexp = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?(\.[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?)*$`)
+
+// containerUserRegexp matches a container user in the uid[:gid] format, names
+// are also accepted in place of the ids
+var containerUserRegexp = regexp.MustCompile(`^([0-9]+|[a-zA-Z_][a-zA-Z0-9_.-]*)(:([0-9]+|[a-zA-Z_][a-zA-Z0-9_.-]*))?$`)
+
+// splitContainerUser splits a container user in the uid[:gid] format in its
+// user and group parts. The group is empty when not provided.
+func splitContainerUser(user string) (string, string) {
+	if i := strings.Index(user, ":"); i >= 0 {
+		return user[:i], user[i+1:]
+	}
+
+	return user, ""
+}
+
+// containerNameRegexp matches a pod service container name. It must be a DNS
+// label (RFC 1123), like required by k8s, of at most maxContainerNameLength
+// characters.
+var containerNameRegexp = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+
+const maxContainerNameLength = 63
+
+// secretNameRegexp matches a pod secret name, used as its file name
+var secretNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9_.-]*$`)
+
 // Driver is a generic interface around the pod concept (a group of "containers"
 // sharing, at least, the same network namespace)
 // It's just tailored aroun the need of an executor and should be quite generic
@@ -70,6 +140,22 @@ type Pod interface {
 	Remove(ctx context.Context) error
 	// Exec executes a command inside the first container in the Pod
 	Exec(ctx context.Context, execConfig *ExecConfig) (ContainerExec, error)
+	// WaitReady waits for all the pod containers to be running. It returns
+	// an error if a container exited, also with a zero exit code, or when
+	// ctx is done. When ctx has no deadline it waits at most
+	// defaultWaitReadyTimeout.
+	WaitReady(ctx context.Context) error
+}
+
+// ErrorCodeContainerExited is the error code returned when a pod container
+// exited while waiting for the pod to be ready
+const ErrorCodeContainerExited util.ErrorCode = "container_exited"
+
+// containerExitedError returns the error of a pod container exited while
+// waiting for the pod to be ready. It'll never be running, also when its exit
+// code is zero.
+func containerExitedError(name string, exitCode int) error {
+	return util.NewAPIError(util.ErrInternal, errors.Errorf("container %q exited with code %d", name, exitCode), util.WithCode(ErrorCodeContainerExited))
 }
 
 type ContainerExec interface {
@@ -85,26 +171,237 @@ type PodConfig struct {
 	// The container dir where the init volume will be mounted
 	InitVolumeDir string
 	DockerConfig  *registry.DockerConfig
+	// DNS, when defined, overrides the pod dns configuration. Not supported
+	// by the k8s driver.
+	DNS *DNSConfig
+	// ExternalNetworks are existing docker networks the main container is
+	// connected to. Only the main container is connected since the other pod
+	// containers share its network namespace. Not supported by the k8s
+	// driver.
+	ExternalNetworks []string
+	// Secrets maps the secret names to their contents. Every secret is
+	// written to a file, named as the secret, in a tmpfs mounted at
+	// /run/secrets in the main container so it isn't stored on disk or
+	// exposed in the container env. The files are written by the main
+	// container user and are readable only by it. Not supported by the k8s
+	// driver.
+	Secrets map[string][]byte
+}
+
+type DNSConfig struct {
+	// Servers are the dns servers ip addresses
+	Servers []string
+	// Searches are the dns search domains
+	Searches []string
+	// Options are the resolver options (i.e. "ndots:2")
+	Options []string
 }
 
+// StopOrder is the order in which the pod containers are stopped
+type StopOrder string
+
+const (
+	// StopOrderForward stops the containers in creation order: the main
+	// container first and then the service containers
+	StopOrderForward StopOrder = "forward"
+	// StopOrderReverse stops the containers in reverse creation order: the
+	// service containers first and the main container last
+	StopOrderReverse StopOrder = "reverse"
+)
+
 type ContainerConfig struct {
+	// Name is the container name inside the pod. It's ignored for the main
+	// container. When empty a name derived from the container index is used.
+	// It must be unique inside the pod and cannot be the main container name.
+	Name string
+	// Entrypoint overrides the image entrypoint. When both Entrypoint and Cmd
+	// are empty the image entrypoint and command are kept.
+	Entrypoint []string
+	// Cmd overrides the image command, the entrypoint arguments. When
+	// Entrypoint is empty, Cmd is used as the entrypoint, keeping the previous
+	// behavior.
 	Cmd        []string
 	Env        map[string]string
 	WorkingDir string
 	Image      string
+	// User is the user, and optionally the group, the container processes
+	// run as, in the uid[:gid] format (user and group names are also
+	// accepted). When empty the image user is used. The k8s driver only uses
+	// a numeric uid and gid.
 	User       string
 	Privileged bool
 	Volumes    []Volume
+	// StopSignal is the signal sent to the container to stop it. When empty
+	// the runtime default is used. Not supported by the k8s driver.
+	StopSignal string
+	// ExtraHosts are additional hosts entries in the "name:ip" form. Since
+	// all the pod containers share the same network namespace, the extra
+	// hosts of all the containers are available to every pod container. Not
+	// supported by the k8s driver.
+	ExtraHosts []string
+	// Aliases are host names resolving to 127.0.0.1 so the pod containers
+	// can reach the container by name (i.e. "redis") instead of localhost.
+	// Since all the pod containers share the same network namespace, the
+	// containers must listen on distinct ports. Not supported by the k8s
+	// driver.
+	Aliases []string
+	// CapAdd and CapDrop are the linux capabilities to add to or drop from
+	// the container default capabilities. The "CAP_" prefix is optional and
+	// "ALL" means all the capabilities. Not supported by the k8s driver.
+	CapAdd  []string
+	CapDrop []string
+	// ReadOnlyRootfs mounts the container root filesystem as read only. Only
+	// the declared volumes will be writable. The toolbox volume mounted in the
+	// main container is always read only and doesn't need to be writable.
+	// Not supported by the k8s driver.
+	ReadOnlyRootfs bool
+	// Ulimits are the container resource limits. Not supported by the k8s
+	// driver.
+	Ulimits []Ulimit
+	// ShmSizeBytes is the size of /dev/shm. When zero the docker default is
+	// used. Not supported by the k8s driver.
+	ShmSizeBytes int64
+	// Sysctls are the namespaced kernel parameters to set in the container
+	// (i.e. "net.core.somaxconn"). Since all the pod containers share the
+	// main container network namespace, network ("net.*") sysctls can be set
+	// only on the main container. Not supported by the k8s driver.
+	Sysctls map[string]string
+	// SeccompProfilePath is the path, on the executor host, of a seccomp
+	// profile json file to apply to the container. Not supported by the k8s
+	// driver.
+	SeccompProfilePath string
+	// AppArmorProfile is the name of an AppArmor profile, already loaded on
+	// the host, to apply to the container. Not supported by the k8s driver.
+	AppArmorProfile string
+	// Platform is the platform, in the os/arch[/variant] format (i.e.
+	// "linux/arm64/v8"), of the image to pull. When empty the executor arch
+	// is used. The docker driver requires docker api version >= 1.32 and
+	// doesn't accept the same image with different platforms in a pod. Not
+	// supported by the k8s driver.
+	Platform string
+	// RestartPolicy defines when a service container is restarted. It can be
+	// set only on service containers (not the main container) since the main
+	// container lifecycle is managed by the task runner. Not supported by the
+	// k8s driver.
+	RestartPolicy *RestartPolicy
+	// Healthcheck is the container health check. Not supported by the k8s
+	// driver.
+	Healthcheck *Healthcheck
+	// Requests are the resources requested by the container. The docker
+	// driver uses them to check that the pod fits the executor capacity. Not
+	// supported by the k8s driver.
+	Requests ResourceRequests
+}
+
+// ResourceRequests are the resources requested by a container.
+type ResourceRequests struct {
+	// Memory is the requested memory in bytes
+	Memory int64
+	// CPU is the requested cpu in millicpus (1000 is one cpu)
+	CPU int64
+}
+
+// Healthcheck defines how the container health is checked.
+type Healthcheck struct {
+	// Test is the check command, in the {"CMD", args...} or
+	// {"CMD-SHELL", command} form.
+	Test []string
+	// Interval is the time between two checks.
+	Interval time.Duration
+	// Timeout is the time after which a check is considered failed.
+	Timeout time.Duration
+	// StartPeriod is the time given to the container to start before the
+	// failed checks count as retries. It requires docker api >= 1.29.
+	StartPeriod time.Duration
+	// Retries is the number of consecutive failed checks needed to consider
+	// the container unhealthy.
+	Retries int
+}
+
+type RestartPolicyName string
+
+const (
+	RestartPolicyNo            RestartPolicyName = "no"
+	RestartPolicyAlways        RestartPolicyName = "always"
+	RestartPolicyUnlessStopped RestartPolicyName = "unless-stopped"
+	RestartPolicyOnFailure     RestartPolicyName = "on-failure"
+)
+
+type RestartPolicy struct {
+	Name RestartPolicyName
+	// MaximumRetryCount is the max number of restarts. It can be set only
+	// with the on-failure policy, zero means unlimited restarts.
+	MaximumRetryCount int
+}
+
+type Ulimit struct {
+	// Name is the resource name (i.e. "nofile")
+	Name string
+	Soft int64
+	Hard int64
+}
+
+// knownUlimits are the resource names accepted by the container runtime
+var knownUlimits = map[string]struct{}{
+	"core":       {},
+	"cpu":        {},
+	"data":       {},
+	"fsize":      {},
+	"locks":      {},
+	"memlock":    {},
+	"msgqueue":   {},
+	"nice":       {},
+	"nofile":     {},
+	"nproc":      {},
+	"rss":        {},
+	"rtprio":     {},
+	"rttime":     {},
+	"sigpending": {},
+	"stack":      {},
+}
+
+func validateUlimit(ulimit Ulimit) error {
+	if _, ok := knownUlimits[ulimit.Name]; !ok {
+		return util.NewAPIError(util.ErrBadRequest, errors.Errorf("unknown ulimit %q", ulimit.Name))
+	}
+	if ulimit.Soft > ulimit.Hard {
+		return util.NewAPIError(util.ErrBadRequest, errors.Errorf("ulimit %q soft limit %d is greater than hard limit %d", ulimit.Name, ulimit.Soft, ulimit.Hard))
+	}
+
+	return nil
 }
 
 type Volume struct {
 	Path string
 
-	TmpFS *VolumeTmpFS
+	TmpFS      *VolumeTmpFS
+	Bind       *VolumeBind
+	Persistent *VolumePersistent
 }
 
 type VolumeTmpFS struct {
 	Size int64
+	// AllowExec permits executing files inside the tmpfs when the driver
+	// mounts tmpfs volumes as noexec,nosuid by default. Currently only used
+	// by the docker driver.
+	AllowExec bool
+}
+
+// VolumeBind bind mounts a host directory at the volume path. The driver must
+// allow the host directory. Not supported by the k8s driver.
+type VolumeBind struct {
+	// Source is the host directory absolute path
+	Source   string
+	ReadOnly bool
+}
+
+// VolumePersistent mounts a named volume that isn't removed with the pod and is
+// shared by all the pods using the same cache key. Not supported by the k8s
+// driver.
+type VolumePersistent struct {
+	// CacheKey identifies the volume, i.e. derived from the project id and
+	// the cache name
+	CacheKey string
 }
 
 type ExecConfig struct {
@@ -116,6 +413,397 @@ type ExecConfig struct {
 	Stdout      io.Writer
 	Stderr      io.Writer
 	Tty         bool
+	// InheritContainerEnv defines if the provided Env is merged with the
+	// container environment or if the command is executed only with the
+	// provided Env. Defaults to true when nil.
+	InheritContainerEnv *bool
+	// MaxOutputBytes, when > 0, is the maximum number of bytes written to
+	// Stdout and Stderr combined. The exceeding output is discarded and a
+	// truncation marker is written. The command isn't stopped.
+	MaxOutputBytes int64
+	// Shell, when not empty, is the shell, with its arguments (i.e. /bin/sh
+	// -c), that runs the command. The first command argument is the script
+	// provided to the shell, the other ones are passed to the script as its
+	// positional parameters ($1, $2...). When empty the command is executed
+	// directly.
+	Shell []string
+}
+
+const outputTruncatedMarker = "\n[output truncated]\n"
+
+// execOutput returns the exec stdout and stderr writers limited to the exec
+// MaxOutputBytes. Nil writers are kept nil.
+func execOutput(execConfig *ExecConfig) (io.Writer, io.Writer) {
+	stdout, stderr := execConfig.Stdout, execConfig.Stderr
+	if execConfig.MaxOutputBytes <= 0 {
+		return stdout, stderr
+	}
+
+	l := &outputLimiter{remaining: execConfig.MaxOutputBytes}
+	if stdout != nil {
+		stdout = &limitedWriter{l: l, w: stdout}
+	}
+	if stderr != nil {
+		stderr = &limitedWriter{l: l, w: stderr}
+	}
+
+	return stdout, stderr
+}
+
+// outputLimiter tracks the remaining bytes that can be written by all its
+// limitedWriters
+type outputLimiter struct {
+	mu        sync.Mutex
+	remaining int64
+	truncated bool
+}
+
+type limitedWriter struct {
+	l *outputLimiter
+	w io.Writer
+}
+
+func (lw *limitedWriter) Write(p []byte) (int, error) {
+	lw.l.mu.Lock()
+	defer lw.l.mu.Unlock()
+
+	// always report the full write so the output copy continues
+	if lw.l.truncated {
+		return len(p), nil
+	}
+	if int64(len(p)) <= lw.l.remaining {
+		lw.l.remaining -= int64(len(p))
+		return lw.w.Write(p)
+	}
+
+	n := lw.l.remaining
+	lw.l.remaining = 0
+	lw.l.truncated = true
+	if _, err := lw.w.Write(p[:n]); err != nil {
+		return 0, err
+	}
+	if _, err := io.WriteString(lw.w, outputTruncatedMarker); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// toolboxExecCmd returns the toolbox command used to execute the exec command
+// with the requested environment and working dir.
+func toolboxExecCmd(initVolumeDir string, execConfig *ExecConfig) ([]string, error) {
+	envj, err := json.Marshal(execConfig.Env)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	cmd := []string{filepath.Join(initVolumeDir, "agola-toolbox"), "exec", "-e", string(envj), "-w", execConfig.WorkingDir}
+	if execConfig.InheritContainerEnv != nil && !*execConfig.InheritContainerEnv {
+		cmd = append(cmd, "--clean-env")
+	}
+	cmd = append(cmd, "--")
+	if len(execConfig.Shell) > 0 {
+		// the toolbox reports a missing shell executable
+		if execConfig.Shell[0] == "" {
+			return nil, util.NewAPIError(util.ErrBadRequest, errors.Errorf("empty exec shell executable"))
+		}
+		cmd = append(cmd, execConfig.Shell...)
+		if len(execConfig.Cmd) > 0 {
+			cmd = append(cmd, execConfig.Cmd[0])
+		}
+		if len(execConfig.Cmd) > 1 {
+			// pass the arguments positionally to keep their boundaries, the
+			// shell executable is used as $0
+			cmd = append(cmd, execConfig.Shell[0])
+			cmd = append(cmd, execConfig.Cmd[1:]...)
+		}
+	} else {
+		cmd = append(cmd, execConfig.Cmd...)
+	}
+
+	return cmd, nil
+}
+
+// containerEntrypointCmd returns the container entrypoint and command. When
+// only Cmd is provided it's used as the entrypoint.
+func containerEntrypointCmd(containerConfig *ContainerConfig) ([]string, []string) {
+	if len(containerConfig.Entrypoint) == 0 {
+		return containerConfig.Cmd, nil
+	}
+	return containerConfig.Entrypoint, containerConfig.Cmd
+}
+
+// validatePodConfig validates the pod config fields that aren't already
+// validated by the container runtime.
+func validatePodConfig(podConfig *PodConfig) error {
+	if podConfig.DNS != nil {
+		for _, server := range podConfig.DNS.Servers {
+			if net.ParseIP(server) == nil {
+				return util.NewAPIError(util.ErrBadRequest, errors.Errorf("invalid dns server %q, must be an ip address", server))
+			}
+		}
+	}
+
+	for name := range podConfig.Secrets {
+		if !secretNameRegexp.MatchString(name) {
+			return util.NewAPIError(util.ErrBadRequest, errors.Errorf("invalid secret name %q", name))
+		}
+	}
+
+	externalNetworks := map[string]struct{}{}
+	for _, network := range podConfig.ExternalNetworks {
+		if network == "" {
+			return util.NewAPIError(util.ErrBadRequest, errors.Errorf("empty external network name"))
+		}
+		if _, ok := externalNetworks[network]; ok {
+			return util.NewAPIError(util.ErrBadRequest, errors.Errorf("duplicate external network %q", network))
+		}
+		externalNetworks[network] = struct{}{}
+	}
+
+	// the main container name is reserved
+	containerNames := map[string]struct{}{mainContainerName: {}}
+	aliases := map[string]struct{}{}
+	for i, containerConfig := range podConfig.Containers {
+		if i > 0 {
+			name := podContainerName(i, containerConfig.Name)
+			if len(name) > maxContainerNameLength || !containerNameRegexp.MatchString(name) {
+				return util.NewAPIError(util.ErrBadRequest, errors.Errorf("invalid container name %q, must be a lowercase dns label of at most %d characters", name, maxContainerNameLength))
+			}
+			if _, ok := containerNames[name]; ok {
+				return util.NewAPIError(util.ErrBadRequest, errors.Errorf("duplicate container name %q", name))
+			}
+			containerNames[name] = struct{}{}
+		}
+		if containerConfig.User != "" && !containerUserRegexp.MatchString(containerConfig.User) {
+			return util.NewAPIError(util.ErrBadRequest, errors.Errorf("invalid container user %q, must be in the uid[:gid] format", containerConfig.User))
+		}
+		for _, extraHost := range containerConfig.ExtraHosts {
+			if _, _, err := parseExtraHost(extraHost); err != nil {
+				return errors.WithStack(err)
+			}
+		}
+		for _, alias := range containerConfig.Aliases {
+			if !hostnameRegexp.MatchString(alias) {
+				return util.NewAPIError(util.ErrBadRequest, errors.Errorf("invalid alias %q, must be a valid host name", alias))
+			}
+			if _, ok := aliases[alias]; ok {
+				return util.NewAPIError(util.ErrBadRequest, errors.Errorf("duplicate alias %q", alias))
+			}
+			aliases[alias] = struct{}{}
+		}
+		for sysctl := range containerConfig.Sysctls {
+			if sysctl == "" {
+				return util.NewAPIError(util.ErrBadRequest, errors.Errorf("empty sysctl name"))
+			}
+			if i > 0 && strings.HasPrefix(sysctl, "net.") {
+				return util.NewAPIError(util.ErrBadRequest, errors.Errorf("network sysctl %q can be set only on the main container since the pod containers share its network namespace", sysctl))
+			}
+		}
+		for _, vol := range containerConfig.Volumes {
+			if vol.Persistent != nil && vol.Persistent.CacheKey == "" {
+				return util.NewAPIError(util.ErrBadRequest, errors.Errorf("empty persistent volume cache key"))
+			}
+			if vol.Bind != nil && (!filepath.IsAbs(vol.Bind.Source) || filepath.Clean(vol.Bind.Source) != vol.Bind.Source) {
+				return util.NewAPIError(util.ErrBadRequest, errors.Errorf("invalid bind source %q, must be a clean absolute path", vol.Bind.Source))
+			}
+		}
+		if containerConfig.Platform != "" {
+			if err := validatePlatform(containerConfig.Platform); err != nil {
+				return errors.WithStack(err)
+			}
+		}
+		if containerConfig.RestartPolicy != nil {
+			if i == 0 {
+				return util.NewAPIError(util.ErrBadRequest, errors.Errorf("restart policy cannot be set on the main container"))
+			}
+			if err := validateRestartPolicy(containerConfig.RestartPolicy); err != nil {
+				return errors.WithStack(err)
+			}
+		}
+		if containerConfig.Healthcheck != nil {
+			if err := validateHealthcheck(containerConfig.Healthcheck); err != nil {
+				return errors.WithStack(err)
+			}
+		}
+		if containerConfig.Requests.Memory < 0 || containerConfig.Requests.CPU < 0 {
+			return util.NewAPIError(util.ErrBadRequest, errors.Errorf("invalid resource requests, must be positive"))
+		}
+		if containerConfig.ShmSizeBytes < 0 {
+			return util.NewAPIError(util.ErrBadRequest, errors.Errorf("invalid shm size %d, must be positive", containerConfig.ShmSizeBytes))
+		}
+		for _, ulimit := range containerConfig.Ulimits {
+			if err := validateUlimit(ulimit); err != nil {
+				return errors.WithStack(err)
+			}
+		}
+		for _, capabilities := range [][]string{containerConfig.CapAdd, containerConfig.CapDrop} {
+			for _, capability := range capabilities {
+				if _, ok := knownCapabilities[normalizeCapability(capability)]; !ok {
+					return util.NewAPIError(util.ErrBadRequest, errors.Errorf("unknown capability %q", capability))
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+func validatePlatform(platform string) error {
+	parts := strings.Split(platform, "/")
+	if len(parts) < 2 || len(parts) > 3 {
+		return util.NewAPIError(util.ErrBadRequest, errors.Errorf("invalid platform %q, must be in the os/arch[/variant] format", platform))
+	}
+	for _, part := range parts {
+		if part == "" {
+			return util.NewAPIError(util.ErrBadRequest, errors.Errorf("invalid platform %q, must be in the os/arch[/variant] format", platform))
+		}
+	}
+
+	return nil
+}
+
+func validateHealthcheck(healthcheck *Healthcheck) error {
+	if len(healthcheck.Test) < 2 || (healthcheck.Test[0] != "CMD" && healthcheck.Test[0] != "CMD-SHELL") {
+		return util.NewAPIError(util.ErrBadRequest, errors.Errorf("invalid healthcheck test %q, must be in the {\"CMD\", args...} or {\"CMD-SHELL\", command} form", healthcheck.Test))
+	}
+	if healthcheck.Interval < 0 || healthcheck.Timeout < 0 || healthcheck.StartPeriod < 0 {
+		return util.NewAPIError(util.ErrBadRequest, errors.Errorf("invalid healthcheck durations, must be positive"))
+	}
+	if healthcheck.Retries < 0 {
+		return util.NewAPIError(util.ErrBadRequest, errors.Errorf("invalid healthcheck retries %d, must be positive", healthcheck.Retries))
+	}
+
+	return nil
+}
+
+func validateRestartPolicy(restartPolicy *RestartPolicy) error {
+	switch restartPolicy.Name {
+	case RestartPolicyNo, RestartPolicyAlways, RestartPolicyUnlessStopped:
+		if restartPolicy.MaximumRetryCount != 0 {
+			return util.NewAPIError(util.ErrBadRequest, errors.Errorf("max retry count cannot be set with restart policy %q", restartPolicy.Name))
+		}
+	case RestartPolicyOnFailure:
+		if restartPolicy.MaximumRetryCount < 0 {
+			return util.NewAPIError(util.ErrBadRequest, errors.Errorf("invalid max retry count %d, must be positive", restartPolicy.MaximumRetryCount))
+		}
+	default:
+		return util.NewAPIError(util.ErrBadRequest, errors.Errorf("unknown restart policy %q", restartPolicy.Name))
+	}
+
+	return nil
+}
+
+// readSeccompProfile reads the seccomp profile at path and returns it as
+// compacted json
+func readSeccompProfile(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", util.NewAPIError(util.ErrBadRequest, errors.Wrapf(err, "failed to read seccomp profile %q", path))
+	}
+	var profile interface{}
+	if err := json.Unmarshal(data, &profile); err != nil {
+		return "", util.NewAPIError(util.ErrBadRequest, errors.Wrapf(err, "invalid seccomp profile %q", path))
+	}
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, data); err != nil {
+		return "", util.NewAPIError(util.ErrBadRequest, errors.Wrapf(err, "invalid seccomp profile %q", path))
+	}
+
+	return buf.String(), nil
+}
+
+// knownCapabilities are the linux capabilities names (without the "CAP_"
+// prefix) plus the special "ALL" value
+var knownCapabilities = map[string]struct{}{
+	"ALL":                {},
+	"AUDIT_CONTROL":      {},
+	"AUDIT_READ":         {},
+	"AUDIT_WRITE":        {},
+	"BLOCK_SUSPEND":      {},
+	"BPF":                {},
+	"CHECKPOINT_RESTORE": {},
+	"CHOWN":              {},
+	"DAC_OVERRIDE":       {},
+	"DAC_READ_SEARCH":    {},
+	"FOWNER":             {},
+	"FSETID":             {},
+	"IPC_LOCK":           {},
+	"IPC_OWNER":          {},
+	"KILL":               {},
+	"LEASE":              {},
+	"LINUX_IMMUTABLE":    {},
+	"MAC_ADMIN":          {},
+	"MAC_OVERRIDE":       {},
+	"MKNOD":              {},
+	"NET_ADMIN":          {},
+	"NET_BIND_SERVICE":   {},
+	"NET_BROADCAST":      {},
+	"NET_RAW":            {},
+	"PERFMON":            {},
+	"SETFCAP":            {},
+	"SETGID":             {},
+	"SETPCAP":            {},
+	"SETUID":             {},
+	"SYSLOG":             {},
+	"SYS_ADMIN":          {},
+	"SYS_BOOT":           {},
+	"SYS_CHROOT":         {},
+	"SYS_MODULE":         {},
+	"SYS_NICE":           {},
+	"SYS_PACCT":          {},
+	"SYS_PTRACE":         {},
+	"SYS_RAWIO":          {},
+	"SYS_RESOURCE":       {},
+	"SYS_TIME":           {},
+	"SYS_TTY_CONFIG":     {},
+	"WAKE_ALARM":         {},
+}
+
+// normalizeCapability returns the upper case capability name without the
+// "CAP_" prefix
+func normalizeCapability(capability string) string {
+	return strings.TrimPrefix(strings.ToUpper(capability), "CAP_")
+}
+
+// parseExtraHost parses an extra host in the "name:ip" form
+func parseExtraHost(extraHost string) (string, string, error) {
+	// split only on the first colon since the ip could be an ipv6 address
+	parts := strings.SplitN(extraHost, ":", 2)
+	if len(parts) != 2 || parts[0] == "" || strings.ContainsAny(parts[0], " \t") {
+		return "", "", util.NewAPIError(util.ErrBadRequest, errors.Errorf("invalid extra host %q, must be in the name:ip form", extraHost))
+	}
+	if net.ParseIP(parts[1]) == nil {
+		return "", "", util.NewAPIError(util.ErrBadRequest, errors.Errorf("invalid extra host %q, %q isn't a valid ip address", extraHost, parts[1]))
+	}
+
+	return parts[0], parts[1], nil
+}
+
+// podExtraHosts returns the extra hosts of all the pod containers, including
+// their aliases mapped to the loopback address
+func podExtraHosts(podConfig *PodConfig) []string {
+	extraHosts := []string{}
+	for _, containerConfig := range podConfig.Containers {
+		extraHosts = append(extraHosts, containerConfig.ExtraHosts...)
+		for _, alias := range containerConfig.Aliases {
+			extraHosts = append(extraHosts, alias+":"+aliasIP)
+		}
+	}
+
+	return extraHosts
+}
+
+// podContainerName returns the name of the pod container at the provided
+// index.
+func podContainerName(index int, name string) string {
+	if index == 0 {
+		return mainContainerName
+	}
+	if name == "" {
+		return fmt.Sprintf("service%d", index)
+	}
+	return name
 }
 
 func toolboxExecPath(toolboxDir string, arch types.Arch) (string, error) {
@@ -126,3 +814,17 @@ func toolboxExecPath(toolboxDir string, arch types.Arch) (string, error) {
 	}
 	return toolboxPath, nil
 }
+
+// toolboxArchs returns the provided archs having a toolbox binary in the
+// toolbox dir. Tasks for the other archs cannot be executed.
+func toolboxArchs(toolboxDir string, archs []types.Arch) []types.Arch {
+	toolboxArchs := []types.Arch{}
+	for _, arch := range archs {
+		if _, err := toolboxExecPath(toolboxDir, arch); err != nil {
+			continue
+		}
+		toolboxArchs = append(toolboxArchs, arch)
+	}
+
+	return toolboxArchs
+}
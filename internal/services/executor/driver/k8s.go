@@ -20,7 +20,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
@@ -53,8 +52,6 @@ import (
 )
 
 const (
-	mainContainerName = "maincontainer"
-
 	configMapName       = "agola-executors-group"
 	executorLeasePrefix = "agola-executor-"
 	podNamePrefix       = "agola-task-"
@@ -73,7 +70,7 @@ const (
 type K8sDriver struct {
 	log              zerolog.Logger
 	restconfig       *restclient.Config
-	client           *kubernetes.Clientset
+	client           kubernetes.Interface
 	toolboxPath      string
 	initImage        string
 	initDockerConfig *registry.DockerConfig
@@ -94,7 +91,7 @@ type K8sPod struct {
 	labels    map[string]string
 
 	restconfig    *restclient.Config
-	client        *kubernetes.Clientset
+	client        kubernetes.Interface
 	initVolumeDir string
 }
 
@@ -269,7 +266,8 @@ func (d *K8sDriver) Archs(ctx context.Context) ([]types.Arch, error) {
 		archs = append(archs, arch)
 	}
 
-	return archs, nil
+	// only advertise the archs with a toolbox binary
+	return toolboxArchs(d.toolboxPath, archs), nil
 }
 
 func (d *K8sDriver) ExecutorGroup(ctx context.Context) (string, error) {
@@ -316,6 +314,67 @@ func (d *K8sDriver) NewPod(ctx context.Context, podConfig *PodConfig, out io.Wri
 	if len(podConfig.Containers) == 0 {
 		return nil, errors.Errorf("empty container config")
 	}
+	if err := validatePodConfig(podConfig); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if podConfig.DNS != nil {
+		return nil, util.NewAPIError(util.ErrBadRequest, errors.Errorf("pod dns config isn't supported by the k8s driver"))
+	}
+	if len(podExtraHosts(podConfig)) > 0 {
+		return nil, util.NewAPIError(util.ErrBadRequest, errors.Errorf("container extra hosts and aliases aren't supported by the k8s driver"))
+	}
+	if len(podConfig.ExternalNetworks) > 0 {
+		return nil, util.NewAPIError(util.ErrBadRequest, errors.Errorf("pod external networks aren't supported by the k8s driver"))
+	}
+	if len(podConfig.Secrets) > 0 {
+		return nil, util.NewAPIError(util.ErrBadRequest, errors.Errorf("pod secrets aren't supported by the k8s driver"))
+	}
+	for _, containerConfig := range podConfig.Containers {
+		if containerConfig.StopSignal != "" {
+			return nil, util.NewAPIError(util.ErrBadRequest, errors.Errorf("container stop signal isn't supported by the k8s driver"))
+		}
+		if len(containerConfig.CapAdd) > 0 || len(containerConfig.CapDrop) > 0 {
+			return nil, util.NewAPIError(util.ErrBadRequest, errors.Errorf("container capabilities aren't supported by the k8s driver"))
+		}
+		if containerConfig.ReadOnlyRootfs {
+			return nil, util.NewAPIError(util.ErrBadRequest, errors.Errorf("read only container root filesystem isn't supported by the k8s driver"))
+		}
+		if len(containerConfig.Ulimits) > 0 {
+			return nil, util.NewAPIError(util.ErrBadRequest, errors.Errorf("container ulimits aren't supported by the k8s driver"))
+		}
+		if containerConfig.ShmSizeBytes > 0 {
+			return nil, util.NewAPIError(util.ErrBadRequest, errors.Errorf("container shm size isn't supported by the k8s driver"))
+		}
+		if len(containerConfig.Sysctls) > 0 {
+			return nil, util.NewAPIError(util.ErrBadRequest, errors.Errorf("container sysctls aren't supported by the k8s driver"))
+		}
+		if containerConfig.SeccompProfilePath != "" {
+			return nil, util.NewAPIError(util.ErrBadRequest, errors.Errorf("container seccomp profile isn't supported by the k8s driver"))
+		}
+		if containerConfig.RestartPolicy != nil {
+			return nil, util.NewAPIError(util.ErrBadRequest, errors.Errorf("container restart policy isn't supported by the k8s driver"))
+		}
+		if containerConfig.Platform != "" {
+			return nil, util.NewAPIError(util.ErrBadRequest, errors.Errorf("container image platform isn't supported by the k8s driver"))
+		}
+		if containerConfig.Healthcheck != nil {
+			return nil, util.NewAPIError(util.ErrBadRequest, errors.Errorf("container healthcheck isn't supported by the k8s driver"))
+		}
+		if containerConfig.Requests.Memory > 0 || containerConfig.Requests.CPU > 0 {
+			return nil, util.NewAPIError(util.ErrBadRequest, errors.Errorf("container resource requests aren't supported by the k8s driver"))
+		}
+		if containerConfig.AppArmorProfile != "" {
+			return nil, util.NewAPIError(util.ErrBadRequest, errors.Errorf("container apparmor profile isn't supported by the k8s driver"))
+		}
+		for _, vol := range containerConfig.Volumes {
+			if vol.Bind != nil {
+				return nil, util.NewAPIError(util.ErrBadRequest, errors.Errorf("bind volumes aren't supported by the k8s driver"))
+			}
+			if vol.Persistent != nil {
+				return nil, util.NewAPIError(util.ErrBadRequest, errors.Errorf("persistent volumes aren't supported by the k8s driver"))
+			}
+		}
+	}
 
 	secretClient := d.client.CoreV1().Secrets(d.namespace)
 	podClient := d.client.CoreV1().Pods(d.namespace)
@@ -397,25 +456,19 @@ func (d *K8sDriver) NewPod(ctx context.Context, podConfig *PodConfig, out io.Wri
 
 	// define containers
 	for cIndex, containerConfig := range podConfig.Containers {
-		var containerName string
-		if cIndex == 0 {
-			containerName = mainContainerName
-		} else {
-			containerName = fmt.Sprintf("service%d", cIndex)
-		}
+		command, args := containerEntrypointCmd(containerConfig)
 		c := corev1.Container{
-			Name:       containerName,
+			Name:       podContainerName(cIndex, containerConfig.Name),
 			Image:      containerConfig.Image,
-			Command:    containerConfig.Cmd,
+			Command:    command,
+			Args:       args,
 			Env:        genEnvVars(containerConfig.Env),
 			Stdin:      true,
 			WorkingDir: containerConfig.WorkingDir,
 			// by default always try to pull the image so we are sure only authorized users can fetch them
 			// see https://kubernetes.io/docs/reference/access-authn-authz/admission-controllers/#alwayspullimages
 			ImagePullPolicy: corev1.PullAlways,
-			SecurityContext: &corev1.SecurityContext{
-				Privileged: &containerConfig.Privileged,
-			},
+			SecurityContext: containerSecurityContext(containerConfig),
 		}
 		if cIndex == 0 {
 			// main container requires the initvolume containing the toolbox
@@ -729,6 +782,44 @@ func (p *K8sPod) Remove(ctx context.Context) error {
 	return p.Stop(ctx)
 }
 
+// WaitReady waits for all the pod containers to be running. It returns an
+// error if a container terminated.
+func (p *K8sPod) WaitReady(ctx context.Context) error {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, defaultWaitReadyTimeout)
+		defer cancel()
+	}
+
+	podClient := p.client.CoreV1().Pods(p.namespace)
+	for {
+		pod, err := podClient.Get(ctx, p.id, metav1.GetOptions{})
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		ready := len(pod.Status.ContainerStatuses) == len(pod.Spec.Containers)
+		for _, containerStatus := range pod.Status.ContainerStatuses {
+			if containerStatus.State.Running != nil {
+				continue
+			}
+			if terminated := containerStatus.State.Terminated; terminated != nil {
+				return containerExitedError(containerStatus.Name, int(terminated.ExitCode))
+			}
+			ready = false
+		}
+		if ready {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return errors.WithStack(ctx.Err())
+		case <-time.After(podPollInterval):
+		}
+	}
+}
+
 type K8sContainerExec struct {
 	endCh chan error
 
@@ -745,12 +836,10 @@ func (p *K8sPod) Exec(ctx context.Context, execConfig *ExecConfig) (ContainerExe
 
 	// k8s pod exec api doesn't let us define the workingdir and the environment.
 	// Use a toolbox command that will set them up and then exec the real command.
-	envj, err := json.Marshal(execConfig.Env)
+	cmd, err := toolboxExecCmd(p.initVolumeDir, execConfig)
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
-	cmd := []string{filepath.Join(p.initVolumeDir, "agola-toolbox"), "exec", "-e", string(envj), "-w", execConfig.WorkingDir, "--"}
-	cmd = append(cmd, execConfig.Cmd...)
 
 	req := coreclient.RESTClient().
 		Post().
@@ -779,11 +868,13 @@ func (p *K8sPod) Exec(ctx context.Context, execConfig *ExecConfig) (ContainerExe
 		stdin = reader
 	}
 
+	stdout, stderr := execOutput(execConfig)
+
 	go func() {
 		err := exec.Stream(remotecommand.StreamOptions{
 			Stdin:  stdin,
-			Stdout: execConfig.Stdout,
-			Stderr: execConfig.Stderr,
+			Stdout: stdout,
+			Stderr: stderr,
 			Tty:    execConfig.Tty,
 		})
 		endCh <- err
@@ -815,6 +906,26 @@ func (e *K8sContainerExec) Stdin() io.WriteCloser {
 	return e.stdin
 }
 
+// containerSecurityContext returns the k8s container security context. Since
+// k8s doesn't resolve user and group names from the image, only a numeric uid
+// and gid of the container user are set as the container user and group. User
+// and group names are ignored.
+func containerSecurityContext(containerConfig *ContainerConfig) *corev1.SecurityContext {
+	securityContext := &corev1.SecurityContext{
+		Privileged: &containerConfig.Privileged,
+	}
+
+	uid, gid := splitContainerUser(containerConfig.User)
+	if v, err := strconv.ParseInt(uid, 10, 64); err == nil {
+		securityContext.RunAsUser = &v
+	}
+	if v, err := strconv.ParseInt(gid, 10, 64); err == nil {
+		securityContext.RunAsGroup = &v
+	}
+
+	return securityContext
+}
+
 func genEnvVars(env map[string]string) []corev1.EnvVar {
 	envVars := make([]corev1.EnvVar, 0, len(env))
 	for n, v := range env {
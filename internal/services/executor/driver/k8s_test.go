@@ -17,15 +17,25 @@ package driver
 import (
 	"bytes"
 	"context"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 
+	"agola.io/agola/internal/errors"
 	"agola.io/agola/internal/testutil"
+	"agola.io/agola/internal/util"
 
 	"github.com/gofrs/uuid"
+	"github.com/rs/zerolog"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
 )
 
 func TestK8sPod(t *testing.T) {
@@ -399,3 +409,349 @@ func TestParseGitVersion(t *testing.T) {
 		})
 	}
 }
+
+func TestK8sNewPodValidation(t *testing.T) {
+	tests := []struct {
+		name        string
+		podConfig   *PodConfig
+		expectedErr string
+	}{
+		{
+			name: "test container name not a dns label",
+			podConfig: &PodConfig{
+				Containers: []*ContainerConfig{{Image: "busybox"}, {Name: "My_DB", Image: "postgres"}},
+			},
+			expectedErr: `invalid container name "My_DB", must be a lowercase dns label of at most 63 characters`,
+		},
+		{
+			name: "test container name too long",
+			podConfig: &PodConfig{
+				Containers: []*ContainerConfig{{Image: "busybox"}, {Name: strings.Repeat("a", 64), Image: "postgres"}},
+			},
+			expectedErr: fmt.Sprintf("invalid container name %q, must be a lowercase dns label of at most 63 characters", strings.Repeat("a", 64)),
+		},
+		{
+			name: "test stop signal",
+			podConfig: &PodConfig{
+				Containers: []*ContainerConfig{{Image: "busybox", StopSignal: "SIGINT"}},
+			},
+			expectedErr: "container stop signal isn't supported by the k8s driver",
+		},
+		{
+			name: "test dns config",
+			podConfig: &PodConfig{
+				Containers: []*ContainerConfig{{Image: "busybox"}},
+				DNS:        &DNSConfig{Servers: []string{"10.0.0.53"}},
+			},
+			expectedErr: "pod dns config isn't supported by the k8s driver",
+		},
+		{
+			name: "test extra hosts",
+			podConfig: &PodConfig{
+				Containers: []*ContainerConfig{{Image: "busybox", ExtraHosts: []string{"db:10.0.0.1"}}},
+			},
+			expectedErr: "container extra hosts and aliases aren't supported by the k8s driver",
+		},
+		{
+			name: "test capabilities",
+			podConfig: &PodConfig{
+				Containers: []*ContainerConfig{{Image: "busybox", CapAdd: []string{"NET_ADMIN"}}},
+			},
+			expectedErr: "container capabilities aren't supported by the k8s driver",
+		},
+		{
+			name: "test read only root filesystem",
+			podConfig: &PodConfig{
+				Containers: []*ContainerConfig{{Image: "busybox", ReadOnlyRootfs: true}},
+			},
+			expectedErr: "read only container root filesystem isn't supported by the k8s driver",
+		},
+		{
+			name: "test ulimits",
+			podConfig: &PodConfig{
+				Containers: []*ContainerConfig{{Image: "busybox", Ulimits: []Ulimit{{Name: "nofile", Soft: 1024, Hard: 2048}}}},
+			},
+			expectedErr: "container ulimits aren't supported by the k8s driver",
+		},
+		{
+			name: "test shm size",
+			podConfig: &PodConfig{
+				Containers: []*ContainerConfig{{Image: "busybox", ShmSizeBytes: 128 << 20}},
+			},
+			expectedErr: "container shm size isn't supported by the k8s driver",
+		},
+		{
+			name: "test sysctls",
+			podConfig: &PodConfig{
+				Containers: []*ContainerConfig{{Image: "busybox", Sysctls: map[string]string{"net.core.somaxconn": "1024"}}},
+			},
+			expectedErr: "container sysctls aren't supported by the k8s driver",
+		},
+		{
+			name: "test seccomp profile",
+			podConfig: &PodConfig{
+				Containers: []*ContainerConfig{{Image: "busybox", SeccompProfilePath: "/etc/agola/seccomp.json"}},
+			},
+			expectedErr: "container seccomp profile isn't supported by the k8s driver",
+		},
+		{
+			name: "test apparmor profile",
+			podConfig: &PodConfig{
+				Containers: []*ContainerConfig{{Image: "busybox", AppArmorProfile: "agola-profile"}},
+			},
+			expectedErr: "container apparmor profile isn't supported by the k8s driver",
+		},
+		{
+			name: "test restart policy",
+			podConfig: &PodConfig{
+				Containers: []*ContainerConfig{{Image: "busybox"}, {Image: "postgres", RestartPolicy: &RestartPolicy{Name: RestartPolicyAlways}}},
+			},
+			expectedErr: "container restart policy isn't supported by the k8s driver",
+		},
+		{
+			name: "test image platform",
+			podConfig: &PodConfig{
+				Containers: []*ContainerConfig{{Image: "busybox", Platform: "linux/arm64"}},
+			},
+			expectedErr: "container image platform isn't supported by the k8s driver",
+		},
+		{
+			name: "test healthcheck",
+			podConfig: &PodConfig{
+				Containers: []*ContainerConfig{{Image: "busybox"}, {Image: "postgres", Healthcheck: &Healthcheck{Test: []string{"CMD", "pg_isready"}}}},
+			},
+			expectedErr: "container healthcheck isn't supported by the k8s driver",
+		},
+		{
+			name: "test resource requests",
+			podConfig: &PodConfig{
+				Containers: []*ContainerConfig{{Image: "busybox", Requests: ResourceRequests{Memory: 1 << 30, CPU: 500}}},
+			},
+			expectedErr: "container resource requests aren't supported by the k8s driver",
+		},
+		{
+			name: "test bind volume",
+			podConfig: &PodConfig{
+				Containers: []*ContainerConfig{{Image: "busybox", Volumes: []Volume{{Path: "/data", Bind: &VolumeBind{Source: "/srv/data"}}}}},
+			},
+			expectedErr: "bind volumes aren't supported by the k8s driver",
+		},
+		{
+			name: "test persistent volume",
+			podConfig: &PodConfig{
+				Containers: []*ContainerConfig{{Image: "busybox", Volumes: []Volume{{Path: "/cache", Persistent: &VolumePersistent{CacheKey: "cachekey01"}}}}},
+			},
+			expectedErr: "persistent volumes aren't supported by the k8s driver",
+		},
+		{
+			name: "test external networks",
+			podConfig: &PodConfig{
+				Containers:       []*ContainerConfig{{Image: "busybox"}},
+				ExternalNetworks: []string{"network01"},
+			},
+			expectedErr: "pod external networks aren't supported by the k8s driver",
+		},
+		{
+			name: "test secrets",
+			podConfig: &PodConfig{
+				Containers: []*ContainerConfig{{Image: "busybox"}},
+				Secrets:    map[string][]byte{"secret01": []byte("secretvalue01")},
+			},
+			expectedErr: "pod secrets aren't supported by the k8s driver",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := fake.NewSimpleClientset()
+			d := &K8sDriver{
+				log:        zerolog.Nop(),
+				client:     client,
+				namespace:  "agola",
+				executorID: "executorid01",
+			}
+			tt.podConfig.ID = "podid01"
+			tt.podConfig.TaskID = "taskid01"
+			tt.podConfig.InitVolumeDir = "/tmp/agola"
+
+			_, err := d.NewPod(context.Background(), tt.podConfig, ioutil.Discard)
+			if err == nil {
+				t.Fatalf("expected err %q, got nil err", tt.expectedErr)
+			}
+			if !util.APIErrorIs(err, util.ErrBadRequest) {
+				t.Fatalf("expected bad request error, got: %v", err)
+			}
+			if err.Error() != tt.expectedErr {
+				t.Fatalf("expected err %q, got err: %q", tt.expectedErr, err.Error())
+			}
+			// the pod config must be rejected before any k8s api call
+			if actions := client.Actions(); len(actions) != 0 {
+				t.Fatalf("expected no k8s api calls, got %d", len(actions))
+			}
+		})
+	}
+}
+
+func TestK8sNewPodUser(t *testing.T) {
+	int64P := func(v int64) *int64 { return &v }
+
+	tests := []struct {
+		name                     string
+		user                     string
+		expectedSecurityContexts []*corev1.SecurityContext
+	}{
+		{
+			name: "test no user",
+			expectedSecurityContexts: []*corev1.SecurityContext{
+				{Privileged: util.BoolP(false)},
+				{Privileged: util.BoolP(false)},
+			},
+		},
+		{
+			name: "test numeric uid and gid",
+			user: "1000:2000",
+			expectedSecurityContexts: []*corev1.SecurityContext{
+				{Privileged: util.BoolP(false), RunAsUser: int64P(1000), RunAsGroup: int64P(2000)},
+				{Privileged: util.BoolP(false)},
+			},
+		},
+		{
+			name: "test numeric uid",
+			user: "1000",
+			expectedSecurityContexts: []*corev1.SecurityContext{
+				{Privileged: util.BoolP(false), RunAsUser: int64P(1000)},
+				{Privileged: util.BoolP(false)},
+			},
+		},
+		{
+			name: "test user name is ignored",
+			user: "postgres",
+			expectedSecurityContexts: []*corev1.SecurityContext{
+				{Privileged: util.BoolP(false)},
+				{Privileged: util.BoolP(false)},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := fake.NewSimpleClientset()
+			// capture the created pod and stop NewPod since the fake client
+			// pods never become ready
+			var createdPod *corev1.Pod
+			client.PrependReactor("create", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+				createdPod = action.(k8stesting.CreateAction).GetObject().(*corev1.Pod)
+				return true, nil, errors.Errorf("pod creation stopped")
+			})
+			d := &K8sDriver{
+				log:        zerolog.Nop(),
+				client:     client,
+				namespace:  "agola",
+				executorID: "executorid01",
+			}
+			podConfig := &PodConfig{
+				ID:            "podid01",
+				TaskID:        "taskid01",
+				InitVolumeDir: "/tmp/agola",
+				Containers: []*ContainerConfig{
+					{Image: "busybox", User: tt.user},
+					{Image: "postgres", Name: "service1"},
+				},
+			}
+
+			if _, err := d.NewPod(context.Background(), podConfig, ioutil.Discard); err == nil {
+				t.Fatalf("expected err, got nil err")
+			}
+			if createdPod == nil {
+				t.Fatalf("expected pod to be created")
+			}
+			securityContexts := []*corev1.SecurityContext{}
+			for _, c := range createdPod.Spec.Containers {
+				securityContexts = append(securityContexts, c.SecurityContext)
+			}
+			if !reflect.DeepEqual(securityContexts, tt.expectedSecurityContexts) {
+				t.Fatalf("expected security contexts %s, got %s", util.Dump(tt.expectedSecurityContexts), util.Dump(securityContexts))
+			}
+		})
+	}
+}
+
+func TestK8sPodWaitReady(t *testing.T) {
+	running := corev1.ContainerState{Running: &corev1.ContainerStateRunning{}}
+	waiting := corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: "ContainerCreating"}}
+	terminated := func(exitCode int32) corev1.ContainerState {
+		return corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{ExitCode: exitCode}}
+	}
+
+	tests := []struct {
+		name        string
+		states      []corev1.ContainerState
+		timeout     time.Duration
+		expectedErr string
+	}{
+		{
+			name:    "test all containers running",
+			states:  []corev1.ContainerState{running, running},
+			timeout: 5 * time.Second,
+		},
+		{
+			name:        "test container terminated with error",
+			states:      []corev1.ContainerState{running, terminated(2)},
+			timeout:     5 * time.Second,
+			expectedErr: `container "service1" exited with code 2`,
+		},
+		{
+			name:        "test container terminated without error",
+			states:      []corev1.ContainerState{running, terminated(0)},
+			timeout:     5 * time.Second,
+			expectedErr: `container "service1" exited with code 0`,
+		},
+		{
+			name:        "test container not running before deadline",
+			states:      []corev1.ContainerState{running, waiting},
+			timeout:     time.Second,
+			expectedErr: context.DeadlineExceeded.Error(),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			names := []string{mainContainerName, "service1"}
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Name: "podid01", Namespace: "agola"},
+			}
+			for i, state := range tt.states {
+				pod.Spec.Containers = append(pod.Spec.Containers, corev1.Container{Name: names[i]})
+				pod.Status.ContainerStatuses = append(pod.Status.ContainerStatuses, corev1.ContainerStatus{Name: names[i], State: state})
+			}
+
+			p := &K8sPod{
+				id:        "podid01",
+				namespace: "agola",
+				client:    fake.NewSimpleClientset(pod),
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), tt.timeout)
+			defer cancel()
+
+			err := p.WaitReady(ctx)
+			if tt.expectedErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected err: %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("expected err %q, got nil err", tt.expectedErr)
+			}
+			if err.Error() != tt.expectedErr {
+				t.Fatalf("expected err %q, got err: %q", tt.expectedErr, err.Error())
+			}
+			if strings.Contains(tt.expectedErr, "exited") {
+				if derr, ok := util.AsAPIError(err); !ok || derr.Kind != util.ErrInternal || derr.Code != ErrorCodeContainerExited {
+					t.Fatalf("expected internal api error with code %q, got: %v", ErrorCodeContainerExited, err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	spanAttrPodID          = attribute.Key("agola.pod.id")
+	spanAttrTaskID         = attribute.Key("agola.task.id")
+	spanAttrImage          = attribute.Key("agola.image")
+	spanAttrPlatform       = attribute.Key("agola.platform")
+	spanAttrContainerIndex = attribute.Key("agola.container.index")
+	spanAttrDurationMs     = attribute.Key("agola.duration_ms")
+)
+
+// driverSpan wraps a span recording the operation duration and error when
+// ended
+type driverSpan struct {
+	span  trace.Span
+	start time.Time
+}
+
+// startSpan starts a span with the provided tracer. A no-op tracer is used when
+// tracer is nil. The returned context carries the span so the spans started
+// from it are its children.
+func startSpan(ctx context.Context, tracer trace.Tracer, spanName string, attrs ...attribute.KeyValue) (context.Context, *driverSpan) {
+	if tracer == nil {
+		tracer = trace.NewNoopTracerProvider().Tracer("")
+	}
+	ctx, span := tracer.Start(ctx, spanName, trace.WithAttributes(attrs...))
+
+	return ctx, &driverSpan{span: span, start: time.Now()}
+}
+
+func (s *driverSpan) end(err error) {
+	s.span.SetAttributes(spanAttrDurationMs.Int64(int64(time.Since(s.start) / time.Millisecond)))
+	if err != nil {
+		s.span.RecordError(err)
+		s.span.SetStatus(codes.Error, err.Error())
+	}
+	s.span.End()
+}
@@ -0,0 +1,148 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"agola.io/agola/internal/errors"
+
+	"github.com/rs/zerolog"
+)
+
+const (
+	warmPoolRefillInterval = 10 * time.Second
+)
+
+// warmPool keeps a number of idle pre-created resources, identified by their
+// id, ready to be acquired. Acquired resources can be released back to the
+// pool: they are reset before being reused and discarded if the reset fails.
+type warmPool struct {
+	log  zerolog.Logger
+	size int
+
+	create func(ctx context.Context) (string, error)
+	reset  func(ctx context.Context, id string) error
+	remove func(ctx context.Context, id string) error
+
+	mu   sync.Mutex
+	idle []string
+
+	refillCh chan struct{}
+}
+
+func newWarmPool(log zerolog.Logger, size int, create func(ctx context.Context) (string, error), reset func(ctx context.Context, id string) error, remove func(ctx context.Context, id string) error) *warmPool {
+	return &warmPool{
+		log:      log,
+		size:     size,
+		create:   create,
+		reset:    reset,
+		remove:   remove,
+		refillCh: make(chan struct{}, 1),
+	}
+}
+
+// acquire returns an idle resource. It returns false if the pool is empty. The
+// pool refill is triggered in background.
+func (p *warmPool) acquire() (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	defer p.triggerRefill()
+
+	if len(p.idle) == 0 {
+		return "", false
+	}
+	id := p.idle[0]
+	p.idle = p.idle[1:]
+
+	return id, true
+}
+
+// release resets the resource and returns it to the pool. The resource is
+// removed if the pool is full or the reset fails.
+func (p *warmPool) release(ctx context.Context, id string) error {
+	p.mu.Lock()
+	full := len(p.idle) >= p.size
+	p.mu.Unlock()
+
+	if !full {
+		if err := p.reset(ctx, id); err != nil {
+			p.log.Warn().Err(err).Msgf("failed to reset warm pool resource %q, discarding it", id)
+		} else {
+			p.mu.Lock()
+			if len(p.idle) < p.size {
+				p.idle = append(p.idle, id)
+				p.mu.Unlock()
+				return nil
+			}
+			p.mu.Unlock()
+		}
+	}
+
+	return errors.WithStack(p.remove(ctx, id))
+}
+
+// refill creates new resources until the pool is full.
+func (p *warmPool) refill(ctx context.Context) error {
+	for {
+		p.mu.Lock()
+		missing := p.size - len(p.idle)
+		p.mu.Unlock()
+		if missing <= 0 {
+			return nil
+		}
+
+		id, err := p.create(ctx)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		p.mu.Lock()
+		// the pool could have been filled by released resources in the meantime
+		if len(p.idle) >= p.size {
+			p.mu.Unlock()
+			return errors.WithStack(p.remove(ctx, id))
+		}
+		p.idle = append(p.idle, id)
+		p.mu.Unlock()
+	}
+}
+
+func (p *warmPool) triggerRefill() {
+	select {
+	case p.refillCh <- struct{}{}:
+	default:
+	}
+}
+
+// run refills the pool at start, when a resource is acquired and periodically
+// (to retry failed refills) until ctx is done.
+func (p *warmPool) run(ctx context.Context) {
+	for {
+		if err := p.refill(ctx); err != nil {
+			p.log.Warn().Err(err).Msgf("failed to refill warm pool")
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-p.refillCh:
+		case <-time.After(warmPoolRefillInterval):
+		}
+	}
+}
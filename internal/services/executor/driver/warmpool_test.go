@@ -0,0 +1,189 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"agola.io/agola/internal/errors"
+	"agola.io/agola/internal/testutil"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+type fakeWarmPoolResources struct {
+	mu        sync.Mutex
+	count     int
+	reset     []string
+	removed   []string
+	failReset map[string]bool
+}
+
+func (r *fakeWarmPoolResources) create(ctx context.Context) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.count++
+	return fmt.Sprintf("resource%02d", r.count), nil
+}
+
+func (r *fakeWarmPoolResources) resetResource(ctx context.Context, id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.failReset[id] {
+		return errors.Errorf("reset failed")
+	}
+	r.reset = append(r.reset, id)
+	return nil
+}
+
+func (r *fakeWarmPoolResources) remove(ctx context.Context, id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.removed = append(r.removed, id)
+	return nil
+}
+
+func newFakeWarmPool(t *testing.T, size int, r *fakeWarmPoolResources) *warmPool {
+	return newWarmPool(testutil.NewLogger(t), size, r.create, r.resetResource, r.remove)
+}
+
+func TestWarmPoolAcquire(t *testing.T) {
+	ctx := context.Background()
+	r := &fakeWarmPoolResources{}
+	p := newFakeWarmPool(t, 2, r)
+
+	if _, ok := p.acquire(); ok {
+		t.Fatalf("expected empty pool")
+	}
+
+	if err := p.refill(ctx); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	acquired := []string{}
+	for i := 0; i < 2; i++ {
+		id, ok := p.acquire()
+		if !ok {
+			t.Fatalf("expected resource from pool")
+		}
+		acquired = append(acquired, id)
+	}
+	if diff := cmp.Diff([]string{"resource01", "resource02"}, acquired); diff != "" {
+		t.Fatalf("unexpected acquired resources: %s", diff)
+	}
+
+	if _, ok := p.acquire(); ok {
+		t.Fatalf("expected empty pool")
+	}
+}
+
+func TestWarmPoolRelease(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("test reset on release", func(t *testing.T) {
+		r := &fakeWarmPoolResources{}
+		p := newFakeWarmPool(t, 1, r)
+
+		if err := p.release(ctx, "used01"); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if diff := cmp.Diff([]string{"used01"}, r.reset); diff != "" {
+			t.Fatalf("unexpected reset resources: %s", diff)
+		}
+
+		id, ok := p.acquire()
+		if !ok {
+			t.Fatalf("expected resource from pool")
+		}
+		if id != "used01" {
+			t.Fatalf("expected released resource %q, got %q", "used01", id)
+		}
+	})
+
+	t.Run("test resource discarded when reset fails", func(t *testing.T) {
+		r := &fakeWarmPoolResources{failReset: map[string]bool{"used01": true}}
+		p := newFakeWarmPool(t, 1, r)
+
+		if err := p.release(ctx, "used01"); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if diff := cmp.Diff([]string{"used01"}, r.removed); diff != "" {
+			t.Fatalf("unexpected removed resources: %s", diff)
+		}
+		if _, ok := p.acquire(); ok {
+			t.Fatalf("expected empty pool")
+		}
+	})
+
+	t.Run("test resource removed when pool is full", func(t *testing.T) {
+		r := &fakeWarmPoolResources{}
+		p := newFakeWarmPool(t, 1, r)
+
+		if err := p.refill(ctx); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if err := p.release(ctx, "used01"); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if len(r.reset) != 0 {
+			t.Fatalf("unexpected reset resources: %v", r.reset)
+		}
+		if diff := cmp.Diff([]string{"used01"}, r.removed); diff != "" {
+			t.Fatalf("unexpected removed resources: %s", diff)
+		}
+	})
+}
+
+func TestWarmPoolRefill(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	r := &fakeWarmPoolResources{}
+	p := newFakeWarmPool(t, 2, r)
+
+	go p.run(ctx)
+
+	waitPoolSize := func(size int) {
+		for i := 0; i < 50; i++ {
+			p.mu.Lock()
+			n := len(p.idle)
+			p.mu.Unlock()
+			if n == size {
+				return
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		t.Fatalf("timeout waiting for pool size %d", size)
+	}
+
+	waitPoolSize(2)
+
+	if _, ok := p.acquire(); !ok {
+		t.Fatalf("expected resource from pool")
+	}
+
+	// acquiring triggers a refill
+	waitPoolSize(2)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.count != 3 {
+		t.Fatalf("expected 3 created resources, got %d", r.count)
+	}
+}
@@ -167,14 +167,15 @@ func (e *Executor) doRunStep(ctx context.Context, s *types.RunStep, t *types.Exe
 	}
 
 	execConfig := &driver.ExecConfig{
-		Cmd:         cmd,
-		Env:         environment,
-		WorkingDir:  workingDir,
-		User:        stepUser(t),
-		AttachStdin: true,
-		Stdout:      outf,
-		Stderr:      outf,
-		Tty:         *s.Tty,
+		Cmd:            cmd,
+		Env:            environment,
+		WorkingDir:     workingDir,
+		User:           stepUser(t),
+		AttachStdin:    true,
+		Stdout:         outf,
+		Stderr:         outf,
+		Tty:            *s.Tty,
+		MaxOutputBytes: e.c.MaxExecOutputBytes,
 	}
 
 	ce, err := pod.Exec(ctx, execConfig)
@@ -309,12 +310,13 @@ func (e *Executor) mkdir(ctx context.Context, t *types.ExecutorTask, pod driver.
 	cmd := append([]string{toolboxContainerPath, "mkdir"}, args...)
 
 	execConfig := &driver.ExecConfig{
-		Cmd:         cmd,
-		Env:         t.Spec.Environment,
-		User:        stepUser(t),
-		AttachStdin: true,
-		Stdout:      logf,
-		Stderr:      logf,
+		Cmd:            cmd,
+		Env:            t.Spec.Environment,
+		User:           stepUser(t),
+		AttachStdin:    true,
+		Stdout:         logf,
+		Stderr:         logf,
+		MaxOutputBytes: e.c.MaxExecOutputBytes,
 	}
 
 	ce, err := pod.Exec(ctx, execConfig)
@@ -394,13 +396,14 @@ func (e *Executor) unarchive(ctx context.Context, t *types.ExecutorTask, source
 	}
 
 	execConfig := &driver.ExecConfig{
-		Cmd:         cmd,
-		Env:         t.Spec.Environment,
-		WorkingDir:  workingDir,
-		User:        stepUser(t),
-		AttachStdin: true,
-		Stdout:      logf,
-		Stderr:      logf,
+		Cmd:            cmd,
+		Env:            t.Spec.Environment,
+		WorkingDir:     workingDir,
+		User:           stepUser(t),
+		AttachStdin:    true,
+		Stdout:         logf,
+		Stderr:         logf,
+		MaxOutputBytes: e.c.MaxExecOutputBytes,
 	}
 
 	ce, err := pod.Exec(ctx, execConfig)
@@ -874,22 +877,27 @@ func (e *Executor) setupTask(ctx context.Context, rt *runningTask) error {
 		Containers:    make([]*driver.ContainerConfig, len(et.Spec.Containers)),
 	}
 	for i, c := range et.Spec.Containers {
-		var cmd []string
+		var entrypoint []string
 		if i == 0 {
-			cmd = []string{toolboxContainerPath, "sleeper"}
+			entrypoint = []string{toolboxContainerPath, "sleeper"}
 		}
 		if c.Entrypoint != "" {
-			cmd = strings.Split(c.Entrypoint, " ")
+			entrypoint = strings.Split(c.Entrypoint, " ")
 		}
 
 		containerConfig := &driver.ContainerConfig{
 			Image:      c.Image,
-			Cmd:        cmd,
+			Entrypoint: entrypoint,
 			Env:        c.Environment,
-			User:       c.User,
 			Privileged: c.Privileged,
 			Volumes:    make([]driver.Volume, len(c.Volumes)),
 		}
+		// the steps are always executed as the container user, the container
+		// itself runs as it only when enabled since existing run configs could
+		// set a user not able to run the container image
+		if e.c.RunContainersAsUser {
+			containerConfig.User = c.User
+		}
 
 		for vIndex, cVol := range c.Volumes {
 			containerConfig.Volumes[vIndex] = driver.Volume{
@@ -1479,7 +1487,7 @@ func NewExecutor(ctx context.Context, log zerolog.Logger, c *config.Executor) (*
 	var d driver.Driver
 	switch c.Driver.Type {
 	case config.DriverTypeDocker:
-		d, err = driver.NewDockerDriver(log, e.id, e.c.ToolboxPath, e.c.InitImage.Image, initDockerConfig)
+		d, err = driver.NewDockerDriver(log, e.id, e.c.ToolboxPath, e.c.InitImage.Image, initDockerConfig, dockerDriverOptions(log, &c.Driver)...)
 		if err != nil {
 			return nil, errors.Wrapf(err, "failed to create docker driver")
 		}
@@ -1497,6 +1505,63 @@ func NewExecutor(ctx context.Context, log zerolog.Logger, c *config.Executor) (*
 	return e, nil
 }
 
+// dockerDriverOptions returns the docker driver options from the executor
+// driver config. The options not set keep the driver defaults.
+func dockerDriverOptions(log zerolog.Logger, c *config.Driver) []driver.DockerDriverOption {
+	opts := []driver.DockerDriverOption{
+		driver.WithDockerDriverMaxConcurrentPulls(c.MaxConcurrentPulls),
+		driver.WithDockerDriverRegistryMirrors(c.RegistryMirrors),
+		driver.WithDockerDriverWaitHealthy(c.WaitHealthyTimeout),
+		driver.WithDockerDriverServiceSettlePeriod(c.ServiceSettlePeriod),
+		driver.WithDockerDriverPodStartTimeout(c.PodStartTimeout),
+		driver.WithDockerDriverResourceTTL(c.ResourceTTL),
+		driver.WithDockerDriverExtraLabels(c.ExtraLabels),
+		driver.WithDockerDriverPruneOnStartup(c.PruneOnStartup),
+		driver.WithDockerDriverTmpfsNoExec(!c.TmpfsAllowExec),
+		driver.WithDockerDriverAllowedBindSources(c.AllowedBindSources),
+		driver.WithDockerDriverCapacity(c.CapacityMemory, c.CapacityCPU),
+		driver.WithDockerDriverToolboxVolumePoolSize(c.ToolboxVolumePoolSize),
+		driver.WithDockerDriverImagePullMetricsHook(func(m driver.ImagePullMetrics) {
+			log.Debug().Msgf("fetched image %q (platform: %q, cache hit: %t, downloaded bytes: %d) in %s", m.Image, m.Platform, m.CacheHit, m.BytesDownloaded, m.Duration)
+		}),
+	}
+	if c.Host != "" {
+		opts = append(opts, driver.WithDockerDriverHost(c.Host))
+	}
+	if c.APIVersion != "" {
+		opts = append(opts, driver.WithDockerDriverAPIVersion(c.APIVersion))
+	}
+	if c.TLSCertFile != "" || c.TLSKeyFile != "" || c.TLSCAFile != "" {
+		opts = append(opts, driver.WithDockerDriverTLS(c.TLSCertFile, c.TLSKeyFile, c.TLSCAFile))
+	}
+	if c.StopTimeout > 0 {
+		opts = append(opts, driver.WithDockerDriverStopTimeout(c.StopTimeout))
+	}
+	if c.StopOrder != "" {
+		opts = append(opts, driver.WithDockerDriverStopOrder(driver.StopOrder(c.StopOrder)))
+	}
+	if c.OrphanedVolumesGracePeriod > 0 {
+		opts = append(opts, driver.WithDockerDriverOrphanedVolumesGracePeriod(c.OrphanedVolumesGracePeriod))
+	}
+	if len(c.DefaultUlimits) > 0 {
+		ulimits := make([]driver.Ulimit, len(c.DefaultUlimits))
+		for i, u := range c.DefaultUlimits {
+			ulimits[i] = driver.Ulimit{Name: u.Name, Soft: u.Soft, Hard: u.Hard}
+		}
+		opts = append(opts, driver.WithDockerDriverDefaultUlimits(ulimits))
+	}
+	if len(c.WarmPool.Images) > 0 {
+		opts = append(opts, driver.WithDockerDriverWarmPool(driver.WarmPoolConfig{
+			Images:        c.WarmPool.Images,
+			Size:          c.WarmPool.Size,
+			InitVolumeDir: toolboxContainerDir,
+			ProjectDir:    c.WarmPool.ProjectDir,
+		}))
+	}
+
+	return opts
+}
+
 func (e *Executor) Run(ctx context.Context) error {
 	if err := e.driver.Setup(ctx); err != nil {
 		return errors.WithStack(err)
@@ -106,6 +106,36 @@ func GetRegistry(image string) (string, error) {
 	return regName, nil
 }
 
+// dockerHubRegistries are the names used to reference the docker hub registry
+var dockerHubRegistries = []string{"docker.io", "index.docker.io", "registry-1.docker.io"}
+
+// NormalizeRegistry returns the canonical name of the provided registry. All
+// the docker hub registry names are normalized to the name returned by
+// GetRegistry for docker hub images.
+func NormalizeRegistry(regName string) string {
+	for _, dockerHubRegistry := range dockerHubRegistries {
+		if regName == dockerHubRegistry {
+			return name.DefaultRegistry
+		}
+	}
+	return regName
+}
+
+// ReplaceRegistry returns the provided image reference with its registry
+// replaced by the provided registry host. Implicit docker hub namespaces are
+// made explicit (i.e. "busybox:latest" becomes "host/library/busybox:latest").
+func ReplaceRegistry(image, regHost string) (string, error) {
+	ref, err := name.ParseReference(image, name.WeakValidation)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	repo := regHost + "/" + ref.Context().RepositoryStr()
+	if _, ok := ref.(name.Digest); ok {
+		return repo + "@" + ref.Identifier(), nil
+	}
+	return repo + ":" + ref.Identifier(), nil
+}
+
 // ResolveAuth resolves the auth username and password for the provided registry name
 func ResolveAuth(auths map[string]DockerRegistryAuth, regname string) (string, string, error) {
 	if auths != nil {
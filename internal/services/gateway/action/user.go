@@ -103,6 +103,10 @@ type GetUsersRequest struct {
 	Start string
 	Limit int
 	Asc   bool
+
+	// RemoteSourceRef, when set, filters the users with a linked account on
+	// the remote source
+	RemoteSourceRef string
 }
 
 func (h *ActionHandler) GetUsers(ctx context.Context, req *GetUsersRequest) ([]*PrivateUserResponse, error) {
@@ -110,7 +114,13 @@ func (h *ActionHandler) GetUsers(ctx context.Context, req *GetUsersRequest) ([]*
 		return nil, util.NewAPIError(util.ErrUnauthorized, errors.Errorf("user not admin"))
 	}
 
-	csusers, _, err := h.configstoreClient.GetUsers(ctx, req.Start, req.Limit, req.Asc)
+	var csusers []*cstypes.User
+	var err error
+	if req.RemoteSourceRef != "" {
+		csusers, _, err = h.configstoreClient.GetRemoteSourceUsers(ctx, req.RemoteSourceRef, req.Start, req.Limit, req.Asc)
+	} else {
+		csusers, _, err = h.configstoreClient.GetUsers(ctx, req.Start, req.Limit, req.Asc)
+	}
 	if err != nil {
 		return nil, util.NewAPIError(util.KindFromRemoteError(err), err)
 	}
@@ -166,26 +176,30 @@ func (h *ActionHandler) CreateUser(ctx context.Context, req *CreateUserRequest)
 type CreateUserTokenRequest struct {
 	UserRef   string
 	TokenName string
+	// ExpiresAt is the optional token expiration time
+	ExpiresAt *time.Time
+	// Scopes are the optional token scopes
+	Scopes []string
 }
 
-func (h *ActionHandler) CreateUserToken(ctx context.Context, req *CreateUserTokenRequest) (string, error) {
+func (h *ActionHandler) CreateUserToken(ctx context.Context, req *CreateUserTokenRequest) (*csapitypes.CreateUserTokenResponse, error) {
 	isAdmin := common.IsUserAdmin(ctx)
 	userID := common.CurrentUserID(ctx)
 
 	userRef := req.UserRef
 	user, _, err := h.configstoreClient.GetUser(ctx, userRef)
 	if err != nil {
-		return "", util.NewAPIError(util.KindFromRemoteError(err), errors.Wrapf(err, "failed to get user"))
+		return nil, util.NewAPIError(util.KindFromRemoteError(err), errors.Wrapf(err, "failed to get user"))
 	}
 
 	// only admin or the same logged user can create a token
 	if !isAdmin && user.ID != userID {
-		return "", util.NewAPIError(util.ErrBadRequest, errors.Errorf("logged in user cannot create token for another user"))
+		return nil, util.NewAPIError(util.ErrBadRequest, errors.Errorf("logged in user cannot create token for another user"))
 	}
 
 	tokens, _, err := h.configstoreClient.GetUserTokens(ctx, user.ID)
 	if err != nil {
-		return "", util.NewAPIError(util.KindFromRemoteError(err), errors.Wrapf(err, "failed to get user %q tokens", user.ID))
+		return nil, util.NewAPIError(util.KindFromRemoteError(err), errors.Wrapf(err, "failed to get user %q tokens", user.ID))
 	}
 
 	var token *cstypes.UserToken
@@ -196,20 +210,22 @@ func (h *ActionHandler) CreateUserToken(ctx context.Context, req *CreateUserToke
 		}
 	}
 	if token != nil {
-		return "", util.NewAPIError(util.ErrBadRequest, errors.Errorf("user %q already have a token with name %q", userRef, req.TokenName))
+		return nil, util.NewAPIError(util.ErrConflict, errors.Errorf("user %q already have a token with name %q", userRef, req.TokenName))
 	}
 
 	h.log.Info().Msgf("creating user token")
 	creq := &csapitypes.CreateUserTokenRequest{
 		TokenName: req.TokenName,
+		ExpiresAt: req.ExpiresAt,
+		Scopes:    req.Scopes,
 	}
 	res, _, err := h.configstoreClient.CreateUserToken(ctx, userRef, creq)
 	if err != nil {
-		return "", util.NewAPIError(util.KindFromRemoteError(err), errors.Wrapf(err, "failed to create user token"))
+		return nil, util.NewAPIError(util.KindFromRemoteError(err), errors.Wrapf(err, "failed to create user token"))
 	}
 	h.log.Info().Msgf("token %q for user %q created", req.TokenName, userRef)
 
-	return res.Token, nil
+	return res, nil
 }
 
 type CreateUserLARequest struct {
@@ -241,7 +257,7 @@ func (h *ActionHandler) CreateUserLA(ctx context.Context, req *CreateUserLAReque
 		}
 	}
 	if la != nil {
-		return nil, util.NewAPIError(util.ErrBadRequest, errors.Errorf("user %q already have a linked account for remote source %q", userRef, rs.Name))
+		return nil, util.NewAPIError(util.ErrConflict, errors.Errorf("user %q already have a linked account for remote source %q", userRef, rs.Name))
 	}
 
 	accessToken, err := scommon.GetAccessToken(rs, req.UserAccessToken, req.Oauth2AccessToken)
@@ -281,42 +297,6 @@ func (h *ActionHandler) CreateUserLA(ctx context.Context, req *CreateUserLAReque
 	return la, nil
 }
 
-func (h *ActionHandler) UpdateUserLA(ctx context.Context, userRef string, la *cstypes.LinkedAccount) error {
-	linkedAccounts, _, err := h.configstoreClient.GetUserLinkedAccounts(ctx, userRef)
-	if err != nil {
-		return util.NewAPIError(util.KindFromRemoteError(err), errors.Wrapf(err, "failed to get user %q linked accounts", userRef))
-	}
-
-	laFound := false
-	for _, ula := range linkedAccounts {
-		if ula.ID == la.ID {
-			laFound = true
-			break
-		}
-	}
-	if !laFound {
-		return util.NewAPIError(util.ErrBadRequest, errors.Errorf("user %q doesn't have a linked account with id %q", userRef, la.ID))
-	}
-
-	creq := &csapitypes.UpdateUserLARequest{
-		RemoteUserID:               la.RemoteUserID,
-		RemoteUserName:             la.RemoteUserName,
-		UserAccessToken:            la.UserAccessToken,
-		Oauth2AccessToken:          la.Oauth2AccessToken,
-		Oauth2RefreshToken:         la.Oauth2RefreshToken,
-		Oauth2AccessTokenExpiresAt: la.Oauth2AccessTokenExpiresAt,
-	}
-
-	h.log.Info().Msgf("updating user %q linked account", userRef)
-	la, _, err = h.configstoreClient.UpdateUserLA(ctx, userRef, la.ID, creq)
-	if err != nil {
-		return util.NewAPIError(util.KindFromRemoteError(err), errors.Wrapf(err, "failed to update user"))
-	}
-	h.log.Info().Msgf("linked account %q for user %q updated", la.ID, userRef)
-
-	return nil
-}
-
 // RefreshLinkedAccount refreshed the linked account oauth2 access token and update linked account in the configstore
 func (h *ActionHandler) RefreshLinkedAccount(ctx context.Context, rs *cstypes.RemoteSource, userName string, la *cstypes.LinkedAccount) (*cstypes.LinkedAccount, error) {
 	switch rs.AuthType {
@@ -333,12 +313,14 @@ func (h *ActionHandler) RefreshLinkedAccount(ctx context.Context, rs *cstypes.Re
 			}
 
 			if la.Oauth2AccessToken != token.AccessToken {
-				la.Oauth2AccessToken = token.AccessToken
-				la.Oauth2RefreshToken = token.RefreshToken
-				la.Oauth2AccessTokenExpiresAt = token.Expiry
-
-				if err := h.UpdateUserLA(ctx, userName, la); err != nil {
-					return nil, errors.Wrapf(err, "failed to update linked account")
+				creq := &csapitypes.RefreshUserLAOauth2TokenRequest{
+					Oauth2AccessToken:          token.AccessToken,
+					Oauth2RefreshToken:         token.RefreshToken,
+					Oauth2AccessTokenExpiresAt: token.Expiry,
+				}
+				la, _, err = h.configstoreClient.RefreshUserLAOauth2Token(ctx, userName, la.ID, creq)
+				if err != nil {
+					return nil, util.NewAPIError(util.KindFromRemoteError(err), errors.Wrapf(err, "failed to update linked account"))
 				}
 			}
 		}
@@ -465,6 +447,9 @@ func (h *ActionHandler) LoginUser(ctx context.Context, req *LoginUserRequest) (*
 	if err != nil {
 		return nil, util.NewAPIError(util.KindFromRemoteError(err), errors.Wrapf(err, "failed to get user for remote user id %q and remote source %q", remoteUserInfo.ID, rs.ID))
 	}
+	if user.Disabled {
+		return nil, util.NewAPIError(util.ErrUnauthorized, errors.Errorf("user %q is disabled", user.Name))
+	}
 
 	linkedAccounts, _, err := h.configstoreClient.GetUserLinkedAccounts(ctx, user.ID)
 	if err != nil {
@@ -508,6 +493,11 @@ func (h *ActionHandler) LoginUser(ctx context.Context, req *LoginUserRequest) (*
 		h.log.Info().Msgf("linked account %q for user %q updated", la.ID, user.Name)
 	}
 
+	// record the linked account use, used to find the inactive users
+	if _, err := h.configstoreClient.MarkUserLAUsed(ctx, user.Name, la.ID); err != nil {
+		return nil, util.NewAPIError(util.KindFromRemoteError(err), errors.Wrapf(err, "failed to record user %q linked account use", user.Name))
+	}
+
 	// generate jwt token
 	token, err := scommon.GenerateLoginJWTToken(h.sd, user.ID)
 	if err != nil {
@@ -602,7 +592,7 @@ func (h *ActionHandler) HandleRemoteSourceAuth(ctx context.Context, remoteSource
 			}
 		}
 		if la != nil {
-			return nil, util.NewAPIError(util.ErrBadRequest, errors.Errorf("user %q already have a linked account for remote source %q", req.UserRef, rs.Name))
+			return nil, util.NewAPIError(util.ErrConflict, errors.Errorf("user %q already have a linked account for remote source %q", req.UserRef, rs.Name))
 		}
 
 	case RemoteSourceRequestTypeLoginUser:
@@ -236,9 +236,10 @@ func (h *UsersHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		ausers = []*action.PrivateUserResponse{user}
 	case "":
 		areq := &action.GetUsersRequest{
-			Start: start,
-			Limit: limit,
-			Asc:   asc,
+			Start:           start,
+			Limit:           limit,
+			Asc:             asc,
+			RemoteSourceRef: query.Get("remotesource"),
 		}
 		ausers, err = h.ah.GetUsers(ctx, areq)
 		if util.HTTPError(w, err) {
@@ -373,6 +374,8 @@ func (h *CreateUserTokenHandler) ServeHTTP(w http.ResponseWriter, r *http.Reques
 	creq := &action.CreateUserTokenRequest{
 		UserRef:   userRef,
 		TokenName: req.TokenName,
+		ExpiresAt: req.ExpiresAt,
+		Scopes:    req.Scopes,
 	}
 	h.log.Info().Msgf("creating user %q token", userRef)
 	token, err := h.ah.CreateUserToken(ctx, creq)
@@ -382,7 +385,9 @@ func (h *CreateUserTokenHandler) ServeHTTP(w http.ResponseWriter, r *http.Reques
 	}
 
 	res := &gwapitypes.CreateUserTokenResponse{
-		Token: token,
+		Token:     token.Token,
+		ExpiresAt: token.ExpiresAt,
+		Scopes:    token.Scopes,
 	}
 
 	if err := util.HTTPResponse(w, http.StatusCreated, res); err != nil {
@@ -16,6 +16,7 @@ package handlers
 
 import (
 	"context"
+	"net"
 	"net/http"
 	"strings"
 
@@ -30,6 +31,10 @@ import (
 	"github.com/rs/zerolog"
 )
 
+// adminTokenAuditActor is the audit actor reported for the requests
+// authenticated with the admin token
+const adminTokenAuditActor = "admin"
+
 type AuthHandler struct {
 	log  zerolog.Logger
 	next http.Handler
@@ -62,12 +67,14 @@ func (h *AuthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if h.adminToken != "" && tokenString != "" {
 		if tokenString == h.adminToken {
 			ctx = context.WithValue(ctx, common.ContextKeyUserAdmin, true)
+			ctx = csclient.WithAuditActor(ctx, adminTokenAuditActor)
 			h.next.ServeHTTP(w, r.WithContext(ctx))
 			return
 		} else {
-			user, _, err := h.configstoreClient.GetUserByToken(ctx, tokenString)
+			user, _, err := h.configstoreClient.GetUserByToken(ctx, tokenString, true, clientIP(r))
 			if err != nil {
-				if util.RemoteErrorIs(err, util.ErrNotExist) {
+				// the configstore rejects the tokens of disabled users
+				if util.RemoteErrorIs(err, util.ErrNotExist) || util.RemoteErrorIs(err, util.ErrUnauthorized) {
 					http.Error(w, "", http.StatusUnauthorized)
 					return
 				}
@@ -78,6 +85,8 @@ func (h *AuthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			// pass userid to handlers via context
 			ctx = context.WithValue(ctx, common.ContextKeyUserID, user.ID)
 			ctx = context.WithValue(ctx, common.ContextKeyUsername, user.Name)
+			// report the user as the actor of the configstore changes
+			ctx = csclient.WithAuditActor(ctx, user.ID)
 
 			if user.Admin {
 				ctx = context.WithValue(ctx, common.ContextKeyUserAdmin, true)
@@ -128,10 +137,16 @@ func (h *AuthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "", http.StatusInternalServerError)
 			return
 		}
+		if user.Disabled {
+			http.Error(w, "", http.StatusUnauthorized)
+			return
+		}
 
 		// pass userid and username to handlers via context
 		ctx = context.WithValue(ctx, common.ContextKeyUserID, user.ID)
 		ctx = context.WithValue(ctx, common.ContextKeyUsername, user.Name)
+		// report the user as the actor of the configstore changes
+		ctx = csclient.WithAuditActor(ctx, user.ID)
 
 		if user.Admin {
 			ctx = context.WithValue(ctx, common.ContextKeyUserAdmin, true)
@@ -149,6 +164,15 @@ func (h *AuthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	h.next.ServeHTTP(w, r.WithContext(ctx))
 }
 
+// clientIP returns the ip address of the request client
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
 func stripPrefixFromTokenString(prefix string) func(tok string) (string, error) {
 	return func(tok string) (string, error) {
 		pl := len(prefix)
@@ -9,8 +9,6 @@ import (
 	"agola.io/agola/internal/errors"
 
 	"github.com/gofrs/uuid"
-	"github.com/lib/pq"
-	"github.com/mattn/go-sqlite3"
 )
 
 type Type string
@@ -172,31 +170,12 @@ func (db *DB) Do(ctx context.Context, f func(tx *Tx) error) error {
 	retries := 0
 	for {
 		err := db.do(ctx, f)
-		if err != nil {
-			switch db.data.t {
-			case Sqlite3:
-				var sqerr sqlite3.Error
-				if errors.As(err, &sqerr) {
-					if sqerr.Code == sqlite3.ErrLocked {
-						retries++
-						if retries <= maxTxRetries {
-							continue
-						}
-					}
-				}
-
-			case Postgres:
-				var pqerr *pq.Error
-				if errors.As(err, &pqerr) {
-					// retry on postgres serialization error
-					if pqerr.Code == "40001" {
-						retries++
-						if retries <= maxTxRetries {
-							continue
-						}
-					}
-				}
+		if err != nil && isSerializationFailure(db.data.t, err) {
+			retries++
+			if retries <= maxTxRetries {
+				continue
 			}
+			return errors.WithStack(&SerializationError{err: err})
 		}
 		return errors.WithStack(err)
 	}
@@ -288,7 +267,7 @@ func (tx *Tx) Rollback() error {
 func (tx *Tx) Exec(query string, args ...interface{}) (sql.Result, error) {
 	query = tx.db.data.translate(query)
 	r, err := tx.tx.ExecContext(tx.ctx, query, tx.db.data.translateArgs(args)...)
-	return r, errors.WithStack(err)
+	return r, errors.WithStack(constraintError(err))
 }
 
 func (tx *Tx) Query(query string, args ...interface{}) (*sql.Rows, error) {
@@ -0,0 +1,117 @@
+package sql
+
+import (
+	"agola.io/agola/internal/errors"
+
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+)
+
+// ConstraintViolation is the kind of db constraint violated by a statement
+type ConstraintViolation string
+
+const (
+	ConstraintViolationUnique     ConstraintViolation = "unique"
+	ConstraintViolationNotNull    ConstraintViolation = "notnull"
+	ConstraintViolationForeignKey ConstraintViolation = "foreignkey"
+)
+
+// ConstraintError wraps a db driver error reporting a constraint violation
+type ConstraintError struct {
+	Violation ConstraintViolation
+
+	err error
+}
+
+func (e *ConstraintError) Error() string {
+	return e.err.Error()
+}
+
+func (e *ConstraintError) Unwrap() error {
+	return e.err
+}
+
+// ConstraintViolation returns the violated constraint kind. It lets the
+// packages not depending on the db drivers detect constraint errors.
+func (e *ConstraintError) ConstraintViolation() string {
+	return string(e.Violation)
+}
+
+// constraintError returns err wrapped in a ConstraintError if it's a db driver
+// constraint violation error, otherwise it returns err unchanged.
+func constraintError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var violation ConstraintViolation
+
+	var sqerr sqlite3.Error
+	var pqerr *pq.Error
+	switch {
+	case errors.As(err, &sqerr):
+		switch sqerr.ExtendedCode {
+		case sqlite3.ErrConstraintUnique, sqlite3.ErrConstraintPrimaryKey:
+			violation = ConstraintViolationUnique
+		case sqlite3.ErrConstraintNotNull:
+			violation = ConstraintViolationNotNull
+		case sqlite3.ErrConstraintForeignKey:
+			violation = ConstraintViolationForeignKey
+		}
+	case errors.As(err, &pqerr):
+		switch pqerr.Code {
+		case "23505":
+			violation = ConstraintViolationUnique
+		case "23502":
+			violation = ConstraintViolationNotNull
+		case "23503":
+			violation = ConstraintViolationForeignKey
+		}
+	}
+
+	if violation == "" {
+		return err
+	}
+
+	return &ConstraintError{Violation: violation, err: err}
+}
+
+// SerializationError wraps a db driver error reporting a transaction
+// serialization failure still happening after the transaction retries
+type SerializationError struct {
+	err error
+}
+
+func (e *SerializationError) Error() string {
+	return e.err.Error()
+}
+
+func (e *SerializationError) Unwrap() error {
+	return e.err
+}
+
+// SerializationFailure lets the packages not depending on the db drivers
+// detect serialization errors.
+func (e *SerializationError) SerializationFailure() bool {
+	return true
+}
+
+// isSerializationFailure reports whether err is a db driver error caused by
+// concurrent transactions that could succeed if retried: a locked table on
+// sqlite or a serialization failure on postgres.
+func isSerializationFailure(t Type, err error) bool {
+	switch t {
+	case Sqlite3:
+		var sqerr sqlite3.Error
+		if errors.As(err, &sqerr) {
+			return sqerr.Code == sqlite3.ErrLocked
+		}
+	case Postgres:
+		var pqerr *pq.Error
+		if errors.As(err, &pqerr) {
+			return pqerr.Code == "40001"
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,137 @@
+package sql
+
+import (
+	"context"
+	"testing"
+
+	"agola.io/agola/internal/errors"
+	"agola.io/agola/internal/util"
+
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+)
+
+func TestConstraintError(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	db := SetupDB(t, ctx, dir)
+
+	if err := db.Do(ctx, func(tx *Tx) error {
+		_, err := tx.Exec("create table if not exists t01 (id varchar not null, PRIMARY KEY (id))")
+		return errors.WithStack(err)
+	}); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	insert := func(id interface{}) error {
+		return db.Do(ctx, func(tx *Tx) error {
+			_, err := tx.Exec("insert into t01 (id) values ($1)", id)
+			return errors.WithStack(err)
+		})
+	}
+
+	if err := insert("id01"); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	tests := []struct {
+		name              string
+		id                interface{}
+		expectedViolation ConstraintViolation
+		expectedKind      util.ErrorKind
+	}{
+		{
+			name:              "test unique violation",
+			id:                "id01",
+			expectedViolation: ConstraintViolationUnique,
+			expectedKind:      util.ErrConflict,
+		},
+		{
+			name:              "test not null violation",
+			id:                nil,
+			expectedViolation: ConstraintViolationNotNull,
+			expectedKind:      util.ErrBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := insert(tt.id)
+			if err == nil {
+				t.Fatalf("expected err, got nil err")
+			}
+
+			var cerr *ConstraintError
+			if !errors.As(err, &cerr) {
+				t.Fatalf("expected constraint error, got err: %v", err)
+			}
+			if cerr.Violation != tt.expectedViolation {
+				t.Fatalf("expected violation %q, got %q", tt.expectedViolation, cerr.Violation)
+			}
+
+			if !util.APIErrorIs(util.MapDBError(err), tt.expectedKind) {
+				t.Fatalf("expected err kind %q, got err: %v", tt.expectedKind, util.MapDBError(err))
+			}
+		})
+	}
+}
+
+func TestSerializationError(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	db := SetupDB(t, ctx, dir)
+
+	serializationErr := func(tx *Tx) error {
+		switch tx.DBType() {
+		case Postgres:
+			return &pq.Error{Code: "40001"}
+		default:
+			return sqlite3.Error{Code: sqlite3.ErrLocked}
+		}
+	}
+
+	tests := []struct {
+		name                  string
+		err                   func(tx *Tx) error
+		expectedCalls         int
+		expectedSerialization bool
+	}{
+		{
+			name:                  "test serialization failure",
+			err:                   serializationErr,
+			expectedCalls:         maxTxRetries + 1,
+			expectedSerialization: true,
+		},
+		{
+			name:          "test other error",
+			err:           func(tx *Tx) error { return errors.Errorf("error") },
+			expectedCalls: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			err := db.Do(ctx, func(tx *Tx) error {
+				calls++
+				return errors.WithStack(tt.err(tx))
+			})
+			if err == nil {
+				t.Fatalf("expected err, got nil err")
+			}
+			if calls != tt.expectedCalls {
+				t.Fatalf("expected %d calls, got %d", tt.expectedCalls, calls)
+			}
+
+			var serr *SerializationError
+			if errors.As(err, &serr) != tt.expectedSerialization {
+				t.Fatalf("expected serialization error: %t, got err: %v", tt.expectedSerialization, err)
+			}
+			if util.IsRetryable(util.MapDBError(err)) != tt.expectedSerialization {
+				t.Fatalf("expected retryable: %t, got err: %v", tt.expectedSerialization, util.MapDBError(err))
+			}
+		})
+	}
+}
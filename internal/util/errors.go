@@ -15,8 +15,10 @@
 package util
 
 import (
+	"context"
 	"fmt"
 	"strings"
+	"time"
 
 	"agola.io/agola/internal/errors"
 )
@@ -42,6 +44,12 @@ func (e *Errors) Error() string {
 	return strings.Join(errs, ", ")
 }
 
+// Unwrap returns the contained errors so errors.Is and errors.As will also
+// check them
+func (e *Errors) Unwrap() []error {
+	return e.Errs
+}
+
 func (e *Errors) Equal(e2 error) bool {
 	errs1 := []string{}
 	errs2 := []string{}
@@ -69,6 +77,9 @@ const (
 	ErrForbidden
 	ErrUnauthorized
 	ErrInternal
+	ErrConflict
+	ErrUnavailable
+	ErrTooManyRequests
 )
 
 func (k ErrorKind) String() string {
@@ -83,6 +94,12 @@ func (k ErrorKind) String() string {
 		return "unauthorized"
 	case ErrInternal:
 		return "internal"
+	case ErrConflict:
+		return "conflict"
+	case ErrUnavailable:
+		return "unavailable"
+	case ErrTooManyRequests:
+		return "toomanyrequests"
 	}
 
 	return "unknown"
@@ -93,6 +110,12 @@ type APIError struct {
 	Kind    ErrorKind
 	Code    ErrorCode
 	Message string
+	// RetryAfter is the optional time the client should wait before retrying
+	// the request. It's returned in the Retry-After header.
+	RetryAfter time.Duration
+	// Retryable reports that the error is caused by a transient condition
+	// and the request could succeed if retried.
+	Retryable bool
 
 	stack *errors.Stack
 }
@@ -133,6 +156,21 @@ func WithMessage(message string) APIErrorOption {
 	}
 }
 
+// WithRetryAfter sets the time the client should wait before retrying the
+// request, usually on ErrTooManyRequests and ErrUnavailable errors
+func WithRetryAfter(retryAfter time.Duration) APIErrorOption {
+	return func(e *APIError) {
+		e.RetryAfter = retryAfter
+	}
+}
+
+// WithRetryable marks the error as caused by a transient condition
+func WithRetryable() APIErrorOption {
+	return func(e *APIError) {
+		e.Retryable = true
+	}
+}
+
 func AsAPIError(err error) (*APIError, bool) {
 	var derr *APIError
 	return derr, errors.As(err, &derr)
@@ -146,6 +184,81 @@ func APIErrorIs(err error, kind ErrorKind) bool {
 	return false
 }
 
+// IsRetryable reports whether err contains an APIError marked as retryable
+func IsRetryable(err error) bool {
+	if derr, ok := AsAPIError(err); ok && derr.Retryable {
+		return true
+	}
+
+	return false
+}
+
+// RootAPIErrorKind returns the kind of the innermost APIError in the err
+// chain. When an APIError wraps another APIError, AsAPIError returns the
+// outermost one while this returns the root cause kind. If err doesn't contain
+// an APIError it returns ErrInternal.
+func RootAPIErrorKind(err error) ErrorKind {
+	kind := ErrInternal
+	for {
+		derr, ok := AsAPIError(err)
+		if !ok {
+			return kind
+		}
+		kind = derr.Kind
+		err = derr.Unwrap()
+	}
+}
+
+// dbConstraintError is implemented by the sql package errors reporting a db
+// constraint violation. An interface is used to avoid depending on the db
+// drivers.
+type dbConstraintError interface {
+	error
+	ConstraintViolation() string
+}
+
+// dbSerializationError is implemented by the sql package errors reporting a
+// transaction serialization failure.
+type dbSerializationError interface {
+	error
+	SerializationFailure() bool
+}
+
+// MapDBError converts a db constraint violation error to an APIError: unique
+// violations become ErrConflict, not null and foreign key violations become
+// ErrBadRequest. Serialization failures become retryable ErrUnavailable
+// errors. Other errors are returned unchanged.
+func MapDBError(err error) error {
+	var serr dbSerializationError
+	if errors.As(err, &serr) && serr.SerializationFailure() {
+		return NewAPIError(ErrUnavailable, err, WithRetryable())
+	}
+
+	var cerr dbConstraintError
+	if !errors.As(err, &cerr) {
+		return err
+	}
+
+	switch cerr.ConstraintViolation() {
+	case "unique":
+		return NewAPIError(ErrConflict, err)
+	case "notnull", "foreignkey":
+		return NewAPIError(ErrBadRequest, err)
+	}
+
+	return err
+}
+
+// ContextError converts a context canceled or deadline exceeded error to an
+// ErrUnavailable APIError. Other errors are returned unchanged.
+func ContextError(err error) error {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return NewAPIError(ErrUnavailable, err)
+	}
+
+	return err
+}
+
 // RemoteError is an error received from a remote call. It's similar to
 // APIError but with another type so it can be distinguished and won't be
 // propagated to the api response.
@@ -153,6 +266,10 @@ type RemoteError struct {
 	Kind    ErrorKind
 	Code    string
 	Message string
+	// RetryAfter is the retry time received in the Retry-After header
+	RetryAfter time.Duration
+	// Retryable is the retryable flag received in the error response
+	Retryable bool
 }
 
 func NewRemoteError(kind ErrorKind, code string, message string) error {
@@ -193,3 +310,58 @@ func KindFromRemoteError(err error) ErrorKind {
 
 	return ErrInternal
 }
+
+// APIErrorFromRemote returns an APIError wrapping err. If err contains a
+// RemoteError its kind, code, message, retry after and retryable flag are
+// kept, otherwise the APIError kind is ErrInternal.
+func APIErrorFromRemote(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	rerr, ok := AsRemoteError(err)
+	if !ok {
+		return NewAPIError(ErrInternal, err)
+	}
+
+	options := []APIErrorOption{WithCode(ErrorCode(rerr.Code)), WithMessage(rerr.Message)}
+	if rerr.RetryAfter > 0 {
+		options = append(options, WithRetryAfter(rerr.RetryAfter))
+	}
+	if rerr.Retryable {
+		options = append(options, WithRetryable())
+	}
+
+	return NewAPIError(rerr.Kind, err, options...)
+}
+
+// ToAPIError converts err to an APIError at the api boundary. An APIError in
+// the err chain is kept (with its kind, code, message and retry info), remote
+// errors are converted by APIErrorFromRemote, context and db errors are converted
+// by ContextError and MapDBError. Any other error becomes an ErrInternal
+// APIError without a message, so its details won't be returned to the user.
+func ToAPIError(err error) *APIError {
+	if err == nil {
+		return nil
+	}
+
+	if derr, ok := AsAPIError(err); ok {
+		if err == error(derr) {
+			return derr
+		}
+		return &APIError{err: err, Kind: derr.Kind, Code: derr.Code, Message: derr.Message, RetryAfter: derr.RetryAfter, Retryable: derr.Retryable, stack: derr.stack}
+	}
+
+	if _, ok := AsRemoteError(err); ok {
+		derr, _ := AsAPIError(APIErrorFromRemote(err))
+		return derr
+	}
+
+	for _, mapErr := range []func(error) error{ContextError, MapDBError} {
+		if derr, ok := AsAPIError(mapErr(err)); ok {
+			return derr
+		}
+	}
+
+	return &APIError{err: err, Kind: ErrInternal, stack: errors.Callers(0)}
+}
@@ -0,0 +1,501 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"agola.io/agola/internal/errors"
+)
+
+func TestRootAPIErrorKind(t *testing.T) {
+	tests := []struct {
+		name         string
+		err          error
+		expectedKind ErrorKind
+	}{
+		{
+			name:         "test nil error",
+			err:          nil,
+			expectedKind: ErrInternal,
+		},
+		{
+			name:         "test not api error",
+			err:          errors.Errorf("error"),
+			expectedKind: ErrInternal,
+		},
+		{
+			name:         "test single api error",
+			err:          NewAPIError(ErrNotExist, errors.Errorf("error")),
+			expectedKind: ErrNotExist,
+		},
+		{
+			name:         "test nested api errors",
+			err:          NewAPIError(ErrInternal, NewAPIError(ErrNotExist, errors.Errorf("error"))),
+			expectedKind: ErrNotExist,
+		},
+		{
+			name:         "test nested api errors wrapped by other errors",
+			err:          errors.Wrapf(NewAPIError(ErrInternal, errors.WithStack(NewAPIError(ErrBadRequest, errors.Wrapf(NewAPIError(ErrNotExist, errors.Errorf("error")), "wrapped")))), "wrapped"),
+			expectedKind: ErrNotExist,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kind := RootAPIErrorKind(tt.err)
+			if kind != tt.expectedKind {
+				t.Fatalf("expected kind %q, got %q", tt.expectedKind, kind)
+			}
+		})
+	}
+}
+
+type fakeConstraintError struct {
+	violation string
+}
+
+func (e *fakeConstraintError) Error() string {
+	return "constraint violation"
+}
+
+func (e *fakeConstraintError) ConstraintViolation() string {
+	return e.violation
+}
+
+type fakeSerializationError struct{}
+
+func (e *fakeSerializationError) Error() string {
+	return "serialization failure"
+}
+
+func (e *fakeSerializationError) SerializationFailure() bool {
+	return true
+}
+
+func TestMapDBError(t *testing.T) {
+	tests := []struct {
+		name              string
+		err               error
+		expectedKind      ErrorKind
+		expectedRetryable bool
+		expectAPIErr      bool
+	}{
+		{
+			name: "test nil error",
+			err:  nil,
+		},
+		{
+			name: "test generic error",
+			err:  errors.Errorf("error"),
+		},
+		{
+			name:         "test unique violation",
+			err:          errors.Wrapf(&fakeConstraintError{violation: "unique"}, "failed to insert"),
+			expectedKind: ErrConflict,
+			expectAPIErr: true,
+		},
+		{
+			name:         "test not null violation",
+			err:          errors.WithStack(&fakeConstraintError{violation: "notnull"}),
+			expectedKind: ErrBadRequest,
+			expectAPIErr: true,
+		},
+		{
+			name:         "test foreign key violation",
+			err:          &fakeConstraintError{violation: "foreignkey"},
+			expectedKind: ErrBadRequest,
+			expectAPIErr: true,
+		},
+		{
+			name: "test unknown violation",
+			err:  &fakeConstraintError{violation: "check"},
+		},
+		{
+			name:              "test serialization failure",
+			err:               errors.Wrapf(&fakeSerializationError{}, "failed to commit"),
+			expectedKind:      ErrUnavailable,
+			expectedRetryable: true,
+			expectAPIErr:      true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := MapDBError(tt.err)
+			derr, ok := AsAPIError(err)
+			if ok != tt.expectAPIErr {
+				t.Fatalf("expected api error: %t, got err: %v", tt.expectAPIErr, err)
+			}
+			if !ok {
+				if err != tt.err {
+					t.Fatalf("expected unchanged error %v, got %v", tt.err, err)
+				}
+				return
+			}
+			if derr.Kind != tt.expectedKind {
+				t.Fatalf("expected err kind %q, got %q", tt.expectedKind, derr.Kind)
+			}
+			if derr.Retryable != tt.expectedRetryable {
+				t.Fatalf("expected err retryable %t, got %t", tt.expectedRetryable, derr.Retryable)
+			}
+			if err.Error() != tt.err.Error() {
+				t.Fatalf("expected err message %q, got %q", tt.err.Error(), err.Error())
+			}
+		})
+	}
+}
+
+type testConstraintError struct {
+	constraint string
+}
+
+func (e *testConstraintError) Error() string { return "constraint violation" }
+
+func (e *testConstraintError) ConstraintViolation() string { return e.constraint }
+
+func TestToAPIError(t *testing.T) {
+	apiErr := NewAPIError(ErrNotExist, errors.Errorf("error"), WithCode("code01"), WithMessage("message"))
+
+	tests := []struct {
+		name            string
+		err             error
+		expectedNil     bool
+		expectedKind    ErrorKind
+		expectedCode    ErrorCode
+		expectedMessage string
+		expectedErr     string
+	}{
+		{
+			name:        "test nil error",
+			err:         nil,
+			expectedNil: true,
+		},
+		{
+			name:            "test api error",
+			err:             apiErr,
+			expectedKind:    ErrNotExist,
+			expectedCode:    "code01",
+			expectedMessage: "message",
+			expectedErr:     "error",
+		},
+		{
+			name:            "test wrapped api error",
+			err:             errors.Wrapf(apiErr, "wrapped"),
+			expectedKind:    ErrNotExist,
+			expectedCode:    "code01",
+			expectedMessage: "message",
+			expectedErr:     "wrapped: error",
+		},
+		{
+			name:            "test remote error",
+			err:             errors.WithStack(NewRemoteError(ErrForbidden, "remotecode", "remote message")),
+			expectedKind:    ErrForbidden,
+			expectedCode:    "remotecode",
+			expectedMessage: "remote message",
+			expectedErr:     "remote error forbidden (code: remotecode) (message: remote message)",
+		},
+		{
+			name:         "test context deadline exceeded error",
+			err:          errors.Wrapf(context.DeadlineExceeded, "wrapped"),
+			expectedKind: ErrUnavailable,
+			expectedErr:  "wrapped: context deadline exceeded",
+		},
+		{
+			name:         "test context canceled error",
+			err:          context.Canceled,
+			expectedKind: ErrUnavailable,
+			expectedErr:  "context canceled",
+		},
+		{
+			name:         "test db unique constraint error",
+			err:          errors.WithStack(&testConstraintError{constraint: "unique"}),
+			expectedKind: ErrConflict,
+			expectedErr:  "constraint violation",
+		},
+		{
+			name:         "test db other constraint error",
+			err:          &testConstraintError{constraint: "check"},
+			expectedKind: ErrInternal,
+			expectedErr:  "constraint violation",
+		},
+		{
+			name:         "test generic error",
+			err:          errors.Errorf("error"),
+			expectedKind: ErrInternal,
+			expectedErr:  "error",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			derr := ToAPIError(tt.err)
+			if tt.expectedNil {
+				if derr != nil {
+					t.Fatalf("expected nil api error, got %v", derr)
+				}
+				return
+			}
+			if derr.Kind != tt.expectedKind {
+				t.Fatalf("expected kind %q, got %q", tt.expectedKind, derr.Kind)
+			}
+			if derr.Code != tt.expectedCode {
+				t.Fatalf("expected code %q, got %q", tt.expectedCode, derr.Code)
+			}
+			if derr.Message != tt.expectedMessage {
+				t.Fatalf("expected message %q, got %q", tt.expectedMessage, derr.Message)
+			}
+			if derr.Error() != tt.expectedErr {
+				t.Fatalf("expected err %q, got %q", tt.expectedErr, derr.Error())
+			}
+			if !errors.Is(derr, tt.err) {
+				t.Fatalf("expected api error to wrap the original error")
+			}
+		})
+	}
+}
+
+func TestErrorKindString(t *testing.T) {
+	tests := []struct {
+		kind     ErrorKind
+		expected string
+	}{
+		{kind: ErrBadRequest, expected: "badrequest"},
+		{kind: ErrNotExist, expected: "notexist"},
+		{kind: ErrForbidden, expected: "forbidden"},
+		{kind: ErrUnauthorized, expected: "unauthorized"},
+		{kind: ErrInternal, expected: "internal"},
+		{kind: ErrConflict, expected: "conflict"},
+		{kind: ErrUnavailable, expected: "unavailable"},
+		{kind: ErrTooManyRequests, expected: "toomanyrequests"},
+		{kind: ErrorKind(100), expected: "unknown"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expected, func(t *testing.T) {
+			if s := tt.kind.String(); s != tt.expected {
+				t.Fatalf("expected %q, got %q", tt.expected, s)
+			}
+		})
+	}
+}
+
+func TestErrorsUnwrap(t *testing.T) {
+	errSentinel := errors.New("sentinel error")
+	errOther := errors.New("other error")
+
+	errs := &Errors{}
+	errs.Append(errors.Errorf("error"))
+	errs.Append(errors.Wrapf(errSentinel, "wrapped"))
+	errs.Append(NewAPIError(ErrNotExist, errors.Errorf("not exist error"), WithCode("code01")))
+	errs.Append(NewRemoteError(ErrForbidden, "remotecode", "remote message"))
+
+	tests := []struct {
+		name string
+		err  error
+	}{
+		{
+			name: "test errors",
+			err:  errs,
+		},
+		{
+			name: "test wrapped errors",
+			err:  errors.Wrapf(errs, "wrapped"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if !errors.Is(tt.err, errSentinel) {
+				t.Fatalf("expected errors.Is to find the sentinel error")
+			}
+			if errors.Is(tt.err, errOther) {
+				t.Fatalf("expected errors.Is to not find a not contained error")
+			}
+
+			var derr *APIError
+			if !errors.As(tt.err, &derr) {
+				t.Fatalf("expected errors.As to find the api error")
+			}
+			if derr.Kind != ErrNotExist || derr.Code != "code01" {
+				t.Fatalf("expected api error with kind %q and code %q, got kind %q and code %q", ErrNotExist, "code01", derr.Kind, derr.Code)
+			}
+			if !APIErrorIs(tt.err, ErrNotExist) {
+				t.Fatalf("expected APIErrorIs to find the not exist api error")
+			}
+
+			var rerr *RemoteError
+			if !errors.As(tt.err, &rerr) {
+				t.Fatalf("expected errors.As to find the remote error")
+			}
+			if rerr.Kind != ErrForbidden {
+				t.Fatalf("expected remote error kind %q, got %q", ErrForbidden, rerr.Kind)
+			}
+
+			var es *Errors
+			if !errors.As(tt.err, &es) || es != errs {
+				t.Fatalf("expected errors.As to find the errors")
+			}
+		})
+	}
+
+	emptyErrs := &Errors{}
+	if errors.Is(emptyErrs, errSentinel) {
+		t.Fatalf("expected errors.Is to not find errors in empty errors")
+	}
+	var derr *APIError
+	if errors.As(emptyErrs, &derr) {
+		t.Fatalf("expected errors.As to not find errors in empty errors")
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	retryableErr := NewAPIError(ErrUnavailable, errors.Errorf("error"), WithRetryable())
+
+	errs := &Errors{}
+	errs.Append(errors.Errorf("error"))
+	errs.Append(retryableErr)
+
+	tests := []struct {
+		name              string
+		err               error
+		expectedRetryable bool
+	}{
+		{
+			name: "test nil error",
+			err:  nil,
+		},
+		{
+			name: "test generic error",
+			err:  errors.Errorf("error"),
+		},
+		{
+			name: "test not retryable api error",
+			err:  NewAPIError(ErrUnavailable, errors.Errorf("error")),
+		},
+		{
+			name:              "test retryable api error",
+			err:               retryableErr,
+			expectedRetryable: true,
+		},
+		{
+			name:              "test wrapped retryable api error",
+			err:               errors.Wrapf(retryableErr, "wrapped"),
+			expectedRetryable: true,
+		},
+		{
+			name:              "test retryable api error converted by ToAPIError",
+			err:               ToAPIError(errors.Wrapf(retryableErr, "wrapped")),
+			expectedRetryable: true,
+		},
+		{
+			name:              "test retryable api error in errors",
+			err:               errs,
+			expectedRetryable: true,
+		},
+		{
+			name: "test not retryable api error wrapping a retryable api error",
+			err:  NewAPIError(ErrInternal, retryableErr),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if retryable := IsRetryable(tt.err); retryable != tt.expectedRetryable {
+				t.Fatalf("expected retryable %t, got %t", tt.expectedRetryable, retryable)
+			}
+		})
+	}
+}
+
+func TestAPIErrorFromRemote(t *testing.T) {
+	remoteErr := NewRemoteError(ErrConflict, "code01", "message01")
+
+	tests := []struct {
+		name               string
+		err                error
+		expectedNil        bool
+		expectedKind       ErrorKind
+		expectedCode       ErrorCode
+		expectedMessage    string
+		expectedRetryAfter time.Duration
+	}{
+		{
+			name:        "test nil error",
+			err:         nil,
+			expectedNil: true,
+		},
+		{
+			name:            "test remote error",
+			err:             remoteErr,
+			expectedKind:    ErrConflict,
+			expectedCode:    "code01",
+			expectedMessage: "message01",
+		},
+		{
+			name:            "test wrapped remote error",
+			err:             errors.Wrapf(remoteErr, "wrapped"),
+			expectedKind:    ErrConflict,
+			expectedCode:    "code01",
+			expectedMessage: "message01",
+		},
+		{
+			name:               "test remote error with retry after",
+			err:                &RemoteError{Kind: ErrTooManyRequests, Code: "code02", Message: "message02", RetryAfter: 10 * time.Second},
+			expectedKind:       ErrTooManyRequests,
+			expectedCode:       "code02",
+			expectedMessage:    "message02",
+			expectedRetryAfter: 10 * time.Second,
+		},
+		{
+			name:         "test generic error",
+			err:          errors.Errorf("error"),
+			expectedKind: ErrInternal,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := APIErrorFromRemote(tt.err)
+			if tt.expectedNil {
+				if err != nil {
+					t.Fatalf("expected nil err, got %v", err)
+				}
+				return
+			}
+			derr, ok := AsAPIError(err)
+			if !ok {
+				t.Fatalf("expected api error, got %v", err)
+			}
+			if derr.Kind != tt.expectedKind {
+				t.Fatalf("expected kind %q, got %q", tt.expectedKind, derr.Kind)
+			}
+			if derr.Code != tt.expectedCode {
+				t.Fatalf("expected code %q, got %q", tt.expectedCode, derr.Code)
+			}
+			if derr.Message != tt.expectedMessage {
+				t.Fatalf("expected message %q, got %q", tt.expectedMessage, derr.Message)
+			}
+			if derr.RetryAfter != tt.expectedRetryAfter {
+				t.Fatalf("expected retry after %s, got %s", tt.expectedRetryAfter, derr.RetryAfter)
+			}
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("expected api error to wrap the original error")
+			}
+		})
+	}
+}
@@ -4,7 +4,10 @@ import (
 	"bytes"
 	"encoding/json"
 	"io/ioutil"
+	"math"
 	"net/http"
+	"strconv"
+	"time"
 
 	"agola.io/agola/internal/errors"
 )
@@ -30,6 +33,22 @@ func HTTPResponse(w http.ResponseWriter, code int, res interface{}) error {
 type ErrorResponse struct {
 	Code    string `json:"code"`
 	Message string `json:"message"`
+	// Retryable reports that the error is caused by a transient condition
+	// and the request could succeed if retried.
+	Retryable bool `json:"retryable,omitempty"`
+}
+
+// httpAPIError converts err to the APIError returned in the api response.
+// Remote errors not already converted to an APIError aren't propagated and
+// become an ErrInternal APIError.
+func httpAPIError(err error) *APIError {
+	if _, ok := AsAPIError(err); !ok {
+		if _, ok := AsRemoteError(err); ok {
+			return &APIError{err: err, Kind: ErrInternal, stack: errors.Callers(0)}
+		}
+	}
+
+	return ToAPIError(err)
 }
 
 func ErrorResponseFromError(err error) *ErrorResponse {
@@ -37,13 +56,9 @@ func ErrorResponseFromError(err error) *ErrorResponse {
 		return nil
 	}
 
-	var derr *APIError
-	if errors.As(err, &derr) {
-		return &ErrorResponse{Code: string(derr.Code), Message: derr.Message}
-	}
-
-	// on generic error return an error response without any code
-	return &ErrorResponse{}
+	// generic errors return an error response without any code
+	derr := httpAPIError(err)
+	return &ErrorResponse{Code: string(derr.Code), Message: derr.Message, Retryable: derr.Retryable}
 }
 
 func HTTPError(w http.ResponseWriter, err error) bool {
@@ -60,20 +75,28 @@ func HTTPError(w http.ResponseWriter, err error) bool {
 
 	code := http.StatusInternalServerError
 
-	var derr *APIError
-	if errors.As(err, &derr) {
-		switch derr.Kind {
-		case ErrBadRequest:
-			code = http.StatusBadRequest
-		case ErrNotExist:
-			code = http.StatusNotFound
-		case ErrForbidden:
-			code = http.StatusForbidden
-		case ErrUnauthorized:
-			code = http.StatusUnauthorized
-		case ErrInternal:
-			code = http.StatusInternalServerError
-		}
+	derr := httpAPIError(err)
+	switch derr.Kind {
+	case ErrBadRequest:
+		code = http.StatusBadRequest
+	case ErrNotExist:
+		code = http.StatusNotFound
+	case ErrForbidden:
+		code = http.StatusForbidden
+	case ErrUnauthorized:
+		code = http.StatusUnauthorized
+	case ErrConflict:
+		code = http.StatusConflict
+	case ErrUnavailable:
+		code = http.StatusServiceUnavailable
+	case ErrTooManyRequests:
+		code = http.StatusTooManyRequests
+	case ErrInternal:
+		code = http.StatusInternalServerError
+	}
+
+	if derr.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.FormatInt(int64(math.Ceil(derr.RetryAfter.Seconds())), 10))
 	}
 
 	w.WriteHeader(code)
@@ -116,9 +139,21 @@ func ErrFromRemote(resp *http.Response) error {
 		kind = ErrForbidden
 	case http.StatusUnauthorized:
 		kind = ErrUnauthorized
+	case http.StatusConflict:
+		kind = ErrConflict
+	case http.StatusServiceUnavailable:
+		kind = ErrUnavailable
+	case http.StatusTooManyRequests:
+		kind = ErrTooManyRequests
 	case http.StatusInternalServerError:
 		kind = ErrInternal
 	}
 
-	return NewRemoteError(kind, response.Code, response.Message)
+	rerr := &RemoteError{Kind: kind, Code: response.Code, Message: response.Message, Retryable: response.Retryable}
+	// only the delay seconds Retry-After form is supported
+	if retryAfter, err := strconv.ParseInt(resp.Header.Get("Retry-After"), 10, 64); err == nil && retryAfter > 0 {
+		rerr.RetryAfter = time.Duration(retryAfter) * time.Second
+	}
+
+	return rerr
 }
@@ -0,0 +1,270 @@
+// Copyright 2022 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"agola.io/agola/internal/errors"
+)
+
+func TestHTTPErrorStatusCode(t *testing.T) {
+	tests := []struct {
+		name         string
+		err          error
+		expectedCode int
+	}{
+		{
+			name:         "test bad request error",
+			err:          NewAPIError(ErrBadRequest, errors.Errorf("error")),
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name:         "test not exist error",
+			err:          NewAPIError(ErrNotExist, errors.Errorf("error")),
+			expectedCode: http.StatusNotFound,
+		},
+		{
+			name:         "test forbidden error",
+			err:          NewAPIError(ErrForbidden, errors.Errorf("error")),
+			expectedCode: http.StatusForbidden,
+		},
+		{
+			name:         "test unauthorized error",
+			err:          NewAPIError(ErrUnauthorized, errors.Errorf("error")),
+			expectedCode: http.StatusUnauthorized,
+		},
+		{
+			name:         "test conflict error",
+			err:          NewAPIError(ErrConflict, errors.Errorf("error")),
+			expectedCode: http.StatusConflict,
+		},
+		{
+			name:         "test wrapped conflict error",
+			err:          errors.Wrapf(NewAPIError(ErrConflict, errors.Errorf("error")), "wrapped"),
+			expectedCode: http.StatusConflict,
+		},
+		{
+			name:         "test unavailable error",
+			err:          NewAPIError(ErrUnavailable, errors.Errorf("error")),
+			expectedCode: http.StatusServiceUnavailable,
+		},
+		{
+			name:         "test too many requests error",
+			err:          NewAPIError(ErrTooManyRequests, errors.Errorf("error")),
+			expectedCode: http.StatusTooManyRequests,
+		},
+		{
+			name:         "test internal error",
+			err:          NewAPIError(ErrInternal, errors.Errorf("error")),
+			expectedCode: http.StatusInternalServerError,
+		},
+		{
+			name:         "test generic error",
+			err:          errors.Errorf("error"),
+			expectedCode: http.StatusInternalServerError,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			if !HTTPError(w, tt.err) {
+				t.Fatalf("expected error to be handled")
+			}
+			if w.Code != tt.expectedCode {
+				t.Fatalf("expected status code %d, got %d", tt.expectedCode, w.Code)
+			}
+
+			// the status code is mapped back to the same error kind
+			if tt.expectedCode == http.StatusInternalServerError {
+				return
+			}
+			err := ErrFromRemote(w.Result())
+			kind := KindFromRemoteError(err)
+			derr, _ := AsAPIError(tt.err)
+			if kind != derr.Kind {
+				t.Fatalf("expected remote error kind %s, got %s", derr.Kind, kind)
+			}
+		})
+	}
+}
+
+func TestHTTPErrorRetryAfter(t *testing.T) {
+	tests := []struct {
+		name               string
+		err                error
+		expectedHeader     string
+		expectedRetryAfter time.Duration
+	}{
+		{
+			name:               "test too many requests error with retry after",
+			err:                NewAPIError(ErrTooManyRequests, errors.Errorf("error"), WithRetryAfter(30*time.Second)),
+			expectedHeader:     "30",
+			expectedRetryAfter: 30 * time.Second,
+		},
+		{
+			name:               "test retry after rounded up to seconds",
+			err:                NewAPIError(ErrTooManyRequests, errors.Errorf("error"), WithRetryAfter(1500*time.Millisecond)),
+			expectedHeader:     "2",
+			expectedRetryAfter: 2 * time.Second,
+		},
+		{
+			name:               "test unavailable error with retry after",
+			err:                errors.Wrapf(NewAPIError(ErrUnavailable, errors.Errorf("error"), WithRetryAfter(time.Minute)), "wrapped"),
+			expectedHeader:     "60",
+			expectedRetryAfter: time.Minute,
+		},
+		{
+			name: "test too many requests error without retry after",
+			err:  NewAPIError(ErrTooManyRequests, errors.Errorf("error")),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			HTTPError(w, tt.err)
+			if h := w.Header().Get("Retry-After"); h != tt.expectedHeader {
+				t.Fatalf("expected Retry-After header %q, got %q", tt.expectedHeader, h)
+			}
+
+			err := ErrFromRemote(w.Result())
+			rerr, ok := AsRemoteError(err)
+			if !ok {
+				t.Fatalf("expected remote error, got %v", err)
+			}
+			if rerr.RetryAfter != tt.expectedRetryAfter {
+				t.Fatalf("expected remote error retry after %s, got %s", tt.expectedRetryAfter, rerr.RetryAfter)
+			}
+
+			// the retry after is kept when the remote error is returned by another api
+			derr := ToAPIError(errors.WithStack(err))
+			if derr.RetryAfter != tt.expectedRetryAfter {
+				t.Fatalf("expected api error retry after %s, got %s", tt.expectedRetryAfter, derr.RetryAfter)
+			}
+		})
+	}
+}
+
+func TestAPIErrorFromRemoteRoundTrip(t *testing.T) {
+	err := NewAPIError(ErrNotExist, errors.Errorf("error"), WithCode("code01"), WithMessage("message01"))
+
+	// the error returned by a service and received by another one is returned
+	// by the latter with the same status code and error response
+	w := httptest.NewRecorder()
+	HTTPError(w, err)
+
+	rerr := APIErrorFromRemote(errors.WithStack(ErrFromRemote(w.Result())))
+
+	rw := httptest.NewRecorder()
+	HTTPError(rw, rerr)
+
+	if rw.Code != w.Code {
+		t.Fatalf("expected status code %d, got %d", w.Code, rw.Code)
+	}
+	if rw.Body.String() != w.Body.String() {
+		t.Fatalf("expected response %q, got %q", w.Body.String(), rw.Body.String())
+	}
+
+	derr, _ := AsAPIError(rerr)
+	if derr.Code != "code01" || derr.Message != "message01" {
+		t.Fatalf("expected code %q and message %q, got code %q and message %q", "code01", "message01", derr.Code, derr.Message)
+	}
+}
+
+func TestToAPIErrorRemoteRoundTrip(t *testing.T) {
+	err := NewAPIError(ErrConflict, errors.Errorf("error"), WithCode("code01"), WithMessage("message01"))
+
+	w := httptest.NewRecorder()
+	HTTPError(w, err)
+
+	derr := ToAPIError(errors.WithStack(ErrFromRemote(w.Result())))
+	if derr.Kind != ErrConflict {
+		t.Fatalf("expected kind %q, got %q", ErrConflict, derr.Kind)
+	}
+	if derr.Code != "code01" || derr.Message != "message01" {
+		t.Fatalf("expected code %q and message %q, got code %q and message %q", "code01", "message01", derr.Code, derr.Message)
+	}
+
+	rw := httptest.NewRecorder()
+	HTTPError(rw, derr)
+
+	if rw.Code != w.Code {
+		t.Fatalf("expected status code %d, got %d", w.Code, rw.Code)
+	}
+	if rw.Body.String() != w.Body.String() {
+		t.Fatalf("expected response %q, got %q", w.Body.String(), rw.Body.String())
+	}
+}
+
+func TestHTTPErrorRetryable(t *testing.T) {
+	tests := []struct {
+		name              string
+		err               error
+		expectedCode      int
+		expectedRetryable bool
+	}{
+		{
+			name:              "test db serialization failure",
+			err:               errors.Wrapf(&fakeSerializationError{}, "failed to commit"),
+			expectedCode:      http.StatusServiceUnavailable,
+			expectedRetryable: true,
+		},
+		{
+			name:              "test retryable api error",
+			err:               errors.Wrapf(NewAPIError(ErrUnavailable, errors.Errorf("error"), WithRetryable()), "wrapped"),
+			expectedCode:      http.StatusServiceUnavailable,
+			expectedRetryable: true,
+		},
+		{
+			name:         "test not retryable api error",
+			err:          NewAPIError(ErrUnavailable, errors.Errorf("error")),
+			expectedCode: http.StatusServiceUnavailable,
+		},
+		{
+			name:         "test not converted remote error",
+			err:          errors.WithStack(&RemoteError{Kind: ErrUnavailable, Retryable: true}),
+			expectedCode: http.StatusInternalServerError,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			HTTPError(w, tt.err)
+			if w.Code != tt.expectedCode {
+				t.Fatalf("expected status code %d, got %d", tt.expectedCode, w.Code)
+			}
+
+			err := ErrFromRemote(w.Result())
+			rerr, ok := AsRemoteError(err)
+			if !ok {
+				t.Fatalf("expected remote error, got %v", err)
+			}
+			if rerr.Retryable != tt.expectedRetryable {
+				t.Fatalf("expected remote error retryable %t, got %t", tt.expectedRetryable, rerr.Retryable)
+			}
+
+			// the retryable flag is kept when the remote error is returned by another api
+			if retryable := IsRetryable(APIErrorFromRemote(errors.WithStack(err))); retryable != tt.expectedRetryable {
+				t.Fatalf("expected api error retryable %t, got %t", tt.expectedRetryable, retryable)
+			}
+		})
+	}
+}
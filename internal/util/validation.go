@@ -15,6 +15,7 @@
 package util
 
 import (
+	"net/mail"
 	"regexp"
 
 	"agola.io/agola/internal/errors"
@@ -36,3 +37,13 @@ func ValidateName(s string) bool {
 	}
 	return nameRegexp.MatchString(s)
 }
+
+// ValidateEmail reports whether s is a plain email address, without a display
+// name or angle brackets.
+func ValidateEmail(s string) bool {
+	addr, err := mail.ParseAddress(s)
+	if err != nil {
+		return false
+	}
+	return addr.Address == s
+}
@@ -65,3 +65,33 @@ func TestValidateName(t *testing.T) {
 		}
 	}
 }
+
+func TestValidateEmail(t *testing.T) {
+	goodEmails := []string{
+		"user01@example.com",
+		"User.Name+tag@sub.example.com",
+		"user-01@localhost",
+	}
+	badEmails := []string{
+		"",
+		"user01",
+		"user01@",
+		"@example.com",
+		"user 01@example.com",
+		"User <user01@example.com>",
+		"<user01@example.com>",
+		" user01@example.com",
+		"user01@example.com, user02@example.com",
+	}
+
+	for _, email := range goodEmails {
+		if !ValidateEmail(email) {
+			t.Errorf("expect valid email for %q", email)
+		}
+	}
+	for _, email := range badEmails {
+		if ValidateEmail(email) {
+			t.Errorf("expect invalid email for %q", email)
+		}
+	}
+}
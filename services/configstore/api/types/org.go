@@ -22,6 +22,7 @@ type CreateOrgRequest struct {
 	Name          string
 	Visibility    cstypes.Visibility
 	CreatorUserID string
+	MaxMembers    int
 }
 
 type AddOrgMemberRequest struct {
@@ -35,4 +36,5 @@ type OrgMemberResponse struct {
 
 type UpdateOrgRequest struct {
 	Visibility cstypes.Visibility
+	MaxMembers *int
 }
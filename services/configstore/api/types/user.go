@@ -22,12 +22,15 @@ import (
 
 type CreateUserRequest struct {
 	UserName string `json:"user_name"`
+	Email    string `json:"email"`
 
 	CreateUserLARequest *CreateUserLARequest `json:"create_user_la_request"`
 }
 
 type UpdateUserRequest struct {
-	UserName string `json:"user_name"`
+	UserName string  `json:"user_name"`
+	Email    *string `json:"email"`
+	Disabled *bool   `json:"disabled"`
 }
 
 type CreateUserLARequest struct {
@@ -49,13 +52,27 @@ type UpdateUserLARequest struct {
 	Oauth2AccessTokenExpiresAt time.Time `json:"oauth_2_access_token_expires_at"`
 }
 
+type RefreshUserLAOauth2TokenRequest struct {
+	Oauth2AccessToken          string    `json:"oauth2_access_token"`
+	Oauth2RefreshToken         string    `json:"oauth2_refresh_token"`
+	Oauth2AccessTokenExpiresAt time.Time `json:"oauth_2_access_token_expires_at"`
+}
+
 type CreateUserTokenRequest struct {
-	TokenName string `json:"token_name"`
+	TokenName string     `json:"token_name"`
+	ExpiresAt *time.Time `json:"expires_at"`
+	Scopes    []string   `json:"scopes"`
 }
 
 type CreateUserTokenResponse struct {
-	Name  string `json:"name"`
-	Token string `json:"token"`
+	Name      string     `json:"name"`
+	Token     string     `json:"token"`
+	ExpiresAt *time.Time `json:"expires_at"`
+	Scopes    []string   `json:"scopes"`
+}
+
+type UpdateUserTokenRequest struct {
+	TokenName string `json:"token_name"`
 }
 
 type UserOrgsResponse struct {
@@ -39,6 +39,15 @@ type Client struct {
 	client *http.Client
 }
 
+type auditActorKey struct{}
+
+// WithAuditActor returns a context reporting actor as the identity requesting
+// the changes. The client sends it to the configstore in the
+// AuditActorHeader header of every request done with the returned context.
+func WithAuditActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, auditActorKey{}, actor)
+}
+
 // NewClient initializes and returns a API client.
 func NewClient(url string) *Client {
 	return &Client{
@@ -67,6 +76,9 @@ func (c *Client) doRequest(ctx context.Context, method, path string, query url.V
 	for k, v := range header {
 		req.Header[k] = v
 	}
+	if actor, _ := ctx.Value(auditActorKey{}).(string); actor != "" {
+		req.Header.Set(csapitypes.AuditActorHeader, actor)
+	}
 
 	res, err := c.client.Do(req)
 
@@ -328,10 +340,20 @@ func (c *Client) GetUser(ctx context.Context, userRef string) (*cstypes.User, *h
 	return user, resp, errors.WithStack(err)
 }
 
-func (c *Client) GetUserByToken(ctx context.Context, token string) (*cstypes.User, *http.Response, error) {
+// GetUserByToken returns the user owning the provided token. When markUsed is
+// true the token last used time is updated.
+// GetUserByToken returns the user owning the token. When markUsed is true the
+// token is marked as used by the client with the provided ip.
+func (c *Client) GetUserByToken(ctx context.Context, token string, markUsed bool, usedIP string) (*cstypes.User, *http.Response, error) {
 	q := url.Values{}
 	q.Add("query_type", "bytoken")
 	q.Add("token", token)
+	if markUsed {
+		q.Add("mark_used", "")
+		if usedIP != "" {
+			q.Add("used_ip", usedIP)
+		}
+	}
 
 	users := []*cstypes.User{}
 	resp, err := c.getParsedResponse(ctx, "GET", "/users", q, jsonContent, nil, &users)
@@ -411,6 +433,26 @@ func (c *Client) GetUsers(ctx context.Context, start string, limit int, asc bool
 	return users, resp, errors.WithStack(err)
 }
 
+// GetRemoteSourceUsers returns the users with a linked account on the
+// provided remote source.
+func (c *Client) GetRemoteSourceUsers(ctx context.Context, remoteSourceRef, start string, limit int, asc bool) ([]*cstypes.User, *http.Response, error) {
+	q := url.Values{}
+	q.Add("remotesource", remoteSourceRef)
+	if start != "" {
+		q.Add("start", start)
+	}
+	if limit > 0 {
+		q.Add("limit", strconv.Itoa(limit))
+	}
+	if asc {
+		q.Add("asc", "")
+	}
+
+	users := []*cstypes.User{}
+	resp, err := c.getParsedResponse(ctx, "GET", "/users", q, jsonContent, nil, &users)
+	return users, resp, errors.WithStack(err)
+}
+
 func (c *Client) GetUserLinkedAccounts(ctx context.Context, userRef string) ([]*cstypes.LinkedAccount, *http.Response, error) {
 	linkedAccounts := []*cstypes.LinkedAccount{}
 	resp, err := c.getParsedResponse(ctx, "GET", fmt.Sprintf("/users/%s/linkedaccounts", userRef), nil, jsonContent, nil, &linkedAccounts)
@@ -443,6 +485,22 @@ func (c *Client) UpdateUserLA(ctx context.Context, userRef, laID string, req *cs
 	return la, resp, errors.WithStack(err)
 }
 
+func (c *Client) RefreshUserLAOauth2Token(ctx context.Context, userRef, laID string, req *csapitypes.RefreshUserLAOauth2TokenRequest) (*cstypes.LinkedAccount, *http.Response, error) {
+	reqj, err := json.Marshal(req)
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+
+	la := new(cstypes.LinkedAccount)
+	resp, err := c.getParsedResponse(ctx, "PUT", fmt.Sprintf("/users/%s/linkedaccounts/%s/oauth2token", userRef, laID), nil, jsonContent, bytes.NewReader(reqj), la)
+	return la, resp, errors.WithStack(err)
+}
+
+// MarkUserLAUsed records the linked account use setting its last used time.
+func (c *Client) MarkUserLAUsed(ctx context.Context, userRef, laID string) (*http.Response, error) {
+	return c.getResponse(ctx, "PUT", fmt.Sprintf("/users/%s/linkedaccounts/%s/lastused", userRef, laID), nil, jsonContent, nil)
+}
+
 func (c *Client) GetUserTokens(ctx context.Context, userRef string) ([]*cstypes.UserToken, *http.Response, error) {
 	tokens := []*cstypes.UserToken{}
 	resp, err := c.getParsedResponse(ctx, "GET", fmt.Sprintf("/users/%s/tokens", userRef), nil, jsonContent, nil, &tokens)
@@ -460,6 +518,17 @@ func (c *Client) CreateUserToken(ctx context.Context, userRef string, req *csapi
 	return tresp, resp, errors.WithStack(err)
 }
 
+func (c *Client) UpdateUserToken(ctx context.Context, userRef, tokenName string, req *csapitypes.UpdateUserTokenRequest) (*cstypes.UserToken, *http.Response, error) {
+	reqj, err := json.Marshal(req)
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+
+	token := new(cstypes.UserToken)
+	resp, err := c.getParsedResponse(ctx, "PUT", fmt.Sprintf("/users/%s/tokens/%s", userRef, tokenName), nil, jsonContent, bytes.NewReader(reqj), token)
+	return token, resp, errors.WithStack(err)
+}
+
 func (c *Client) DeleteUserToken(ctx context.Context, userRef, tokenName string) (*http.Response, error) {
 	return c.getResponse(ctx, "DELETE", fmt.Sprintf("/users/%s/tokens/%s", userRef, tokenName), nil, jsonContent, nil)
 }
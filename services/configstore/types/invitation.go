@@ -15,6 +15,8 @@
 package types
 
 import (
+	"time"
+
 	"agola.io/agola/internal/sql"
 	stypes "agola.io/agola/services/types"
 	"github.com/gofrs/uuid"
@@ -32,6 +34,18 @@ type OrgInvitation struct {
 	UserID         string     `json:"userId,omitempty"`
 	OrganizationID string     `json:"organizationId,omitempty"`
 	Role           MemberRole `json:"role,omitempty"`
+
+	// Token is set on invitations for users that don't exist yet. The
+	// invitation is consumed when the user is created using this token.
+	Token string `json:"token,omitempty"`
+	// ExpirationTime, when set, is the time after which the invitation isn't
+	// valid anymore
+	ExpirationTime *time.Time `json:"expirationTime,omitempty"`
+}
+
+// IsExpired reports if the invitation is expired at the provided time
+func (i *OrgInvitation) IsExpired(now time.Time) bool {
+	return i.ExpirationTime != nil && !now.Before(*i.ExpirationTime)
 }
 
 func NewOrgInvitation(tx *sql.Tx) *OrgInvitation {
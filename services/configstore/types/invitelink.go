@@ -0,0 +1,64 @@
+// Copyright 2022 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"time"
+
+	"agola.io/agola/internal/sql"
+	stypes "agola.io/agola/services/types"
+	"github.com/gofrs/uuid"
+)
+
+const (
+	OrgInviteLinkKind    = "orginvitelink"
+	OrgInviteLinkVersion = "v0.1.0"
+)
+
+// OrgInviteLink is a shareable org invitation. Unlike an OrgInvitation it
+// isn't bound to a user: every user providing its token is added to the org
+// with the link role until the link uses are exhausted.
+type OrgInviteLink struct {
+	stypes.TypeMeta
+	stypes.ObjectMeta
+
+	OrganizationID string     `json:"organizationId,omitempty"`
+	Role           MemberRole `json:"role,omitempty"`
+
+	Token string `json:"token,omitempty"`
+	// RemainingUses is the number of times the link can still be redeemed
+	RemainingUses int `json:"remainingUses,omitempty"`
+	// ExpirationTime, when set, is the time after which the link isn't valid
+	// anymore
+	ExpirationTime *time.Time `json:"expirationTime,omitempty"`
+}
+
+// IsExpired reports if the invite link is expired at the provided time
+func (l *OrgInviteLink) IsExpired(now time.Time) bool {
+	return l.ExpirationTime != nil && !now.Before(*l.ExpirationTime)
+}
+
+func NewOrgInviteLink(tx *sql.Tx) *OrgInviteLink {
+	return &OrgInviteLink{
+		TypeMeta: stypes.TypeMeta{
+			Kind:    OrgInviteLinkKind,
+			Version: OrgInviteLinkVersion,
+		},
+		ObjectMeta: stypes.ObjectMeta{
+			ID:   uuid.Must(uuid.NewV4()).String(),
+			TxID: tx.ID(),
+		},
+	}
+}
@@ -37,6 +37,9 @@ type Organization struct {
 	// CreatorUserID is the user id that created the organization. It could be empty
 	// if the org was created by using the admin user or the user has been removed.
 	CreatorUserID string `json:"creator_user_id,omitempty"`
+
+	// MaxMembers, when > 0, is the maximum number of org members
+	MaxMembers int `json:"max_members,omitempty"`
 }
 
 func NewOrganization(tx *sql.Tx) *Organization {
@@ -33,6 +33,17 @@ const (
 	RemoteSourceTypeGitlab RemoteSourceType = "gitlab"
 )
 
+func IsValidRemoteSourceType(t RemoteSourceType) bool {
+	switch t {
+	case RemoteSourceTypeGitea:
+	case RemoteSourceTypeGithub:
+	case RemoteSourceTypeGitlab:
+	default:
+		return false
+	}
+	return true
+}
+
 type RemoteSourceAuthType string
 
 const (
@@ -62,6 +62,18 @@ func IsValidMemberRole(r MemberRole) bool {
 	return true
 }
 
+// MemberRolesAtLeast returns the member roles with the same or more privileges
+// than the provided role
+func MemberRolesAtLeast(r MemberRole) []MemberRole {
+	switch r {
+	case MemberRoleOwner:
+		return []MemberRole{MemberRoleOwner}
+	case MemberRoleMember:
+		return []MemberRole{MemberRoleOwner, MemberRoleMember}
+	}
+	return nil
+}
+
 type Parent struct {
 	Kind ObjectKind `json:"type,omitempty"`
 	ID   string     `json:"id,omitempty"`
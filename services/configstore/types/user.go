@@ -34,12 +34,31 @@ type User struct {
 
 	Name string `json:"name,omitempty"`
 
+	// Email is the optional user email address. It's unique between all the
+	// users, compared case insensitively.
+	Email string `json:"email,omitempty"`
+
 	// Secret is a secret that could be used for signing or other purposes. It
 	// should never be directly exposed to external services
 	Secret string `json:"secret,omitempty"`
 
 	// Admin defines if the user is a global admin
 	Admin bool `json:"admin,omitempty"`
+
+	// Disabled defines if the user is suspended. A disabled user cannot
+	// authenticate and its tokens are rejected.
+	Disabled bool `json:"disabled,omitempty"`
+
+	// DeletedAt is the time the user was soft deleted (archived). A soft
+	// deleted user is kept to preserve its history but it's hidden by
+	// default, cannot authenticate and its tokens and linked accounts are
+	// deactivated.
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+}
+
+// IsDeleted reports if the user is soft deleted
+func (u *User) IsDeleted() bool {
+	return u.DeletedAt != nil
 }
 
 func NewUser(tx *sql.Tx) *User {
@@ -64,10 +83,65 @@ type UserToken struct {
 	stypes.TypeMeta
 	stypes.ObjectMeta
 
-	Name  string `json:"name,omitempty"`
+	Name string `json:"name,omitempty"`
+	// Value is the plaintext token value of legacy tokens created before
+	// token values were stored hashed. It's empty for all the other tokens.
+	//
+	// Deprecated: use ValueHash.
 	Value string `json:"value,omitempty"`
+	// ValueHash is the hex encoded sha256 hash of the token value. The
+	// plaintext value is returned only at token creation.
+	ValueHash string `json:"value_hash,omitempty"`
+	// NeedsRotation reports that the token was migrated from a legacy
+	// plaintext token and should be replaced by a new one.
+	NeedsRotation bool `json:"needs_rotation,omitempty"`
 
 	UserID string `json:"user_id,omitempty"`
+
+	// LastUsedAt is the last time the token was used
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	// LastUsedIP is the client ip address of the use recorded in LastUsedAt
+	LastUsedIP string `json:"last_used_ip,omitempty"`
+
+	// ExpiresAt is the optional token expiration time. Expired tokens are
+	// rejected but not deleted.
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+
+	// Scopes restricts what the token can do. A token without scopes isn't
+	// restricted.
+	Scopes []string `json:"scopes,omitempty"`
+}
+
+// IsExpired reports if the token is expired at the provided time
+func (t *UserToken) IsExpired(now time.Time) bool {
+	return t.ExpiresAt != nil && !now.Before(*t.ExpiresAt)
+}
+
+const (
+	UserTokenScopeUserRead     = "user:read"
+	UserTokenScopeUserWrite    = "user:write"
+	UserTokenScopeOrgRead      = "org:read"
+	UserTokenScopeOrgWrite     = "org:write"
+	UserTokenScopeProjectRead  = "project:read"
+	UserTokenScopeProjectWrite = "project:write"
+	UserTokenScopeRunRead      = "run:read"
+	UserTokenScopeRunWrite     = "run:write"
+)
+
+func IsValidUserTokenScope(scope string) bool {
+	switch scope {
+	case UserTokenScopeUserRead:
+	case UserTokenScopeUserWrite:
+	case UserTokenScopeOrgRead:
+	case UserTokenScopeOrgWrite:
+	case UserTokenScopeProjectRead:
+	case UserTokenScopeProjectWrite:
+	case UserTokenScopeRunRead:
+	case UserTokenScopeRunWrite:
+	default:
+		return false
+	}
+	return true
 }
 
 func NewUserToken(tx *sql.Tx) *UserToken {
@@ -105,6 +179,9 @@ type LinkedAccount struct {
 	Oauth2AccessToken          string    `json:"oauth2_access_token,omitempty"`
 	Oauth2RefreshToken         string    `json:"oauth2_refresh_token,omitempty"`
 	Oauth2AccessTokenExpiresAt time.Time `json:"oauth_2_access_token_expires_at,omitempty"`
+
+	// LastUsedAt is the last time the linked account was used to login
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
 }
 
 func NewLinkedAccount(tx *sql.Tx) *LinkedAccount {
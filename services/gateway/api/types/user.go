@@ -14,6 +14,8 @@
 
 package types
 
+import "time"
+
 type LinkedAccount struct {
 	ID string `json:"id,omitempty"`
 
@@ -59,11 +61,15 @@ type CreateUserLAResponse struct {
 }
 
 type CreateUserTokenRequest struct {
-	TokenName string `json:"token_name"`
+	TokenName string     `json:"token_name"`
+	ExpiresAt *time.Time `json:"expires_at"`
+	Scopes    []string   `json:"scopes"`
 }
 
 type CreateUserTokenResponse struct {
-	Token string `json:"token"`
+	Token     string     `json:"token"`
+	ExpiresAt *time.Time `json:"expires_at"`
+	Scopes    []string   `json:"scopes"`
 }
 
 type RegisterUserRequest struct {
@@ -374,6 +374,26 @@ func (c *Client) GetUsers(ctx context.Context, start string, limit int, asc bool
 	return users, resp, errors.WithStack(err)
 }
 
+// GetRemoteSourceUsers returns the users with a linked account on the
+// provided remote source.
+func (c *Client) GetRemoteSourceUsers(ctx context.Context, remoteSourceRef, start string, limit int, asc bool) ([]*gwapitypes.PrivateUserResponse, *http.Response, error) {
+	q := url.Values{}
+	q.Add("remotesource", remoteSourceRef)
+	if start != "" {
+		q.Add("start", start)
+	}
+	if limit > 0 {
+		q.Add("limit", strconv.Itoa(limit))
+	}
+	if asc {
+		q.Add("asc", "")
+	}
+
+	users := []*gwapitypes.PrivateUserResponse{}
+	resp, err := c.getParsedResponse(ctx, "GET", "/users", q, jsonContent, nil, &users)
+	return users, resp, errors.WithStack(err)
+}
+
 func (c *Client) GetUserByLinkedAccountRemoteUserAndSource(ctx context.Context, remoteUserID, remoteSourceRef string) (*gwapitypes.PrivateUserResponse, *http.Response, error) {
 	q := url.Values{}
 	q.Add("query_type", "byremoteuser")